@@ -0,0 +1,1260 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AOF persistence: every command changing the dataset is appended to the
+// append only file in the protocol format, as call propagates it. The
+// commands are buffered in aofBuf while the event loop runs them, and
+// written by beforeSleep before their replies are sent, so a client never
+// sees the reply of a write the file misses.
+//
+// appendfsync picks when the file is fsynced: always before the replies,
+// everysec from a background goroutine of the bio pool once a second, at
+// most one at a time, or never leaving it to the kernel.
+//
+// The AOF is made of several files in appenddirname, listed by a manifest:
+// the base, the dataset saved in the RDB format when the AOF was last
+// rewritten, then the incr files of the commands run since, in order. A
+// rewrite, BGREWRITEAOF or the automatic one once the AOF grew by
+// auto-aof-rewrite-percentage, switches the commands to a new incr file,
+// and a goroutine saves a snapshot of the dataset, copied on write like the
+// one of BGSAVE. Once done, serverCron makes the file saved the new base in
+// a new manifest, renamed over the old one, and the files replaced are
+// deleted in the background.
+//
+// The files are loaded at startup in place of the rdb, the commands being
+// run by a fake client. A command cut by a crash at the end of the last
+// file is truncated away with aof-load-truncated.
+
+const (
+	aofOff = iota
+	aofOn
+	aofWaitRewrite // turned on, waiting for the rewrite writing its base
+)
+
+// the kinds of files of the manifest
+const (
+	aofManifestTypeBase = "b"
+	aofManifestTypeHist = "h"
+	aofManifestTypeIncr = "i"
+)
+
+const (
+	aofBaseFileSuffix     = ".base"
+	aofIncrFileSuffix     = ".incr"
+	aofRdbFormatSuffix    = ".rdb"
+	aofFormatSuffix       = ".aof"
+	aofManifestNameSuffix = ".manifest"
+	aofTempFilePrefix     = "temp-"
+)
+
+// after a failed automatic rewrite, the next one waits this long
+const aofRewriteRetryDelay = time.Minute
+
+// appendfsync policies
+const (
+	aofFsyncNo = iota
+	aofFsyncAlways
+	aofFsyncEverysec
+)
+
+var aofFsyncEnum = []configEnum{
+	{"no", aofFsyncNo},
+	{"always", aofFsyncAlways},
+	{"everysec", aofFsyncEverysec},
+}
+
+// the same write error is logged once in a while only
+const aofWriteLogErrorRate = 30 * time.Second
+
+var (
+	errAofTruncated = errors.New("unexpected end of file")
+	errAofBadFormat = errors.New("bad file format")
+)
+
+// aofBioFsync is the state of the fsyncs run by the bio pool.
+type aofBioFsync struct {
+	mu         sync.Mutex
+	inProgress bool
+	offset     int64 // the AOF size known to be on disk
+	reploff    int64 // the replication offset known to be on disk, see WAITAOF
+	err        error // error of the last fsync, nil once one succeeds
+	jobs       sync.WaitGroup
+}
+
+// aofChild is the rewrite in progress, saving the base to tmpfile.
+type aofChild struct {
+	start   time.Time
+	tmpfile string
+	abort   atomic.Bool
+	done    chan error
+}
+
+func aofDirPath() string {
+	return filepath.Join(rServer.dir, rServer.aofDirname)
+}
+
+func aofFilePath(name string) string {
+	return filepath.Join(aofDirPath(), name)
+}
+
+// aofTempIncrName is the incr file written while the AOF waits for its
+// first base, it is listed in the manifest once the base is.
+func aofTempIncrName() string {
+	return aofTempFilePrefix + rServer.aofFilename + aofIncrFileSuffix
+}
+
+// catAppendOnlyGenericCommand appends argv to buf in the protocol format.
+func catAppendOnlyGenericCommand(buf []byte, argv []*rObj) []byte {
+
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(argv)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, o := range argv {
+		arg := o.bytes()
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+
+}
+
+// feedAppendOnlyFile buffers a command propagated, preceded by a SELECT
+// when it runs in another db than the last one.
+func feedAppendOnlyFile(dbid int, argv []*rObj) {
+
+	// the rewrite yet to start saves these changes in the base
+	if rServer.aofState == aofWaitRewrite && rServer.aofChild == nil {
+		return
+	}
+
+	if dbid != -1 && dbid != rServer.aofSelectedDb {
+		rServer.aofBuf = catAppendOnlyGenericCommand(rServer.aofBuf, []*rObj{
+			createEmbeddedStringObject("SELECT"), createStringObjectFromLongLong(int64(dbid)),
+		})
+		rServer.aofSelectedDb = dbid
+	}
+	rServer.aofBuf = catAppendOnlyGenericCommand(rServer.aofBuf, argv)
+
+}
+
+// aofFsyncedOffset returns the size of the AOF known to be on disk.
+func aofFsyncedOffset() int64 {
+	bio := &rServer.aofBio
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	return bio.offset
+}
+
+// aofWriteStatus returns the error writes are refused with, the AOF can't
+// be written or fsynced.
+func aofWriteStatus() error {
+
+	if rServer.aofState == aofOff {
+		return nil
+	}
+	if rServer.aofLastWriteStatus != nil {
+		return rServer.aofLastWriteStatus
+	}
+	bio := &rServer.aofBio
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	return bio.err
+
+}
+
+// aofBackgroundFsync fsyncs the AOF, offset bytes long with the stream up
+// to reploff, from the bio pool.
+func aofBackgroundFsync(offset, reploff int64) {
+
+	bio := &rServer.aofBio
+	f := rServer.aofFile
+	bio.mu.Lock()
+	bio.inProgress = true
+	bio.mu.Unlock()
+	bio.jobs.Add(1)
+
+	job := func() {
+		err := f.Sync()
+		bio.mu.Lock()
+		if err == nil && offset > bio.offset {
+			bio.offset = offset
+		}
+		if err == nil && reploff > bio.reploff {
+			bio.reploff = reploff
+		}
+		bio.err = err
+		bio.inProgress = false
+		bio.mu.Unlock()
+		bio.jobs.Done()
+	}
+	if err := rServer.bioPool.submitTask(job); err != nil {
+		job()
+	}
+
+}
+
+func aofBioFsyncInProgress() bool {
+	bio := &rServer.aofBio
+	bio.mu.Lock()
+	defer bio.mu.Unlock()
+	return bio.inProgress
+}
+
+// aofFsync fsyncs the AOF from the event loop, after the background fsync
+// in progress if any.
+func aofFsync() error {
+
+	bio := &rServer.aofBio
+	bio.jobs.Wait()
+	err := rServer.aofFile.Sync()
+	bio.mu.Lock()
+	if err == nil {
+		bio.offset = rServer.aofCurrentSize
+		bio.reploff = max(bio.reploff, rServer.masterReplOffset)
+	}
+	bio.err = err
+	bio.mu.Unlock()
+	rServer.aofLastFsync = time.Now()
+	return err
+
+}
+
+// flushAppendOnlyFile writes the commands buffered to the AOF and fsyncs it
+// as appendfsync asks. force fsyncs it right away whatever the policy, e.g.
+// at shutdown.
+func flushAppendOnlyFile(force bool) {
+
+	if rServer.aofState == aofOff || rServer.aofFile == nil {
+		return
+	}
+
+	if len(rServer.aofBuf) > 0 {
+		n, err := rServer.aofFile.Write(rServer.aofBuf)
+		if err != nil {
+			aofWriteError(n, err)
+			return
+		}
+		rServer.aofCurrentSize += int64(n)
+		rServer.aofLastIncrSize += int64(n)
+		if rServer.aofLastWriteStatus != nil {
+			Log("AOF write error looks solved, the server can write again.")
+			rServer.aofLastWriteStatus = nil
+		}
+		// a big buffer is not kept around
+		if cap(rServer.aofBuf) > 4000 {
+			rServer.aofBuf = nil
+		} else {
+			rServer.aofBuf = rServer.aofBuf[:0]
+		}
+	}
+
+	// nothing to fsync, unless the last fsync failed: the stream so far is
+	// on disk
+	if aofFsyncedOffset() == rServer.aofCurrentSize && aofWriteStatus() == nil {
+		bio := &rServer.aofBio
+		bio.mu.Lock()
+		bio.reploff = max(bio.reploff, rServer.masterReplOffset)
+		bio.mu.Unlock()
+		return
+	}
+
+	switch {
+	case force || rServer.aofFsync == aofFsyncAlways:
+		if err := aofFsync(); err != nil {
+			Log("Can't persist AOF for fsync error: %v", err)
+			if !force {
+				Log("The AOF fsync policy is 'always', exiting...")
+				os.Exit(1)
+			}
+		}
+	case rServer.aofFsync == aofFsyncEverysec:
+		if time.Since(rServer.aofLastFsync) >= time.Second && !aofBioFsyncInProgress() {
+			aofBackgroundFsync(rServer.aofCurrentSize, rServer.masterReplOffset)
+			rServer.aofLastFsync = time.Now()
+		}
+	}
+
+}
+
+// updateFsyncedReploff publishes the replication offset fsynced, once the
+// AOF has its base, and serves the clients in WAITAOF it satisfies. A
+// replica tells its master right away.
+func updateFsyncedReploff() {
+
+	if rServer.aofState != aofOn {
+		return
+	}
+	bio := &rServer.aofBio
+	bio.mu.Lock()
+	reploff := bio.reploff
+	bio.mu.Unlock()
+	if reploff == rServer.fsyncedReploff {
+		return
+	}
+
+	rServer.fsyncedReploff = reploff
+	if rServer.clientsWaitingAcks.Len() > 0 {
+		processClientsWaitingReplicas()
+	}
+	if rServer.masterhost != "" && rServer.master != nil {
+		replicationSendAck()
+	}
+
+}
+
+// aofWriteError handles the failed write of aofBuf, the buffer is written
+// again on the next flush. A partial write is truncated away, the file
+// can't end with half a command.
+func aofWriteError(n int, err error) {
+
+	if n > 0 {
+		if terr := rServer.aofFile.Truncate(rServer.aofLastIncrSize); terr != nil {
+			// what was written stays, and is no longer to write
+			Log("Could not remove short write from the append-only file, %v", terr)
+			rServer.aofCurrentSize += int64(n)
+			rServer.aofLastIncrSize += int64(n)
+			rServer.aofBuf = append(rServer.aofBuf[:0], rServer.aofBuf[n:]...)
+		}
+	}
+
+	if rServer.aofFsync == aofFsyncAlways {
+		Log("Can't recover from AOF write error when the AOF fsync policy is 'always', %v. Exiting...", err)
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	if now.Sub(rServer.aofLastWriteErrorLog) > aofWriteLogErrorRate {
+		Log("Error writing to the AOF file, %v", err)
+		rServer.aofLastWriteErrorLog = now
+	}
+	rServer.aofLastWriteStatus = err
+
+}
+
+// aofCloseFile closes the incr file the commands were appended to, after
+// the background fsync in progress.
+func aofCloseFile() {
+
+	if rServer.aofFile == nil {
+		return
+	}
+	rServer.aofBio.jobs.Wait()
+	_ = rServer.aofFile.Close()
+	rServer.aofFile = nil
+
+}
+
+// aofOpenIncrFile opens the incr file name to append the commands to it.
+func aofOpenIncrFile(name string, flag int) (*os.File, error) {
+
+	f, err := os.OpenFile(aofFilePath(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE|flag, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("can't open the append-only file %s, %w", name, err)
+	}
+	return f, nil
+
+}
+
+// aofSwitchIncrFile makes f the file the commands are appended to.
+func aofSwitchIncrFile(f *os.File) {
+
+	aofCloseFile()
+	rServer.aofFile = f
+	rServer.aofLastIncrSize = 0
+	if info, err := f.Stat(); err == nil {
+		rServer.aofLastIncrSize = info.Size()
+	}
+	// every file starts in db 0 when loaded
+	rServer.aofSelectedDb = -1
+
+}
+
+// openNewIncrAofForAppend switches the commands to a new incr file, when a
+// rewrite starts. The file is listed in the manifest right away, unless the
+// AOF waits for its first base.
+func openNewIncrAofForAppend() error {
+
+	if rServer.aofState == aofOff {
+		return nil
+	}
+
+	if rServer.aofState == aofWaitRewrite {
+		f, err := aofOpenIncrFile(aofTempIncrName(), os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		aofSwitchIncrFile(f)
+		return nil
+	}
+
+	am := rServer.aofManifest.dup()
+	name := am.newIncrFile()
+	f, err := aofOpenIncrFile(name, os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if err := persistAofManifest(am); err != nil {
+		_ = f.Close()
+		_ = os.Remove(aofFilePath(name))
+		return err
+	}
+	rServer.aofManifest = am
+	aofSwitchIncrFile(f)
+	return nil
+
+}
+
+// aofUpdateCurrentSize sets the size of the AOF from the files listed, all
+// on disk.
+func aofUpdateCurrentSize() {
+
+	am := rServer.aofManifest
+	var size int64
+	infos := am.incrs
+	if am.base != nil {
+		infos = append([]*aofInfo{am.base}, infos...)
+	}
+	for _, info := range infos {
+		if fi, err := os.Stat(aofFilePath(info.filename)); err == nil {
+			size += fi.Size()
+		}
+	}
+	rServer.aofCurrentSize = size
+	rServer.aofRewriteBaseSize = size
+	bio := &rServer.aofBio
+	bio.mu.Lock()
+	bio.offset, bio.err = size, nil
+	bio.reploff = rServer.masterReplOffset
+	bio.mu.Unlock()
+
+}
+
+// aofOpenIfNeededOnServerStart opens the last incr file of the AOF loaded
+// at startup, a new one when there is none. Without AOF files yet the
+// dataset, loaded from the rdb, is saved as the base first.
+func aofOpenIfNeededOnServerStart() error {
+
+	if err := os.MkdirAll(aofDirPath(), 0o755); err != nil {
+		return fmt.Errorf("can't create the AOF dir, %w", err)
+	}
+
+	am := rServer.aofManifest.dup()
+	if am.base == nil && len(am.incrs) == 0 {
+		name := am.newBaseFile()
+		tmpfile := aofFilePath(fmt.Sprintf("%srewriteaof-%d%s", aofTempFilePrefix, os.Getpid(), aofFormatSuffix))
+		snap := rdbSnapshotDataset(false)
+		snap.aofBase = true
+		if err := rdbSaveFile(snap, aofFilePath(name), tmpfile, nil); err != nil {
+			return fmt.Errorf("can't write the AOF base, %w", err)
+		}
+		Log("Creating AOF base file %s on server start", name)
+	}
+
+	var name string
+	if len(am.incrs) > 0 {
+		name = am.incrs[len(am.incrs)-1].filename
+	} else {
+		name = am.newIncrFile()
+		Log("Creating AOF incr file %s on server start", name)
+	}
+	f, err := aofOpenIncrFile(name, 0)
+	if err != nil {
+		return err
+	}
+	if err := persistAofManifest(am); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	aofSwitchIncrFile(f)
+	rServer.aofManifest = am
+	rServer.aofState = aofOn
+	rServer.aofLastFsync = time.Now()
+	aofUpdateCurrentSize()
+	return nil
+
+}
+
+// startAppendOnly turns the AOF on, it waits for a rewrite saving its base
+// before it is on.
+func startAppendOnly() error {
+
+	if err := os.MkdirAll(aofDirPath(), 0o755); err != nil {
+		Log("Can't create the AOF dir, %v", err)
+		return err
+	}
+
+	rServer.aofState = aofWaitRewrite
+	rServer.aofLastWriteStatus = nil
+	// the size counts the temp incr file until the base is written
+	rServer.aofCurrentSize = 0
+	bio := &rServer.aofBio
+	bio.mu.Lock()
+	// the base saves the dataset up to here
+	bio.offset, bio.err = 0, nil
+	bio.reploff = rServer.masterReplOffset
+	bio.mu.Unlock()
+	if rServer.rdbChild != nil {
+		rServer.aofRewriteScheduled = true
+		Log("AOF was enabled but there is already a BGSAVE in progress, an AOF rewrite is scheduled")
+	} else {
+		if rServer.aofChild != nil {
+			Log("AOF was enabled but there is already an AOF rewrite in progress, restarting it")
+			killAppendOnlyChild()
+		}
+		if err := rewriteAppendOnlyFileBackground(); err != nil {
+			aofCloseFile()
+			rServer.aofState = aofOff
+			rServer.aofRewriteScheduled = false
+			return err
+		}
+	}
+	rServer.aofLastFsync = time.Now()
+	return nil
+
+}
+
+// stopAppendOnly turns the AOF off, the commands buffered are written and
+// fsynced first. The rewrite in progress is stopped.
+func stopAppendOnly() {
+
+	flushAppendOnlyFile(true)
+	killAppendOnlyChild()
+	aofCloseFile()
+	if rServer.aofState == aofWaitRewrite {
+		_ = os.Remove(aofFilePath(aofTempIncrName()))
+	}
+	rServer.aofState = aofOff
+	rServer.aofBuf = nil
+	rServer.aofRewriteScheduled = false
+	rServer.fsyncedReploff = -1
+	Log("AOF turned off")
+
+}
+
+// updateAppendonly applies CONFIG SET appendonly.
+func updateAppendonly() error {
+
+	if rServer.aofEnabled && rServer.aofState == aofOff {
+		return startAppendOnly()
+	}
+	if !rServer.aofEnabled && rServer.aofState != aofOff {
+		stopAppendOnly()
+	}
+	return nil
+
+}
+
+func getAppendfilenameConfig() string {
+	return rServer.aofFilename
+}
+
+func setAppendfilenameConfig(val string) error {
+	if val == "" || strings.ContainsRune(val, '/') {
+		return errors.New("appendfilename can't be a path, just a filename")
+	}
+	rServer.aofFilename = val
+	return nil
+}
+
+func getAppenddirnameConfig() string {
+	return rServer.aofDirname
+}
+
+func setAppenddirnameConfig(val string) error {
+	if val == "" || strings.ContainsRune(val, '/') {
+		return errors.New("appenddirname can't be a path, just a dirname")
+	}
+	rServer.aofDirname = val
+	return nil
+}
+
+// aofReader reads the commands of an AOF, offset being what was read so
+// far.
+type aofReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+// readLine reads a line ending with CRLF, without the CRLF.
+func (ar *aofReader) readLine() ([]byte, error) {
+
+	line, err := ar.r.ReadSlice('\n')
+	ar.offset += int64(len(line))
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil, errAofTruncated
+	case err != nil:
+		return nil, errAofBadFormat
+	case len(line) < 3 || line[len(line)-2] != '\r':
+		return nil, errAofBadFormat
+	}
+	return line[:len(line)-2], nil
+
+}
+
+// readCommand reads the next command, errAofTruncated means the file ends
+// in the middle of it.
+func (ar *aofReader) readCommand() ([]*rObj, error) {
+
+	line, err := ar.readLine()
+	if err != nil {
+		return nil, err
+	}
+	argc, ok := string2ll(line[1:])
+	if line[0] != '*' || !ok || argc < 1 {
+		return nil, errAofBadFormat
+	}
+
+	argv := make([]*rObj, 0, rdbSizeHint(uint64(argc)))
+	for j := int64(0); j < argc; j++ {
+		if line, err = ar.readLine(); err != nil {
+			return nil, err
+		}
+		l, ok := string2ll(line[1:])
+		if line[0] != '$' || !ok || l < 0 || l > maxBulkLen {
+			return nil, errAofBadFormat
+		}
+		buf := make([]byte, l+2)
+		n, err := io.ReadFull(ar.r, buf)
+		ar.offset += int64(n)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errAofTruncated
+		} else if err != nil {
+			return nil, err
+		}
+		if buf[l] != '\r' || buf[l+1] != '\n' {
+			return nil, errAofBadFormat
+		}
+		argv = append(argv, createStringObject(buf[:l:l]))
+	}
+	return argv, nil
+
+}
+
+// createAOFClient returns the client running the commands of the AOF, its
+// replies are discarded and it can't block.
+func createAOFClient() *client {
+	return &client{
+		id:            -1,
+		fd:            -1,
+		db:            rServer.db[0],
+		resp:          2,
+		authenticated: true,
+		flag:          clientDenyBlocking,
+	}
+}
+
+// loadSingleAppendOnlyFile runs the commands of the AOF file filename,
+// after loading its RDB preamble if any. Only the last file may end with a
+// partial command.
+func loadSingleAppendOnlyFile(filename string, last bool) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ar := &aofReader{r: bufio.NewReaderSize(f, 64*1024)}
+	if sig, _ := ar.r.Peek(5); string(sig) == "REDIS" {
+		if err := rdbLoadRio(&rdbReader{r: ar.r}, rServer.db); err != nil {
+			return fmt.Errorf("error reading the RDB preamble of the AOF file, %w", err)
+		}
+		pos, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		ar.offset = pos - int64(ar.r.Buffered())
+		Log("Reading RDB preamble from AOF file...")
+	}
+
+	fakeClient := createAOFClient()
+	// the offset after the last command read whole, and before the
+	// transaction read if any
+	validUpTo, validBeforeMulti := ar.offset, int64(-1)
+	commands := 0
+	for {
+		if _, err := ar.r.Peek(1); errors.Is(err, io.EOF) {
+			break
+		}
+		argv, err := ar.readCommand()
+		if errors.Is(err, errAofTruncated) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w reading the append only file %s at offset %d", err, filename, validUpTo)
+		}
+
+		cmd := lookupCommand(argv[0].bytes())
+		if cmd == nil {
+			return fmt.Errorf("unknown command '%s' reading the append only file %s", argv[0].String(), filename)
+		}
+		if (cmd.arity > 0 && cmd.arity != len(argv)) || len(argv) < -cmd.arity {
+			return fmt.Errorf("command '%s' was called with the wrong number of arguments", cmd.name)
+		}
+		if cmd.name == "multi" {
+			validBeforeMulti = validUpTo
+		}
+
+		fakeClient.argv, fakeClient.argc, fakeClient.cmd = argv, len(argv), cmd
+		if fakeClient.flag&clientMulti != 0 && !commandRunsInMulti(cmd) {
+			queueMultiCommand(fakeClient)
+		} else {
+			call(fakeClient)
+		}
+		validUpTo = ar.offset
+		commands++
+	}
+
+	// a transaction without its EXEC was cut as well
+	if fakeClient.flag&clientMulti != 0 {
+		discardTransaction(fakeClient)
+		validUpTo = validBeforeMulti
+	}
+	if validUpTo < ar.offset {
+		if !last {
+			return fmt.Errorf("the truncated file %s is not the last file of the AOF", filename)
+		}
+		if err := aofTruncateTail(filename, validUpTo); err != nil {
+			return err
+		}
+	}
+	Log("Done loading the AOF file %s, %d commands", filepath.Base(filename), commands)
+	return nil
+
+}
+
+// aofTruncateTail handles an AOF ending with a partial command, what a crash
+// in the middle of a write leaves. With aof-load-truncated the file is
+// truncated to the last command read whole, and loaded up to it.
+func aofTruncateTail(filename string, offset int64) error {
+
+	Log("!!! Warning: short read while loading the AOF file %s!!!", filename)
+	if !rServer.aofLoadTruncated {
+		return errors.New("unexpected end of file reading the append only file, set aof-load-truncated " +
+			"to yes to load the file up to the last command read whole")
+	}
+	if err := os.Truncate(filename, offset); err != nil {
+		return fmt.Errorf("error truncating the AOF file, %w", err)
+	}
+	Log("AOF loaded anyway because aof-load-truncated is enabled, truncated to %d bytes", offset)
+	return nil
+
+}
+
+// aofInfo is a file of the AOF listed in the manifest.
+type aofInfo struct {
+	filename string
+	seq      int64
+	kind     string
+}
+
+// aofManifest lists the files of the AOF: the base, the incr files in the
+// order they were written, and the history files, replaced by a rewrite,
+// to delete.
+type aofManifest struct {
+	base        *aofInfo
+	incrs       []*aofInfo
+	history     []*aofInfo
+	currBaseSeq int64
+	currIncrSeq int64
+}
+
+// dup returns a copy of the manifest to change, made the manifest of the
+// server once saved.
+func (am *aofManifest) dup() *aofManifest {
+
+	cp := func(info *aofInfo) *aofInfo {
+		c := *info
+		return &c
+	}
+	dup := &aofManifest{currBaseSeq: am.currBaseSeq, currIncrSeq: am.currIncrSeq}
+	if am.base != nil {
+		dup.base = cp(am.base)
+	}
+	for _, info := range am.incrs {
+		dup.incrs = append(dup.incrs, cp(info))
+	}
+	for _, info := range am.history {
+		dup.history = append(dup.history, cp(info))
+	}
+	return dup
+
+}
+
+// newBaseFile adds a new base, the previous one becoming history, and
+// returns its name.
+func (am *aofManifest) newBaseFile() string {
+
+	if am.base != nil {
+		am.base.kind = aofManifestTypeHist
+		am.history = append(am.history, am.base)
+	}
+	am.currBaseSeq++
+	name := fmt.Sprintf("%s.%d%s%s", rServer.aofFilename, am.currBaseSeq, aofBaseFileSuffix, aofRdbFormatSuffix)
+	am.base = &aofInfo{filename: name, seq: am.currBaseSeq, kind: aofManifestTypeBase}
+	return name
+
+}
+
+// newIncrFile adds a new incr file after the others and returns its name.
+func (am *aofManifest) newIncrFile() string {
+
+	am.currIncrSeq++
+	name := fmt.Sprintf("%s.%d%s%s", rServer.aofFilename, am.currIncrSeq, aofIncrFileSuffix, aofFormatSuffix)
+	am.incrs = append(am.incrs, &aofInfo{filename: name, seq: am.currIncrSeq, kind: aofManifestTypeIncr})
+	return name
+
+}
+
+// markRewrittenIncrAsHistory makes history of the incr files whose
+// commands are in the new base, all but the last one with keepLast.
+func (am *aofManifest) markRewrittenIncrAsHistory(keepLast bool) {
+
+	n := len(am.incrs)
+	if keepLast && n > 0 {
+		n--
+	}
+	for _, info := range am.incrs[:n] {
+		info.kind = aofManifestTypeHist
+		am.history = append(am.history, info)
+	}
+	am.incrs = append([]*aofInfo(nil), am.incrs[n:]...)
+
+}
+
+// String formats the manifest the way it is saved, a line for each file:
+//
+//	file appendonly.aof.1.base.rdb seq 1 type b
+func (am *aofManifest) String() string {
+
+	var b strings.Builder
+	write := func(info *aofInfo) {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", catRepr(info.filename), info.seq, info.kind)
+	}
+	if am.base != nil {
+		write(am.base)
+	}
+	for _, info := range am.history {
+		write(info)
+	}
+	for _, info := range am.incrs {
+		write(info)
+	}
+	return b.String()
+
+}
+
+// the lines of the manifest are short, a longer line is a corrupted file
+const aofManifestMaxLine = 1024
+
+// aofLoadManifestFromFile parses the manifest filename.
+func aofLoadManifestFromFile(filename string) (*aofManifest, error) {
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	am := &aofManifest{}
+	lines := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) > aofManifestMaxLine {
+			return nil, errors.New("the AOF manifest file contains too long line")
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lines++
+
+		argv, ok := splitArgs([]byte(line))
+		if !ok || len(argv) < 6 || len(argv)%2 != 0 {
+			return nil, errors.New("invalid AOF manifest file format")
+		}
+		info := &aofInfo{}
+		for j := 0; j < len(argv); j += 2 {
+			val := string(argv[j+1])
+			switch strings.ToLower(string(argv[j])) {
+			case "file":
+				if strings.ContainsRune(val, '/') {
+					return nil, errors.New("file can't be a path, just a filename")
+				}
+				info.filename = val
+			case "seq":
+				info.seq, _ = strconv.ParseInt(val, 10, 64)
+			case "type":
+				info.kind = val
+			}
+			// unknown keys are kept for the versions to come
+		}
+		if info.filename == "" || info.seq <= 0 || info.kind == "" {
+			return nil, errors.New("invalid AOF manifest file format")
+		}
+
+		switch info.kind {
+		case aofManifestTypeBase:
+			if am.base != nil {
+				return nil, errors.New("found duplicate base file information")
+			}
+			am.base = info
+			am.currBaseSeq = info.seq
+		case aofManifestTypeHist:
+			am.history = append(am.history, info)
+		case aofManifestTypeIncr:
+			if info.seq <= am.currIncrSeq {
+				return nil, errors.New("found a non-monotonic sequence number")
+			}
+			am.incrs = append(am.incrs, info)
+			am.currIncrSeq = info.seq
+		default:
+			return nil, fmt.Errorf("unknown AOF file type %s", info.kind)
+		}
+	}
+
+	if lines == 0 {
+		return nil, errors.New("found an empty AOF manifest")
+	}
+	return am, nil
+
+}
+
+// aofLoadManifestFromDisk returns the manifest of the AOF dir, empty
+// without AOF files yet.
+func aofLoadManifestFromDisk() (*aofManifest, error) {
+
+	am, err := aofLoadManifestFromFile(aofFilePath(rServer.aofFilename + aofManifestNameSuffix))
+	if errors.Is(err, os.ErrNotExist) {
+		return &aofManifest{}, nil
+	}
+	return am, err
+
+}
+
+// persistAofManifest saves the manifest to a temp file renamed over the
+// manifest once synced, the switch to the files it lists is atomic.
+func persistAofManifest(am *aofManifest) error {
+
+	name := rServer.aofFilename + aofManifestNameSuffix
+	tmpfile := aofFilePath(aofTempFilePrefix + name)
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return fmt.Errorf("can't open the AOF manifest %s, %w", tmpfile, err)
+	}
+	_, err = f.WriteString(am.String())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, aofFilePath(name))
+	}
+	if err != nil {
+		_ = os.Remove(tmpfile)
+		return fmt.Errorf("can't persist the AOF manifest, %w", err)
+	}
+	fsyncFileDir(aofFilePath(name))
+	return nil
+
+}
+
+// aofUpgradePrepare moves an AOF of a single file, written before the AOF
+// had a manifest, into the AOF dir as its base.
+func aofUpgradePrepare() error {
+
+	if _, err := os.Stat(aofDirPath()); err == nil {
+		return nil
+	}
+	old := filepath.Join(rServer.dir, rServer.aofFilename)
+	if _, err := os.Stat(old); err != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(aofDirPath(), 0o755); err != nil {
+		return fmt.Errorf("can't create the AOF dir, %w", err)
+	}
+	am := &aofManifest{
+		base:        &aofInfo{filename: rServer.aofFilename, seq: 1, kind: aofManifestTypeBase},
+		currBaseSeq: 1,
+	}
+	if err := persistAofManifest(am); err != nil {
+		return err
+	}
+	if err := os.Rename(old, aofFilePath(rServer.aofFilename)); err != nil {
+		return fmt.Errorf("can't move the AOF file into the AOF dir, %w", err)
+	}
+	Log("Successfully migrated an old-style AOF into the AOF directory")
+	return nil
+
+}
+
+// loadAppendOnlyFiles loads the manifest of the AOF and runs its files, the
+// base then the incr files. The error wraps os.ErrNotExist when there is
+// no AOF yet.
+func loadAppendOnlyFiles() error {
+
+	if err := aofUpgradePrepare(); err != nil {
+		return err
+	}
+	am, err := aofLoadManifestFromDisk()
+	if err != nil {
+		return err
+	}
+	rServer.aofManifest = am
+
+	infos := am.incrs
+	if am.base != nil {
+		infos = append([]*aofInfo{am.base}, infos...)
+	}
+	if len(infos) == 0 {
+		return fmt.Errorf("no AOF files, %w", os.ErrNotExist)
+	}
+
+	start := time.Now()
+	for j, info := range infos {
+		path := aofFilePath(info.filename)
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("the AOF file %s listed in the manifest can't be read, %v", info.filename, err)
+		}
+		if err := loadSingleAppendOnlyFile(path, j == len(infos)-1); err != nil {
+			return err
+		}
+	}
+	Log("DB loaded from append only file: %.3f seconds", time.Since(start).Seconds())
+	if rServer.aofState == aofOn {
+		aofUpdateCurrentSize()
+	}
+	return nil
+
+}
+
+// rewriteAppendOnlyFileBackground starts a rewrite: the commands run from
+// now on go to a new incr file, and a goroutine saves the snapshot of the
+// dataset as the next base, see backgroundRewriteDoneHandler.
+func rewriteAppendOnlyFileBackground() error {
+
+	if hasActiveChildProcess() {
+		return errors.New("a background save or rewrite is already in progress")
+	}
+	rServer.aofRewriteScheduled = false
+	if err := os.MkdirAll(aofDirPath(), 0o755); err != nil {
+		Log("Can't create the AOF dir, %v", err)
+		return err
+	}
+
+	start := time.Now()
+	rServer.aofLastRewriteTry = start
+	flushAppendOnlyFile(true)
+	if err := openNewIncrAofForAppend(); err != nil {
+		Log("Can't open a new AOF incr file, %v", err)
+		rServer.aofLastBgrewriteStatus = err
+		return err
+	}
+
+	pid := os.Getpid()
+	child := &aofChild{
+		start:   start,
+		tmpfile: aofFilePath(fmt.Sprintf("%srewriteaof-bg-%d%s", aofTempFilePrefix, pid, aofFormatSuffix)),
+		done:    make(chan error, 1),
+	}
+	snap := rdbSnapshotDataset(true)
+	snap.aofBase = true
+	tmpfile := aofFilePath(fmt.Sprintf("%srewriteaof-%d%s", aofTempFilePrefix, pid, aofFormatSuffix))
+	go func() {
+		child.done <- rdbSaveFile(snap, child.tmpfile, tmpfile, &child.abort)
+	}()
+	rServer.aofChild = child
+	Log("Background append only file rewriting started, the dataset snapshot took %v", rServer.statSnapshotTime)
+	return nil
+
+}
+
+// backgroundRewriteDoneHandler installs the base saved by the rewrite once
+// the goroutine is done.
+func backgroundRewriteDoneHandler(child *aofChild, err error) {
+
+	rServer.aofChild = nil
+	rServer.aofRewriteTimeLast = time.Since(child.start)
+	if err == nil {
+		err = aofInstallRewrite(child)
+	}
+	if err != nil {
+		Log("Background AOF rewrite error, %v", err)
+		_ = os.Remove(child.tmpfile)
+		rServer.aofLastBgrewriteStatus = err
+		// the AOF turned on is on once a rewrite succeeds
+		if rServer.aofState == aofWaitRewrite {
+			rServer.aofRewriteScheduled = true
+		}
+		return
+	}
+
+	rServer.aofLastBgrewriteStatus = nil
+	rServer.statAofRewrites++
+	Log("Background AOF rewrite finished successfully")
+	aofDelHistoryFiles()
+
+}
+
+// aofInstallRewrite makes the file saved by the rewrite the base of the AOF
+// in a new manifest, the incr files whose commands it holds becoming
+// history.
+func aofInstallRewrite(child *aofChild) error {
+
+	am := rServer.aofManifest.dup()
+	base := am.newBaseFile()
+	am.markRewrittenIncrAsHistory(rServer.aofState == aofOn)
+	var incr string
+	if rServer.aofState == aofWaitRewrite {
+		incr = am.newIncrFile()
+	}
+
+	basePath := aofFilePath(base)
+	if err := os.Rename(child.tmpfile, basePath); err != nil {
+		return err
+	}
+	if incr != "" {
+		if err := os.Rename(aofFilePath(aofTempIncrName()), aofFilePath(incr)); err != nil {
+			_ = os.Remove(basePath)
+			return err
+		}
+	}
+	if err := persistAofManifest(am); err != nil {
+		_ = os.Remove(basePath)
+		if incr != "" {
+			_ = os.Rename(aofFilePath(incr), aofFilePath(aofTempIncrName()))
+		}
+		return err
+	}
+	rServer.aofManifest = am
+
+	if rServer.aofState != aofOff {
+		var baseSize int64
+		if info, err := os.Stat(basePath); err == nil {
+			baseSize = info.Size()
+		}
+		size := baseSize + rServer.aofLastIncrSize
+		bio := &rServer.aofBio
+		bio.mu.Lock()
+		bio.offset += size - rServer.aofCurrentSize
+		bio.mu.Unlock()
+		rServer.aofCurrentSize = size
+		rServer.aofRewriteBaseSize = size
+	}
+	if rServer.aofState == aofWaitRewrite {
+		rServer.aofState = aofOn
+		Log("AOF turned on, its base was written")
+	}
+	return nil
+
+}
+
+// aofDelHistoryFiles removes the history files from the manifest, then
+// deletes them in the background.
+func aofDelHistoryFiles() {
+
+	am := rServer.aofManifest
+	if len(am.history) == 0 {
+		return
+	}
+	next := am.dup()
+	next.history = nil
+	if err := persistAofManifest(next); err != nil {
+		Log("Can't remove the history files from the AOF manifest, %v", err)
+		return
+	}
+	rServer.aofManifest = next
+
+	for _, info := range am.history {
+		path := aofFilePath(info.filename)
+		Log("Removing the history file %s in the background", info.filename)
+		remove := func() {
+			_ = os.Remove(path)
+		}
+		if err := rServer.bioPool.submitTask(remove); err != nil {
+			remove()
+		}
+	}
+
+}
+
+// killAppendOnlyChild stops the rewrite in progress, the incr file it
+// switched to stays listed.
+func killAppendOnlyChild() {
+
+	child := rServer.aofChild
+	if child == nil {
+		return
+	}
+	child.abort.Store(true)
+	<-child.done
+	_ = os.Remove(child.tmpfile)
+	rServer.aofChild = nil
+	Log("Killing running AOF rewrite child")
+
+}
+
+// aofCron starts the rewrite scheduled, or the automatic rewrite once the
+// AOF grew by auto-aof-rewrite-percentage since the last one. It is called
+// by serverCron.
+func aofCron() {
+
+	if hasActiveChildProcess() {
+		return
+	}
+	if rServer.aofRewriteScheduled {
+		_ = rewriteAppendOnlyFileBackground()
+		return
+	}
+
+	if rServer.aofState != aofOn || rServer.aofRewritePerc == 0 || rServer.aofCurrentSize < rServer.aofRewriteMinSize {
+		return
+	}
+	base := max(rServer.aofRewriteBaseSize, 1)
+	growth := rServer.aofCurrentSize*100/base - 100
+	if growth < int64(rServer.aofRewritePerc) {
+		return
+	}
+	// after a failure the rewrite is retried once in a while only
+	if rServer.aofLastBgrewriteStatus != nil && time.Since(rServer.aofLastRewriteTry) < aofRewriteRetryDelay {
+		return
+	}
+	Log("Starting automatic rewriting of AOF on %d%% growth", growth)
+	_ = rewriteAppendOnlyFileBackground()
+
+}
+
+func bgrewriteaofCommand(c *client) {
+
+	switch {
+	case rServer.aofChild != nil:
+		addReplyError(c, "Background append only file rewriting already in progress")
+	case hasActiveChildProcess():
+		rServer.aofRewriteScheduled = true
+		addReplyStatus(c, "Background append only file rewriting scheduled")
+	case rewriteAppendOnlyFileBackground() != nil:
+		addReplyError(c, "Can't execute an AOF background rewriting. Please check the server logs for more information.")
+	default:
+		addReplyStatus(c, "Background append only file rewriting started")
+	}
+
+}
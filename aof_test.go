@@ -0,0 +1,299 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAofTestConn(t *testing.T) *testConn {
+	return newBlockingTestConns(t, "5", 1)[0]
+}
+
+// enableAof turns the AOF on until the end of the test, once its base is
+// written.
+func enableAof(tc *testConn) {
+	tc.t.Helper()
+	tc.expect(testStatus("OK"), "config", "set", "appendonly", "yes")
+	tc.t.Cleanup(func() {
+		tc.do("config", "set", "appendonly", "no", "appendfsync", "everysec")
+	})
+	waitAofRewrite(tc)
+}
+
+// waitAofRewrite waits for the AOF rewrite in progress to be done.
+func waitAofRewrite(tc *testConn) {
+	tc.t.Helper()
+	for j := 0; j < 500; j++ {
+		if tc.infoField("persistence", "aof_rewrite_in_progress") == "0" &&
+			tc.infoField("persistence", "aof_rewrite_scheduled") == "0" {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	tc.t.Fatalf("the AOF rewrite is still in progress")
+}
+
+// aofManifestLines returns the lines of the manifest of the AOF.
+func aofManifestLines(tc *testConn) []string {
+	tc.t.Helper()
+	data, err := os.ReadFile(filepath.Join(aofTestDir(tc), "appendonly.aof.manifest"))
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func aofTestDir(tc *testConn) string {
+	dir := tc.do("config", "get", "dir").([]any)[1].(string)
+	return filepath.Join(dir, tc.do("config", "get", "appenddirname").([]any)[1].(string))
+}
+
+func TestAof_LoadPropagatedCommands(t *testing.T) {
+	tc := newAofTestConn(t)
+
+	// the keys written before the AOF is on are in its preamble
+	tc.expect(testStatus("OK"), "set", "pre", "1")
+	enableAof(tc)
+	if tc.infoField("persistence", "aof_enabled") != "1" {
+		t.Fatalf("want the AOF enabled")
+	}
+
+	tc.expect(testStatus("OK"), "set", "ex", "v", "ex", "100")
+	tc.expect("1.5", "incrbyfloat", "f", "1.5")
+	tc.expect("3", "incrbyfloat", "f", "1.5")
+	tc.expect("0.5", "hincrbyfloat", "h", "f", "0.5")
+	tc.expect(testStatus("OK"), "set", "gone", "v")
+	tc.expect("v", "getdel", "gone")
+	tc.expect(testStatus("OK"), "set", "old", "v")
+	tc.expect(int64(1), "pexpireat", "old", "1")
+	tc.expect(int64(10), "sadd", "s", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10")
+	popped := tc.do("spop", "s", "3").([]any)
+	popped = append(popped, tc.do("spop", "s"))
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect(testStatus("QUEUED"), "incr", "c")
+	tc.expect(testStatus("QUEUED"), "incr", "c")
+	tc.expect([]any{int64(1), int64(2)}, "exec")
+
+	tc.expect("1-1", "xadd", "st", "1-1", "a", "1")
+	tc.expect("2-1", "xadd", "st", "2-1", "b", "2")
+	tc.expect(testStatus("OK"), "xgroup", "create", "st", "g", "0")
+	tc.expect([]any{[]any{"st", []any{[]any{"1-1", []any{"a", "1"}}}}},
+		"xreadgroup", "group", "g", "alice", "count", "1", "streams", "st", ">")
+	tc.expect([]any{"1-1"}, "xclaim", "st", "g", "bob", "0", "1-1", "justid")
+
+	tc.expect(testStatus("OK"), "debug", "loadaof")
+
+	tc.expect("1", "get", "pre")
+	if ttl := tc.do("pttl", "ex").(int64); ttl <= 0 || ttl > 100000 {
+		t.Fatalf("want the ttl of ex kept, got %d", ttl)
+	}
+	tc.expect("3", "get", "f")
+	tc.expect("0.5", "hget", "h", "f")
+	tc.expect(int64(0), "exists", "gone", "old")
+	tc.expect(int64(6), "scard", "s")
+	for _, member := range popped {
+		tc.expect(int64(0), "sismember", "s", member.(string))
+	}
+	tc.expect("2", "get", "c")
+
+	// the delivery of 1-1 and its claim were propagated as is
+	tc.expect([]any{int64(1), "1-1", "1-1", []any{[]any{"bob", "1"}}}, "xpending", "st", "g")
+	tc.expect([]any{[]any{"st", []any{[]any{"2-1", []any{"b", "2"}}}}},
+		"xreadgroup", "group", "g", "alice", "streams", "st", ">")
+}
+
+func TestAof_FsyncPolicies(t *testing.T) {
+	tc := newAofTestConn(t)
+	enableAof(tc)
+
+	for _, policy := range []string{"always", "no", "everysec"} {
+		tc.expect(testStatus("OK"), "config", "set", "appendfsync", policy)
+		tc.expect([]any{"appendfsync", policy}, "config", "get", "appendfsync")
+		tc.expect(int64(1), "rpush", "l-"+policy, "a")
+		// the write is in the file before the reply is sent
+		if got := tc.infoField("persistence", "aof_buffer_length"); got != "0" {
+			t.Fatalf("%s: want the AOF buffer written, got %s", policy, got)
+		}
+	}
+	tc.expectError("ERR CONFIG SET failed (possibly related to argument 'appendfsync')",
+		"config", "set", "appendfsync", "sometimes")
+
+	// everysec fsyncs in the background, once a second
+	for j := 0; j < 300 && tc.infoField("persistence", "aof_pending_bio_fsync") != "0"; j++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	tc.expect(testStatus("OK"), "debug", "loadaof")
+	for _, policy := range []string{"always", "no", "everysec"} {
+		tc.expect(int64(1), "llen", "l-"+policy)
+	}
+}
+
+func TestAof_TruncatedTail(t *testing.T) {
+	tc := newAofTestConn(t)
+
+	dir := aofTestDir(tc)
+	filename := filepath.Join(dir, "appendonly.aof.1.incr.aof")
+	manifest := filepath.Join(dir, "appendonly.aof.manifest")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+		tc.do("config", "set", "aof-load-truncated", "yes")
+	})
+	load := func(data string) any {
+		t.Helper()
+		if err := os.WriteFile(manifest, []byte("file appendonly.aof.1.incr.aof seq 1 type i\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return tc.do("debug", "loadaof")
+	}
+	fileSize := func() int {
+		t.Helper()
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(data)
+	}
+
+	valid := "*2\r\n$6\r\nSELECT\r\n$1\r\n5\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+
+	// the command cut in the middle is truncated away
+	if got := load(valid + "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1"); got != testStatus("OK") {
+		t.Fatalf("want the truncated AOF loaded, got %#v", got)
+	}
+	tc.expect("1", "get", "a")
+	tc.expect(int64(0), "exists", "b")
+	if fileSize() != len(valid) {
+		t.Fatalf("want the AOF truncated to %d bytes, got %d", len(valid), fileSize())
+	}
+
+	// so is a transaction without its EXEC
+	if got := load(valid + "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n1\r\n"); got != testStatus("OK") {
+		t.Fatalf("want the truncated AOF loaded, got %#v", got)
+	}
+	tc.expect(int64(0), "exists", "c")
+	if fileSize() != len(valid) {
+		t.Fatalf("want the AOF truncated before MULTI, got %d bytes", fileSize())
+	}
+
+	tc.expect(testStatus("OK"), "config", "set", "aof-load-truncated", "no")
+	if got, ok := load(valid + "*3\r\n$3\r\nSET").(testError); !ok || !strings.Contains(string(got), "unexpected end of file") {
+		t.Fatalf("want the truncated AOF refused, got %#v", got)
+	}
+	if got, ok := load(valid + "*x\r\n").(testError); !ok || !strings.Contains(string(got), "bad file format") {
+		t.Fatalf("want a bad format error, got %#v", got)
+	}
+	if got, ok := load("*1\r\n$3\r\nFOO\r\n").(testError); !ok || !strings.Contains(string(got), "unknown command 'FOO'") {
+		t.Fatalf("want an unknown command error, got %#v", got)
+	}
+}
+
+func TestAof_Bgrewriteaof(t *testing.T) {
+	tc := newAofTestConn(t)
+	enableAof(tc)
+
+	for j := 0; j < 100; j++ {
+		tc.expect(int64(j+1), "incr", "counter")
+	}
+	tc.expect(int64(3), "rpush", "l", "a", "b", "c")
+	before := aofManifestLines(tc)
+	rewrites, _ := strconv.Atoi(tc.infoField("persistence", "aof_rewrites"))
+
+	tc.expect(testStatus("Background append only file rewriting started"), "bgrewriteaof")
+	// the writes while the rewrite runs go to the new incr file
+	tc.expect(int64(101), "incr", "counter")
+	waitAofRewrite(tc)
+	if got := tc.infoField("persistence", "aof_rewrites"); got != strconv.Itoa(rewrites+1) {
+		t.Fatalf("want %d rewrites, got %s", rewrites+1, got)
+	}
+
+	after := aofManifestLines(tc)
+	if len(after) != 2 || !strings.HasSuffix(after[0], "type b") || !strings.HasSuffix(after[1], "type i") {
+		t.Fatalf("want a base and an incr file, got %q", after)
+	}
+	if after[0] == before[0] {
+		t.Fatalf("want a new base, got %q", after[0])
+	}
+	// the files replaced are deleted in the background
+	for _, line := range before {
+		name := strings.Fields(line)[1]
+		if name == strings.Fields(after[1])[1] {
+			continue
+		}
+		path := filepath.Join(aofTestDir(tc), name)
+		for j := 0; j < 100; j++ {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("want the history file %s deleted", name)
+		}
+	}
+
+	tc.expect(testStatus("OK"), "debug", "loadaof")
+	tc.expect("101", "get", "counter")
+	tc.expect([]any{"a", "b", "c"}, "lrange", "l", "0", "-1")
+}
+
+func TestAof_RewriteCopyOnWrite(t *testing.T) {
+	tc := newAofTestConn(t)
+	enableAof(tc)
+
+	mutateDuringSnapshot(tc, func() {
+		tc.expect(testStatus("Background append only file rewriting started"), "bgrewriteaof")
+	})
+	waitAofRewrite(tc)
+
+	// the base is the dataset when the rewrite started, the incr file the
+	// changes made since, a change in both shows after the reload
+	tc.expect(testStatus("OK"), "debug", "loadaof")
+	tc.expect(int64(snapshotNumKeys+1), "dbsize")
+	tc.expect(int64(snapshotNumMembers+1), "scard", "s:0")
+	tc.expect(int64(0), "sismember", "s:1", "m0")
+	tc.expect(int64(0), "exists", "s:2")
+	tc.expect("11", "get", "counter")
+	tc.expect([]any{"before", "added-during-save"}, "lrange", "l", "0", "-1")
+}
+
+func TestAof_AutoRewrite(t *testing.T) {
+	tc := newAofTestConn(t)
+	enableAof(tc)
+	t.Cleanup(func() {
+		tc.do("config", "set", "auto-aof-rewrite-percentage", "100", "auto-aof-rewrite-min-size", "64mb")
+	})
+
+	rewrites, _ := strconv.Atoi(tc.infoField("persistence", "aof_rewrites"))
+	tc.expect(testStatus("OK"), "config", "set", "auto-aof-rewrite-percentage", "10", "auto-aof-rewrite-min-size", "1kb")
+	value := strings.Repeat("x", 512)
+	for j := 0; j < 10; j++ {
+		tc.expect(testStatus("OK"), "set", "big", value)
+	}
+	for j := 0; j < 300; j++ {
+		got, _ := strconv.Atoi(tc.infoField("persistence", "aof_rewrites"))
+		if got > rewrites {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	waitAofRewrite(tc)
+	if got, _ := strconv.Atoi(tc.infoField("persistence", "aof_rewrites")); got <= rewrites {
+		t.Fatalf("want the AOF rewritten on growth")
+	}
+	// the base holds a single SET now
+	size, _ := strconv.Atoi(tc.infoField("persistence", "aof_current_size"))
+	if size >= 10*len(value) {
+		t.Fatalf("want the AOF compacted, got %d bytes", size)
+	}
+	tc.expect(value, "get", "big")
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"time"
+)
+
+// Blocking commands, BLPOP and friends, park the client when every key they
+// wait for is empty. The client stays registered in the event loop, so a
+// disconnection is still noticed, but its input is not processed until it
+// is served or times out.
+//
+// A blocked client is queued, per key, in db.blockingKeys. Commands adding a
+// key that clients wait for signal it as ready, and once the command
+// returns handleClientsBlockedOnKeys serves the waiting clients in the
+// order they blocked, running their command again. The remaining input of
+// an unblocked client, the rest of a pipeline, is processed in beforeSleep.
+//
+// WAIT and WAITAOF park the client in server.clientsWaitingAcks instead,
+// until the replicas acknowledge, and the AOF fsyncs, the replication
+// offset of its last write. See processClientsWaitingReplicas.
+
+const (
+	blockedNone    = iota
+	blockedList    // BLPOP, BRPOP, BRPOPLPUSH, BLMOVE and BLMPOP
+	blockedZset    // BZPOPMIN and BZPOPMAX
+	blockedStream  // XREAD and XREADGROUP
+	blockedWait    // WAIT
+	blockedWaitAOF // WAITAOF
+)
+
+// units of the timeout argument
+const (
+	unitSeconds = iota
+	unitMilliseconds
+)
+
+type blockingState struct {
+	btype    int
+	keys     map[string]*list.Element // the client in db.blockingKeys[key]
+	timerId  int64                    // -1 when blocked forever
+	deadline time.Time                // zero when blocked forever
+
+	// WAIT and WAITAOF
+	reploffset  int64 // the offset to be acknowledged
+	numreplicas int
+	numlocal    int
+	waitingAcks *list.Element // the client in server.clientsWaitingAcks
+}
+
+type readyKey struct {
+	db  *redisDb
+	key string
+}
+
+// getTimeoutFromObjectOrReply parses the timeout of the blocking commands,
+// in seconds with decimals or in milliseconds, 0 meaning forever.
+func getTimeoutFromObjectOrReply(c *client, o *rObj, unit int) (time.Duration, bool) {
+
+	if unit == unitMilliseconds {
+		ms, ok := getLongLongFromObject(o)
+		if !ok || ms > math.MaxInt64/int64(time.Millisecond) {
+			addReplyError(c, "timeout is not an integer or out of range")
+			return 0, false
+		}
+		if ms < 0 {
+			addReplyError(c, "timeout is negative")
+			return 0, false
+		}
+		return time.Duration(ms) * time.Millisecond, true
+	}
+
+	secs, ok := getLongDoubleFromObject(o)
+	if !ok || math.IsInf(secs, 0) || secs*1000 > math.MaxInt64/float64(time.Millisecond) {
+		addReplyError(c, "timeout is not a float or out of range")
+		return 0, false
+	}
+	if secs < 0 {
+		addReplyError(c, "timeout is negative")
+		return 0, false
+	}
+	return time.Duration(secs*1000) * time.Millisecond, true
+
+}
+
+// blockForKeys blocks the client until one of keys is ready, or the timeout
+// expires when not 0. The command, still in argv, runs again once served,
+// blocking again from there keeps the original deadline. Inside EXEC it
+// replies as timed out right away.
+func blockForKeys(c *client, btype int, keys []*rObj, timeout time.Duration) {
+
+	// a transaction can not wait, the command behaves as timed out
+	if c.flag&(clientMulti|clientDenyBlocking) != 0 {
+		replyToBlockedClientTimedOut(c)
+		return
+	}
+
+	if c.flag&clientReprocessingCommand == 0 {
+		c.bstate.deadline = time.Time{}
+		if timeout > 0 {
+			c.bstate.deadline = time.Now().Add(timeout)
+		}
+	}
+
+	c.bstate.btype = btype
+	c.bstate.keys = make(map[string]*list.Element, len(keys))
+	for _, k := range keys {
+		key := k.String()
+		if _, ok := c.bstate.keys[key]; ok {
+			continue
+		}
+		l := c.db.blockingKeys[key]
+		if l == nil {
+			l = list.New()
+			c.db.blockingKeys[key] = l
+		}
+		c.bstate.keys[key] = l.PushBack(c)
+	}
+
+	c.bstate.timerId = -1
+	if !c.bstate.deadline.IsZero() {
+		timeout = max(time.Until(c.bstate.deadline), time.Millisecond)
+		c.bstate.timerId = rServer.el.AddTimer(timeout, blockedClientTimedOut, c)
+	}
+
+	c.flag |= clientBlocked
+	rServer.blockedClients++
+
+}
+
+// blockForAcks blocks the client in WAIT or WAITAOF until numreplicas
+// replicas, and the AOF when numlocal is 1, acknowledge offset, or the
+// timeout expires when not 0.
+func blockForAcks(c *client, btype int, timeout time.Duration, offset int64, numlocal, numreplicas int) {
+
+	c.bstate.btype = btype
+	c.bstate.reploffset = offset
+	c.bstate.numlocal, c.bstate.numreplicas = numlocal, numreplicas
+	c.bstate.waitingAcks = rServer.clientsWaitingAcks.PushBack(c)
+
+	c.bstate.timerId = -1
+	c.bstate.deadline = time.Time{}
+	if timeout > 0 {
+		c.bstate.deadline = time.Now().Add(timeout)
+		c.bstate.timerId = rServer.el.AddTimer(timeout, blockedClientTimedOut, c)
+	}
+
+	c.flag |= clientBlocked
+	rServer.blockedClients++
+
+}
+
+// removeBlockedClient forgets the blocking state of the client, without
+// touching its command.
+func removeBlockedClient(c *client) {
+
+	for key, ele := range c.bstate.keys {
+		l := c.db.blockingKeys[key]
+		l.Remove(ele)
+		if l.Len() == 0 {
+			delete(c.db.blockingKeys, key)
+		}
+	}
+	c.bstate.keys = nil
+	if c.bstate.waitingAcks != nil {
+		rServer.clientsWaitingAcks.Remove(c.bstate.waitingAcks)
+		c.bstate.waitingAcks = nil
+	}
+	c.bstate.btype = blockedNone
+
+	if c.bstate.timerId != -1 {
+		_ = rServer.el.DeleteTimer(c.bstate.timerId)
+		c.bstate.timerId = -1
+	}
+
+	c.flag &^= clientBlocked
+	rServer.blockedClients--
+
+}
+
+// queueUnblockedClient finishes the command of a client that is no longer
+// blocked, the rest of its input is processed by processUnblockedClients.
+func queueUnblockedClient(c *client) {
+
+	c.lastCmd = c.cmd
+	resetClient(c)
+	if c.flag&clientUnblocked == 0 {
+		c.flag |= clientUnblocked
+		rServer.unblockedClients.PushBack(c)
+	}
+
+}
+
+func unblockClient(c *client) {
+	removeBlockedClient(c)
+	queueUnblockedClient(c)
+}
+
+func blockedClientTimedOut(el *EventLoop, id int64, clientData any) time.Duration {
+
+	c := clientData.(*client)
+	// returning 0 deletes the timer
+	c.bstate.timerId = -1
+	replyToBlockedClientTimedOut(c)
+	unblockClient(c)
+	return 0
+
+}
+
+// replyToBlockedClientTimedOut replies to a client blocked for too long,
+// WAIT and WAITAOF with the acknowledgements so far.
+func replyToBlockedClientTimedOut(c *client) {
+
+	switch c.bstate.btype {
+	case blockedWait:
+		addReplyLongLong(c, int64(replicationCountAcksByOffset(c.bstate.reploffset)))
+	case blockedWaitAOF:
+		addReplyWaitAOF(c, c.bstate.reploffset)
+	default:
+		addReplyNullArray(c)
+	}
+
+}
+
+// disconnectAllBlockedClients unblocks every blocked client with an error,
+// e.g. when turning into a replica the keys they wait for may never come.
+func disconnectAllBlockedClients() {
+
+	for ele := rServer.clients.Front(); ele != nil; ele = ele.Next() {
+		c := ele.Value.(*client)
+		if c.flag&clientBlocked == 0 {
+			continue
+		}
+		addReplyError(c, "-UNBLOCKED force unblock from blocking operation, instance state changed (master -> replica?)")
+		unblockClient(c)
+		c.flag |= clientCloseAfterReply
+	}
+
+}
+
+// processUnblockedClients processes the input the unblocked clients
+// received while blocked.
+func processUnblockedClients() {
+
+	for rServer.unblockedClients.Len() > 0 {
+		c := rServer.unblockedClients.Remove(rServer.unblockedClients.Front()).(*client)
+		c.flag &^= clientUnblocked
+
+		// reading clients are processed by handleClientsWithPendingRead
+		if c.flag&(clientBlocked|clientPendingRead|clientClosed|clientCloseASAP) != 0 {
+			continue
+		}
+		processInputBuffer(c)
+	}
+
+}
+
+// signalKeyAsReady is called when key is added or overwritten, clients
+// blocked on it are served after the current command.
+func signalKeyAsReady(db *redisDb, key string) {
+
+	if _, ok := db.blockingKeys[key]; !ok {
+		return
+	}
+	if _, ok := db.readyKeys[key]; ok {
+		return
+	}
+	db.readyKeys[key] = struct{}{}
+	rServer.readyKeys = append(rServer.readyKeys, readyKey{db: db, key: key})
+
+}
+
+// scanDatabaseForReadyKeys signals the blocking keys of db that exist, after
+// its dataset was replaced.
+func scanDatabaseForReadyKeys(db *redisDb) {
+	for key := range db.blockingKeys {
+		if db.dict.find(key) != nil {
+			signalKeyAsReady(db, key)
+		}
+	}
+}
+
+func blockedTypeOf(o *rObj) int {
+	switch o.objectType {
+	case objectTypeList:
+		return blockedList
+	case objectTypeZSet:
+		return blockedZset
+	case objectTypeStream:
+		return blockedStream
+	}
+	return blockedNone
+}
+
+// serveClientsBlockedOnKey runs the command of the clients blocked on key,
+// first blocked first served, while the key has something to serve.
+func serveClientsBlockedOnKey(db *redisDb, key string) {
+
+	l := db.blockingKeys[key]
+	if l == nil {
+		return
+	}
+
+	// clients blocking again on the key while served wait for the next round
+	count := l.Len()
+	for ele := l.Front(); ele != nil && count > 0; count-- {
+		c := ele.Value.(*client)
+		ele = ele.Next()
+
+		o := lookupKeyWrite(db, key)
+		if o == nil {
+			return
+		}
+		if c.bstate.btype != blockedTypeOf(o) || c.flag&(clientCloseASAP|clientCloseAfterReply) != 0 {
+			continue
+		}
+
+		removeBlockedClient(c)
+		c.flag |= clientReprocessingCommand
+		call(c)
+		c.flag &^= clientReprocessingCommand
+		if c.flag&clientBlocked == 0 {
+			queueUnblockedClient(c)
+		}
+	}
+
+}
+
+// handleClientsBlockedOnKeys serves the clients blocked on the keys signaled
+// as ready, serving them may make more keys ready.
+func handleClientsBlockedOnKeys() {
+
+	for len(rServer.readyKeys) > 0 {
+		readyKeys := rServer.readyKeys
+		rServer.readyKeys = nil
+		for _, rk := range readyKeys {
+			// the key may be signaled again while its clients are served
+			delete(rk.db.readyKeys, rk.key)
+			serveClientsBlockedOnKey(rk.db, rk.key)
+		}
+	}
+
+}
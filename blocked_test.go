@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// waitBlockedClients waits for the server to have n blocked clients, so the
+// commands that follow see them parked.
+func waitBlockedClients(tc *testConn, n int) {
+	tc.t.Helper()
+	want := strconv.Itoa(n)
+	for j := 0; j < 500; j++ {
+		if tc.infoField("clients", "blocked_clients") == want {
+			return
+		}
+		time.Sleep(time.Millisecond * 2)
+	}
+	tc.t.Fatalf("want %d blocked clients, got %s", n, tc.infoField("clients", "blocked_clients"))
+}
+
+// expectReply reads the reply of a command sent earlier.
+func expectReply(tc *testConn, want any) {
+	tc.t.Helper()
+	got := tc.read()
+	if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", want) {
+		tc.t.Fatalf("want %#v, got %#v", want, got)
+	}
+}
+
+func newBlockingTestConns(t *testing.T, db string, n int) []*testConn {
+	conns := make([]*testConn, n)
+	for j := range conns {
+		conns[j] = newTestConn(t)
+		conns[j].expect(testStatus("OK"), "select", db)
+	}
+	conns[0].expect(testStatus("OK"), "flushdb")
+	t.Cleanup(func() {
+		conns[0].do("flushdb")
+	})
+	return conns
+}
+
+func TestBlocking_ListPop(t *testing.T) {
+	conns := newBlockingTestConns(t, "13", 3)
+	tc, b1, b2 := conns[0], conns[1], conns[2]
+
+	// served right away
+	tc.expect(int64(2), "rpush", "l2", "a", "b")
+	tc.expect([]any{"l2", "a"}, "blpop", "l1", "l2", "0")
+	tc.expect([]any{"l2", "b"}, "brpop", "l1", "l2", "0")
+	tc.expect(int64(0), "exists", "l2")
+
+	// first blocked, first served
+	b1.send("blpop", "l1", "l2", "0")
+	waitBlockedClients(tc, 1)
+	b2.send("brpop", "l2", "0")
+	waitBlockedClients(tc, 2)
+	tc.expect(int64(3), "rpush", "l2", "x", "y", "z")
+	expectReply(b1, []any{"l2", "x"})
+	expectReply(b2, []any{"l2", "z"})
+	tc.expect([]any{"y"}, "lrange", "l2", "0", "-1")
+	waitBlockedClients(tc, 0)
+
+	// a push consumed in the same pipeline leaves the client blocked
+	b1.send("blpop", "l3", "0")
+	waitBlockedClients(tc, 1)
+	tc.writeRaw("*3\r\n$5\r\nlpush\r\n$2\r\nl3\r\n$1\r\nv\r\n*2\r\n$4\r\nllen\r\n$2\r\nl3\r\n")
+	expectReply(tc, int64(1))
+	expectReply(tc, int64(0))
+	expectReply(b1, []any{"l3", "v"})
+
+	tc.expect(nil, "blpop", "l4", "0.05")
+	tc.expect(nil, "brpop", "l4", "l5", "0.01")
+	waitBlockedClients(tc, 0)
+
+	tc.expect(testStatus("OK"), "set", "str", "v")
+	tc.expectError("WRONGTYPE", "blpop", "str", "0")
+	tc.expect(testError("ERR timeout is not a float or out of range"), "blpop", "l", "x")
+	tc.expect(testError("ERR timeout is negative"), "blpop", "l", "-1")
+}
+
+func TestBlocking_ListMove(t *testing.T) {
+	conns := newBlockingTestConns(t, "13", 2)
+	tc, b := conns[0], conns[1]
+
+	b.send("blmove", "src", "dst", "right", "left", "0")
+	waitBlockedClients(tc, 1)
+	tc.expect(int64(2), "rpush", "src", "a", "b")
+	expectReply(b, "b")
+	tc.expect([]any{"b"}, "lrange", "dst", "0", "-1")
+
+	// the destination of a move wakes the clients blocked on it
+	b.send("brpop", "dst2", "0")
+	waitBlockedClients(tc, 1)
+	tc.expect("a", "brpoplpush", "src", "dst2", "0")
+	expectReply(b, []any{"dst2", "a"})
+	tc.expect(int64(0), "exists", "dst2")
+
+	tc.expect(nil, "blmove", "src", "dst", "left", "left", "0.01")
+	tc.expect(testError("ERR syntax error"), "blmove", "src", "dst", "up", "left", "0")
+
+	b.send("blmpop", "0", "2", "m1", "m2", "right", "count", "2")
+	waitBlockedClients(tc, 1)
+	tc.expect(int64(3), "rpush", "m2", "a", "b", "c")
+	expectReply(b, []any{"m2", []any{"c", "b"}})
+	tc.expect([]any{"m2", []any{"a"}}, "blmpop", "0", "2", "m1", "m2", "left")
+	tc.expect(nil, "blmpop", "0.01", "1", "m1", "left")
+	tc.expect(testError("ERR numkeys should be greater than 0"), "blmpop", "0", "0", "m1", "left")
+}
+
+func TestBlocking_Zset(t *testing.T) {
+	conns := newBlockingTestConns(t, "15", 2)
+	tc, b := conns[0], conns[1]
+
+	tc.expect(int64(2), "zadd", "z2", "1", "a", "2", "b")
+	tc.expect([]any{"z2", "a", "1"}, "bzpopmin", "z1", "z2", "0")
+	tc.expect([]any{"z2", "b", "2"}, "bzpopmax", "z2", "0")
+
+	b.send("bzpopmax", "z1", "0")
+	waitBlockedClients(tc, 1)
+	// a list at the key does not serve a sorted set client
+	tc.expect(int64(1), "rpush", "z1", "x")
+	waitBlockedClients(tc, 1)
+	tc.expectError("WRONGTYPE", "bzpopmin", "z1", "0")
+	tc.expect(int64(1), "del", "z1")
+	tc.expect(int64(2), "zadd", "z1", "1", "a", "3", "c")
+	expectReply(b, []any{"z1", "c", "3"})
+
+	tc.expect(nil, "bzpopmin", "z3", "0.01")
+}
+
+// TestBlocking_Pipeline checks that the commands pipelined after a blocking
+// one wait for it, and that a disconnected client stops waiting.
+func TestBlocking_Pipeline(t *testing.T) {
+	conns := newBlockingTestConns(t, "13", 2)
+	tc, b := conns[0], conns[1]
+
+	b.writeRaw("*3\r\n$5\r\nblpop\r\n$1\r\nl\r\n$1\r\n0\r\n" +
+		"*3\r\n$5\r\nrpush\r\n$4\r\ndone\r\n$1\r\n1\r\n" +
+		"*1\r\n$4\r\nping\r\n")
+	waitBlockedClients(tc, 1)
+	tc.expect(int64(0), "exists", "done")
+	tc.expect(int64(1), "rpush", "l", "v")
+	expectReply(b, []any{"l", "v"})
+	expectReply(b, int64(1))
+	expectReply(b, testStatus("PONG"))
+
+	// timing out resumes the pipeline too
+	b.writeRaw("*3\r\n$5\r\nblpop\r\n$1\r\nl\r\n$4\r\n0.05\r\n*1\r\n$4\r\nping\r\n")
+	expectReply(b, nil)
+	expectReply(b, testStatus("PONG"))
+
+	c := newTestConn(t)
+	c.expect(testStatus("OK"), "select", "13")
+	c.send("blpop", "gone", "0")
+	waitBlockedClients(tc, 1)
+	_ = c.conn.Close()
+	waitBlockedClients(tc, 0)
+	tc.expect(int64(1), "rpush", "gone", "v")
+	tc.expect(int64(1), "llen", "gone")
+}
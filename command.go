@@ -0,0 +1,637 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// command flags
+const (
+	cmdWrite    = 1 << iota // may modify the dataset
+	cmdReadonly             // only reads the dataset
+	cmdDenyOOM              // may increase memory usage, refused when out of memory
+	cmdAdmin                // administrative command
+	cmdPubSub               // pub/sub related command
+	cmdNoScript             // not allowed in scripts
+	cmdBlocking             // may block the client
+	cmdLoading              // allowed while the dataset is loading
+	cmdStale                // allowed while a replica has stale data
+	cmdFast                 // O(1) or O(log(N)) command
+	cmdNoMulti              // not allowed inside a transaction
+	cmdNoAuth               // allowed before authentication
+)
+
+type commandProc func(c *client)
+
+// commandGetKeysProc returns the argv positions of the keys, for commands
+// whose keys can not be described by firstKey, lastKey and keyStep.
+type commandGetKeysProc func(argv []*rObj) []int
+
+type redisCommand struct {
+	name     string
+	proc     commandProc
+	arity    int // exact number of arguments, -N means at least N
+	flags    int
+	getKeys  commandGetKeysProc
+	firstKey int // first argument that is a key, 0 means no keys
+	lastKey  int // last argument that is a key, negative counts from the end
+	keyStep  int
+
+	calls        int64
+	microseconds int64
+}
+
+var commandTable = []*redisCommand{
+	{name: "ping", proc: pingCommand, arity: -1, flags: cmdFast | cmdStale | cmdLoading},
+	{name: "echo", proc: echoCommand, arity: 2, flags: cmdFast},
+	{name: "quit", proc: quitCommand, arity: -1, flags: cmdFast | cmdStale | cmdLoading | cmdNoScript | cmdNoAuth},
+	{name: "hello", proc: helloCommand, arity: -1, flags: cmdFast | cmdStale | cmdLoading | cmdNoScript | cmdNoAuth},
+	{name: "auth", proc: authCommand, arity: -2, flags: cmdFast | cmdStale | cmdLoading | cmdNoScript | cmdNoAuth},
+	{name: "client", proc: clientCommand, arity: -2, flags: cmdAdmin | cmdNoScript | cmdLoading | cmdStale},
+	{name: "command", proc: commandCommand, arity: -1, flags: cmdStale | cmdLoading},
+	{name: "select", proc: selectCommand, arity: 2, flags: cmdLoading | cmdStale | cmdFast},
+	{name: "swapdb", proc: swapdbCommand, arity: 3, flags: cmdWrite | cmdFast},
+	{name: "move", proc: moveCommand, arity: 3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "dbsize", proc: dbsizeCommand, arity: 1, flags: cmdReadonly | cmdFast},
+	{name: "flushdb", proc: flushdbCommand, arity: -1, flags: cmdWrite},
+	{name: "flushall", proc: flushallCommand, arity: -1, flags: cmdWrite},
+	{name: "del", proc: delCommand, arity: -2, flags: cmdWrite, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "exists", proc: existsCommand, arity: -2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "type", proc: typeCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "object", proc: objectCommand, arity: -2, flags: cmdReadonly, firstKey: 2, lastKey: 2, keyStep: 1},
+	{name: "memory", proc: memoryCommand, arity: -2, flags: cmdReadonly, firstKey: 2, lastKey: 2, keyStep: 1},
+	{name: "info", proc: infoCommand, arity: -1, flags: cmdLoading | cmdStale},
+	{name: "config", proc: configCommand, arity: -2, flags: cmdAdmin | cmdNoScript | cmdLoading | cmdStale},
+	{name: "save", proc: saveCommand, arity: 1, flags: cmdAdmin | cmdNoScript | cmdNoMulti},
+	{name: "bgsave", proc: bgsaveCommand, arity: -1, flags: cmdAdmin | cmdNoScript},
+	{name: "bgrewriteaof", proc: bgrewriteaofCommand, arity: 1, flags: cmdAdmin | cmdNoScript},
+	{name: "replicaof", proc: replicaofCommand, arity: 3, flags: cmdAdmin | cmdNoScript | cmdStale},
+	{name: "slaveof", proc: replicaofCommand, arity: 3, flags: cmdAdmin | cmdNoScript | cmdStale},
+	{name: "replconf", proc: replconfCommand, arity: -1, flags: cmdAdmin | cmdNoScript | cmdLoading | cmdStale},
+	{name: "psync", proc: syncCommand, arity: -3, flags: cmdAdmin | cmdNoScript | cmdNoMulti},
+	{name: "wait", proc: waitCommand, arity: 3, flags: cmdNoScript | cmdBlocking},
+	{name: "waitaof", proc: waitaofCommand, arity: 4, flags: cmdNoScript | cmdBlocking},
+	{name: "lastsave", proc: lastsaveCommand, arity: 1, flags: cmdLoading | cmdStale | cmdFast},
+	{name: "debug", proc: debugCommand, arity: -2, flags: cmdAdmin | cmdNoScript | cmdLoading | cmdStale},
+	{name: "expire", proc: expireCommand, arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "pexpire", proc: pexpireCommand, arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "expireat", proc: expireatCommand, arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "pexpireat", proc: pexpireatCommand, arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "persist", proc: persistCommand, arity: 2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "ttl", proc: ttlCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "pttl", proc: pttlCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "expiretime", proc: expiretimeCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "pexpiretime", proc: pexpiretimeCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "get", proc: getCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "set", proc: setCommand, arity: -3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "setnx", proc: setnxCommand, arity: 3, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "setex", proc: setexCommand, arity: 4, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "psetex", proc: psetexCommand, arity: 4, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "getex", proc: getexCommand, arity: -2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "getdel", proc: getdelCommand, arity: 2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "getset", proc: getsetCommand, arity: 3, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "mget", proc: mgetCommand, arity: -2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "mset", proc: msetCommand, arity: -3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: -1, keyStep: 2},
+	{name: "msetnx", proc: msetnxCommand, arity: -3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: -1, keyStep: 2},
+	{name: "append", proc: appendCommand, arity: 3, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "strlen", proc: strlenCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "getrange", proc: getrangeCommand, arity: 4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "substr", proc: getrangeCommand, arity: 4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "setrange", proc: setrangeCommand, arity: 4, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "incr", proc: incrCommand, arity: 2, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "decr", proc: decrCommand, arity: 2, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "incrby", proc: incrbyCommand, arity: 3, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "decrby", proc: decrbyCommand, arity: 3, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "incrbyfloat", proc: incrbyfloatCommand, arity: 3, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hset", proc: hsetCommand, arity: -4, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hmset", proc: hsetCommand, arity: -4, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hsetnx", proc: hsetnxCommand, arity: 4, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hget", proc: hgetCommand, arity: 3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hmget", proc: hmgetCommand, arity: -3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hdel", proc: hdelCommand, arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hlen", proc: hlenCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hstrlen", proc: hstrlenCommand, arity: 3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hexists", proc: hexistsCommand, arity: 3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hincrby", proc: hincrbyCommand, arity: 4, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hincrbyfloat", proc: hincrbyfloatCommand, arity: 4, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hkeys", proc: hkeysCommand, arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hvals", proc: hvalsCommand, arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hgetall", proc: hgetallCommand, arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hrandfield", proc: hrandfieldCommand, arity: -2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "hscan", proc: hscanCommand, arity: -3, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "lpush", proc: lpushCommand, arity: -3, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "rpush", proc: rpushCommand, arity: -3, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "lpushx", proc: lpushxCommand, arity: -3, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "rpushx", proc: rpushxCommand, arity: -3, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "lpop", proc: lpopCommand, arity: -2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "rpop", proc: rpopCommand, arity: -2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "llen", proc: llenCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "lindex", proc: lindexCommand, arity: 3, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "lset", proc: lsetCommand, arity: 4, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "lrange", proc: lrangeCommand, arity: 4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "ltrim", proc: ltrimCommand, arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "linsert", proc: linsertCommand, arity: 5, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "lrem", proc: lremCommand, arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "lpos", proc: lposCommand, arity: -3, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "lmove", proc: lmoveCommand, arity: 5, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 2, keyStep: 1},
+	{name: "rpoplpush", proc: rpoplpushCommand, arity: 3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 2, keyStep: 1},
+	{name: "lmpop", proc: lmpopCommand, arity: -4, flags: cmdWrite, getKeys: lmpopGetKeys},
+	{name: "blpop", proc: blpopCommand, arity: -3, flags: cmdWrite | cmdNoScript | cmdBlocking, firstKey: 1, lastKey: -2, keyStep: 1},
+	{name: "brpop", proc: brpopCommand, arity: -3, flags: cmdWrite | cmdNoScript | cmdBlocking, firstKey: 1, lastKey: -2, keyStep: 1},
+	{name: "blmove", proc: blmoveCommand, arity: 6, flags: cmdWrite | cmdDenyOOM | cmdNoScript | cmdBlocking, firstKey: 1, lastKey: 2, keyStep: 1},
+	{name: "brpoplpush", proc: brpoplpushCommand, arity: 4, flags: cmdWrite | cmdDenyOOM | cmdNoScript | cmdBlocking, firstKey: 1, lastKey: 2, keyStep: 1},
+	{name: "blmpop", proc: blmpopCommand, arity: -5, flags: cmdWrite | cmdBlocking, getKeys: blmpopGetKeys},
+	{name: "sadd", proc: saddCommand, arity: -3, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "srem", proc: sremCommand, arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "smove", proc: smoveCommand, arity: 4, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 2, keyStep: 1},
+	{name: "sismember", proc: sismemberCommand, arity: 3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "smismember", proc: smismemberCommand, arity: -3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "scard", proc: scardCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "smembers", proc: smembersCommand, arity: 2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "spop", proc: spopCommand, arity: -2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "srandmember", proc: srandmemberCommand, arity: -2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "sinter", proc: sinterCommand, arity: -2, flags: cmdReadonly, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "sintercard", proc: sintercardCommand, arity: -3, flags: cmdReadonly, getKeys: sintercardGetKeys},
+	{name: "sinterstore", proc: sinterstoreCommand, arity: -3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "sunion", proc: sunionCommand, arity: -2, flags: cmdReadonly, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "sunionstore", proc: sunionstoreCommand, arity: -3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "sdiff", proc: sdiffCommand, arity: -2, flags: cmdReadonly, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "sdiffstore", proc: sdiffstoreCommand, arity: -3, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "sscan", proc: sscanCommand, arity: -3, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zadd", proc: zaddCommand, arity: -4, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zincrby", proc: zincrbyCommand, arity: 4, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zrem", proc: zremCommand, arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zremrangebyscore", proc: zremrangebyscoreCommand, arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zremrangebyrank", proc: zremrangebyrankCommand, arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zremrangebylex", proc: zremrangebylexCommand, arity: 4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zunionstore", proc: zunionstoreCommand, arity: -4, flags: cmdWrite | cmdDenyOOM, getKeys: zunionInterDiffStoreGetKeys},
+	{name: "zinterstore", proc: zinterstoreCommand, arity: -4, flags: cmdWrite | cmdDenyOOM, getKeys: zunionInterDiffStoreGetKeys},
+	{name: "zdiffstore", proc: zdiffstoreCommand, arity: -4, flags: cmdWrite | cmdDenyOOM, getKeys: zunionInterDiffStoreGetKeys},
+	{name: "zunion", proc: zunionCommand, arity: -3, flags: cmdReadonly, getKeys: zunionInterDiffGetKeys},
+	{name: "zinter", proc: zinterCommand, arity: -3, flags: cmdReadonly, getKeys: zunionInterDiffGetKeys},
+	{name: "zdiff", proc: zdiffCommand, arity: -3, flags: cmdReadonly, getKeys: zunionInterDiffGetKeys},
+	{name: "zrange", proc: zrangeCommand, arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zrangestore", proc: zrangestoreCommand, arity: -5, flags: cmdWrite | cmdDenyOOM, firstKey: 1, lastKey: 2, keyStep: 1},
+	{name: "zrangebyscore", proc: zrangebyscoreCommand, arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zrevrangebyscore", proc: zrevrangebyscoreCommand, arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zrangebylex", proc: zrangebylexCommand, arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zrevrangebylex", proc: zrevrangebylexCommand, arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zcount", proc: zcountCommand, arity: 4, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zlexcount", proc: zlexcountCommand, arity: 4, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zrevrange", proc: zrevrangeCommand, arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zcard", proc: zcardCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zscore", proc: zscoreCommand, arity: 3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zmscore", proc: zmscoreCommand, arity: -3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zrank", proc: zrankCommand, arity: -3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zrevrank", proc: zrevrankCommand, arity: -3, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zscan", proc: zscanCommand, arity: -3, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zpopmin", proc: zpopminCommand, arity: -2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "zpopmax", proc: zpopmaxCommand, arity: -2, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "bzpopmin", proc: bzpopminCommand, arity: -3, flags: cmdWrite | cmdNoScript | cmdFast | cmdBlocking, firstKey: 1, lastKey: -2, keyStep: 1},
+	{name: "bzpopmax", proc: bzpopmaxCommand, arity: -3, flags: cmdWrite | cmdNoScript | cmdFast | cmdBlocking, firstKey: 1, lastKey: -2, keyStep: 1},
+	{name: "zrandmember", proc: zrandmemberCommand, arity: -2, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "xadd", proc: xaddCommand, arity: -5, flags: cmdWrite | cmdDenyOOM | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "xrange", proc: xrangeCommand, arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "xrevrange", proc: xrevrangeCommand, arity: -4, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "xlen", proc: xlenCommand, arity: 2, flags: cmdReadonly | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "xdel", proc: xdelCommand, arity: -3, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "xtrim", proc: xtrimCommand, arity: -4, flags: cmdWrite, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "xread", proc: xreadCommand, arity: -4, flags: cmdReadonly | cmdBlocking, getKeys: xreadGetKeys},
+	{name: "xreadgroup", proc: xreadCommand, arity: -7, flags: cmdWrite | cmdBlocking, getKeys: xreadGetKeys},
+	{name: "xgroup", proc: xgroupCommand, arity: -2, flags: cmdWrite, firstKey: 2, lastKey: 2, keyStep: 1},
+	{name: "xack", proc: xackCommand, arity: -4, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "xpending", proc: xpendingCommand, arity: -3, flags: cmdReadonly, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "xclaim", proc: xclaimCommand, arity: -6, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "xautoclaim", proc: xautoclaimCommand, arity: -6, flags: cmdWrite | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "xinfo", proc: xinfoCommand, arity: -2, flags: cmdReadonly, firstKey: 2, lastKey: 2, keyStep: 1},
+	{name: "subscribe", proc: subscribeCommand, arity: -2, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale},
+	{name: "unsubscribe", proc: unsubscribeCommand, arity: -1, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale},
+	{name: "psubscribe", proc: psubscribeCommand, arity: -2, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale},
+	{name: "punsubscribe", proc: punsubscribeCommand, arity: -1, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale},
+	{name: "publish", proc: publishCommand, arity: 3, flags: cmdPubSub | cmdLoading | cmdStale | cmdFast},
+	{name: "pubsub", proc: pubsubCommand, arity: -2, flags: cmdPubSub | cmdLoading | cmdStale},
+	{name: "ssubscribe", proc: ssubscribeCommand, arity: -2, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "sunsubscribe", proc: sunsubscribeCommand, arity: -1, flags: cmdPubSub | cmdNoScript | cmdLoading | cmdStale, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "spublish", proc: spublishCommand, arity: 3, flags: cmdPubSub | cmdLoading | cmdStale | cmdFast, firstKey: 1, lastKey: 1, keyStep: 1},
+	{name: "multi", proc: multiCommand, arity: 1, flags: cmdNoScript | cmdLoading | cmdStale | cmdFast},
+	{name: "exec", proc: execCommand, arity: 1, flags: cmdNoScript | cmdLoading | cmdStale},
+	{name: "discard", proc: discardCommand, arity: 1, flags: cmdNoScript | cmdLoading | cmdStale | cmdFast},
+	{name: "watch", proc: watchCommand, arity: -2, flags: cmdNoScript | cmdLoading | cmdStale | cmdFast, firstKey: 1, lastKey: -1, keyStep: 1},
+	{name: "unwatch", proc: unwatchCommand, arity: 1, flags: cmdNoScript | cmdLoading | cmdStale | cmdFast},
+}
+
+func populateCommandTable() {
+	rServer.commands = make(map[string]*redisCommand, len(commandTable))
+	for _, cmd := range commandTable {
+		rServer.commands[cmd.name] = cmd
+	}
+}
+
+func lookupCommand(name []byte) *redisCommand {
+	return rServer.commands[strings.ToLower(string(name))]
+}
+
+// keyIndexes returns the positions of the keys in argv.
+func (cmd *redisCommand) keyIndexes(argv []*rObj) []int {
+
+	if cmd.getKeys != nil {
+		return cmd.getKeys(argv)
+	}
+
+	if cmd.firstKey == 0 {
+		return nil
+	}
+
+	last := cmd.lastKey
+	if last < 0 {
+		last = len(argv) + last
+	}
+
+	keys := make([]int, 0, (last-cmd.firstKey)/cmd.keyStep+1)
+	for j := cmd.firstKey; j <= last && j < len(argv); j += cmd.keyStep {
+		keys = append(keys, j)
+	}
+	return keys
+
+}
+
+func processCommand(c *client) {
+
+	c.cmd = lookupCommand(c.argv[0].bytes())
+	if c.cmd == nil {
+		var args strings.Builder
+		for j := 1; j < c.argc && args.Len() < 128; j++ {
+			fmt.Fprintf(&args, "'%.*s' ", 128-args.Len(), c.argv[j].data)
+		}
+		rejectCommandFormat(c, "unknown command '%.128s', with args beginning with: %s",
+			c.argv[0].data, args.String())
+		return
+	}
+
+	if (c.cmd.arity > 0 && c.cmd.arity != c.argc) || c.argc < -c.cmd.arity {
+		rejectCommandFormat(c, "wrong number of arguments for '%s' command", c.cmd.name)
+		return
+	}
+
+	if !clientAuthenticated(c) && c.cmd.flags&cmdNoAuth == 0 {
+		rejectCommand(c, "-NOAUTH Authentication required.")
+		return
+	}
+
+	queued := c.flag&clientMulti != 0 && !commandRunsInMulti(c.cmd)
+	if queued && c.cmd.flags&cmdNoMulti != 0 {
+		rejectCommand(c, "Command not allowed inside a transaction")
+		return
+	}
+
+	// a RESP2 connection in subscribed mode only receives messages
+	if c.flag&clientPubSub != 0 && c.resp == 2 {
+		switch c.cmd.name {
+		case "ping", "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ssubscribe", "sunsubscribe", "quit":
+		default:
+			rejectCommandFormat(c, "Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context",
+				c.cmd.name)
+			return
+		}
+	}
+
+	// a write the AOF can't persist is refused, but the ones of our master
+	if c.flag&clientMaster == 0 && (c.cmd.flags&cmdWrite != 0 || (c.cmd.name == "exec" && c.mstate.cmdFlags&cmdWrite != 0)) {
+		if err := aofWriteStatus(); err != nil {
+			rejectCommandFormat(c, "-MISCONF Errors writing to the AOF file: %v", err)
+			return
+		}
+	}
+
+	// the dataset of a replica only changes with the stream of its master
+	if rServer.masterhost != "" && rServer.replSlaveRO && c.flag&clientMaster == 0 &&
+		(c.cmd.flags&cmdWrite != 0 || (c.cmd.name == "exec" && c.mstate.cmdFlags&cmdWrite != 0)) {
+		rejectCommand(c, "-READONLY You can't write against a read only replica.")
+		return
+	}
+
+	if rServer.masterhost != "" && rServer.replState != replStateConnected && !rServer.replServeStaleData &&
+		c.cmd.flags&cmdStale == 0 {
+		rejectCommand(c, "-MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.")
+		return
+	}
+
+	// free memory before the command gets the chance to use more, EXEC
+	// runs the commands queued and queuing itself takes memory.
+	if rServer.maxmemory > 0 {
+		flags := c.cmd.flags
+		if c.cmd.name == "exec" {
+			flags |= c.mstate.cmdFlags
+		}
+		if queued {
+			flags |= cmdDenyOOM
+		}
+		if flags&(cmdWrite|cmdDenyOOM) != 0 && performEvictions() == evictFail && flags&cmdDenyOOM != 0 {
+			rejectCommand(c, "-OOM command not allowed when used memory > 'maxmemory'.")
+			return
+		}
+	}
+
+	if queued {
+		queueMultiCommand(c)
+		addReply(c, shared.queued)
+		return
+	}
+
+	call(c)
+	if len(rServer.readyKeys) > 0 {
+		handleClientsBlockedOnKeys()
+	}
+
+}
+
+// rejectCommand replies err to a command refused before running, failing
+// the transaction it was meant to be queued in.
+func rejectCommand(c *client, err string) {
+	flagTransaction(c)
+	addReplyError(c, err)
+}
+
+func rejectCommandFormat(c *client, format string, a ...any) {
+	flagTransaction(c)
+	addReplyErrorFormat(c, format, a...)
+}
+
+func call(c *client) {
+
+	start := time.Now()
+	cmd, argv := c.cmd, c.argv // the command may rewrite its argv
+	dirty, reploff := rServer.dirty, rServer.masterReplOffset
+	rServer.executionNesting++
+	prevClient := rServer.currentClient
+	rServer.currentClient = c
+	cmd.proc(c)
+	rServer.currentClient = prevClient
+	dirty = rServer.dirty - dirty
+
+	// values modified in place change size, and the clients watching the
+	// keys modified have to know.
+	if cmd.flags&cmdWrite != 0 {
+		for _, j := range cmd.keyIndexes(argv) {
+			key := argv[j].String()
+			dbUpdateKeyMemory(c.db, key)
+			if dirty > 0 {
+				touchWatchedKey(c.db, key)
+			}
+		}
+	}
+
+	// a command changing the dataset is propagated as it was run, or as it
+	// rewrote itself to give the same result when run again.
+	if (dirty > 0 || c.flag&clientForcePropagation != 0) && c.flag&clientPreventPropagation == 0 {
+		alsoPropagate(c.db.id, c.argv)
+	}
+	c.flag &^= clientPreventPropagation | clientForcePropagation
+	rServer.executionNesting--
+	postExecutionUnitOperations()
+
+	// WAIT waits for the offset of the last write of the client
+	if rServer.masterReplOffset != reploff {
+		c.woff = rServer.masterReplOffset
+	}
+
+	cmd.calls++
+	rServer.statNumCommands++
+	cmd.microseconds += time.Since(start).Microseconds()
+
+}
+
+// redisOp is a command to propagate to the AOF and the replicas.
+type redisOp struct {
+	dbid int
+	argv []*rObj
+}
+
+// alsoPropagate queues a command to propagate once the command being run,
+// the execution unit, is done. The commands of a unit are propagated
+// together, in a transaction when there are more than one.
+func alsoPropagate(dbid int, argv []*rObj) {
+	if rServer.loading {
+		return
+	}
+	rServer.alsoPropagate = append(rServer.alsoPropagate, redisOp{dbid: dbid, argv: argv})
+}
+
+// preventCommandPropagation keeps the command being run from being
+// propagated, when it propagated what it did by itself.
+func preventCommandPropagation(c *client) {
+	c.flag |= clientPreventPropagation
+}
+
+// forceCommandPropagation propagates the command being run even when it did
+// not change the dataset, e.g. FLUSHALL of an empty dataset.
+func forceCommandPropagation(c *client) {
+	c.flag |= clientForcePropagation
+}
+
+// postExecutionUnitOperations propagates the commands queued once the
+// outermost unit is done, the changes made outside of a command, e.g. by
+// the active expire cycle, right away.
+func postExecutionUnitOperations() {
+	if rServer.executionNesting == 0 {
+		propagatePendingCommands()
+	}
+}
+
+func propagatePendingCommands() {
+
+	ops := rServer.alsoPropagate
+	if len(ops) == 0 {
+		return
+	}
+	rServer.alsoPropagate = nil
+
+	transaction := len(ops) > 1
+	if transaction {
+		propagateNow(-1, []*rObj{createEmbeddedStringObject("MULTI")})
+	}
+	for _, op := range ops {
+		propagateNow(op.dbid, op.argv)
+	}
+	if transaction {
+		propagateNow(-1, []*rObj{createEmbeddedStringObject("EXEC")})
+	}
+
+}
+
+// propagateNow feeds the command to the AOF and the replicas, dbid -1 means
+// the command does not depend on the selected db.
+func propagateNow(dbid int, argv []*rObj) {
+	if rServer.aofState != aofOff {
+		feedAppendOnlyFile(dbid, argv)
+	}
+	replicationFeedSlaves(dbid, argv)
+}
+
+func pingCommand(c *client) {
+
+	if c.argc > 2 {
+		addReplyErrorFormat(c, "wrong number of arguments for '%s' command", c.cmd.name)
+		return
+	}
+
+	// in subscribed mode the reply is told apart from the messages
+	if c.flag&clientPubSub != 0 && c.resp == 2 {
+		addReplyArrayLen(c, 2)
+		addReplyBulkString(c, "pong")
+		if c.argc == 1 {
+			addReply(c, shared.emptyBulk)
+		} else {
+			addReplyBulk(c, c.argv[1].bytes())
+		}
+		return
+	}
+
+	if c.argc == 1 {
+		addReply(c, shared.pong)
+	} else {
+		addReplyBulk(c, c.argv[1].bytes())
+	}
+
+}
+
+func echoCommand(c *client) {
+	addReplyBulk(c, c.argv[1].bytes())
+}
+
+func quitCommand(c *client) {
+	addReply(c, shared.ok)
+	c.flag |= clientCloseAfterReply
+}
+
+var commandFlagNames = []struct {
+	flag int
+	name string
+}{
+	{cmdWrite, "write"},
+	{cmdReadonly, "readonly"},
+	{cmdDenyOOM, "denyoom"},
+	{cmdAdmin, "admin"},
+	{cmdPubSub, "pubsub"},
+	{cmdNoScript, "noscript"},
+	{cmdBlocking, "blocking"},
+	{cmdLoading, "loading"},
+	{cmdStale, "stale"},
+	{cmdFast, "fast"},
+	{cmdNoMulti, "no_multi"},
+	{cmdNoAuth, "no_auth"},
+}
+
+func addReplyCommandInfo(c *client, cmd *redisCommand) {
+
+	if cmd == nil {
+		addReplyNullArray(c)
+		return
+	}
+
+	addReplyArrayLen(c, 6)
+	addReplyBulkString(c, cmd.name)
+	addReplyLongLong(c, int64(cmd.arity))
+
+	flags := addReplyDeferredLen(c)
+	numFlags := 0
+	for _, f := range commandFlagNames {
+		if cmd.flags&f.flag != 0 {
+			addReplyStatus(c, f.name)
+			numFlags++
+		}
+	}
+	if cmd.getKeys != nil {
+		addReplyStatus(c, "movablekeys")
+		numFlags++
+	}
+	setDeferredSetLen(c, flags, numFlags)
+
+	addReplyLongLong(c, int64(cmd.firstKey))
+	addReplyLongLong(c, int64(cmd.lastKey))
+	addReplyLongLong(c, int64(cmd.keyStep))
+
+}
+
+func commandCommand(c *client) {
+
+	if c.argc == 1 {
+		addReplyArrayLen(c, len(rServer.commands))
+		for _, cmd := range rServer.commands {
+			addReplyCommandInfo(c, cmd)
+		}
+		return
+	}
+
+	sub := strings.ToLower(c.argv[1].String())
+	switch {
+	case sub == "help" && c.argc == 2:
+		addReplyHelp(c, []string{
+			"(no subcommand)",
+			"    Return details about all commands.",
+			"COUNT",
+			"    Return the total number of commands in this server.",
+			"LIST",
+			"    Return a list of all commands in this server.",
+			"INFO [<command-name> ...]",
+			"    Return details about multiple commands.",
+			"GETKEYS <full-command>",
+			"    Return the keys from a full command.",
+		})
+	case sub == "count" && c.argc == 2:
+		addReplyLongLong(c, int64(len(rServer.commands)))
+	case sub == "list" && c.argc == 2:
+		addReplyArrayLen(c, len(rServer.commands))
+		for _, cmd := range rServer.commands {
+			addReplyBulkString(c, cmd.name)
+		}
+	case sub == "info":
+		if c.argc == 2 {
+			addReplyArrayLen(c, len(rServer.commands))
+			for _, cmd := range rServer.commands {
+				addReplyCommandInfo(c, cmd)
+			}
+			return
+		}
+		addReplyArrayLen(c, c.argc-2)
+		for j := 2; j < c.argc; j++ {
+			addReplyCommandInfo(c, lookupCommand(c.argv[j].bytes()))
+		}
+	case sub == "getkeys" && c.argc >= 3:
+		commandGetKeys(c)
+	default:
+		addReplySubcommandSyntaxError(c)
+	}
+
+}
+
+func commandGetKeys(c *client) {
+
+	argv := c.argv[2:]
+	cmd := lookupCommand(argv[0].bytes())
+	if cmd == nil {
+		addReplyError(c, "Invalid command specified")
+		return
+	}
+	if (cmd.arity > 0 && cmd.arity != len(argv)) || len(argv) < -cmd.arity {
+		addReplyError(c, "Invalid number of arguments specified for command")
+		return
+	}
+
+	keys := cmd.keyIndexes(argv)
+	if len(keys) == 0 {
+		addReplyError(c, "The command has no key arguments")
+		return
+	}
+	addReplyArrayLen(c, len(keys))
+	for _, j := range keys {
+		addReplyBulk(c, argv[j].bytes())
+	}
+
+}
+
+func addReplySubcommandSyntaxError(c *client) {
+	addReplyErrorFormat(c, "unknown subcommand or wrong number of arguments for '%.128s'. Try %s HELP.",
+		c.argv[min(c.argc-1, 1)].data, strings.ToUpper(c.cmd.name))
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config flags
+const (
+	configImmutable = 1 << iota // can only be set at startup
+)
+
+// standardConfig is a single entry of the configTable. set validates the
+// value before storing it, apply runs after CONFIG SET changed the value.
+type standardConfig struct {
+	name  string
+	flags int
+	get   func() string
+	set   func(val string) error
+	init  func()
+	apply func() error
+}
+
+type configEnum struct {
+	name  string
+	value int
+}
+
+func createBoolConfig(name string, flags int, config *bool, def bool) *standardConfig {
+	return &standardConfig{
+		name:  name,
+		flags: flags,
+		get: func() string {
+			if *config {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(val string) error {
+			switch strings.ToLower(val) {
+			case "yes":
+				*config = true
+			case "no":
+				*config = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+		init: func() {
+			*config = def
+		},
+	}
+}
+
+func createStringConfig(name string, flags int, config *string, def string) *standardConfig {
+	return &standardConfig{
+		name:  name,
+		flags: flags,
+		get: func() string {
+			return *config
+		},
+		set: func(val string) error {
+			*config = val
+			return nil
+		},
+		init: func() {
+			*config = def
+		},
+	}
+}
+
+func createIntConfig(name string, flags int, config *int, lower, upper, def int) *standardConfig {
+	return &standardConfig{
+		name:  name,
+		flags: flags,
+		get: func() string {
+			return strconv.Itoa(*config)
+		},
+		set: func(val string) error {
+			v, ok := string2ll([]byte(val))
+			if !ok {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			if v < int64(lower) || v > int64(upper) {
+				return fmt.Errorf("argument must be between %d and %d inclusive", lower, upper)
+			}
+			*config = int(v)
+			return nil
+		},
+		init: func() {
+			*config = def
+		},
+	}
+}
+
+// createMemoryConfig accepts byte counts with the k, kb, m, mb, g and gb
+// units.
+func createMemoryConfig(name string, flags int, config *int64, lower, upper, def int64) *standardConfig {
+	return &standardConfig{
+		name:  name,
+		flags: flags,
+		get: func() string {
+			return strconv.FormatInt(*config, 10)
+		},
+		set: func(val string) error {
+			v, ok := memtoll(val)
+			if !ok {
+				return errors.New("argument must be a memory value")
+			}
+			if v < lower || v > upper {
+				return fmt.Errorf("argument must be between %d and %d inclusive", lower, upper)
+			}
+			*config = v
+			return nil
+		},
+		init: func() {
+			*config = def
+		},
+	}
+}
+
+func createEnumConfig(name string, flags int, config *int, enum []configEnum, def int) *standardConfig {
+	return &standardConfig{
+		name:  name,
+		flags: flags,
+		get: func() string {
+			for _, e := range enum {
+				if e.value == *config {
+					return e.name
+				}
+			}
+			return ""
+		},
+		set: func(val string) error {
+			for _, e := range enum {
+				if strings.EqualFold(e.name, val) {
+					*config = e.value
+					return nil
+				}
+			}
+			names := make([]string, len(enum))
+			for j, e := range enum {
+				names[j] = e.name
+			}
+			return errors.New("argument(s) must be one of the following: " + strings.Join(names, ", "))
+		},
+		init: func() {
+			*config = def
+		},
+	}
+}
+
+// createSpecialConfig is a config parsed and formatted by its own
+// functions.
+func createSpecialConfig(name string, flags int, get func() string, set func(val string) error, def string) *standardConfig {
+	return &standardConfig{
+		name:  name,
+		flags: flags,
+		get:   get,
+		set:   set,
+		init: func() {
+			if err := set(def); err != nil {
+				panic(err)
+			}
+		},
+	}
+}
+
+func (config *standardConfig) withApply(apply func() error) *standardConfig {
+	config.apply = apply
+	return config
+}
+
+// memtoll parses a memory amount like 100, 1k, 10mb or 2GB.
+func memtoll(s string) (int64, bool) {
+
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"gb", 1024 * 1024 * 1024},
+		{"mb", 1024 * 1024},
+		{"kb", 1024},
+		{"g", 1000 * 1000 * 1000},
+		{"m", 1000 * 1000},
+		{"k", 1000},
+		{"b", 1},
+	}
+
+	mul := int64(1)
+	lower := strings.ToLower(s)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			mul = u.mul
+			s = s[:len(s)-len(u.suffix)]
+			break
+		}
+	}
+
+	v, ok := string2ll([]byte(s))
+	if !ok || v > math.MaxInt64/mul || v < math.MinInt64/mul {
+		return 0, false
+	}
+	return v * mul, true
+
+}
+
+var configTable = []*standardConfig{
+	createIntConfig("port", configImmutable, &rServer.port, 0, 65535, defaultPort),
+	createStringConfig("bind", configImmutable, &rServer.bindAddr, ""),
+	createIntConfig("hz", 0, &rServer.hz, 1, 500, defaultHz),
+	createStringConfig("requirepass", 0, &rServer.requirePass, ""),
+	createMemoryConfig("maxmemory", 0, &rServer.maxmemory, 0, math.MaxInt64, 0).withApply(updateMaxmemory),
+	createEnumConfig("maxmemory-policy", 0, &rServer.maxmemoryPolicy, maxmemoryPolicyEnum, maxmemoryNoEviction),
+	createIntConfig("maxmemory-samples", 0, &rServer.maxmemorySamples, 1, 64, 5),
+	createIntConfig("lfu-log-factor", 0, &rServer.lfuLogFactor, 0, math.MaxInt32, 10),
+	createIntConfig("lfu-decay-time", 0, &rServer.lfuDecayTime, 0, math.MaxInt32, 1),
+	createIntConfig("hash-max-listpack-entries", 0, &rServer.hashMaxListpackEntries, 0, math.MaxInt32, 128),
+	createIntConfig("hash-max-listpack-value", 0, &rServer.hashMaxListpackValue, 0, math.MaxInt32, 64),
+	createIntConfig("list-max-listpack-size", 0, &rServer.listMaxListpackSize, -5, 1<<15, -2),
+	createIntConfig("list-compress-depth", 0, &rServer.listCompressDepth, 0, math.MaxInt32, 0),
+	createIntConfig("set-max-intset-entries", 0, &rServer.setMaxIntsetEntries, 0, math.MaxInt32, 512),
+	createIntConfig("zset-max-listpack-entries", 0, &rServer.zsetMaxListpackEntries, 0, math.MaxInt32, 128),
+	createIntConfig("zset-max-listpack-value", 0, &rServer.zsetMaxListpackValue, 0, math.MaxInt32, 64),
+	createMemoryConfig("stream-node-max-bytes", 0, &rServer.streamNodeMaxBytes, 0, math.MaxInt64, 4096),
+	createIntConfig("stream-node-max-entries", 0, &rServer.streamNodeMaxEntries, 0, math.MaxInt64, 100),
+	createSpecialConfig("dir", 0, getDirConfig, setDirConfig, "."),
+	createSpecialConfig("dbfilename", 0, getDbfilenameConfig, setDbfilenameConfig, "dump.rdb"),
+	createSpecialConfig("save", 0, getSaveConfig, setSaveConfig, "3600 1 300 100 60 10000"),
+	createBoolConfig("rdbcompression", 0, &rServer.rdbCompression, true),
+	createBoolConfig("rdbchecksum", 0, &rServer.rdbChecksum, true),
+	createBoolConfig("appendonly", 0, &rServer.aofEnabled, false).withApply(updateAppendonly),
+	createSpecialConfig("appendfilename", configImmutable, getAppendfilenameConfig, setAppendfilenameConfig, "appendonly.aof"),
+	createEnumConfig("appendfsync", 0, &rServer.aofFsync, aofFsyncEnum, aofFsyncEverysec),
+	createBoolConfig("aof-load-truncated", 0, &rServer.aofLoadTruncated, true),
+	createSpecialConfig("appenddirname", configImmutable, getAppenddirnameConfig, setAppenddirnameConfig, "appendonlydir"),
+	createIntConfig("auto-aof-rewrite-percentage", 0, &rServer.aofRewritePerc, 0, math.MaxInt32, 100),
+	createMemoryConfig("auto-aof-rewrite-min-size", 0, &rServer.aofRewriteMinSize, 0, math.MaxInt64, 64<<20),
+	createSpecialConfig("replicaof", configImmutable, getReplicaofConfig, setReplicaofConfig, ""),
+	createStringConfig("masteruser", 0, &rServer.masteruser, ""),
+	createStringConfig("masterauth", 0, &rServer.masterauth, ""),
+	createMemoryConfig("repl-backlog-size", 0, &rServer.replBacklogSize, replBacklogMinSize, math.MaxInt64, 1<<20).withApply(resizeReplicationBacklog),
+	createIntConfig("repl-backlog-ttl", 0, &rServer.replBacklogTTL, 0, math.MaxInt32, 3600),
+	createIntConfig("repl-timeout", 0, &rServer.replTimeout, 1, math.MaxInt32, 60),
+	createIntConfig("repl-ping-replica-period", 0, &rServer.replPingSlavePeriod, 1, math.MaxInt32, 10),
+	createBoolConfig("replica-read-only", 0, &rServer.replSlaveRO, true),
+	createBoolConfig("replica-serve-stale-data", 0, &rServer.replServeStaleData, true),
+	createBoolConfig("replica-ignore-maxmemory", 0, &rServer.replIgnoreMaxmemory, true),
+	createBoolConfig("repl-diskless-sync", 0, &rServer.replDisklessSync, true),
+	createIntConfig("repl-diskless-sync-delay", 0, &rServer.replDisklessSyncDelay, 0, math.MaxInt32, 5),
+	createIntConfig("repl-diskless-sync-max-replicas", 0, &rServer.replDisklessSyncMaxReplicas, 0, math.MaxInt32, 0),
+	createEnumConfig("repl-diskless-load", 0, &rServer.replDisklessLoad, replDisklessLoadEnum, replDisklessLoadDisabled),
+}
+
+func getDirConfig() string {
+	return rServer.dir
+}
+
+// setDirConfig sets the directory of the rdb file, the server does not
+// change its working directory.
+func setDirConfig(val string) error {
+	if info, err := os.Stat(val); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", val)
+	}
+	rServer.dir = val
+	return nil
+}
+
+func getDbfilenameConfig() string {
+	return rServer.rdbFilename
+}
+
+func setDbfilenameConfig(val string) error {
+	if val == "" || strings.ContainsRune(val, '/') {
+		return errors.New("dbfilename can't be a path, just a filename")
+	}
+	rServer.rdbFilename = val
+	return nil
+}
+
+func getSaveConfig() string {
+	parts := make([]string, 0, len(rServer.saveParams)*2)
+	for _, sp := range rServer.saveParams {
+		parts = append(parts, strconv.FormatInt(int64(sp.seconds/time.Second), 10), strconv.FormatInt(sp.changes, 10))
+	}
+	return strings.Join(parts, " ")
+}
+
+// setSaveConfig parses the save points, "<seconds> <changes>" pairs, an
+// empty string disables them.
+func setSaveConfig(val string) error {
+
+	args := strings.Fields(val)
+	if len(args)%2 != 0 {
+		return errors.New("Invalid save parameters")
+	}
+	params := make([]saveParam, 0, len(args)/2)
+	for j := 0; j < len(args); j += 2 {
+		seconds, ok := string2ll([]byte(args[j]))
+		changes, ok2 := string2ll([]byte(args[j+1]))
+		if !ok || !ok2 || seconds < 1 || seconds > math.MaxInt32 || changes < 0 {
+			return errors.New("Invalid save parameters")
+		}
+		params = append(params, saveParam{seconds: time.Duration(seconds) * time.Second, changes: changes})
+	}
+	rServer.saveParams = params
+	return nil
+
+}
+
+func lookupConfig(name string) *standardConfig {
+	for _, config := range configTable {
+		if strings.EqualFold(config.name, name) {
+			return config
+		}
+	}
+	return nil
+}
+
+// initServerConfig sets every config to its default.
+func initServerConfig() {
+	for _, config := range configTable {
+		config.init()
+	}
+}
+
+// loadServerConfigFromArgs parses the command line, "--name value" pairs
+// like redis-server accepts.
+func loadServerConfigFromArgs(args []string) error {
+
+	for j := 0; j < len(args); j++ {
+		if !strings.HasPrefix(args[j], "--") {
+			return fmt.Errorf("invalid argument '%s', options must start with --", args[j])
+		}
+		config := lookupConfig(args[j][2:])
+		if config == nil {
+			return fmt.Errorf("bad directive or wrong number of arguments, '%s'", args[j][2:])
+		}
+		if j+1 >= len(args) {
+			return fmt.Errorf("missing value of '%s'", config.name)
+		}
+		if err := config.set(args[j+1]); err != nil {
+			return fmt.Errorf("invalid value of '%s', %v", config.name, err)
+		}
+		j++
+	}
+	return nil
+
+}
+
+func configGetCommand(c *client) {
+
+	matches := make(map[string]*standardConfig)
+	for j := 2; j < c.argc; j++ {
+		pattern := c.argv[j].String()
+		for _, config := range configTable {
+			if stringmatch(pattern, config.name, true) {
+				matches[config.name] = config
+			}
+		}
+	}
+
+	names := make([]string, 0, len(matches))
+	for name := range matches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	addReplyMapLen(c, len(names))
+	for _, name := range names {
+		addReplyBulkString(c, name)
+		addReplyBulkString(c, matches[name].get())
+	}
+
+}
+
+// configSetCommand sets all the given configs or none of them.
+func configSetCommand(c *client) {
+
+	if c.argc < 4 || c.argc%2 != 0 {
+		addReplySubcommandSyntaxError(c)
+		return
+	}
+
+	var configs []*standardConfig
+	var olds []string
+	restore := func() {
+		for j := len(configs) - 1; j >= 0; j-- {
+			_ = configs[j].set(olds[j])
+		}
+	}
+
+	for j := 2; j < c.argc; j += 2 {
+		name := c.argv[j].String()
+		config := lookupConfig(name)
+		if config == nil || config.flags&configImmutable != 0 {
+			restore()
+			addReplyErrorFormat(c, "Unknown option or number of arguments for CONFIG SET - '%s'", name)
+			return
+		}
+		for _, set := range configs {
+			if set == config {
+				restore()
+				addReplyErrorFormat(c, "CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", name)
+				return
+			}
+		}
+
+		old := config.get()
+		if err := config.set(c.argv[j+1].String()); err != nil {
+			restore()
+			addReplyErrorFormat(c, "CONFIG SET failed (possibly related to argument '%s') - %v", name, err)
+			return
+		}
+		configs = append(configs, config)
+		olds = append(olds, old)
+	}
+
+	for _, config := range configs {
+		if config.apply == nil {
+			continue
+		}
+		if err := config.apply(); err != nil {
+			restore()
+			addReplyErrorFormat(c, "CONFIG SET failed (possibly related to argument '%s') - %v", config.name, err)
+			return
+		}
+	}
+	addReply(c, shared.ok)
+
+}
+
+func configCommand(c *client) {
+
+	sub := strings.ToLower(c.argv[1].String())
+	switch {
+	case sub == "help" && c.argc == 2:
+		addReplyHelp(c, []string{
+			"GET <pattern>",
+			"    Return parameters matching the glob-like <pattern> and their values.",
+			"SET <directive> <value>",
+			"    Set the configuration <directive> to <value>.",
+		})
+	case sub == "get" && c.argc >= 3:
+		configGetCommand(c)
+	case sub == "set" && c.argc >= 4:
+		configSetCommand(c)
+	default:
+		addReplySubcommandSyntaxError(c)
+	}
+
+}
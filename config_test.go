@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConfig_GetSet(t *testing.T) {
+	tc := newTestConn(t)
+
+	tc.expect([]any{"maxmemory", "0", "maxmemory-policy", "noeviction", "maxmemory-samples", "5"}, "config", "get", "maxmemory*")
+	tc.expect([]any{"hz", "10", "port", "6379"}, "config", "get", "HZ", "port")
+	tc.expect([]any{}, "config", "get", "nosuchconfig")
+
+	tc.expect(testStatus("OK"), "config", "set", "maxmemory-samples", "10", "hz", "20")
+	tc.expect([]any{"hz", "20", "maxmemory-samples", "10"}, "config", "get", "hz", "maxmemory-samples")
+
+	// nothing changes when a single value is invalid
+	tc.expectError("ERR CONFIG SET failed (possibly related to argument 'maxmemory-samples') - argument must be between 1 and 64 inclusive",
+		"config", "set", "hz", "30", "maxmemory-samples", "100")
+	tc.expectError("ERR CONFIG SET failed (possibly related to argument 'maxmemory-policy') - argument(s) must be one of the following",
+		"config", "set", "maxmemory-policy", "nope")
+	tc.expectError("ERR Unknown option or number of arguments for CONFIG SET - 'port'", "config", "set", "port", "1")
+	tc.expectError("ERR CONFIG SET failed (possibly related to argument 'hz') - duplicate parameter", "config", "set", "hz", "1", "hz", "2")
+	tc.expect([]any{"hz", "20"}, "config", "get", "hz")
+
+	tc.expect(testStatus("OK"), "config", "set", "hz", "10", "maxmemory-samples", "5")
+}
+
+func TestConfig_Memtoll(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"100", 100, true},
+		{"1k", 1000, true},
+		{"1kb", 1024, true},
+		{"2MB", 2 * 1024 * 1024, true},
+		{"3g", 3000000000, true},
+		{"-1", -1, true},
+		{"1x", 0, false},
+		{"gb", 0, false},
+	} {
+		got, ok := memtoll(tt.s)
+		if got != tt.want || ok != tt.ok {
+			t.Fatalf("memtoll(%q): want %d, %v, got %d, %v", tt.s, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestStringmatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, s string
+		nocase     bool
+		want       bool
+	}{
+		{"*", "anything", false, true},
+		{"h?llo", "hello", false, true},
+		{"h*llo", "heeeello", false, true},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"HELLO", "hello", true, true},
+		{"HELLO", "hello", false, false},
+		{"a*b*c", "axxbyyc", false, true},
+		{"a*b*c", "axxbyy", false, false},
+		{"", "", false, true},
+	} {
+		if got := stringmatch(tt.pattern, tt.s, tt.nocase); got != tt.want {
+			t.Fatalf("stringmatch(%q, %q): want %v, got %v", tt.pattern, tt.s, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "strings"
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum, polynomial 0x1021 with 0 as
+// initial value, used to map keys to hash slots.
+
+var crc16tab = func() (tab [256]uint16) {
+	for j := range tab {
+		crc := uint16(j) << 8
+		for k := 0; k < 8; k++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		tab[j] = crc
+	}
+	return tab
+}()
+
+func crc16(buf []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range buf {
+		crc = crc<<8 ^ crc16tab[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// clusterSlots is the number of hash slots keys are mapped to.
+const clusterSlots = 16384
+
+// keyHashSlot returns the hash slot of key. When the key contains a {...}
+// hash tag with something inside, only the tag is hashed, so related keys
+// can be forced in the same slot.
+func keyHashSlot(key string) int {
+
+	if s := strings.IndexByte(key, '{'); s != -1 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16([]byte(key)) & (clusterSlots - 1))
+
+}
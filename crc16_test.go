@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestKeyHashSlot(t *testing.T) {
+	if got := crc16([]byte("123456789")); got != 0x31c3 {
+		t.Fatalf("want crc16 0x31c3, got %#x", got)
+	}
+	for key, want := range map[string]int{
+		"foo":                  12182,
+		"{user1000}.following": keyHashSlot("user1000"),
+		"foo{}{bar}":           int(crc16([]byte("foo{}{bar}")) % clusterSlots),
+		"foo{{bar}}zap":        keyHashSlot("{bar"),
+		"foo{bar}{zap}":        keyHashSlot("bar"),
+	} {
+		if got := keyHashSlot(key); got != want {
+			t.Fatalf("%s: want slot %d, got %d", key, want, got)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import "hash/crc64"
+
+// The rdb files are checksummed with the CRC64 Jones of redis, polynomial
+// 0xad93d23594c935a9 reflected, with 0 as initial value and no final xor.
+
+var crc64JonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crc64Update updates crc with buf. The standard package inverts the crc
+// before and after the update, inverting it on both sides cancels that out.
+func crc64Update(crc uint64, buf []byte) uint64 {
+	return ^crc64.Update(^crc, crc64JonesTable, buf)
+}
@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestCrc64(t *testing.T) {
+	if got := crc64Update(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("want crc64 0xe9c6d914c4b8d9ca, got %#x", got)
+	}
+	// the checksum can be computed in pieces
+	if got := crc64Update(crc64Update(0, []byte("1234")), []byte("56789")); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("want incremental crc64 0xe9c6d914c4b8d9ca, got %#x", got)
+	}
+}
@@ -0,0 +1,755 @@
+package main
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDbNum = 16
+	// rehash budget of a BeforeSleep call, in buckets.
+	rehashBeforeSleepBuckets = 100
+)
+
+type redisDb struct {
+	dict    *dict // the keyspace
+	expires *dict // key -> unix time in ms at which the key expires
+	id      int
+
+	expiresCursor uint64 // where the active expire cycle resumes sampling
+	usedMemory    int64  // approximate size of the keys and values
+
+	blockingKeys map[string]*list.List // key -> clients blocked on it, FIFO
+	readyKeys    map[string]struct{}   // blocking keys already in server.readyKeys
+	watchedKeys  map[string]*list.List // key -> clients WATCHing it
+}
+
+func initDb() {
+	rServer.dbnum = defaultDbNum
+	rServer.db = createDbArray(rServer.dbnum)
+}
+
+func createDbArray(dbnum int) []*redisDb {
+	dbs := make([]*redisDb, dbnum)
+	for j := range dbs {
+		dbs[j] = &redisDb{
+			dict:         newDict(),
+			expires:      newDict(),
+			id:           j,
+			blockingKeys: make(map[string]*list.List),
+			readyKeys:    make(map[string]struct{}),
+			watchedKeys:  make(map[string]*list.List),
+		}
+	}
+	return dbs
+}
+
+func selectDb(c *client, id int64) bool {
+	if id < 0 || id >= int64(rServer.dbnum) {
+		return false
+	}
+	c.db = rServer.db[id]
+	return true
+}
+
+func lookupKey(db *redisDb, key string) *rObj {
+	// a replica keeps the expired key until the DEL of its master, but it
+	// is already logically gone.
+	if expireIfNeeded(db, key) {
+		return nil
+	}
+	val, ok := db.dict.fetchValue(key)
+	if !ok {
+		return nil
+	}
+	o := dbUnshareValue(db, key, val.(*rObj))
+	updateObjectAccess(o)
+	return o
+}
+
+// dbUnshareValue replaces the value of key by a copy when the goroutine of a
+// background save may still read it, the copy is the one the command reads
+// and modifies. Even a read only command can rehash a dict, so every lookup
+// goes through it. Like a page of a fork, a value is copied at most once per
+// save. Embedded and int encoded strings are immutable and never copied.
+func dbUnshareValue(db *redisDb, key string, o *rObj) *rObj {
+
+	if o.snapshot != rServer.snapshotEpoch || !hasActiveChildProcess() {
+		return o
+	}
+	if o.objectType == objectTypeString && o.encoding != objectEncodingRaw {
+		return o
+	}
+	dup := rdbDupObject(o)
+	dup.lru, dup.memory = o.lru, o.memory
+	db.dict.replace(key, dup)
+	return dup
+
+}
+
+func keyMemoryOverhead(key string) int64 {
+	return int64(len(key)) + stringHeaderOverhead + dictEntryOverhead
+}
+
+// dbAccountObject sets the accounted size of a value entering db.
+func dbAccountObject(db *redisDb, o *rObj) {
+	o.memory = objectComputeSize(o)
+	db.usedMemory += o.memory
+}
+
+// dbUpdateKeyMemory accounts the changes of a value modified in place.
+func dbUpdateKeyMemory(db *redisDb, key string) {
+	o := lookupKeyNoTouch(db, key)
+	if o == nil {
+		return
+	}
+	db.usedMemory -= o.memory
+	dbAccountObject(db, o)
+}
+
+// lookupKeyRead looks up key for read only commands.
+func lookupKeyRead(db *redisDb, key string) *rObj {
+	return lookupKey(db, key)
+}
+
+// lookupKeyWrite looks up key for commands that are about to modify it.
+func lookupKeyWrite(db *redisDb, key string) *rObj {
+	return lookupKey(db, key)
+}
+
+func lookupKeyReadOrReply(c *client, key string, reply []byte) *rObj {
+	o := lookupKeyRead(c.db, key)
+	if o == nil {
+		addReply(c, reply)
+	}
+	return o
+}
+
+func lookupKeyWriteOrReply(c *client, key string, reply []byte) *rObj {
+	o := lookupKeyWrite(c.db, key)
+	if o == nil {
+		addReply(c, reply)
+	}
+	return o
+}
+
+// dbAdd adds a key that must not exist yet.
+func dbAdd(db *redisDb, key string, val *rObj) {
+	if !db.dict.add(key, val) {
+		panic("dbAdd: key already exists, key=" + key)
+	}
+	initObjectAccess(val)
+	db.usedMemory += keyMemoryOverhead(key)
+	dbAccountObject(db, val)
+	signalKeyAsReady(db, key)
+}
+
+// dbOverwrite replaces the value of a key that must exist.
+func dbOverwrite(db *redisDb, key string, val *rObj) {
+	old := lookupKeyNoTouch(db, key)
+	if old == nil {
+		panic("dbOverwrite: key does not exist, key=" + key)
+	}
+	// the access frequency survives the new value
+	if rServer.maxmemoryPolicy&maxmemoryFlagLFU != 0 {
+		val.lru = old.lru
+	} else {
+		initObjectAccess(val)
+	}
+	db.dict.replace(key, val)
+	db.usedMemory -= old.memory
+	dbAccountObject(db, val)
+	signalKeyAsReady(db, key)
+}
+
+// setKey is the high level way to set a key, adding or overwriting it. The
+// time to live is removed unless keepTTL is set.
+func setKey(db *redisDb, key string, val *rObj, keepTTL bool) {
+	if lookupKeyNoTouch(db, key) == nil {
+		dbAdd(db, key, val)
+	} else {
+		dbOverwrite(db, key, val)
+	}
+	if !keepTTL {
+		removeExpire(db, key)
+	}
+}
+
+func dbExists(db *redisDb, key string) bool {
+	return db.dict.find(key) != nil
+}
+
+func dbDelete(db *redisDb, key string) bool {
+	de := db.dict.delete(key)
+	if de == nil {
+		return false
+	}
+	db.usedMemory -= keyMemoryOverhead(key) + de.val.(*rObj).memory
+	removeExpire(db, key)
+	return true
+}
+
+func setExpire(db *redisDb, key string, when int64) {
+	if db.expires.replace(key, when) {
+		db.usedMemory += dictEntryOverhead
+	}
+}
+
+// getExpire returns the expire time of key in unix ms, or -1 if the key has
+// no associated expire.
+func getExpire(db *redisDb, key string) int64 {
+	when, ok := db.expires.fetchValue(key)
+	if !ok {
+		return -1
+	}
+	return when.(int64)
+}
+
+func removeExpire(db *redisDb, key string) bool {
+	if db.expires.delete(key) == nil {
+		return false
+	}
+	db.usedMemory -= dictEntryOverhead
+	return true
+}
+
+// keyIsExpired tells if the time to live of key elapsed. Nothing expires
+// while loading, the commands of the AOF run on the keys they found.
+func keyIsExpired(db *redisDb, key string) bool {
+	if rServer.loading {
+		return false
+	}
+	when := getExpire(db, key)
+	return when >= 0 && when < mstime()
+}
+
+// expireIfNeeded deletes key if its time to live elapsed, it returns true if
+// the key was deleted. A replica waits for the DEL of its master, the key
+// only looks deleted to its clients meanwhile.
+func expireIfNeeded(db *redisDb, key string) bool {
+
+	if !keyIsExpired(db, key) {
+		return false
+	}
+	if rServer.masterhost != "" {
+		return rServer.currentClient == nil || rServer.currentClient.flag&clientMaster == 0
+	}
+	deleteExpiredKey(db, key)
+	return true
+
+}
+
+// emptyDb removes every key of db dbnum, or of all the dbs if dbnum is -1.
+// It returns the number of keys removed.
+func emptyDb(dbnum int) int64 {
+
+	var removed int64
+	for j := 0; j < rServer.dbnum; j++ {
+		if dbnum != -1 && dbnum != j {
+			continue
+		}
+		touchAllWatchedKeysInDb(rServer.db[j], nil)
+		removed += int64(rServer.db[j].dict.size())
+		// the old tables are left to the garbage collector, so flushing a
+		// huge db does not block the event loop.
+		rServer.db[j].dict = newDict()
+		rServer.db[j].expires = newDict()
+		rServer.db[j].expiresCursor = 0
+		rServer.db[j].usedMemory = 0
+	}
+	return removed
+
+}
+
+// dbTotalServerKeyCount returns the number of keys of all the dbs.
+func dbTotalServerKeyCount() int64 {
+	var total int64
+	for _, db := range rServer.db {
+		total += int64(db.dict.size())
+	}
+	return total
+}
+
+// dbSwapDatabases swaps the keyspaces, clients stay connected to the same db
+// index and see the data of the other db.
+func dbSwapDatabases(id1, id2 int) bool {
+
+	if id1 < 0 || id1 >= rServer.dbnum || id2 < 0 || id2 >= rServer.dbnum {
+		return false
+	}
+	if id1 == id2 {
+		return true
+	}
+
+	db1, db2 := rServer.db[id1], rServer.db[id2]
+	// the clients watching keys stay with the db index too
+	touchAllWatchedKeysInDb(db1, db2)
+	touchAllWatchedKeysInDb(db2, db1)
+
+	db1.dict, db2.dict = db2.dict, db1.dict
+	db1.expires, db2.expires = db2.expires, db1.expires
+	db1.expiresCursor, db2.expiresCursor = db2.expiresCursor, db1.expiresCursor
+	db1.usedMemory, db2.usedMemory = db2.usedMemory, db1.usedMemory
+
+	// the blocked clients stay with the db index, the keys they wait for may
+	// exist in the swapped dataset.
+	scanDatabaseForReadyKeys(db1)
+	scanDatabaseForReadyKeys(db2)
+	return true
+
+}
+
+// swapMainDbWithTempDb replaces the dataset with the one of tempDb, e.g.
+// loaded by a replica from the socket of its master. The clients blocked
+// on keys and watching keys stay with the db they use.
+func swapMainDbWithTempDb(tempDb []*redisDb) {
+
+	for j, db := range rServer.db {
+		tdb := tempDb[j]
+		touchAllWatchedKeysInDb(db, tdb)
+
+		db.dict, tdb.dict = tdb.dict, db.dict
+		db.expires, tdb.expires = tdb.expires, db.expires
+		db.expiresCursor, tdb.expiresCursor = tdb.expiresCursor, db.expiresCursor
+		db.usedMemory, tdb.usedMemory = tdb.usedMemory, db.usedMemory
+
+		scanDatabaseForReadyKeys(db)
+	}
+
+}
+
+// databasesCron shrinks the tables that got too sparse and spends a
+// millisecond per db on incremental rehashing.
+func databasesCron() {
+
+	for j := 0; j < rServer.dbnum; j++ {
+		for _, d := range []*dict{rServer.db[j].dict, rServer.db[j].expires} {
+			if d.needsResize() {
+				d.resize()
+			}
+		}
+	}
+
+	for j := 0; j < rServer.dbnum; j++ {
+		db := rServer.db[j]
+		if db.dict.isRehashing() && db.dict.rehashMilliseconds(1) > 0 {
+			// one db per call, so the cron stays short.
+			break
+		}
+		if db.expires.isRehashing() && db.expires.rehashMilliseconds(1) > 0 {
+			break
+		}
+	}
+
+}
+
+// databasesRehashBeforeSleep gives a small bounded rehash budget to every
+// event loop iteration, so busy servers don't rely on the cron only.
+func databasesRehashBeforeSleep() {
+
+	for j := 0; j < rServer.dbnum; j++ {
+		for _, d := range []*dict{rServer.db[j].dict, rServer.db[j].expires} {
+			if d.isRehashing() && d.pauseRehash == 0 {
+				d.rehash(rehashBeforeSleepBuckets)
+				return
+			}
+		}
+	}
+
+}
+
+func serverCron(el *EventLoop, timerId int64, clientData any) time.Duration {
+
+	rServer.lruclock = getLRUClock()
+
+	databasesCron()
+
+	rdbCron()
+
+	aofCron()
+
+	replicationCheckTransfers()
+	if rServer.cronLoops%int64(rServer.hz) == 0 {
+		replicationCron()
+	}
+
+	rServer.cronLoops++
+	return time.Second / time.Duration(rServer.hz)
+
+}
+
+func getFlushCommandFlags(c *client) bool {
+
+	if c.argc > 2 {
+		addReplyError(c, "syntax error")
+		return false
+	}
+	if c.argc == 2 {
+		arg := c.argv[1].String()
+		if !strings.EqualFold(arg, "sync") && !strings.EqualFold(arg, "async") {
+			addReplyError(c, "syntax error")
+			return false
+		}
+	}
+	return true
+
+}
+
+func selectCommand(c *client) {
+
+	id, ok := getLongLongFromObjectOrReply(c, c.argv[1], "")
+	if !ok {
+		return
+	}
+
+	if !selectDb(c, id) {
+		addReplyError(c, "DB index is out of range")
+		return
+	}
+	addReply(c, shared.ok)
+
+}
+
+func swapdbCommand(c *client) {
+
+	id1, ok := getLongLongFromObjectOrReply(c, c.argv[1], "invalid first DB index")
+	if !ok {
+		return
+	}
+	id2, ok := getLongLongFromObjectOrReply(c, c.argv[2], "invalid second DB index")
+	if !ok {
+		return
+	}
+
+	if id1 < 0 || id1 >= int64(rServer.dbnum) || id2 < 0 || id2 >= int64(rServer.dbnum) {
+		addReplyError(c, "DB index is out of range")
+		return
+	}
+
+	dbSwapDatabases(int(id1), int(id2))
+	rServer.dirty++
+	addReply(c, shared.ok)
+
+}
+
+func moveCommand(c *client) {
+
+	id, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+	if id < 0 || id >= int64(rServer.dbnum) {
+		addReplyError(c, "DB index is out of range")
+		return
+	}
+
+	src, dst := c.db, rServer.db[id]
+	if src == dst {
+		addReplyError(c, "source and destination objects are the same")
+		return
+	}
+
+	key := c.argv[1].String()
+	o := lookupKeyWrite(src, key)
+	if o == nil || lookupKeyWrite(dst, key) != nil {
+		addReply(c, shared.czero)
+		return
+	}
+
+	expire := getExpire(src, key)
+	dbAdd(dst, key, o)
+	if expire != -1 {
+		setExpire(dst, key, expire)
+	}
+	dbDelete(src, key)
+	touchWatchedKey(dst, key)
+	rServer.dirty++
+	addReply(c, shared.cone)
+
+}
+
+func dbsizeCommand(c *client) {
+	addReplyLongLong(c, int64(c.db.dict.size()))
+}
+
+func flushdbCommand(c *client) {
+
+	if !getFlushCommandFlags(c) {
+		return
+	}
+	rServer.dirty += emptyDb(c.db.id)
+	// propagated even when the db was empty already
+	forceCommandPropagation(c)
+	addReply(c, shared.ok)
+
+}
+
+func flushallCommand(c *client) {
+
+	if !getFlushCommandFlags(c) {
+		return
+	}
+	rServer.dirty += emptyDb(-1)
+	// the BGSAVE in progress would save the old dataset, the empty one is
+	// saved right away
+	killRDBChild()
+	if len(rServer.saveParams) > 0 {
+		_ = rdbSave(rdbPath())
+	}
+	rServer.dirty++
+	forceCommandPropagation(c)
+	addReply(c, shared.ok)
+
+}
+
+func delCommand(c *client) {
+
+	var deleted int64
+	for j := 1; j < c.argc; j++ {
+		key := c.argv[j].String()
+		expireIfNeeded(c.db, key)
+		if dbDelete(c.db, key) {
+			rServer.dirty++
+			deleted++
+		}
+	}
+	addReplyLongLong(c, deleted)
+
+}
+
+func existsCommand(c *client) {
+
+	var count int64
+	for j := 1; j < c.argc; j++ {
+		if lookupKeyRead(c.db, c.argv[j].String()) != nil {
+			count++
+		}
+	}
+	addReplyLongLong(c, count)
+
+}
+
+func typeCommand(c *client) {
+
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o == nil {
+		addReplyStatus(c, "none")
+		return
+	}
+
+	switch o.objectType {
+	case objectTypeString:
+		addReplyStatus(c, "string")
+	case objectTypeHash:
+		addReplyStatus(c, "hash")
+	case objectTypeList:
+		addReplyStatus(c, "list")
+	case objectTypeSet:
+		addReplyStatus(c, "set")
+	case objectTypeZSet:
+		addReplyStatus(c, "zset")
+	case objectTypeStream:
+		addReplyStatus(c, "stream")
+	default:
+		addReplyStatus(c, "unknown")
+	}
+
+}
+
+// parseScanCursorOrReply parses the unsigned cursor of the SCAN family.
+func parseScanCursorOrReply(c *client, o *rObj) (uint64, bool) {
+	cursor, err := strconv.ParseUint(o.String(), 10, 64)
+	if err != nil {
+		addReplyError(c, "invalid cursor")
+		return 0, false
+	}
+	return cursor, true
+}
+
+// scanGenericCommand implements the SCAN family on the elements of o, the
+// options start at argv[3]. Hashtable encoded values are scanned with the
+// cursor of the dict, the compact encodings are small enough to be returned
+// in a single call with cursor 0.
+func scanGenericCommand(c *client, o *rObj, cursor uint64) {
+
+	count := int64(10)
+	pattern := ""
+	novalues := false
+	for j := 3; j < c.argc; j++ {
+		opt := strings.ToLower(c.argv[j].String())
+		switch {
+		case opt == "count" && j+1 < c.argc:
+			v, ok := getLongLongFromObjectOrReply(c, c.argv[j+1], "")
+			if !ok {
+				return
+			}
+			if v < 1 {
+				addReply(c, shared.syntaxErr)
+				return
+			}
+			count = v
+			j++
+		case opt == "match" && j+1 < c.argc:
+			pattern = c.argv[j+1].String()
+			// "*" matches everything, skip the matching
+			if pattern == "*" {
+				pattern = ""
+			}
+			j++
+		case opt == "novalues" && o.objectType == objectTypeHash:
+			novalues = true
+		default:
+			addReply(c, shared.syntaxErr)
+			return
+		}
+	}
+
+	// elements holds the fields followed by their values, or the members
+	// followed by their scores, when the type has values
+	var elements [][]byte
+	step := 1
+	if o.objectType == objectTypeHash || o.objectType == objectTypeZSet {
+		step = 2
+	}
+
+	if o.encoding == objectEncodingHT || o.encoding == objectEncodingSkiplist {
+		d, ok := o.data.(*dict)
+		if !ok {
+			d = o.data.(*zset).dict
+		}
+		// bound the number of empty buckets visited by a call
+		maxIterations := count * 10
+		for {
+			cursor = d.scan(cursor, func(de *dictEntry) {
+				elements = append(elements, []byte(de.key))
+				switch val := de.val.(type) {
+				case []byte:
+					elements = append(elements, val)
+				case float64:
+					elements = append(elements, formatDouble(val))
+				}
+			})
+			maxIterations--
+			if cursor == 0 || maxIterations == 0 || int64(len(elements)/step) >= count {
+				break
+			}
+		}
+	} else if o.encoding == objectEncodingIntset {
+		is := o.data.([]byte)
+		for j := 0; j < intsetLen(is); j++ {
+			elements = append(elements, strconv.AppendInt(nil, intsetGet(is, j), 10))
+		}
+		cursor = 0
+	} else {
+		lp := o.data.([]byte)
+		for p := lpFirst(lp); p != -1; p = lpNext(lp, p) {
+			elements = append(elements, lpGetBytes(lp, p))
+		}
+		cursor = 0
+	}
+
+	if pattern != "" || novalues {
+		filtered := elements[:0]
+		for j := 0; j < len(elements); j += step {
+			if pattern != "" && !stringmatch(pattern, string(elements[j]), false) {
+				continue
+			}
+			filtered = append(filtered, elements[j])
+			if step == 2 && !novalues {
+				filtered = append(filtered, elements[j+1])
+			}
+		}
+		elements = filtered
+	}
+
+	addReplyArrayLen(c, 2)
+	addReplyBulkString(c, strconv.FormatUint(cursor, 10))
+	addReplyArrayLen(c, len(elements))
+	for _, e := range elements {
+		addReplyBulk(c, e)
+	}
+
+}
+
+// getKeysFromNumkeys returns the positions of the keys of commands taking
+// a number of keys at argv[numkeysIdx], followed by the keys.
+func getKeysFromNumkeys(argv []*rObj, numkeysIdx int) []int {
+
+	if numkeysIdx >= len(argv) {
+		return nil
+	}
+	numkeys, ok := getLongLongFromObject(argv[numkeysIdx])
+	if !ok || numkeys < 1 || numkeys > int64(len(argv)-numkeysIdx-1) {
+		return nil
+	}
+	keys := make([]int, numkeys)
+	for j := range keys {
+		keys[j] = numkeysIdx + 1 + j
+	}
+	return keys
+
+}
+
+func lmpopGetKeys(argv []*rObj) []int {
+	return getKeysFromNumkeys(argv, 1)
+}
+
+func blmpopGetKeys(argv []*rObj) []int {
+	return getKeysFromNumkeys(argv, 2)
+}
+
+func sintercardGetKeys(argv []*rObj) []int {
+	return getKeysFromNumkeys(argv, 1)
+}
+
+func zunionInterDiffGetKeys(argv []*rObj) []int {
+	return getKeysFromNumkeys(argv, 1)
+}
+
+// zunionInterDiffStoreGetKeys returns the destination key followed by the
+// source keys.
+func zunionInterDiffStoreGetKeys(argv []*rObj) []int {
+	keys := getKeysFromNumkeys(argv, 2)
+	if keys == nil {
+		return nil
+	}
+	return append([]int{1}, keys...)
+}
+
+// xreadGetKeys returns the keys of XREAD and XREADGROUP, the first half of
+// the arguments after STREAMS.
+func xreadGetKeys(argv []*rObj) []int {
+
+	streamsPos := -1
+	for j := 1; j < len(argv); j++ {
+		switch strings.ToLower(argv[j].String()) {
+		case "block", "count":
+			j++
+			continue
+		case "group":
+			j += 2
+			continue
+		case "noack":
+			continue
+		case "streams":
+			streamsPos = j
+		}
+		break
+	}
+	if streamsPos == -1 {
+		return nil
+	}
+
+	num := len(argv) - streamsPos - 1
+	if num == 0 || num%2 != 0 {
+		return nil
+	}
+	keys := make([]int, num/2)
+	for j := range keys {
+		keys[j] = streamsPos + 1 + j
+	}
+	return keys
+
+}
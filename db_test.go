@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestDb_Select(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "15")
+	tc.expect(testError("ERR DB index is out of range"), "select", "16")
+	tc.expect(testError("ERR DB index is out of range"), "select", "-1")
+	tc.expect(testError("ERR value is not an integer or out of range"), "select", "01")
+	tc.expect(int64(0), "dbsize")
+}
+
+func TestDb_SwapDbAndMoveErrors(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testError("ERR invalid first DB index"), "swapdb", "a", "1")
+	tc.expect(testError("ERR invalid second DB index"), "swapdb", "1", "b")
+	tc.expect(testError("ERR DB index is out of range"), "swapdb", "1", "16")
+	tc.expect(testStatus("OK"), "swapdb", "14", "15")
+	tc.expect(testError("ERR source and destination objects are the same"), "move", "key", "0")
+	tc.expect(testError("ERR DB index is out of range"), "move", "key", "99")
+	tc.expect(int64(0), "move", "nokey", "1")
+}
+
+func TestDb_Flush(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "13")
+	tc.expect(testStatus("OK"), "flushdb")
+	tc.expect(testStatus("OK"), "flushdb", "async")
+	tc.expect(testError("ERR syntax error"), "flushdb", "now")
+	tc.expect(testError("ERR syntax error"), "flushall", "sync", "async")
+}
@@ -0,0 +1,55 @@
+package main
+
+import "strings"
+
+// debugCommand implements the subcommands of DEBUG used to test the server.
+func debugCommand(c *client) {
+
+	sub := strings.ToLower(c.argv[1].String())
+	switch {
+	case sub == "help" && c.argc == 2:
+		addReplyHelp(c, []string{
+			"RELOAD [NOSAVE]",
+			"    Save the RDB on disk and reload it back to memory. With NOSAVE the",
+			"    RDB on disk is loaded without saving the dataset first.",
+			"LOADAOF",
+			"    Flush the AOF buffers on disk and reload the AOF in memory.",
+		})
+	case sub == "reload" && c.argc <= 3:
+		if c.argc == 3 && !strings.EqualFold(c.argv[2].String(), "nosave") {
+			addReplyError(c, "DEBUG RELOAD only supports the NOSAVE option.")
+			return
+		}
+		if c.argc == 2 {
+			if err := rdbSave(rdbPath()); err != nil {
+				addReplyErrorFormat(c, "Error trying to save the DB, %v", err)
+				return
+			}
+		}
+		emptyDb(-1)
+		rServer.loading = true
+		err := rdbLoad(rdbPath())
+		rServer.loading = false
+		if err != nil {
+			addReplyErrorFormat(c, "Error trying to load the RDB dump, %v", err)
+			return
+		}
+		Log("DB reloaded by DEBUG RELOAD")
+		addReply(c, shared.ok)
+	case sub == "loadaof" && c.argc == 2:
+		flushAppendOnlyFile(true)
+		emptyDb(-1)
+		rServer.loading = true
+		err := loadAppendOnlyFiles()
+		rServer.loading = false
+		if err != nil {
+			addReplyErrorFormat(c, "Error trying to load the AOF, %v", err)
+			return
+		}
+		Log("Append Only File loaded by DEBUG LOADAOF")
+		addReply(c, shared.ok)
+	default:
+		addReplySubcommandSyntaxError(c)
+	}
+
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+	"time"
+)
+
+const (
+	dictHtInitialSize = 4
+	// dictForceResizeRatio forces a grow even while resizing is disabled,
+	// once the table holds that many elements per bucket.
+	dictForceResizeRatio = 5
+	// dictHtMinFill is the percentage below which a table should shrink.
+	dictHtMinFill = 10
+)
+
+var (
+	dictHashSeed = maphash.MakeSeed()
+	// dictCanResize is turned off while a snapshot shares the keyspace, tables
+	// then only grow once they get really crowded.
+	dictCanResize = true
+)
+
+type dictEntry struct {
+	key  string
+	val  any
+	next *dictEntry
+}
+
+type dictht struct {
+	table    []*dictEntry
+	sizemask uint64
+	used     int
+}
+
+// dict is a chained hash table which grows and shrinks incrementally: while
+// rehashing, every operation moves a bucket from ht[0] to ht[1], and the
+// server cron moves more of them when it has spare time.
+type dict struct {
+	ht          [2]dictht
+	rehashIdx   int // next bucket of ht[0] to move, -1 if not rehashing
+	pauseRehash int // >0 while iterators or scans are running
+}
+
+func newDict() *dict {
+	return &dict{rehashIdx: -1}
+}
+
+func dictHashKey(key string) uint64 {
+	return maphash.String(dictHashSeed, key)
+}
+
+func (d *dict) isRehashing() bool {
+	return d.rehashIdx != -1
+}
+
+func (d *dict) size() int {
+	return d.ht[0].used + d.ht[1].used
+}
+
+func (d *dict) slots() int {
+	return len(d.ht[0].table) + len(d.ht[1].table)
+}
+
+func dictNextPower(size int) int {
+	if size <= dictHtInitialSize {
+		return dictHtInitialSize
+	}
+	return 1 << bits.Len(uint(size-1))
+}
+
+// expand creates ht[1] with room for size elements and starts rehashing into
+// it, or creates ht[0] for an empty dict.
+func (d *dict) expand(size int) bool {
+
+	if d.isRehashing() || d.ht[0].used > size {
+		return false
+	}
+
+	realSize := dictNextPower(size)
+	if realSize == len(d.ht[0].table) {
+		return false
+	}
+
+	n := dictht{
+		table:    make([]*dictEntry, realSize),
+		sizemask: uint64(realSize - 1),
+	}
+
+	if d.ht[0].table == nil {
+		d.ht[0] = n
+		return true
+	}
+
+	d.ht[1] = n
+	d.rehashIdx = 0
+	return true
+
+}
+
+func (d *dict) expandIfNeeded() {
+
+	if d.isRehashing() {
+		return
+	}
+
+	size := len(d.ht[0].table)
+	if size == 0 {
+		d.expand(dictHtInitialSize)
+		return
+	}
+
+	if d.ht[0].used >= size && (dictCanResize || d.ht[0].used/size > dictForceResizeRatio) {
+		d.expand(d.ht[0].used + 1)
+	}
+
+}
+
+// resize shrinks the table to the smallest size holding all the elements.
+func (d *dict) resize() bool {
+
+	if !dictCanResize || d.isRehashing() {
+		return false
+	}
+
+	minimal := d.ht[0].used
+	if minimal < dictHtInitialSize {
+		minimal = dictHtInitialSize
+	}
+	return d.expand(minimal)
+
+}
+
+func (d *dict) needsResize() bool {
+	size := d.slots()
+	return size > dictHtInitialSize && d.size()*100/size < dictHtMinFill
+}
+
+// rehash moves n buckets from ht[0] to ht[1], visiting at most n*10 empty
+// buckets so a sparse table does not block the caller. It returns true if
+// there are still buckets to move.
+func (d *dict) rehash(n int) bool {
+
+	if !d.isRehashing() {
+		return false
+	}
+
+	emptyVisits := n * 10
+	for ; n > 0 && d.ht[0].used != 0; n-- {
+
+		for d.ht[0].table[d.rehashIdx] == nil {
+			d.rehashIdx++
+			emptyVisits--
+			if emptyVisits == 0 {
+				return true
+			}
+		}
+
+		de := d.ht[0].table[d.rehashIdx]
+		for de != nil {
+			next := de.next
+			idx := dictHashKey(de.key) & d.ht[1].sizemask
+			de.next = d.ht[1].table[idx]
+			d.ht[1].table[idx] = de
+			d.ht[0].used--
+			d.ht[1].used++
+			de = next
+		}
+		d.ht[0].table[d.rehashIdx] = nil
+		d.rehashIdx++
+	}
+
+	if d.ht[0].used == 0 {
+		d.ht[0] = d.ht[1]
+		d.ht[1] = dictht{}
+		d.rehashIdx = -1
+		return false
+	}
+
+	return true
+
+}
+
+// rehashMilliseconds rehashes in steps of 100 buckets for about ms
+// milliseconds, and returns the number of buckets moved.
+func (d *dict) rehashMilliseconds(ms int) int {
+
+	if d.pauseRehash > 0 {
+		return 0
+	}
+
+	start := time.Now()
+	rehashes := 0
+	for d.rehash(100) {
+		rehashes += 100
+		if time.Since(start) > time.Duration(ms)*time.Millisecond {
+			break
+		}
+	}
+	return rehashes
+
+}
+
+func (d *dict) rehashStep() {
+	if d.pauseRehash == 0 {
+		d.rehash(1)
+	}
+}
+
+func (d *dict) find(key string) *dictEntry {
+
+	if d.size() == 0 {
+		return nil
+	}
+
+	if d.isRehashing() {
+		d.rehashStep()
+	}
+
+	h := dictHashKey(key)
+	for table := 0; table <= 1; table++ {
+		idx := h & d.ht[table].sizemask
+		for he := d.ht[table].table[idx]; he != nil; he = he.next {
+			if he.key == key {
+				return he
+			}
+		}
+		if !d.isRehashing() {
+			break
+		}
+	}
+	return nil
+
+}
+
+func (d *dict) fetchValue(key string) (any, bool) {
+	he := d.find(key)
+	if he == nil {
+		return nil, false
+	}
+	return he.val, true
+}
+
+// addRaw inserts an entry without value for key, or returns the existing one.
+func (d *dict) addRaw(key string) (entry *dictEntry, existing *dictEntry) {
+
+	if d.isRehashing() {
+		d.rehashStep()
+	}
+
+	d.expandIfNeeded()
+
+	h := dictHashKey(key)
+	for table := 0; table <= 1; table++ {
+		idx := h & d.ht[table].sizemask
+		for he := d.ht[table].table[idx]; he != nil; he = he.next {
+			if he.key == key {
+				return nil, he
+			}
+		}
+		if !d.isRehashing() {
+			break
+		}
+	}
+
+	// new entries go to the new table while rehashing
+	ht := &d.ht[0]
+	if d.isRehashing() {
+		ht = &d.ht[1]
+	}
+	idx := h & ht.sizemask
+	entry = &dictEntry{key: key, next: ht.table[idx]}
+	ht.table[idx] = entry
+	ht.used++
+	return entry, nil
+
+}
+
+// add inserts key only if it does not exist yet.
+func (d *dict) add(key string, val any) bool {
+	entry, _ := d.addRaw(key)
+	if entry == nil {
+		return false
+	}
+	entry.val = val
+	return true
+}
+
+// replace sets the value of key, it returns true if the key was added.
+func (d *dict) replace(key string, val any) bool {
+	entry, existing := d.addRaw(key)
+	if entry != nil {
+		entry.val = val
+		return true
+	}
+	existing.val = val
+	return false
+}
+
+// delete removes key and returns its entry, or nil if it was not found.
+func (d *dict) delete(key string) *dictEntry {
+
+	if d.size() == 0 {
+		return nil
+	}
+
+	if d.isRehashing() {
+		d.rehashStep()
+	}
+
+	h := dictHashKey(key)
+	for table := 0; table <= 1; table++ {
+		idx := h & d.ht[table].sizemask
+		var prev *dictEntry
+		for he := d.ht[table].table[idx]; he != nil; he = he.next {
+			if he.key == key {
+				if prev == nil {
+					d.ht[table].table[idx] = he.next
+				} else {
+					prev.next = he.next
+				}
+				he.next = nil
+				d.ht[table].used--
+				return he
+			}
+			prev = he
+		}
+		if !d.isRehashing() {
+			break
+		}
+	}
+	return nil
+
+}
+
+func (d *dict) empty() {
+	d.ht[0] = dictht{}
+	d.ht[1] = dictht{}
+	d.rehashIdx = -1
+}
+
+// dictIterator walks every entry exactly once. Rehashing is paused until the
+// iterator is released, so entries may be added or deleted while iterating.
+type dictIterator struct {
+	d         *dict
+	table     int
+	index     int
+	entry     *dictEntry
+	nextEntry *dictEntry
+}
+
+func (d *dict) iterator() *dictIterator {
+	d.pauseRehash++
+	return &dictIterator{d: d, index: -1}
+}
+
+func (it *dictIterator) next() *dictEntry {
+
+	for {
+		if it.entry == nil {
+			it.index++
+			if it.index >= len(it.d.ht[it.table].table) {
+				if it.d.isRehashing() && it.table == 0 {
+					it.table++
+					it.index = 0
+				}
+				if it.index >= len(it.d.ht[it.table].table) {
+					return nil
+				}
+			}
+			it.entry = it.d.ht[it.table].table[it.index]
+		} else {
+			it.entry = it.nextEntry
+		}
+
+		if it.entry != nil {
+			it.nextEntry = it.entry.next
+			return it.entry
+		}
+	}
+
+}
+
+func (it *dictIterator) release() {
+	it.d.pauseRehash--
+}
+
+// forEachUnsafe is forEach without pausing the rehash, fn must not modify d.
+// As it writes nothing to d, several goroutines can walk d at once as long as
+// none of them modifies it, see dbUnshareValue.
+func (d *dict) forEachUnsafe(fn func(de *dictEntry) bool) {
+
+	for table := 0; table <= 1; table++ {
+		if table == 1 && !d.isRehashing() {
+			return
+		}
+		for _, de := range d.ht[table].table {
+			for ; de != nil; de = de.next {
+				if !fn(de) {
+					return
+				}
+			}
+		}
+	}
+
+}
+
+// forEach calls fn for every entry until fn returns false.
+func (d *dict) forEach(fn func(de *dictEntry) bool) {
+	it := d.iterator()
+	defer it.release()
+	for de := it.next(); de != nil; de = it.next() {
+		if !fn(de) {
+			return
+		}
+	}
+}
+
+func (d *dict) randomEntry() *dictEntry {
+
+	if d.size() == 0 {
+		return nil
+	}
+
+	if d.isRehashing() {
+		d.rehashStep()
+	}
+
+	var he *dictEntry
+	if d.isRehashing() {
+		// buckets below rehashIdx of ht[0] are empty
+		s0 := len(d.ht[0].table)
+		for he == nil {
+			h := d.rehashIdx + rand.Intn(d.slots()-d.rehashIdx)
+			if h >= s0 {
+				he = d.ht[1].table[h-s0]
+			} else {
+				he = d.ht[0].table[h]
+			}
+		}
+	} else {
+		for he == nil {
+			he = d.ht[0].table[rand.Uint64()&d.ht[0].sizemask]
+		}
+	}
+
+	// pick a random element of the chain, chains are short on average.
+	chainLen := 0
+	for e := he; e != nil; e = e.next {
+		chainLen++
+	}
+	for j := rand.Intn(chainLen); j > 0; j-- {
+		he = he.next
+	}
+	return he
+
+}
+
+// someEntries samples up to count entries from random consecutive buckets.
+// It's faster than count calls to randomEntry but the distribution is worse,
+// which is fine for eviction and expire sampling. Entries are never repeated.
+func (d *dict) someEntries(count int) []*dictEntry {
+
+	if count > d.size() {
+		count = d.size()
+	}
+	if count == 0 {
+		return nil
+	}
+
+	// rehash a bit, proportionally to the work we are about to do.
+	for j := 0; j < count && d.isRehashing(); j++ {
+		d.rehashStep()
+	}
+
+	tables := 1
+	if d.isRehashing() {
+		tables = 2
+	}
+	maxSizeMask := d.ht[0].sizemask
+	if tables > 1 && d.ht[1].sizemask > maxSizeMask {
+		maxSizeMask = d.ht[1].sizemask
+	}
+
+	entries := make([]*dictEntry, 0, count)
+	maxSteps := count * 10
+	emptyLen := 0
+	i := rand.Uint64() & maxSizeMask
+
+	for len(entries) < count && maxSteps > 0 {
+		maxSteps--
+		for j := 0; j < tables; j++ {
+			// buckets below rehashIdx of ht[0] were already moved.
+			if tables == 2 && j == 0 && i < uint64(d.rehashIdx) {
+				if i >= uint64(len(d.ht[1].table)) {
+					i = uint64(d.rehashIdx)
+				} else {
+					continue
+				}
+			}
+			if i >= uint64(len(d.ht[j].table)) {
+				continue
+			}
+
+			he := d.ht[j].table[i]
+			if he == nil {
+				// too many empty buckets in a row, jump somewhere else.
+				emptyLen++
+				if emptyLen >= 5 && emptyLen > count {
+					i = rand.Uint64() & maxSizeMask
+					emptyLen = 0
+				}
+				continue
+			}
+
+			emptyLen = 0
+			for ; he != nil; he = he.next {
+				entries = append(entries, he)
+				if len(entries) == count {
+					return entries
+				}
+			}
+		}
+		i = (i + 1) & maxSizeMask
+	}
+	return entries
+
+}
+
+// scan iterates the dict with a stateless cursor, the cursor is incremented
+// on its reversed bits so every element present for the whole scan is
+// returned at least once, even if the table grows or shrinks in between.
+// Start with cursor 0, the scan is over when the returned cursor is 0.
+func (d *dict) scan(cursor uint64, fn func(de *dictEntry)) uint64 {
+
+	if d.size() == 0 {
+		return 0
+	}
+
+	emitBucket := func(de *dictEntry) {
+		for de != nil {
+			next := de.next
+			fn(de)
+			de = next
+		}
+	}
+
+	d.pauseRehash++
+	defer func() {
+		d.pauseRehash--
+	}()
+
+	if !d.isRehashing() {
+		m0 := d.ht[0].sizemask
+		emitBucket(d.ht[0].table[cursor&m0])
+
+		// set the unmasked bits so incrementing the reversed cursor
+		// operates on the masked bits
+		cursor |= ^m0
+		cursor = bits.Reverse64(cursor)
+		cursor++
+		cursor = bits.Reverse64(cursor)
+		return cursor
+	}
+
+	t0, t1 := &d.ht[0], &d.ht[1]
+	// t0 is the smaller table
+	if len(t0.table) > len(t1.table) {
+		t0, t1 = t1, t0
+	}
+	m0, m1 := t0.sizemask, t1.sizemask
+
+	emitBucket(t0.table[cursor&m0])
+
+	// iterate over the buckets of the larger table that are expansions of
+	// the bucket pointed by cursor in the smaller table
+	for {
+		emitBucket(t1.table[cursor&m1])
+
+		cursor |= ^m1
+		cursor = bits.Reverse64(cursor)
+		cursor++
+		cursor = bits.Reverse64(cursor)
+
+		if cursor&(m0^m1) == 0 {
+			break
+		}
+	}
+	return cursor
+
+}
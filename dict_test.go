@@ -0,0 +1,222 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestDict_AddFindDelete(t *testing.T) {
+	d := newDict()
+
+	const n = 10000
+	for j := 0; j < n; j++ {
+		if !d.add(strconv.Itoa(j), j) {
+			t.Fatalf("add %d failed", j)
+		}
+	}
+	if d.add("42", 0) {
+		t.Fatalf("want add of an existing key to fail")
+	}
+	if d.size() != n {
+		t.Fatalf("want size %d, got %d", n, d.size())
+	}
+
+	for j := 0; j < n; j++ {
+		val, ok := d.fetchValue(strconv.Itoa(j))
+		if !ok || val.(int) != j {
+			t.Fatalf("fetch %d: got %v, %v", j, val, ok)
+		}
+	}
+
+	if d.replace("42", -1) {
+		t.Fatalf("want replace of an existing key to return false")
+	}
+	if val, _ := d.fetchValue("42"); val.(int) != -1 {
+		t.Fatalf("want replaced value -1, got %v", val)
+	}
+
+	for j := 0; j < n; j += 2 {
+		if d.delete(strconv.Itoa(j)) == nil {
+			t.Fatalf("delete %d failed", j)
+		}
+	}
+	if d.delete("0") != nil {
+		t.Fatalf("want delete of a missing key to return nil")
+	}
+	if d.size() != n/2 {
+		t.Fatalf("want size %d, got %d", n/2, d.size())
+	}
+	for j := 1; j < n; j += 2 {
+		if d.find(strconv.Itoa(j)) == nil {
+			t.Fatalf("key %d lost after deletes", j)
+		}
+	}
+}
+
+func TestDict_IncrementalRehash(t *testing.T) {
+	d := newDict()
+
+	// fill up to a table boundary, the next add starts a rehash
+	for j := 0; j < 1024; j++ {
+		d.add(strconv.Itoa(j), j)
+	}
+	for d.isRehashing() {
+		d.rehash(100)
+	}
+	d.add("trigger", nil)
+	if !d.isRehashing() {
+		t.Fatalf("want rehashing after growing past the table size")
+	}
+
+	// every key stays reachable while the buckets move
+	steps := 0
+	for d.isRehashing() {
+		d.rehash(1)
+		steps++
+		for _, key := range []string{"0", "511", "1023", "trigger"} {
+			if d.find(key) == nil {
+				t.Fatalf("key %s not found while rehashing, step=%d", key, steps)
+			}
+		}
+	}
+	if steps < 2 {
+		t.Fatalf("want rehash in several steps, got %d", steps)
+	}
+	if len(d.ht[0].table) != 2048 || d.ht[1].table != nil {
+		t.Fatalf("want a single table of 2048 buckets, got %d and %d", len(d.ht[0].table), len(d.ht[1].table))
+	}
+
+	// shrink after deleting most of the keys
+	for j := 0; j < 1000; j++ {
+		d.delete(strconv.Itoa(j))
+	}
+	if !d.needsResize() {
+		t.Fatalf("want needsResize with %d keys in %d slots", d.size(), d.slots())
+	}
+	d.resize()
+	d.rehashMilliseconds(10)
+	if d.isRehashing() || len(d.ht[0].table) != 32 || d.size() != 25 {
+		t.Fatalf("want 25 keys in 32 buckets, got %d keys in %d buckets", d.size(), len(d.ht[0].table))
+	}
+}
+
+func TestDict_IteratorPausesRehash(t *testing.T) {
+	d := newDict()
+	for j := 0; j < 100; j++ {
+		d.add(strconv.Itoa(j), j)
+	}
+
+	seen := make(map[string]int)
+	it := d.iterator()
+	for de := it.next(); de != nil; de = it.next() {
+		seen[de.key]++
+		if de.key[0] == 'n' {
+			continue
+		}
+		// deleting the current entry is safe
+		d.delete(de.key)
+		d.add("new"+de.key, nil)
+	}
+	it.release()
+
+	if d.pauseRehash != 0 {
+		t.Fatalf("want rehash resumed after release, got %d", d.pauseRehash)
+	}
+	for j := 0; j < 100; j++ {
+		if seen[strconv.Itoa(j)] != 1 {
+			t.Fatalf("key %d seen %d times", j, seen[strconv.Itoa(j)])
+		}
+	}
+}
+
+func TestDict_ForEachUnsafeWhileRehashing(t *testing.T) {
+	d := newDict()
+	for j := 0; j < 1024; j++ {
+		d.add(strconv.Itoa(j), j)
+	}
+	for d.isRehashing() {
+		d.rehash(100)
+	}
+	d.add("trigger", nil)
+	d.rehash(10)
+
+	// both tables are walked, and the walk leaves d untouched
+	rehashIdx := d.rehashIdx
+	seen := make(map[string]int)
+	d.forEachUnsafe(func(de *dictEntry) bool {
+		seen[de.key]++
+		return true
+	})
+	if len(seen) != d.size() || d.rehashIdx != rehashIdx || d.pauseRehash != 0 {
+		t.Fatalf("want %d keys walked with d untouched, got %d keys", d.size(), len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Fatalf("key %s seen %d times", key, n)
+		}
+	}
+}
+
+func TestDict_ScanWhileRehashing(t *testing.T) {
+	d := newDict()
+
+	const n = 1000
+	for j := 0; j < n; j++ {
+		d.add(strconv.Itoa(j), j)
+	}
+
+	seen := make(map[string]bool)
+	var cursor uint64
+	added := 0
+	for {
+		cursor = d.scan(cursor, func(de *dictEntry) {
+			seen[de.key] = true
+		})
+		// grow the table in the middle of the scan
+		if added < 5000 {
+			for j := 0; j < 500; j++ {
+				d.add("extra"+strconv.Itoa(added), nil)
+				added++
+			}
+		}
+		d.rehash(10)
+		if cursor == 0 {
+			break
+		}
+	}
+
+	for j := 0; j < n; j++ {
+		if !seen[strconv.Itoa(j)] {
+			t.Fatalf("key %d not returned by scan", j)
+		}
+	}
+}
+
+func TestDict_Sampling(t *testing.T) {
+	d := newDict()
+	if d.randomEntry() != nil || len(d.someEntries(10)) != 0 {
+		t.Fatalf("want no entries from an empty dict")
+	}
+
+	for j := 0; j < 1000; j++ {
+		d.add(strconv.Itoa(j), j)
+	}
+
+	for j := 0; j < 100; j++ {
+		if de := d.randomEntry(); de == nil || d.find(de.key) != de {
+			t.Fatalf("randomEntry returned a foreign entry %v", de)
+		}
+	}
+
+	entries := d.someEntries(20)
+	if len(entries) != 20 {
+		t.Fatalf("want 20 sampled entries, got %d", len(entries))
+	}
+	unique := make(map[string]bool)
+	for _, de := range entries {
+		unique[de.key] = true
+	}
+	if len(unique) != 20 {
+		t.Fatalf("want unique sampled entries, got %d", len(unique))
+	}
+}
@@ -13,10 +13,13 @@ const (
 	ELMaskWritable = 1 << 1
 )
 
+// ELMaxPollWait bounds a poll without any pending timer.
+const ELMaxPollWait = time.Millisecond * 100
+
 const (
 	ELFlagsTimeEvents = 1 << 0
 	ELFlagsFileEvents = 1 << 1
-	ELFlagsAllEvents  = 1 << 2
+	ELFlagsAllEvents  = ELFlagsTimeEvents | ELFlagsFileEvents
 	ELFlagsNoWait     = 1 << 3
 	ELFlagsBarrier    = 1 << 4
 )
@@ -42,8 +45,8 @@ type EventLoop struct {
 	Events  []FireEvent
 	Fired   []FireEvent
 
-	TimerHead   *TimerEvent
-	TimerTail   *TimerEvent
+	Timers      timerHeap
+	TimerIndex  map[int64]*TimerEvent
 	NextTimerId int64
 
 	BeforeSleep ProcBeforeSleep
@@ -51,37 +54,72 @@ type EventLoop struct {
 
 	Stop  chan chan struct{}
 	maxFd int
+
+	EdgeTrigger bool // see ELApiEpollEdge
 }
 
 type TimerEvent struct {
-	Id               int64
-	Next             *TimerEvent
-	Prev             *TimerEvent
-	ProcTimer        ProcTimerEvent
-	clientData       interface{}
-	when             int64
-	whenMilliseconds int64
+	Id         int64
+	ProcTimer  ProcTimerEvent
+	clientData interface{}
+	when       int64 // unix milliseconds
+	index      int   // position in el.Timers, -1 once removed
 }
 
+// EventLoopApi is the multiplexing backend of the EventLoop. AddFileEvent and
+// DelFileEvent are called before el.Events[fd].Mask is updated, so the backend
+// can read the old mask from it. Poll fills el.Fired with the fd and mask of
+// every ready file event and returns the number of entries filled.
 type EventLoopApi interface {
 	AddFileEvent(fd int, mask uint8) error
 	DelFileEvent(fd int, mask uint8) error
 	Poll(duration *time.Duration) (int, error)
+	Name() string
+	Close() error
 }
 
-func NewEventLoop(setSize int, beforeSleep ProcBeforeSleep, afterSleep ProcAfterSleep) *EventLoop {
+const (
+	ELApiSelect    = iota + 1
+	ELApiEpoll     // epoll, level triggered
+	ELApiEpollEdge // epoll, edge triggered, handlers must drain the fd
+)
+
+var errEventLoopApiUnsupported = errors.New("event loop api not supported on this platform")
+
+// NewEventLoop creates a loop watching fds below setSize with the apiType
+// backend. ELApiEpollEdge reports a ready fd once per edge, so every handler
+// of such a loop has to read or accept until EAGAIN, checking el.EdgeTrigger,
+// or the data left in the fd is never reported again.
+func NewEventLoop(setSize int, apiType int, beforeSleep ProcBeforeSleep, afterSleep ProcAfterSleep) (*EventLoop, error) {
 	el := &EventLoop{
 		SetSize:     setSize,
 		Events:      make([]FireEvent, setSize),
 		Fired:       make([]FireEvent, setSize),
+		TimerIndex:  make(map[int64]*TimerEvent),
 		NextTimerId: 0,
 		BeforeSleep: beforeSleep,
 		AfterSleep:  afterSleep,
 		Stop:        make(chan chan struct{}),
 		maxFd:       -1,
 	}
-	el.ElApi = NewEventLoopSelector(el, setSize)
-	return el
+
+	var err error
+	switch apiType {
+	case ELApiSelect:
+		el.ElApi, err = NewEventLoopSelector(el, setSize)
+	case ELApiEpoll:
+		el.ElApi, err = NewEventLoopEpoll(el, setSize, false)
+	case ELApiEpollEdge:
+		el.ElApi, err = NewEventLoopEpoll(el, setSize, true)
+		el.EdgeTrigger = true
+	default:
+		err = errors.New("NewEventLoop unknown api type")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return el, nil
 }
 
 func (el *EventLoop) Serve() {
@@ -92,13 +130,16 @@ func (el *EventLoop) Serve() {
 		select {
 		case c := <-el.Stop:
 			Log("EventLoop stop...")
+			if err := el.ElApi.Close(); err != nil {
+				Log("EventLoop close api error=%v", err)
+			}
 			c <- struct{}{}
 			return
 		default:
 			if el.BeforeSleep != nil {
 				el.BeforeSleep()
 			}
-			_, err := el.poll(ELFlagsAllEvents | ELFlagsNoWait | ELFlagsBarrier)
+			_, err := el.poll(ELFlagsAllEvents | ELFlagsBarrier)
 			if err != nil {
 				Log("poll error", err)
 			}
@@ -122,7 +163,12 @@ func (el *EventLoop) AddFileEvent(f *os.File, mask uint8, procFileEvent ProcFile
 		return errors.New("AddFileEvent mask only support read and write")
 	}
 
-	el.Events[fd].Mask = mask
+	err := el.ElApi.AddFileEvent(fd, mask)
+	if err != nil {
+		return err
+	}
+
+	el.Events[fd].Mask |= mask
 	if mask&ELMaskReadable != 0 {
 		el.Events[fd].rProc = procFileEvent
 	}
@@ -136,8 +182,7 @@ func (el *EventLoop) AddFileEvent(f *os.File, mask uint8, procFileEvent ProcFile
 		el.maxFd = fd
 	}
 
-	err := el.ElApi.AddFileEvent(fd, mask)
-	return err
+	return nil
 
 }
 
@@ -146,62 +191,36 @@ func (el *EventLoop) DelFileEvent(fd int, mask uint8) error {
 	if fd >= el.SetSize {
 		return errors.New("DelFileEvent fd out of range")
 	}
-	el.Events[fd].Mask = ELMaskNone
-	el.Events[fd].File = nil
+	if el.Events[fd].Mask == ELMaskNone {
+		return nil
+	}
+
 	err := el.ElApi.DelFileEvent(fd, mask)
 
+	el.Events[fd].Mask &^= mask
+	if el.Events[fd].Mask != ELMaskNone {
+		return err
+	}
+
+	el.Events[fd].File = nil
+	el.Events[fd].rProc = nil
+	el.Events[fd].wProc = nil
+	el.Events[fd].clientData = nil
+
 	if fd == el.maxFd {
-		for j := el.maxFd; j >= 0; j-- {
+		el.maxFd = -1
+		for j := fd - 1; j >= 0; j-- {
 			if el.Events[j].Mask&(ELMaskReadable|ELMaskWritable) > 0 {
 				el.maxFd = j
 				break
 			}
 		}
-		// current fd is the last one
-		if el.maxFd == fd {
-			el.maxFd = -1
-		}
 	}
 
 	return err
 
 }
 
-func (el *EventLoop) AddTimer(t time.Duration, procTimerEvent ProcTimerEvent, clientData interface{}) {
-
-	procWhen := time.Now().Add(t).UnixMilli()
-	timerEvent := &TimerEvent{
-		Id:               el.NextTimerId,
-		when:             procWhen / 1000,
-		whenMilliseconds: procWhen % 1000,
-		ProcTimer:        procTimerEvent,
-		clientData:       clientData,
-	}
-
-	if el.TimerHead == nil {
-		el.TimerHead = timerEvent
-		el.TimerTail = timerEvent
-	} else {
-		el.TimerTail.Next = timerEvent
-		timerEvent.Prev = el.TimerTail
-		el.TimerTail = timerEvent
-	}
-
-}
-
-func (el *EventLoop) searchNearestTimer() *TimerEvent {
-	p := el.TimerHead
-	nearest := p
-	for p != nil {
-		if p.when < nearest.when || (p.when == nearest.when && p.whenMilliseconds < nearest.whenMilliseconds) {
-			nearest = p
-		}
-		p = p.Next
-	}
-	return nearest
-
-}
-
 func (el *EventLoop) poll(flags int) (int, error) {
 
 	var nearest *TimerEvent
@@ -215,18 +234,18 @@ func (el *EventLoop) poll(flags int) (int, error) {
 		var waitDuration *time.Duration
 
 		if nearest != nil {
-			now := time.Now().UnixMilli()
-			wait := time.Second*time.Duration(nearest.when-now/1000) +
-				time.Millisecond*time.Duration(nearest.whenMilliseconds-now%1000)
+			wait := time.Millisecond * time.Duration(nearest.when-time.Now().UnixMilli())
 			if wait < 0 {
 				wait = time.Duration(0)
 			}
 			waitDuration = &wait
 		} else {
+			// never block forever, Serve has to observe el.Stop.
+			wait := ELMaxPollWait
 			if flags&ELFlagsNoWait != 0 {
-				wait := time.Duration(0)
-				waitDuration = &wait
+				wait = time.Duration(0)
 			}
+			waitDuration = &wait
 		}
 
 		n, err := el.ElApi.Poll(waitDuration)
@@ -237,75 +256,43 @@ func (el *EventLoop) poll(flags int) (int, error) {
 		}
 
 		for i := 0; i < n; i++ {
-			fired := el.Fired[i]
+			fd := el.Fired[i].Fd
+			mask := el.Fired[i].Mask
+			// handlers may delete events of this fd, always re-read the registered one.
+			fe := &el.Events[fd]
 			proc := 0
-			if fired.Mask&ELMaskReadable != 0 && flags&ELFlagsBarrier == 0 {
-				fired.rProc(el, fired.Fd, ELMaskReadable, fired.clientData)
+			if fe.Mask&mask&ELMaskReadable != 0 && flags&ELFlagsBarrier == 0 {
+				fe.rProc(el, fd, ELMaskReadable, fe.clientData)
 				proc++
 			}
 
-			if fired.Mask&ELMaskWritable != 0 {
-				if proc == 0 || reflect.ValueOf(fired.rProc).Pointer() != reflect.ValueOf(fired.wProc).Pointer() {
-					fired.wProc(el, fired.Fd, ELMaskWritable, fired.clientData)
+			if fe.Mask&mask&ELMaskWritable != 0 {
+				if proc == 0 || !sameProcFileEvent(fe.rProc, fe.wProc) {
+					fe.wProc(el, fd, ELMaskWritable, fe.clientData)
+					proc++
 				}
-				proc++
 			}
 
-			if fired.Mask&ELMaskReadable != 0 && flags&ELFlagsBarrier != 0 {
-				fired.rProc(el, fired.Fd, ELMaskReadable, fired.clientData)
-				proc++
+			if fe.Mask&mask&ELMaskReadable != 0 && flags&ELFlagsBarrier != 0 {
+				if proc == 0 || !sameProcFileEvent(fe.rProc, fe.wProc) {
+					fe.rProc(el, fd, ELMaskReadable, fe.clientData)
+					proc++
+				}
 			}
 			numEvents += proc
 		}
 
 	}
 
-	numEvents += el.processTimerEvents()
+	if flags&ELFlagsTimeEvents != 0 {
+		numEvents += el.processTimerEvents()
+	}
 	return numEvents, nil
 
 }
 
-func (el *EventLoop) processTimerEvents() int {
-	numEvents := 0
-	timerEvent := el.TimerHead
-	maxId := el.NextTimerId
-
-	now := time.Now().UnixMilli()
-	var (
-		prev *TimerEvent
-	)
-
-	for {
-		if timerEvent == nil {
-			break
-		}
-
-		if maxId >= timerEvent.Id {
-			continue
-		}
-
-		if timerEvent.when >= now/1000 && timerEvent.whenMilliseconds >= now%1000 {
-			nextTrigger := timerEvent.ProcTimer(el, timerEvent.Id, timerEvent.clientData)
-			if nextTrigger <= 0 {
-				if prev != nil {
-					prev.Next = timerEvent.Next
-				}
-				if timerEvent == el.TimerTail {
-					el.TimerTail = prev
-				}
-			} else {
-				getNow := time.Now().UnixMilli()
-				timerEvent.when = getNow/1000 + int64(nextTrigger/1000)
-				timerEvent.whenMilliseconds = int64(nextTrigger % 1000)
-			}
-
-			numEvents++
-
-		}
-		prev = timerEvent
-
-	}
-	return numEvents
+func sameProcFileEvent(a, b ProcFileEvent) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
 }
 
 func (el *EventLoop) StopAndWait() {
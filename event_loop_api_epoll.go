@@ -0,0 +1,140 @@
+//go:build linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+const defaultEventLoopApi = ELApiEpoll
+
+// EventLoopEpoll is the epoll backend, events are reported for the ready fds
+// only, so Poll costs O(ready) instead of O(maxFd) like the selector.
+type EventLoopEpoll struct {
+	el          *EventLoop
+	epfd        int
+	edgeTrigger bool
+	events      []unix.EpollEvent
+}
+
+func NewEventLoopEpoll(el *EventLoop, setSize int, edgeTrigger bool) (EventLoopApi, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &EventLoopEpoll{
+		el:          el,
+		epfd:        epfd,
+		edgeTrigger: edgeTrigger,
+		events:      make([]unix.EpollEvent, setSize),
+	}, nil
+}
+
+func (e *EventLoopEpoll) epollEvents(mask uint8) uint32 {
+	var events uint32
+	if mask&ELMaskReadable != 0 {
+		events |= unix.EPOLLIN
+	}
+	if mask&ELMaskWritable != 0 {
+		events |= unix.EPOLLOUT
+	}
+	if e.edgeTrigger {
+		events |= unix.EPOLLET
+	}
+	return events
+}
+
+func (e *EventLoopEpoll) AddFileEvent(fd int, mask uint8) error {
+
+	// if the fd was already monitored for some event, we need a MOD
+	// operation. Otherwise we need an ADD operation.
+	oldMask := e.el.Events[fd].Mask
+	op := unix.EPOLL_CTL_ADD
+	if oldMask != ELMaskNone {
+		op = unix.EPOLL_CTL_MOD
+	}
+
+	ev := unix.EpollEvent{
+		Events: e.epollEvents(mask | oldMask),
+		Fd:     int32(fd),
+	}
+	return unix.EpollCtl(e.epfd, op, fd, &ev)
+}
+
+func (e *EventLoopEpoll) DelFileEvent(fd int, mask uint8) error {
+
+	newMask := e.el.Events[fd].Mask &^ mask
+	if newMask != ELMaskNone {
+		ev := unix.EpollEvent{
+			Events: e.epollEvents(newMask),
+			Fd:     int32(fd),
+		}
+		return unix.EpollCtl(e.epfd, unix.EPOLL_CTL_MOD, fd, &ev)
+	}
+
+	// kernel < 2.6.9 requires a non null event pointer even for EPOLL_CTL_DEL.
+	var ev unix.EpollEvent
+	err := unix.EpollCtl(e.epfd, unix.EPOLL_CTL_DEL, fd, &ev)
+	if err == unix.EBADF || err == unix.ENOENT {
+		// the fd was closed before the event was deleted, the kernel
+		// already dropped it from the interest list.
+		return nil
+	}
+	return err
+}
+
+func (e *EventLoopEpoll) Poll(t *time.Duration) (int, error) {
+
+	msec := -1
+	if t != nil {
+		msec = int((*t + time.Millisecond - 1) / time.Millisecond)
+	}
+
+	n, err := unix.EpollWait(e.epfd, e.events, msec)
+	if err != nil {
+		if err == unix.EINTR {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	numEvents := 0
+	for j := 0; j < n; j++ {
+		ev := e.events[j]
+		fd := int(ev.Fd)
+
+		var mask uint8
+		if ev.Events&unix.EPOLLIN != 0 {
+			mask |= ELMaskReadable
+		}
+		if ev.Events&unix.EPOLLOUT != 0 {
+			mask |= ELMaskWritable
+		}
+		// let the handlers observe the error through read or write.
+		if ev.Events&(unix.EPOLLERR|unix.EPOLLHUP) != 0 {
+			mask |= ELMaskReadable | ELMaskWritable
+		}
+
+		mask &= e.el.Events[fd].Mask
+		if mask == ELMaskNone {
+			continue
+		}
+		e.el.Fired[numEvents].Fd = fd
+		e.el.Fired[numEvents].Mask = mask
+		numEvents++
+	}
+
+	return numEvents, nil
+}
+
+func (e *EventLoopEpoll) Name() string {
+	if e.edgeTrigger {
+		return "epoll-et"
+	}
+	return "epoll"
+}
+
+func (e *EventLoopEpoll) Close() error {
+	return unix.Close(e.epfd)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+const defaultEventLoopApi = ELApiSelect
+
+func NewEventLoopEpoll(el *EventLoop, setSize int, edgeTrigger bool) (EventLoopApi, error) {
+	return nil, errEventLoopApiUnsupported
+}
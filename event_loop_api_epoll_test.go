@@ -0,0 +1,100 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEventLoopEpoll_EdgeTriggered(t *testing.T) {
+	el, err := NewEventLoop(128, ELApiEpollEdge, nil, nil)
+	if err != nil {
+		t.Fatalf("NewEventLoop error=%v", err)
+	}
+	defer el.ElApi.Close()
+
+	r, w := newTestPipe(t)
+
+	fired := 0
+	err = el.AddFileEvent(r, ELMaskReadable, func(el *EventLoop, fd int, mask uint8, clientData interface{}) {
+		fired++
+	}, nil)
+	if err != nil {
+		t.Fatalf("AddFileEvent error=%v", err)
+	}
+
+	_, _ = w.Write([]byte("x"))
+	pollNoWait(t, el)
+	pollNoWait(t, el)
+	if fired != 1 {
+		t.Fatalf("want fired once for a single edge, got %d", fired)
+	}
+
+	_, _ = w.Write([]byte("y"))
+	pollNoWait(t, el)
+	if fired != 2 {
+		t.Fatalf("want fired again on a new edge, got %d", fired)
+	}
+}
+
+// the test server is shared by the whole binary, the edge triggered one runs
+// in a child process of its own.
+func TestEventLoopEpoll_EdgeTriggeredServer(t *testing.T) {
+	if os.Getenv(testEdgeTriggerEnv) == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestEventLoopEpoll_EdgeTriggeredServer$", "-test.count=1")
+		cmd.Env = append(os.Environ(), testEdgeTriggerEnv+"=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("edge triggered server error=%v\n%s", err, out)
+		}
+		return
+	}
+
+	// the connections queued on the listener before the loop accepts
+	// them share a single edge.
+	addr := startTestServer(t)
+	const numConns = 32
+	conns := make([]net.Conn, numConns)
+	errs := make([]error, numConns)
+	var wg sync.WaitGroup
+	for j := range conns {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			conns[j], errs[j] = net.Dial("tcp", addr)
+		}(j)
+	}
+	wg.Wait()
+	for j, conn := range conns {
+		if errs[j] != nil {
+			t.Fatalf("dial %s error=%v", addr, errs[j])
+		}
+		defer conn.Close()
+		tc := &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+		tc.expect(testStatus("PONG"), "PING")
+	}
+
+	// a pipeline many times the read buffer is all read on one edge.
+	tc := newTestConn(t)
+	value := strings.Repeat("v", 1000)
+	numCmds := 4 * genericIOBufferLength / len(value)
+	var pipeline strings.Builder
+	for j := 0; j < numCmds; j++ {
+		key := fmt.Sprintf("et:%d", j)
+		fmt.Fprintf(&pipeline, "*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(key), key, len(value), value)
+	}
+	tc.writeRaw(pipeline.String())
+	for j := 0; j < numCmds; j++ {
+		if got := tc.read(); got != testStatus("OK") {
+			t.Fatalf("want OK for command %d, got %v", j, got)
+		}
+	}
+	tc.expect(value, "GET", fmt.Sprintf("et:%d", numCmds-1))
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"golang.org/x/sys/unix"
 	"time"
 )
 
+// selectSetSize is FD_SETSIZE, select can not watch fds above it.
+const selectSetSize = len(unix.FdSet{}.Bits) * 64
+
 type EventLoopSelector struct {
 	el                 *EventLoop
 	setSize            int
@@ -12,14 +16,20 @@ type EventLoopSelector struct {
 	wfdsPoll, rfdsPoll unix.FdSet // writefds, readfds
 }
 
-func NewEventLoopSelector(el *EventLoop, setSize int) EventLoopApi {
+func NewEventLoopSelector(el *EventLoop, setSize int) (EventLoopApi, error) {
+	if setSize > selectSetSize {
+		return nil, errors.New("NewEventLoopSelector setSize exceed FD_SETSIZE")
+	}
 	return &EventLoopSelector{
 		el:      el,
 		setSize: setSize,
-	}
+	}, nil
 }
 
 func (e *EventLoopSelector) AddFileEvent(fd int, mask uint8) error {
+	if fd >= selectSetSize {
+		return errors.New("EventLoopSelector fd exceed FD_SETSIZE")
+	}
 	if mask&ELMaskWritable != 0 {
 		e.wfds.Set(fd)
 	}
@@ -46,10 +56,8 @@ func (e *EventLoopSelector) Poll(t *time.Duration) (int, error) {
 	var tv *unix.Timeval
 
 	if t != nil {
-		tv = &unix.Timeval{
-			Sec:  t.Milliseconds() / 1000,
-			Usec: int32(t.Milliseconds() % 1000),
-		}
+		timeval := unix.NsecToTimeval(t.Nanoseconds())
+		tv = &timeval
 	}
 
 	copy(e.wfdsPoll.Bits[:], e.wfds.Bits[:])
@@ -57,6 +65,9 @@ func (e *EventLoopSelector) Poll(t *time.Duration) (int, error) {
 
 	n, err := unix.Select(e.el.maxFd+1, &e.rfdsPoll, &e.wfdsPoll, nil, tv)
 	if err != nil {
+		if err == unix.EINTR {
+			return 0, nil
+		}
 		return n, err
 	}
 
@@ -69,20 +80,18 @@ func (e *EventLoopSelector) Poll(t *time.Duration) (int, error) {
 				continue
 			}
 
-			if !e.rfdsPoll.IsSet(j) && !e.wfdsPoll.IsSet(j) {
-				continue
-			}
-
+			var mask uint8
 			if event.Mask&ELMaskReadable != 0 && e.rfdsPoll.IsSet(j) {
-				e.el.Fired[numEvents].Mask |= ELMaskReadable
+				mask |= ELMaskReadable
 			}
 			if event.Mask&ELMaskWritable != 0 && e.wfdsPoll.IsSet(j) {
-				e.el.Fired[numEvents].Mask |= ELMaskWritable
+				mask |= ELMaskWritable
+			}
+			if mask == ELMaskNone {
+				continue
 			}
 			e.el.Fired[numEvents].Fd = j
-			e.el.Fired[numEvents].clientData = event.clientData
-			e.el.Fired[numEvents].rProc = event.rProc
-			e.el.Fired[numEvents].wProc = event.wProc
+			e.el.Fired[numEvents].Mask = mask
 			numEvents++
 		}
 	}
@@ -90,3 +99,11 @@ func (e *EventLoopSelector) Poll(t *time.Duration) (int, error) {
 	return numEvents, nil
 
 }
+
+func (e *EventLoopSelector) Name() string {
+	return "select"
+}
+
+func (e *EventLoopSelector) Close() error {
+	return nil
+}
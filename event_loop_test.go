@@ -0,0 +1,229 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+var testEventLoopApis = [...]int{ELApiSelect, ELApiEpoll, ELApiEpollEdge}
+
+func forEachEventLoopApi(t *testing.T, fn func(t *testing.T, el *EventLoop)) {
+	for _, apiType := range testEventLoopApis {
+		el, err := NewEventLoop(128, apiType, nil, nil)
+		if err == errEventLoopApiUnsupported {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("NewEventLoop error=%v, api=%d", err, apiType)
+		}
+		t.Run(el.ElApi.Name(), func(t *testing.T) {
+			defer el.ElApi.Close()
+			fn(t, el)
+		})
+	}
+}
+
+func newTestPipe(t *testing.T) (*os.File, *os.File) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe error=%v", err)
+	}
+	t.Cleanup(func() {
+		_ = r.Close()
+		_ = w.Close()
+	})
+	return r, w
+}
+
+func pollNoWait(t *testing.T, el *EventLoop) int {
+	n, err := el.poll(ELFlagsFileEvents | ELFlagsNoWait)
+	if err != nil {
+		t.Fatalf("poll error=%v", err)
+	}
+	return n
+}
+
+func TestEventLoop_Readable(t *testing.T) {
+	forEachEventLoopApi(t, func(t *testing.T, el *EventLoop) {
+		r, w := newTestPipe(t)
+
+		fired := 0
+		err := el.AddFileEvent(r, ELMaskReadable, func(el *EventLoop, fd int, mask uint8, clientData interface{}) {
+			if mask != ELMaskReadable {
+				t.Fatalf("want readable mask, got %d", mask)
+			}
+			if clientData.(string) != "reader" {
+				t.Fatalf("want clientData reader, got %v", clientData)
+			}
+			buf := make([]byte, 16)
+			_, _ = r.Read(buf)
+			fired++
+		}, "reader")
+		if err != nil {
+			t.Fatalf("AddFileEvent error=%v", err)
+		}
+
+		if n := pollNoWait(t, el); n != 0 {
+			t.Fatalf("want no event before write, got %d", n)
+		}
+
+		_, _ = w.Write([]byte("ping"))
+		if n := pollNoWait(t, el); n != 1 || fired != 1 {
+			t.Fatalf("want 1 event after write, got n=%d, fired=%d", n, fired)
+		}
+
+		if n := pollNoWait(t, el); n != 0 {
+			t.Fatalf("want no event after drain, got %d", n)
+		}
+	})
+}
+
+func TestEventLoop_Writable(t *testing.T) {
+	forEachEventLoopApi(t, func(t *testing.T, el *EventLoop) {
+		_, w := newTestPipe(t)
+
+		fired := 0
+		err := el.AddFileEvent(w, ELMaskWritable, func(el *EventLoop, fd int, mask uint8, clientData interface{}) {
+			fired++
+			if err := el.DelFileEvent(fd, ELMaskWritable); err != nil {
+				t.Fatalf("DelFileEvent error=%v", err)
+			}
+		}, nil)
+		if err != nil {
+			t.Fatalf("AddFileEvent error=%v", err)
+		}
+
+		if n := pollNoWait(t, el); n != 1 || fired != 1 {
+			t.Fatalf("want 1 writable event, got n=%d, fired=%d", n, fired)
+		}
+
+		if n := pollNoWait(t, el); n != 0 || fired != 1 {
+			t.Fatalf("want no event after delete, got n=%d, fired=%d", n, fired)
+		}
+
+		if el.maxFd != -1 {
+			t.Fatalf("want maxFd -1 after delete, got %d", el.maxFd)
+		}
+	})
+}
+
+func TestEventLoop_DelOneMaskKeepsOther(t *testing.T) {
+	forEachEventLoopApi(t, func(t *testing.T, el *EventLoop) {
+		r, w := newTestPipe(t)
+		fd := int(r.Fd())
+
+		reads, writes := 0, 0
+		readProc := func(el *EventLoop, fd int, mask uint8, clientData interface{}) {
+			buf := make([]byte, 16)
+			_, _ = r.Read(buf)
+			reads++
+		}
+		writeProc := func(el *EventLoop, fd int, mask uint8, clientData interface{}) {
+			writes++
+		}
+
+		if err := el.AddFileEvent(r, ELMaskReadable, readProc, nil); err != nil {
+			t.Fatalf("AddFileEvent readable error=%v", err)
+		}
+		if err := el.AddFileEvent(w, ELMaskWritable, writeProc, nil); err != nil {
+			t.Fatalf("AddFileEvent writable error=%v", err)
+		}
+
+		_, _ = w.Write([]byte("x"))
+		if n := pollNoWait(t, el); n != 2 || reads != 1 || writes != 1 {
+			t.Fatalf("want 2 events, got n=%d, reads=%d, writes=%d", n, reads, writes)
+		}
+
+		if err := el.DelFileEvent(int(w.Fd()), ELMaskWritable); err != nil {
+			t.Fatalf("DelFileEvent error=%v", err)
+		}
+		if el.maxFd != fd {
+			t.Fatalf("want maxFd %d, got %d", fd, el.maxFd)
+		}
+
+		_, _ = w.Write([]byte("y"))
+		if n := pollNoWait(t, el); n != 1 || reads != 2 || writes != 1 {
+			t.Fatalf("want only the readable event, got n=%d, reads=%d, writes=%d", n, reads, writes)
+		}
+
+		if el.Events[fd].Mask != ELMaskReadable {
+			t.Fatalf("want readable mask kept, got %d", el.Events[fd].Mask)
+		}
+	})
+}
+
+func TestEventLoop_HandlerDeletesFd(t *testing.T) {
+	forEachEventLoopApi(t, func(t *testing.T, el *EventLoop) {
+		r, w := newTestPipe(t)
+
+		reads, writes := 0, 0
+		err := el.AddFileEvent(r, ELMaskReadable, func(el *EventLoop, fd int, mask uint8, clientData interface{}) {
+			reads++
+			_ = el.DelFileEvent(fd, ELMaskReadable|ELMaskWritable)
+		}, nil)
+		if err != nil {
+			t.Fatalf("AddFileEvent error=%v", err)
+		}
+		err = el.AddFileEvent(r, ELMaskWritable, func(el *EventLoop, fd int, mask uint8, clientData interface{}) {
+			writes++
+		}, nil)
+		if err != nil {
+			t.Fatalf("AddFileEvent error=%v", err)
+		}
+
+		_, _ = w.Write([]byte("x"))
+		pollNoWait(t, el)
+		if reads != 1 || writes != 0 {
+			t.Fatalf("want write handler skipped after delete, got reads=%d, writes=%d", reads, writes)
+		}
+	})
+}
+
+func TestEventLoop_FdOutOfRange(t *testing.T) {
+	forEachEventLoopApi(t, func(t *testing.T, el *EventLoop) {
+		var files []*os.File
+		defer func() {
+			for _, f := range files {
+				_ = f.Close()
+			}
+		}()
+
+		for {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatalf("os.Pipe error=%v", err)
+			}
+			files = append(files, r, w)
+			if int(w.Fd()) >= el.SetSize {
+				if err := el.AddFileEvent(w, ELMaskWritable, nil, nil); err == nil {
+					t.Fatalf("want out of range error, fd=%d", w.Fd())
+				}
+				return
+			}
+		}
+	})
+}
+
+func TestEventLoop_LevelTriggered(t *testing.T) {
+	forEachEventLoopApi(t, func(t *testing.T, el *EventLoop) {
+		if el.ElApi.Name() == "epoll-et" {
+			t.Skip("edge triggered")
+		}
+		r, w := newTestPipe(t)
+
+		fired := 0
+		err := el.AddFileEvent(r, ELMaskReadable, func(el *EventLoop, fd int, mask uint8, clientData interface{}) {
+			fired++
+		}, nil)
+		if err != nil {
+			t.Fatalf("AddFileEvent error=%v", err)
+		}
+
+		_, _ = w.Write([]byte("x"))
+		pollNoWait(t, el)
+		pollNoWait(t, el)
+		if fired != 2 {
+			t.Fatalf("want fired twice while unread, got %d", fired)
+		}
+	})
+}
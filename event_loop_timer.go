@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"time"
+)
+
+var errNoSuchTimer = errors.New("no such timer")
+
+// timerHeap is a min-heap of timers ordered by fire time, timers firing at
+// the same millisecond keep their creation order.
+type timerHeap []*TimerEvent
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when == h[j].when {
+		return h[i].Id < h[j].Id
+	}
+	return h[i].when < h[j].when
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x any) {
+	te := x.(*TimerEvent)
+	te.index = len(*h)
+	*h = append(*h, te)
+}
+
+func (h *timerHeap) Pop() any {
+	old := *h
+	n := len(old)
+	te := old[n-1]
+	old[n-1] = nil
+	te.index = -1
+	*h = old[:n-1]
+	return te
+}
+
+// AddTimer schedules procTimerEvent to run after t and returns the timer id.
+// The value returned by procTimerEvent reschedules the timer that far in the
+// future, a value <= 0 deletes it.
+func (el *EventLoop) AddTimer(t time.Duration, procTimerEvent ProcTimerEvent, clientData interface{}) int64 {
+
+	timerEvent := &TimerEvent{
+		Id:         el.NextTimerId,
+		when:       time.Now().Add(t).UnixMilli(),
+		ProcTimer:  procTimerEvent,
+		clientData: clientData,
+	}
+	el.NextTimerId++
+
+	heap.Push(&el.Timers, timerEvent)
+	el.TimerIndex[timerEvent.Id] = timerEvent
+	return timerEvent.Id
+
+}
+
+// DeleteTimer cancels the timer, it is safe to call from any timer handler,
+// including the handler of the timer itself.
+func (el *EventLoop) DeleteTimer(id int64) error {
+
+	timerEvent, ok := el.TimerIndex[id]
+	if !ok {
+		return errNoSuchTimer
+	}
+
+	delete(el.TimerIndex, id)
+	if timerEvent.index >= 0 {
+		heap.Remove(&el.Timers, timerEvent.index)
+	}
+	return nil
+
+}
+
+func (el *EventLoop) searchNearestTimer() *TimerEvent {
+	if len(el.Timers) == 0 {
+		return nil
+	}
+	return el.Timers[0]
+}
+
+func (el *EventLoop) processTimerEvents() int {
+
+	numEvents := 0
+	now := time.Now().UnixMilli()
+
+	// the due timers leave the heap before any handler runs, so a timer
+	// created by a handler waits for the next iteration without holding
+	// back the older ones, even when it goes to the head of the heap.
+	var due []*TimerEvent
+	for len(el.Timers) > 0 && el.Timers[0].when <= now {
+		due = append(due, heap.Pop(&el.Timers).(*TimerEvent))
+	}
+
+	for _, timerEvent := range due {
+
+		// deleted by the handler of a timer run before it
+		if el.TimerIndex[timerEvent.Id] != timerEvent {
+			continue
+		}
+
+		nextTrigger := timerEvent.ProcTimer(el, timerEvent.Id, timerEvent.clientData)
+		numEvents++
+
+		// deleted by its own handler
+		if el.TimerIndex[timerEvent.Id] != timerEvent {
+			continue
+		}
+
+		if nextTrigger > 0 {
+			// sub millisecond reschedules still wait a tick, the loop above
+			// must make progress.
+			timerEvent.when = time.Now().UnixMilli() + max(nextTrigger.Milliseconds(), 1)
+			heap.Push(&el.Timers, timerEvent)
+		} else {
+			delete(el.TimerIndex, timerEvent.Id)
+		}
+
+	}
+
+	return numEvents
+}
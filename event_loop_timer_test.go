@@ -0,0 +1,206 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func newTestTimerEventLoop(t *testing.T) *EventLoop {
+	el, err := NewEventLoop(128, ELApiSelect, nil, nil)
+	if err != nil {
+		t.Fatalf("NewEventLoop error=%v", err)
+	}
+	t.Cleanup(func() {
+		_ = el.ElApi.Close()
+	})
+	return el
+}
+
+func runTimersUntil(t *testing.T, el *EventLoop, deadline time.Duration, done func() bool) {
+	end := time.Now().Add(deadline)
+	for !done() {
+		if time.Now().After(end) {
+			t.Fatalf("timers not done after %v, pending=%d", deadline, len(el.Timers))
+		}
+		if _, err := el.poll(ELFlagsTimeEvents); err != nil {
+			t.Fatalf("poll error=%v", err)
+		}
+	}
+}
+
+func TestEventLoop_AddTimerReturnsIds(t *testing.T) {
+	el := newTestTimerEventLoop(t)
+
+	proc := func(el *EventLoop, timerId int64, clientData interface{}) time.Duration {
+		return 0
+	}
+	first := el.AddTimer(time.Second, proc, nil)
+	second := el.AddTimer(time.Second, proc, nil)
+	if first == second {
+		t.Fatalf("want distinct timer ids, got %d twice", first)
+	}
+	if el.NextTimerId != second+1 {
+		t.Fatalf("want NextTimerId %d, got %d", second+1, el.NextTimerId)
+	}
+
+	if err := el.DeleteTimer(first); err != nil {
+		t.Fatalf("DeleteTimer error=%v", err)
+	}
+	if err := el.DeleteTimer(first); err != errNoSuchTimer {
+		t.Fatalf("want errNoSuchTimer deleting twice, got %v", err)
+	}
+	if nearest := el.searchNearestTimer(); nearest == nil || nearest.Id != second {
+		t.Fatalf("want nearest timer %d, got %v", second, nearest)
+	}
+}
+
+func TestEventLoop_ThousandsOfTimers(t *testing.T) {
+	el := newTestTimerEventLoop(t)
+
+	const numTimers = 5000
+	fired := make(map[int64]int, numTimers)
+	deleted := make(map[int64]bool)
+	lastWhen := int64(0)
+	inOrder := true
+
+	proc := func(el *EventLoop, timerId int64, clientData interface{}) time.Duration {
+		when := el.TimerIndex[timerId].when
+		if when < lastWhen {
+			inOrder = false
+		}
+		lastWhen = when
+		fired[timerId]++
+		return 0
+	}
+
+	ids := make([]int64, 0, numTimers)
+	for i := 0; i < numTimers; i++ {
+		delay := time.Duration(rand.Intn(50)) * time.Millisecond
+		ids = append(ids, el.AddTimer(delay, proc, nil))
+	}
+
+	for i := 0; i < numTimers; i += 3 {
+		if err := el.DeleteTimer(ids[i]); err != nil {
+			t.Fatalf("DeleteTimer error=%v, id=%d", err, ids[i])
+		}
+		deleted[ids[i]] = true
+	}
+
+	runTimersUntil(t, el, time.Second*5, func() bool {
+		return len(el.Timers) == 0
+	})
+
+	for _, id := range ids {
+		if deleted[id] {
+			if fired[id] != 0 {
+				t.Fatalf("deleted timer %d fired %d times", id, fired[id])
+			}
+			continue
+		}
+		if fired[id] != 1 {
+			t.Fatalf("timer %d fired %d times, want 1", id, fired[id])
+		}
+	}
+
+	if !inOrder {
+		t.Fatalf("timers not fired in order of their fire time")
+	}
+
+	if len(el.TimerIndex) != 0 {
+		t.Fatalf("want empty timer index, got %d", len(el.TimerIndex))
+	}
+}
+
+func TestEventLoop_TimerReschedule(t *testing.T) {
+	el := newTestTimerEventLoop(t)
+
+	var fires []time.Time
+	start := time.Now()
+	el.AddTimer(time.Millisecond*10, func(el *EventLoop, timerId int64, clientData interface{}) time.Duration {
+		fires = append(fires, time.Now())
+		if len(fires) == 4 {
+			return 0
+		}
+		return time.Millisecond * 20
+	}, nil)
+
+	runTimersUntil(t, el, time.Second*5, func() bool {
+		return len(el.Timers) == 0
+	})
+
+	if len(fires) != 4 {
+		t.Fatalf("want 4 fires, got %d", len(fires))
+	}
+	if elapsed := fires[3].Sub(start); elapsed < time.Millisecond*70 {
+		t.Fatalf("want rescheduled in milliseconds, last fire after %v", elapsed)
+	}
+}
+
+func TestEventLoop_TimerDeletesItself(t *testing.T) {
+	el := newTestTimerEventLoop(t)
+
+	fired := 0
+	el.AddTimer(0, func(el *EventLoop, timerId int64, clientData interface{}) time.Duration {
+		fired++
+		if err := el.DeleteTimer(timerId); err != nil {
+			t.Fatalf("DeleteTimer error=%v", err)
+		}
+		return time.Millisecond
+	}, nil)
+
+	runTimersUntil(t, el, time.Second, func() bool {
+		return fired > 0
+	})
+	_, _ = el.poll(ELFlagsTimeEvents | ELFlagsNoWait)
+
+	if fired != 1 || len(el.Timers) != 0 {
+		t.Fatalf("want fired once and removed, got fired=%d, pending=%d", fired, len(el.Timers))
+	}
+}
+
+func TestEventLoop_TimerAddedByHandlerWaitsNextIteration(t *testing.T) {
+	el := newTestTimerEventLoop(t)
+
+	fired := 0
+	var proc ProcTimerEvent
+	proc = func(el *EventLoop, timerId int64, clientData interface{}) time.Duration {
+		fired++
+		el.AddTimer(0, proc, nil)
+		return 0
+	}
+	el.AddTimer(0, proc, nil)
+
+	time.Sleep(time.Millisecond)
+	if n := el.processTimerEvents(); n != 1 {
+		t.Fatalf("want a single timer processed, got %d", n)
+	}
+	if fired != 1 || len(el.Timers) != 1 {
+		t.Fatalf("want 1 fire and 1 pending timer, got fired=%d, pending=%d", fired, len(el.Timers))
+	}
+}
+
+func TestEventLoop_TimerAddedByHandlerKeepsDueTimers(t *testing.T) {
+	el := newTestTimerEventLoop(t)
+
+	var fired []int64
+	proc := func(el *EventLoop, timerId int64, clientData interface{}) time.Duration {
+		fired = append(fired, timerId)
+		return 0
+	}
+	first := el.AddTimer(0, func(el *EventLoop, timerId int64, clientData interface{}) time.Duration {
+		fired = append(fired, timerId)
+		// already due and ahead of the second timer in the heap
+		el.AddTimer(-time.Second, proc, nil)
+		return 0
+	}, nil)
+	second := el.AddTimer(0, proc, nil)
+
+	time.Sleep(time.Millisecond)
+	if n := el.processTimerEvents(); n != 2 {
+		t.Fatalf("want the 2 due timers processed, got %d", n)
+	}
+	if len(fired) != 2 || fired[0] != first || fired[1] != second || len(el.Timers) != 1 {
+		t.Fatalf("want timers %d and %d fired and 1 pending, got fired=%v, pending=%d", first, second, fired, len(el.Timers))
+	}
+}
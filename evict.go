@@ -0,0 +1,357 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// maxmemory policies, the low bits tell how the keys are ranked and which
+// keyspace is sampled.
+const (
+	maxmemoryFlagLRU     = 1 << 0
+	maxmemoryFlagLFU     = 1 << 1
+	maxmemoryFlagAllKeys = 1 << 2
+
+	maxmemoryVolatileLRU    = 0<<8 | maxmemoryFlagLRU
+	maxmemoryVolatileLFU    = 1<<8 | maxmemoryFlagLFU
+	maxmemoryVolatileTTL    = 2 << 8
+	maxmemoryVolatileRandom = 3 << 8
+	maxmemoryAllKeysLRU     = 4<<8 | maxmemoryFlagLRU | maxmemoryFlagAllKeys
+	maxmemoryAllKeysLFU     = 5<<8 | maxmemoryFlagLFU | maxmemoryFlagAllKeys
+	maxmemoryAllKeysRandom  = 6<<8 | maxmemoryFlagAllKeys
+	maxmemoryNoEviction     = 7 << 8
+)
+
+var maxmemoryPolicyEnum = []configEnum{
+	{"volatile-lru", maxmemoryVolatileLRU},
+	{"volatile-lfu", maxmemoryVolatileLFU},
+	{"volatile-random", maxmemoryVolatileRandom},
+	{"volatile-ttl", maxmemoryVolatileTTL},
+	{"allkeys-lru", maxmemoryAllKeysLRU},
+	{"allkeys-lfu", maxmemoryAllKeysLFU},
+	{"allkeys-random", maxmemoryAllKeysRandom},
+	{"noeviction", maxmemoryNoEviction},
+}
+
+const (
+	lruClockMax        = 1<<24 - 1 // max value of the 24 bits object clock
+	lruClockResolution = 1000      // milliseconds per clock tick
+	lfuInitVal         = 5         // counter of new objects, so they are not evicted at once
+	evictionPoolSize   = 16
+	// time a single performEvictions call can spend, the eviction continues
+	// from a timer when it's not enough.
+	evictionTimeLimit = 500 * time.Microsecond
+)
+
+const (
+	evictOK = iota
+	evictRunning
+	evictFail
+)
+
+type evictionPoolEntry struct {
+	idle uint64 // the higher, the better candidate
+	key  string
+	dbid int
+}
+
+// the pool keeps the best candidates across performEvictions calls.
+var evictionPool = make([]evictionPoolEntry, 0, evictionPoolSize)
+
+func getLRUClock() uint32 {
+	return uint32(mstime()/lruClockResolution) & lruClockMax
+}
+
+// lruClock returns the clock cached by serverCron when its resolution is
+// enough.
+func lruClock() uint32 {
+	if 1000/rServer.hz <= lruClockResolution {
+		return rServer.lruclock
+	}
+	return getLRUClock()
+}
+
+// estimateObjectIdleTime returns the milliseconds since the last access of
+// o, with the clock resolution.
+func estimateObjectIdleTime(o *rObj) uint64 {
+	now := lruClock()
+	if now >= o.lru {
+		return uint64(now-o.lru) * lruClockResolution
+	}
+	// the clock wrapped around
+	return uint64(lruClockMax-o.lru+now) * lruClockResolution
+}
+
+// with a LFU policy, the 24 bits of the object clock hold the last decrement
+// time in minutes (16 bits) and a logarithmic access counter (8 bits).
+
+func lfuGetTimeInMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & 65535
+}
+
+func lfuTimeElapsed(ldt uint32) uint32 {
+	now := lfuGetTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 65535 - ldt + now
+}
+
+// lfuLogIncr increments the counter with a probability that decreases as
+// the counter grows.
+func lfuLogIncr(counter uint32) uint32 {
+	if counter == 255 {
+		return 255
+	}
+	baseval := float64(counter) - lfuInitVal
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*float64(rServer.lfuLogFactor) + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
+
+// lfuDecrAndReturn returns the counter of o decremented by the number of
+// decay periods elapsed since the last decrement.
+func lfuDecrAndReturn(o *rObj) uint32 {
+	ldt := o.lru >> 8
+	counter := o.lru & 255
+	if rServer.lfuDecayTime == 0 {
+		return counter
+	}
+	periods := lfuTimeElapsed(ldt) / uint32(rServer.lfuDecayTime)
+	if periods > counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// initObjectAccess sets the clock of a new object.
+func initObjectAccess(o *rObj) {
+	if rServer.maxmemoryPolicy&maxmemoryFlagLFU != 0 {
+		o.lru = lfuGetTimeInMinutes()<<8 | lfuInitVal
+	} else {
+		o.lru = lruClock()
+	}
+}
+
+// updateObjectAccess records an access to o.
+func updateObjectAccess(o *rObj) {
+	if rServer.maxmemoryPolicy&maxmemoryFlagLFU != 0 {
+		counter := lfuLogIncr(lfuDecrAndReturn(o))
+		o.lru = lfuGetTimeInMinutes()<<8 | counter
+	} else {
+		o.lru = lruClock()
+	}
+}
+
+// usedMemory is the approximate memory used by the dataset.
+func usedMemory() int64 {
+	var used int64
+	for _, db := range rServer.db {
+		used += db.usedMemory
+	}
+	return used
+}
+
+// evictionPoolPopulate samples keys of db and inserts the ones better than
+// the worst of the pool, keeping the pool sorted by ascending idle.
+func evictionPoolPopulate(db *redisDb, sampleDict *dict) {
+
+	for _, de := range sampleDict.someEntries(rServer.maxmemorySamples) {
+
+		o := lookupKeyNoTouch(db, de.key)
+		if o == nil {
+			continue
+		}
+
+		var idle uint64
+		switch {
+		case rServer.maxmemoryPolicy&maxmemoryFlagLRU != 0:
+			idle = estimateObjectIdleTime(o)
+		case rServer.maxmemoryPolicy&maxmemoryFlagLFU != 0:
+			idle = 255 - uint64(lfuDecrAndReturn(o))
+		case rServer.maxmemoryPolicy == maxmemoryVolatileTTL:
+			// the sooner it expires, the better
+			idle = math.MaxUint64 - uint64(de.val.(int64))
+		}
+
+		k := 0
+		for k < len(evictionPool) && evictionPool[k].idle < idle {
+			k++
+		}
+		if k < len(evictionPool) && evictionPool[k].key == de.key && evictionPool[k].dbid == db.id {
+			continue
+		}
+
+		entry := evictionPoolEntry{idle: idle, key: de.key, dbid: db.id}
+		switch {
+		case len(evictionPool) < evictionPoolSize:
+			evictionPool = append(evictionPool, evictionPoolEntry{})
+			copy(evictionPool[k+1:], evictionPool[k:])
+			evictionPool[k] = entry
+		case k == 0:
+			// worse than every candidate of a full pool
+		default:
+			// drop the worst candidate on the left
+			copy(evictionPool[:k-1], evictionPool[1:k])
+			evictionPool[k-1] = entry
+		}
+	}
+
+}
+
+// lookupKeyNoTouch returns the value of key without changing its access
+// time or expiring it.
+func lookupKeyNoTouch(db *redisDb, key string) *rObj {
+	val, ok := db.dict.fetchValue(key)
+	if !ok {
+		return nil
+	}
+	return val.(*rObj)
+}
+
+// evictionBestKey finds the next key to evict according to the policy.
+func evictionBestKey() (*redisDb, string, bool) {
+
+	policy := rServer.maxmemoryPolicy
+	sampleDict := func(db *redisDb) *dict {
+		if policy&maxmemoryFlagAllKeys != 0 {
+			return db.dict
+		}
+		return db.expires
+	}
+
+	if policy&(maxmemoryFlagLRU|maxmemoryFlagLFU) != 0 || policy == maxmemoryVolatileTTL {
+		for {
+			total := 0
+			for _, db := range rServer.db {
+				d := sampleDict(db)
+				if d.size() > 0 {
+					total += d.size()
+					evictionPoolPopulate(db, d)
+				}
+			}
+			if total == 0 {
+				return nil, "", false
+			}
+
+			// the best candidates are at the end, they may be gone already
+			for k := len(evictionPool) - 1; k >= 0; k-- {
+				entry := evictionPool[k]
+				evictionPool = evictionPool[:k]
+				db := rServer.db[entry.dbid]
+				if sampleDict(db).find(entry.key) != nil {
+					return db, entry.key, true
+				}
+			}
+		}
+	}
+
+	// random policies, visit the dbs incrementally
+	for j := 0; j < rServer.dbnum; j++ {
+		db := rServer.db[rServer.evictCurrentDb%rServer.dbnum]
+		rServer.evictCurrentDb++
+		if de := sampleDict(db).randomEntry(); de != nil {
+			return db, de.key, true
+		}
+	}
+	return nil, "", false
+
+}
+
+// performEvictions evicts keys until the memory is below maxmemory. It
+// returns evictRunning when it ran out of time, the eviction then goes on
+// from a timer, and evictFail when nothing can be evicted.
+func performEvictions() int {
+
+	// the dataset of a replica is the one of its master
+	if rServer.masterhost != "" && rServer.replIgnoreMaxmemory {
+		return evictOK
+	}
+	if rServer.maxmemory == 0 || usedMemory() <= rServer.maxmemory {
+		return evictOK
+	}
+	if rServer.maxmemoryPolicy == maxmemoryNoEviction {
+		return evictFail
+	}
+
+	start := time.Now()
+	for keys := 0; usedMemory() > rServer.maxmemory; keys++ {
+
+		db, key, ok := evictionBestKey()
+		if !ok {
+			return evictFail
+		}
+		deleteEvictedKey(db, key)
+
+		if keys&15 == 15 && time.Since(start) > evictionTimeLimit {
+			if !rServer.evictionTimerActive {
+				rServer.evictionTimerActive = true
+				rServer.el.AddTimer(0, evictionTimeProc, nil)
+			}
+			return evictRunning
+		}
+	}
+	return evictOK
+
+}
+
+func evictionTimeProc(el *EventLoop, timerId int64, clientData any) time.Duration {
+
+	if performEvictions() == evictRunning {
+		return time.Millisecond
+	}
+	rServer.evictionTimerActive = false
+	return 0
+
+}
+
+func deleteEvictedKey(db *redisDb, key string) {
+	dbDelete(db, key)
+	touchWatchedKey(db, key)
+	rServer.statEvictedKeys++
+	propagateDeletion(db, key)
+}
+
+func updateMaxmemory() error {
+
+	if rServer.maxmemory > 0 && usedMemory() > rServer.maxmemory {
+		Log("WARNING: the new maxmemory value set via CONFIG SET (%d) is smaller than the current memory usage (%d)."+
+			" This will result in key eviction and/or the inability to accept new write commands depending on the"+
+			" maxmemory-policy.", rServer.maxmemory, usedMemory())
+	}
+	performEvictions()
+	return nil
+
+}
+
+// objectSetLRUOrLFU restores the clock of a loaded object from the LFU
+// counter or the LRU idle seconds saved with it, -1 when not saved.
+func objectSetLRUOrLFU(o *rObj, lfuFreq int, lruIdle int64) {
+
+	if rServer.maxmemoryPolicy&maxmemoryFlagLFU != 0 {
+		if lfuFreq >= 0 {
+			o.lru = lfuGetTimeInMinutes()<<8 | uint32(lfuFreq)
+		}
+		return
+	}
+	if rServer.maxmemoryPolicy&maxmemoryFlagLRU != 0 && lruIdle >= 0 {
+		// the idle time is made relative to the current clock
+		idle := uint64(lruIdle) * 1000 / lruClockResolution
+		if idle >= lruClockMax {
+			idle = lruClockMax - 1
+		}
+		now := lruClock()
+		if uint64(now) >= idle {
+			o.lru = now - uint32(idle)
+		} else {
+			o.lru = lruClockMax - (uint32(idle) - now)
+		}
+	}
+
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// setMaxmemory configures the eviction for the duration of the test.
+func setMaxmemory(tc *testConn, maxmemory int64, policy string) {
+	tc.t.Helper()
+	tc.expect(testStatus("OK"), "config", "set", "maxmemory-policy", policy, "maxmemory", strconv.FormatInt(maxmemory, 10))
+	tc.t.Cleanup(func() {
+		tc.expect(testStatus("OK"), "config", "set", "maxmemory", "0", "maxmemory-policy", "noeviction")
+	})
+}
+
+func TestEvict_NoEviction(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "11")
+	tc.expect(testStatus("OK"), "flushall")
+	tc.expect(testStatus("OK"), "set", "a", "1")
+
+	setMaxmemory(tc, 1, "noeviction")
+	tc.expect(testError("OOM command not allowed when used memory > 'maxmemory'."), "set", "b", "1")
+	tc.expect("1", "get", "a")
+	// commands that free memory are still allowed
+	tc.expect(int64(1), "del", "a")
+	tc.expect(int64(0), "dbsize")
+}
+
+func TestEvict_VolatileTTL(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "11")
+	tc.expect(testStatus("OK"), "flushall")
+
+	tc.expect(testStatus("OK"), "set", "persistent", "v")
+	for j := 0; j < 10; j++ {
+		tc.expect(testStatus("OK"), "set", "k"+strconv.Itoa(j), "v", "ex", strconv.Itoa(1000+j))
+	}
+	used := tc.usedMemory()
+	perKey := used / 11
+
+	// room for two keys less, the keys expiring first go. Sampling every key
+	// makes the eviction exact.
+	tc.expect(testStatus("OK"), "config", "set", "maxmemory-samples", "64")
+	defer tc.expect(testStatus("OK"), "config", "set", "maxmemory-samples", "5")
+	setMaxmemory(tc, used-perKey*2, "volatile-ttl")
+	tc.expect(testStatus("OK"), "set", "k10", "v", "ex", "5000")
+	tc.expect([]any{nil, nil, "v", "v"}, "mget", "k0", "k1", "k2", "persistent")
+	// the memory of the new key is reclaimed by the next write
+	tc.expect(int64(0), "del", "nokey")
+	tc.expect([]any{nil, "v", "v", "v"}, "mget", "k2", "k3", "k10", "persistent")
+	tc.expect(int64(9), "dbsize")
+
+	// the volatile policies can't evict keys without ttl
+	tc.expect(testStatus("OK"), "flushall")
+	tc.expect(testStatus("OK"), "set", "persistent", "v")
+	tc.expect(testStatus("OK"), "config", "set", "maxmemory", "1")
+	tc.expectError("OOM", "set", "a", "b")
+	tc.expect("v", "get", "persistent")
+}
+
+func TestEvict_AllKeys(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "11")
+
+	for _, policy := range []string{"allkeys-lru", "allkeys-lfu", "allkeys-random", "volatile-lru", "volatile-lfu", "volatile-random"} {
+		tc.expect(testStatus("OK"), "flushall")
+		tc.expect(testStatus("OK"), "set", "k", "v", "ex", "1000")
+		setMaxmemory(tc, tc.usedMemory()*100, policy)
+
+		for j := 0; j < 500; j++ {
+			tc.send("set", "k"+strconv.Itoa(j), "v", "ex", "1000")
+		}
+		for j := 0; j < 500; j++ {
+			if got := tc.read(); got != testStatus("OK") {
+				t.Fatalf("%s: want OK, got %#v", policy, got)
+			}
+		}
+		size := tc.do("dbsize").(int64)
+		if size >= 500 || size < 50 {
+			t.Fatalf("%s: want about 100 keys left, got %d", policy, size)
+		}
+		// the eviction runs before the write commands
+		tc.expect(int64(0), "del", "nokey")
+		maxmemory, _ := strconv.ParseInt(tc.infoField("memory", "maxmemory"), 10, 64)
+		if used := tc.usedMemory(); used > maxmemory {
+			t.Fatalf("%s: used memory %d over maxmemory %d", policy, used, maxmemory)
+		}
+	}
+}
+
+func TestEvict_AccessClock(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "11")
+	tc.expect(testStatus("OK"), "set", "clock", "v")
+
+	tc.expect(int64(0), "object", "idletime", "clock")
+	tc.expectError("ERR An LFU maxmemory policy is not selected", "object", "freq", "clock")
+
+	setMaxmemory(tc, 0, "allkeys-lfu")
+	tc.expect(testStatus("OK"), "set", "lfu", "v")
+	tc.expect(int64(lfuInitVal), "object", "freq", "lfu")
+	for j := 0; j < 100; j++ {
+		tc.do("get", "lfu")
+	}
+	if freq := tc.do("object", "freq", "lfu").(int64); freq <= lfuInitVal {
+		t.Fatalf("want the counter incremented by the accesses, got %d", freq)
+	}
+	tc.expectError("ERR An LFU maxmemory policy is selected", "object", "idletime", "clock")
+
+	if usage := tc.do("memory", "usage", "clock").(int64); usage < int64(len("clock")+len("v")) {
+		t.Fatalf("want memory usage of the key, got %d", usage)
+	}
+	tc.expect(nil, "memory", "usage", "nokey")
+}
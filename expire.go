@@ -0,0 +1,328 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// active expire cycle tuning
+const (
+	activeExpireCycleKeysPerLoop     = 20   // keys sampled per db loop
+	activeExpireCycleFastDuration    = 1000 // microseconds
+	activeExpireCycleSlowTimePerc    = 25   // max CPU percentage of a slow cycle
+	activeExpireCycleAcceptableStale = 10   // percentage of expired keys that stops a db loop
+)
+
+const (
+	activeExpireCycleSlow = iota
+	activeExpireCycleFast
+)
+
+// EXPIRE family option flags
+const (
+	expireNX = 1 << iota
+	expireXX
+	expireGT
+	expireLT
+)
+
+// deleteExpiredKey removes a key whose time to live elapsed, the deletion
+// is propagated as a DEL.
+func deleteExpiredKey(db *redisDb, key string) {
+	dbDelete(db, key)
+	touchWatchedKey(db, key)
+	rServer.statExpiredKeys++
+	propagateDeletion(db, key)
+}
+
+// propagateDeletion propagates the deletion of a key made by the server
+// itself, expired or evicted, that running the commands again would not
+// make.
+func propagateDeletion(db *redisDb, key string) {
+	alsoPropagate(db.id, []*rObj{createEmbeddedStringObject("DEL"), createStringObject([]byte(key))})
+	postExecutionUnitOperations()
+}
+
+// activeExpireCycle samples keys with an expire from every db and deletes
+// the expired ones. A db is sampled again while more than
+// activeExpireCycleAcceptableStale percent of the sampled keys were expired,
+// until the time limit of the cycle is reached: a slow cycle can use
+// activeExpireCycleSlowTimePerc percent of a timer period, a fast cycle
+// activeExpireCycleFastDuration microseconds.
+func activeExpireCycle(cycleType int) {
+
+	start := time.Now()
+	if cycleType == activeExpireCycleFast {
+		// a fast cycle only runs when the last one could not keep up, and
+		// never more often than twice its duration.
+		if !rServer.expireTimelimitExit &&
+			rServer.statExpiredStalePerc < activeExpireCycleAcceptableStale {
+			return
+		}
+		if start.Sub(rServer.expireLastFastStart) < activeExpireCycleFastDuration*2*time.Microsecond {
+			return
+		}
+		rServer.expireLastFastStart = start
+	}
+
+	timelimit := time.Duration(activeExpireCycleSlowTimePerc) * time.Second / time.Duration(rServer.hz) / 100
+	if cycleType == activeExpireCycleFast {
+		timelimit = activeExpireCycleFastDuration * time.Microsecond
+	}
+	rServer.expireTimelimitExit = false
+
+	var totalSampled, totalExpired int64
+	var keys []string
+	iteration := 0
+
+	for dbs := 0; dbs < rServer.dbnum && !rServer.expireTimelimitExit; dbs++ {
+		db := rServer.db[rServer.expireCurrentDb%rServer.dbnum]
+		rServer.expireCurrentDb++
+
+		for {
+			if db.expires.size() == 0 {
+				break
+			}
+			iteration++
+
+			// walk the buckets from where the last cycle stopped, so every
+			// key gets checked eventually
+			keys = keys[:0]
+			maxBuckets := activeExpireCycleKeysPerLoop * 20
+			for buckets := 0; buckets < maxBuckets && len(keys) < activeExpireCycleKeysPerLoop; buckets++ {
+				db.expiresCursor = db.expires.scan(db.expiresCursor, func(de *dictEntry) {
+					keys = append(keys, de.key)
+				})
+				if db.expiresCursor == 0 {
+					break
+				}
+			}
+
+			now := mstime()
+			expired := 0
+			for _, key := range keys {
+				if when := getExpire(db, key); when >= 0 && when < now {
+					deleteExpiredKey(db, key)
+					expired++
+				}
+			}
+			totalSampled += int64(len(keys))
+			totalExpired += int64(expired)
+
+			if iteration&0xf == 0 && time.Since(start) > timelimit {
+				rServer.expireTimelimitExit = true
+				rServer.statExpiredTimeCapReached++
+				break
+			}
+
+			if len(keys) == 0 || expired*100/len(keys) <= activeExpireCycleAcceptableStale {
+				break
+			}
+		}
+	}
+
+	// running average of the stale keys, so the next cycles know how much
+	// garbage is left.
+	current := 0.0
+	if totalSampled > 0 {
+		current = float64(totalExpired) * 100 / float64(totalSampled)
+	}
+	rServer.statExpiredStalePerc = current*0.05 + rServer.statExpiredStalePerc*0.95
+
+}
+
+// activeExpireProc is the timer of the active expire cycle: a slow cycle
+// every 1/hz second, with fast cycles in between while the sampled keys
+// show that a lot of expired keys are left.
+func activeExpireProc(el *EventLoop, timerId int64, clientData any) time.Duration {
+
+	period := time.Second / time.Duration(rServer.hz)
+	// the keys of a replica expire with the DELs of its master
+	if rServer.masterhost != "" {
+		return period
+	}
+	now := time.Now()
+	if now.Sub(rServer.expireLastSlowStart) >= period {
+		rServer.expireLastSlowStart = now
+		activeExpireCycle(activeExpireCycleSlow)
+	} else {
+		activeExpireCycle(activeExpireCycleFast)
+	}
+
+	if rServer.expireTimelimitExit || rServer.statExpiredStalePerc > activeExpireCycleAcceptableStale {
+		return activeExpireCycleFastDuration * 2 * time.Microsecond
+	}
+	// a non positive duration would delete the timer
+	return max(time.Until(rServer.expireLastSlowStart.Add(period)), time.Millisecond)
+
+}
+
+// parseExpireFlags parses the NX, XX, GT and LT options of the EXPIRE family
+// from argv[3].
+func parseExpireFlags(c *client) (int, bool) {
+
+	flags := 0
+	for j := 3; j < c.argc; j++ {
+		switch opt := c.argv[j].String(); {
+		case strings.EqualFold(opt, "nx"):
+			flags |= expireNX
+		case strings.EqualFold(opt, "xx"):
+			flags |= expireXX
+		case strings.EqualFold(opt, "gt"):
+			flags |= expireGT
+		case strings.EqualFold(opt, "lt"):
+			flags |= expireLT
+		default:
+			addReplyErrorFormat(c, "Unsupported option %s", opt)
+			return 0, false
+		}
+	}
+
+	if flags&expireNX != 0 && flags&(expireXX|expireGT|expireLT) != 0 {
+		addReplyError(c, "NX and XX, GT or LT options at the same time are not compatible")
+		return 0, false
+	}
+	if flags&expireGT != 0 && flags&expireLT != 0 {
+		addReplyError(c, "GT and LT options at the same time are not compatible")
+		return 0, false
+	}
+	return flags, true
+
+}
+
+// expireGenericCommand implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT.
+// basetime is added to the argument, 0 for absolute times, and unit
+// converts it to milliseconds.
+func expireGenericCommand(c *client, basetime int64, unit time.Duration) {
+
+	key := c.argv[1].String()
+	when, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+	flags, ok := parseExpireFlags(c)
+	if !ok {
+		return
+	}
+
+	invalid := func() {
+		addReplyErrorFormat(c, "invalid expire time in '%s' command", c.cmd.name)
+	}
+	if unit == time.Second {
+		if when > math.MaxInt64/1000 || when < math.MinInt64/1000 {
+			invalid()
+			return
+		}
+		when *= 1000
+	}
+	if when > math.MaxInt64-basetime {
+		invalid()
+		return
+	}
+	when += basetime
+
+	if lookupKeyWrite(c.db, key) == nil {
+		addReply(c, shared.czero)
+		return
+	}
+
+	if flags != 0 {
+		current := getExpire(c.db, key)
+		// a key without ttl has an infinite one for GT and LT
+		if (flags&expireNX != 0 && current != -1) ||
+			(flags&expireXX != 0 && current == -1) ||
+			(flags&expireGT != 0 && (current == -1 || when <= current)) ||
+			(flags&expireLT != 0 && current != -1 && when >= current) {
+			addReply(c, shared.czero)
+			return
+		}
+	}
+
+	// an expire in the past deletes the key, but not while loading, the
+	// key is deleted when the AOF tells so
+	if when <= mstime() && !rServer.loading {
+		dbDelete(c.db, key)
+		rewriteClientCommandVector(c, createEmbeddedStringObject("DEL"), c.argv[1])
+	} else {
+		setExpire(c.db, key, when)
+		// relative times are propagated as the absolute time they gave
+		rewriteClientCommandVector(c, createEmbeddedStringObject("PEXPIREAT"), c.argv[1],
+			createStringObjectFromLongLong(when))
+	}
+	rServer.dirty++
+	addReply(c, shared.cone)
+
+}
+
+func expireCommand(c *client) {
+	expireGenericCommand(c, mstime(), time.Second)
+}
+
+func expireatCommand(c *client) {
+	expireGenericCommand(c, 0, time.Second)
+}
+
+func pexpireCommand(c *client) {
+	expireGenericCommand(c, mstime(), time.Millisecond)
+}
+
+func pexpireatCommand(c *client) {
+	expireGenericCommand(c, 0, time.Millisecond)
+}
+
+// ttlGenericCommand replies -2 for a missing key, -1 for a key without
+// expire, otherwise the remaining time to live or the absolute expire time.
+func ttlGenericCommand(c *client, outputMs, outputAbs bool) {
+
+	key := c.argv[1].String()
+	if lookupKeyRead(c.db, key) == nil {
+		addReplyLongLong(c, -2)
+		return
+	}
+
+	expire := getExpire(c.db, key)
+	if expire == -1 {
+		addReplyLongLong(c, -1)
+		return
+	}
+
+	ttl := expire
+	if !outputAbs {
+		ttl = max(expire-mstime(), 0)
+	}
+	if outputMs {
+		addReplyLongLong(c, ttl)
+	} else {
+		addReplyLongLong(c, (ttl+500)/1000)
+	}
+
+}
+
+func ttlCommand(c *client) {
+	ttlGenericCommand(c, false, false)
+}
+
+func pttlCommand(c *client) {
+	ttlGenericCommand(c, true, false)
+}
+
+func expiretimeCommand(c *client) {
+	ttlGenericCommand(c, false, true)
+}
+
+func pexpiretimeCommand(c *client) {
+	ttlGenericCommand(c, true, true)
+}
+
+func persistCommand(c *client) {
+
+	key := c.argv[1].String()
+	if lookupKeyWrite(c.db, key) == nil || !removeExpire(c.db, key) {
+		addReply(c, shared.czero)
+		return
+	}
+	rServer.dirty++
+	addReply(c, shared.cone)
+
+}
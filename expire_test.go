@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpire_Commands(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "10")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(int64(0), "expire", "nokey", "100")
+	tc.expect(int64(-2), "ttl", "nokey")
+	tc.expect(int64(-2), "expiretime", "nokey")
+
+	tc.expect(testStatus("OK"), "set", "k", "v")
+	tc.expect(int64(-1), "ttl", "k")
+	tc.expect(int64(-1), "pexpiretime", "k")
+
+	// GT never applies to a key without ttl, LT always does
+	tc.expect(int64(0), "expire", "k", "100", "xx")
+	tc.expect(int64(0), "expire", "k", "100", "gt")
+	tc.expect(int64(1), "expire", "k", "100", "lt")
+	tc.expect(int64(100), "ttl", "k")
+	tc.expect(int64(0), "expire", "k", "200", "nx")
+	tc.expect(int64(0), "expire", "k", "50", "gt")
+	tc.expect(int64(1), "expire", "k", "200", "gt")
+	tc.expect(int64(0), "pexpire", "k", "300000", "lt")
+	tc.expect(int64(1), "pexpire", "k", "150000", "xx", "lt")
+	if pttl := tc.do("pttl", "k").(int64); pttl <= 149000 || pttl > 150000 {
+		t.Fatalf("want pttl close to 150000, got %d", pttl)
+	}
+
+	at := time.Now().Unix() + 1000
+	tc.expect(int64(1), "expireat", "k", strconv.FormatInt(at, 10))
+	tc.expect(at, "expiretime", "k")
+	tc.expect(at*1000, "pexpiretime", "k")
+	tc.expect(int64(1), "pexpireat", "k", strconv.FormatInt(at*1000+1, 10))
+	tc.expect(at*1000+1, "pexpiretime", "k")
+
+	tc.expect(int64(1), "persist", "k")
+	tc.expect(int64(0), "persist", "k")
+	tc.expect(int64(-1), "ttl", "k")
+
+	tc.expectError("ERR NX and XX, GT or LT options at the same time are not compatible", "expire", "k", "1", "nx", "gt")
+	tc.expectError("ERR GT and LT options at the same time are not compatible", "expire", "k", "1", "gt", "lt")
+	tc.expectError("ERR Unsupported option foo", "expire", "k", "1", "foo")
+	tc.expectError("ERR invalid expire time in 'expire' command", "expire", "k", "9223372036854775807")
+
+	// a time in the past deletes the key
+	tc.expect(int64(1), "expire", "k", "-1")
+	tc.expect(int64(0), "exists", "k")
+}
+
+func TestExpire_ActiveCycle(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "10")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	const n = 1000
+	for j := 0; j < n; j++ {
+		tc.send("set", "key:"+strconv.Itoa(j), "v", "px", "10")
+	}
+	tc.send("set", "persistent", "v")
+	tc.send("set", "later", "v", "ex", "100")
+	for j := 0; j < n+2; j++ {
+		tc.read()
+	}
+	tc.expect(int64(n+2), "dbsize")
+
+	// nobody touches the keys, only the active cycle can reclaim them
+	deadline := time.Now().Add(time.Second * 5)
+	for tc.do("dbsize").(int64) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want expired keys reclaimed, dbsize=%d", tc.do("dbsize"))
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	tc.expect(int64(2), "exists", "persistent", "later")
+}
@@ -2,4 +2,4 @@ module roma
 
 go 1.21
 
-require golang.org/x/sys v0.19.0 // indirect
+require golang.org/x/sys v0.19.0
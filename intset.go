@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+)
+
+// An intset is a sorted array of unique integers serialized in a byte slice,
+// with the layout redis uses:
+//
+//	<encoding:4> <length:4> <values>
+//
+// every value being stored little endian in the encoding width, 2, 4 or 8
+// bytes. The encoding is upgraded when a value that does not fit is added,
+// and never downgraded.
+
+const (
+	intsetEncInt16 = 2
+	intsetEncInt32 = 4
+	intsetEncInt64 = 8
+
+	intsetHeaderSize = 8
+)
+
+func intsetNew() []byte {
+	is := make([]byte, intsetHeaderSize)
+	binary.LittleEndian.PutUint32(is[0:4], intsetEncInt16)
+	return is
+}
+
+func intsetValueEncoding(v int64) int {
+	switch {
+	case v < math.MinInt32 || v > math.MaxInt32:
+		return intsetEncInt64
+	case v < math.MinInt16 || v > math.MaxInt16:
+		return intsetEncInt32
+	}
+	return intsetEncInt16
+}
+
+func intsetEncoding(is []byte) int {
+	return int(binary.LittleEndian.Uint32(is[0:4]))
+}
+
+func intsetLen(is []byte) int {
+	return int(binary.LittleEndian.Uint32(is[4:8]))
+}
+
+func intsetSetLen(is []byte, n int) {
+	binary.LittleEndian.PutUint32(is[4:8], uint32(n))
+}
+
+func intsetGetEncoded(is []byte, pos, enc int) int64 {
+	off := intsetHeaderSize + pos*enc
+	switch enc {
+	case intsetEncInt64:
+		return int64(binary.LittleEndian.Uint64(is[off:]))
+	case intsetEncInt32:
+		return int64(int32(binary.LittleEndian.Uint32(is[off:])))
+	}
+	return int64(int16(binary.LittleEndian.Uint16(is[off:])))
+}
+
+// intsetGet returns the value at pos.
+func intsetGet(is []byte, pos int) int64 {
+	return intsetGetEncoded(is, pos, intsetEncoding(is))
+}
+
+func intsetSet(is []byte, pos int, v int64) {
+	enc := intsetEncoding(is)
+	off := intsetHeaderSize + pos*enc
+	switch enc {
+	case intsetEncInt64:
+		binary.LittleEndian.PutUint64(is[off:], uint64(v))
+	case intsetEncInt32:
+		binary.LittleEndian.PutUint32(is[off:], uint32(v))
+	default:
+		binary.LittleEndian.PutUint16(is[off:], uint16(v))
+	}
+}
+
+// intsetSearch returns the position of v, or the position where it would be
+// inserted when it is not found.
+func intsetSearch(is []byte, v int64) (int, bool) {
+
+	n := intsetLen(is)
+	if n == 0 {
+		return 0, false
+	}
+	// the common cases of values out of the range
+	if v > intsetGet(is, n-1) {
+		return n, false
+	}
+	if v < intsetGet(is, 0) {
+		return 0, false
+	}
+
+	lo, hi := 0, n-1
+	for lo <= hi {
+		mid := int(uint(lo+hi) >> 1)
+		cur := intsetGet(is, mid)
+		switch {
+		case v > cur:
+			lo = mid + 1
+		case v < cur:
+			hi = mid - 1
+		default:
+			return mid, true
+		}
+	}
+	return lo, false
+
+}
+
+// intsetResize makes room for n values, the encoding being already updated.
+func intsetResize(is []byte, n int) []byte {
+	size := intsetHeaderSize + n*intsetEncoding(is)
+	if size <= cap(is) {
+		return is[:size]
+	}
+	return append(is, make([]byte, size-len(is))...)
+}
+
+// intsetUpgradeAndAdd adds v, that does not fit the current encoding and so
+// is either smaller or bigger than every value.
+func intsetUpgradeAndAdd(is []byte, v int64) []byte {
+
+	oldEnc := intsetEncoding(is)
+	n := intsetLen(is)
+	prepend := 0
+	if v < 0 {
+		prepend = 1
+	}
+
+	binary.LittleEndian.PutUint32(is[0:4], uint32(intsetValueEncoding(v)))
+	is = intsetResize(is, n+1)
+
+	// from the end, so the old values are not overwritten
+	for j := n - 1; j >= 0; j-- {
+		intsetSet(is, j+prepend, intsetGetEncoded(is, j, oldEnc))
+	}
+	if prepend == 1 {
+		intsetSet(is, 0, v)
+	} else {
+		intsetSet(is, n, v)
+	}
+	intsetSetLen(is, n+1)
+	return is
+
+}
+
+// intsetAdd adds v, it returns the new intset and whether v was added.
+func intsetAdd(is []byte, v int64) ([]byte, bool) {
+
+	if intsetValueEncoding(v) > intsetEncoding(is) {
+		return intsetUpgradeAndAdd(is, v), true
+	}
+
+	pos, found := intsetSearch(is, v)
+	if found {
+		return is, false
+	}
+	n := intsetLen(is)
+	is = intsetResize(is, n+1)
+	enc := intsetEncoding(is)
+	if pos < n {
+		copy(is[intsetHeaderSize+(pos+1)*enc:], is[intsetHeaderSize+pos*enc:intsetHeaderSize+n*enc])
+	}
+	intsetSet(is, pos, v)
+	intsetSetLen(is, n+1)
+	return is, true
+
+}
+
+// intsetRemove removes v, it returns the new intset and whether v was there.
+func intsetRemove(is []byte, v int64) ([]byte, bool) {
+
+	if intsetValueEncoding(v) > intsetEncoding(is) {
+		return is, false
+	}
+	pos, found := intsetSearch(is, v)
+	if !found {
+		return is, false
+	}
+	n := intsetLen(is)
+	enc := intsetEncoding(is)
+	copy(is[intsetHeaderSize+pos*enc:], is[intsetHeaderSize+(pos+1)*enc:])
+	intsetSetLen(is, n-1)
+	return is[:intsetHeaderSize+(n-1)*enc], true
+
+}
+
+func intsetFind(is []byte, v int64) bool {
+	if intsetValueEncoding(v) > intsetEncoding(is) {
+		return false
+	}
+	_, found := intsetSearch(is, v)
+	return found
+}
+
+func intsetRandom(is []byte) int64 {
+	return intsetGet(is, rand.Intn(intsetLen(is)))
+}
+
+// intsetValidateIntegrity checks that is is a non empty intset of sorted
+// unique values, so an intset read from the outside can be used safely.
+func intsetValidateIntegrity(is []byte) bool {
+
+	if len(is) < intsetHeaderSize {
+		return false
+	}
+	enc := intsetEncoding(is)
+	if enc != intsetEncInt16 && enc != intsetEncInt32 && enc != intsetEncInt64 {
+		return false
+	}
+	n := intsetLen(is)
+	if n == 0 || intsetHeaderSize+int64(n)*int64(enc) != int64(len(is)) {
+		return false
+	}
+	for j := 1; j < n; j++ {
+		if intsetGetEncoded(is, j-1, enc) >= intsetGetEncoded(is, j, enc) {
+			return false
+		}
+	}
+	return true
+
+}
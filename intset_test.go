@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestIntset_Upgrade(t *testing.T) {
+	is := intsetNew()
+	is, _ = intsetAdd(is, 32)
+	is, _ = intsetAdd(is, -5)
+	if intsetEncoding(is) != intsetEncInt16 || len(is) != intsetHeaderSize+2*2 {
+		t.Fatalf("want int16 encoding, got %d", intsetEncoding(is))
+	}
+
+	is, _ = intsetAdd(is, math.MaxInt16+1)
+	if intsetEncoding(is) != intsetEncInt32 {
+		t.Fatalf("want int32 encoding, got %d", intsetEncoding(is))
+	}
+	// a negative value is prepended
+	is, _ = intsetAdd(is, math.MinInt64)
+	if intsetEncoding(is) != intsetEncInt64 {
+		t.Fatalf("want int64 encoding, got %d", intsetEncoding(is))
+	}
+
+	want := []int64{math.MinInt64, -5, 32, math.MaxInt16 + 1}
+	if intsetLen(is) != len(want) {
+		t.Fatalf("want %d values, got %d", len(want), intsetLen(is))
+	}
+	for j, v := range want {
+		if intsetGet(is, j) != v {
+			t.Fatalf("position %d: want %d, got %d", j, v, intsetGet(is, j))
+		}
+	}
+
+	// the encoding is not downgraded
+	is, _ = intsetRemove(is, math.MinInt64)
+	if intsetEncoding(is) != intsetEncInt64 || intsetFind(is, math.MinInt64) {
+		t.Fatalf("want the value removed in the int64 encoding")
+	}
+	if _, removed := intsetRemove(is, math.MaxInt64); removed {
+		t.Fatalf("want a missing value not removed")
+	}
+}
+
+func TestIntset_Model(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	is := intsetNew()
+	model := make(map[int64]bool)
+
+	value := func() int64 {
+		switch rnd.Intn(3) {
+		case 0:
+			return int64(rnd.Intn(1000) - 500)
+		case 1:
+			return int64(rnd.Intn(1<<20) - 1<<19)
+		}
+		return rnd.Int63() - rnd.Int63()
+	}
+
+	for op := 0; op < 20000; op++ {
+		v := value()
+		if rnd.Intn(3) == 0 && len(model) > 0 {
+			v = intsetRandom(is)
+		}
+		if rnd.Intn(2) == 0 {
+			var added bool
+			is, added = intsetAdd(is, v)
+			if added == model[v] {
+				t.Fatalf("add %d: want added %v", v, !model[v])
+			}
+			model[v] = true
+		} else {
+			var removed bool
+			is, removed = intsetRemove(is, v)
+			if removed != model[v] {
+				t.Fatalf("remove %d: want removed %v", v, model[v])
+			}
+			delete(model, v)
+		}
+	}
+
+	values := make([]int64, 0, len(model))
+	for v := range model {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	if intsetLen(is) != len(values) || len(is) != intsetHeaderSize+len(values)*intsetEncoding(is) {
+		t.Fatalf("want %d values, got %d in %d bytes", len(values), intsetLen(is), len(is))
+	}
+	for j, v := range values {
+		if intsetGet(is, j) != v || !intsetFind(is, v) {
+			t.Fatalf("position %d: want %d, got %d", j, v, intsetGet(is, j))
+		}
+	}
+}
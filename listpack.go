@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// A listpack is a compact list of strings and integers serialized in a
+// single byte slice, with the same layout redis uses:
+//
+//	<total-bytes:4> <num-elements:2> <entry> ... <entry> <end:0xFF>
+//
+// Every entry is <encoding+data> <backlen>, backlen being the size of the
+// encoding and data written backward, so the list can be walked in both
+// directions. Integers are stored in the smallest of the integer encodings
+// and strings prefixed by their length. The number of elements saturates at
+// 65535, the real count is then computed walking the list.
+//
+// Positions are byte offsets in the slice, -1 meaning no element. Functions
+// modifying the listpack return the new slice, that may be reallocated.
+
+const (
+	lpHeaderSize     = 6
+	lpEOF            = 0xFF
+	lpNumElementsMax = 65535
+
+	lp7BitUint     = 0x00
+	lp7BitUintMask = 0x80
+	lp6BitStr      = 0x80
+	lp6BitStrMask  = 0xC0
+	lp13BitInt     = 0xC0
+	lp13BitIntMask = 0xE0
+	lp12BitStr     = 0xE0
+	lp12BitStrMask = 0xF0
+	lp16BitInt     = 0xF1
+	lp24BitInt     = 0xF2
+	lp32BitInt     = 0xF3
+	lp64BitInt     = 0xF4
+	lp32BitStr     = 0xF0
+)
+
+// where to insert, relative to the given position
+const (
+	lpInsertBefore = iota
+	lpInsertAfter
+	lpInsertReplace
+)
+
+func lpNew(capacity int) []byte {
+	lp := make([]byte, lpHeaderSize+1, max(lpHeaderSize+1, capacity))
+	lpSetTotalBytes(lp, lpHeaderSize+1)
+	lpSetNumElements(lp, 0)
+	lp[lpHeaderSize] = lpEOF
+	return lp
+}
+
+func lpTotalBytes(lp []byte) uint32 {
+	return binary.LittleEndian.Uint32(lp[0:4])
+}
+
+func lpSetTotalBytes(lp []byte, n uint32) {
+	binary.LittleEndian.PutUint32(lp[0:4], n)
+}
+
+func lpNumElements(lp []byte) int {
+	return int(binary.LittleEndian.Uint16(lp[4:6]))
+}
+
+func lpSetNumElements(lp []byte, n int) {
+	if n > lpNumElementsMax {
+		n = lpNumElementsMax
+	}
+	binary.LittleEndian.PutUint16(lp[4:6], uint16(n))
+}
+
+// lpEncodeBacklen writes the backlen of an entry of l bytes to buf and
+// returns its size.
+func lpEncodeBacklen(buf []byte, l uint64) int {
+	switch {
+	case l <= 127:
+		buf[0] = byte(l)
+		return 1
+	case l < 16383:
+		buf[0] = byte(l >> 7)
+		buf[1] = byte(l&127) | 128
+		return 2
+	case l < 2097151:
+		buf[0] = byte(l >> 14)
+		buf[1] = byte((l>>7)&127) | 128
+		buf[2] = byte(l&127) | 128
+		return 3
+	case l < 268435455:
+		buf[0] = byte(l >> 21)
+		buf[1] = byte((l>>14)&127) | 128
+		buf[2] = byte((l>>7)&127) | 128
+		buf[3] = byte(l&127) | 128
+		return 4
+	}
+	buf[0] = byte(l >> 28)
+	buf[1] = byte((l>>21)&127) | 128
+	buf[2] = byte((l>>14)&127) | 128
+	buf[3] = byte((l>>7)&127) | 128
+	buf[4] = byte(l&127) | 128
+	return 5
+}
+
+func lpBacklenSize(l uint64) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// lpDecodeBacklen reads the backlen whose last byte is at p.
+func lpDecodeBacklen(lp []byte, p int) uint64 {
+	var val uint64
+	shift := 0
+	for {
+		val |= uint64(lp[p]&127) << shift
+		if lp[p]&128 == 0 {
+			return val
+		}
+		shift += 7
+		p--
+	}
+}
+
+// lpEncodeInteger returns the smallest encoding of v.
+func lpEncodeInteger(v int64) []byte {
+	switch {
+	case v >= 0 && v <= 127:
+		return []byte{byte(v)}
+	case v >= -4096 && v <= 4095:
+		u := uint64(v)
+		if v < 0 {
+			u = uint64((1 << 13) + v)
+		}
+		return []byte{byte(u>>8) | lp13BitInt, byte(u)}
+	case v >= -32768 && v <= 32767:
+		u := uint64(v)
+		if v < 0 {
+			u = uint64((1 << 16) + v)
+		}
+		return []byte{lp16BitInt, byte(u), byte(u >> 8)}
+	case v >= -8388608 && v <= 8388607:
+		u := uint64(v)
+		if v < 0 {
+			u = uint64((1 << 24) + v)
+		}
+		return []byte{lp24BitInt, byte(u), byte(u >> 8), byte(u >> 16)}
+	case v >= -2147483648 && v <= 2147483647:
+		u := uint64(v)
+		if v < 0 {
+			u = uint64((1 << 32) + v)
+		}
+		buf := []byte{lp32BitInt, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(u))
+		return buf
+	}
+	buf := []byte{lp64BitInt, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint64(buf[1:], uint64(v))
+	return buf
+}
+
+// lpEncodeString returns the encoding of ele, integers are encoded as such.
+func lpEncodeString(ele []byte) []byte {
+
+	if len(ele) <= 20 {
+		if v, ok := string2ll(ele); ok {
+			return lpEncodeInteger(v)
+		}
+	}
+
+	var buf []byte
+	l := len(ele)
+	switch {
+	case l < 64:
+		buf = make([]byte, 0, 1+l)
+		buf = append(buf, lp6BitStr|byte(l))
+	case l < 4096:
+		buf = make([]byte, 0, 2+l)
+		buf = append(buf, lp12BitStr|byte(l>>8), byte(l))
+	default:
+		buf = make([]byte, 5, 5+l)
+		buf[0] = lp32BitStr
+		binary.LittleEndian.PutUint32(buf[1:], uint32(l))
+	}
+	return append(buf, ele...)
+
+}
+
+// lpCurrentEncodedSize returns the size of the encoding and data of the
+// entry at p, without the backlen.
+func lpCurrentEncodedSize(lp []byte, p int) int {
+	b := lp[p]
+	switch {
+	case b&lp7BitUintMask == lp7BitUint:
+		return 1
+	case b&lp6BitStrMask == lp6BitStr:
+		return 1 + int(b&0x3F)
+	case b&lp13BitIntMask == lp13BitInt:
+		return 2
+	case b == lp16BitInt:
+		return 3
+	case b == lp24BitInt:
+		return 4
+	case b == lp32BitInt:
+		return 5
+	case b == lp64BitInt:
+		return 9
+	case b&lp12BitStrMask == lp12BitStr:
+		return 2 + (int(b&0x0F)<<8 | int(lp[p+1]))
+	case b == lp32BitStr:
+		return 5 + int(binary.LittleEndian.Uint32(lp[p+1:]))
+	case b == lpEOF:
+		return 1
+	}
+	panic("listpack: invalid encoding")
+}
+
+func lpEntrySize(lp []byte, p int) int {
+	l := lpCurrentEncodedSize(lp, p)
+	return l + lpBacklenSize(uint64(l))
+}
+
+func lpFirst(lp []byte) int {
+	if lp[lpHeaderSize] == lpEOF {
+		return -1
+	}
+	return lpHeaderSize
+}
+
+func lpNext(lp []byte, p int) int {
+	p += lpEntrySize(lp, p)
+	if lp[p] == lpEOF {
+		return -1
+	}
+	return p
+}
+
+func lpPrev(lp []byte, p int) int {
+	if p == lpHeaderSize {
+		return -1
+	}
+	prevlen := lpDecodeBacklen(lp, p-1)
+	return p - int(prevlen) - lpBacklenSize(prevlen)
+}
+
+func lpLast(lp []byte) int {
+	return lpPrev(lp, len(lp)-1)
+}
+
+// lpLength returns the number of elements, walking the listpack when the
+// header count saturated.
+func lpLength(lp []byte) int {
+	if n := lpNumElements(lp); n != lpNumElementsMax {
+		return n
+	}
+	n := 0
+	for p := lpFirst(lp); p != -1; p = lpNext(lp, p) {
+		n++
+	}
+	return n
+}
+
+// lpGet returns the element at p, either a string aliasing the listpack or
+// an integer when str is nil.
+func lpGet(lp []byte, p int) (str []byte, v int64) {
+
+	b := lp[p]
+	var uval uint64
+	var negstart, negmax uint64
+
+	switch {
+	case b&lp7BitUintMask == lp7BitUint:
+		return nil, int64(b & 0x7F)
+	case b&lp6BitStrMask == lp6BitStr:
+		l := int(b & 0x3F)
+		return lp[p+1 : p+1+l], 0
+	case b&lp13BitIntMask == lp13BitInt:
+		uval = uint64(b&0x1F)<<8 | uint64(lp[p+1])
+		negstart, negmax = 1<<12, 8191
+	case b == lp16BitInt:
+		uval = uint64(binary.LittleEndian.Uint16(lp[p+1:]))
+		negstart, negmax = 1<<15, math.MaxUint16
+	case b == lp24BitInt:
+		uval = uint64(lp[p+1]) | uint64(lp[p+2])<<8 | uint64(lp[p+3])<<16
+		negstart, negmax = 1<<23, 1<<24-1
+	case b == lp32BitInt:
+		uval = uint64(binary.LittleEndian.Uint32(lp[p+1:]))
+		negstart, negmax = 1<<31, math.MaxUint32
+	case b == lp64BitInt:
+		return nil, int64(binary.LittleEndian.Uint64(lp[p+1:]))
+	case b&lp12BitStrMask == lp12BitStr:
+		l := int(b&0x0F)<<8 | int(lp[p+1])
+		return lp[p+2 : p+2+l], 0
+	case b == lp32BitStr:
+		l := int(binary.LittleEndian.Uint32(lp[p+1:]))
+		return lp[p+5 : p+5+l], 0
+	default:
+		panic("listpack: invalid encoding")
+	}
+
+	if uval >= negstart {
+		// two's complement in the encoding width
+		return nil, -int64(negmax-uval) - 1
+	}
+	return nil, int64(uval)
+
+}
+
+// lpGetString returns a copy of the element at p as a string.
+func lpGetString(lp []byte, p int) string {
+	str, v := lpGet(lp, p)
+	if str == nil {
+		return strconv.FormatInt(v, 10)
+	}
+	return string(str)
+}
+
+// lpGetBytes returns the element at p as a new byte slice.
+func lpGetBytes(lp []byte, p int) []byte {
+	str, v := lpGet(lp, p)
+	if str == nil {
+		return strconv.AppendInt(nil, v, 10)
+	}
+	return append([]byte(nil), str...)
+}
+
+// lpGetInteger returns the element at p, that must be an integer or a
+// string holding one.
+func lpGetInteger(lp []byte, p int) int64 {
+	str, v := lpGet(lp, p)
+	if str != nil {
+		v, _ = string2ll(str)
+	}
+	return v
+}
+
+// lpCompare reports whether the element at p equals s.
+func lpCompare(lp []byte, p int, s []byte) bool {
+	str, v := lpGet(lp, p)
+	if str != nil {
+		return string(str) == string(s)
+	}
+	sv, ok := string2ll(s)
+	return ok && sv == v
+}
+
+// lpInsert inserts ele before or after the element at p, or replaces it.
+// p == -1 with lpInsertBefore appends. It returns the new listpack and the position
+// of the inserted element.
+func lpInsert(lp []byte, ele []byte, p int, where int) ([]byte, int) {
+
+	if p == -1 {
+		p = len(lp) - 1
+		where = lpInsertBefore
+	}
+	if where == lpInsertAfter {
+		p += lpEntrySize(lp, p)
+		where = lpInsertBefore
+	}
+
+	enc := lpEncodeString(ele)
+	var backlen [5]byte
+	blen := lpEncodeBacklen(backlen[:], uint64(len(enc)))
+	newSize := len(enc) + blen
+
+	oldSize := 0
+	if where == lpInsertReplace {
+		oldSize = lpEntrySize(lp, p)
+	}
+
+	delta := newSize - oldSize
+	oldLen := len(lp)
+	if delta > 0 {
+		lp = append(lp, make([]byte, delta)...)
+	}
+	copy(lp[p+newSize:], lp[p+oldSize:oldLen])
+	if delta < 0 {
+		lp = lp[:oldLen+delta]
+	}
+	copy(lp[p:], enc)
+	copy(lp[p+len(enc):], backlen[:blen])
+
+	lpSetTotalBytes(lp, uint32(len(lp)))
+	if where != lpInsertReplace {
+		if n := lpNumElements(lp); n != lpNumElementsMax {
+			lpSetNumElements(lp, n+1)
+		}
+	}
+	return lp, p
+
+}
+
+func lpAppend(lp []byte, ele []byte) []byte {
+	lp, _ = lpInsert(lp, ele, -1, lpInsertBefore)
+	return lp
+}
+
+func lpPrepend(lp []byte, ele []byte) []byte {
+	p := lpFirst(lp)
+	if p == -1 {
+		return lpAppend(lp, ele)
+	}
+	lp, _ = lpInsert(lp, ele, p, lpInsertBefore)
+	return lp
+}
+
+func lpAppendInteger(lp []byte, v int64) []byte {
+	return lpAppend(lp, strconv.AppendInt(nil, v, 10))
+}
+
+// lpReplace replaces the element at p, returning its new position.
+func lpReplace(lp []byte, p int, ele []byte) ([]byte, int) {
+	return lpInsert(lp, ele, p, lpInsertReplace)
+}
+
+func lpReplaceInteger(lp []byte, p int, v int64) ([]byte, int) {
+	return lpInsert(lp, strconv.AppendInt(nil, v, 10), p, lpInsertReplace)
+}
+
+// lpDelete removes the element at p, it returns the new listpack and the
+// position of the next element, or -1.
+func lpDelete(lp []byte, p int) ([]byte, int) {
+	lp = lpDeleteRangeWithEntry(lp, p, 1)
+	if lp[p] == lpEOF {
+		return lp, -1
+	}
+	return lp, p
+}
+
+// lpDeleteRangeWithEntry removes num elements starting at p.
+func lpDeleteRangeWithEntry(lp []byte, p int, num int) []byte {
+
+	end := p
+	deleted := 0
+	for deleted < num && lp[end] != lpEOF {
+		end += lpEntrySize(lp, end)
+		deleted++
+	}
+
+	lp = append(lp[:p], lp[end:]...)
+	lpSetTotalBytes(lp, uint32(len(lp)))
+	if n := lpNumElements(lp); n != lpNumElementsMax {
+		lpSetNumElements(lp, n-deleted)
+	} else {
+		lpSetNumElements(lp, lpLength(lp))
+	}
+	return lp
+
+}
+
+// lpDeleteRange removes num elements starting at index, negative indexes
+// count from the tail.
+func lpDeleteRange(lp []byte, index, num int) []byte {
+	p := lpSeek(lp, index)
+	if p == -1 || num <= 0 {
+		return lp
+	}
+	return lpDeleteRangeWithEntry(lp, p, num)
+}
+
+// lpSeek returns the position of the element at index, negative indexes
+// count from the tail.
+func lpSeek(lp []byte, index int) int {
+
+	n := lpLength(lp)
+	if index < 0 {
+		index += n
+	}
+	if index < 0 || index >= n {
+		return -1
+	}
+
+	// walk from the nearest end
+	if index > n/2 {
+		p := lpLast(lp)
+		for j := n - 1; j > index; j-- {
+			p = lpPrev(lp, p)
+		}
+		return p
+	}
+	p := lpFirst(lp)
+	for j := 0; j < index; j++ {
+		p = lpNext(lp, p)
+	}
+	return p
+
+}
+
+// lpFind returns the position of the first element equal to ele starting at
+// p, skipping skip elements after every comparison, so a listpack of
+// field-value pairs can be searched by field with skip 1.
+func lpFind(lp []byte, p int, ele []byte, skip int) int {
+
+	for p != -1 {
+		if lpCompare(lp, p, ele) {
+			return p
+		}
+		for j := 0; j <= skip && p != -1; j++ {
+			p = lpNext(lp, p)
+		}
+	}
+	return -1
+
+}
+
+// lpMerge appends the elements of second to first.
+func lpMerge(first, second []byte) []byte {
+
+	n := lpNumElements(first) + lpNumElements(second)
+	lp := append(first[:len(first)-1], second[lpHeaderSize:]...)
+	lpSetTotalBytes(lp, uint32(len(lp)))
+	if n >= lpNumElementsMax {
+		n = lpLength(lp)
+	}
+	lpSetNumElements(lp, n)
+	return lp
+
+}
+
+// lpValidateIntegrity walks the listpack checking every entry is within the
+// bounds of lp, so a listpack read from the outside can be used safely.
+func lpValidateIntegrity(lp []byte) bool {
+
+	if len(lp) < lpHeaderSize+1 || int(lpTotalBytes(lp)) != len(lp) || lp[len(lp)-1] != lpEOF {
+		return false
+	}
+
+	var backlen [5]byte
+	count := 0
+	p := lpHeaderSize
+	for lp[p] != lpEOF {
+		b := lp[p]
+		if (b > lp64BitInt && b < lpEOF) || (b == lp32BitStr && p+5 >= len(lp)) {
+			return false
+		}
+		l := lpCurrentEncodedSize(lp, p)
+		bl := lpEncodeBacklen(backlen[:], uint64(l))
+		next := p + l + bl
+		if next >= len(lp) || string(lp[next-bl:next]) != string(backlen[:bl]) {
+			return false
+		}
+		p = next
+		count++
+	}
+	return p == len(lp)-1 && (lpNumElements(lp) == lpNumElementsMax || lpNumElements(lp) == count)
+
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func lpElements(lp []byte) []string {
+	var elements []string
+	for p := lpFirst(lp); p != -1; p = lpNext(lp, p) {
+		elements = append(elements, lpGetString(lp, p))
+	}
+	return elements
+}
+
+func TestListpack_Encodings(t *testing.T) {
+	values := []string{
+		"0", "127", "128", "-1", "4095", "-4096", "4096", "32767", "-32768", "32768",
+		"8388607", "-8388608", "2147483647", "-2147483648", "2147483648",
+		strconv.FormatInt(math.MaxInt64, 10), strconv.FormatInt(math.MinInt64, 10),
+		"", "a", "012", "-0", strings.Repeat("x", 63), strings.Repeat("y", 64),
+		strings.Repeat("z", 4095), strings.Repeat("w", 4096), strings.Repeat("v", 20000),
+	}
+
+	lp := lpNew(0)
+	for _, v := range values {
+		lp = lpAppend(lp, []byte(v))
+	}
+	if int(lpTotalBytes(lp)) != len(lp) || lpLength(lp) != len(values) {
+		t.Fatalf("want %d bytes and %d elements, header says %d and %d", len(lp), len(values), lpTotalBytes(lp), lpLength(lp))
+	}
+
+	if got := lpElements(lp); strings.Join(got, ",") != strings.Join(values, ",") {
+		t.Fatalf("forward walk mismatch")
+	}
+	j := len(values) - 1
+	for p := lpLast(lp); p != -1; p = lpPrev(lp, p) {
+		if got := lpGetString(lp, p); got != values[j] {
+			t.Fatalf("backward walk, element %d: want %.20q, got %.20q", j, values[j], got)
+		}
+		j--
+	}
+
+	// integers are stored as such
+	if str, v := lpGet(lp, lpSeek(lp, 1)); str != nil || v != 127 {
+		t.Fatalf("want integer 127, got %q, %d", str, v)
+	}
+	if str, _ := lpGet(lp, lpSeek(lp, 19)); string(str) != "012" {
+		t.Fatalf("want string 012, got %q", str)
+	}
+	if lpSeek(lp, -1) != lpLast(lp) || lpSeek(lp, len(values)) != -1 {
+		t.Fatalf("seek out of the edges")
+	}
+}
+
+func TestListpack_InsertReplaceDelete(t *testing.T) {
+	lp := lpNew(0)
+	for _, v := range []string{"b", "d"} {
+		lp = lpAppend(lp, []byte(v))
+	}
+	lp = lpPrepend(lp, []byte("a"))
+	lp, _ = lpInsert(lp, []byte("c"), lpSeek(lp, 1), lpInsertAfter)
+	lp, _ = lpInsert(lp, []byte("e"), lpSeek(lp, 3), lpInsertAfter)
+	if got := strings.Join(lpElements(lp), ""); got != "abcde" {
+		t.Fatalf("want abcde, got %s", got)
+	}
+
+	// replace with longer and shorter elements
+	lp, p := lpReplace(lp, lpSeek(lp, 2), []byte(strings.Repeat("C", 200)))
+	if lpGetString(lp, p) != strings.Repeat("C", 200) || lpGetString(lp, lpNext(lp, p)) != "d" {
+		t.Fatalf("replace with a longer element broke the list")
+	}
+	lp, _ = lpReplace(lp, p, []byte("100"))
+	if got := strings.Join(lpElements(lp), ","); got != "a,b,100,d,e" {
+		t.Fatalf("want a,b,100,d,e, got %s", got)
+	}
+
+	if p := lpFind(lp, lpFirst(lp), []byte("100"), 0); p != lpSeek(lp, 2) {
+		t.Fatalf("find 100 at %d, want %d", p, lpSeek(lp, 2))
+	}
+	// with skip 1 only the even elements are compared
+	if p := lpFind(lp, lpFirst(lp), []byte("b"), 1); p != -1 {
+		t.Fatalf("want b skipped, found at %d", p)
+	}
+
+	lp, next := lpDelete(lp, lpSeek(lp, 0))
+	if lpGetString(lp, next) != "b" {
+		t.Fatalf("want next element b after delete")
+	}
+	lp, next = lpDelete(lp, lpLast(lp))
+	if next != -1 {
+		t.Fatalf("want no next element after deleting the tail")
+	}
+	lp = lpDeleteRange(lp, -2, 5)
+	if got := strings.Join(lpElements(lp), ","); got != "b" || lpLength(lp) != 1 || int(lpTotalBytes(lp)) != len(lp) {
+		t.Fatalf("want b, got %s", got)
+	}
+}
+
+func TestListpack_SaturatedCount(t *testing.T) {
+	lp := lpNew(0)
+	for j := 0; j < lpNumElementsMax+10; j++ {
+		lp = lpAppend(lp, []byte("1"))
+	}
+	if lpNumElements(lp) != lpNumElementsMax || lpLength(lp) != lpNumElementsMax+10 {
+		t.Fatalf("want saturated header and real length, got %d and %d", lpNumElements(lp), lpLength(lp))
+	}
+	lp = lpDeleteRange(lp, 0, 20)
+	if lpNumElements(lp) != lpNumElementsMax-10 {
+		t.Fatalf("want the count restored below the limit, got %d", lpNumElements(lp))
+	}
+}
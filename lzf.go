@@ -0,0 +1,208 @@
+package main
+
+// LZF compression, the format used by redis for compressed quicklist nodes
+// and rdb strings. The output of lzfCompress can be decompressed by any lzf
+// implementation and the other way around.
+//
+// A compressed stream is a sequence of literal runs and back references:
+//
+//	000LLLLL <L+1 literal bytes>
+//	LLLooooo oooooooo              reference of L+2 bytes, L < 7
+//	111ooooo LLLLLLLL oooooooo     reference of L+9 bytes
+//
+// the offset o counting backward from the current position minus one.
+
+const (
+	lzfHashLog  = 16
+	lzfHashSize = 1 << lzfHashLog
+	lzfMaxLit   = 1 << 5
+	lzfMaxOff   = 1 << 13
+	lzfMaxRef   = 1<<8 + 1<<3
+)
+
+func lzfIndex(h uint32) uint32 {
+	return ((h >> (3*8 - lzfHashLog)) - h*5) & (lzfHashSize - 1)
+}
+
+// lzfCompress compresses in into out, it returns the compressed length or 0
+// if the result does not fit in out.
+func lzfCompress(in, out []byte) int {
+
+	inLen, outLen := len(in), len(out)
+	if inLen == 0 || outLen == 0 {
+		return 0
+	}
+
+	// positions of the last occurrence of every hashed 3 bytes sequence,
+	// 0 meaning none
+	var htab [lzfHashSize]int32
+	ip, op := 0, 0
+	lit := 0
+	op++ // start run
+
+	hval := uint32(in[0])<<8 | uint32(in[1%inLen])
+	for ip < inLen-2 {
+		hval = hval<<8 | uint32(in[ip+2])
+		slot := lzfIndex(hval)
+		ref := int(htab[slot])
+		htab[slot] = int32(ip)
+
+		off := ip - ref - 1
+		if ref > 0 && off < lzfMaxOff &&
+			in[ref+2] == in[ip+2] && in[ref] == in[ip] && in[ref+1] == in[ip+1] {
+
+			// match found at ref
+			length := 2
+			maxlen := inLen - ip - length
+			if maxlen > lzfMaxRef {
+				maxlen = lzfMaxRef
+			}
+
+			if op+3+1 >= outLen {
+				extra := 0
+				if lit == 0 {
+					extra = 1
+				}
+				if op-extra+3+1 >= outLen {
+					return 0
+				}
+			}
+
+			out[op-lit-1] = byte(lit - 1) // stop run
+			if lit == 0 {
+				op-- // undo run if length is zero
+			}
+
+			for {
+				length++
+				if length >= maxlen || in[ref+length] != in[ip+length] {
+					break
+				}
+			}
+
+			length -= 2 // length is now #octets - 1
+			ip++
+
+			if length < 7 {
+				out[op] = byte(off>>8) + byte(length<<5)
+				op++
+			} else {
+				out[op] = byte(off>>8) + 7<<5
+				out[op+1] = byte(length - 7)
+				op += 2
+			}
+			out[op] = byte(off)
+			op++
+
+			lit = 0
+			op++ // start run
+
+			ip += length + 1
+			if ip >= inLen-2 {
+				break
+			}
+
+			// hash the two positions before ip, skipped by the match
+			ip -= 2
+			hval = uint32(in[ip])<<8 | uint32(in[ip+1])
+			hval = hval<<8 | uint32(in[ip+2])
+			htab[lzfIndex(hval)] = int32(ip)
+			ip++
+			hval = hval<<8 | uint32(in[ip+2])
+			htab[lzfIndex(hval)] = int32(ip)
+			ip++
+			continue
+		}
+
+		// one more literal byte to copy
+		if op >= outLen {
+			return 0
+		}
+		lit++
+		out[op] = in[ip]
+		op++
+		ip++
+		if lit == lzfMaxLit {
+			out[op-lit-1] = byte(lit - 1) // stop run
+			lit = 0
+			op++ // start run
+		}
+	}
+
+	// at most 3 bytes can be missing here
+	if op+3 > outLen {
+		return 0
+	}
+
+	for ip < inLen {
+		lit++
+		out[op] = in[ip]
+		op++
+		ip++
+		if lit == lzfMaxLit {
+			out[op-lit-1] = byte(lit - 1)
+			lit = 0
+			op++
+		}
+	}
+
+	out[op-lit-1] = byte(lit - 1) // end run
+	if lit == 0 {
+		op--
+	}
+	return op
+
+}
+
+// lzfDecompress decompresses in into out, it returns the decompressed length
+// or 0 if out is too small or the input is corrupted.
+func lzfDecompress(in, out []byte) int {
+
+	ip, op := 0, 0
+	inLen, outLen := len(in), len(out)
+
+	for ip < inLen {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 1<<5 {
+			// literal run
+			ctrl++
+			if op+ctrl > outLen || ip+ctrl > inLen {
+				return 0
+			}
+			copy(out[op:], in[ip:ip+ctrl])
+			op += ctrl
+			ip += ctrl
+			continue
+		}
+
+		// back reference
+		length := ctrl >> 5
+		ref := op - (ctrl&0x1f)<<8 - 1
+		if ip >= inLen {
+			return 0
+		}
+		if length == 7 {
+			length += int(in[ip])
+			ip++
+			if ip >= inLen {
+				return 0
+			}
+		}
+		ref -= int(in[ip])
+		ip++
+
+		length += 2
+		if op+length > outLen || ref < 0 {
+			return 0
+		}
+		// the reference may overlap the output, copy byte by byte
+		for j := 0; j < length; j++ {
+			out[op+j] = out[ref+j]
+		}
+		op += length
+	}
+	return op
+
+}
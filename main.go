@@ -1,64 +1,126 @@
 package main
 
 import (
+	"golang.org/x/sys/unix"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 )
 
 func main() {
 
-	el := NewEventLoop(1024, beforeSleep, afterSleep)
+	initServerConfig()
+	if err := loadServerConfigFromArgs(os.Args[1:]); err != nil {
+		Log("Fatal config error, %v", err)
+		os.Exit(1)
+	}
+
+	el, err := NewEventLoop(1024, defaultEventLoopApi, beforeSleep, afterSleep)
+	if err != nil {
+		Log("NewEventLoop error=%v", err)
+		panic(err)
+	}
 	initServer(el)
+	loadDataFromDisk()
+
+	addr := net.JoinHostPort(rServer.bindAddr, strconv.Itoa(rServer.port))
+	if _, err = listenToPort(el, addr); err != nil {
+		panic(err)
+	}
+
+	go func() {
+		el.Serve()
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Kill, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	terminate(el)
+
+}
 
-	laddr, err := net.ResolveTCPAddr("tcp", ":6379")
+func listenToPort(el *EventLoop, addr string) (*net.TCPListener, error) {
+
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		Log("ResolveTCPAddr error=%v", err)
-		panic(err)
+		return nil, err
 	}
 	listener, err := net.ListenTCP(laddr.Network(), laddr)
 	if err != nil {
 		Log("ListenTCP error=%v", err)
-		panic(err)
+		return nil, err
 	}
 	lf, err := listener.File()
 	if err != nil {
 		Log("listener get file fd error=%v", err)
-		panic(err)
+		_ = listener.Close()
+		return nil, err
 	}
 
 	err = el.AddFileEvent(lf, ELMaskReadable, acceptConnection, listener)
 	if err != nil {
 		Log("AddFileEvent error=%v, fd=%d", err, lf.Fd())
-		panic(err)
+		_ = lf.Close()
+		_ = listener.Close()
+		return nil, err
 	}
 
-	go func() {
-		el.Serve()
-	}()
-
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Kill, os.Interrupt, syscall.SIGTERM)
-	<-sig
-
-	terminate(el)
+	// File.Fd puts the fd in blocking mode, the edge triggered accept
+	// needs EAGAIN once the backlog is drained.
+	if err = unix.SetNonblock(int(lf.Fd()), true); err != nil {
+		Log("SetNonblock error=%v, fd=%d", err, lf.Fd())
+	}
 
+	return listener, nil
 }
 
 func acceptConnection(el *EventLoop, fd int, mask uint8, clientData interface{}) {
 	Log("accept new connection: fd=%d", fd)
-	listener := clientData.(*net.TCPListener)
-	conn, err := listener.Accept()
-	if err != nil {
-		Log("acceptConnection failed, err=%v", err)
+
+	if !el.EdgeTrigger {
+		listener := clientData.(*net.TCPListener)
+		conn, err := listener.Accept()
+		if err != nil {
+			Log("acceptConnection failed, err=%v", err)
+			return
+		}
+		acceptCommonHandler(el, conn.(*net.TCPConn))
 		return
 	}
 
-	err = createClient(el, conn.(*net.TCPConn))
-	if err != nil {
+	// an edge triggered loop reports the listener once for all the pending
+	// connections, accept them on the fd until EAGAIN.
+	for {
+		nfd, _, err := unix.Accept(fd)
+		if err == unix.EINTR || err == unix.ECONNABORTED {
+			continue
+		}
+		if err != nil {
+			if err != unix.EAGAIN {
+				Log("acceptConnection failed, err=%v", err)
+			}
+			return
+		}
+		unix.CloseOnExec(nfd)
+
+		f := os.NewFile(uintptr(nfd), "client")
+		conn, err := net.FileConn(f)
+		_ = f.Close()
+		if err != nil {
+			Log("acceptConnection FileConn error=%v", err)
+			continue
+		}
+		acceptCommonHandler(el, conn.(*net.TCPConn))
+	}
+}
+
+func acceptCommonHandler(el *EventLoop, conn *net.TCPConn) {
+	if _, err := createClient(el, conn); err != nil {
 		Log("acceptConnection createClient error=%v", err)
-		return
 	}
 }
 
@@ -66,8 +128,26 @@ func beforeSleep() {
 
 	handleClientsWithPendingRead()
 
+	handleClientsBlockedOnKeys()
+
+	processUnblockedClients()
+
+	// the replicas are asked for their offset once, for all the WAIT
+	if rServer.getAckFromSlaves {
+		sendGetackToReplicas()
+		rServer.getAckFromSlaves = false
+	}
+
+	flushAppendOnlyFile(false)
+
+	updateFsyncedReploff()
+
 	handleClientsWithPendingWrite()
 
+	freeClientsInAsyncFreeQueue()
+
+	databasesRehashBeforeSleep()
+
 }
 
 func afterSleep() {
@@ -84,9 +164,22 @@ func terminate(el *EventLoop) {
 
 	// todo close clients..
 
-	// todo save rdb
+	killRDBChild()
+	cancelReplicationHandshake()
+	// the rewrite in progress is done again at restart if still needed
+	killAppendOnlyChild()
+	if len(rServer.saveParams) > 0 {
+		Log("Saving the final RDB snapshot before exiting.")
+		if err := rdbSave(rdbPath()); err != nil {
+			Log("Error trying to save the DB, can't exit.")
+		}
+	}
 
-	// todo save aof
+	if rServer.aofState == aofOn {
+		Log("Calling fsync() on the AOF file.")
+		flushAppendOnlyFile(true)
+	}
+	_ = rServer.bioPool.release()
 
 	// wait io threads
 
@@ -0,0 +1,290 @@
+package main
+
+import "container/list"
+
+// Transactions: after MULTI the commands of the client are queued instead
+// of run, and EXEC runs them all, one after the other, without commands of
+// other clients in between. A command failing to queue, e.g. unknown or
+// with a wrong number of arguments, makes EXEC discard the transaction.
+//
+// WATCH makes the next EXEC fail if one of the watched keys is modified
+// before it runs, by any client, by the expiration of the key or by an
+// eviction. Every watched key is listed in db.watchedKeys with the clients
+// watching it, a write to the key flags them with clientDirtyCAS.
+
+type multiCmd struct {
+	argv []*rObj
+	argc int
+	cmd  *redisCommand
+}
+
+type multiState struct {
+	commands []multiCmd
+	cmdFlags int // union of the flags of the queued commands
+}
+
+type watchedKey struct {
+	key     string
+	db      *redisDb
+	expired bool // the key was logically expired when watched
+}
+
+// commandRunsInMulti reports whether cmd runs right away inside MULTI
+// instead of being queued.
+func commandRunsInMulti(cmd *redisCommand) bool {
+	switch cmd.name {
+	case "exec", "discard", "multi", "watch", "quit":
+		return true
+	}
+	return false
+}
+
+func queueMultiCommand(c *client) {
+
+	// once the transaction is doomed there is no point in queuing more
+	if c.flag&(clientDirtyCAS|clientDirtyExec) != 0 {
+		return
+	}
+	c.mstate.commands = append(c.mstate.commands, multiCmd{argv: c.argv, argc: c.argc, cmd: c.cmd})
+	c.mstate.cmdFlags |= c.cmd.flags
+
+}
+
+func discardTransaction(c *client) {
+	c.mstate = multiState{}
+	c.flag &^= clientMulti | clientDirtyCAS | clientDirtyExec
+	unwatchAllKeys(c)
+}
+
+// flagTransaction makes the transaction of the client fail, a command
+// could not be queued.
+func flagTransaction(c *client) {
+	if c.flag&clientMulti != 0 {
+		c.flag |= clientDirtyExec
+	}
+}
+
+func multiCommand(c *client) {
+
+	if c.flag&clientMulti != 0 {
+		addReplyError(c, "MULTI calls can not be nested")
+		return
+	}
+	c.flag |= clientMulti
+	addReply(c, shared.ok)
+
+}
+
+func discardCommand(c *client) {
+
+	if c.flag&clientMulti == 0 {
+		addReplyError(c, "DISCARD without MULTI")
+		return
+	}
+	discardTransaction(c)
+	addReply(c, shared.ok)
+
+}
+
+func execCommand(c *client) {
+
+	if c.flag&clientMulti == 0 {
+		addReplyError(c, "EXEC without MULTI")
+		return
+	}
+
+	// a watched key may have expired without being deleted yet
+	if isWatchedKeyExpired(c) {
+		c.flag |= clientDirtyCAS
+	}
+
+	if c.flag&(clientDirtyCAS|clientDirtyExec) != 0 {
+		if c.flag&clientDirtyExec != 0 {
+			addReplyError(c, "-EXECABORT Transaction discarded because of previous errors.")
+		} else {
+			addReplyNullArray(c)
+		}
+		discardTransaction(c)
+		return
+	}
+
+	// the keys are unwatched first, the writes of the transaction itself
+	// have nothing to flag.
+	unwatchAllKeys(c)
+
+	origArgv, origArgc, origCmd := c.argv, c.argc, c.cmd
+	addReplyArrayLen(c, len(c.mstate.commands))
+	for _, mc := range c.mstate.commands {
+		c.argv, c.argc, c.cmd = mc.argv, mc.argc, mc.cmd
+		call(c)
+	}
+	c.argv, c.argc, c.cmd = origArgv, origArgc, origCmd
+	// the commands run were propagated one by one, in a transaction
+	preventCommandPropagation(c)
+
+	discardTransaction(c)
+
+}
+
+// watchForKey adds key to the keys watched by the client.
+func watchForKey(c *client, key string) {
+
+	for ele := c.watchedKeys.Front(); ele != nil; ele = ele.Next() {
+		wk := ele.Value.(*watchedKey)
+		if wk.db == c.db && wk.key == key {
+			return
+		}
+	}
+
+	clients := c.db.watchedKeys[key]
+	if clients == nil {
+		clients = list.New()
+		c.db.watchedKeys[key] = clients
+	}
+	clients.PushBack(c)
+	wk := &watchedKey{key: key, db: c.db, expired: keyIsExpired(c.db, key)}
+	c.watchedKeys.PushBack(wk)
+
+}
+
+// unwatchAllKeys forgets every key watched by the client.
+func unwatchAllKeys(c *client) {
+
+	if c.watchedKeys == nil {
+		return
+	}
+	for c.watchedKeys.Len() > 0 {
+		wk := c.watchedKeys.Remove(c.watchedKeys.Front()).(*watchedKey)
+		clients := wk.db.watchedKeys[wk.key]
+		for ele := clients.Front(); ele != nil; ele = ele.Next() {
+			if ele.Value.(*client) == c {
+				clients.Remove(ele)
+				break
+			}
+		}
+		if clients.Len() == 0 {
+			delete(wk.db.watchedKeys, wk.key)
+		}
+	}
+
+}
+
+// isWatchedKeyExpired reports whether a key that was not expired when
+// watched is expired now.
+func isWatchedKeyExpired(c *client) bool {
+
+	if c.watchedKeys == nil {
+		return false
+	}
+	for ele := c.watchedKeys.Front(); ele != nil; ele = ele.Next() {
+		wk := ele.Value.(*watchedKey)
+		if !wk.expired && keyIsExpired(wk.db, wk.key) {
+			return true
+		}
+	}
+	return false
+
+}
+
+// lookupWatchedKey returns the watch of key in db by the client.
+func lookupWatchedKey(c *client, db *redisDb, key string) *watchedKey {
+	for ele := c.watchedKeys.Front(); ele != nil; ele = ele.Next() {
+		wk := ele.Value.(*watchedKey)
+		if wk.db == db && wk.key == key {
+			return wk
+		}
+	}
+	return nil
+}
+
+// touchWatchedKey flags the clients watching key as dirty, their next EXEC
+// fails. It is called after key was modified.
+func touchWatchedKey(db *redisDb, key string) {
+
+	clients := db.watchedKeys[key]
+	if clients == nil {
+		return
+	}
+	for ele := clients.Front(); ele != nil; {
+		c := ele.Value.(*client)
+		ele = ele.Next()
+
+		wk := lookupWatchedKey(c, db, key)
+		if wk.expired {
+			// deleting a key that was already expired when watched changes
+			// nothing, but the key is no longer an expired one from there.
+			if db.dict.find(key) == nil {
+				wk.expired = false
+				continue
+			}
+		}
+		c.flag |= clientDirtyCAS
+		// nothing can undo it, the client has no more reasons to watch
+		unwatchAllKeys(c)
+	}
+
+}
+
+// touchAllWatchedKeysInDb flags the clients watching a key of emptied that
+// exists in it, or in replacedWith when not nil, the dataset of emptied
+// being flushed or swapped with another one. It is called before the
+// dataset changes.
+func touchAllWatchedKeysInDb(emptied, replacedWith *redisDb) {
+
+	for key, clients := range emptied.watchedKeys {
+		existsInEmptied := emptied.dict.find(key) != nil
+		if !existsInEmptied && (replacedWith == nil || replacedWith.dict.find(key) == nil) {
+			continue
+		}
+		for ele := clients.Front(); ele != nil; {
+			c := ele.Value.(*client)
+			ele = ele.Next()
+
+			wk := lookupWatchedKey(c, emptied, key)
+			if wk.expired {
+				if replacedWith == nil || replacedWith.dict.find(key) == nil {
+					// an expired key deleted, nothing changed
+					wk.expired = false
+					continue
+				} else if keyIsExpired(replacedWith, key) {
+					// replaced with another expired key
+					continue
+				}
+			} else if !existsInEmptied && keyIsExpired(replacedWith, key) {
+				// a missing key replaced with an expired one
+				wk.expired = true
+				continue
+			}
+			c.flag |= clientDirtyCAS
+			unwatchAllKeys(c)
+		}
+	}
+
+}
+
+func watchCommand(c *client) {
+
+	if c.flag&clientMulti != 0 {
+		addReplyError(c, "WATCH inside MULTI is not allowed")
+		return
+	}
+	// no point in watching a client that is dirty already
+	if c.flag&clientDirtyCAS != 0 {
+		addReply(c, shared.ok)
+		return
+	}
+	if c.watchedKeys == nil {
+		c.watchedKeys = list.New()
+	}
+	for j := 1; j < c.argc; j++ {
+		watchForKey(c, c.argv[j].String())
+	}
+	addReply(c, shared.ok)
+
+}
+
+func unwatchCommand(c *client) {
+	unwatchAllKeys(c)
+	c.flag &^= clientDirtyCAS
+	addReply(c, shared.ok)
+}
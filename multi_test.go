@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMulti_Exec(t *testing.T) {
+	tc := newBlockingTestConns(t, "7", 1)[0]
+
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect(testStatus("QUEUED"), "set", "a", "1")
+	tc.expect(testStatus("QUEUED"), "incr", "a")
+	tc.expect(testStatus("QUEUED"), "lpush", "a", "x")
+	tc.expect(testStatus("QUEUED"), "get", "a")
+	// a failing command does not stop the others
+	tc.expect([]any{testStatus("OK"), int64(2),
+		testError("WRONGTYPE Operation against a key holding the wrong kind of value"), "2"}, "exec")
+
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect(testStatus("QUEUED"), "set", "a", "3")
+	tc.expect(testStatus("OK"), "discard")
+	tc.expect("2", "get", "a")
+
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect([]any{}, "exec")
+
+	tc.expectError("ERR EXEC without MULTI", "exec")
+	tc.expectError("ERR DISCARD without MULTI", "discard")
+	tc.expect(testStatus("OK"), "multi")
+	tc.expectError("ERR MULTI calls can not be nested", "multi")
+	tc.expectError("ERR WATCH inside MULTI is not allowed", "watch", "a")
+	tc.expect(testStatus("OK"), "discard")
+}
+
+func TestMulti_ExecAbort(t *testing.T) {
+	tc := newBlockingTestConns(t, "7", 1)[0]
+
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect(testStatus("QUEUED"), "set", "a", "1")
+	tc.expectError("ERR unknown command", "nope")
+	tc.expect(testStatus("QUEUED"), "set", "b", "1")
+	tc.expectError("EXECABORT Transaction discarded because of previous errors.", "exec")
+	tc.expect(int64(0), "exists", "a", "b")
+
+	tc.expect(testStatus("OK"), "multi")
+	tc.expectError("ERR wrong number of arguments for 'get' command", "get")
+	tc.expectError("EXECABORT", "exec")
+}
+
+func TestMulti_Watch(t *testing.T) {
+	conns := newBlockingTestConns(t, "7", 2)
+	tc, other := conns[0], conns[1]
+
+	// a key modified by another client aborts the transaction
+	tc.expect(testStatus("OK"), "watch", "a")
+	other.expect(testStatus("OK"), "set", "a", "1")
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect(testStatus("QUEUED"), "set", "a", "2")
+	tc.expect(nil, "exec")
+	tc.expect("1", "get", "a")
+
+	// EXEC unwatches, the writes of the transaction touch nothing
+	tc.expect(testStatus("OK"), "watch", "a")
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect(testStatus("QUEUED"), "set", "a", "2")
+	tc.expect([]any{testStatus("OK")}, "exec")
+	other.expect(testStatus("OK"), "set", "a", "3")
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect([]any{}, "exec")
+
+	// a write that changes nothing does not touch the key
+	tc.expect(testStatus("OK"), "watch", "a")
+	other.expect(int64(0), "del", "missing")
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect([]any{}, "exec")
+
+	tc.expect(testStatus("OK"), "watch", "a")
+	tc.expect(testStatus("OK"), "unwatch")
+	other.expect(testStatus("OK"), "set", "a", "4")
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect([]any{}, "exec")
+
+	// flushing the db touches the keys it had
+	tc.expect(testStatus("OK"), "watch", "a")
+	other.expect(testStatus("OK"), "flushdb")
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect(nil, "exec")
+
+	// an expired key that is deleted afterwards changes nothing
+	other.expect(testStatus("OK"), "set", "e", "1", "px", "1")
+	time.Sleep(time.Millisecond * 5)
+	tc.expect(testStatus("OK"), "watch", "e")
+	other.expect(nil, "get", "e")
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect([]any{}, "exec")
+
+	// a key expiring after WATCH aborts the transaction
+	other.expect(testStatus("OK"), "set", "e", "1", "px", "20")
+	tc.expect(testStatus("OK"), "watch", "e")
+	time.Sleep(time.Millisecond * 30)
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect(nil, "exec")
+}
+
+func TestMulti_Blocking(t *testing.T) {
+	tc := newBlockingTestConns(t, "7", 1)[0]
+
+	// blocking commands do not block inside a transaction
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect(testStatus("QUEUED"), "blpop", "l", "0")
+	tc.expect(testStatus("QUEUED"), "rpush", "l", "a")
+	tc.expect(testStatus("QUEUED"), "blpop", "l", "0")
+	tc.expect([]any{nil, int64(1), []any{"l", "a"}}, "exec")
+}
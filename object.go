@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	objectTypeString = iota + 1
+	objectTypeHash
+	objectTypeList
+	objectTypeSet
+	objectTypeZSet
+	objectTypeStream
+)
+
+// string encodings: raw holds a []byte, embedding an immutable go string and
+// int an int64. The aggregate types start with a compact encoding held in a
+// []byte, listpack or intset, and convert to their hashtable based encodings
+// once they grow.
+const (
+	objectEncodingRaw = iota
+	objectEncodingEmbedding
+	objectEncodingInt
+	objectEncodingListpack
+	objectEncodingHT
+	objectEncodingQuicklist
+	objectEncodingIntset
+	objectEncodingSkiplist
+	objectEncodingStream
+)
+
+// strings up to this length are stored with the embedding encoding.
+const objectEncodingEmbeddingSizeLimit = 44
+
+type rObj struct {
+	objectType uint8
+	encoding   uint8
+	snapshot   uint16 // epoch of the background save sharing it, see dbUnshareValue
+	lru        uint32 // access clock, see initObjectAccess
+	memory     int64  // size accounted to the db the object is stored in
+	data       any
+}
+
+// approximate memory overhead of the go structures, in bytes
+const (
+	objectOverhead       = 64 // rObj plus the interface header of data
+	dictEntryOverhead    = 48 // dictEntry and its bucket slot
+	stringHeaderOverhead = 16
+)
+
+// objectComputeSize returns the approximate memory used by o.
+func objectComputeSize(o *rObj) int64 {
+
+	size := int64(objectOverhead)
+	switch o.encoding {
+	case objectEncodingRaw:
+		size += int64(cap(o.data.([]byte))) + 24
+	case objectEncodingEmbedding:
+		size += int64(len(o.data.(string))) + stringHeaderOverhead
+	case objectEncodingListpack, objectEncodingIntset:
+		size += int64(cap(o.data.([]byte))) + 24
+	case objectEncodingHT:
+		switch o.objectType {
+		case objectTypeHash:
+			size += dictComputeSize(o.data.(*dict), func(de *dictEntry) int64 {
+				return int64(len(de.key)+cap(de.val.([]byte))) + stringHeaderOverhead + 24
+			})
+		case objectTypeSet:
+			size += dictComputeSize(o.data.(*dict), func(de *dictEntry) int64 {
+				return int64(len(de.key)) + stringHeaderOverhead
+			})
+		}
+	case objectEncodingQuicklist:
+		size += quicklistComputeSize(o.data.(*quicklist))
+	case objectEncodingSkiplist:
+		// the node shares the member with the dict entry
+		size += dictComputeSize(o.data.(*zset).dict, func(de *dictEntry) int64 {
+			return int64(len(de.key)) + stringHeaderOverhead + zskiplistNodeOverhead
+		})
+	case objectEncodingStream:
+		size += streamComputeSize(o.data.(*stream))
+	}
+	return size
+
+}
+
+// objectComputeSizeSamples is the number of elements sampled to estimate the
+// size of the hashtable encodings.
+const objectComputeSizeSamples = 5
+
+// dictComputeSize estimates the size of d from the average size of a few
+// sampled entries, computed by entrySize without the entry overhead.
+func dictComputeSize(d *dict, entrySize func(de *dictEntry) int64) int64 {
+
+	size := int64(d.slots()) * 8
+	samples := d.someEntries(objectComputeSizeSamples)
+	if len(samples) == 0 {
+		return size
+	}
+	var sampled int64
+	for _, de := range samples {
+		sampled += entrySize(de) + dictEntryOverhead
+	}
+	return size + sampled*int64(d.size())/int64(len(samples))
+
+}
+
+func createStringObject(data any) *rObj {
+	return &rObj{
+		objectType: objectTypeString,
+		encoding:   objectEncodingRaw,
+		data:       data,
+	}
+}
+
+func createStringObjectFromLongLong(v int64) *rObj {
+	return &rObj{
+		objectType: objectTypeString,
+		encoding:   objectEncodingInt,
+		data:       v,
+	}
+}
+
+func createEmbeddedStringObject(s string) *rObj {
+	return &rObj{
+		objectType: objectTypeString,
+		encoding:   objectEncodingEmbedding,
+		data:       s,
+	}
+}
+
+// createStringObjectFromLongDouble stores v the way INCRBYFLOAT prints it,
+// without exponent.
+func createStringObjectFromLongDouble(v float64) *rObj {
+	return tryObjectEncoding(createStringObject(strconv.AppendFloat(nil, v, 'f', -1, 64)))
+}
+
+// tryObjectEncoding converts a raw string object to the most compact
+// encoding, integers become int and short strings embedding.
+func tryObjectEncoding(o *rObj) *rObj {
+
+	if o.objectType != objectTypeString || o.encoding != objectEncodingRaw {
+		return o
+	}
+
+	buf := o.data.([]byte)
+	if len(buf) <= 20 {
+		if v, ok := string2ll(buf); ok {
+			o.encoding, o.data = objectEncodingInt, v
+			return o
+		}
+	}
+	if len(buf) <= objectEncodingEmbeddingSizeLimit {
+		o.encoding, o.data = objectEncodingEmbedding, string(buf)
+	}
+	return o
+
+}
+
+// bytes returns the content of a string object, the result must not be
+// modified unless the object is raw encoded.
+func (o *rObj) bytes() []byte {
+	switch o.encoding {
+	case objectEncodingEmbedding:
+		return []byte(o.data.(string))
+	case objectEncodingInt:
+		return strconv.AppendInt(nil, o.data.(int64), 10)
+	}
+	return o.data.([]byte)
+}
+
+// String returns the content of a string object, mostly used as dict key.
+func (o *rObj) String() string {
+	switch o.encoding {
+	case objectEncodingEmbedding:
+		return o.data.(string)
+	case objectEncodingInt:
+		return strconv.FormatInt(o.data.(int64), 10)
+	}
+	return string(o.data.([]byte))
+}
+
+// stringObjectLen returns the length of a string object without converting
+// int encoded values.
+func stringObjectLen(o *rObj) int {
+	switch o.encoding {
+	case objectEncodingEmbedding:
+		return len(o.data.(string))
+	case objectEncodingInt:
+		return digits10(o.data.(int64))
+	}
+	return len(o.data.([]byte))
+}
+
+// dupStringObject returns a raw encoded copy that can be modified in place.
+func dupStringObject(o *rObj) *rObj {
+	buf := o.bytes()
+	if o.encoding == objectEncodingRaw {
+		buf = append([]byte(nil), buf...)
+	}
+	return createStringObject(buf)
+}
+
+func strEncoding(encoding uint8) string {
+	switch encoding {
+	case objectEncodingRaw:
+		return "raw"
+	case objectEncodingEmbedding:
+		return "embstr"
+	case objectEncodingInt:
+		return "int"
+	case objectEncodingListpack:
+		return "listpack"
+	case objectEncodingHT:
+		return "hashtable"
+	case objectEncodingQuicklist:
+		return "quicklist"
+	case objectEncodingIntset:
+		return "intset"
+	case objectEncodingSkiplist:
+		return "skiplist"
+	case objectEncodingStream:
+		return "stream"
+	}
+	return "unknown"
+}
+
+func checkType(c *client, o *rObj, objectType uint8) bool {
+	if o.objectType != objectType {
+		addReply(c, shared.wrongTypeErr)
+		return false
+	}
+	return true
+}
+
+// string2ll parses s as a 64 bit integer with the strictness of redis:
+// no spaces, no '+' sign and no leading zeros, so an integer converted back
+// to a string is always byte to byte equal to the original.
+func string2ll(s []byte) (int64, bool) {
+
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	if len(s) == 1 && s[0] == '0' {
+		return 0, true
+	}
+
+	p := s
+	if p[0] == '-' {
+		p = p[1:]
+	}
+	if len(p) == 0 || p[0] < '1' || p[0] > '9' {
+		return 0, false
+	}
+	for _, b := range p {
+		if b < '0' || b > '9' {
+			return 0, false
+		}
+	}
+
+	v, err := strconv.ParseInt(string(s), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+
+}
+
+// string2ld parses s as a float, rejecting spaces and NaN.
+func string2ld(s []byte) (float64, bool) {
+
+	if len(s) == 0 || len(s) > 5*1024 || isSpace(s[0]) || isSpace(s[len(s)-1]) {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(string(s), 64)
+	if err != nil || math.IsNaN(v) {
+		return 0, false
+	}
+	return v, true
+
+}
+
+func getLongLongFromObject(o *rObj) (int64, bool) {
+	if o == nil {
+		return 0, true
+	}
+	if o.encoding == objectEncodingInt {
+		return o.data.(int64), true
+	}
+	return string2ll(o.bytes())
+}
+
+func getLongDoubleFromObject(o *rObj) (float64, bool) {
+	if o == nil {
+		return 0, true
+	}
+	if o.encoding == objectEncodingInt {
+		return float64(o.data.(int64)), true
+	}
+	return string2ld(o.bytes())
+}
+
+func getLongDoubleFromObjectOrReply(c *client, o *rObj, msg string) (float64, bool) {
+	v, ok := getLongDoubleFromObject(o)
+	if !ok {
+		if msg == "" {
+			msg = "value is not a valid float"
+		}
+		addReplyError(c, msg)
+		return 0, false
+	}
+	return v, true
+}
+
+func getLongLongFromObjectOrReply(c *client, o *rObj, msg string) (int64, bool) {
+	v, ok := getLongLongFromObject(o)
+	if !ok {
+		if msg == "" {
+			msg = "value is not an integer or out of range"
+		}
+		addReplyError(c, msg)
+		return 0, false
+	}
+	return v, true
+}
+
+func getRangeLongFromObjectOrReply(c *client, o *rObj, minVal, maxVal int64, msg string) (int64, bool) {
+	v, ok := getLongLongFromObjectOrReply(c, o, msg)
+	if !ok {
+		return 0, false
+	}
+	if v < minVal || v > maxVal {
+		if msg == "" {
+			msg = fmt.Sprintf("value is out of range, must be between %d and %d", minVal, maxVal)
+		}
+		addReplyError(c, msg)
+		return 0, false
+	}
+	return v, true
+}
+
+func objectCommand(c *client) {
+
+	sub := strings.ToLower(c.argv[1].String())
+	switch {
+	case sub == "help" && c.argc == 2:
+		addReplyHelp(c, []string{
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+			"FREQ <key>",
+			"    Return the access frequency index of the <key>. The returned integer is",
+			"    proportional to the logarithm of the recent access frequency of the key.",
+			"IDLETIME <key>",
+			"    Return the idle time of the <key>, that is the approximated number of",
+			"    seconds elapsed since the last access to the key.",
+		})
+	case sub == "encoding" && c.argc == 3:
+		o := objectCommandLookupOrReply(c, c.argv[2].String(), shared.nullBulk)
+		if o == nil {
+			return
+		}
+		addReplyBulkString(c, strEncoding(o.encoding))
+	case sub == "idletime" && c.argc == 3:
+		o := objectCommandLookupOrReply(c, c.argv[2].String(), shared.nullBulk)
+		if o == nil {
+			return
+		}
+		if rServer.maxmemoryPolicy&maxmemoryFlagLFU != 0 {
+			addReplyError(c, "An LFU maxmemory policy is selected, idle time not tracked. "+
+				"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+			return
+		}
+		addReplyLongLong(c, int64(estimateObjectIdleTime(o)/1000))
+	case sub == "freq" && c.argc == 3:
+		o := objectCommandLookupOrReply(c, c.argv[2].String(), shared.nullBulk)
+		if o == nil {
+			return
+		}
+		if rServer.maxmemoryPolicy&maxmemoryFlagLFU == 0 {
+			addReplyError(c, "An LFU maxmemory policy is not selected, access frequency not tracked. "+
+				"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+			return
+		}
+		addReplyLongLong(c, int64(lfuDecrAndReturn(o)))
+	default:
+		addReplySubcommandSyntaxError(c)
+	}
+
+}
+
+// objectCommandLookupOrReply looks up key without touching its access clock.
+func objectCommandLookupOrReply(c *client, key string, reply []byte) *rObj {
+	var o *rObj
+	if !expireIfNeeded(c.db, key) {
+		o = lookupKeyNoTouch(c.db, key)
+	}
+	// sampling the size of a dict rehashes it
+	if o != nil {
+		o = dbUnshareValue(c.db, key, o)
+	}
+	if o == nil {
+		addReply(c, reply)
+	}
+	return o
+}
+
+func memoryCommand(c *client) {
+
+	sub := strings.ToLower(c.argv[1].String())
+	switch {
+	case sub == "help" && c.argc == 2:
+		addReplyHelp(c, []string{
+			"USAGE <key>",
+			"    Return memory in bytes used by <key> and its value.",
+		})
+	case sub == "usage" && c.argc == 3:
+		key := c.argv[2].String()
+		o := objectCommandLookupOrReply(c, key, shared.nullBulk)
+		if o == nil {
+			return
+		}
+		addReplyLongLong(c, objectComputeSize(o)+keyMemoryOverhead(key))
+	default:
+		addReplySubcommandSyntaxError(c)
+	}
+
+}
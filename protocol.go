@@ -12,6 +12,7 @@ const (
 	bulkBigArgs           = 1024 * 32
 	clientMaxQueryBufLen  = 1024 * 1024 * 1024 // 1Gi
 	maxBulkLen            = 1024 * 1024 * 512
+	maxMultiBulkLen       = 1024 * 1024
 )
 
 const (
@@ -29,15 +30,63 @@ const (
 
 // client flag
 const (
-	clientSlave           = 1 << 0
-	clientCloseAfterReply = 1 << 6
-	clientPendingWrite    = 1 << 21
-	clientPendingRead     = 1 << 22
-	clientPendingCommand  = 1 << 23
+	clientSlave               = 1 << 0 // a replica, its output is the replication stream
+	clientMaster              = 1 << 1 // our master, applying its stream
+	clientMulti               = 1 << 3 // in MULTI, queuing commands
+	clientBlocked             = 1 << 4 // waiting in a blocking command
+	clientDirtyCAS            = 1 << 5 // a watched key was modified, EXEC fails
+	clientUnblocked           = 1 << 7 // queued in server.unblockedClients
+	clientCloseAfterReply     = 1 << 6
+	clientCloseASAP           = 1 << 10
+	clientDirtyExec           = 1 << 12 // a command failed to queue, EXEC fails
+	clientMasterForceReply    = 1 << 13 // the master gets this reply, e.g. REPLCONF ACK
+	clientPubSub              = 1 << 18 // has pub/sub subscriptions
+	clientPendingWrite        = 1 << 21
+	clientPendingRead         = 1 << 22
+	clientPendingCommand      = 1 << 23
+	clientClosed              = 1 << 24
+	clientReprocessingCommand = 1 << 25 // running again the command it blocked in
+	clientPreventPropagation  = 1 << 26 // the command propagated what it did by itself
+	clientDenyBlocking        = 1 << 27 // blocking commands behave as timed out, e.g. loading the AOF
+	clientForcePropagation    = 1 << 28 // propagate the command even if it changed nothing
 )
 
+// processInlineBuffer parses a request sent as a single line of space
+// separated arguments, e.g. "SET key \"hello world\"\r\n", as telnet and
+// health check scripts do.
 func processInlineBuffer(c *client) bool {
-	return false
+
+	newline := bytes.IndexByte(c.queryBuf, '\n')
+	if newline == -1 {
+		if len(c.queryBuf) > maxInlineLength {
+			addReplyError(c, "Protocol error: too big inline request")
+			setProtocolError(c, "too big inline request")
+		}
+		return false
+	}
+
+	// handle the \r\n case
+	end := newline
+	if end > 0 && c.queryBuf[end-1] == '\r' {
+		end--
+	}
+
+	args, ok := splitArgs(c.queryBuf[:end])
+	if !ok {
+		addReplyError(c, "Protocol error: unbalanced quotes in request")
+		setProtocolError(c, "unbalanced quotes in inline request")
+		return false
+	}
+
+	c.queryBuf = c.queryBuf[newline+1:]
+
+	c.argv = make([]*rObj, 0, len(args))
+	for _, arg := range args {
+		c.argv = append(c.argv, createStringObject(arg))
+	}
+	c.argc = len(c.argv)
+	return true
+
 }
 
 type bufferBlock struct {
@@ -61,8 +110,9 @@ func addReply(c *client, reply []byte) {
 
 	replyLen := len(reply)
 
-	// copy to reply buffer
-	if int(c.replyPos) < len(c.reply) {
+	// copy to reply buffer, only while nothing is queued in the block list,
+	// otherwise the reply would be sent out of order.
+	if (c.replyList == nil || c.replyList.Len() == 0) && int(c.replyPos) < len(c.reply) {
 		copyLen := len(c.reply) - int(c.replyPos)
 		if copyLen > replyLen {
 			copyLen = replyLen
@@ -76,15 +126,15 @@ func addReply(c *client, reply []byte) {
 	// copy to reply block list
 	for replyLen > 0 {
 
-		var replyBlock *bufferBlock
 		if c.replyList == nil {
-			replyBlock = newBufferBlock(genericReplyBlockLen)
 			c.replyList = list.New()
-			c.replyList.PushBack(replyBlock)
 		}
 
-		replyBlock = c.replyList.Back().Value.(*bufferBlock)
-		if replyBlock.pos == replyBlock.len {
+		var replyBlock *bufferBlock
+		if c.replyList.Len() > 0 {
+			replyBlock = c.replyList.Back().Value.(*bufferBlock)
+		}
+		if replyBlock == nil || replyBlock.pos == replyBlock.len {
 			replyBlock = newBufferBlock(genericReplyBlockLen)
 			c.replyList.PushBack(replyBlock)
 		}
@@ -95,6 +145,7 @@ func addReply(c *client, reply []byte) {
 		}
 
 		copy(replyBlock.data[replyBlock.pos:], reply[:copyLen])
+		replyBlock.pos += copyLen
 		replyLen -= copyLen
 		reply = reply[copyLen:]
 	}
@@ -103,21 +154,43 @@ func addReply(c *client, reply []byte) {
 
 func prepareClientTotWrite(c *client) bool {
 
-	if !c.hasPendingOutputs() && c.flag&clientPendingWrite == 0 {
-		c.flag |= clientPendingWrite
-		rServer.clientsPendingWrite.PushBack(c)
-		c.clientPendingWriteElement = rServer.clientsPendingWrite.Back()
+	// a closing client will never send the reply.
+	if c.flag&(clientCloseAfterReply|clientCloseASAP|clientClosed) != 0 {
+		return false
+	}
+
+	// the fake client loading the AOF has no one to reply to.
+	if c.conn == nil {
+		return false
+	}
+
+	// the master is never replied, but for the offset it asks for.
+	if c.flag&clientMaster != 0 && c.flag&clientMasterForceReply == 0 {
+		return false
+	}
+
+	// the stream waits in the output of a replica until it has the rdb, and
+	// loaded it when it was streamed to the socket.
+	if c.flag&clientSlave != 0 && (c.replState != slaveStateOnline || c.replStartCmdStreamOnAck) {
+		return true
+	}
+
+	// clients read by the io goroutines are queued by the main loop later.
+	if !c.hasPendingOutputs() && c.flag&(clientPendingWrite|clientPendingRead) == 0 {
+		queueClientPendingWrite(c)
 	}
 
 	return true
 }
 
-func (c *client) hasPendingOutputs() bool {
-	return c.replyPos > 0 || c.replyList.Len() > 0
+func queueClientPendingWrite(c *client) {
+	c.flag |= clientPendingWrite
+	rServer.clientsPendingWrite.PushBack(c)
+	c.clientPendingWriteElement = rServer.clientsPendingWrite.Back()
 }
 
-func addReplyError(c *client, err string) {
-
+func (c *client) hasPendingOutputs() bool {
+	return c.replyPos > 0 || (c.replyList != nil && c.replyList.Len() > 0)
 }
 
 func setProtocolError(c *client, err string) {
@@ -151,20 +224,22 @@ func processMultiBulkBuffer(c *client) bool {
 		}
 
 		mbulk, err := strconv.ParseInt(string(c.queryBuf[1:idx]), 10, 64)
-		if err != nil {
-			addReplyError(c, "Protocol error: mbulk count invalid")
-			setProtocolError(c, "mbulk count invalid")
+		if err != nil || mbulk > maxMultiBulkLen {
+			addReplyError(c, "Protocol error: invalid multibulk length")
+			setProtocolError(c, "invalid multibulk length")
 			return false
 		}
 
 		pos += idx + 2
 		if mbulk <= 0 {
+			// an empty command, the caller resets the client.
 			c.queryBuf = c.queryBuf[pos:]
-			return false
+			return true
 		}
 		c.multiBulkLen = int32(mbulk)
 
-		c.argv = make([]rObj, mbulk)
+		// don't trust the client for the preallocation
+		c.argv = make([]*rObj, 0, min(int(mbulk), 1024))
 		c.argc = 0
 	}
 
@@ -176,8 +251,10 @@ func processMultiBulkBuffer(c *client) bool {
 				if len(c.queryBuf) >= maxInlineLength {
 					addReplyError(c, "Protocol error: too big bulk count string")
 					setProtocolError(c, "too big mbulk count string")
+					return false
 				}
-				return false
+				// keep the arguments parsed so far
+				break
 			}
 
 			// should contain \n
@@ -209,8 +286,8 @@ func processMultiBulkBuffer(c *client) bool {
 			if bulk >= bulkBigArgs {
 				c.queryBuf = c.queryBuf[pos:]
 				pos = 0
-				if cap(c.queryBuf)-len(c.queryBuf) < bulkBigArgs+2 {
-					newBuffer := make([]byte, 0, bulkBigArgs+2)
+				if cap(c.queryBuf) < int(bulk)+2 {
+					newBuffer := make([]byte, 0, bulk+2)
 					newBuffer = append(newBuffer, c.queryBuf...)
 					c.queryBuf = newBuffer
 				}
@@ -222,19 +299,22 @@ func processMultiBulkBuffer(c *client) bool {
 			break
 		}
 
-		c.argv[c.argc] = rObj{
-			objectType: objectTypeString,
-			encoding:   objectEncodingRaw,
-			data:       c.queryBuf[:c.bulkLen],
-		}
-
+		var arg []byte
 		if c.bulkLen >= bulkBigArgs && pos == 0 &&
 			int64(len(c.queryBuf)) == c.bulkLen+2 {
+			// the query buffer holds exactly this argument, hand it over
+			// instead of copying it.
+			arg = c.queryBuf[:c.bulkLen]
 			c.queryBuf = make([]byte, 0, genericIOBufferLength)
 		} else {
+			arg = make([]byte, c.bulkLen)
+			copy(arg, c.queryBuf[pos:pos+int(c.bulkLen)])
 			pos += int(c.bulkLen) + 2
 		}
-		c.bulkLen--
+
+		c.argv = append(c.argv, createStringObject(arg))
+		c.argc++
+		c.bulkLen = -1
 		c.multiBulkLen--
 	}
 
@@ -253,6 +333,12 @@ func processInputBuffer(c *client) {
 
 	for len(c.queryBuf) > 0 {
 
+		// stop reading after a protocol error, or once the client is closing.
+		// the input of a blocked client waits until it is unblocked.
+		if c.flag&(clientBlocked|clientCloseAfterReply|clientCloseASAP|clientClosed) != 0 {
+			break
+		}
+
 		if c.reqType == 0 {
 			if c.queryBuf[0] == '*' {
 				c.reqType = reqTypeMultiBulk
@@ -271,8 +357,6 @@ func processInputBuffer(c *client) {
 			}
 		}
 
-		Log("client get commands, %#v", c.argv)
-
 		if c.argc == 0 {
 			resetClient(c)
 		} else {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		line string
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"   ", nil, true},
+		{"PING", []string{"PING"}, true},
+		{"  set  key   value ", []string{"set", "key", "value"}, true},
+		{`set key "hello world"`, []string{"set", "key", "hello world"}, true},
+		{`set key "a\nb\tc\x41\"d"`, []string{"set", "key", "a\nb\tcA\"d"}, true},
+		{`set key 'it\'s "raw" \n'`, []string{"set", "key", `it's "raw" \n`}, true},
+		{`set key ""`, []string{"set", "key", ""}, true},
+		{`a"b c"`, []string{"ab c"}, true},
+		{`set key "unterminated`, nil, false},
+		{`set key 'unterminated`, nil, false},
+		{`set key "closed"garbage`, nil, false},
+		{`set key 'closed'garbage`, nil, false},
+	}
+
+	for _, tt := range cases {
+		args, ok := splitArgs([]byte(tt.line))
+		if ok != tt.ok {
+			t.Fatalf("%q: want ok=%v, got %v", tt.line, tt.ok, ok)
+		}
+		got := make([]string, 0, len(args))
+		for _, arg := range args {
+			got = append(got, string(arg))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) || len(got) != len(tt.want) {
+			t.Fatalf("%q: want %q, got %q", tt.line, tt.want, got)
+		}
+	}
+}
+
+func TestInline_Commands(t *testing.T) {
+	tc := newTestConn(t)
+
+	tc.writeRaw("PING\r\n")
+	if got := tc.read(); got != testStatus("PONG") {
+		t.Fatalf("want PONG, got %#v", got)
+	}
+
+	// bare \n, empty lines and pipelining
+	tc.writeRaw("\r\n\necho \"hello world\"\nECHO 'single quoted'\r\nping\n")
+	for _, want := range []any{"hello world", "single quoted", testStatus("PONG")} {
+		if got := tc.read(); got != want {
+			t.Fatalf("want %#v, got %#v", want, got)
+		}
+	}
+
+	// inline and multibulk requests can be mixed
+	tc.writeRaw("echo inline\r\n*2\r\n$4\r\necho\r\n$5\r\nmulti\r\n")
+	for _, want := range []any{"inline", "multi"} {
+		if got := tc.read(); got != want {
+			t.Fatalf("want %#v, got %#v", want, got)
+		}
+	}
+
+	// a request split across reads
+	tc.writeRaw("ec")
+	tc.writeRaw("ho split\r\n")
+	if got := tc.read(); got != "split" {
+		t.Fatalf("want split, got %#v", got)
+	}
+}
+
+func TestInline_UnbalancedQuotes(t *testing.T) {
+	tc := newTestConn(t)
+	tc.writeRaw("echo \"oops\r\n")
+	if got := tc.read(); got != testError("ERR Protocol error: unbalanced quotes in request") {
+		t.Fatalf("want unbalanced quotes error, got %#v", got)
+	}
+}
+
+func TestInline_TooBig(t *testing.T) {
+	tc := newTestConn(t)
+	tc.writeRaw(strings.Repeat("a", maxInlineLength+1))
+	if got := tc.read(); got != testError("ERR Protocol error: too big inline request") {
+		t.Fatalf("want too big inline error, got %#v", got)
+	}
+}
+
+func TestMultiBulk_SplitReads(t *testing.T) {
+	tc := newTestConn(t)
+
+	// split inside the length of the second argument, after the first one
+	// was parsed
+	tc.writeRaw("*2\r\n$4\r\necho\r\n$")
+	time.Sleep(time.Millisecond * 20)
+	tc.writeRaw("5\r\nsplit\r\n")
+	if got := tc.read(); got != "split" {
+		t.Fatalf("want split, got %#v", got)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import "strings"
+
+// Pub/Sub: clients subscribe to channels, or to glob-style patterns of
+// channels, and receive the messages published to them as push messages.
+// A RESP2 client with subscriptions can only run the subscription commands,
+// its connection being dedicated to receiving messages, a RESP3 client
+// gets the messages out of band and can keep running any command.
+//
+// The subscriptions are kept both in the client, to reply its count and to
+// unsubscribe it when freed, and in the server, to find the receivers of a
+// message.
+//
+// Shard channels (SSUBSCRIBE, SPUBLISH) are hashed to slots like keys and
+// their subscribers are kept by slot, so a message only concerns the node
+// serving the slot of its channel instead of being broadcast to every node.
+
+// pubsubSubscribers are the clients subscribed to each channel or pattern.
+type pubsubSubscribers map[string]map[*client]struct{}
+
+// pubsubType tells the classic channels from the shard channels, which
+// have their own subscriptions, counts and messages.
+type pubsubType struct {
+	shard bool
+	// the channels of the client
+	clientChannels func(c *client) *map[string]struct{}
+	// the subscriptions counted in the replies
+	subscriptionCount func(c *client) int
+	// the subscribers of the channels in the same slot as channel
+	serverChannels func(channel string) pubsubSubscribers
+
+	subscribeMsg   string
+	unsubscribeMsg string
+	messageBulk    string
+}
+
+var pubsubStandard = &pubsubType{
+	clientChannels:    func(c *client) *map[string]struct{} { return &c.pubsubChannels },
+	subscriptionCount: clientSubscriptionsCount,
+	serverChannels:    func(string) pubsubSubscribers { return rServer.pubsubChannels },
+	subscribeMsg:      "subscribe",
+	unsubscribeMsg:    "unsubscribe",
+	messageBulk:       "message",
+}
+
+var pubsubShard = &pubsubType{
+	shard:             true,
+	clientChannels:    func(c *client) *map[string]struct{} { return &c.pubsubShardChannels },
+	subscriptionCount: clientShardSubscriptionsCount,
+	serverChannels:    pubsubShardChannelsOf,
+	subscribeMsg:      "ssubscribe",
+	unsubscribeMsg:    "sunsubscribe",
+	messageBulk:       "smessage",
+}
+
+// clientSubscriptionsCount returns the channels and patterns the client is
+// subscribed to.
+func clientSubscriptionsCount(c *client) int {
+	return len(c.pubsubChannels) + len(c.pubsubPatterns)
+}
+
+func clientShardSubscriptionsCount(c *client) int {
+	return len(c.pubsubShardChannels)
+}
+
+// pubsubShardChannelsOf returns the shard channels sharing the slot of
+// channel, creating the slot table on first use.
+func pubsubShardChannelsOf(channel string) pubsubSubscribers {
+
+	slot := keyHashSlot(channel)
+	if rServer.pubsubShardChannels[slot] == nil {
+		rServer.pubsubShardChannels[slot] = make(pubsubSubscribers)
+	}
+	return rServer.pubsubShardChannels[slot]
+
+}
+
+// pubsubTotalShardChannels returns the shard channels with subscribers.
+func pubsubTotalShardChannels() int {
+	total := 0
+	for _, channels := range rServer.pubsubShardChannels {
+		total += len(channels)
+	}
+	return total
+}
+
+// markClientAsPubSub flags the client in subscribed mode once it has a
+// subscription, and out of it once it has none.
+func markClientAsPubSub(c *client) {
+	if clientSubscriptionsCount(c)+clientShardSubscriptionsCount(c) > 0 {
+		c.flag |= clientPubSub
+	} else {
+		c.flag &^= clientPubSub
+	}
+}
+
+// addReplyPubsubMessage sends a message published to channel.
+func addReplyPubsubMessage(c *client, channel string, msg []byte, kind string) {
+	addReplyPushLen(c, 3)
+	addReplyBulkString(c, kind)
+	addReplyBulkString(c, channel)
+	addReplyBulk(c, msg)
+}
+
+// addReplyPubsubPatMessage sends a message published to channel, received
+// through the subscription to pattern.
+func addReplyPubsubPatMessage(c *client, pattern, channel string, msg []byte) {
+	addReplyPushLen(c, 4)
+	addReplyBulkString(c, "pmessage")
+	addReplyBulkString(c, pattern)
+	addReplyBulkString(c, channel)
+	addReplyBulk(c, msg)
+}
+
+// addReplyPubsubSubscribed confirms a subscription, kind being e.g.
+// "subscribe" or "psubscribe" and count the subscriptions of that type.
+func addReplyPubsubSubscribed(c *client, kind, channel string, count int) {
+	addReplyPushLen(c, 3)
+	addReplyBulkString(c, kind)
+	addReplyBulkString(c, channel)
+	addReplyLongLong(c, int64(count))
+}
+
+// addReplyPubsubUnsubscribed confirms an unsubscription, a nil channel
+// meaning the client had no subscription to drop.
+func addReplyPubsubUnsubscribed(c *client, kind string, channel *string, count int) {
+
+	addReplyPushLen(c, 3)
+	addReplyBulkString(c, kind)
+	if channel == nil {
+		addReplyNull(c)
+	} else {
+		addReplyBulkString(c, *channel)
+	}
+	addReplyLongLong(c, int64(count))
+
+}
+
+// subscribe adds c to the clients of name in subs, it returns false if it
+// was there already.
+func subscribe(subs pubsubSubscribers, name string, c *client) bool {
+
+	clients := subs[name]
+	if clients == nil {
+		clients = make(map[*client]struct{})
+		subs[name] = clients
+	}
+	if _, ok := clients[c]; ok {
+		return false
+	}
+	clients[c] = struct{}{}
+	return true
+
+}
+
+func unsubscribe(subs pubsubSubscribers, name string, c *client) {
+	clients := subs[name]
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(subs, name)
+	}
+}
+
+// pubsubSubscribeChannel subscribes the client to channel, it returns false
+// if it was subscribed already.
+func pubsubSubscribeChannel(c *client, channel string, t *pubsubType) bool {
+
+	added := false
+	channels := t.clientChannels(c)
+	if _, ok := (*channels)[channel]; !ok {
+		if *channels == nil {
+			*channels = make(map[string]struct{})
+		}
+		(*channels)[channel] = struct{}{}
+		subscribe(t.serverChannels(channel), channel, c)
+		added = true
+	}
+	addReplyPubsubSubscribed(c, t.subscribeMsg, channel, t.subscriptionCount(c))
+	return added
+
+}
+
+// pubsubUnsubscribeChannel unsubscribes the client from channel, replying
+// the confirmation when notify is set. It returns false if the client was
+// not subscribed.
+func pubsubUnsubscribeChannel(c *client, channel string, notify bool, t *pubsubType) bool {
+
+	removed := false
+	channels := t.clientChannels(c)
+	if _, ok := (*channels)[channel]; ok {
+		delete(*channels, channel)
+		unsubscribe(t.serverChannels(channel), channel, c)
+		removed = true
+	}
+	if notify {
+		addReplyPubsubUnsubscribed(c, t.unsubscribeMsg, &channel, t.subscriptionCount(c))
+	}
+	return removed
+
+}
+
+func pubsubSubscribePattern(c *client, pattern string) bool {
+
+	added := false
+	if _, ok := c.pubsubPatterns[pattern]; !ok {
+		if c.pubsubPatterns == nil {
+			c.pubsubPatterns = make(map[string]struct{})
+		}
+		c.pubsubPatterns[pattern] = struct{}{}
+		subscribe(rServer.pubsubPatterns, pattern, c)
+		added = true
+	}
+	addReplyPubsubSubscribed(c, "psubscribe", pattern, clientSubscriptionsCount(c))
+	return added
+
+}
+
+func pubsubUnsubscribePattern(c *client, pattern string, notify bool) bool {
+
+	removed := false
+	if _, ok := c.pubsubPatterns[pattern]; ok {
+		delete(c.pubsubPatterns, pattern)
+		unsubscribe(rServer.pubsubPatterns, pattern, c)
+		removed = true
+	}
+	if notify {
+		addReplyPubsubUnsubscribed(c, "punsubscribe", &pattern, clientSubscriptionsCount(c))
+	}
+	return removed
+
+}
+
+// pubsubUnsubscribeAllChannels unsubscribes the client from every channel
+// of type t, returning how many. Without channels to drop a single
+// confirmation with a null channel is replied.
+func pubsubUnsubscribeAllChannels(c *client, notify bool, t *pubsubType) int {
+
+	count := 0
+	for channel := range *t.clientChannels(c) {
+		pubsubUnsubscribeChannel(c, channel, notify, t)
+		count++
+	}
+	if notify && count == 0 {
+		addReplyPubsubUnsubscribed(c, t.unsubscribeMsg, nil, t.subscriptionCount(c))
+	}
+	return count
+
+}
+
+func pubsubUnsubscribeAllPatterns(c *client, notify bool) int {
+
+	count := 0
+	for pattern := range c.pubsubPatterns {
+		pubsubUnsubscribePattern(c, pattern, notify)
+		count++
+	}
+	if notify && count == 0 {
+		addReplyPubsubUnsubscribed(c, "punsubscribe", nil, clientSubscriptionsCount(c))
+	}
+	return count
+
+}
+
+// pubsubUnsubscribeAll drops every subscription of a client being freed.
+func pubsubUnsubscribeAll(c *client) {
+	pubsubUnsubscribeAllChannels(c, false, pubsubStandard)
+	pubsubUnsubscribeAllChannels(c, false, pubsubShard)
+	pubsubUnsubscribeAllPatterns(c, false)
+}
+
+// pubsubPublishMessage sends message to the clients subscribed to channel,
+// or to a pattern matching it for the classic channels, returning the
+// number of receivers.
+func pubsubPublishMessage(channel string, message []byte, t *pubsubType) int {
+
+	receivers := 0
+	for c := range t.serverChannels(channel)[channel] {
+		addReplyPubsubMessage(c, channel, message, t.messageBulk)
+		receivers++
+	}
+	if t.shard {
+		return receivers
+	}
+
+	for pattern, clients := range rServer.pubsubPatterns {
+		if !stringmatch(pattern, channel, false) {
+			continue
+		}
+		for c := range clients {
+			addReplyPubsubPatMessage(c, pattern, channel, message)
+			receivers++
+		}
+	}
+	return receivers
+
+}
+
+func subscribeCommand(c *client) {
+	for j := 1; j < c.argc; j++ {
+		pubsubSubscribeChannel(c, c.argv[j].String(), pubsubStandard)
+	}
+	markClientAsPubSub(c)
+}
+
+func unsubscribeCommand(c *client) {
+
+	if c.argc == 1 {
+		pubsubUnsubscribeAllChannels(c, true, pubsubStandard)
+	} else {
+		for j := 1; j < c.argc; j++ {
+			pubsubUnsubscribeChannel(c, c.argv[j].String(), true, pubsubStandard)
+		}
+	}
+	markClientAsPubSub(c)
+
+}
+
+func psubscribeCommand(c *client) {
+	for j := 1; j < c.argc; j++ {
+		pubsubSubscribePattern(c, c.argv[j].String())
+	}
+	markClientAsPubSub(c)
+}
+
+func punsubscribeCommand(c *client) {
+
+	if c.argc == 1 {
+		pubsubUnsubscribeAllPatterns(c, true)
+	} else {
+		for j := 1; j < c.argc; j++ {
+			pubsubUnsubscribePattern(c, c.argv[j].String(), true)
+		}
+	}
+	markClientAsPubSub(c)
+
+}
+
+func publishCommand(c *client) {
+	receivers := pubsubPublishMessage(c.argv[1].String(), c.argv[2].bytes(), pubsubStandard)
+	addReplyLongLong(c, int64(receivers))
+}
+
+func ssubscribeCommand(c *client) {
+	for j := 1; j < c.argc; j++ {
+		pubsubSubscribeChannel(c, c.argv[j].String(), pubsubShard)
+	}
+	markClientAsPubSub(c)
+}
+
+func sunsubscribeCommand(c *client) {
+
+	if c.argc == 1 {
+		pubsubUnsubscribeAllChannels(c, true, pubsubShard)
+	} else {
+		for j := 1; j < c.argc; j++ {
+			pubsubUnsubscribeChannel(c, c.argv[j].String(), true, pubsubShard)
+		}
+	}
+	markClientAsPubSub(c)
+
+}
+
+func spublishCommand(c *client) {
+	receivers := pubsubPublishMessage(c.argv[1].String(), c.argv[2].bytes(), pubsubShard)
+	addReplyLongLong(c, int64(receivers))
+}
+
+// channelList returns the channels of subs matching pattern, every channel
+// when pattern is empty.
+func channelList(channels []string, subs pubsubSubscribers, pattern string) []string {
+	for channel := range subs {
+		if pattern == "" || stringmatch(pattern, channel, false) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// pubsubCommand implements PUBSUB CHANNELS [pattern], NUMSUB [channel ...],
+// NUMPAT, SHARDCHANNELS [pattern] and SHARDNUMSUB [channel ...].
+func pubsubCommand(c *client) {
+
+	sub := strings.ToLower(c.argv[1].String())
+	switch {
+	case sub == "help" && c.argc == 2:
+		addReplyHelp(c, []string{
+			"CHANNELS [<pattern>]",
+			"    Return the currently active channels matching a <pattern> (default: '*').",
+			"NUMPAT",
+			"    Return number of subscriptions to patterns.",
+			"NUMSUB [<channel> ...]",
+			"    Return the number of subscribers for the specified channels, excluding",
+			"    pattern subscriptions(default: no channels).",
+			"SHARDCHANNELS [<pattern>]",
+			"    Return the currently active shard level channels matching a <pattern> (default: '*').",
+			"SHARDNUMSUB [<shardchannel> ...]",
+			"    Return the number of subscribers for the specified shard level channel(s)",
+		})
+	case sub == "channels" && (c.argc == 2 || c.argc == 3):
+		pattern := ""
+		if c.argc == 3 {
+			pattern = c.argv[2].String()
+		}
+		addReplyBulkStrings(c, channelList(nil, rServer.pubsubChannels, pattern))
+	case sub == "numsub" && c.argc >= 2:
+		addReplyMapLen(c, c.argc-2)
+		for j := 2; j < c.argc; j++ {
+			addReplyBulk(c, c.argv[j].bytes())
+			addReplyLongLong(c, int64(len(rServer.pubsubChannels[c.argv[j].String()])))
+		}
+	case sub == "numpat" && c.argc == 2:
+		addReplyLongLong(c, int64(len(rServer.pubsubPatterns)))
+	case sub == "shardchannels" && (c.argc == 2 || c.argc == 3):
+		pattern := ""
+		if c.argc == 3 {
+			pattern = c.argv[2].String()
+		}
+		var channels []string
+		for _, subs := range rServer.pubsubShardChannels {
+			channels = channelList(channels, subs, pattern)
+		}
+		addReplyBulkStrings(c, channels)
+	case sub == "shardnumsub" && c.argc >= 2:
+		addReplyMapLen(c, c.argc-2)
+		for j := 2; j < c.argc; j++ {
+			channel := c.argv[j].String()
+			addReplyBulk(c, c.argv[j].bytes())
+			addReplyLongLong(c, int64(len(rServer.pubsubShardChannels[keyHashSlot(channel)][channel])))
+		}
+	default:
+		addReplySubcommandSyntaxError(c)
+	}
+
+}
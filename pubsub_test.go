@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPubSub_Subscribe(t *testing.T) {
+	pub, sub := newTestConn(t), newTestConn(t)
+
+	sub.expect([]any{"subscribe", "ps:a", int64(1)}, "subscribe", "ps:a", "ps:b")
+	expectReply(sub, []any{"subscribe", "ps:b", int64(2)})
+	sub.expect([]any{"psubscribe", "ps:*", int64(3)}, "psubscribe", "ps:*")
+
+	pub.expect(int64(2), "publish", "ps:a", "hello")
+	expectReply(sub, []any{"message", "ps:a", "hello"})
+	expectReply(sub, []any{"pmessage", "ps:*", "ps:a", "hello"})
+	pub.expect(int64(1), "publish", "ps:c", "world")
+	expectReply(sub, []any{"pmessage", "ps:*", "ps:c", "world"})
+	pub.expect(int64(0), "publish", "other", "x")
+
+	pub.expect([]any{"ps:a", int64(1), "ps:c", int64(0)}, "pubsub", "numsub", "ps:a", "ps:c")
+	pub.expect([]any{"ps:b"}, "pubsub", "channels", "ps:[b]")
+
+	// only the subscription commands run in subscribed mode
+	sub.expect(testError("ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context"),
+		"get", "k")
+	sub.expect([]any{"pong", ""}, "ping")
+	sub.expect([]any{"pong", "hi"}, "ping", "hi")
+
+	sub.expect([]any{"unsubscribe", "ps:a", int64(2)}, "unsubscribe", "ps:a")
+	sub.expect([]any{"punsubscribe", "ps:*", int64(1)}, "punsubscribe")
+	sub.expect([]any{"unsubscribe", "ps:b", int64(0)}, "unsubscribe")
+	sub.expect([]any{"unsubscribe", nil, int64(0)}, "unsubscribe")
+	sub.expect(testStatus("PONG"), "ping")
+	pub.expect(int64(0), "publish", "ps:b", "x")
+
+	// closing the connection drops its subscriptions
+	sub.expect([]any{"subscribe", "ps:gone", int64(1)}, "subscribe", "ps:gone")
+	_ = sub.conn.Close()
+	for j := 0; j < 500 && pub.do("publish", "ps:gone", "x") != int64(0); j++ {
+		time.Sleep(time.Millisecond * 2)
+	}
+	pub.expect([]any{"ps:gone", int64(0)}, "pubsub", "numsub", "ps:gone")
+}
+
+func TestPubSub_Resp3(t *testing.T) {
+	tc := newTestConn(t)
+	tc.do("hello", "3")
+
+	tc.expect(testPush{"subscribe", "ps3:a", int64(1)}, "subscribe", "ps3:a")
+	// commands keep working, the messages come out of band
+	tc.expect(testPush{"message", "ps3:a", "m"}, "publish", "ps3:a", "m")
+	expectReply(tc, int64(1))
+	tc.expect(testStatus("PONG"), "ping")
+	tc.expect(testPush{"unsubscribe", "ps3:a", int64(0)}, "unsubscribe", "ps3:a")
+
+	tc.expectError("ERR unknown subcommand", "pubsub", "nope")
+}
+
+func TestPubSub_Shard(t *testing.T) {
+	pub, sub := newTestConn(t), newTestConn(t)
+
+	sub.expect([]any{"ssubscribe", "sh:{a}1", int64(1)}, "ssubscribe", "sh:{a}1", "sh:{a}2")
+	expectReply(sub, []any{"ssubscribe", "sh:{a}2", int64(2)})
+	// shard and classic subscriptions are counted apart
+	sub.expect([]any{"subscribe", "sh:{a}1", int64(1)}, "subscribe", "sh:{a}1")
+
+	pub.expect(int64(1), "spublish", "sh:{a}1", "m1")
+	expectReply(sub, []any{"smessage", "sh:{a}1", "m1"})
+	pub.expect(int64(1), "publish", "sh:{a}1", "m2")
+	expectReply(sub, []any{"message", "sh:{a}1", "m2"})
+	pub.expect(int64(0), "spublish", "sh:{b}1", "m3")
+
+	pub.expect([]any{"sh:{a}1", int64(1), "sh:{b}1", int64(0)}, "pubsub", "shardnumsub", "sh:{a}1", "sh:{b}1")
+	pub.expect([]any{"sh:{a}2"}, "pubsub", "shardchannels", "sh:*2")
+	pub.expect([]any{"sh:{a}1"}, "pubsub", "channels", "sh:*")
+	pub.expect([]any{"sh:{a}1"}, "command", "getkeys", "spublish", "sh:{a}1", "m")
+
+	sub.expect(testError("ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context"),
+		"get", "k")
+	sub.expect([]any{"sunsubscribe", "sh:{a}1", int64(1)}, "sunsubscribe", "sh:{a}1")
+	sub.expect([]any{"sunsubscribe", "sh:{a}2", int64(0)}, "sunsubscribe")
+	sub.expect([]any{"unsubscribe", "sh:{a}1", int64(0)}, "unsubscribe")
+	sub.expect(testStatus("PONG"), "ping")
+}
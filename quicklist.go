@@ -0,0 +1,758 @@
+package main
+
+import "strconv"
+
+// A quicklist is a doubly linked list of listpacks, so long lists keep the
+// memory efficiency of the listpack without paying for the reallocation of
+// a single huge buffer. The fill factor limits the nodes either by number of
+// elements (positive fill) or by size (negative fill, -1 for 4kb up to -5 for
+// 64kb). With a compress depth greater than zero, the nodes farther than
+// depth nodes from both ends are stored LZF compressed, lists being mostly
+// accessed at their ends.
+
+const (
+	quicklistNodeEncodingRaw = 1
+	quicklistNodeEncodingLZF = 2
+)
+
+// where to push and in which direction to iterate
+const (
+	quicklistHead = 0
+	quicklistTail = 1
+)
+
+const (
+	// size limit of the nodes with a positive fill
+	quicklistSizeSafetyLimit      = 8192
+	quicklistSizeEstimateOverhead = 8
+	// nodes smaller than this are not compressed
+	quicklistMinCompressBytes = 48
+	// the compression must save at least this many bytes to be kept
+	quicklistMinCompressImprove = 8
+	quicklistNodeOverhead       = 64
+)
+
+var quicklistOptimizationLevel = []int{4096, 8192, 16384, 32768, 65536}
+
+type quicklistNode struct {
+	prev, next *quicklistNode
+	entry      []byte // the listpack, or its LZF compression
+	sz         int    // size of the uncompressed listpack
+	count      int
+	encoding   uint8
+	recompress bool // decompressed for use, to be compressed again
+}
+
+type quicklist struct {
+	head, tail *quicklistNode
+	count      int // elements in all the nodes
+	len        int // number of nodes
+	fill       int
+	compress   int // nodes at each end left uncompressed, 0 to disable
+}
+
+// quicklistEntry is an element found by an iterator. value is nil when the
+// element is an integer, stored in longval.
+type quicklistEntry struct {
+	node    *quicklistNode
+	p       int // position in the node listpack
+	offset  int // index in the node, negative when iterating from the tail
+	value   []byte
+	longval int64
+}
+
+func quicklistCreate(fill, compress int) *quicklist {
+	return &quicklist{fill: fill, compress: compress}
+}
+
+func quicklistCreateNode() *quicklistNode {
+	return &quicklistNode{encoding: quicklistNodeEncodingRaw}
+}
+
+func (node *quicklistNode) updateSz() {
+	node.sz = len(node.entry)
+}
+
+// compressNode compresses a raw node, it returns false when the node is too
+// small or the compression does not save enough.
+func (node *quicklistNode) compressNode() bool {
+
+	if node.encoding != quicklistNodeEncodingRaw {
+		return false
+	}
+	node.recompress = false
+	if node.sz < quicklistMinCompressBytes {
+		return false
+	}
+
+	out := make([]byte, node.sz)
+	n := lzfCompress(node.entry, out)
+	if n == 0 || n+quicklistMinCompressImprove >= node.sz {
+		return false
+	}
+	node.entry = append([]byte(nil), out[:n]...)
+	node.encoding = quicklistNodeEncodingLZF
+	return true
+
+}
+
+func (node *quicklistNode) decompressNode() {
+
+	if node.encoding != quicklistNodeEncodingLZF {
+		return
+	}
+	out := make([]byte, node.sz)
+	if lzfDecompress(node.entry, out) != node.sz {
+		panic("quicklist: corrupted compressed node")
+	}
+	node.entry = out
+	node.encoding = quicklistNodeEncodingRaw
+
+}
+
+// decompressForUse decompresses the node and marks it to be compressed again
+// once the caller is done.
+func (node *quicklistNode) decompressForUse() {
+	if node.encoding == quicklistNodeEncodingLZF {
+		node.decompressNode()
+		node.recompress = true
+	}
+}
+
+func (node *quicklistNode) recompressOnly() {
+	if node.recompress {
+		node.compressNode()
+	}
+}
+
+// compressAround makes sure the nodes within the compress depth are raw and
+// compresses node, if any, when it is beyond it.
+func (ql *quicklist) compressAround(node *quicklistNode) {
+
+	if node != nil && node.recompress {
+		node.compressNode()
+		return
+	}
+	if ql.compress == 0 || ql.len < ql.compress*2 {
+		return
+	}
+
+	forward, reverse := ql.head, ql.tail
+	inDepth := false
+	for depth := 0; depth < ql.compress; depth++ {
+		forward.decompressNode()
+		reverse.decompressNode()
+		if forward == node || reverse == node {
+			inDepth = true
+		}
+		// the list is all within the depth
+		if forward == reverse || forward.next == reverse {
+			return
+		}
+		forward, reverse = forward.next, reverse.prev
+	}
+
+	if !inDepth && node != nil {
+		node.compressNode()
+	}
+	// the nodes just beyond the depth may have been pushed out of it
+	forward.compressNode()
+	reverse.compressNode()
+
+}
+
+// nodeLimits returns the size and count limits of a node, -1 meaning none.
+func (ql *quicklist) nodeLimits() (int, int) {
+	if ql.fill >= 0 {
+		return -1, max(ql.fill, 1)
+	}
+	idx := -ql.fill - 1
+	if idx >= len(quicklistOptimizationLevel) {
+		idx = len(quicklistOptimizationLevel) - 1
+	}
+	return quicklistOptimizationLevel[idx], -1
+}
+
+func (ql *quicklist) nodeExceedsLimit(sz, count int) bool {
+	sizeLimit, countLimit := ql.nodeLimits()
+	if sizeLimit != -1 {
+		return sz > sizeLimit
+	}
+	return sz > quicklistSizeSafetyLimit || count > countLimit
+}
+
+func (ql *quicklist) nodeAllowInsert(node *quicklistNode, value []byte) bool {
+	if node == nil {
+		return false
+	}
+	return !ql.nodeExceedsLimit(node.sz+len(value)+quicklistSizeEstimateOverhead, node.count+1)
+}
+
+func (ql *quicklist) nodeAllowMerge(a, b *quicklistNode) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	// one header and end byte go away
+	return !ql.nodeExceedsLimit(a.sz+b.sz-lpHeaderSize-1, a.count+b.count)
+}
+
+// insertNode links node before or after old, or as the only node when old
+// is nil.
+func (ql *quicklist) insertNode(old, node *quicklistNode, after bool) {
+
+	if after {
+		node.prev = old
+		if old != nil {
+			node.next = old.next
+			if old.next != nil {
+				old.next.prev = node
+			}
+			old.next = node
+		}
+		if ql.tail == old {
+			ql.tail = node
+		}
+	} else {
+		node.next = old
+		if old != nil {
+			node.prev = old.prev
+			if old.prev != nil {
+				old.prev.next = node
+			}
+			old.prev = node
+		}
+		if ql.head == old {
+			ql.head = node
+		}
+	}
+	// first node of the list
+	if ql.len == 0 {
+		ql.head, ql.tail = node, node
+	}
+
+	ql.len++
+	if old != nil {
+		ql.compressAround(old)
+	}
+	ql.compressAround(node)
+
+}
+
+func (ql *quicklist) delNode(node *quicklistNode) {
+
+	if node.next != nil {
+		node.next.prev = node.prev
+	}
+	if node.prev != nil {
+		node.prev.next = node.next
+	}
+	if node == ql.tail {
+		ql.tail = node.prev
+	}
+	if node == ql.head {
+		ql.head = node.next
+	}
+
+	ql.len--
+	ql.count -= node.count
+	ql.compressAround(nil)
+
+}
+
+// delIndex deletes the element at p of node, it returns whether the node was
+// deleted and otherwise the position of the next element.
+func (ql *quicklist) delIndex(node *quicklistNode, p int) (bool, int) {
+
+	var next int
+	node.entry, next = lpDelete(node.entry, p)
+	node.count--
+	ql.count--
+	if node.count == 0 {
+		ql.delNode(node)
+		return true, -1
+	}
+	node.updateSz()
+	return false, next
+
+}
+
+// push adds value at the head or the tail of the list.
+func (ql *quicklist) push(value []byte, where int) {
+
+	node := ql.head
+	if where == quicklistTail {
+		node = ql.tail
+	}
+
+	if ql.nodeAllowInsert(node, value) {
+		node.decompressForUse()
+		if where == quicklistHead {
+			node.entry = lpPrepend(node.entry, value)
+		} else {
+			node.entry = lpAppend(node.entry, value)
+		}
+		node.count++
+		node.updateSz()
+		node.recompressOnly()
+	} else {
+		newNode := quicklistCreateNode()
+		newNode.entry = lpAppend(lpNew(0), value)
+		newNode.count = 1
+		newNode.updateSz()
+		ql.insertNode(node, newNode, where == quicklistTail)
+	}
+	ql.count++
+
+}
+
+// pop removes and returns the element at the head or the tail of the list.
+func (ql *quicklist) pop(where int) ([]byte, bool) {
+
+	node := ql.head
+	if where == quicklistTail {
+		node = ql.tail
+	}
+	if node == nil {
+		return nil, false
+	}
+
+	node.decompressForUse()
+	p := lpFirst(node.entry)
+	if where == quicklistTail {
+		p = lpLast(node.entry)
+	}
+	value := lpGetBytes(node.entry, p)
+	if deleted, _ := ql.delIndex(node, p); !deleted {
+		node.recompressOnly()
+	}
+	return value, true
+
+}
+
+// splitNode moves the elements after offset, or before it, to a new node
+// that is returned, not linked yet.
+func (ql *quicklist) splitNode(node *quicklistNode, offset int, after bool) *quicklistNode {
+
+	if offset < 0 {
+		offset += node.count
+	}
+	newNode := quicklistCreateNode()
+	newNode.entry = append([]byte(nil), node.entry...)
+
+	if after {
+		node.entry = lpDeleteRange(node.entry, offset+1, node.count)
+		newNode.entry = lpDeleteRange(newNode.entry, 0, offset+1)
+	} else {
+		node.entry = lpDeleteRange(node.entry, 0, offset)
+		newNode.entry = lpDeleteRange(newNode.entry, offset, node.count)
+	}
+	node.count = lpLength(node.entry)
+	node.updateSz()
+	newNode.count = lpLength(newNode.entry)
+	newNode.updateSz()
+	return newNode
+
+}
+
+// mergeNodes merges b into a when the result fits in a node.
+func (ql *quicklist) mergeNodes(a, b *quicklistNode) bool {
+
+	if !ql.nodeAllowMerge(a, b) {
+		return false
+	}
+	a.decompressNode()
+	b.decompressNode()
+	a.entry = lpMerge(a.entry, b.entry)
+	a.count += b.count
+	a.updateSz()
+
+	// b elements are now in a
+	b.count = 0
+	ql.delNode(b)
+	ql.compressAround(a)
+	return true
+
+}
+
+// insert adds value before or after the element of entry, or as the only
+// element when the list is empty.
+func (ql *quicklist) insert(entry *quicklistEntry, value []byte, after bool) {
+
+	node := entry.node
+	if node == nil {
+		node = quicklistCreateNode()
+		node.entry = lpAppend(lpNew(0), value)
+		node.count = 1
+		node.updateSz()
+		ql.insertNode(nil, node, after)
+		ql.count++
+		return
+	}
+
+	full := !ql.nodeAllowInsert(node, value)
+	atTail := after && (entry.offset == node.count-1 || entry.offset == -1)
+	atHead := !after && (entry.offset == 0 || entry.offset == -node.count)
+
+	switch {
+	case !full:
+		node.decompressForUse()
+		where := lpInsertBefore
+		if after {
+			where = lpInsertAfter
+		}
+		node.entry, _ = lpInsert(node.entry, value, entry.p, where)
+		node.count++
+		node.updateSz()
+		node.recompressOnly()
+	case atTail && ql.nodeAllowInsert(node.next, value):
+		next := node.next
+		next.decompressForUse()
+		next.entry = lpPrepend(next.entry, value)
+		next.count++
+		next.updateSz()
+		next.recompressOnly()
+	case atHead && ql.nodeAllowInsert(node.prev, value):
+		prev := node.prev
+		prev.decompressForUse()
+		prev.entry = lpAppend(prev.entry, value)
+		prev.count++
+		prev.updateSz()
+		prev.recompressOnly()
+	case atTail || atHead:
+		// the neighbour is full too, start a node between them
+		newNode := quicklistCreateNode()
+		newNode.entry = lpAppend(lpNew(0), value)
+		newNode.count = 1
+		newNode.updateSz()
+		ql.insertNode(node, newNode, after)
+	default:
+		// full node, split it where the element goes
+		node.decompressForUse()
+		newNode := ql.splitNode(node, entry.offset, after)
+		if after {
+			newNode.entry = lpPrepend(newNode.entry, value)
+		} else {
+			newNode.entry = lpAppend(newNode.entry, value)
+		}
+		newNode.count++
+		newNode.updateSz()
+		ql.insertNode(node, newNode, after)
+		node.recompressOnly()
+		if after {
+			ql.mergeNodes(newNode, newNode.next)
+		} else {
+			ql.mergeNodes(newNode.prev, newNode)
+		}
+	}
+	ql.count++
+
+}
+
+// replaceEntry replaces the element of entry with value.
+func (ql *quicklist) replaceEntry(entry *quicklistEntry, value []byte) {
+
+	node := entry.node
+	node.decompressForUse()
+	node.entry, entry.p = lpReplace(node.entry, entry.p, value)
+	node.updateSz()
+
+	// a bigger element may need a node of its own
+	if node.count > 1 && ql.nodeExceedsLimit(node.sz, node.count) {
+		offset := entry.offset
+		if offset < 0 {
+			offset += node.count
+		}
+		// split before linking, that may compress node
+		var after, before *quicklistNode
+		if offset+1 < node.count {
+			after = ql.splitNode(node, offset, true)
+		}
+		if offset > 0 {
+			before = ql.splitNode(node, offset, false)
+		}
+		if after != nil {
+			ql.insertNode(node, after, true)
+		}
+		if before != nil {
+			ql.insertNode(node, before, false)
+		}
+	}
+	node.recompressOnly()
+
+}
+
+// replaceAtIndex replaces the element at index, it returns false if the
+// index is out of range.
+func (ql *quicklist) replaceAtIndex(index int, value []byte) bool {
+
+	it := ql.getIteratorAtIdx(quicklistHead, index)
+	if it == nil {
+		return false
+	}
+	defer it.release()
+	var entry quicklistEntry
+	if !it.next(&entry) {
+		return false
+	}
+	ql.replaceEntry(&entry, value)
+	return true
+
+}
+
+// delRange deletes count elements starting at index start, negative indexes
+// count from the tail. It returns the number of deleted elements.
+func (ql *quicklist) delRange(start, count int) int {
+
+	if count <= 0 {
+		return 0
+	}
+	extent := count
+	if start >= 0 && extent > ql.count-start {
+		extent = ql.count - start
+	} else if start < 0 && extent > -start {
+		extent = -start
+	}
+
+	it := ql.getIteratorAtIdx(quicklistHead, start)
+	if it == nil {
+		return 0
+	}
+	node, offset := it.current, it.offset
+	it.release()
+
+	deleted := 0
+	for extent > 0 && node != nil {
+		next := node.next
+
+		var delStart, delCount int
+		switch {
+		case offset == 0 && extent >= node.count:
+			delCount = node.count
+		case offset >= 0 && offset+extent >= node.count:
+			// up to the end of the node
+			delStart, delCount = offset, node.count-offset
+		case offset < 0:
+			// negative offsets delete up to the end of the node too
+			delStart, delCount = offset, min(-offset, extent)
+		default:
+			delStart, delCount = offset, extent
+		}
+
+		if delCount == node.count {
+			ql.delNode(node)
+		} else {
+			node.decompressForUse()
+			node.entry = lpDeleteRange(node.entry, delStart, delCount)
+			node.count -= delCount
+			node.updateSz()
+			ql.count -= delCount
+			node.recompressOnly()
+		}
+
+		extent -= delCount
+		deleted += delCount
+		node = next
+		offset = 0
+	}
+	return deleted
+
+}
+
+// quicklistIter walks the elements of a quicklist. Elements can be deleted
+// while iterating with delEntry, any other change invalidates the iterator.
+type quicklistIter struct {
+	ql        *quicklist
+	current   *quicklistNode
+	p         int // position in the current node, -1 to seek offset
+	offset    int
+	direction int
+}
+
+func (ql *quicklist) iterator(direction int) *quicklistIter {
+	it := &quicklistIter{ql: ql, p: -1, direction: direction}
+	if direction == quicklistHead {
+		it.current = ql.head
+	} else {
+		it.current = ql.tail
+		it.offset = -1
+	}
+	return it
+}
+
+// getIteratorAtIdx returns an iterator whose next element is the one at
+// index, or nil if the index is out of range.
+func (ql *quicklist) getIteratorAtIdx(direction int, idx int) *quicklistIter {
+
+	forward := idx >= 0
+	index := idx
+	if !forward {
+		index = -idx - 1
+	}
+	if index >= ql.count {
+		return nil
+	}
+
+	// seek from the nearest end
+	seekForward := forward
+	seekIndex := index
+	if index > (ql.count-1)/2 {
+		seekForward = !forward
+		seekIndex = ql.count - 1 - index
+	}
+
+	n := ql.head
+	if !seekForward {
+		n = ql.tail
+	}
+	accum := 0
+	for n != nil {
+		if accum+n.count > seekIndex {
+			break
+		}
+		accum += n.count
+		if seekForward {
+			n = n.next
+		} else {
+			n = n.prev
+		}
+	}
+	if n == nil {
+		return nil
+	}
+	// accum as if the seek happened in the requested direction
+	if seekForward != forward {
+		accum = ql.count - n.count - accum
+	}
+
+	it := ql.iterator(direction)
+	it.current = n
+	if forward {
+		it.offset = index - accum
+	} else {
+		it.offset = -index - 1 + accum
+	}
+	return it
+
+}
+
+// next fills entry with the next element, it returns false at the end of the
+// list.
+func (it *quicklistIter) next(entry *quicklistEntry) bool {
+
+	for it.current != nil {
+		node := it.current
+		if it.p == -1 {
+			node.decompressForUse()
+			it.p = lpSeek(node.entry, it.offset)
+		} else if it.direction == quicklistHead {
+			it.p = lpNext(node.entry, it.p)
+			it.offset++
+		} else {
+			it.p = lpPrev(node.entry, it.p)
+			it.offset--
+		}
+
+		if it.p != -1 {
+			*entry = quicklistEntry{node: node, p: it.p, offset: it.offset}
+			entry.value, entry.longval = lpGet(node.entry, it.p)
+			return true
+		}
+
+		// the node is over, move to the next one
+		it.ql.compressAround(node)
+		if it.direction == quicklistHead {
+			it.current = node.next
+			it.offset = 0
+		} else {
+			it.current = node.prev
+			it.offset = -1
+		}
+		it.p = -1
+	}
+	return false
+
+}
+
+// delEntry deletes the element returned by the last next call, the
+// following call returns the element after it.
+func (it *quicklistIter) delEntry(entry *quicklistEntry) {
+
+	prev, next := entry.node.prev, entry.node.next
+	deletedNode, _ := it.ql.delIndex(entry.node, entry.p)
+	it.p = -1
+	// otherwise the offset already points to the next element
+	if deletedNode {
+		if it.direction == quicklistHead {
+			it.current = next
+			it.offset = 0
+		} else {
+			it.current = prev
+			it.offset = -1
+		}
+	}
+
+}
+
+func (it *quicklistIter) release() {
+	if it.current != nil {
+		it.ql.compressAround(it.current)
+	}
+}
+
+// entryBytes returns the element of entry as a string.
+func (entry *quicklistEntry) entryBytes() []byte {
+	if entry.value != nil {
+		return append([]byte(nil), entry.value...)
+	}
+	return strconv.AppendInt(nil, entry.longval, 10)
+}
+
+// compare reports whether the element of entry equals s.
+func (entry *quicklistEntry) compare(s []byte) bool {
+	if entry.value != nil {
+		return string(entry.value) == string(s)
+	}
+	v, ok := string2ll(s)
+	return ok && v == entry.longval
+}
+
+// dup returns a copy of ql, the compressed nodes are copied compressed.
+func (ql *quicklist) dup() *quicklist {
+
+	copyql := quicklistCreate(ql.fill, ql.compress)
+	for node := ql.head; node != nil; node = node.next {
+		n := &quicklistNode{
+			entry:      append([]byte(nil), node.entry...),
+			sz:         node.sz,
+			count:      node.count,
+			encoding:   node.encoding,
+			recompress: node.recompress,
+			prev:       copyql.tail,
+		}
+		if copyql.tail == nil {
+			copyql.head = n
+		} else {
+			copyql.tail.next = n
+		}
+		copyql.tail = n
+	}
+	copyql.count, copyql.len = ql.count, ql.len
+	return copyql
+
+}
+
+// quicklistComputeSize estimates the memory of ql from a few sampled nodes.
+func quicklistComputeSize(ql *quicklist) int64 {
+
+	size := int64(quicklistNodeOverhead)
+	sampled, samples := int64(0), 0
+	for node := ql.head; node != nil && samples < objectComputeSizeSamples; node = node.next {
+		sampled += int64(cap(node.entry)) + quicklistNodeOverhead
+		samples++
+	}
+	if samples > 0 {
+		size += sampled * int64(ql.len) / int64(samples)
+	}
+	return size
+
+}
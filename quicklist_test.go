@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLzf_RoundTrip(t *testing.T) {
+	inputs := [][]byte{
+		[]byte("a"),
+		[]byte("abcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabc"),
+		bytes.Repeat([]byte{0}, 100000),
+		[]byte(strings.Repeat("hello world ", 1000)),
+	}
+	random := make([]byte, 10000)
+	rand.Read(random)
+	inputs = append(inputs, random)
+
+	for _, in := range inputs {
+		out := make([]byte, len(in)+len(in)/16+64)
+		n := lzfCompress(in, out)
+		if n == 0 {
+			t.Fatalf("compression of %d bytes failed", len(in))
+		}
+		dec := make([]byte, len(in))
+		if m := lzfDecompress(out[:n], dec); m != len(in) || !bytes.Equal(dec, in) {
+			t.Fatalf("round trip of %d bytes failed, decompressed %d", len(in), m)
+		}
+	}
+
+	// the output must fit
+	in := []byte(strings.Repeat("x", 1000))
+	if n := lzfCompress(in, make([]byte, 4)); n != 0 {
+		t.Fatalf("want no room, got %d", n)
+	}
+	if n := lzfCompress(random, make([]byte, len(random)-1)); n != 0 {
+		t.Fatalf("want random data not compressible, got %d", n)
+	}
+	// and so must the decompressed data
+	out := make([]byte, 100)
+	n := lzfCompress(in, out)
+	if m := lzfDecompress(out[:n], make([]byte, 999)); m != 0 {
+		t.Fatalf("want a too small output detected, got %d", m)
+	}
+}
+
+// quicklistElements returns the elements of ql walking it forward, checking
+// the counters on the way.
+func quicklistElements(t *testing.T, ql *quicklist) []string {
+	t.Helper()
+	var elements []string
+	it := ql.iterator(quicklistHead)
+	var entry quicklistEntry
+	for it.next(&entry) {
+		elements = append(elements, string(entry.entryBytes()))
+	}
+	it.release()
+
+	count, nodes := 0, 0
+	for node := ql.head; node != nil; node = node.next {
+		if node.count == 0 {
+			t.Fatalf("empty node in the list")
+		}
+		count += node.count
+		nodes++
+	}
+	if count != ql.count || nodes != ql.len || len(elements) != ql.count {
+		t.Fatalf("want %d elements in %d nodes, counted %d in %d, walked %d", ql.count, ql.len, count, nodes, len(elements))
+	}
+	return elements
+}
+
+func TestQuicklist_Model(t *testing.T) {
+	for _, config := range []struct{ fill, compress int }{{-2, 0}, {4, 1}, {-1, 2}, {1, 0}} {
+		ql := quicklistCreate(config.fill, config.compress)
+		var model []string
+		rnd := rand.New(rand.NewSource(int64(config.fill*10 + config.compress)))
+
+		value := func() string {
+			if rnd.Intn(3) == 0 {
+				return strconv.Itoa(rnd.Intn(100000))
+			}
+			return strings.Repeat(string(rune('a'+rnd.Intn(26))), 1+rnd.Intn(300))
+		}
+
+		for op := 0; op < 5000; op++ {
+			switch r := rnd.Intn(10); {
+			case r < 3:
+				v := value()
+				ql.push([]byte(v), quicklistHead)
+				model = append([]string{v}, model...)
+			case r < 6:
+				v := value()
+				ql.push([]byte(v), quicklistTail)
+				model = append(model, v)
+			case r == 6 && len(model) > 0:
+				v, _ := ql.pop(quicklistTail)
+				if string(v) != model[len(model)-1] {
+					t.Fatalf("pop: want %.10q, got %.10q", model[len(model)-1], v)
+				}
+				model = model[:len(model)-1]
+			case r == 7 && len(model) > 0:
+				idx := rnd.Intn(len(model))
+				v := value()
+				after := rnd.Intn(2) == 0
+				it := ql.getIteratorAtIdx(quicklistHead, idx)
+				var entry quicklistEntry
+				it.next(&entry)
+				ql.insert(&entry, []byte(v), after)
+				it.release()
+				if after {
+					idx++
+				}
+				model = append(model[:idx], append([]string{v}, model[idx:]...)...)
+			case r == 8 && len(model) > 0:
+				idx := rnd.Intn(len(model))
+				v := value()
+				ql.replaceAtIndex(idx, []byte(v))
+				model[idx] = v
+			case r == 9 && len(model) > 0:
+				start := rnd.Intn(len(model))
+				count := rnd.Intn(10)
+				deleted := ql.delRange(start, count)
+				want := min(count, len(model)-start)
+				if deleted != want {
+					t.Fatalf("delRange: want %d deleted, got %d", want, deleted)
+				}
+				model = append(model[:start], model[start+deleted:]...)
+			}
+		}
+
+		got := quicklistElements(t, ql)
+		if strings.Join(got, ",") != strings.Join(model, ",") {
+			t.Fatalf("fill %d compress %d: the list does not match the model", config.fill, config.compress)
+		}
+
+		// negative indexes walk from the tail
+		for j := 1; j <= len(model) && j < 50; j++ {
+			it := ql.getIteratorAtIdx(quicklistTail, -j)
+			var entry quicklistEntry
+			if !it.next(&entry) || string(entry.entryBytes()) != model[len(model)-j] {
+				t.Fatalf("index %d: want %.10q", -j, model[len(model)-j])
+			}
+			it.release()
+		}
+	}
+}
+
+func TestQuicklist_Compression(t *testing.T) {
+	ql := quicklistCreate(-1, 1)
+	for j := 0; j < 2000; j++ {
+		ql.push([]byte(strings.Repeat("v", 50)+strconv.Itoa(j)), quicklistTail)
+	}
+	if ql.len < 4 {
+		t.Fatalf("want several nodes, got %d", ql.len)
+	}
+
+	for node := ql.head; node != nil; node = node.next {
+		ends := node == ql.head || node == ql.tail
+		if ends != (node.encoding == quicklistNodeEncodingRaw) {
+			t.Fatalf("want only the end nodes raw")
+		}
+	}
+
+	// deleting while iterating goes through the compressed nodes
+	it := ql.iterator(quicklistHead)
+	var entry quicklistEntry
+	for j := 0; it.next(&entry); j++ {
+		if j%2 == 0 {
+			it.delEntry(&entry)
+		}
+	}
+	it.release()
+	elements := quicklistElements(t, ql)
+	if len(elements) != 1000 || elements[0] != strings.Repeat("v", 50)+"1" {
+		t.Fatalf("want the odd elements left, got %d", len(elements))
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import "sort"
+
+// A rax is a radix tree mapping byte strings to values, its keys are kept
+// in lexicographic order so it can be iterated and seeked like a sorted
+// map. Every node holds the part of the key, the edge, leading to it from
+// its parent, nodes with a single child that are not keys are merged with
+// it, so a chain of bytes shared by a few keys costs a single node.
+//
+// Streams keep their listpacks in a rax keyed by the big endian encoding of
+// the first ID of each listpack, and the consumer groups state in rax keyed
+// by names and IDs.
+
+// approximate memory used by a node, for the MEMORY USAGE of streams
+const raxNodeOverhead = 64
+
+type raxNode struct {
+	edge     string
+	isKey    bool
+	val      any
+	children []*raxNode // sorted by the first byte of their edge
+}
+
+type rax struct {
+	head        *raxNode
+	numElements int
+	numNodes    int
+}
+
+func newRax() *rax {
+	return &rax{head: &raxNode{}, numNodes: 1}
+}
+
+func (r *rax) size() int {
+	return r.numElements
+}
+
+func commonPrefixLen(a, b string) int {
+	n := min(len(a), len(b))
+	j := 0
+	for j < n && a[j] == b[j] {
+		j++
+	}
+	return j
+}
+
+// child returns the index of the child whose edge starts with b, or where
+// such a child would be inserted.
+func (n *raxNode) child(b byte) (int, bool) {
+	j := sort.Search(len(n.children), func(j int) bool {
+		return n.children[j].edge[0] >= b
+	})
+	return j, j < len(n.children) && n.children[j].edge[0] == b
+}
+
+// insert sets the value of key, it returns false when the key already
+// existed, leaving the old value in place unless overwrite is set.
+func (r *rax) insert(key string, val any, overwrite bool) bool {
+
+	n := r.head
+	for len(key) > 0 {
+		j, found := n.child(key[0])
+		if !found {
+			leaf := &raxNode{edge: key, isKey: true, val: val}
+			n.children = append(n.children, nil)
+			copy(n.children[j+1:], n.children[j:])
+			n.children[j] = leaf
+			r.numElements++
+			r.numNodes++
+			return true
+		}
+
+		c := n.children[j]
+		common := commonPrefixLen(c.edge, key)
+		if common < len(c.edge) {
+			// split the edge, the new node holds the common part
+			split := &raxNode{edge: c.edge[:common], children: []*raxNode{c}}
+			c.edge = c.edge[common:]
+			n.children[j] = split
+			r.numNodes++
+			c = split
+		}
+		n = c
+		key = key[common:]
+	}
+
+	if n.isKey {
+		if overwrite {
+			n.val = val
+		}
+		return false
+	}
+	n.isKey, n.val = true, val
+	r.numElements++
+	return true
+
+}
+
+func (r *rax) find(key string) (any, bool) {
+
+	n := r.head
+	for len(key) > 0 {
+		j, found := n.child(key[0])
+		if !found {
+			return nil, false
+		}
+		c := n.children[j]
+		if len(key) < len(c.edge) || key[:len(c.edge)] != c.edge {
+			return nil, false
+		}
+		n = c
+		key = key[len(c.edge):]
+	}
+	if !n.isKey {
+		return nil, false
+	}
+	return n.val, true
+
+}
+
+// remove deletes key, returning its value.
+func (r *rax) remove(key string) (any, bool) {
+
+	// the path from the head, to fix the tree once the key is gone
+	var parents []*raxNode
+	n := r.head
+	for len(key) > 0 {
+		j, found := n.child(key[0])
+		if !found {
+			return nil, false
+		}
+		c := n.children[j]
+		if len(key) < len(c.edge) || key[:len(c.edge)] != c.edge {
+			return nil, false
+		}
+		parents = append(parents, n)
+		n = c
+		key = key[len(c.edge):]
+	}
+	if !n.isKey {
+		return nil, false
+	}
+
+	val := n.val
+	n.isKey, n.val = false, nil
+	r.numElements--
+
+	if len(parents) == 0 {
+		return val, true
+	}
+	parent := parents[len(parents)-1]
+	switch len(n.children) {
+	case 0:
+		j, _ := parent.child(n.edge[0])
+		parent.children = append(parent.children[:j], parent.children[j+1:]...)
+		r.numNodes--
+		// the parent may be left with a single child to merge with
+		if len(parents) > 1 {
+			r.compress(parents[len(parents)-2], parent)
+		}
+	case 1:
+		r.compress(parent, n)
+	}
+	return val, true
+
+}
+
+// compress merges n, child of parent, with its only child when it is not a
+// key itself.
+func (r *rax) compress(parent, n *raxNode) {
+
+	if n.isKey || len(n.children) != 1 {
+		return
+	}
+	c := n.children[0]
+	c.edge = n.edge + c.edge
+	j, _ := parent.child(n.edge[0])
+	parent.children[j] = c
+	r.numNodes--
+
+}
+
+// first returns the smallest key of the subtree of n, whose keys all start
+// with path.
+func (n *raxNode) first(path string) (string, any) {
+	for !n.isKey {
+		n = n.children[0]
+		path += n.edge
+	}
+	return path, n.val
+}
+
+func (n *raxNode) last(path string) (string, any) {
+	for len(n.children) > 0 {
+		n = n.children[len(n.children)-1]
+		path += n.edge
+	}
+	return path, n.val
+}
+
+// seekGreater returns the smallest key of the subtree of n, reached by path,
+// that is >= key, or > key when strict.
+func (n *raxNode) seekGreater(path, key string, strict bool) (string, any, bool) {
+
+	l := min(len(path), len(key))
+	switch {
+	case path[:l] > key[:l]:
+		if !n.isKey && len(n.children) == 0 {
+			return "", nil, false
+		}
+		k, v := n.first(path)
+		return k, v, true
+	case path[:l] < key[:l]:
+		return "", nil, false
+	case len(path) > len(key) || (len(path) == len(key) && !strict):
+		// every key of the subtree starts with key
+		if !n.isKey && len(n.children) == 0 {
+			return "", nil, false
+		}
+		k, v := n.first(path)
+		return k, v, true
+	}
+
+	// path is key itself, skipped being strict, or a prefix of it: the key
+	// of n is smaller and only the children may be greater.
+	for _, c := range n.children {
+		if k, v, ok := c.seekGreater(path+c.edge, key, strict); ok {
+			return k, v, true
+		}
+	}
+	return "", nil, false
+
+}
+
+// seekLess returns the greatest key of the subtree of n, reached by path,
+// that is <= key, or < key when strict.
+func (n *raxNode) seekLess(path, key string, strict bool) (string, any, bool) {
+
+	l := min(len(path), len(key))
+	switch {
+	case path[:l] < key[:l]:
+		if !n.isKey && len(n.children) == 0 {
+			return "", nil, false
+		}
+		k, v := n.last(path)
+		return k, v, true
+	case path[:l] > key[:l], len(path) > len(key):
+		return "", nil, false
+	case len(path) == len(key):
+		// the children are all greater
+		if n.isKey && !strict {
+			return path, n.val, true
+		}
+		return "", nil, false
+	}
+
+	for j := len(n.children) - 1; j >= 0; j-- {
+		c := n.children[j]
+		if k, v, ok := c.seekLess(path+c.edge, key, strict); ok {
+			return k, v, true
+		}
+	}
+	if n.isKey {
+		return path, n.val, true
+	}
+	return "", nil, false
+
+}
+
+// raxIterator walks the keys in order from the element it was seeked to.
+// Every step looks the next key up from the current one, so the tree may be
+// modified while iterating.
+type raxIterator struct {
+	rt     *rax
+	key    string
+	data   any
+	seeked bool // next or prev returns the seeked element first
+	eof    bool
+}
+
+func (r *rax) iterator() *raxIterator {
+	return &raxIterator{rt: r, eof: true}
+}
+
+// seek positions the iterator, op being one of "^" (first key), "$" (last
+// key), "=", ">=", ">", "<=" and "<" compared to ele. The element found is
+// returned by the next call to next or prev. It returns false when nothing
+// matches.
+func (it *raxIterator) seek(op string, ele string) bool {
+
+	head := it.rt.head
+	var k string
+	var v any
+	ok := false
+	switch op {
+	case "^":
+		k, v, ok = head.seekGreater("", "", false)
+	case "$":
+		if head.isKey || len(head.children) > 0 {
+			k, v = head.last("")
+			ok = true
+		}
+	case "=":
+		v, ok = it.rt.find(ele)
+		k = ele
+	case ">=":
+		k, v, ok = head.seekGreater("", ele, false)
+	case ">":
+		k, v, ok = head.seekGreater("", ele, true)
+	case "<=":
+		k, v, ok = head.seekLess("", ele, false)
+	case "<":
+		k, v, ok = head.seekLess("", ele, true)
+	default:
+		panic("rax: invalid seek operator " + op)
+	}
+
+	it.key, it.data = k, v
+	it.eof = !ok
+	it.seeked = ok
+	return ok
+
+}
+
+// next moves to the following key, returning false at the end.
+func (it *raxIterator) next() bool {
+
+	if it.eof {
+		return false
+	}
+	if it.seeked {
+		it.seeked = false
+		return true
+	}
+	k, v, ok := it.rt.head.seekGreater("", it.key, true)
+	if !ok {
+		it.eof = true
+		return false
+	}
+	it.key, it.data = k, v
+	return true
+
+}
+
+// prev moves to the preceding key, returning false at the start.
+func (it *raxIterator) prev() bool {
+
+	if it.eof {
+		return false
+	}
+	if it.seeked {
+		it.seeked = false
+		return true
+	}
+	k, v, ok := it.rt.head.seekLess("", it.key, true)
+	if !ok {
+		it.eof = true
+		return false
+	}
+	it.key, it.data = k, v
+	return true
+
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestRax_Model(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	r := newRax()
+	model := make(map[string]int)
+
+	// short keys over a small alphabet share many prefixes
+	randomKey := func() string {
+		b := make([]byte, rnd.Intn(6))
+		for j := range b {
+			b[j] = "abc"[rnd.Intn(3)]
+		}
+		return string(b)
+	}
+
+	for op := 0; op < 20000; op++ {
+		key := randomKey()
+		if rnd.Intn(3) == 0 {
+			_, want := model[key]
+			if _, got := r.remove(key); got != want {
+				t.Fatalf("remove %q: want %v, got %v", key, want, got)
+			}
+			delete(model, key)
+			continue
+		}
+		_, exists := model[key]
+		if r.insert(key, op, true) == exists {
+			t.Fatalf("insert %q: existed %v", key, exists)
+		}
+		model[key] = op
+	}
+
+	if r.size() != len(model) {
+		t.Fatalf("want %d keys, got %d", len(model), r.size())
+	}
+	keys := make([]string, 0, len(model))
+	for key, val := range model {
+		keys = append(keys, key)
+		if got, ok := r.find(key); !ok || got != val {
+			t.Fatalf("find %q: want %d, got %v", key, val, got)
+		}
+	}
+	sort.Strings(keys)
+
+	it := r.iterator()
+	it.seek("^", "")
+	for j := 0; it.next(); j++ {
+		if j >= len(keys) || it.key != keys[j] {
+			t.Fatalf("next %d: got %q", j, it.key)
+		}
+	}
+	it.seek("$", "")
+	for j := len(keys) - 1; it.prev(); j-- {
+		if j < 0 || it.key != keys[j] {
+			t.Fatalf("prev %d: got %q", j, it.key)
+		}
+	}
+
+	for j := 0; j < 200; j++ {
+		ele := randomKey()
+		ge := sort.SearchStrings(keys, ele)
+		gt := sort.Search(len(keys), func(i int) bool { return keys[i] > ele })
+		checks := []struct {
+			op   string
+			want int
+		}{{">=", ge}, {">", gt}, {"<=", gt - 1}, {"<", ge - 1}}
+		for _, check := range checks {
+			found := it.seek(check.op, ele) && it.next()
+			if check.want < 0 || check.want >= len(keys) {
+				if found {
+					t.Fatalf("seek %s %q: got %q", check.op, ele, it.key)
+				}
+				continue
+			}
+			if !found || it.key != keys[check.want] {
+				t.Fatalf("seek %s %q: want %q, got %q", check.op, ele, keys[check.want], it.key)
+			}
+		}
+	}
+
+	// removing every key while iterating
+	it.seek("^", "")
+	for it.next() {
+		r.remove(it.key)
+	}
+	if r.size() != 0 || r.numNodes != 1 {
+		t.Fatalf("want an empty tree, got %d keys and %d nodes", r.size(), r.numNodes)
+	}
+	if !r.insert("k", 1, false) || r.size() != 1 {
+		t.Fatalf("insert after emptying failed")
+	}
+}
@@ -0,0 +1,1814 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// RDB persistence: the dataset is saved to a binary snapshot in the format
+// of redis 7.2, RDB version 11, so the files can be exchanged with redis:
+//
+//	"REDIS0011" <aux fields> (<SELECTDB> <RESIZEDB> <key value pairs>)* <EOF> <crc64>
+//
+// SAVE writes the file from the event loop. There is no fork to give BGSAVE
+// a point in time view for free, so the event loop only lists the keys and
+// marks their values as shared, and a goroutine serializes them while the
+// server keeps serving. Like the pages of a fork, a shared value is copied
+// the first time the event loop looks it up, so the goroutine keeps reading
+// the original untouched, see dbUnshareValue. serverCron reaps the goroutine
+// once it is done, and starts a BGSAVE when one of the save points, N changes
+// in M seconds, is reached.
+//
+// The file is written to a temp file renamed once synced, a crash never
+// leaves a partial snapshot behind. It is loaded at startup, before the
+// listener accepts clients.
+
+const rdbVersion = 11
+
+// object types
+const (
+	rdbTypeString           = 0
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeZset             = 3
+	rdbTypeHash             = 4
+	rdbTypeZset2            = 5 // zset with binary scores
+	rdbTypeSetIntset        = 11
+	rdbTypeHashListpack     = 16
+	rdbTypeZsetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks  = 15
+	rdbTypeStreamListpacks2 = 19 // with first ID, max deleted ID, entries added and entries read
+	rdbTypeSetListpack      = 20
+	rdbTypeStreamListpacks3 = 21 // with the active time of the consumers
+)
+
+// special opcodes
+const (
+	rdbOpcodeFunction2    = 245
+	rdbOpcodeFunction     = 246
+	rdbOpcodeModuleAux    = 247
+	rdbOpcodeIdle         = 248 // LRU idle time
+	rdbOpcodeFreq         = 249 // LFU counter
+	rdbOpcodeAux          = 250
+	rdbOpcodeResizeDb     = 251
+	rdbOpcodeExpireTimeMs = 252
+	rdbOpcodeExpireTime   = 253
+	rdbOpcodeSelectDb     = 254
+	rdbOpcodeEOF          = 255
+)
+
+// the two most significant bits of a length tell how it is encoded, 11
+// being a string stored in a special encoding told by the six others.
+const (
+	rdb6BitLen  = 0
+	rdb14BitLen = 1
+	rdb32BitLen = 0x80
+	rdb64BitLen = 0x81
+	rdbEncVal   = 3
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// quicklist node containers
+const (
+	rdbQuicklistNodeContainerPlain  = 1
+	rdbQuicklistNodeContainerPacked = 2
+)
+
+// after a failed BGSAVE, the save points try again after this delay
+const rdbBgsaveRetryDelay = 5 * time.Second
+
+// where a BGSAVE writes the rdb
+const (
+	rdbChildTypeDisk   = iota + 1 // to the rdb file
+	rdbChildTypeSocket            // to the sockets of replicas, diskless
+)
+
+// the EOF mark ending an rdb sent to replicas, its length is not known
+// before it is all written
+const rdbEOFMarkSize = configRunIdSize
+
+var (
+	errRdbAborted  = errors.New("background save aborted")
+	errRdbEmptyKey = errors.New("empty key")
+)
+
+// saveParam is a save point, a BGSAVE starts once there are changes in
+// seconds.
+type saveParam struct {
+	seconds time.Duration
+	changes int64
+}
+
+// rdbChild is the BGSAVE in progress.
+type rdbChild struct {
+	kind    int
+	start   time.Time
+	dirty   int64 // server.dirty when the dataset was snapshotted
+	abort   atomic.Bool
+	done    chan error
+	tmpfile string             // the file of a BGSAVE to disk
+	targets []*rdbSocketTarget // the replicas of a diskless BGSAVE
+}
+
+// rdbSocketTarget is a replica a diskless BGSAVE writes to, err is set by
+// the goroutine once its socket failed.
+type rdbSocketTarget struct {
+	slave *client
+	conn  *net.TCPConn
+	err   error
+}
+
+// rdbSocketsWriter writes to the sockets of all the replicas, the ones that
+// fail are left behind. It fails once all of them did.
+type rdbSocketsWriter struct {
+	targets []*rdbSocketTarget
+	timeout time.Duration
+	abort   *atomic.Bool
+}
+
+// setConnNonblock switches the mode of the socket of conn. The fd handed to
+// the event loop leaves it blocking, and a write blocked in the kernel does
+// not see the deadlines.
+func setConnNonblock(conn *net.TCPConn, nonblocking bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	_ = raw.Control(func(fd uintptr) {
+		_ = unix.SetNonblock(int(fd), nonblocking)
+	})
+}
+
+func (sw *rdbSocketsWriter) Write(p []byte) (int, error) {
+
+	// killRDBChild cut the deadlines short, they are not to be pushed back
+	if sw.abort.Load() {
+		return 0, errRdbAborted
+	}
+	alive := 0
+	for _, t := range sw.targets {
+		if t.err != nil {
+			continue
+		}
+		_ = t.conn.SetWriteDeadline(time.Now().Add(sw.timeout))
+		if _, t.err = t.conn.Write(p); t.err == nil {
+			alive++
+		}
+	}
+	if alive == 0 {
+		return 0, errors.New("all the replicas failed")
+	}
+	return len(p), nil
+
+}
+
+// rdbKeyValue is a key of the snapshot, lruIdle and lfuFreq are -1 when not
+// saved.
+type rdbKeyValue struct {
+	key     string
+	val     *rObj
+	expire  int64
+	lruIdle int64
+	lfuFreq int
+}
+
+type rdbDbSnapshot struct {
+	id      int
+	expires int
+	keys    []rdbKeyValue
+}
+
+// rdbSnapshot is the dataset to save, along with the configuration the
+// goroutine of a BGSAVE can't read from the server.
+type rdbSnapshot struct {
+	dbs      []rdbDbSnapshot
+	usedMem  int64
+	compress bool
+	checksum bool
+	aofBase  bool // the preamble of an AOF
+}
+
+func rdbPath() string {
+	return filepath.Join(rServer.dir, rServer.rdbFilename)
+}
+
+// rdbDupObject returns a copy of o the event loop can modify while a
+// goroutine still reads o. Embedded and int encoded strings are immutable,
+// their data is shared.
+func rdbDupObject(o *rObj) *rObj {
+
+	switch o.objectType {
+	case objectTypeString:
+		if o.encoding == objectEncodingRaw {
+			return dupStringObject(o)
+		}
+		return &rObj{objectType: o.objectType, encoding: o.encoding, data: o.data}
+	case objectTypeList:
+		return listTypeDup(o)
+	case objectTypeSet:
+		return setTypeDup(o)
+	case objectTypeZSet:
+		return zsetDup(o)
+	case objectTypeHash:
+		return hashTypeDup(o)
+	case objectTypeStream:
+		return streamDup(o)
+	}
+	panic("rdbDupObject: unknown object type")
+
+}
+
+// rdbSnapshotDataset lists the keys to save. With cow their values are marked
+// with a new snapshot epoch, so the snapshot can be saved by a goroutine while
+// the dataset changes, the time it takes is what the loop pays for a fork.
+func rdbSnapshotDataset(cow bool) *rdbSnapshot {
+
+	start := time.Now()
+	if cow {
+		rServer.snapshotEpoch++
+		if rServer.snapshotEpoch == 0 {
+			rServer.snapshotEpoch = 1
+		}
+	}
+	snap := &rdbSnapshot{
+		usedMem:  usedMemory(),
+		compress: rServer.rdbCompression,
+		checksum: rServer.rdbChecksum,
+	}
+	for _, db := range rServer.db {
+		if db.dict.size() == 0 {
+			continue
+		}
+		dbsnap := rdbDbSnapshot{id: db.id, expires: db.expires.size(), keys: make([]rdbKeyValue, 0, db.dict.size())}
+		db.dict.forEach(func(de *dictEntry) bool {
+			o := de.val.(*rObj)
+			kv := rdbKeyValue{key: de.key, val: o, expire: getExpire(db, de.key), lruIdle: -1, lfuFreq: -1}
+			// the clock is saved when the eviction policy makes use of it
+			if rServer.maxmemoryPolicy&maxmemoryFlagLRU != 0 {
+				kv.lruIdle = int64(estimateObjectIdleTime(o) / 1000)
+			} else if rServer.maxmemoryPolicy&maxmemoryFlagLFU != 0 {
+				kv.lfuFreq = int(lfuDecrAndReturn(o))
+			}
+			if cow {
+				o.snapshot = rServer.snapshotEpoch
+			}
+			dbsnap.keys = append(dbsnap.keys, kv)
+			return true
+		})
+		snap.dbs = append(snap.dbs, dbsnap)
+	}
+	if cow {
+		rServer.statSnapshotTime = time.Since(start)
+	}
+	return snap
+
+}
+
+// rdbWriter serializes the snapshot computing its checksum, the first error
+// is kept and makes every following write a no-op.
+type rdbWriter struct {
+	w        *bufio.Writer
+	crc      uint64
+	err      error
+	compress bool
+}
+
+func (rw *rdbWriter) write(p []byte) {
+	if rw.err != nil {
+		return
+	}
+	rw.crc = crc64Update(rw.crc, p)
+	_, rw.err = rw.w.Write(p)
+}
+
+func (rw *rdbWriter) saveType(t byte) {
+	rw.write([]byte{t})
+}
+
+func (rw *rdbWriter) saveLen(l uint64) {
+
+	var buf [9]byte
+	switch {
+	case l < 1<<6:
+		buf[0] = byte(l) | rdb6BitLen<<6
+		rw.write(buf[:1])
+	case l < 1<<14:
+		buf[0] = byte(l>>8) | rdb14BitLen<<6
+		buf[1] = byte(l)
+		rw.write(buf[:2])
+	case l <= math.MaxUint32:
+		buf[0] = rdb32BitLen
+		binary.BigEndian.PutUint32(buf[1:], uint32(l))
+		rw.write(buf[:5])
+	default:
+		buf[0] = rdb64BitLen
+		binary.BigEndian.PutUint64(buf[1:], l)
+		rw.write(buf[:9])
+	}
+
+}
+
+// saveEncodedInteger writes v with the integer string encodings, it returns
+// false when v does not fit in 32 bits.
+func (rw *rdbWriter) saveEncodedInteger(v int64) bool {
+
+	switch {
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		rw.write([]byte{rdbEncVal<<6 | rdbEncInt8, byte(v)})
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		rw.write([]byte{rdbEncVal<<6 | rdbEncInt16, byte(v), byte(v >> 8)})
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		rw.write([]byte{rdbEncVal<<6 | rdbEncInt32, byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)})
+	default:
+		return false
+	}
+	return true
+
+}
+
+// saveLzfBlob writes a string already LZF compressed.
+func (rw *rdbWriter) saveLzfBlob(c []byte, origLen int) {
+	rw.saveType(rdbEncVal<<6 | rdbEncLZF)
+	rw.saveLen(uint64(len(c)))
+	rw.saveLen(uint64(origLen))
+	rw.write(c)
+}
+
+// saveLzfString writes s compressed, it returns false when the compression
+// does not save at least 4 bytes.
+func (rw *rdbWriter) saveLzfString(s []byte) bool {
+
+	if len(s) <= 4 {
+		return false
+	}
+	out := make([]byte, len(s)-4)
+	n := lzfCompress(s, out)
+	if n == 0 {
+		return false
+	}
+	rw.saveLzfBlob(out[:n], len(s))
+	return true
+
+}
+
+// saveRawString writes s, as an integer or compressed when it takes less
+// space.
+func (rw *rdbWriter) saveRawString(s []byte) {
+
+	if len(s) <= 11 {
+		if v, ok := string2ll(s); ok && rw.saveEncodedInteger(v) {
+			return
+		}
+	}
+	if rw.compress && len(s) > 20 && rw.saveLzfString(s) {
+		return
+	}
+	rw.saveLen(uint64(len(s)))
+	rw.write(s)
+
+}
+
+func (rw *rdbWriter) saveLongLongAsString(v int64) {
+	if !rw.saveEncodedInteger(v) {
+		buf := strconv.AppendInt(nil, v, 10)
+		rw.saveLen(uint64(len(buf)))
+		rw.write(buf)
+	}
+}
+
+func (rw *rdbWriter) saveStringObject(o *rObj) {
+	if o.encoding == objectEncodingInt {
+		rw.saveLongLongAsString(o.data.(int64))
+		return
+	}
+	rw.saveRawString(o.bytes())
+}
+
+func (rw *rdbWriter) saveMillisecondTime(ms int64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(ms))
+	rw.write(buf[:])
+}
+
+func (rw *rdbWriter) saveBinaryDouble(f float64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+	rw.write(buf[:])
+}
+
+func (rw *rdbWriter) saveAuxField(key, val string) {
+	rw.saveType(rdbOpcodeAux)
+	rw.saveRawString([]byte(key))
+	rw.saveRawString([]byte(val))
+}
+
+func rdbObjectType(o *rObj) byte {
+
+	switch o.objectType {
+	case objectTypeString:
+		return rdbTypeString
+	case objectTypeList:
+		return rdbTypeListQuicklist2
+	case objectTypeSet:
+		if o.encoding == objectEncodingIntset {
+			return rdbTypeSetIntset
+		}
+		return rdbTypeSet
+	case objectTypeZSet:
+		if o.encoding == objectEncodingListpack {
+			return rdbTypeZsetListpack
+		}
+		return rdbTypeZset2
+	case objectTypeHash:
+		if o.encoding == objectEncodingListpack {
+			return rdbTypeHashListpack
+		}
+		return rdbTypeHash
+	case objectTypeStream:
+		return rdbTypeStreamListpacks3
+	}
+	panic("rdbObjectType: unknown object type")
+
+}
+
+// saveObject writes the value of o, the compact encodings are written as
+// they are in memory.
+func (rw *rdbWriter) saveObject(o *rObj) {
+
+	switch o.objectType {
+	case objectTypeString:
+		rw.saveStringObject(o)
+	case objectTypeList:
+		ql := o.data.(*quicklist)
+		rw.saveLen(uint64(ql.len))
+		for node := ql.head; node != nil; node = node.next {
+			rw.saveLen(rdbQuicklistNodeContainerPacked)
+			if node.encoding == quicklistNodeEncodingLZF {
+				rw.saveLzfBlob(node.entry, node.sz)
+			} else {
+				rw.saveRawString(node.entry)
+			}
+		}
+	case objectTypeSet:
+		if o.encoding == objectEncodingIntset {
+			rw.saveRawString(o.data.([]byte))
+			return
+		}
+		d := o.data.(*dict)
+		rw.saveLen(uint64(d.size()))
+		d.forEachUnsafe(func(de *dictEntry) bool {
+			rw.saveRawString([]byte(de.key))
+			return rw.err == nil
+		})
+	case objectTypeZSet:
+		if o.encoding == objectEncodingListpack {
+			rw.saveRawString(o.data.([]byte))
+			return
+		}
+		// from the tail, so loading inserts every member at the head
+		zsl := o.data.(*zset).zsl
+		rw.saveLen(uint64(zsl.length))
+		for x := zsl.tail; x != nil && rw.err == nil; x = x.backward {
+			rw.saveRawString([]byte(x.ele))
+			rw.saveBinaryDouble(x.score)
+		}
+	case objectTypeHash:
+		if o.encoding == objectEncodingListpack {
+			rw.saveRawString(o.data.([]byte))
+			return
+		}
+		d := o.data.(*dict)
+		rw.saveLen(uint64(d.size()))
+		d.forEachUnsafe(func(de *dictEntry) bool {
+			rw.saveRawString([]byte(de.key))
+			rw.saveRawString(de.val.([]byte))
+			return rw.err == nil
+		})
+	case objectTypeStream:
+		rw.saveStream(o.data.(*stream))
+	}
+
+}
+
+func (rw *rdbWriter) saveStream(s *stream) {
+
+	rw.saveLen(uint64(s.rax.size()))
+	it := s.rax.iterator()
+	it.seek("^", "")
+	for it.next() && rw.err == nil {
+		rw.saveRawString([]byte(it.key))
+		rw.saveRawString(it.data.([]byte))
+	}
+
+	rw.saveLen(uint64(s.length))
+	rw.saveLen(s.lastId.ms)
+	rw.saveLen(s.lastId.seq)
+	rw.saveLen(s.firstId.ms)
+	rw.saveLen(s.firstId.seq)
+	rw.saveLen(s.maxDeletedEntryId.ms)
+	rw.saveLen(s.maxDeletedEntryId.seq)
+	rw.saveLen(uint64(s.entriesAdded))
+
+	if s.cgroups == nil {
+		rw.saveLen(0)
+		return
+	}
+	rw.saveLen(uint64(s.cgroups.size()))
+	gi := s.cgroups.iterator()
+	gi.seek("^", "")
+	for gi.next() {
+		cg := gi.data.(*streamCG)
+		rw.saveRawString([]byte(gi.key))
+		rw.saveLen(cg.lastId.ms)
+		rw.saveLen(cg.lastId.seq)
+		rw.saveLen(uint64(cg.entriesRead))
+
+		// the group PEL holds the NACKs, the consumer PELs only their IDs
+		rw.saveLen(uint64(cg.pel.size()))
+		pi := cg.pel.iterator()
+		pi.seek("^", "")
+		for pi.next() {
+			nack := pi.data.(*streamNACK)
+			rw.write([]byte(pi.key))
+			rw.saveMillisecondTime(nack.deliveryTime)
+			rw.saveLen(uint64(nack.deliveryCount))
+		}
+
+		rw.saveLen(uint64(cg.consumers.size()))
+		ci := cg.consumers.iterator()
+		ci.seek("^", "")
+		for ci.next() {
+			consumer := ci.data.(*streamConsumer)
+			rw.saveRawString([]byte(consumer.name))
+			rw.saveMillisecondTime(consumer.seenTime)
+			rw.saveMillisecondTime(consumer.activeTime)
+			rw.saveLen(uint64(consumer.pel.size()))
+			pi = consumer.pel.iterator()
+			pi.seek("^", "")
+			for pi.next() {
+				rw.write([]byte(pi.key))
+			}
+		}
+	}
+
+}
+
+func (rw *rdbWriter) saveKeyValuePair(kv *rdbKeyValue) {
+
+	if kv.expire != -1 {
+		rw.saveType(rdbOpcodeExpireTimeMs)
+		rw.saveMillisecondTime(kv.expire)
+	}
+	if kv.lruIdle != -1 {
+		rw.saveType(rdbOpcodeIdle)
+		rw.saveLen(uint64(kv.lruIdle))
+	}
+	if kv.lfuFreq != -1 {
+		rw.saveType(rdbOpcodeFreq)
+		rw.saveType(byte(kv.lfuFreq))
+	}
+	rw.saveType(rdbObjectType(kv.val))
+	rw.saveRawString([]byte(kv.key))
+	rw.saveObject(kv.val)
+
+}
+
+// rdbSaveRio writes the whole snapshot, abort is checked every few keys
+// when not nil.
+func rdbSaveRio(rw *rdbWriter, snap *rdbSnapshot, abort *atomic.Bool) error {
+
+	rw.write([]byte(fmt.Sprintf("REDIS%04d", rdbVersion)))
+	rw.saveAuxField("redis-ver", redisCompatVersion)
+	rw.saveAuxField("redis-bits", "64")
+	rw.saveAuxField("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	rw.saveAuxField("used-mem", strconv.FormatInt(snap.usedMem, 10))
+	rw.saveAuxField("aof-base", strconv.Itoa(boolToInt(snap.aofBase)))
+
+	for _, db := range snap.dbs {
+		rw.saveType(rdbOpcodeSelectDb)
+		rw.saveLen(uint64(db.id))
+		rw.saveType(rdbOpcodeResizeDb)
+		rw.saveLen(uint64(len(db.keys)))
+		rw.saveLen(uint64(db.expires))
+		for j := range db.keys {
+			rw.saveKeyValuePair(&db.keys[j])
+			if j&1023 == 0 && abort != nil && abort.Load() && rw.err == nil {
+				rw.err = errRdbAborted
+			}
+		}
+	}
+	rw.saveType(rdbOpcodeEOF)
+
+	// the checksum of everything before it, 0 disables the check on load
+	var checksum uint64
+	if snap.checksum {
+		checksum = rw.crc
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], checksum)
+	rw.write(buf[:])
+	return rw.err
+
+}
+
+// rdbSaveFile writes snap to tmpfile, renamed to filename once synced on
+// disk. The temp file is removed on errors.
+func rdbSaveFile(snap *rdbSnapshot, filename, tmpfile string, abort *atomic.Bool) error {
+
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return fmt.Errorf("failed opening the temp RDB file %s for saving, %w", tmpfile, err)
+	}
+	rw := &rdbWriter{w: bufio.NewWriterSize(f, 64*1024), compress: snap.compress}
+	err = rdbSaveRio(rw, snap, abort)
+	if err == nil {
+		err = rw.w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	// a save killed while syncing must not replace the file
+	if err == nil && abort != nil && abort.Load() {
+		err = errRdbAborted
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpfile)
+		return err
+	}
+	fsyncFileDir(filename)
+	return nil
+
+}
+
+// fsyncFileDir makes the rename of filename durable.
+func fsyncFileDir(filename string) {
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return
+	}
+	_ = dir.Sync()
+	_ = dir.Close()
+}
+
+// rdbSave saves the dataset to filename from the event loop.
+func rdbSave(filename string) error {
+
+	tmpfile := filepath.Join(filepath.Dir(filename), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	if err := rdbSaveFile(rdbSnapshotDataset(false), filename, tmpfile, nil); err != nil {
+		Log("Error saving DB on disk, %v", err)
+		return err
+	}
+	Log("DB saved on disk")
+	rServer.dirty = 0
+	rServer.lastSave = time.Now()
+	rServer.lastBgsaveStatus = nil
+	rServer.statRdbSaves++
+	return nil
+
+}
+
+// rdbSaveBackground snapshots the dataset and saves it to filename from a
+// goroutine, see checkChildrenDone.
+func rdbSaveBackground(filename string) error {
+
+	if hasActiveChildProcess() {
+		return errors.New("background save or AOF rewrite already in progress")
+	}
+
+	start := time.Now()
+	rServer.lastBgsaveTry = start
+	tmpfile := filepath.Join(filepath.Dir(filename), fmt.Sprintf("temp-%d-bg.rdb", os.Getpid()))
+	child := &rdbChild{kind: rdbChildTypeDisk, start: start, dirty: rServer.dirty, done: make(chan error, 1), tmpfile: tmpfile}
+	snap := rdbSnapshotDataset(true)
+	go func() {
+		child.done <- rdbSaveFile(snap, filename, tmpfile, &child.abort)
+	}()
+	rServer.rdbChild = child
+	Log("Background saving started, the dataset snapshot took %v", rServer.statSnapshotTime)
+	return nil
+
+}
+
+// rdbSaveToSlavesSockets sends the rdb to the replicas waiting to start a
+// full sync, a goroutine serializes the snapshot of the dataset, copied on
+// write like the one of BGSAVE, to all their sockets at once. Nothing goes
+// to disk, the rdb ends with an EOF mark instead of being sent as a bulk of
+// known length.
+func rdbSaveToSlavesSockets() error {
+
+	if hasActiveChildProcess() {
+		return errors.New("background save or AOF rewrite already in progress")
+	}
+
+	start := time.Now()
+	rServer.lastBgsaveTry = start
+	child := &rdbChild{kind: rdbChildTypeSocket, start: start, dirty: rServer.dirty, done: make(chan error, 1)}
+	for ele := rServer.slaves.Front(); ele != nil; ele = ele.Next() {
+		slave := ele.Value.(*client)
+		if slave.replState != slaveStateWaitBgsaveStart {
+			continue
+		}
+		// +FULLRESYNC goes before the rdb
+		replicationSetupSlaveForFullResync(slave, rServer.masterReplOffset)
+		setConnNonblock(slave.conn, true)
+		child.targets = append(child.targets, &rdbSocketTarget{slave: slave, conn: slave.conn})
+	}
+
+	snap := rdbSnapshotDataset(true)
+	mark := []byte(genRunId())
+	sw := &rdbSocketsWriter{targets: child.targets, timeout: time.Duration(rServer.replTimeout) * time.Second, abort: &child.abort}
+	go func() {
+		rw := &rdbWriter{w: bufio.NewWriterSize(sw, 64*1024), compress: snap.compress}
+		_, rw.err = fmt.Fprintf(rw.w, "$EOF:%s\r\n", mark)
+		err := rdbSaveRio(rw, snap, &child.abort)
+		if err == nil {
+			_, err = rw.w.Write(mark)
+		}
+		if err == nil {
+			err = rw.w.Flush()
+		}
+		for _, t := range child.targets {
+			_ = t.conn.SetWriteDeadline(time.Time{})
+			setConnNonblock(t.conn, false)
+		}
+		child.done <- err
+	}()
+	rServer.rdbChild = child
+	Log("Background RDB transfer started, the dataset snapshot took %v", rServer.statSnapshotTime)
+	return nil
+
+}
+
+// hasActiveChildProcess reports whether a BGSAVE or an AOF rewrite runs,
+// only one of them at a time.
+func hasActiveChildProcess() bool {
+	return rServer.rdbChild != nil || rServer.aofChild != nil
+}
+
+// checkChildrenDone reaps the BGSAVE or AOF rewrite goroutine once it is
+// done.
+func checkChildrenDone() {
+
+	if child := rServer.rdbChild; child != nil {
+		select {
+		case err := <-child.done:
+			backgroundSaveDoneHandler(child, err)
+		default:
+		}
+	}
+	if child := rServer.aofChild; child != nil {
+		select {
+		case err := <-child.done:
+			backgroundRewriteDoneHandler(child, err)
+		default:
+		}
+	}
+
+}
+
+func backgroundSaveDoneHandler(child *rdbChild, err error) {
+
+	rServer.rdbChild = nil
+	rServer.rdbSaveTimeLast = time.Since(child.start)
+	if child.abort.Load() {
+		// killed, even if it was done before it noticed
+		err = errRdbAborted
+	}
+	// the replicas waiting for the rdb get it, or lose the link
+	defer updateSlavesWaitingBgsave(child, err)
+	if err == errRdbAborted {
+		// the status of the last save is left as it is
+		Log("Background saving terminated")
+		return
+	}
+	if child.kind == rdbChildTypeSocket {
+		// nothing was saved
+		if err != nil {
+			Log("Background RDB transfer error, %v", err)
+		} else {
+			Log("Background RDB transfer terminated with success")
+		}
+		return
+	}
+	if err != nil {
+		Log("Background saving error, %v", err)
+		rServer.lastBgsaveStatus = err
+		return
+	}
+	Log("Background saving terminated with success")
+	// the changes made while saving are still to be saved
+	rServer.dirty -= child.dirty
+	rServer.lastSave = time.Now()
+	rServer.lastBgsaveStatus = nil
+	rServer.statRdbSaves++
+
+}
+
+// killRDBChild stops the BGSAVE in progress without waiting for it, the
+// goroutine gives up at its next check of abort and checkChildrenDone reaps
+// it. Until then the values it reads are still copied on write.
+func killRDBChild() {
+
+	child := rServer.rdbChild
+	if child == nil || child.abort.Load() {
+		return
+	}
+	child.abort.Store(true)
+	// a replica not reading must not keep the goroutine in a write
+	for _, t := range child.targets {
+		_ = t.conn.SetWriteDeadline(time.Now())
+	}
+	if child.tmpfile != "" {
+		_ = os.Remove(child.tmpfile)
+	}
+	Log("Killing running RDB child")
+
+}
+
+// rdbCron reaps the BGSAVE or AOF rewrite done, or starts a BGSAVE when a
+// save point is reached or one was scheduled. It is called by serverCron.
+func rdbCron() {
+
+	if hasActiveChildProcess() {
+		checkChildrenDone()
+		return
+	}
+
+	now := time.Now()
+	for _, sp := range rServer.saveParams {
+		// after an error, the save is retried once in a while only
+		if rServer.dirty >= sp.changes && now.Sub(rServer.lastSave) > sp.seconds &&
+			(rServer.lastBgsaveStatus == nil || now.Sub(rServer.lastBgsaveTry) > rdbBgsaveRetryDelay) {
+			Log("%d changes in %d seconds. Saving...", sp.changes, int64(sp.seconds/time.Second))
+			_ = rdbSaveBackground(rdbPath())
+			break
+		}
+	}
+
+	if rServer.rdbChild == nil && rServer.rdbBgsaveScheduled &&
+		(rServer.lastBgsaveStatus == nil || now.Sub(rServer.lastBgsaveTry) > rdbBgsaveRetryDelay) {
+		if rdbSaveBackground(rdbPath()) == nil {
+			rServer.rdbBgsaveScheduled = false
+		}
+	}
+
+}
+
+// rdbReader reads an rdb computing the checksum of what is read.
+type rdbReader struct {
+	r       *bufio.Reader
+	crc     uint64
+	scratch [16]byte
+}
+
+func rdbReadError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("short read loading DB, unexpected end of file")
+	}
+	return err
+}
+
+// read returns the next n bytes. A corrupted length does not allocate more
+// than what the file holds, big strings being read in chunks.
+func (rr *rdbReader) read(n uint64) ([]byte, error) {
+
+	var buf []byte
+	if n <= 1<<20 {
+		buf = make([]byte, n)
+		if _, err := io.ReadFull(rr.r, buf); err != nil {
+			return nil, rdbReadError(err)
+		}
+	} else {
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("invalid string length %d", n)
+		}
+		var b bytes.Buffer
+		if _, err := io.CopyN(&b, rr.r, int64(n)); err != nil {
+			return nil, rdbReadError(err)
+		}
+		buf = b.Bytes()
+	}
+	rr.crc = crc64Update(rr.crc, buf)
+	return buf, nil
+
+}
+
+// readFixed returns the next n bytes, at most 16, in a buffer reused by the
+// next read.
+func (rr *rdbReader) readFixed(n int) ([]byte, error) {
+	buf := rr.scratch[:n]
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		return nil, rdbReadError(err)
+	}
+	rr.crc = crc64Update(rr.crc, buf)
+	return buf, nil
+}
+
+func (rr *rdbReader) loadType() (byte, error) {
+	buf, err := rr.readFixed(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// loadLenEncoded returns a length, or the special encoding of a string when
+// encoded is true.
+func (rr *rdbReader) loadLenEncoded() (l uint64, encoded bool, err error) {
+
+	b, err := rr.loadType()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case rdbEncVal:
+		return uint64(b & 0x3F), true, nil
+	case rdb6BitLen:
+		return uint64(b & 0x3F), false, nil
+	case rdb14BitLen:
+		b2, err := rr.loadType()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(b2), false, nil
+	}
+
+	switch b {
+	case rdb32BitLen:
+		buf, err := rr.readFixed(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case rdb64BitLen:
+		buf, err := rr.readFixed(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, fmt.Errorf("unknown length encoding %d", b)
+
+}
+
+func (rr *rdbReader) loadLen() (uint64, error) {
+	l, encoded, err := rr.loadLenEncoded()
+	if err == nil && encoded {
+		err = errors.New("unexpected string encoding in place of a length")
+	}
+	return l, err
+}
+
+// loadString returns a string in any of its encodings, integers as their
+// decimal representation.
+func (rr *rdbReader) loadString() ([]byte, error) {
+
+	l, encoded, err := rr.loadLenEncoded()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return rr.read(l)
+	}
+
+	switch l {
+	case rdbEncInt8, rdbEncInt16, rdbEncInt32:
+		buf, err := rr.readFixed(1 << l)
+		if err != nil {
+			return nil, err
+		}
+		var v int64
+		switch l {
+		case rdbEncInt8:
+			v = int64(int8(buf[0]))
+		case rdbEncInt16:
+			v = int64(int16(binary.LittleEndian.Uint16(buf)))
+		default:
+			v = int64(int32(binary.LittleEndian.Uint32(buf)))
+		}
+		return strconv.AppendInt(nil, v, 10), nil
+	case rdbEncLZF:
+		return rr.loadLzfString()
+	}
+	return nil, fmt.Errorf("unknown RDB string encoding type %d", l)
+
+}
+
+func (rr *rdbReader) loadLzfString() ([]byte, error) {
+
+	clen, err := rr.loadLen()
+	if err != nil {
+		return nil, err
+	}
+	l, err := rr.loadLen()
+	if err != nil {
+		return nil, err
+	}
+	c, err := rr.read(clen)
+	if err != nil {
+		return nil, err
+	}
+	// a reference expands 3 bytes to 264 at most
+	if l == 0 || l > clen*88+64 {
+		return nil, errors.New("invalid LZF compressed string")
+	}
+	out := make([]byte, l)
+	if lzfDecompress(c, out) != int(l) {
+		return nil, errors.New("invalid LZF compressed string")
+	}
+	return out, nil
+
+}
+
+func (rr *rdbReader) loadStringObject() (*rObj, error) {
+	buf, err := rr.loadString()
+	if err != nil {
+		return nil, err
+	}
+	return tryObjectEncoding(createStringObject(buf)), nil
+}
+
+func (rr *rdbReader) loadMillisecondTime() (int64, error) {
+	buf, err := rr.readFixed(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+func (rr *rdbReader) loadBinaryDouble() (float64, error) {
+	buf, err := rr.readFixed(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// loadDouble reads the scores of the old zset type, a length byte followed
+// by the score as text, or 253, 254 and 255 for nan, inf and -inf.
+func (rr *rdbReader) loadDouble() (float64, error) {
+
+	l, err := rr.loadType()
+	if err != nil {
+		return 0, err
+	}
+	switch l {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := rr.read(uint64(l))
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(string(buf), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid double value %q", buf)
+	}
+	return f, nil
+
+}
+
+// loadListpack reads a listpack, checking it can be used safely.
+func (rr *rdbReader) loadListpack() ([]byte, error) {
+	lp, err := rr.loadString()
+	if err != nil {
+		return nil, err
+	}
+	if !lpValidateIntegrity(lp) {
+		return nil, errors.New("listpack integrity check failed")
+	}
+	return lp, nil
+}
+
+// rdbListpackMaxLen returns the length of the longest element of lp.
+func rdbListpackMaxLen(lp []byte) int {
+	maxlen := 0
+	for p := lpFirst(lp); p != -1; p = lpNext(lp, p) {
+		if str, v := lpGet(lp, p); str != nil {
+			maxlen = max(maxlen, len(str))
+		} else {
+			maxlen = max(maxlen, digits10(v))
+		}
+	}
+	return maxlen
+}
+
+// rdbSizeHint bounds the number of elements announced by the file, used to
+// presize a table, so a corrupted length does not allocate a huge one.
+func rdbSizeHint(n uint64) int {
+	if n > 1<<20 {
+		return 1 << 20
+	}
+	return int(n)
+}
+
+// loadObject reads a value of type rdbtype. An aggregate without elements
+// returns errRdbEmptyKey, such keys are skipped.
+func (rr *rdbReader) loadObject(rdbtype byte) (*rObj, error) {
+
+	switch rdbtype {
+	case rdbTypeString:
+		return rr.loadStringObject()
+
+	case rdbTypeList:
+		n, err := rr.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		o := createQuicklistObject()
+		for ; n > 0; n-- {
+			ele, err := rr.loadString()
+			if err != nil {
+				return nil, err
+			}
+			listTypePush(o, ele, listTail)
+		}
+		if listTypeLength(o) == 0 {
+			return nil, errRdbEmptyKey
+		}
+		return o, nil
+
+	case rdbTypeListQuicklist2:
+		n, err := rr.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		o := createQuicklistObject()
+		for ; n > 0; n-- {
+			container, err := rr.loadLen()
+			if err != nil {
+				return nil, err
+			}
+			if container == rdbQuicklistNodeContainerPlain {
+				ele, err := rr.loadString()
+				if err != nil {
+					return nil, err
+				}
+				listTypePush(o, ele, listTail)
+				continue
+			}
+			if container != rdbQuicklistNodeContainerPacked {
+				return nil, fmt.Errorf("quicklist integrity check failed, unknown container %d", container)
+			}
+			lp, err := rr.loadListpack()
+			if err != nil {
+				return nil, err
+			}
+			// the elements are pushed again, the nodes follow the current
+			// list-max-listpack-size
+			for p := lpFirst(lp); p != -1; p = lpNext(lp, p) {
+				listTypePush(o, lpGetBytes(lp, p), listTail)
+			}
+		}
+		if listTypeLength(o) == 0 {
+			return nil, errRdbEmptyKey
+		}
+		return o, nil
+
+	case rdbTypeSet:
+		n, err := rr.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, errRdbEmptyKey
+		}
+		o := createIntsetObject()
+		if n > uint64(rServer.setMaxIntsetEntries) {
+			setTypeConvert(o, rdbSizeHint(n))
+		}
+		for ; n > 0; n-- {
+			ele, err := rr.loadString()
+			if err != nil {
+				return nil, err
+			}
+			if !setTypeAdd(o, string(ele)) {
+				return nil, errors.New("duplicate set members detected")
+			}
+		}
+		return o, nil
+
+	case rdbTypeSetIntset:
+		is, err := rr.loadString()
+		if err != nil {
+			return nil, err
+		}
+		if !intsetValidateIntegrity(is) {
+			return nil, errors.New("intset integrity check failed")
+		}
+		o := &rObj{objectType: objectTypeSet, encoding: objectEncodingIntset, data: is}
+		if intsetLen(is) > rServer.setMaxIntsetEntries {
+			setTypeConvert(o, intsetLen(is))
+		}
+		return o, nil
+
+	case rdbTypeSetListpack:
+		lp, err := rr.loadListpack()
+		if err != nil {
+			return nil, err
+		}
+		if lpFirst(lp) == -1 {
+			return nil, errRdbEmptyKey
+		}
+		o := setTypeCreate(lpGetString(lp, lpFirst(lp)), lpLength(lp))
+		for p := lpFirst(lp); p != -1; p = lpNext(lp, p) {
+			if !setTypeAdd(o, lpGetString(lp, p)) {
+				return nil, errors.New("duplicate set members detected")
+			}
+		}
+		return o, nil
+
+	case rdbTypeZset, rdbTypeZset2:
+		n, err := rr.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, errRdbEmptyKey
+		}
+		o := zsetTypeCreate(rdbSizeHint(n), 0)
+		for ; n > 0; n-- {
+			ele, err := rr.loadString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if rdbtype == rdbTypeZset2 {
+				score, err = rr.loadBinaryDouble()
+			} else {
+				score, err = rr.loadDouble()
+			}
+			if err != nil {
+				return nil, err
+			}
+			if math.IsNaN(score) {
+				return nil, errors.New("zset with NAN score detected")
+			}
+			if flags, _ := zsetAdd(o, score, string(ele), zaddInNX); flags&zaddOutAdded == 0 {
+				return nil, errors.New("duplicate zset fields detected")
+			}
+		}
+		return o, nil
+
+	case rdbTypeZsetListpack:
+		lp, err := rr.loadListpack()
+		if err != nil {
+			return nil, err
+		}
+		if lpLength(lp)%2 != 0 {
+			return nil, errors.New("zset listpack integrity check failed")
+		}
+		if lpFirst(lp) == -1 {
+			return nil, errRdbEmptyKey
+		}
+		o := &rObj{objectType: objectTypeZSet, encoding: objectEncodingListpack, data: lp}
+		if zzlLength(lp) > rServer.zsetMaxListpackEntries || rdbListpackMaxLen(lp) > rServer.zsetMaxListpackValue {
+			zsetConvert(o, objectEncodingSkiplist)
+		}
+		return o, nil
+
+	case rdbTypeHash:
+		n, err := rr.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, errRdbEmptyKey
+		}
+		o := createHashObject()
+		if n > uint64(rServer.hashMaxListpackEntries) {
+			hashTypeConvert(o, objectEncodingHT)
+		}
+		for ; n > 0; n-- {
+			field, err := rr.loadString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := rr.loadString()
+			if err != nil {
+				return nil, err
+			}
+			if o.encoding == objectEncodingListpack &&
+				(len(field) > rServer.hashMaxListpackValue || len(value) > rServer.hashMaxListpackValue) {
+				hashTypeConvert(o, objectEncodingHT)
+			}
+			if hashTypeExists(o, string(field)) {
+				return nil, errors.New("duplicate hash fields detected")
+			}
+			hashTypeSet(o, string(field), value, hashSetTakeValue)
+		}
+		return o, nil
+
+	case rdbTypeHashListpack:
+		lp, err := rr.loadListpack()
+		if err != nil {
+			return nil, err
+		}
+		if lpLength(lp)%2 != 0 {
+			return nil, errors.New("hash listpack integrity check failed")
+		}
+		if lpFirst(lp) == -1 {
+			return nil, errRdbEmptyKey
+		}
+		o := &rObj{objectType: objectTypeHash, encoding: objectEncodingListpack, data: lp}
+		if hashTypeLength(o) > rServer.hashMaxListpackEntries || rdbListpackMaxLen(lp) > rServer.hashMaxListpackValue {
+			hashTypeConvert(o, objectEncodingHT)
+		}
+		return o, nil
+
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return rr.loadStream(rdbtype)
+	}
+	return nil, fmt.Errorf("unknown RDB encoding type %d", rdbtype)
+
+}
+
+func (rr *rdbReader) loadStreamID() (streamID, error) {
+	ms, err := rr.loadLen()
+	if err != nil {
+		return streamID{}, err
+	}
+	seq, err := rr.loadLen()
+	return streamID{ms: ms, seq: seq}, err
+}
+
+func (rr *rdbReader) loadStream(rdbtype byte) (*rObj, error) {
+
+	o := createStreamObject()
+	s := o.data.(*stream)
+
+	n, err := rr.loadLen()
+	if err != nil {
+		return nil, err
+	}
+	for ; n > 0; n-- {
+		key, err := rr.loadString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, errors.New("stream node key entry is not the size of a stream ID")
+		}
+		lp, err := rr.loadListpack()
+		if err != nil {
+			return nil, err
+		}
+		if lpFirst(lp) == -1 {
+			return nil, errors.New("empty listpack inside stream")
+		}
+		if !s.rax.insert(string(key), lp, false) {
+			return nil, errors.New("listpack re-added with existing key")
+		}
+	}
+
+	length, err := rr.loadLen()
+	if err != nil {
+		return nil, err
+	}
+	s.length = int64(length)
+	if s.lastId, err = rr.loadStreamID(); err != nil {
+		return nil, err
+	}
+	if rdbtype >= rdbTypeStreamListpacks2 {
+		if s.firstId, err = rr.loadStreamID(); err != nil {
+			return nil, err
+		}
+		if s.maxDeletedEntryId, err = rr.loadStreamID(); err != nil {
+			return nil, err
+		}
+		entriesAdded, err := rr.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		s.entriesAdded = int64(entriesAdded)
+	} else {
+		// older files only know the live entries
+		s.entriesAdded = s.length
+		s.firstId = streamGetEdgeID(s, true, true)
+	}
+
+	ngroups, err := rr.loadLen()
+	if err != nil {
+		return nil, err
+	}
+	for ; ngroups > 0; ngroups-- {
+		if err := rr.loadStreamCG(s, rdbtype); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+
+}
+
+func (rr *rdbReader) loadStreamCG(s *stream, rdbtype byte) error {
+
+	name, err := rr.loadString()
+	if err != nil {
+		return err
+	}
+	lastId, err := rr.loadStreamID()
+	if err != nil {
+		return err
+	}
+	var entriesRead int64
+	if rdbtype >= rdbTypeStreamListpacks2 {
+		v, err := rr.loadLen()
+		if err != nil {
+			return err
+		}
+		entriesRead = int64(v)
+	} else {
+		entriesRead = streamEstimateDistanceFromFirstEverEntry(s, lastId)
+	}
+	cg := streamCreateCG(s, string(name), lastId, entriesRead)
+	if cg == nil {
+		return fmt.Errorf("duplicated consumer group name %s", name)
+	}
+
+	// the group PEL, its NACKs are assigned to the consumers below
+	n, err := rr.loadLen()
+	if err != nil {
+		return err
+	}
+	for ; n > 0; n-- {
+		rawid, err := rr.readFixed(16)
+		if err != nil {
+			return err
+		}
+		id := string(rawid)
+		nack := &streamNACK{}
+		if nack.deliveryTime, err = rr.loadMillisecondTime(); err != nil {
+			return err
+		}
+		count, err := rr.loadLen()
+		if err != nil {
+			return err
+		}
+		nack.deliveryCount = int64(count)
+		if !cg.pel.insert(id, nack, false) {
+			return errors.New("duplicated global PEL entry loading stream consumer group")
+		}
+	}
+
+	nconsumers, err := rr.loadLen()
+	if err != nil {
+		return err
+	}
+	for ; nconsumers > 0; nconsumers-- {
+		cname, err := rr.loadString()
+		if err != nil {
+			return err
+		}
+		consumer := streamCreateConsumer(cg, string(cname))
+		if consumer == nil {
+			return fmt.Errorf("duplicate stream consumer detected %s", cname)
+		}
+		if consumer.seenTime, err = rr.loadMillisecondTime(); err != nil {
+			return err
+		}
+		if rdbtype >= rdbTypeStreamListpacks3 {
+			if consumer.activeTime, err = rr.loadMillisecondTime(); err != nil {
+				return err
+			}
+		} else {
+			consumer.activeTime = consumer.seenTime
+		}
+
+		n, err := rr.loadLen()
+		if err != nil {
+			return err
+		}
+		for ; n > 0; n-- {
+			rawid, err := rr.readFixed(16)
+			if err != nil {
+				return err
+			}
+			id := string(rawid)
+			nack, ok := cg.pel.find(id)
+			if !ok {
+				return errors.New("consumer entry not found in group global PEL")
+			}
+			nack.(*streamNACK).consumer = consumer
+			if !consumer.pel.insert(id, nack, false) {
+				return errors.New("duplicated consumer PEL entry loading a stream consumer group")
+			}
+		}
+	}
+
+	// every NACK belongs to a consumer
+	it := cg.pel.iterator()
+	it.seek("^", "")
+	for it.next() {
+		if it.data.(*streamNACK).consumer == nil {
+			return errors.New("stream CG PEL entry without consumer")
+		}
+	}
+	return nil
+
+}
+
+// rdbLoad loads the dataset saved in filename, adding its keys to the dbs.
+func rdbLoad(filename string) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return rdbLoadRio(&rdbReader{r: bufio.NewReaderSize(f, 64*1024)}, rServer.db)
+
+}
+
+// rdbLoadRio loads the keys of the rdb read by rr into dbs, the ones of the
+// server or a temporary keyspace.
+func rdbLoadRio(rr *rdbReader, dbs []*redisDb) error {
+
+	header, err := rr.readFixed(9)
+	if err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbVersion {
+		return fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
+
+	db := dbs[0]
+	now := mstime()
+	expire, lruIdle, lfuFreq := int64(-1), int64(-1), -1
+	var expired, emptySkipped int64
+	for {
+		rdbtype, err := rr.loadType()
+		if err != nil {
+			return err
+		}
+
+		switch rdbtype {
+		case rdbOpcodeExpireTime:
+			buf, err := rr.readFixed(4)
+			if err != nil {
+				return err
+			}
+			expire = int64(int32(binary.LittleEndian.Uint32(buf))) * 1000
+			continue
+		case rdbOpcodeExpireTimeMs:
+			if expire, err = rr.loadMillisecondTime(); err != nil {
+				return err
+			}
+			continue
+		case rdbOpcodeFreq:
+			freq, err := rr.loadType()
+			if err != nil {
+				return err
+			}
+			lfuFreq = int(freq)
+			continue
+		case rdbOpcodeIdle:
+			idle, err := rr.loadLen()
+			if err != nil {
+				return err
+			}
+			if idle > math.MaxInt32 {
+				idle = math.MaxInt32
+			}
+			lruIdle = int64(idle)
+			continue
+		case rdbOpcodeSelectDb:
+			id, err := rr.loadLen()
+			if err != nil {
+				return err
+			}
+			if id >= uint64(rServer.dbnum) {
+				return fmt.Errorf("data file was created with a server configured to handle more than %d databases",
+					rServer.dbnum)
+			}
+			db = dbs[id]
+			continue
+		case rdbOpcodeResizeDb:
+			size, err := rr.loadLen()
+			if err != nil {
+				return err
+			}
+			expires, err := rr.loadLen()
+			if err != nil {
+				return err
+			}
+			db.dict.expand(rdbSizeHint(size))
+			db.expires.expand(rdbSizeHint(expires))
+			continue
+		case rdbOpcodeAux:
+			key, err := rr.loadString()
+			if err != nil {
+				return err
+			}
+			val, err := rr.loadString()
+			if err != nil {
+				return err
+			}
+			switch string(key) {
+			case "redis-ver":
+				Log("Loading RDB produced by version %s", val)
+			case "ctime":
+				if ctime, ok := string2ll(val); ok {
+					Log("RDB age %d seconds", max(time.Now().Unix()-ctime, 0))
+				}
+			case "used-mem":
+				Log("RDB memory usage when created %s", val)
+			}
+			continue
+		case rdbOpcodeModuleAux, rdbOpcodeFunction, rdbOpcodeFunction2:
+			return errors.New("the RDB file contains modules or functions data, which is not supported")
+		case rdbOpcodeEOF:
+		}
+		if rdbtype == rdbOpcodeEOF {
+			break
+		}
+
+		key, err := rr.loadString()
+		if err != nil {
+			return err
+		}
+		val, err := rr.loadObject(rdbtype)
+		if errors.Is(err, errRdbEmptyKey) {
+			emptySkipped++
+			if emptySkipped <= 10 {
+				Log("rdbLoadObject skipping empty key: %s", key)
+			}
+		} else if err != nil {
+			return fmt.Errorf("loading key '%s', %w", key, err)
+		} else if expire != -1 && expire < now && rServer.masterhost == "" {
+			// the key expired while the server was down, a replica waits
+			// for the DEL of its master
+			expired++
+		} else {
+			k := string(key)
+			if dbExists(db, k) {
+				return fmt.Errorf("duplicate key '%s' found in RDB file", key)
+			}
+			dbAdd(db, k, val)
+			if expire != -1 {
+				setExpire(db, k, expire)
+			}
+			objectSetLRUOrLFU(val, lfuFreq, lruIdle)
+		}
+		expire, lruIdle, lfuFreq = -1, -1, -1
+	}
+
+	// the checksum of everything read so far, 0 when the file was saved
+	// without
+	if version >= 5 {
+		crc := rr.crc
+		buf, err := rr.readFixed(8)
+		if err != nil {
+			return err
+		}
+		checksum := binary.LittleEndian.Uint64(buf)
+		if checksum == 0 {
+			Log("RDB file was saved with checksum disabled: no check performed.")
+		} else if rServer.rdbChecksum && checksum != crc {
+			return errors.New("wrong RDB checksum")
+		}
+	}
+	if expired > 0 || emptySkipped > 0 {
+		Log("Done loading RDB, keys loaded: %d, keys expired: %d, empty keys skipped: %d",
+			rdbLoadedKeys(dbs), expired, emptySkipped)
+	}
+	return nil
+
+}
+
+func rdbLoadedKeys(dbs []*redisDb) int {
+	keys := 0
+	for _, db := range dbs {
+		keys += db.dict.size()
+	}
+	return keys
+}
+
+// loadDataFromDisk loads the AOF at startup when turned on, the rdb
+// otherwise, a missing file being an empty dataset. Without an AOF yet, it
+// is created from the dataset of the rdb. The server does not start with a
+// file it can't load.
+func loadDataFromDisk() {
+
+	loaded := false
+	if rServer.aofEnabled {
+		rServer.loading = true
+		err := loadAppendOnlyFiles()
+		rServer.loading = false
+		switch {
+		case err == nil:
+			loaded = true
+		case !errors.Is(err, os.ErrNotExist):
+			Log("Fatal error loading the AOF: %v. Exiting.", err)
+			os.Exit(1)
+		}
+	}
+
+	if !loaded {
+		start := time.Now()
+		rServer.loading = true
+		err := rdbLoad(rdbPath())
+		rServer.loading = false
+		switch {
+		case err == nil:
+			Log("DB loaded from disk: %.3f seconds", time.Since(start).Seconds())
+		case errors.Is(err, os.ErrNotExist):
+		default:
+			Log("Fatal error loading the DB: %v. Exiting.", err)
+			os.Exit(1)
+		}
+	}
+
+	if rServer.aofEnabled {
+		if err := aofOpenIfNeededOnServerStart(); err != nil {
+			Log("Fatal error opening the AOF: %v. Exiting.", err)
+			os.Exit(1)
+		}
+		aofDelHistoryFiles()
+	}
+
+}
+
+func saveCommand(c *client) {
+
+	if rServer.rdbChild != nil {
+		addReplyError(c, "Background save already in progress")
+		return
+	}
+	if err := rdbSave(rdbPath()); err != nil {
+		addReplyErrorFormat(c, "Error saving the DB, %v", err)
+		return
+	}
+	addReply(c, shared.ok)
+
+}
+
+// bgsaveCommand implements BGSAVE [SCHEDULE], SCHEDULE starts the save
+// once the AOF rewrite in progress is done instead of failing.
+func bgsaveCommand(c *client) {
+
+	schedule := false
+	if c.argc > 1 {
+		if c.argc > 2 || !strings.EqualFold(c.argv[1].String(), "schedule") {
+			addReply(c, shared.syntaxErr)
+			return
+		}
+		schedule = true
+	}
+	if rServer.rdbChild != nil {
+		addReplyError(c, "Background save already in progress")
+		return
+	}
+	if hasActiveChildProcess() {
+		if !schedule {
+			addReplyError(c, "Another child process is active (AOF?): can't BGSAVE right now. "+
+				"Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible.")
+			return
+		}
+		rServer.rdbBgsaveScheduled = true
+		addReplyStatus(c, "Background saving scheduled")
+		return
+	}
+	if err := rdbSaveBackground(rdbPath()); err != nil {
+		addReplyErrorFormat(c, "Error starting the background save, %v", err)
+		return
+	}
+	addReplyStatus(c, "Background saving started")
+
+}
+
+func lastsaveCommand(c *client) {
+	addReplyLongLong(c, rServer.lastSave.Unix())
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRdbTestConn(t *testing.T) *testConn {
+	return newBlockingTestConns(t, "6", 1)[0]
+}
+
+func TestRdb_ReloadTypes(t *testing.T) {
+	tc := newRdbTestConn(t)
+
+	long := strings.Repeat("abcdefghij", 30)
+	tc.expect(testStatus("OK"), "set", "int", "12345")
+	tc.expect(testStatus("OK"), "set", "bigint", "-9223372036854775808")
+	tc.expect(testStatus("OK"), "set", "embstr", "hello")
+	tc.expect(testStatus("OK"), "set", "raw", long)
+	tc.expect(int64(0), "setrange", "empty", "0", "")
+
+	tc.expect(int64(3), "rpush", "list", "a", "1", "c")
+	tc.expect(testStatus("OK"), "config", "set", "list-max-listpack-size", "2", "list-compress-depth", "1")
+	for j := 0; j < 5; j++ {
+		tc.do("rpush", "biglist", strings.Repeat("x", 60)+strconv.Itoa(j))
+	}
+	tc.expect(testStatus("OK"), "config", "set", "list-max-listpack-size", "-2", "list-compress-depth", "0")
+
+	tc.expect(int64(3), "sadd", "intset", "1", "-20", "300000")
+	tc.expect(int64(2), "sadd", "set", "a", "b")
+	tc.expect(int64(2), "zadd", "zlp", "1.5", "a", "-inf", "b")
+	tc.expect(int64(2), "zadd", "zsl", "2", "m", "1", long)
+	tc.expect(int64(2), "hset", "hlp", "f", "v", "n", "12")
+	tc.expect(int64(1), "hset", "hht", "f", long)
+
+	tc.expect("1-1", "xadd", "s", "1-1", "a", "1")
+	tc.expect("2-1", "xadd", "s", "2-1", "b", "2")
+	tc.expect(testStatus("OK"), "xgroup", "create", "s", "g", "0")
+	tc.expect([]any{[]any{"s", []any{[]any{"1-1", []any{"a", "1"}}}}},
+		"xreadgroup", "group", "g", "alice", "count", "1", "streams", "s", ">")
+	tc.expect(int64(1), "pexpire", "raw", "100000")
+
+	encodings := map[string]string{
+		"int": "int", "bigint": "int", "embstr": "embstr", "raw": "raw", "list": "quicklist",
+		"intset": "intset", "set": "hashtable", "zlp": "listpack", "zsl": "skiplist",
+		"hlp": "listpack", "hht": "hashtable", "s": "stream",
+	}
+	tc.expect(testStatus("OK"), "debug", "reload")
+	for key, enc := range encodings {
+		tc.expect(enc, "object", "encoding", key)
+	}
+
+	tc.expect("12345", "get", "int")
+	tc.expect("-9223372036854775808", "get", "bigint")
+	tc.expect("hello", "get", "embstr")
+	tc.expect(long, "get", "raw")
+	tc.expect(int64(0), "exists", "empty")
+	if ttl := tc.do("pttl", "raw").(int64); ttl <= 0 || ttl > 100000 {
+		t.Fatalf("want the ttl of raw kept, got %d", ttl)
+	}
+	tc.expect(int64(-1), "pttl", "int")
+
+	tc.expect([]any{"a", "1", "c"}, "lrange", "list", "0", "-1")
+	tc.expect(int64(5), "llen", "biglist")
+	tc.expect(strings.Repeat("x", 60)+"3", "lindex", "biglist", "3")
+	tc.expect([]any{"-20", "1", "300000"}, "smembers", "intset")
+	tc.expect(int64(1), "sismember", "set", "b")
+	tc.expect([]any{"b", "-inf", "a", "1.5"}, "zrange", "zlp", "0", "-1", "withscores")
+	tc.expect([]any{long, "1", "m", "2"}, "zrange", "zsl", "0", "-1", "withscores")
+	tc.expect([]any{"f", "v", "n", "12"}, "hgetall", "hlp")
+	tc.expect(long, "hget", "hht", "f")
+
+	tc.expect([]any{[]any{"1-1", []any{"a", "1"}}, []any{"2-1", []any{"b", "2"}}}, "xrange", "s", "-", "+")
+	tc.expect([]any{int64(1), "1-1", "1-1", []any{[]any{"alice", "1"}}}, "xpending", "s", "g")
+	tc.expect([]any{[]any{"s", []any{[]any{"2-1", []any{"b", "2"}}}}},
+		"xreadgroup", "group", "g", "bob", "streams", "s", ">")
+	tc.expectError("ERR The ID specified in XADD is equal or smaller", "xadd", "s", "2-1", "c", "3")
+}
+
+func TestRdb_SaveAndLastsave(t *testing.T) {
+	tc := newRdbTestConn(t)
+
+	tc.expect(testStatus("OK"), "set", "a", "1")
+	tc.expect(testStatus("OK"), "save")
+	if lastsave := tc.do("lastsave").(int64); time.Now().Unix()-lastsave > 1 {
+		t.Fatalf("want LASTSAVE now, got %d", lastsave)
+	}
+	if got := tc.infoField("persistence", "rdb_changes_since_last_save"); got != "0" {
+		t.Fatalf("want no changes since the save, got %s", got)
+	}
+
+	// the changes after the save are lost by a reload without save
+	tc.expect(testStatus("OK"), "set", "a", "2")
+	tc.expect(testStatus("OK"), "debug", "reload", "nosave")
+	tc.expect("1", "get", "a")
+	tc.expectError("ERR DEBUG RELOAD only supports the NOSAVE option.", "debug", "reload", "now")
+}
+
+// waitBgsave waits for the BGSAVE in progress to be done.
+func waitBgsave(tc *testConn) {
+	tc.t.Helper()
+	for j := 0; j < 500; j++ {
+		if tc.infoField("persistence", "rdb_bgsave_in_progress") == "0" {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	tc.t.Fatalf("the background save did not finish")
+}
+
+func TestRdb_Bgsave(t *testing.T) {
+	tc := newRdbTestConn(t)
+
+	for j := 0; j < 100; j++ {
+		tc.do("rpush", "l", strconv.Itoa(j))
+	}
+	saves, _ := strconv.Atoi(tc.infoField("persistence", "rdb_saves"))
+	tc.expect(testStatus("Background saving started"), "bgsave")
+	// the copy saved is the dataset when BGSAVE started
+	tc.expect(int64(101), "rpush", "l", "after")
+	waitBgsave(tc)
+	if tc.infoField("persistence", "rdb_last_bgsave_status") != "ok" {
+		t.Fatalf("want the background save ok")
+	}
+	if got := tc.infoField("persistence", "rdb_saves"); got != strconv.Itoa(saves+1) {
+		t.Fatalf("want %d saves, got %s", saves+1, got)
+	}
+	// the write made while saving is not saved yet
+	if got := tc.infoField("persistence", "rdb_changes_since_last_save"); got != "1" {
+		t.Fatalf("want the change made while saving counted, got %s", got)
+	}
+
+	tc.expect(testStatus("OK"), "debug", "reload", "nosave")
+	tc.expect(int64(100), "llen", "l")
+	tc.expectError("ERR syntax error", "bgsave", "now")
+}
+
+// pipelineBigKeys adds numElements elements to numKeys keys named prefix
+// followed by their number, with cmd pipelined a thousand elements at a
+// time. elem returns the arguments of the element j.
+func pipelineBigKeys(tc *testConn, cmd, prefix string, numKeys, numElements int, elem func(j int) []string) {
+	tc.t.Helper()
+
+	var pipeline strings.Builder
+	numCmds := 0
+	for k := 0; k < numKeys; k++ {
+		for first := 0; first < numElements; first += 1000 {
+			args := []string{cmd, prefix + strconv.Itoa(k)}
+			for j := first; j < first+1000 && j < numElements; j++ {
+				args = append(args, elem(j)...)
+			}
+			fmt.Fprintf(&pipeline, "*%d\r\n", len(args))
+			for _, arg := range args {
+				fmt.Fprintf(&pipeline, "$%d\r\n%s\r\n", len(arg), arg)
+			}
+			numCmds++
+		}
+	}
+	tc.writeRaw(pipeline.String())
+	for j := 0; j < numCmds; j++ {
+		if reply, ok := tc.read().(testError); ok {
+			tc.t.Fatalf("%s error=%s", cmd, reply)
+		}
+	}
+}
+
+// the sets of the snapshot tests are big enough for the background job to
+// be still saving them when they are changed
+const snapshotNumKeys, snapshotNumMembers = 20, 20000
+
+// mutateDuringSnapshot fills the keys of the snapshot tests, calls start,
+// which begins a background job saving the dataset, then changes the keys
+// while the job runs. Some changes are not idempotent, a replay of them on
+// top of a dataset that already has them shows.
+func mutateDuringSnapshot(tc *testConn, start func()) {
+	tc.t.Helper()
+
+	pipelineBigKeys(tc, "sadd", "s:", snapshotNumKeys, snapshotNumMembers, func(j int) []string {
+		return []string{"m" + strconv.Itoa(j)}
+	})
+	tc.expect("hashtable", "object", "encoding", "s:0")
+	tc.expect(testStatus("OK"), "set", "counter", "10")
+	tc.expect(int64(1), "rpush", "l", "before")
+
+	start()
+	// the values shared with the job are copied when touched
+	tc.expect(int64(1), "sadd", "s:0", "added-during-save")
+	tc.expect(int64(1), "srem", "s:1", "m0")
+	tc.expect(int64(1), "del", "s:2")
+	tc.expect(int64(11), "incr", "counter")
+	tc.expect(int64(2), "rpush", "l", "added-during-save")
+	tc.expect(int64(snapshotNumMembers+1), "scard", "s:0")
+}
+
+// expectSnapshotBeforeMutations checks the dataset saved by the job of
+// mutateDuringSnapshot, once loaded, is the one before the changes.
+func expectSnapshotBeforeMutations(tc *testConn) {
+	tc.t.Helper()
+
+	tc.expect(int64(snapshotNumKeys+2), "dbsize")
+	tc.expect(int64(snapshotNumMembers), "scard", "s:0")
+	tc.expect(int64(0), "sismember", "s:0", "added-during-save")
+	tc.expect(int64(1), "sismember", "s:1", "m0")
+	tc.expect(int64(snapshotNumMembers), "scard", "s:2")
+	tc.expect("10", "get", "counter")
+	tc.expect([]any{"before"}, "lrange", "l", "0", "-1")
+}
+
+func TestRdb_BgsaveCopyOnWrite(t *testing.T) {
+	tc := newRdbTestConn(t)
+
+	mutateDuringSnapshot(tc, func() {
+		tc.expect(testStatus("Background saving started"), "bgsave")
+	})
+	waitBgsave(tc)
+	tc.expect(testStatus("OK"), "debug", "reload", "nosave")
+	expectSnapshotBeforeMutations(tc)
+}
+
+func TestRdb_SavePoints(t *testing.T) {
+	tc := newRdbTestConn(t)
+
+	tc.expect([]any{"save", ""}, "config", "get", "save")
+	tc.expect(testStatus("OK"), "config", "set", "save", "1 1")
+	t.Cleanup(func() {
+		tc.do("config", "set", "save", "")
+	})
+	tc.expect([]any{"save", "1 1"}, "config", "get", "save")
+	tc.expectError("ERR CONFIG SET failed (possibly related to argument 'save') - Invalid save parameters",
+		"config", "set", "save", "1")
+	tc.expectError("ERR CONFIG SET failed (possibly related to argument 'save') - Invalid save parameters",
+		"config", "set", "save", "0 1")
+
+	tc.expect(testStatus("OK"), "set", "a", "1")
+	for j := 0; j < 300; j++ {
+		if tc.infoField("persistence", "rdb_changes_since_last_save") == "0" {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("want a background save after a change in a second")
+}
+
+func TestRdb_Corruption(t *testing.T) {
+	tc := newRdbTestConn(t)
+
+	tc.expect(testStatus("OK"), "set", "a", strings.Repeat("z", 100))
+	tc.expect(testStatus("OK"), "save")
+	t.Cleanup(func() {
+		tc.do("config", "set", "dbfilename", "dump.rdb", "rdbchecksum", "yes")
+		tc.do("debug", "reload", "nosave")
+	})
+
+	dir := tc.do("config", "get", "dir").([]any)[1].(string)
+	rdb, err := os.ReadFile(filepath.Join(dir, "dump.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func(name string, data []byte) any {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		tc.expect(testStatus("OK"), "config", "set", "dbfilename", name)
+		return tc.do("debug", "reload", "nosave")
+	}
+	expectLoadError := func(name string, data []byte, msg string) {
+		t.Helper()
+		if got, ok := load(name, data).(testError); !ok || !strings.Contains(string(got), msg) {
+			t.Fatalf("want load error %q, got %#v", msg, got)
+		}
+	}
+
+	badsum := append([]byte(nil), rdb...)
+	badsum[len(badsum)-1] ^= 0xFF
+	expectLoadError("badsum.rdb", badsum, "wrong RDB checksum")
+	expectLoadError("short.rdb", rdb[:len(rdb)-20], "unexpected end of file")
+	expectLoadError("signature.rdb", []byte("RODIS0011"), "wrong signature")
+	expectLoadError("version.rdb", []byte("REDIS0099"), "can't handle RDB format version")
+
+	// the checksum is not verified when turned off
+	tc.expect(testStatus("OK"), "config", "set", "rdbchecksum", "no")
+	if got := load("badsum.rdb", badsum); got != testStatus("OK") {
+		t.Fatalf("want the file loaded without checksum, got %#v", got)
+	}
+	tc.expect(strings.Repeat("z", 100), "get", "a")
+
+	tc.expectError("ERR CONFIG SET failed (possibly related to argument 'dbfilename') - dbfilename can't be a path",
+		"config", "set", "dbfilename", "a/b.rdb")
+}
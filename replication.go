@@ -0,0 +1,1703 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Master-replica replication. A replica connects to its master with the
+// handshake:
+//
+//	PING
+//	AUTH [<masteruser>] <masterauth>    when masterauth is set
+//	REPLCONF listening-port <port>
+//	REPLCONF capa eof capa psync2
+//	PSYNC <replid> <offset>             "PSYNC ? -1" without any history
+//
+// The master continues the stream from offset with what its backlog holds,
+// "+CONTINUE <replid>", or replies "+FULLRESYNC <replid> <offset>" and sends
+// the rdb of a BGSAVE as a bulk, followed by the commands propagated since
+// the dataset was snapshotted. Every command propagated is fed to the backlog, a
+// circular buffer with the last repl-backlog-size bytes of the stream, and
+// to the output of the replicas: the replication offset counts the bytes of
+// the stream so far, the replication id names the history the offset is a
+// position in.
+//
+// The replica applies the stream through the master client, replying to
+// nothing but REPLCONF GETACK, and acknowledges the offset it applied every
+// second with REPLCONF ACK. The stream it applied goes as is to its own
+// backlog and replicas, they share the history of the master.
+//
+// With repl-diskless-sync the master does not write the rdb to disk: after
+// waiting repl-diskless-sync-delay seconds for more replicas to batch, it
+// streams the rdb to the sockets of the replicas as "$EOF:<mark>\r\n", the
+// rdb and the 40 bytes mark. The stream follows once the replica acks it
+// loaded the rdb. With repl-diskless-load the replica loads the rdb as it
+// is read from the socket, into a temporary keyspace swapped in on success
+// with swapdb.
+//
+// The handshake with the master, and the transfers of the rdb in both
+// directions, run in goroutines the event loop checks on every serverCron,
+// the way it does for BGSAVE.
+
+// the link of a replica with its master
+const (
+	replStateNone       = iota // not a replica
+	replStateConnect           // to connect with the master
+	replStateConnecting        // handshake or transfer of the rdb in progress
+	replStateConnected         // applying the stream of the master
+)
+
+// the state of a replica on its master
+const (
+	slaveStateWaitBgsaveStart = iota + 1 // waiting for a BGSAVE to start
+	slaveStateWaitBgsaveEnd              // waiting for the BGSAVE to end
+	slaveStateSendBulk                   // the rdb is being sent
+	slaveStateOnline                     // the stream is being sent
+)
+
+// capabilities of a replica, REPLCONF capa
+const (
+	slaveCapaEOF    = 1 << 0 // reads an rdb of unknown length
+	slaveCapaPsync2 = 1 << 1 // knows the replication id may change on CONTINUE
+)
+
+// repl-diskless-load
+const (
+	replDisklessLoadDisabled    = iota // the rdb goes to disk first
+	replDisklessLoadWhenDbEmpty        // from the socket if there is no key
+	replDisklessLoadSwapdb             // from the socket, in a temporary keyspace
+)
+
+var replDisklessLoadEnum = []configEnum{
+	{"disabled", replDisklessLoadDisabled},
+	{"on-empty-db", replDisklessLoadWhenDbEmpty},
+	{"swapdb", replDisklessLoadSwapdb},
+}
+
+const (
+	configRunIdSize    = 40
+	replBacklogMinSize = 16 * 1024
+)
+
+// replBacklog is a circular buffer with the end of the replication stream,
+// offset is the replication offset of its first byte.
+type replBacklog struct {
+	buf     []byte
+	idx     int   // where the next byte goes
+	histlen int64 // bytes of the stream it holds
+	offset  int64
+}
+
+// replCachedMaster is where a replica is in the stream of its master once
+// disconnected, to continue it with PSYNC.
+type replCachedMaster struct {
+	replid  string
+	reploff int64
+	dbid    int
+}
+
+// replBulkTransfer is the rdb sent to a replica by a goroutine.
+type replBulkTransfer struct {
+	done chan error
+}
+
+// replHandshake is what the goroutine syncing with the master needs to know
+// of the server.
+type replHandshake struct {
+	addr       string
+	masteruser string
+	masterauth string
+	port       int
+	replid     string // "?" without history to continue
+	offset     int64
+	timeout    time.Duration
+	tmpfile    string
+	// the rdb is left on the socket, for the event loop to load
+	disklessLoad bool
+}
+
+// replSyncTransfer is the handshake with the master in progress.
+type replSyncTransfer struct {
+	cancel context.CancelFunc
+	done   chan *replSyncResult
+}
+
+// replSyncResult is the outcome of the handshake, the conn then belongs to
+// the event loop.
+type replSyncResult struct {
+	conn     *net.TCPConn
+	err      error
+	fullSync bool
+	replid   string // of the master, may be empty on CONTINUE
+	offset   int64  // of the rdb of a full sync
+	tmpfile  string // the rdb of a full sync
+	leftover []byte // the stream read after the reply or the rdb
+	// a diskless load reads the rdb with reader, size bytes or up to mark
+	reader *bufio.Reader
+	size   int64
+	mark   string
+}
+
+// genRunId returns a random id of configRunIdSize hex characters.
+func genRunId() string {
+	buf := make([]byte, configRunIdSize/2)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// changeReplicationId starts a new history, e.g. when the backlog is lost
+// and the offsets of the previous one can't be continued.
+func changeReplicationId() {
+	rServer.replid = genRunId()
+}
+
+func clearReplicationId2() {
+	rServer.replid2 = strings.Repeat("0", configRunIdSize)
+	rServer.secondReplidOffset = -1
+}
+
+// shiftReplicationId makes the history of the master the second id of a
+// replica promoted: the other replicas of the master can continue it with
+// us, up to where we left it.
+func shiftReplicationId() {
+
+	rServer.replid2 = rServer.replid
+	// the replicas ask for the next byte they miss, the first byte of the
+	// new history is the last one they can ask for with the old id
+	rServer.secondReplidOffset = rServer.masterReplOffset + 1
+	changeReplicationId()
+	Log("Setting secondary replication ID to %s, valid up to offset: %d. New replication ID is %s",
+		rServer.replid2, rServer.secondReplidOffset, rServer.replid)
+
+}
+
+func createReplicationBacklog() {
+	rServer.replBacklog = &replBacklog{
+		buf:    make([]byte, rServer.replBacklogSize),
+		offset: rServer.masterReplOffset + 1,
+	}
+}
+
+// resizeReplicationBacklog applies repl-backlog-size, what the backlog held
+// is lost.
+func resizeReplicationBacklog() error {
+	if rServer.replBacklog != nil && int64(len(rServer.replBacklog.buf)) != rServer.replBacklogSize {
+		createReplicationBacklog()
+	}
+	return nil
+}
+
+// feedReplicationBacklog adds p to the stream, the oldest bytes of the
+// backlog are overwritten once full.
+func feedReplicationBacklog(p []byte) {
+
+	rServer.masterReplOffset += int64(len(p))
+	bl := rServer.replBacklog
+	if bl == nil {
+		return
+	}
+
+	for len(p) > 0 {
+		n := copy(bl.buf[bl.idx:], p)
+		bl.idx = (bl.idx + n) % len(bl.buf)
+		bl.histlen += int64(n)
+		p = p[n:]
+	}
+	if bl.histlen > int64(len(bl.buf)) {
+		bl.histlen = int64(len(bl.buf))
+	}
+	bl.offset = rServer.masterReplOffset - bl.histlen + 1
+
+}
+
+// addReplyReplicationBacklog sends the replica the stream from offset, in
+// the backlog. It returns the number of bytes sent.
+func addReplyReplicationBacklog(c *client, offset int64) int64 {
+
+	bl := rServer.replBacklog
+	size := int64(len(bl.buf))
+	skip := offset - bl.offset
+
+	// the oldest byte follows the newest one once the buffer is full
+	j := (int64(bl.idx) + size - bl.histlen) % size
+	j = (j + skip) % size
+	n := bl.histlen - skip
+	for left := n; left > 0; {
+		chunk := size - j
+		if chunk > left {
+			chunk = left
+		}
+		addReply(c, bl.buf[j:j+chunk])
+		left -= chunk
+		j = 0
+	}
+	return n
+
+}
+
+// replicationFeedSlaves feeds a command propagated to the backlog and the
+// replicas, dbid -1 meaning it does not depend on the db. A replica feeds
+// the stream of its master instead, see replicationFeedStreamFromMasterStream.
+func replicationFeedSlaves(dbid int, argv []*rObj) {
+
+	if rServer.masterhost != "" {
+		return
+	}
+	// the offset moves anyway, WAITAOF tracks the fsyncs of the AOF with it
+	if rServer.replBacklog == nil && rServer.slaves.Len() == 0 {
+		rServer.masterReplOffset++
+		return
+	}
+
+	var buf []byte
+	if dbid != -1 && dbid != rServer.slaveseldb {
+		buf = catAppendOnlyGenericCommand(buf, []*rObj{
+			createEmbeddedStringObject("SELECT"), createStringObjectFromLongLong(int64(dbid)),
+		})
+		rServer.slaveseldb = dbid
+	}
+	buf = catAppendOnlyGenericCommand(buf, argv)
+	feedReplicationBuffer(buf)
+
+}
+
+// feedReplicationBuffer adds p to the stream of the backlog and of the
+// replicas.
+func feedReplicationBuffer(p []byte) {
+
+	feedReplicationBacklog(p)
+	for ele := rServer.slaves.Front(); ele != nil; ele = ele.Next() {
+		slave := ele.Value.(*client)
+		// the stream of a replica starts with the BGSAVE it waits for
+		if slave.replState == slaveStateWaitBgsaveStart {
+			continue
+		}
+		addReply(slave, p)
+	}
+
+}
+
+// replicationFeedStreamFromMasterStream feeds the stream the master client
+// applied since the last call to the backlog and the replicas of a replica,
+// and moves its offset. It is called once a command of the master is done,
+// a transaction once EXEC is.
+func replicationFeedStreamFromMasterStream(c *client) {
+
+	applied := c.readReploff - int64(len(c.queryBuf)) - c.reploff
+	if applied <= 0 {
+		return
+	}
+	feedReplicationBuffer(c.pendingReplStream[:applied])
+	c.pendingReplStream = c.pendingReplStream[applied:]
+	c.reploff += applied
+
+}
+
+// replicationGetSlaveName returns the address the replica listens to, the
+// one it connected from when it did not tell.
+func replicationGetSlaveName(c *client) string {
+
+	host := c.slaveAddr
+	if host == "" && c.conn != nil {
+		host, _, _ = net.SplitHostPort(c.conn.RemoteAddr().String())
+	}
+	if c.slaveListeningPort != 0 {
+		return net.JoinHostPort(host, strconv.Itoa(c.slaveListeningPort))
+	}
+	return host
+
+}
+
+// syncCommand implements PSYNC <replid> <offset>, the replica asks for the
+// stream from offset, or for the whole dataset first.
+func syncCommand(c *client) {
+
+	// a replica asking again is ignored
+	if c.flag&clientSlave != 0 {
+		return
+	}
+	// a replica can only give the stream it is in sync with
+	if rServer.masterhost != "" && rServer.replState != replStateConnected {
+		addReplyError(c, "-NOMASTERLINK Can't SYNC while not connected with my master")
+		return
+	}
+	// from now on the output of the client is the stream
+	if c.hasPendingOutputs() {
+		addReplyError(c, "SYNC and PSYNC are invalid with pending output")
+		return
+	}
+	offset, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+
+	Log("Replica %s asks for synchronization", replicationGetSlaveName(c))
+	replid := c.argv[1].String()
+	if masterTryPartialResynchronization(c, replid, offset) {
+		rServer.statSyncPartialOk++
+		return
+	}
+	if replid != "?" {
+		rServer.statSyncPartialErr++
+	}
+
+	rServer.statSyncFull++
+	c.replState = slaveStateWaitBgsaveStart
+	c.replAckTime = time.Now()
+	c.flag |= clientSlave
+	rServer.slaves.PushBack(c)
+
+	// without a backlog the history so far can't be continued anyway
+	if rServer.slaves.Len() == 1 && rServer.replBacklog == nil {
+		changeReplicationId()
+		clearReplicationId2()
+		createReplicationBacklog()
+		Log("Replication backlog created, my new replication IDs are '%s' and '%s'", rServer.replid, rServer.replid2)
+	}
+
+	switch {
+	case rServer.rdbChild != nil && rServer.rdbChild.kind == rdbChildTypeDisk:
+		// the replicas waiting for the BGSAVE in progress have the stream
+		// since it started, the new one can have the same
+		if other := slaveWaitingBgsaveEnd(); other != nil {
+			copyReplicaOutputBuffer(c, other)
+			replicationSetupSlaveForFullResync(c, other.psyncInitialOffset)
+			Log("Waiting for end of BGSAVE for SYNC")
+		} else {
+			Log("Can't attach the replica to the current BGSAVE. Waiting for next BGSAVE for SYNC")
+		}
+	case rServer.rdbChild != nil:
+		// the sockets of a diskless BGSAVE are chosen once started
+		Log("Current BGSAVE has socket target. Waiting for next BGSAVE for SYNC")
+	case rServer.replDisklessSync && c.slaveCapa&slaveCapaEOF != 0 && rServer.replDisklessSyncDelay > 0:
+		// the replicas arriving meanwhile get the same rdb, see
+		// replicationStartPendingFork
+		Log("Delay next BGSAVE for diskless SYNC")
+	case hasActiveChildProcess():
+		Log("No BGSAVE in progress, but another BG operation is active. BGSAVE for replication delayed")
+	default:
+		startBgsaveForReplication(c.slaveCapa)
+	}
+
+}
+
+// masterTryPartialResynchronization continues the stream of the replica
+// from offset when it is in the backlog. It returns false when the replica
+// needs a full sync.
+func masterTryPartialResynchronization(c *client, replid string, offset int64) bool {
+
+	// the history asked is ours, or the one of our master up to when we
+	// were promoted
+	if !strings.EqualFold(replid, rServer.replid) &&
+		(!strings.EqualFold(replid, rServer.replid2) || offset > rServer.secondReplidOffset) {
+		switch {
+		case replid == "?":
+			Log("Full resync requested by replica %s", replicationGetSlaveName(c))
+		case !strings.EqualFold(replid, rServer.replid2):
+			Log("Partial resynchronization not accepted: Replication ID mismatch (Replica asked for '%s', my replication IDs are '%s' and '%s')",
+				replid, rServer.replid, rServer.replid2)
+		default:
+			Log("Partial resynchronization not accepted: Requested offset for second ID was %d, but I can reply up to %d",
+				offset, rServer.secondReplidOffset)
+		}
+		return false
+	}
+
+	bl := rServer.replBacklog
+	if bl == nil || offset < bl.offset || offset > bl.offset+bl.histlen {
+		Log("Unable to partial resync with replica %s for lack of backlog (Replica request was: %d).",
+			replicationGetSlaveName(c), offset)
+		if offset > rServer.masterReplOffset {
+			Log("Warning: replica %s tried to PSYNC with an offset that is greater than the master replication offset.",
+				replicationGetSlaveName(c))
+		}
+		return false
+	}
+
+	c.flag |= clientSlave
+	c.replState = slaveStateOnline
+	c.replAckTime = time.Now()
+	rServer.slaves.PushBack(c)
+	// the reply goes before the stream, nothing else is pending
+	if _, err := c.conn.Write([]byte("+CONTINUE " + rServer.replid + "\r\n")); err != nil {
+		freeClientAsync(c)
+		return true
+	}
+	n := addReplyReplicationBacklog(c, offset)
+	Log("Partial resynchronization request from %s accepted. Sending %d bytes of backlog starting from offset %d.",
+		replicationGetSlaveName(c), n, offset)
+	return true
+
+}
+
+func slaveWaitingBgsaveEnd() *client {
+	for ele := rServer.slaves.Front(); ele != nil; ele = ele.Next() {
+		if slave := ele.Value.(*client); slave.replState == slaveStateWaitBgsaveEnd {
+			return slave
+		}
+	}
+	return nil
+}
+
+// copyReplicaOutputBuffer gives dst, without output yet, the output src has
+// not sent.
+func copyReplicaOutputBuffer(dst, src *client) {
+
+	dst.reply = src.reply
+	dst.replyPos = src.replyPos
+	if src.replyList == nil {
+		return
+	}
+	dst.replyList = list.New()
+	for ele := src.replyList.Front(); ele != nil; ele = ele.Next() {
+		block := *ele.Value.(*bufferBlock)
+		block.data = append([]byte(nil), block.data...)
+		dst.replyList.PushBack(&block)
+	}
+
+}
+
+// replicationSetupSlaveForFullResync tells the replica the stream it gets
+// after the rdb starts at offset.
+func replicationSetupSlaveForFullResync(slave *client, offset int64) {
+
+	slave.psyncInitialOffset = offset
+	slave.replState = slaveStateWaitBgsaveEnd
+	// the stream after the rdb starts with a SELECT
+	rServer.slaveseldb = -1
+	reply := fmt.Sprintf("+FULLRESYNC %s %d\r\n", rServer.replid, offset)
+	if _, err := slave.conn.Write([]byte(reply)); err != nil {
+		freeClientAsync(slave)
+	}
+
+}
+
+// startBgsaveForReplication starts the BGSAVE the replicas waiting to start
+// their full sync are sent.
+// The rdb goes to the sockets of the replicas when diskless and all of them,
+// mincapa, read an rdb of unknown length.
+func startBgsaveForReplication(mincapa int) {
+
+	var err error
+	if rServer.replDisklessSync && mincapa&slaveCapaEOF != 0 {
+		Log("Starting BGSAVE for SYNC with target: replicas sockets")
+		err = rdbSaveToSlavesSockets()
+	} else {
+		Log("Starting BGSAVE for SYNC with target: disk")
+		err = rdbSaveBackground(rdbPath())
+	}
+	if err != nil {
+		Log("BGSAVE for replication failed, %v", err)
+	}
+
+	for ele := rServer.slaves.Front(); ele != nil; {
+		slave := ele.Value.(*client)
+		ele = ele.Next()
+		if slave.replState != slaveStateWaitBgsaveStart {
+			continue
+		}
+		if err != nil {
+			unlinkSlave(slave)
+			addReplyError(slave, "BGSAVE failed, replication can't continue")
+			slave.flag |= clientCloseAfterReply
+			continue
+		}
+		replicationSetupSlaveForFullResync(slave, rServer.masterReplOffset)
+	}
+
+}
+
+// replicationStartPendingFork starts the BGSAVE the replicas wait for, once
+// no other child runs. A diskless one waits repl-diskless-sync-delay for
+// more replicas to share it, or until repl-diskless-sync-max-replicas
+// are waiting.
+func replicationStartPendingFork() {
+
+	if hasActiveChildProcess() {
+		return
+	}
+
+	var maxIdle time.Duration
+	waiting, mincapa := 0, -1
+	for ele := rServer.slaves.Front(); ele != nil; ele = ele.Next() {
+		slave := ele.Value.(*client)
+		if slave.replState != slaveStateWaitBgsaveStart {
+			continue
+		}
+		maxIdle = max(maxIdle, time.Since(slave.lastInteraction))
+		waiting++
+		mincapa &= slave.slaveCapa
+	}
+	if waiting == 0 {
+		return
+	}
+	if !rServer.replDisklessSync ||
+		(rServer.replDisklessSyncMaxReplicas > 0 && waiting >= rServer.replDisklessSyncMaxReplicas) ||
+		maxIdle >= time.Duration(rServer.replDisklessSyncDelay)*time.Second {
+		startBgsaveForReplication(mincapa)
+	}
+
+}
+
+// updateSlavesWaitingBgsave sends the rdb of the BGSAVE done to the replicas
+// waiting for it, the ones of a diskless BGSAVE have it already. It is
+// called once the BGSAVE is done.
+func updateSlavesWaitingBgsave(child *rdbChild, bgsaveErr error) {
+
+	var socketErrs map[*client]error
+	if child.kind == rdbChildTypeSocket {
+		socketErrs = make(map[*client]error, len(child.targets))
+		for _, t := range child.targets {
+			socketErrs[t.slave] = t.err
+		}
+	}
+
+	for ele := rServer.slaves.Front(); ele != nil; ele = ele.Next() {
+		slave := ele.Value.(*client)
+		if slave.replState != slaveStateWaitBgsaveEnd {
+			continue
+		}
+		if bgsaveErr != nil {
+			Log("SYNC failed. BGSAVE child returned an error")
+			freeClientAsync(slave)
+			continue
+		}
+
+		if child.kind == rdbChildTypeSocket {
+			if err := socketErrs[slave]; err != nil {
+				Log("Diskless rdb transfer to replica %s failed, %v", replicationGetSlaveName(slave), err)
+				freeClientAsync(slave)
+				continue
+			}
+			// the replica reads the rdb until the EOF mark, the stream
+			// can't follow it until it says it loaded it. It may have
+			// said so before the transfer was reaped.
+			if slave.replAckTime.After(child.start) {
+				putSlaveOnline(slave)
+				continue
+			}
+			Log("Streamed RDB transfer with replica %s succeeded (socket). Waiting for REPLCONF ACK from replica to enable streaming",
+				replicationGetSlaveName(slave))
+			slave.replStartCmdStreamOnAck = true
+			putSlaveOnline(slave)
+			continue
+		}
+
+		f, err := os.Open(rdbPath())
+		var info os.FileInfo
+		if err == nil {
+			info, err = f.Stat()
+		}
+		if err != nil {
+			Log("SYNC failed. Can't open/stat DB after BGSAVE: %v", err)
+			if f != nil {
+				_ = f.Close()
+			}
+			freeClientAsync(slave)
+			continue
+		}
+		slave.replState = slaveStateSendBulk
+		slave.replBulk = sendBulkToSlave(slave.conn, f, info.Size())
+	}
+
+}
+
+// sendBulkToSlave sends the rdb f from a goroutine, the event loop writes
+// nothing else to the replica until it is done.
+func sendBulkToSlave(conn *net.TCPConn, f *os.File, size int64) *replBulkTransfer {
+
+	t := &replBulkTransfer{done: make(chan error, 1)}
+	go func() {
+		defer f.Close()
+		_, err := fmt.Fprintf(conn, "$%d\r\n", size)
+		if err == nil {
+			_, err = io.CopyN(conn, f, size)
+		}
+		t.done <- err
+	}()
+	return t
+
+}
+
+// putSlaveOnline starts sending the stream to a replica that has its rdb,
+// or once it acknowledges it with replStartCmdStreamOnAck.
+func putSlaveOnline(slave *client) {
+
+	slave.replState = slaveStateOnline
+	slave.replAckTime = time.Now()
+	if slave.replStartCmdStreamOnAck {
+		return
+	}
+	replicaStartCommandStream(slave)
+	Log("Synchronization with replica %s succeeded", replicationGetSlaveName(slave))
+
+}
+
+// replicaStartCommandStream sends the stream buffered for the replica.
+func replicaStartCommandStream(slave *client) {
+	slave.replStartCmdStreamOnAck = false
+	if slave.hasPendingOutputs() && slave.flag&clientPendingWrite == 0 {
+		queueClientPendingWrite(slave)
+	}
+}
+
+func unlinkSlave(c *client) {
+
+	for ele := rServer.slaves.Front(); ele != nil; ele = ele.Next() {
+		if ele.Value.(*client) == c {
+			rServer.slaves.Remove(ele)
+			break
+		}
+	}
+	c.flag &^= clientSlave
+	c.replState = 0
+	if rServer.slaves.Len() == 0 {
+		rServer.replNoSlavesSince = time.Now()
+	}
+
+}
+
+// replicationFreeSlave forgets a replica being freed.
+func replicationFreeSlave(c *client) {
+	Log("Connection with replica %s lost.", replicationGetSlaveName(c))
+	unlinkSlave(c)
+}
+
+// disconnectSlaves closes the link with the replicas, they connect again
+// and learn about a history that changed.
+func disconnectSlaves() {
+	for rServer.slaves.Len() > 0 {
+		freeClient(rServer.slaves.Front().Value.(*client))
+	}
+}
+
+// replconfCommand implements REPLCONF <option> <value> [<option> <value> ...],
+// the replicas tell about themselves during the handshake and acknowledge
+// the stream they applied.
+func replconfCommand(c *client) {
+
+	if c.argc%2 == 0 {
+		addReply(c, shared.syntaxErr)
+		return
+	}
+
+	for j := 1; j < c.argc; j += 2 {
+		val := c.argv[j+1]
+		switch strings.ToLower(c.argv[j].String()) {
+		case "listening-port":
+			port, ok := getRangeLongFromObjectOrReply(c, val, 0, 65535, "")
+			if !ok {
+				return
+			}
+			c.slaveListeningPort = int(port)
+		case "ip-address":
+			c.slaveAddr = val.String()
+		case "capa":
+			// the capabilities we don't know are ignored
+			switch strings.ToLower(val.String()) {
+			case "eof":
+				c.slaveCapa |= slaveCapaEOF
+			case "psync2":
+				c.slaveCapa |= slaveCapaPsync2
+			}
+		case "ack":
+			// the offset applied by the replica, never replied
+			if c.flag&clientSlave == 0 {
+				return
+			}
+			if offset, ok := getLongLongFromObject(val); ok && offset > c.replAckOff {
+				c.replAckOff = offset
+			}
+			// REPLCONF ACK <offset> FACK <aofoffset>
+			if c.argc > j+3 && strings.EqualFold(c.argv[j+2].String(), "fack") {
+				if offset, ok := getLongLongFromObject(c.argv[j+3]); ok && offset > c.replAofOff {
+					c.replAofOff = offset
+				}
+			}
+			c.replAckTime = time.Now()
+			// the first ACK after a diskless sync, the replica loaded the rdb
+			if c.replStartCmdStreamOnAck && c.replState == slaveStateOnline {
+				replicaStartCommandStream(c)
+			}
+			if rServer.clientsWaitingAcks.Len() > 0 {
+				processClientsWaitingReplicas()
+			}
+			return
+		case "getack":
+			// the master wants our offset right away
+			if rServer.masterhost != "" && rServer.master != nil {
+				replicationSendAck()
+			}
+			return
+		default:
+			addReplyErrorFormat(c, "Unrecognized REPLCONF option: %s", c.argv[j].String())
+			return
+		}
+	}
+	addReply(c, shared.ok)
+
+}
+
+// replicationSendAck tells the master the offset of the stream applied, and
+// the one fsynced to the AOF.
+func replicationSendAck() {
+
+	c := rServer.master
+	c.flag |= clientMasterForceReply
+	addReplyArrayLen(c, 5)
+	addReplyBulkString(c, "REPLCONF")
+	addReplyBulkString(c, "ACK")
+	addReplyBulkString(c, strconv.FormatInt(c.reploff, 10))
+	addReplyBulkString(c, "FACK")
+	addReplyBulkString(c, strconv.FormatInt(rServer.fsyncedReploff, 10))
+	c.flag &^= clientMasterForceReply
+
+}
+
+// connectWithMaster starts the handshake with the master in a goroutine,
+// see replicationSyncDone.
+func connectWithMaster() {
+
+	hs := &replHandshake{
+		addr:       net.JoinHostPort(rServer.masterhost, strconv.Itoa(rServer.masterport)),
+		masteruser: rServer.masteruser,
+		masterauth: rServer.masterauth,
+		port:       rServer.port,
+		replid:     "?",
+		offset:     -1,
+		timeout:    time.Duration(rServer.replTimeout) * time.Second,
+		tmpfile:    filepath.Join(rServer.dir, fmt.Sprintf("temp-%d.%d.rdb", time.Now().Unix(), os.Getpid())),
+		disklessLoad: rServer.replDisklessLoad == replDisklessLoadSwapdb ||
+			(rServer.replDisklessLoad == replDisklessLoadWhenDbEmpty && dbTotalServerKeyCount() == 0),
+	}
+	if cm := rServer.cachedMaster; cm != nil {
+		hs.replid, hs.offset = cm.replid, cm.reploff+1
+		Log("Trying a partial resynchronization (request %s:%d).", hs.replid, hs.offset)
+	} else {
+		Log("Partial resynchronization not possible (no cached master)")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &replSyncTransfer{cancel: cancel, done: make(chan *replSyncResult, 1)}
+	go func() {
+		t.done <- syncWithMaster(ctx, hs)
+	}()
+	rServer.replTransfer = t
+	rServer.replState = replStateConnecting
+	Log("MASTER <-> REPLICA sync started")
+
+}
+
+// deadlineReader moves the read deadline of conn on every read, a transfer
+// times out when the master is silent for too long, not when it is long.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	_ = dr.conn.SetReadDeadline(time.Now().Add(dr.timeout))
+	return dr.conn.Read(p)
+}
+
+// syncWithMaster runs the handshake, and receives the rdb of a full sync to
+// a temp file. It runs in a goroutine, touching nothing of the server.
+func syncWithMaster(ctx context.Context, hs *replHandshake) (res *replSyncResult) {
+
+	res = &replSyncResult{}
+	dialer := net.Dialer{Timeout: hs.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", hs.addr)
+	if err != nil {
+		res.err = fmt.Errorf("error condition on socket for SYNC: %w", err)
+		return res
+	}
+	// canceling the handshake closes the conn, failing the read in progress
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer func() {
+		stop()
+		if res.err != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	r := bufio.NewReader(&deadlineReader{conn: conn, timeout: hs.timeout})
+	sendCommand := func(args ...string) (string, error) {
+		_ = conn.SetWriteDeadline(time.Now().Add(hs.timeout))
+		cmd := fmt.Appendf(nil, "*%d\r\n", len(args))
+		for _, arg := range args {
+			cmd = fmt.Appendf(cmd, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+		if _, err := conn.Write(cmd); err != nil {
+			return "", err
+		}
+		return readSyncLine(r)
+	}
+
+	reply, err := sendCommand("PING")
+	if err != nil {
+		res.err = fmt.Errorf("error reading PING reply from master: %w", err)
+		return res
+	}
+	// the master asking for AUTH refuses PING, AUTH comes next
+	if strings.HasPrefix(reply, "-") && !strings.HasPrefix(reply, "-NOAUTH") &&
+		!strings.HasPrefix(reply, "-NOPERM") && !strings.HasPrefix(reply, "-ERR operation not permitted") {
+		res.err = fmt.Errorf("error reply to PING from master: '%s'", reply)
+		return res
+	}
+
+	if hs.masterauth != "" {
+		args := []string{"AUTH", hs.masterauth}
+		if hs.masteruser != "" {
+			args = []string{"AUTH", hs.masteruser, hs.masterauth}
+		}
+		if reply, err = sendCommand(args...); err == nil && strings.HasPrefix(reply, "-") {
+			err = errors.New(reply)
+		}
+		if err != nil {
+			res.err = fmt.Errorf("unable to AUTH to MASTER: %w", err)
+			return res
+		}
+	}
+
+	// the master can do without these
+	if reply, err = sendCommand("REPLCONF", "listening-port", strconv.Itoa(hs.port)); err != nil {
+		res.err = err
+		return res
+	} else if strings.HasPrefix(reply, "-") {
+		Log("(Non critical) Master does not understand REPLCONF listening-port: %s", reply)
+	}
+	if reply, err = sendCommand("REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		res.err = err
+		return res
+	} else if strings.HasPrefix(reply, "-") {
+		Log("(Non critical) Master does not understand REPLCONF capa: %s", reply)
+	}
+
+	if reply, err = sendCommand("PSYNC", hs.replid, strconv.FormatInt(hs.offset, 10)); err != nil {
+		res.err = fmt.Errorf("error reading PSYNC reply from master: %w", err)
+		return res
+	}
+	switch {
+	case strings.HasPrefix(reply, "+CONTINUE"):
+		res.replid = strings.TrimSpace(reply[len("+CONTINUE"):])
+	case strings.HasPrefix(reply, "+FULLRESYNC"):
+		fields := strings.Fields(reply)
+		if len(fields) != 3 || len(fields[1]) != configRunIdSize {
+			res.err = fmt.Errorf("master replied with wrong +FULLRESYNC syntax: '%s'", reply)
+			return res
+		}
+		res.fullSync, res.replid = true, fields[1]
+		if res.offset, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			res.err = fmt.Errorf("master replied with wrong +FULLRESYNC syntax: '%s'", reply)
+			return res
+		}
+		Log("Full resync from master: %s:%d", res.replid, res.offset)
+		if res.size, res.mark, res.err = readSyncBulkHeader(r); res.err != nil {
+			return res
+		}
+		if hs.disklessLoad {
+			// the event loop reads the rest, see replicationLoadFromSocket
+			res.reader = r
+			res.conn = conn.(*net.TCPConn)
+			return res
+		}
+		if res.err = readSyncBulkPayload(r, res.size, res.mark, hs.tmpfile); res.err != nil {
+			return res
+		}
+		res.tmpfile = hs.tmpfile
+	case strings.HasPrefix(reply, "-NOMASTERLINK"), strings.HasPrefix(reply, "-LOADING"):
+		res.err = fmt.Errorf("master is currently unable to PSYNC but should be in the future: %s", reply)
+		return res
+	default:
+		res.err = fmt.Errorf("unexpected reply to PSYNC from master: %s", reply)
+		return res
+	}
+
+	// the stream read along with the reply is the first to apply
+	res.leftover, _ = r.Peek(r.Buffered())
+	res.leftover = append([]byte(nil), res.leftover...)
+	_ = conn.SetDeadline(time.Time{})
+	res.conn = conn.(*net.TCPConn)
+	return res
+
+}
+
+// readSyncLine reads a reply line, skipping the newlines the master sends
+// to keep the link alive while it prepares the rdb.
+func readSyncLine(r *bufio.Reader) (string, error) {
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			return line, nil
+		}
+	}
+
+}
+
+// readSyncBulkHeader reads the length of the rdb of a full sync, or the mark
+// ending it when the master streams it without knowing the length.
+func readSyncBulkHeader(r *bufio.Reader) (size int64, mark string, err error) {
+
+	line, err := readSyncLine(r)
+	if err != nil {
+		return 0, "", fmt.Errorf("I/O error reading bulk count from MASTER: %w", err)
+	}
+	if strings.HasPrefix(line, "-") {
+		return 0, "", fmt.Errorf("MASTER aborted replication with an error: %s", line[1:])
+	}
+	if strings.HasPrefix(line, "$EOF:") && len(line) == len("$EOF:")+rdbEOFMarkSize {
+		return -1, line[len("$EOF:"):], nil
+	}
+	size, err = strconv.ParseInt(strings.TrimPrefix(line, "$"), 10, 64)
+	if line[0] != '$' || err != nil || size < 0 {
+		return 0, "", fmt.Errorf("bad protocol from MASTER, the first byte is not '$' (we received '%s'), are you sure the host and port are right?", line)
+	}
+	return size, "", nil
+
+}
+
+// readSyncBulkPayload receives the rdb of a full sync to tmpfile, size bytes
+// or up to mark.
+func readSyncBulkPayload(r *bufio.Reader, size int64, mark string, tmpfile string) error {
+
+	if mark != "" {
+		Log("MASTER <-> REPLICA sync: receiving streamed RDB from master with EOF to disk")
+	} else {
+		Log("MASTER <-> REPLICA sync: receiving %d bytes from master to disk", size)
+	}
+
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return fmt.Errorf("opening the temp file needed for MASTER <-> REPLICA synchronization: %w", err)
+	}
+	if mark != "" {
+		err = copyUntilEOFMark(f, r, mark)
+	} else {
+		_, err = io.CopyN(f, r, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmpfile)
+		return fmt.Errorf("I/O error trying to sync with MASTER: %w", err)
+	}
+	return nil
+
+}
+
+// copyUntilEOFMark copies r to f until the last bytes read are mark, which
+// is then truncated. The master sends nothing after the mark before our ACK.
+func copyUntilEOFMark(f *os.File, r *bufio.Reader, mark string) error {
+
+	buf := make([]byte, 16*1024)
+	last := make([]byte, 0, 2*len(mark))
+	var written int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := f.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			written += int64(n)
+			if n >= len(mark) {
+				last = append(last[:0], buf[n-len(mark):n]...)
+			} else {
+				last = append(last, buf[:n]...)
+				if len(last) > len(mark) {
+					last = append(last[:0], last[len(last)-len(mark):]...)
+				}
+			}
+			if string(last) == mark {
+				return f.Truncate(written - int64(len(mark)))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+}
+
+// replicationSyncDone takes over the link of the handshake done, as the
+// master client, once the rdb of a full sync is loaded.
+func replicationSyncDone(res *replSyncResult) {
+
+	if res.err != nil {
+		Log("MASTER <-> REPLICA sync failed, %v", res.err)
+		rServer.replState = replStateConnect
+		return
+	}
+
+	if !res.fullSync {
+		cm := rServer.cachedMaster
+		// the master was promoted, the history goes on under its new id
+		if res.replid != "" && res.replid != cm.replid {
+			rServer.replid2 = cm.replid
+			rServer.secondReplidOffset = rServer.masterReplOffset + 1
+			rServer.replid = res.replid
+			Log("Master replication ID changed to %s", res.replid)
+			// our replicas learn about it reconnecting
+			disconnectSlaves()
+		}
+		rServer.cachedMaster = nil
+		if rServer.replBacklog == nil {
+			createReplicationBacklog()
+		}
+		replicationCreateMasterClient(res.conn, res.leftover, cm.reploff, cm.dbid)
+		Log("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization.")
+		return
+	}
+
+	// a full sync replaces the dataset and the history
+	rServer.cachedMaster = nil
+	disconnectSlaves()
+	rServer.replBacklog = nil
+	if rServer.aofState != aofOff {
+		stopAppendOnly()
+	}
+	if res.reader != nil {
+		if err := replicationLoadFromSocket(res); err != nil {
+			Log("Failed trying to load the MASTER synchronization DB from socket, %v", err)
+			_ = res.conn.Close()
+			rServer.replState = replStateConnect
+			return
+		}
+	} else {
+		Log("MASTER <-> REPLICA sync: Flushing old data")
+		emptyDb(-1)
+
+		Log("MASTER <-> REPLICA sync: Loading DB in memory")
+		err := os.Rename(res.tmpfile, rdbPath())
+		if err == nil {
+			rServer.loading = true
+			err = rdbLoad(rdbPath())
+			rServer.loading = false
+		}
+		if err != nil {
+			Log("Failed trying to load the MASTER synchronization DB from disk, %v", err)
+			_ = os.Remove(res.tmpfile)
+			emptyDb(-1)
+			_ = res.conn.Close()
+			rServer.replState = replStateConnect
+			return
+		}
+	}
+
+	rServer.replid = res.replid
+	clearReplicationId2()
+	rServer.masterReplOffset = res.offset
+	createReplicationBacklog()
+	replicationCreateMasterClient(res.conn, res.leftover, res.offset, -1)
+	// the master streaming the rdb waits for the ACK to send the stream
+	if res.mark != "" && rServer.master != nil {
+		replicationSendAck()
+	}
+	Log("MASTER <-> REPLICA sync: Finished with success")
+
+	if rServer.aofEnabled {
+		restartAOFAfterSYNC()
+	}
+
+}
+
+// replicationLoadFromSocket loads the rdb of a full sync as it is read from
+// the link with the master. With swapdb the rdb is loaded in a temporary
+// keyspace, the dataset is left as it was if the load fails.
+func replicationLoadFromSocket(res *replSyncResult) error {
+
+	swapdb := rServer.replDisklessLoad == replDisklessLoadSwapdb
+	dbs := rServer.db
+	if swapdb {
+		dbs = createDbArray(rServer.dbnum)
+	} else {
+		Log("MASTER <-> REPLICA sync: Flushing old data")
+		emptyDb(-1)
+	}
+
+	// the rdb of a known length may be followed by the stream
+	r, lr := res.reader, (*io.LimitedReader)(nil)
+	if res.mark == "" {
+		lr = &io.LimitedReader{R: res.reader, N: res.size}
+		r = bufio.NewReaderSize(lr, 64*1024)
+	}
+	Log("MASTER <-> REPLICA sync: Loading DB in memory from socket")
+	rServer.loading = true
+	err := rdbLoadRio(&rdbReader{r: r}, dbs)
+	rServer.loading = false
+	if err == nil && res.mark != "" {
+		mark := make([]byte, rdbEOFMarkSize)
+		if _, err = io.ReadFull(r, mark); err == nil && string(mark) != res.mark {
+			err = errors.New("replication stream EOF marker is broken")
+		}
+	} else if err == nil && (lr.N != 0 || r.Buffered() != 0) {
+		err = errors.New("the rdb is shorter than the bulk sent by the master")
+	}
+	if err != nil {
+		if swapdb {
+			Log("MASTER <-> REPLICA sync: Discarding the half-loaded data, the old dataset is kept")
+		} else {
+			emptyDb(-1)
+		}
+		return err
+	}
+
+	if swapdb {
+		Log("MASTER <-> REPLICA sync: Swapping the loaded data with the old dataset")
+		swapMainDbWithTempDb(dbs)
+	}
+	res.leftover, _ = res.reader.Peek(res.reader.Buffered())
+	res.leftover = append([]byte(nil), res.leftover...)
+	_ = res.conn.SetDeadline(time.Time{})
+	return nil
+
+}
+
+// restartAOFAfterSYNC turns on again the AOF turned off during the sync, it
+// starts from the dataset of the master.
+func restartAOFAfterSYNC() {
+	if err := startAppendOnly(); err != nil {
+		Log("Failed enabling the AOF after successful master synchronization! Exiting.")
+		os.Exit(1)
+	}
+}
+
+// replicationCreateMasterClient makes conn the master client, applying the
+// stream from reploff, starting with leftover.
+func replicationCreateMasterClient(conn *net.TCPConn, leftover []byte, reploff int64, dbid int) {
+
+	c, err := createClient(rServer.el, conn)
+	if err != nil {
+		Log("Can't create the master client, %v", err)
+		_ = conn.Close()
+		rServer.replState = replStateConnect
+		return
+	}
+	c.flag |= clientMaster | clientDenyBlocking
+	c.authenticated = true
+	c.reploff, c.readReploff = reploff, reploff
+	c.lastInteraction = time.Now()
+	if dbid != -1 {
+		c.db = rServer.db[dbid]
+	}
+	rServer.master = c
+	rServer.replState = replStateConnected
+
+	if len(leftover) > 0 {
+		c.queryBuf = append(c.queryBuf, leftover...)
+		c.pendingReplStream = append(c.pendingReplStream, leftover...)
+		c.readReploff += int64(len(leftover))
+		processInputBuffer(c)
+	}
+
+}
+
+// replicationCacheMaster remembers where the stream of the master freed
+// was, to continue it once connected again.
+func replicationCacheMaster(c *client) {
+
+	Log("Connection with master lost.")
+	Log("Caching the disconnected master state.")
+	rServer.cachedMaster = &replCachedMaster{replid: rServer.replid, reploff: c.reploff, dbid: c.db.id}
+	rServer.master = nil
+	rServer.replDownSince = time.Now()
+	if rServer.masterhost != "" {
+		rServer.replState = replStateConnect
+	}
+
+}
+
+// replicationCacheMasterUsingMyself lets a master turned replica continue
+// its own history, the new master may have it when it was our replica.
+func replicationCacheMasterUsingMyself() {
+	Log("Before turning into a replica, using my own master parameters to synthesize a cached master: " +
+		"I may be able to synchronize with the new master with just a partial transfer.")
+	rServer.cachedMaster = &replCachedMaster{replid: rServer.replid, reploff: rServer.masterReplOffset, dbid: 0}
+}
+
+// cancelReplicationHandshake stops the handshake in progress, the transfer
+// of the rdb with it.
+func cancelReplicationHandshake() {
+
+	t := rServer.replTransfer
+	if t == nil {
+		return
+	}
+	t.cancel()
+	if res := <-t.done; res.err == nil {
+		_ = res.conn.Close()
+		if res.tmpfile != "" {
+			_ = os.Remove(res.tmpfile)
+		}
+	}
+	rServer.replTransfer = nil
+	if rServer.masterhost != "" {
+		rServer.replState = replStateConnect
+	}
+
+}
+
+// replicationSetMaster turns the server into a replica of host:port.
+func replicationSetMaster(host string, port int) {
+
+	wasMaster := rServer.masterhost == ""
+	rServer.masterhost, rServer.masterport = host, port
+	if rServer.master != nil {
+		freeClient(rServer.master)
+	}
+	disconnectAllBlockedClients()
+	// our replicas follow the history of the new master with us
+	disconnectSlaves()
+	cancelReplicationHandshake()
+	if wasMaster {
+		replicationCacheMasterUsingMyself()
+	}
+	rServer.replState = replStateConnect
+	Log("Connecting to MASTER %s:%d", host, port)
+	connectWithMaster()
+
+}
+
+// replicationUnsetMaster promotes a replica, its history goes on as ours.
+func replicationUnsetMaster() {
+
+	if rServer.masterhost == "" {
+		return
+	}
+	rServer.masterhost = ""
+	if rServer.master != nil {
+		freeClient(rServer.master)
+	}
+	rServer.cachedMaster = nil
+	cancelReplicationHandshake()
+	// the replicas of our master can continue with us, up to here
+	shiftReplicationId()
+	// ours learn about the new id reconnecting
+	disconnectSlaves()
+	rServer.replState = replStateNone
+	// the replicas may not be in the db the stream goes on with
+	rServer.slaveseldb = -1
+	rServer.replNoSlavesSince = time.Now()
+	// the AOF turned off by a sync that failed
+	if rServer.aofEnabled && rServer.aofState == aofOff {
+		restartAOFAfterSYNC()
+	}
+
+}
+
+// replicaofCommand implements REPLICAOF <host> <port> and REPLICAOF NO ONE.
+func replicaofCommand(c *client) {
+
+	host := c.argv[1].String()
+	if strings.EqualFold(host, "no") && strings.EqualFold(c.argv[2].String(), "one") {
+		if rServer.masterhost != "" {
+			replicationUnsetMaster()
+			Log("MASTER MODE enabled (user request from '%s')", catClientInfoString(c))
+		}
+		addReply(c, shared.ok)
+		return
+	}
+
+	if c.flag&clientSlave != 0 {
+		addReplyError(c, "Command is not valid when client is a replica.")
+		return
+	}
+	port, ok := getRangeLongFromObjectOrReply(c, c.argv[2], 0, 65535, "Invalid master port")
+	if !ok {
+		return
+	}
+	if rServer.masterhost != "" && strings.EqualFold(rServer.masterhost, host) && rServer.masterport == int(port) {
+		Log("REPLICAOF would result into synchronization with the master we are already connected with. No operation performed.")
+		addReplyStatus(c, "OK Already connected to specified master")
+		return
+	}
+	replicationSetMaster(host, int(port))
+	Log("REPLICAOF %s:%d enabled (user request from '%s')", host, port, catClientInfoString(c))
+	addReply(c, shared.ok)
+
+}
+
+// replicationCountAcksByOffset returns the number of replicas that
+// acknowledged the stream up to offset.
+func replicationCountAcksByOffset(offset int64) int {
+
+	count := 0
+	for ele := rServer.slaves.Front(); ele != nil; ele = ele.Next() {
+		slave := ele.Value.(*client)
+		if slave.replState == slaveStateOnline && slave.replAckOff >= offset {
+			count++
+		}
+	}
+	return count
+
+}
+
+// replicationCountAOFAcksByOffset returns the number of replicas that
+// fsynced the stream up to offset to their AOF.
+func replicationCountAOFAcksByOffset(offset int64) int {
+
+	count := 0
+	for ele := rServer.slaves.Front(); ele != nil; ele = ele.Next() {
+		slave := ele.Value.(*client)
+		if slave.replState == slaveStateOnline && slave.replAofOff >= offset {
+			count++
+		}
+	}
+	return count
+
+}
+
+// addReplyWaitAOF replies to WAITAOF whether the AOF has offset fsynced, 1
+// or 0, and how many replicas do.
+func addReplyWaitAOF(c *client, offset int64) {
+
+	var acklocal int64
+	if rServer.fsyncedReploff >= offset {
+		acklocal = 1
+	}
+	addReplyArrayLen(c, 2)
+	addReplyLongLong(c, acklocal)
+	addReplyLongLong(c, int64(replicationCountAOFAcksByOffset(offset)))
+
+}
+
+// replicationRequestAckFromSlaves asks the replicas for their offset before
+// sleeping, once for all the clients blocking in this iteration.
+func replicationRequestAckFromSlaves() {
+	rServer.getAckFromSlaves = true
+}
+
+// sendGetackToReplicas sends REPLCONF GETACK * in the stream, the replicas
+// reply with REPLCONF ACK once they applied what comes before.
+func sendGetackToReplicas() {
+	replicationFeedSlaves(-1, []*rObj{
+		createEmbeddedStringObject("REPLCONF"), createEmbeddedStringObject("GETACK"), createEmbeddedStringObject("*"),
+	})
+}
+
+// waitCommand implements WAIT numreplicas timeout, the client blocks until
+// numreplicas replicas acknowledge its last write. It replies with the
+// number of replicas that did, when enough did or on timeout.
+func waitCommand(c *client) {
+
+	if rServer.masterhost != "" {
+		addReplyError(c, "WAIT cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.")
+		return
+	}
+	numreplicas, ok := getLongLongFromObjectOrReply(c, c.argv[1], "")
+	if !ok {
+		return
+	}
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.argv[2], unitMilliseconds)
+	if !ok {
+		return
+	}
+
+	// a transaction can not wait, it replies with the replicas so far
+	ackreplicas := replicationCountAcksByOffset(c.woff)
+	if int64(ackreplicas) >= numreplicas || c.flag&(clientMulti|clientDenyBlocking) != 0 {
+		addReplyLongLong(c, int64(ackreplicas))
+		return
+	}
+
+	blockForAcks(c, blockedWait, timeout, c.woff, 0, int(numreplicas))
+	replicationRequestAckFromSlaves()
+
+}
+
+// waitaofCommand implements WAITAOF numlocal numreplicas timeout, the client
+// blocks until its last write is fsynced to the AOF when numlocal is 1, and
+// by numreplicas replicas. It replies with the local fsync, 1 or 0, and the
+// number of replicas that fsynced, when enough did or on timeout.
+func waitaofCommand(c *client) {
+
+	numlocal, ok := getRangeLongFromObjectOrReply(c, c.argv[1], 0, 1, "")
+	if !ok {
+		return
+	}
+	numreplicas, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+	if numreplicas < 0 {
+		addReplyError(c, "value is out of range, must be positive")
+		return
+	}
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.argv[3], unitMilliseconds)
+	if !ok {
+		return
+	}
+	if rServer.masterhost != "" {
+		addReplyError(c, "WAITAOF cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.")
+		return
+	}
+	if numlocal > 0 && !rServer.aofEnabled {
+		addReplyError(c, "WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+		return
+	}
+
+	acklocal := rServer.fsyncedReploff >= c.woff
+	ackreplicas := replicationCountAOFAcksByOffset(c.woff)
+	if (int64(ackreplicas) >= numreplicas && (acklocal || numlocal == 0)) || c.flag&(clientMulti|clientDenyBlocking) != 0 {
+		addReplyWaitAOF(c, c.woff)
+		return
+	}
+
+	blockForAcks(c, blockedWaitAOF, timeout, c.woff, int(numlocal), int(numreplicas))
+	replicationRequestAckFromSlaves()
+
+}
+
+// processClientsWaitingReplicas replies to the clients in WAIT and WAITAOF
+// whose last write is acknowledged as asked. It is called when a replica
+// acknowledges and when the AOF is fsynced.
+func processClientsWaitingReplicas() {
+
+	for ele := rServer.clientsWaitingAcks.Front(); ele != nil; {
+		c := ele.Value.(*client)
+		ele = ele.Next()
+
+		offset := c.bstate.reploffset
+		if c.bstate.btype == blockedWait {
+			ackreplicas := replicationCountAcksByOffset(offset)
+			if ackreplicas < c.bstate.numreplicas {
+				continue
+			}
+			addReplyLongLong(c, int64(ackreplicas))
+		} else {
+			if replicationCountAOFAcksByOffset(offset) < c.bstate.numreplicas ||
+				(c.bstate.numlocal > 0 && rServer.fsyncedReploff < offset) {
+				continue
+			}
+			addReplyWaitAOF(c, offset)
+		}
+		unblockClient(c)
+	}
+
+}
+
+// replicationCheckTransfers puts the replicas sent their rdb online, and
+// takes over the link of the handshake with the master once done. It is
+// called by serverCron.
+func replicationCheckTransfers() {
+
+	for ele := rServer.slaves.Front(); ele != nil; {
+		slave := ele.Value.(*client)
+		ele = ele.Next()
+		if slave.replState != slaveStateSendBulk {
+			continue
+		}
+		select {
+		case err := <-slave.replBulk.done:
+			slave.replBulk = nil
+			if err != nil {
+				Log("Write error sending DB to replica: %v", err)
+				freeClient(slave)
+				continue
+			}
+			putSlaveOnline(slave)
+		default:
+		}
+	}
+
+	if t := rServer.replTransfer; t != nil {
+		select {
+		case res := <-t.done:
+			rServer.replTransfer = nil
+			replicationSyncDone(res)
+		default:
+		}
+	}
+
+	replicationStartPendingFork()
+
+}
+
+// replicationCron connects with the master, acknowledges its stream, pings
+// the replicas and times out the links silent for too long. It is called
+// once a second.
+func replicationCron() {
+
+	now := time.Now()
+	timeout := time.Duration(rServer.replTimeout) * time.Second
+
+	if rServer.masterhost != "" && rServer.replState == replStateConnect {
+		Log("Connecting to MASTER %s:%d", rServer.masterhost, rServer.masterport)
+		connectWithMaster()
+	}
+	if m := rServer.master; m != nil {
+		if now.Sub(m.lastInteraction) > timeout {
+			Log("MASTER timeout: no data nor PING received...")
+			freeClient(m)
+		} else {
+			replicationSendAck()
+		}
+	}
+
+	// the replicas tell the master is alive from the stream
+	if rServer.replCronLoops%int64(rServer.replPingSlavePeriod) == 0 && rServer.slaves.Len() > 0 {
+		replicationFeedSlaves(-1, []*rObj{createEmbeddedStringObject("PING")})
+	}
+
+	for ele := rServer.slaves.Front(); ele != nil; {
+		slave := ele.Value.(*client)
+		ele = ele.Next()
+		// the sockets of a diskless BGSAVE only get the rdb
+		if slave.replState == slaveStateWaitBgsaveEnd && rServer.rdbChild != nil && rServer.rdbChild.kind == rdbChildTypeSocket {
+			continue
+		}
+		switch slave.replState {
+		case slaveStateWaitBgsaveStart, slaveStateWaitBgsaveEnd:
+			// newlines keep the replicas waiting for the rdb from timing out
+			if _, err := slave.conn.Write([]byte("\n")); err != nil {
+				freeClientAsync(slave)
+			}
+		case slaveStateOnline:
+			if now.Sub(slave.replAckTime) > timeout {
+				Log("Disconnecting timedout replica (streaming sync): %s", replicationGetSlaveName(slave))
+				freeClient(slave)
+			}
+		}
+	}
+
+	// the history of a master whose backlog is gone can't be continued
+	if rServer.masterhost == "" && rServer.slaves.Len() == 0 && rServer.replBacklog != nil &&
+		rServer.replBacklogTTL > 0 && now.Sub(rServer.replNoSlavesSince) > time.Duration(rServer.replBacklogTTL)*time.Second {
+		changeReplicationId()
+		clearReplicationId2()
+		rServer.replBacklog = nil
+		Log("Replication backlog freed after %d seconds without connected replicas.", rServer.replBacklogTTL)
+	}
+
+	rServer.replCronLoops++
+
+}
+
+func getReplicaofConfig() string {
+	if rServer.masterhost == "" {
+		return ""
+	}
+	return rServer.masterhost + " " + strconv.Itoa(rServer.masterport)
+}
+
+// setReplicaofConfig parses "<host> <port>", the replica connects once
+// started. Empty or "no one" keeps the server a master.
+func setReplicaofConfig(val string) error {
+
+	args := strings.Fields(val)
+	if len(args) == 0 || (len(args) == 2 && strings.EqualFold(args[0], "no") && strings.EqualFold(args[1], "one")) {
+		rServer.masterhost, rServer.masterport = "", 0
+		rServer.replState = replStateNone
+		return nil
+	}
+	if len(args) != 2 {
+		return errors.New("replicaof takes a host and a port")
+	}
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port < 0 || port > 65535 {
+		return errors.New("invalid master port")
+	}
+	rServer.masterhost, rServer.masterport = args[0], port
+	rServer.replState = replStateConnect
+	return nil
+
+}
+
+// genReplicationInfoString returns the replication section of INFO.
+func genReplicationInfoString() string {
+
+	var info strings.Builder
+	info.WriteString("# Replication\r\n")
+	if rServer.masterhost == "" {
+		info.WriteString("role:master\r\n")
+	} else {
+		linkStatus, lastIO, readReploff, reploff := "down", int64(-1), int64(0), int64(0)
+		if m := rServer.master; m != nil && rServer.replState == replStateConnected {
+			linkStatus = "up"
+			lastIO = int64(time.Since(m.lastInteraction).Seconds())
+			readReploff, reploff = m.readReploff, m.reploff
+		} else if cm := rServer.cachedMaster; cm != nil {
+			readReploff, reploff = cm.reploff, cm.reploff
+		}
+		fmt.Fprintf(&info, "role:slave\r\n"+
+			"master_host:%s\r\n"+
+			"master_port:%d\r\n"+
+			"master_link_status:%s\r\n"+
+			"master_last_io_seconds_ago:%d\r\n"+
+			"master_sync_in_progress:%d\r\n"+
+			"slave_read_repl_offset:%d\r\n"+
+			"slave_repl_offset:%d\r\n",
+			rServer.masterhost, rServer.masterport, linkStatus, lastIO,
+			boolToInt(rServer.replState == replStateConnecting), readReploff, reploff)
+		if linkStatus == "down" {
+			downSince := int64(-1)
+			if !rServer.replDownSince.IsZero() {
+				downSince = int64(time.Since(rServer.replDownSince).Seconds())
+			}
+			fmt.Fprintf(&info, "master_link_down_since_seconds:%d\r\n", downSince)
+		}
+		fmt.Fprintf(&info, "slave_read_only:%d\r\n", boolToInt(rServer.replSlaveRO))
+	}
+
+	fmt.Fprintf(&info, "connected_slaves:%d\r\n", rServer.slaves.Len())
+	j := 0
+	for ele := rServer.slaves.Front(); ele != nil; ele = ele.Next() {
+		slave := ele.Value.(*client)
+		host, port, err := net.SplitHostPort(replicationGetSlaveName(slave))
+		if err != nil {
+			host, port = replicationGetSlaveName(slave), "0"
+		}
+		state := "online"
+		switch slave.replState {
+		case slaveStateWaitBgsaveStart, slaveStateWaitBgsaveEnd:
+			state = "wait_bgsave"
+		case slaveStateSendBulk:
+			state = "send_bulk"
+		}
+		fmt.Fprintf(&info, "slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d\r\n",
+			j, host, port, state, slave.replAckOff, int64(time.Since(slave.replAckTime).Seconds()))
+		j++
+	}
+
+	var backlogSize, firstByte, histlen int64
+	if bl := rServer.replBacklog; bl != nil {
+		backlogSize, firstByte, histlen = int64(len(bl.buf)), bl.offset, bl.histlen
+	}
+	fmt.Fprintf(&info, "master_replid:%s\r\n"+
+		"master_replid2:%s\r\n"+
+		"master_repl_offset:%d\r\n"+
+		"second_repl_offset:%d\r\n"+
+		"repl_backlog_active:%d\r\n"+
+		"repl_backlog_size:%d\r\n"+
+		"repl_backlog_first_byte_offset:%d\r\n"+
+		"repl_backlog_histlen:%d\r\n",
+		rServer.replid, rServer.replid2, rServer.masterReplOffset, rServer.secondReplidOffset,
+		boolToInt(rServer.replBacklog != nil), backlogSize, firstByte, histlen)
+	return info.String()
+
+}
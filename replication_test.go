@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReplicationTestConn(t *testing.T) *testConn {
+	tc := newBlockingTestConns(t, "9", 1)[0]
+	// no PING in the stream the tests read
+	tc.expect(testStatus("OK"), "config", "set", "repl-ping-replica-period", "3600")
+	tc.expect(testStatus("OK"), "config", "set", "repl-diskless-sync-delay", "0")
+	t.Cleanup(func() {
+		tc.do("config", "set", "repl-ping-replica-period", "10")
+		tc.do("config", "set", "repl-diskless-sync-delay", "5")
+		// the transfer to the replicas closed fails
+		waitBgsave(tc)
+	})
+	return tc
+}
+
+func expectInfoField(tc *testConn, section, field, want string) {
+	tc.t.Helper()
+	if got := tc.infoField(section, field); got != want {
+		tc.t.Fatalf("want %s:%s, got %s", field, want, got)
+	}
+}
+
+// newTestReplica connects to the server as a replica would, the link is
+// read with the testConn of the returned replica.
+func newTestReplica(t *testing.T) *testConn {
+	r := newTestConn(t)
+	r.expect(testStatus("OK"), "replconf", "listening-port", "6380", "capa", "eof", "capa", "psync2")
+	return r
+}
+
+// readSyncLine skips the newlines sent to a replica waiting for the rdb.
+func (tc *testConn) readSyncLine() string {
+	tc.t.Helper()
+	_ = tc.conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	for {
+		line, err := tc.r.ReadString('\n')
+		if err != nil {
+			tc.t.Fatalf("read line error=%v", err)
+		}
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			return line
+		}
+	}
+}
+
+// readRdbPayload reads the rdb of a full sync, streamed up to the EOF mark
+// or sent with its length.
+func (tc *testConn) readRdbPayload() []byte {
+	tc.t.Helper()
+	line := tc.readSyncLine()
+	if mark, ok := strings.CutPrefix(line, "$EOF:"); ok {
+		var rdb []byte
+		for !bytes.HasSuffix(rdb, []byte(mark)) {
+			b, err := tc.r.ReadByte()
+			if err != nil {
+				tc.t.Fatalf("read rdb error=%v", err)
+			}
+			rdb = append(rdb, b)
+		}
+		return rdb[:len(rdb)-len(mark)]
+	}
+	size, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+	if err != nil {
+		tc.t.Fatalf("want the rdb bulk, got %q", line)
+	}
+	rdb := make([]byte, size)
+	if _, err = io.ReadFull(tc.r, rdb); err != nil {
+		tc.t.Fatalf("read rdb error=%v", err)
+	}
+	return rdb
+}
+
+func TestReplication_FullAndPartialSync(t *testing.T) {
+	tc := newReplicationTestConn(t)
+	tc.expect(testStatus("OK"), "set", "before", "1")
+
+	r1 := newTestReplica(t)
+	r1.send("psync", "?", "-1")
+	fields := strings.Fields(r1.readSyncLine())
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" || len(fields[1]) != 40 {
+		t.Fatalf("want +FULLRESYNC <replid> <offset>, got %q", fields)
+	}
+	replid := fields[1]
+	offset, _ := strconv.ParseInt(fields[2], 10, 64)
+	if rdb := r1.readRdbPayload(); !strings.HasPrefix(string(rdb), "REDIS") || !strings.Contains(string(rdb), "before") {
+		t.Fatalf("want the rdb with the key, got %q", rdb)
+	}
+	expectInfoField(tc, "replication", "master_replid", replid)
+	// the rdb streamed to the socket is followed by the stream once loaded
+	r1.send("replconf", "ack", strconv.FormatInt(offset, 10))
+
+	// the stream after the rdb starts with the db it writes to
+	tc.expect(testStatus("OK"), "set", "after", "2")
+	tc.expect(int64(1), "del", "before")
+	want := []any{[]any{"SELECT", "9"}, []any{"set", "after", "2"}, []any{"del", "before"}}
+	for _, cmd := range want {
+		if got := r1.read(); fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", cmd) {
+			t.Fatalf("want %#v, got %#v", cmd, got)
+		}
+	}
+	streamOffset, _ := strconv.ParseInt(tc.infoField("replication", "master_repl_offset"), 10, 64)
+
+	// the replicas acknowledge the stream applied, nothing is replied
+	r1.send("replconf", "ack", strconv.FormatInt(streamOffset, 10))
+	for j := 0; j < 100 && !strings.Contains(tc.infoField("replication", "slave0"), "state=online"); j++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if got := tc.infoField("replication", "slave0"); !strings.Contains(got, "state=online,offset="+strconv.FormatInt(streamOffset, 10)) {
+		t.Fatalf("want the replica online at %d, got %s", streamOffset, got)
+	}
+
+	// a replica that missed part of the stream gets it from the backlog
+	r2 := newTestReplica(t)
+	r2.send("psync", replid, strconv.FormatInt(offset+1, 10))
+	if got := r2.readSyncLine(); got != "+CONTINUE "+replid {
+		t.Fatalf("want +CONTINUE, got %q", got)
+	}
+	for _, cmd := range want {
+		if got := r2.read(); fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", cmd) {
+			t.Fatalf("want %#v from the backlog, got %#v", cmd, got)
+		}
+	}
+
+	// the history of another server can't be continued
+	r3 := newTestReplica(t)
+	r3.send("psync", strings.Repeat("a", 40), "1")
+	if got := r3.readSyncLine(); !strings.HasPrefix(got, "+FULLRESYNC "+replid) {
+		t.Fatalf("want +FULLRESYNC, got %q", got)
+	}
+	r3.readRdbPayload()
+	if got := tc.infoField("stats", "sync_partial_err"); got == "0" {
+		t.Fatalf("want the partial sync refused counted")
+	}
+}
+
+func TestReplication_BacklogOverflow(t *testing.T) {
+	tc := newReplicationTestConn(t)
+
+	r := newTestReplica(t)
+	r.send("psync", "?", "-1")
+	fields := strings.Fields(r.readSyncLine())
+	r.readRdbPayload()
+	replid := fields[1]
+	offset, _ := strconv.ParseInt(fields[2], 10, 64)
+
+	// the stream written is more than the backlog holds
+	value := strings.Repeat("x", 1024)
+	for j := 0; j < 20; j++ {
+		tc.expect(testStatus("OK"), "set", "k"+strconv.Itoa(j), value)
+	}
+	tc.expect(testStatus("OK"), "config", "set", "repl-backlog-size", "16kb")
+	t.Cleanup(func() {
+		tc.do("config", "set", "repl-backlog-size", "1mb")
+	})
+	for j := 0; j < 20; j++ {
+		tc.expect(testStatus("OK"), "set", "k"+strconv.Itoa(j), value)
+	}
+	expectInfoField(tc, "replication", "repl_backlog_histlen", "16384")
+
+	late := newTestReplica(t)
+	late.send("psync", replid, strconv.FormatInt(offset+1, 10))
+	if got := late.readSyncLine(); !strings.HasPrefix(got, "+FULLRESYNC") {
+		t.Fatalf("want +FULLRESYNC for an offset out of the backlog, got %q", got)
+	}
+	late.readRdbPayload()
+}
+
+func TestReplication_Errors(t *testing.T) {
+	tc := newReplicationTestConn(t)
+
+	tc.expectError("ERR Unrecognized REPLCONF option: foo", "replconf", "foo", "bar")
+	tc.expectError("ERR syntax error", "replconf", "listening-port")
+	tc.expectError("ERR Invalid master port", "replicaof", "127.0.0.1", "70000")
+	tc.expectError("ERR value is not an integer", "psync", "?", "abc")
+	tc.expect(testStatus("OK"), "replicaof", "no", "one")
+	tc.expect(testStatus("OK"), "multi")
+	tc.expectError("ERR Command not allowed inside a transaction", "psync", "?", "-1")
+	tc.expectError("EXECABORT", "exec")
+}
+
+// fakeMaster accepts a replica and runs the handshake of a full sync,
+// sending rdb and then stream.
+type fakeMaster struct {
+	t         *testing.T
+	listener  net.Listener
+	handshake []any  // the commands of the replica
+	mark      string // the rdb is streamed up to the mark when set
+	replica   chan *testConn
+}
+
+func newFakeMaster(t *testing.T) *fakeMaster {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return &fakeMaster{t: t, listener: listener, replica: make(chan *testConn, 1)}
+}
+
+func (m *fakeMaster) port() string {
+	return strconv.Itoa(m.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// serve replies the handshake of the replica, its link is given to the test
+// once the stream is sent.
+func (m *fakeMaster) serve(replid string, offset int64, rdb []byte, stream string) {
+	go func() {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		r := bufio.NewReader(conn)
+		for _, reply := range []string{"+PONG\r\n", "+OK\r\n", "+OK\r\n", ""} {
+			cmd, err := readTestReply(r)
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+			m.handshake = append(m.handshake, cmd)
+			_, _ = conn.Write([]byte(reply))
+		}
+		if m.mark != "" {
+			_, _ = fmt.Fprintf(conn, "+FULLRESYNC %s %d\r\n\n\n$EOF:%s\r\n%s%s%s", replid, offset, m.mark, rdb, m.mark, stream)
+		} else {
+			_, _ = fmt.Fprintf(conn, "+FULLRESYNC %s %d\r\n\n\n$%d\r\n%s%s", replid, offset, len(rdb), rdb, stream)
+		}
+		m.replica <- &testConn{t: m.t, conn: conn, r: r}
+	}()
+}
+
+// waitReplica returns the link of the replica with the fake master.
+func (m *fakeMaster) waitReplica() *testConn {
+	m.t.Helper()
+	select {
+	case r := <-m.replica:
+		m.t.Cleanup(func() {
+			_ = r.conn.Close()
+		})
+		return r
+	case <-time.After(time.Second * 5):
+		m.t.Fatalf("the replica did not sync")
+	}
+	return nil
+}
+
+// saveRdb returns the rdb of the dataset, to be sent by a fake master.
+func (tc *testConn) saveRdb() []byte {
+	tc.t.Helper()
+	tc.expect(testStatus("OK"), "save")
+	dir := tc.do("config", "get", "dir").([]any)[1].(string)
+	rdb, err := os.ReadFile(filepath.Join(dir, "dump.rdb"))
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return rdb
+}
+
+func TestReplication_Replica(t *testing.T) {
+	tc := newReplicationTestConn(t)
+
+	// the rdb of the master, made by the server itself
+	tc.expect(testStatus("OK"), "set", "a", "1")
+	tc.expect(int64(2), "rpush", "l", "x", "y")
+	rdb := tc.saveRdb()
+	tc.expect(testStatus("OK"), "flushdb")
+	tc.expect(testStatus("OK"), "set", "stale", "1")
+
+	master := newFakeMaster(t)
+	replid := strings.Repeat("b", 40)
+	stream := "*2\r\n$6\r\nSELECT\r\n$1\r\n9\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n"
+	master.serve(replid, 1000, rdb, stream)
+	tc.expect(testStatus("OK"), "replicaof", "127.0.0.1", master.port())
+	t.Cleanup(func() {
+		tc.do("replicaof", "no", "one")
+	})
+
+	m := master.waitReplica()
+	handshake := fmt.Sprintf("%v", master.handshake)
+	if !strings.HasPrefix(handshake, "[[PING] [REPLCONF listening-port ") ||
+		!strings.Contains(handshake, "[REPLCONF capa eof capa psync2] [PSYNC ") {
+		t.Fatalf("unexpected handshake %s", handshake)
+	}
+	for j := 0; j < 100 && tc.infoField("replication", "master_link_status") != "up"; j++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	expectInfoField(tc, "replication", "master_link_status", "up")
+
+	// the dataset is the one of the master, stream applied
+	tc.expect("1", "get", "a")
+	tc.expect([]any{"x", "y"}, "lrange", "l", "0", "-1")
+	tc.expect("2", "get", "b")
+	tc.expect(int64(0), "exists", "stale")
+	expectInfoField(tc, "replication", "master_replid", replid)
+	want := strconv.Itoa(1000 + len(stream))
+	expectInfoField(tc, "replication", "slave_repl_offset", want)
+	tc.expectError("READONLY", "set", "c", "3")
+	if hello := fmt.Sprintf("%v", tc.do("hello", "2")); !strings.Contains(hello, "role replica") {
+		t.Fatalf("want HELLO role replica, got %s", hello)
+	}
+	tc.expectError("ERR WAIT cannot be used with replica instances", "wait", "1", "0")
+
+	// the offset applied is acknowledged every second
+	if got := m.read(); fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", []any{"REPLCONF", "ACK", want, "FACK", "-1"}) {
+		t.Fatalf("want REPLCONF ACK %s, got %#v", want, got)
+	}
+	m.send("del", "a")
+	for j := 0; j < 100 && tc.do("exists", "a") != int64(0); j++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	tc.expect(int64(0), "exists", "a")
+
+	// an expired key is kept until the DEL of the master, but never served
+	keys := tc.do("dbsize").(int64)
+	m.send("set", "e", "1", "px", "50")
+	for j := 0; j < 100 && tc.do("dbsize") != keys+1; j++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 100)
+	tc.expect(nil, "get", "e")
+	tc.expect(int64(0), "exists", "e")
+	tc.expect(keys+1, "dbsize")
+	m.send("del", "e")
+	for j := 0; j < 100 && tc.do("dbsize") != keys; j++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	tc.expect(keys, "dbsize")
+
+	// promoted, it continues the history of its master
+	tc.expect(testStatus("OK"), "replicaof", "no", "one")
+	expectInfoField(tc, "replication", "role", "master")
+	if hello := fmt.Sprintf("%v", tc.do("hello", "2")); !strings.Contains(hello, "role master") {
+		t.Fatalf("want HELLO role master, got %s", hello)
+	}
+	expectInfoField(tc, "replication", "master_replid2", replid)
+	tc.expect(testStatus("OK"), "set", "c", "3")
+}
+
+func TestReplication_DisklessSync(t *testing.T) {
+	tc := newReplicationTestConn(t)
+	tc.expect(testStatus("OK"), "set", "a", "1")
+
+	// the transfer waits for a second replica to share it
+	tc.expect(testStatus("OK"), "config", "set", "repl-diskless-sync-delay", "60")
+	tc.expect(testStatus("OK"), "config", "set", "repl-diskless-sync-max-replicas", "2")
+	t.Cleanup(func() {
+		tc.do("config", "set", "repl-diskless-sync-max-replicas", "0")
+		tc.do("config", "set", "repl-diskless-sync", "yes")
+	})
+	r1 := newTestReplica(t)
+	r1.send("psync", "?", "-1")
+	r2 := newTestReplica(t)
+	r2.send("psync", "?", "-1")
+	f1, f2 := r1.readSyncLine(), r2.readSyncLine()
+	if f1 != f2 || !strings.HasPrefix(f1, "+FULLRESYNC") {
+		t.Fatalf("want the same +FULLRESYNC, got %q and %q", f1, f2)
+	}
+	offset := strings.Fields(f1)[2]
+	rdb1, rdb2 := r1.readRdbPayload(), r2.readRdbPayload()
+	if string(rdb1) != string(rdb2) || !strings.Contains(string(rdb1), "a") {
+		t.Fatalf("want the same rdb with the key, got %q and %q", rdb1, rdb2)
+	}
+
+	// the stream goes to the replica that acked it loaded the rdb
+	r1.send("replconf", "ack", offset)
+	tc.expect(testStatus("OK"), "set", "b", "2")
+	for _, cmd := range []any{[]any{"SELECT", "9"}, []any{"set", "b", "2"}} {
+		if got := r1.read(); fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", cmd) {
+			t.Fatalf("want %#v, got %#v", cmd, got)
+		}
+	}
+	_ = r2.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	if _, err := r2.r.ReadByte(); err == nil {
+		t.Fatalf("want no stream before the ACK")
+	}
+	r2.send("replconf", "ack", offset)
+	if got := r2.read(); fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", []any{"SELECT", "9"}) {
+		t.Fatalf("want the stream after the ACK, got %#v", got)
+	}
+
+	// without diskless sync the rdb is sent with its length
+	tc.expect(testStatus("OK"), "config", "set", "repl-diskless-sync", "no")
+	r3 := newTestReplica(t)
+	r3.send("psync", "?", "-1")
+	r3.readSyncLine()
+	if line := r3.readSyncLine(); !strings.HasPrefix(line, "$") || strings.HasPrefix(line, "$EOF:") {
+		t.Fatalf("want the rdb bulk length, got %q", line)
+	}
+}
+
+func TestReplication_DisklessSyncCopyOnWrite(t *testing.T) {
+	tc := newReplicationTestConn(t)
+
+	r := newTestReplica(t)
+	var offset string
+	mutateDuringSnapshot(tc, func() {
+		r.send("psync", "?", "-1")
+		offset = strings.Fields(r.readSyncLine())[2]
+	})
+
+	// the rdb streamed is the dataset at +FULLRESYNC
+	rdb := r.readRdbPayload()
+	dir := tc.do("config", "get", "dir").([]any)[1].(string)
+	dbfilename := tc.do("config", "get", "dbfilename").([]any)[1].(string)
+	if err := os.WriteFile(filepath.Join(dir, dbfilename), rdb, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tc.expect(testStatus("OK"), "debug", "reload", "nosave")
+	expectSnapshotBeforeMutations(tc)
+
+	// the changes made while it was sent follow in the stream
+	r.send("replconf", "ack", offset)
+	stream := []any{
+		[]any{"SELECT", "9"},
+		[]any{"sadd", "s:0", "added-during-save"},
+		[]any{"srem", "s:1", "m0"},
+		[]any{"del", "s:2"},
+		[]any{"incr", "counter"},
+		[]any{"rpush", "l", "added-during-save"},
+	}
+	for _, cmd := range stream {
+		if got := r.read(); fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", cmd) {
+			t.Fatalf("want %#v, got %#v", cmd, got)
+		}
+	}
+}
+
+func TestReplication_FlushallKillsStalledTransfer(t *testing.T) {
+	tc := newReplicationTestConn(t)
+
+	// more than the socket buffers hold, the replica never reads it
+	pipelineBigKeys(tc, "sadd", "s:", 50, 40000, func(j int) []string {
+		return []string{"m" + strconv.Itoa(j)}
+	})
+	r := newTestReplica(t)
+	r.send("psync", "?", "-1")
+	if line := r.readSyncLine(); !strings.HasPrefix(line, "+FULLRESYNC") {
+		t.Fatalf("want +FULLRESYNC, got %q", line)
+	}
+
+	// the goroutine gets stuck writing to the replica, past the first key
+	// where it checks whether it was killed, the loop is not held by it
+	time.Sleep(time.Millisecond * 200)
+	tc.expect(testStatus("OK"), "flushall")
+	waitBgsave(tc)
+	_ = r.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.Copy(io.Discard, r.r); err != nil {
+		t.Fatalf("want the replica link closed, got %v", err)
+	}
+}
+
+func TestReplication_ReplicaDisklessLoad(t *testing.T) {
+	tc := newReplicationTestConn(t)
+
+	tc.expect(testStatus("OK"), "set", "a", "1")
+	rdb := tc.saveRdb()
+	tc.expect(testStatus("OK"), "flushdb")
+	tc.expect(testStatus("OK"), "set", "stale", "1")
+	tc.expect(testStatus("OK"), "config", "set", "repl-diskless-load", "swapdb")
+	t.Cleanup(func() {
+		tc.do("config", "set", "repl-diskless-load", "disabled")
+	})
+
+	// the rdb failing to load is discarded, the dataset is kept
+	master := newFakeMaster(t)
+	master.mark = strings.Repeat("c", 40)
+	replid := strings.Repeat("d", 40)
+	broken := append([]byte(nil), rdb...)
+	broken[len(broken)-1]++ // the checksum
+	master.serve(replid, 1000, broken, "")
+	tc.expect(testStatus("OK"), "replicaof", "127.0.0.1", master.port())
+	t.Cleanup(func() {
+		tc.do("replicaof", "no", "one")
+	})
+	m := master.waitReplica()
+	_ = m.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := m.r.ReadByte(); err != io.EOF {
+		t.Fatalf("want the link closed, got %v", err)
+	}
+	tc.expect("1", "get", "stale")
+	tc.expect(int64(0), "exists", "a")
+
+	// loaded, the dataset is swapped and the ACK is sent right away
+	stream := "*2\r\n$6\r\nSELECT\r\n$1\r\n9\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n"
+	master.serve(replid, 1000, rdb, stream)
+	m = master.waitReplica()
+	want := strconv.Itoa(1000 + len(stream))
+	if got := m.read(); fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", []any{"REPLCONF", "ACK", want, "FACK", "-1"}) {
+		t.Fatalf("want REPLCONF ACK %s, got %#v", want, got)
+	}
+	tc.expect("1", "get", "a")
+	tc.expect("2", "get", "b")
+	tc.expect(int64(0), "exists", "stale")
+	expectInfoField(tc, "replication", "master_link_status", "up")
+}
+
+// newOnlineTestReplica is a replica that did its full sync, and acked the
+// rdb streamed.
+func newOnlineTestReplica(t *testing.T) *testConn {
+	r := newTestReplica(t)
+	r.send("psync", "?", "-1")
+	offset := strings.Fields(r.readSyncLine())[2]
+	r.readRdbPayload()
+	r.send("replconf", "ack", offset)
+	return r
+}
+
+// expectGetack reads the stream of the replica up to REPLCONF GETACK.
+func (tc *testConn) expectGetack() {
+	tc.t.Helper()
+	for {
+		got := tc.read()
+		if fmt.Sprintf("%#v", got) == fmt.Sprintf("%#v", []any{"REPLCONF", "GETACK", "*"}) {
+			return
+		}
+	}
+}
+
+func TestReplication_Wait(t *testing.T) {
+	tc := newReplicationTestConn(t)
+
+	tc.expect(int64(0), "wait", "0", "0")
+	start := time.Now()
+	tc.expect(int64(0), "wait", "1", "50")
+	if elapsed := time.Since(start); elapsed < time.Millisecond*50 {
+		t.Fatalf("want WAIT to time out after 50ms, got %v", elapsed)
+	}
+
+	// the client waits for the replica to ack its last write
+	r := newOnlineTestReplica(t)
+	tc.expect(testStatus("OK"), "set", "a", "1")
+	offset := tc.infoField("replication", "master_repl_offset")
+	tc.send("wait", "1", "0")
+	r.expectGetack()
+	r.send("replconf", "ack", offset)
+	expectReply(tc, int64(1))
+
+	// one more replica than acknowledged
+	tc.expect(int64(1), "wait", "2", "50")
+
+	// a transaction does not block
+	tc.expect(testStatus("OK"), "multi")
+	tc.expect(testStatus("QUEUED"), "wait", "2", "0")
+	tc.expect([]any{int64(1)}, "exec")
+}
+
+func TestReplication_WaitAOF(t *testing.T) {
+	tc := newReplicationTestConn(t)
+
+	tc.expectError("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.", "waitaof", "1", "0", "0")
+	tc.expectError("ERR value is out of range, must be between 0 and 1", "waitaof", "2", "0", "0")
+	tc.expectError("ERR value is out of range, must be positive", "waitaof", "0", "-1", "0")
+	tc.expect([]any{int64(0), int64(0)}, "waitaof", "0", "0", "0")
+
+	// the replica acks the offset it fsynced to its AOF
+	r := newOnlineTestReplica(t)
+	tc.expect(testStatus("OK"), "set", "a", "1")
+	offset := tc.infoField("replication", "master_repl_offset")
+	tc.send("waitaof", "0", "1", "0")
+	r.expectGetack()
+	r.send("replconf", "ack", offset, "fack", "0")
+	r.send("replconf", "ack", offset, "fack", offset)
+	expectReply(tc, []any{int64(0), int64(1)})
+	tc.expect([]any{int64(0), int64(1)}, "waitaof", "0", "2", "50")
+
+	// the write is acked once fsynced
+	enableAof(tc)
+	tc.expect(testStatus("OK"), "config", "set", "appendfsync", "always")
+	tc.expect(testStatus("OK"), "set", "b", "1")
+	tc.expect([]any{int64(1), int64(0)}, "waitaof", "1", "0", "5000")
+	tc.expect(testStatus("OK"), "config", "set", "appendfsync", "everysec")
+	tc.expect(testStatus("OK"), "set", "b", "2")
+	tc.expect([]any{int64(1), int64(0)}, "waitaof", "1", "0", "5000")
+}
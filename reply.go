@@ -0,0 +1,330 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// shared replies, built once.
+var shared = struct {
+	ok           []byte
+	pong         []byte
+	crlf         []byte
+	czero        []byte
+	cone         []byte
+	nullBulk     []byte
+	nullArray    []byte
+	emptyArray   []byte
+	emptyBulk    []byte
+	emptyScan    []byte
+	queued       []byte
+	wrongTypeErr []byte
+	syntaxErr    []byte
+	noKeyErr     []byte
+	outOfRange   []byte
+	null3        []byte
+	true3        []byte
+	false3       []byte
+}{
+	ok:           []byte("+OK\r\n"),
+	pong:         []byte("+PONG\r\n"),
+	crlf:         []byte("\r\n"),
+	czero:        []byte(":0\r\n"),
+	cone:         []byte(":1\r\n"),
+	nullBulk:     []byte("$-1\r\n"),
+	nullArray:    []byte("*-1\r\n"),
+	emptyArray:   []byte("*0\r\n"),
+	emptyBulk:    []byte("$0\r\n\r\n"),
+	emptyScan:    []byte("*2\r\n$1\r\n0\r\n*0\r\n"),
+	queued:       []byte("+QUEUED\r\n"),
+	wrongTypeErr: []byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"),
+	syntaxErr:    []byte("-ERR syntax error\r\n"),
+	noKeyErr:     []byte("-ERR no such key\r\n"),
+	outOfRange:   []byte("-ERR index out of range\r\n"),
+	null3:        []byte("_\r\n"),
+	true3:        []byte("#t\r\n"),
+	false3:       []byte("#f\r\n"),
+}
+
+var replyErrorReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// addReplyProtoLen adds "<prefix><n>\r\n", the header of every aggregate and
+// bulk reply.
+func addReplyProtoLen(c *client, prefix byte, n int64) {
+	buf := make([]byte, 0, 24)
+	buf = append(buf, prefix)
+	buf = strconv.AppendInt(buf, n, 10)
+	addReply(c, append(buf, '\r', '\n'))
+}
+
+// addReplyStatus replies a simple string, status must not contain newlines.
+func addReplyStatus(c *client, status string) {
+	buf := make([]byte, 0, len(status)+3)
+	buf = append(buf, '+')
+	buf = append(buf, status...)
+	addReply(c, append(buf, '\r', '\n'))
+}
+
+// addReplyError replies "-ERR err", unless err already starts with its own
+// error code, e.g. "-WRONGTYPE ...".
+func addReplyError(c *client, err string) {
+
+	// newlines would break the protocol.
+	err = replyErrorReplacer.Replace(err)
+
+	buf := make([]byte, 0, len(err)+8)
+	if len(err) == 0 || err[0] != '-' {
+		buf = append(buf, "-ERR "...)
+	}
+	buf = append(buf, err...)
+	addReply(c, append(buf, '\r', '\n'))
+
+}
+
+func addReplyErrorFormat(c *client, format string, a ...any) {
+	addReplyError(c, fmt.Sprintf(format, a...))
+}
+
+// addReplyErrorCode replies an error with its own code, e.g. WRONGTYPE,
+// EXECABORT or OOM, so clients can tell errors apart without parsing the
+// message.
+func addReplyErrorCode(c *client, code string, msg string) {
+	addReplyError(c, "-"+code+" "+msg)
+}
+
+func addReplyLongLong(c *client, n int64) {
+	switch n {
+	case 0:
+		addReply(c, shared.czero)
+	case 1:
+		addReply(c, shared.cone)
+	default:
+		addReplyProtoLen(c, ':', n)
+	}
+}
+
+func addReplyBulk(c *client, data []byte) {
+	addReplyProtoLen(c, '$', int64(len(data)))
+	addReply(c, data)
+	addReply(c, shared.crlf)
+}
+
+func addReplyBulkString(c *client, s string) {
+	addReplyProtoLen(c, '$', int64(len(s)))
+	addReply(c, []byte(s))
+	addReply(c, shared.crlf)
+}
+
+// addReplyBulkLongLong replies n as a bulk string.
+func addReplyBulkLongLong(c *client, n int64) {
+	addReplyBulk(c, strconv.AppendInt(nil, n, 10))
+}
+
+// addReplyDouble replies d as a bulk string, with the shortest
+// representation that parses back to the same double.
+func addReplyDouble(c *client, d float64) {
+	if c.resp >= 3 {
+		buf := append([]byte{','}, formatDouble(d)...)
+		addReply(c, append(buf, '\r', '\n'))
+		return
+	}
+	addReplyBulk(c, formatDouble(d))
+}
+
+func formatDouble(d float64) []byte {
+	switch {
+	case math.IsInf(d, 1):
+		return []byte("inf")
+	case math.IsInf(d, -1):
+		return []byte("-inf")
+	}
+	return strconv.AppendFloat(nil, d, 'g', -1, 64)
+}
+
+func addReplyNull(c *client) {
+	if c.resp >= 3 {
+		addReply(c, shared.null3)
+		return
+	}
+	addReply(c, shared.nullBulk)
+}
+
+func addReplyNullArray(c *client) {
+	if c.resp >= 3 {
+		addReply(c, shared.null3)
+		return
+	}
+	addReply(c, shared.nullArray)
+}
+
+func addReplyArrayLen(c *client, n int) {
+	addReplyProtoLen(c, '*', int64(n))
+}
+
+// addReplyMapLen starts a map of n key value pairs, a flat array of 2*n
+// elements in RESP2.
+func addReplyMapLen(c *client, n int) {
+	if c.resp >= 3 {
+		addReplyProtoLen(c, '%', int64(n))
+		return
+	}
+	addReplyProtoLen(c, '*', int64(n*2))
+}
+
+func addReplySetLen(c *client, n int) {
+	if c.resp >= 3 {
+		addReplyProtoLen(c, '~', int64(n))
+		return
+	}
+	addReplyProtoLen(c, '*', int64(n))
+}
+
+// addReplyAttributeLen starts n attribute pairs describing the next reply,
+// attributes only exist in RESP3 so callers must check c.resp first.
+func addReplyAttributeLen(c *client, n int) {
+	if c.resp < 3 {
+		panic("addReplyAttributeLen: attributes need RESP3")
+	}
+	addReplyProtoLen(c, '|', int64(n))
+}
+
+// addReplyPushLen starts an out of band message, e.g. a pub/sub message,
+// which is a plain array in RESP2.
+func addReplyPushLen(c *client, n int) {
+	if c.resp >= 3 {
+		addReplyProtoLen(c, '>', int64(n))
+		return
+	}
+	addReplyProtoLen(c, '*', int64(n))
+}
+
+func addReplyBool(c *client, b bool) {
+	switch {
+	case c.resp >= 3 && b:
+		addReply(c, shared.true3)
+	case c.resp >= 3:
+		addReply(c, shared.false3)
+	case b:
+		addReply(c, shared.cone)
+	default:
+		addReply(c, shared.czero)
+	}
+}
+
+// addReplyBigNum replies an integer that does not fit in 64 bits, num must
+// be a valid base 10 number.
+func addReplyBigNum(c *client, num string) {
+	if c.resp >= 3 {
+		addReply(c, []byte("("+num+"\r\n"))
+		return
+	}
+	addReplyBulkString(c, num)
+}
+
+// addReplyVerbatim replies text meant to be shown as is, ext is the three
+// letters format, e.g. "txt" or "mkd".
+func addReplyVerbatim(c *client, text string, ext string) {
+	if c.resp >= 3 {
+		addReplyProtoLen(c, '=', int64(len(text)+4))
+		addReply(c, []byte(ext+":"))
+		addReply(c, []byte(text))
+		addReply(c, shared.crlf)
+		return
+	}
+	addReplyBulkString(c, text)
+}
+
+// addReplyBulkStrings replies an array of bulk strings.
+func addReplyBulkStrings(c *client, items []string) {
+	addReplyArrayLen(c, len(items))
+	for _, item := range items {
+		addReplyBulkString(c, item)
+	}
+}
+
+// addReplyDeferredLen reserves the header of an aggregate reply whose length
+// is not known yet, e.g. while iterating with a filter. The header must be
+// set with setDeferredArrayLen before the command returns.
+func addReplyDeferredLen(c *client) *bufferBlock {
+
+	if !prepareClientTotWrite(c) {
+		return nil
+	}
+
+	// the placeholder goes in the list, whatever follows is added after it.
+	if c.replyList == nil {
+		c.replyList = list.New()
+	}
+	placeholder := &bufferBlock{}
+	c.replyList.PushBack(placeholder)
+	return placeholder
+
+}
+
+func setDeferredReplyLen(c *client, placeholder *bufferBlock, prefix byte, n int) {
+
+	if placeholder == nil {
+		return
+	}
+
+	buf := make([]byte, 0, 24)
+	buf = append(buf, prefix)
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	buf = append(buf, '\r', '\n')
+
+	placeholder.data = buf
+	placeholder.len = len(buf)
+	placeholder.pos = len(buf)
+
+}
+
+func setDeferredArrayLen(c *client, placeholder *bufferBlock, n int) {
+	setDeferredReplyLen(c, placeholder, '*', n)
+}
+
+func setDeferredMapLen(c *client, placeholder *bufferBlock, n int) {
+	if c.resp >= 3 {
+		setDeferredReplyLen(c, placeholder, '%', n)
+		return
+	}
+	setDeferredReplyLen(c, placeholder, '*', n*2)
+}
+
+func setDeferredSetLen(c *client, placeholder *bufferBlock, n int) {
+	if c.resp >= 3 {
+		setDeferredReplyLen(c, placeholder, '~', n)
+		return
+	}
+	setDeferredReplyLen(c, placeholder, '*', n)
+}
+
+func setDeferredAttributeLen(c *client, placeholder *bufferBlock, n int) {
+	if c.resp < 3 {
+		panic("setDeferredAttributeLen: attributes need RESP3")
+	}
+	setDeferredReplyLen(c, placeholder, '|', n)
+}
+
+func setDeferredPushLen(c *client, placeholder *bufferBlock, n int) {
+	if c.resp >= 3 {
+		setDeferredReplyLen(c, placeholder, '>', n)
+		return
+	}
+	setDeferredReplyLen(c, placeholder, '*', n)
+}
+
+// addReplyHelp replies the help of a container command, the first line
+// gives the command name and the others are the lines of help.
+func addReplyHelp(c *client, help []string) {
+	name := strings.ToUpper(c.cmd.name)
+	addReplyArrayLen(c, len(help)+3)
+	addReplyStatus(c, fmt.Sprintf("%s <subcommand> [<arg> [value] [opt] ...]. Subcommands are:", name))
+	for _, line := range help {
+		addReplyStatus(c, line)
+	}
+	addReplyStatus(c, "HELP")
+	addReplyStatus(c, "    Prints this help.")
+}
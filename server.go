@@ -4,30 +4,21 @@ import (
 	"container/list"
 	"context"
 	"errors"
+	"fmt"
 	"golang.org/x/sys/unix"
 	"io"
 	"net"
+	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 var rServer server
 
-const (
-	objectTypeString = iota + 1
-	objectTypeHash
-	objectTypeList
-	objectTypeSet
-	objectTypeZSet
-)
-
-const (
-	objectEncodingRaw = iota
-	objectEncodingEmbedding
-)
-
 const (
 	clientFlagCloseAfterReply = 1 << 0
 )
@@ -40,35 +31,70 @@ const (
 	enableAsyncRWMinCPUS = 4
 )
 
-type rObj struct {
-	objectType uint8
-	encoding   uint8
-	data       any
-}
+// goroutines of the pool running the background jobs
+const bioPoolSize = 4
 
-func createStringObject(data any) rObj {
-	return rObj{
-		objectType: objectTypeString,
-		encoding:   objectEncodingRaw,
-		data:       data,
-	}
-}
+const (
+	defaultHz   = 10
+	defaultPort = 6379
+)
+
+// redisCompatVersion is the redis version whose protocol and commands we
+// follow, reported to clients by HELLO.
+const redisCompatVersion = "7.2.0"
 
 type client struct {
 	id       int64
 	fd       int
 	conn     *net.TCPConn
+	file     *os.File // dup of the conn fd registered in the event loop
 	queryBuf []byte
 
 	reqType int
 
-	argv         []rObj
+	argv         []*rObj
 	argc         int
 	multiBulkLen int32
 	bulkLen      int64
 
+	cmd     *redisCommand
+	lastCmd *redisCommand
+	db      *redisDb
+
+	resp          int    // protocol version, 2 or 3
+	name          string // set by CLIENT SETNAME or HELLO SETNAME
+	authenticated bool
+
 	flag int64
 
+	bstate blockingState // see blocked.go
+
+	mstate      multiState // see multi.go
+	watchedKeys *list.List // *watchedKey
+
+	pubsubChannels      map[string]struct{} // see pubsub.go
+	pubsubPatterns      map[string]struct{}
+	pubsubShardChannels map[string]struct{}
+
+	// replication, see replication.go
+	replState          int   // of a replica on its master
+	replAckOff         int64 // offset acknowledged by the replica
+	replAofOff         int64 // offset the replica fsynced to its AOF
+	replAckTime        time.Time
+	psyncInitialOffset int64 // offset of the stream after the rdb
+	slaveListeningPort int
+	slaveAddr          string
+	slaveCapa          int
+	replBulk           *replBulkTransfer
+	// an rdb streamed to the socket is followed by the stream only once the
+	// replica acks it loaded, see replicaStartCommandStream
+	replStartCmdStreamOnAck bool
+	reploff                 int64  // offset of the master stream applied
+	readReploff             int64  // offset of the master stream read
+	pendingReplStream       []byte // master stream read, not fed to our replicas yet
+	lastInteraction         time.Time
+	woff                    int64 // replication offset after the last write, see WAIT
+
 	reply                     [genericIOBufferLength]byte
 	replyPos                  int64
 	replyList                 *list.List
@@ -83,6 +109,7 @@ type server struct {
 
 	clientsPendingWrite     *list.List
 	clientsPendingRead      *list.List
+	clientsToClose          *list.List
 	activeAsyncReadWrite    bool // is server in async read mode
 	numConcurrenceReadWrite int  // num of goroutines in async read
 
@@ -92,19 +119,167 @@ type server struct {
 	readWriteIOSendChannels []chan struct{}
 	ioRead                  bool
 
+	commands map[string]*redisCommand
+
+	// blocking operations state, see blocked.go
+	blockedClients   int
+	unblockedClients *list.List
+	readyKeys        []readyKey
+
+	// pub/sub subscribers by channel and by pattern, and the shard channels
+	// subscribers by slot, see pubsub.go
+	pubsubChannels      pubsubSubscribers
+	pubsubPatterns      pubsubSubscribers
+	pubsubShardChannels []pubsubSubscribers
+
+	port        int
+	bindAddr    string
+	requirePass string // password of the default user, empty means nopass
+
+	db        []*redisDb
+	dbnum     int
+	dirty     int64 // changes to the dataset since the last save
+	hz        int   // serverCron calls per second
+	cronLoops int64
+
+	// active expire cycle state
+	expireCurrentDb           int
+	expireTimelimitExit       bool // the last cycle ran out of time
+	expireLastSlowStart       time.Time
+	expireLastFastStart       time.Time
+	statExpiredKeys           int64
+	statExpiredStalePerc      float64 // running average of the expired sampled keys
+	statExpiredTimeCapReached int64
+
+	maxmemory           int64
+	maxmemoryPolicy     int
+	maxmemorySamples    int
+	lfuLogFactor        int
+	lfuDecayTime        int // minutes to halve the LFU counter
+	lruclock            uint32
+	evictCurrentDb      int
+	evictionTimerActive bool
+	statEvictedKeys     int64
+
+	// thresholds of the compact encodings
+	hashMaxListpackEntries int
+	hashMaxListpackValue   int
+	listMaxListpackSize    int
+	listCompressDepth      int
+	setMaxIntsetEntries    int
+	zsetMaxListpackEntries int
+	zsetMaxListpackValue   int
+	streamNodeMaxBytes     int64
+	streamNodeMaxEntries   int
+
+	// rdb persistence, see rdb.go
+	dir              string
+	rdbFilename      string
+	rdbCompression   bool
+	rdbChecksum      bool
+	saveParams       []saveParam
+	loading          bool
+	lastSave         time.Time // last successful save
+	lastBgsaveTry    time.Time
+	lastBgsaveStatus error
+	rdbChild         *rdbChild // BGSAVE in progress
+	rdbSaveTimeLast  time.Duration
+	statRdbSaves     int64
+	// the values shared with the goroutine of a background save are marked
+	// with its epoch, the snapshot takes the place of the fork of redis.
+	snapshotEpoch    uint16
+	statSnapshotTime time.Duration
+	// BGSAVE SCHEDULE while an AOF rewrite runs
+	rdbBgsaveScheduled bool
+
+	// append only file persistence, see aof.go
+	aofEnabled           bool // appendonly, aofState follows it
+	aofState             int
+	aofFilename          string
+	aofDirname           string
+	aofFsync             int
+	aofLoadTruncated     bool
+	aofFile              *os.File
+	aofBuf               []byte // commands to write before the replies are sent
+	aofSelectedDb        int    // db of the last SELECT written, -1 for none
+	aofCurrentSize       int64
+	aofLastFsync         time.Time
+	aofLastWriteStatus   error
+	aofLastWriteErrorLog time.Time
+	aofBio               aofBioFsync
+	bioPool              *workPool // background jobs, e.g. the AOF fsyncs
+
+	// the AOF files and their rewrite
+	aofManifest            *aofManifest
+	aofLastIncrSize        int64 // size of the incr file written to
+	aofRewritePerc         int
+	aofRewriteMinSize      int64
+	aofRewriteBaseSize     int64     // aofCurrentSize after the last rewrite
+	aofChild               *aofChild // BGREWRITEAOF in progress
+	aofRewriteScheduled    bool
+	aofLastRewriteTry      time.Time
+	aofLastBgrewriteStatus error
+	aofRewriteTimeLast     time.Duration
+	statAofRewrites        int64
+
+	// replication, see replication.go
+	masterhost                  string // set on a replica
+	masterport                  int
+	masteruser                  string
+	masterauth                  string
+	replState                   int     // of the link with the master
+	master                      *client // applying the stream of the master
+	cachedMaster                *replCachedMaster
+	replTransfer                *replSyncTransfer // handshake with the master in progress
+	replDownSince               time.Time
+	slaves                      *list.List // *client
+	slaveseldb                  int        // db of the last SELECT fed, -1 for none
+	replid                      string
+	replid2                     string
+	masterReplOffset            int64
+	secondReplidOffset          int64
+	replBacklog                 *replBacklog
+	replBacklogSize             int64
+	replBacklogTTL              int
+	replNoSlavesSince           time.Time
+	replTimeout                 int
+	replPingSlavePeriod         int
+	replSlaveRO                 bool
+	replServeStaleData          bool
+	replIgnoreMaxmemory         bool
+	replDisklessSync            bool // rdb of a full sync streamed to the sockets
+	replDisklessSyncDelay       int
+	replDisklessSyncMaxReplicas int
+	replDisklessLoad            int // see replDisklessLoadEnum
+	replCronLoops               int64
+	currentClient               *client    // running the command, see call
+	clientsWaitingAcks          *list.List // *client blocked in WAIT or WAITAOF
+	getAckFromSlaves            bool       // REPLCONF GETACK sent before sleeping
+	fsyncedReploff              int64      // offset on disk in the AOF, -1 without AOF
+	statSyncFull                int64
+	statSyncPartialOk           int64
+	statSyncPartialErr          int64
+
+	// commands to propagate once the command running is done, see call
+	alsoPropagate    []redisOp
+	executionNesting int
+
+	startTime       time.Time
+	statNumCommands int64
+
 	// shutdown handler
 	stop              func()
 	closeReadWriteIOs sync.WaitGroup
 	el                *EventLoop
 }
 
-func createClient(el *EventLoop, tcpConn *net.TCPConn) error {
+func createClient(el *EventLoop, tcpConn *net.TCPConn) (*client, error) {
 
 	tcpFd, err := tcpConn.File()
 
 	if err != nil {
 		Log("acceptConnection AddFileEvent error=%v", err)
-		return err
+		return nil, err
 	}
 
 	fd := int(tcpFd.Fd())
@@ -112,11 +287,15 @@ func createClient(el *EventLoop, tcpConn *net.TCPConn) error {
 	c := &client{
 		id:           atomic.LoadInt64(&rServer.nextClientId),
 		conn:         tcpConn,
+		file:         tcpFd,
 		fd:           fd,
 		queryBuf:     make([]byte, 0, genericIOBufferLength),
-		argv:         make([]rObj, 0),
 		multiBulkLen: 0,
 		bulkLen:      -1,
+		db:           rServer.db[0],
+		resp:         2,
+		// without a password every client is the default user already
+		authenticated: rServer.requirePass == "",
 	}
 
 	if fd != -1 {
@@ -135,8 +314,9 @@ func createClient(el *EventLoop, tcpConn *net.TCPConn) error {
 		err = el.AddFileEvent(tcpFd, ELMaskReadable, acceptHandle, c)
 		if err != nil {
 			Log("readData AddFileEvent error=%v", err)
+			_ = tcpFd.Close()
 			_ = tcpConn.Close()
-			return err
+			return nil, err
 		}
 
 	}
@@ -144,23 +324,46 @@ func createClient(el *EventLoop, tcpConn *net.TCPConn) error {
 	atomic.AddInt64(&rServer.nextClientId, 1)
 	rServer.clients.PushBack(c)
 	c.clientElement = rServer.clients.Back()
-	return nil
+	return c, nil
 }
 
 func freeClient(c *client) {
 
+	if c.flag&clientClosed != 0 {
+		return
+	}
+
 	Log("client closed, fd=%d", c.fd)
 
 	if err := rServer.el.DelFileEvent(c.fd, ELMaskReadable|ELMaskWritable); err != nil {
 		Log("del client event, fd=%d, err=%v", c.fd, err)
 	}
 
+	if c.flag&clientBlocked != 0 {
+		removeBlockedClient(c)
+	}
+	if c.flag&clientMulti != 0 {
+		discardTransaction(c)
+	}
+	unwatchAllKeys(c)
+	pubsubUnsubscribeAll(c)
+	if c.flag&clientSlave != 0 {
+		replicationFreeSlave(c)
+	}
+	if c.flag&clientMaster != 0 {
+		replicationCacheMaster(c)
+	}
+
 	rServer.clients.Remove(c.clientElement)
-	if c.clientPendingWriteElement != nil {
+	if c.flag&clientPendingWrite != 0 {
 		rServer.clientsPendingWrite.Remove(c.clientPendingWriteElement)
+		c.flag &^= clientPendingWrite
 	}
 
+	// both the conn and its dup have to be closed, or the peer never sees EOF.
+	_ = c.file.Close()
 	_ = c.conn.Close()
+	c.flag |= clientClosed
 	c.argv = nil
 	if c.replyList != nil {
 		c.replyList = nil
@@ -180,39 +383,77 @@ func readQueryFromClient(c *client) {
 		return
 	}
 
-	Log("readQueryFromClient fd=%d", c.fd)
+	for {
+		nRead := genericIOBufferLength
+
+		if c.reqType == reqTypeMultiBulk && c.bulkLen != -1 && c.bulkLen >= bulkBigArgs {
+			remaining := int(c.bulkLen) + 2 - len(c.queryBuf)
+			if remaining < nRead {
+				nRead = remaining
+			}
+		}
+
+		buf := make([]byte, nRead)
 
-	nRead := genericIOBufferLength
+		read, err := connReadClient(c, buf)
 
-	if c.reqType == reqTypeMultiBulk && c.bulkLen != -1 && c.bulkLen >= bulkBigArgs {
-		remaining := int(c.bulkLen) + 2 - len(c.queryBuf)
-		if remaining < nRead {
-			nRead = remaining
+		if errors.Is(err, unix.EAGAIN) {
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, syscall.EINVAL) {
+				Log("try to Read From Connection error=%v", err)
+			}
+			freeClientAsync(c)
+			return
 		}
-	}
 
-	buf := make([]byte, nRead)
+		c.queryBuf = append(c.queryBuf, buf[:read]...)
+		c.lastInteraction = time.Now()
+		if c.flag&clientMaster != 0 {
+			c.readReploff += int64(read)
+			c.pendingReplStream = append(c.pendingReplStream, buf[:read]...)
+		}
 
-	read, err := c.conn.Read(buf)
+		// the stream of the master is never too long
+		if len(c.queryBuf) > clientMaxQueryBufLen && c.flag&clientMaster == 0 {
+			addReplyError(c, "invalid query buf length")
+			setProtocolError(c, "query buf too long")
+			return
+		}
 
-	if err != nil {
-		if err == io.EOF || errors.Is(err, syscall.EINVAL) {
-			freeClient(c)
+		processInputBuffer(c)
+
+		// an edge triggered loop reports the fd once, it is read until EAGAIN
+		if !rServer.el.EdgeTrigger || c.flag&(clientCloseAfterReply|clientCloseASAP|clientClosed) != 0 {
 			return
 		}
-		Log("try to Read From Connection error=%v", err)
-		return
 	}
 
-	c.queryBuf = append(c.queryBuf, buf[:read]...)
+}
 
-	if len(c.queryBuf) > clientMaxQueryBufLen {
-		addReplyError(c, "invalid query buf length")
-		setProtocolError(c, "query buf too long")
-		return
+// connReadClient reads the conn of the client, an edge triggered loop reads
+// the fd with MSG_DONTWAIT so that a drained socket returns EAGAIN instead of
+// blocking the loop, the fd itself may be in blocking mode after a File.Fd.
+func connReadClient(c *client, buf []byte) (int, error) {
+
+	if !rServer.el.EdgeTrigger {
+		return c.conn.Read(buf)
 	}
 
-	processInputBuffer(c)
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buf, unix.MSG_DONTWAIT)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	}
 
 }
 
@@ -222,7 +463,26 @@ func initServer(el *EventLoop) {
 	rServer.clients = list.New()
 	rServer.clientsPendingWrite = list.New()
 	rServer.clientsPendingRead = list.New()
+	rServer.clientsToClose = list.New()
+	rServer.unblockedClients = list.New()
+	rServer.pubsubChannels = make(pubsubSubscribers)
+	rServer.pubsubPatterns = make(pubsubSubscribers)
+	rServer.pubsubShardChannels = make([]pubsubSubscribers, clusterSlots)
 	rServer.nextClientId = 0
+	rServer.startTime = time.Now()
+	rServer.lastSave = rServer.startTime
+	rServer.lruclock = getLRUClock()
+	populateCommandTable()
+	initDb()
+	rServer.bioPool = newPool(bioPoolSize)
+	rServer.aofManifest = &aofManifest{}
+	rServer.slaves = list.New()
+	rServer.slaveseldb = -1
+	rServer.clientsWaitingAcks = list.New()
+	rServer.fsyncedReploff = -1
+	changeReplicationId()
+	clearReplicationId2()
+	rServer.replNoSlavesSince = rServer.startTime
 
 	cpus := runtime.NumCPU()
 	if cpus >= enableAsyncRWMinCPUS {
@@ -231,12 +491,15 @@ func initServer(el *EventLoop) {
 	}
 
 	rServer.el = el
+	el.AddTimer(time.Millisecond, serverCron, nil)
+	el.AddTimer(time.Millisecond, activeExpireProc, nil)
 	initThreadIO(ctx)
 }
 
 func postponeClientRead(c *client) bool {
 
-	if !rServer.readWriteThreadActive {
+	// the replication links are served by the main loop, in order
+	if !rServer.readWriteThreadActive || c.flag&(clientMaster|clientSlave) != 0 {
 		return false
 	}
 
@@ -291,8 +554,8 @@ func readWriteIO(ctx context.Context, ioId int) {
 		case ch := <-rServer.readWriteIORecvChannels[ioId]:
 
 			ioList := rServer.readWriteIOList[ioId]
-			for ele := ioList.Front(); ele != nil; ele = ele.Next() {
-				c := ioList.Remove(ele).(*client)
+			for ioList.Len() > 0 {
+				c := ioList.Remove(ioList.Front()).(*client)
 				if rServer.ioRead {
 					readQueryFromClient(c)
 				}
@@ -314,10 +577,11 @@ func handleClientsWithPendingRead() {
 		return
 	}
 
-	for ix := 0; ix < rServer.clientsPendingRead.Len(); ix++ {
-		ele := rServer.clientsPendingRead.Front()
+	ix := 0
+	for ele := rServer.clientsPendingRead.Front(); ele != nil; ele = ele.Next() {
 		c := ele.Value.(*client)
 		rServer.readWriteIOList[ix%rServer.numConcurrenceReadWrite].PushBack(c)
+		ix++
 	}
 
 	rServer.ioRead = true
@@ -339,18 +603,31 @@ func handleClientsWithPendingRead() {
 		<-rServer.readWriteIOSendChannels[ix]
 	}
 
-	for ele := rServer.clientsPendingRead.Front(); ele != nil; ele = ele.Next() {
+	rServer.ioRead = false
+
+	for rServer.clientsPendingRead.Len() > 0 {
+
+		c := rServer.clientsPendingRead.Remove(rServer.clientsPendingRead.Front()).(*client)
+		c.flag &^= clientPendingRead
+
+		// the io goroutines never free clients, they only mark them.
+		if c.flag&clientCloseASAP != 0 {
+			rServer.clientsToClose.PushBack(c)
+			continue
+		}
 
-		c := ele.Value.(*client)
-		c.flag ^= clientPendingRead
-		rServer.clientsPendingRead.Remove(ele)
 		if c.flag&clientPendingCommand > 0 {
-			c.flag ^= clientPendingCommand
+			c.flag &^= clientPendingCommand
 			if !processCommandAndResetClient(c) {
 				continue
 			}
 		}
 		processInputBuffer(c)
+
+		// replies added while reading in the io goroutines were not queued.
+		if c.flag&clientPendingWrite == 0 && c.hasPendingOutputs() {
+			queueClientPendingWrite(c)
+		}
 	}
 
 }
@@ -360,19 +637,14 @@ func handleClientsWithPendingWrite() {
 	for rServer.clientsPendingWrite.Len() > 0 {
 
 		c := rServer.clientsPendingWrite.Front().Value.(*client)
-		c.flag ^= clientPendingWrite
+		c.flag &^= clientPendingWrite
 		rServer.clientsPendingWrite.Remove(c.clientPendingWriteElement)
 		if err := c.writeToClient(false); err != nil {
 			continue
 		}
 
 		if c.hasPendingOutputs() {
-			f, err := c.conn.File()
-			if err != nil {
-				freeClient(c)
-				continue
-			}
-			err = rServer.el.AddFileEvent(f, ELMaskWritable, c.sendReplyToClient, c)
+			err := rServer.el.AddFileEvent(c.file, ELMaskWritable, c.sendReplyToClient, c)
 			if err != nil {
 				freeClient(c)
 				continue
@@ -414,7 +686,7 @@ func (c *client) writeToClient(handleInstalled bool) error {
 
 			block := c.replyList.Front().Value.(*bufferBlock)
 
-			if block.len == 0 {
+			if block.pos == 0 {
 				c.replyList.Remove(c.replyList.Front())
 				continue
 			}
@@ -445,7 +717,8 @@ func (c *client) writeToClient(handleInstalled bool) error {
 		}
 
 		if c.flag&clientCloseAfterReply > 0 {
-			return errors.New("client close after reply")
+			err = errors.New("client close after reply")
+			return err
 		}
 
 	}
@@ -454,16 +727,431 @@ func (c *client) writeToClient(handleInstalled bool) error {
 
 }
 
+// processCommandAndResetClient executes the parsed command and prepares the
+// client for the next one in the pipeline. It returns false if the client
+// can not process any more input.
 func processCommandAndResetClient(c *client) bool {
-	return false
+
+	processCommand(c)
+	if c.flag&(clientClosed|clientCloseASAP) != 0 {
+		return false
+	}
+	// the command stays in argv, it runs again once the client is served
+	if c.flag&clientBlocked != 0 {
+		return false
+	}
+	c.lastCmd = c.cmd
+	resetClient(c)
+	// a transaction of the master goes to our replicas once done
+	if c.flag&clientMaster != 0 && c.flag&clientMulti == 0 {
+		replicationFeedStreamFromMasterStream(c)
+	}
+	return true
+
 }
 
 func resetClient(c *client) {
 
 	c.argc = 0
 	c.argv = nil
+	c.reqType = 0
 	c.multiBulkLen = 0
 	c.bulkLen = -1
-	c.flag = 0
+	c.cmd = nil
+
+}
+
+// rewriteClientCommandArgument replaces argv[j] of the command being run, so
+// running it again gives the result it had, e.g. with the ID an XADD
+// generated.
+func rewriteClientCommandArgument(c *client, j int, o *rObj) {
+	c.argv[j] = o
+}
+
+// rewriteClientCommandVector replaces the whole argv of the command being
+// run, e.g. GETDEL propagated as DEL.
+func rewriteClientCommandVector(c *client, argv ...*rObj) {
+	c.argv, c.argc = argv, len(argv)
+}
+
+// freeClientAsync closes the client from beforeSleep, it's safe to call from
+// the io goroutines and from inside the command being executed.
+func freeClientAsync(c *client) {
+
+	if c.flag&clientCloseASAP != 0 {
+		return
+	}
+	c.flag |= clientCloseASAP
+
+	// the io goroutines share the clients list with the main loop.
+	if c.flag&clientPendingRead != 0 {
+		return
+	}
+	rServer.clientsToClose.PushBack(c)
+
+}
+
+func freeClientsInAsyncFreeQueue() {
+
+	for rServer.clientsToClose.Len() > 0 {
+		c := rServer.clientsToClose.Remove(rServer.clientsToClose.Front()).(*client)
+		freeClient(c)
+	}
+
+}
+
+func clientAuthenticated(c *client) bool {
+	return c.authenticated
+}
+
+// checkPassword authenticates the client as username, only the default
+// user exists.
+func checkPassword(c *client, username, password string) bool {
+	if username != "default" || (rServer.requirePass != "" && password != rServer.requirePass) {
+		return false
+	}
+	c.authenticated = true
+	return true
+}
+
+// validateClientName rejects names that would break CLIENT LIST output.
+func validateClientName(name string) bool {
+	for j := 0; j < len(name); j++ {
+		if name[j] < '!' || name[j] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// authCommand implements AUTH <password> and AUTH <username> <password>.
+func authCommand(c *client) {
+
+	if c.argc > 3 {
+		addReply(c, shared.syntaxErr)
+		return
+	}
+
+	username, password := "default", c.argv[1].String()
+	if c.argc == 3 {
+		username, password = c.argv[1].String(), c.argv[2].String()
+	} else if rServer.requirePass == "" {
+		addReplyError(c, "AUTH <password> called without any password configured for the default user. "+
+			"Are you sure your configuration is correct?")
+		return
+	}
+
+	if !checkPassword(c, username, password) {
+		addReplyErrorCode(c, "WRONGPASS", "invalid username-password pair or user is disabled.")
+		return
+	}
+	addReply(c, shared.ok)
+
+}
+
+// helloCommand implements HELLO [protover [AUTH username password] [SETNAME name]],
+// switching the client protocol and replying the server properties.
+func helloCommand(c *client) {
+
+	ver := int64(0)
+	nextArg := 1
+
+	if c.argc >= 2 {
+		v, ok := getLongLongFromObject(c.argv[1])
+		if !ok {
+			addReplyError(c, "Protocol version is not an integer or out of range")
+			return
+		}
+		if v < 2 || v > 3 {
+			addReplyErrorCode(c, "NOPROTO", "unsupported protocol version")
+			return
+		}
+		ver = v
+		nextArg++
+	}
+
+	var username, password, name string
+	var auth, setName bool
+	for j := nextArg; j < c.argc; j++ {
+		moreArgs := c.argc - 1 - j
+		opt := c.argv[j].String()
+		switch {
+		case strings.EqualFold(opt, "auth") && moreArgs >= 2:
+			auth = true
+			username, password = c.argv[j+1].String(), c.argv[j+2].String()
+			j += 2
+		case strings.EqualFold(opt, "setname") && moreArgs >= 1:
+			setName = true
+			name = c.argv[j+1].String()
+			if !validateClientName(name) {
+				addReplyError(c, "Client names cannot contain spaces, newlines or special characters.")
+				return
+			}
+			j++
+		default:
+			addReplyErrorFormat(c, "Syntax error in HELLO option '%s'", opt)
+			return
+		}
+	}
+
+	if auth && !checkPassword(c, username, password) {
+		addReplyErrorCode(c, "WRONGPASS", "invalid username-password pair or user is disabled.")
+		return
+	}
+
+	if !clientAuthenticated(c) {
+		addReplyErrorCode(c, "NOAUTH", "HELLO must be called with the client already authenticated, "+
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate "+
+			"the client and select the RESP protocol version at the same time")
+		return
+	}
+
+	if setName {
+		c.name = name
+	}
+	if ver != 0 {
+		c.resp = int(ver)
+	}
+
+	addReplyMapLen(c, 7)
+	addReplyBulkString(c, "server")
+	addReplyBulkString(c, "redis")
+	addReplyBulkString(c, "version")
+	addReplyBulkString(c, redisCompatVersion)
+	addReplyBulkString(c, "proto")
+	addReplyLongLong(c, int64(c.resp))
+	addReplyBulkString(c, "id")
+	addReplyLongLong(c, c.id)
+	addReplyBulkString(c, "mode")
+	addReplyBulkString(c, "standalone")
+	addReplyBulkString(c, "role")
+	if rServer.masterhost != "" {
+		addReplyBulkString(c, "replica")
+	} else {
+		addReplyBulkString(c, "master")
+	}
+	addReplyBulkString(c, "modules")
+	addReplyArrayLen(c, 0)
+
+}
+
+func clientCommand(c *client) {
+
+	sub := strings.ToLower(c.argv[1].String())
+	switch {
+	case sub == "help" && c.argc == 2:
+		addReplyHelp(c, []string{
+			"ID",
+			"    Return the ID of the current connection.",
+			"GETNAME",
+			"    Return the name of the current connection.",
+			"SETNAME <name>",
+			"    Assign the name <name> to the current connection.",
+			"INFO",
+			"    Return information about the current client connection.",
+		})
+	case sub == "id" && c.argc == 2:
+		addReplyLongLong(c, c.id)
+	case sub == "getname" && c.argc == 2:
+		if c.name == "" {
+			addReplyNull(c)
+			return
+		}
+		addReplyBulkString(c, c.name)
+	case sub == "setname" && c.argc == 3:
+		name := c.argv[2].String()
+		if !validateClientName(name) {
+			addReplyError(c, "Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		c.name = name
+		addReply(c, shared.ok)
+	case sub == "info" && c.argc == 2:
+		addReplyVerbatim(c, catClientInfoString(c)+"\n", "txt")
+	default:
+		addReplySubcommandSyntaxError(c)
+	}
+
+}
+
+func catClientInfoString(c *client) string {
+	addr := ""
+	if c.conn != nil {
+		addr = c.conn.RemoteAddr().String()
+	}
+	cmd := "NULL"
+	if c.lastCmd != nil {
+		cmd = c.lastCmd.name
+	}
+	multi := -1
+	if c.flag&clientMulti != 0 {
+		multi = len(c.mstate.commands)
+	}
+	return fmt.Sprintf("id=%d addr=%s fd=%d name=%s db=%d sub=%d psub=%d ssub=%d multi=%d resp=%d cmd=%s",
+		c.id, addr, c.fd, c.name, c.db.id, len(c.pubsubChannels), len(c.pubsubPatterns), len(c.pubsubShardChannels),
+		multi, c.resp, cmd)
+}
+
+// bytesToHuman formats n with the B, K, M and G units.
+func bytesToHuman(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", float64(n)/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", float64(n)/(1024*1024))
+	}
+	return fmt.Sprintf("%.2fG", float64(n)/(1024*1024*1024))
+}
+
+var infoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "keyspace"}
+
+// genRedisInfoString returns the INFO text of the given sections, "all" and
+// "default" select every section.
+func genRedisInfoString(sections map[string]bool) string {
+
+	var info strings.Builder
+	all := sections["all"] || sections["default"] || sections["everything"]
+
+	for _, section := range infoSections {
+		if !all && !sections[section] {
+			continue
+		}
+		if info.Len() > 0 {
+			info.WriteString("\r\n")
+		}
+
+		switch section {
+		case "server":
+			uptime := int64(time.Since(rServer.startTime).Seconds())
+			fmt.Fprintf(&info, "# Server\r\n"+
+				"redis_version:%s\r\n"+
+				"redis_mode:standalone\r\n"+
+				"multiplexing_api:%s\r\n"+
+				"process_id:%d\r\n"+
+				"tcp_port:%d\r\n"+
+				"uptime_in_seconds:%d\r\n"+
+				"uptime_in_days:%d\r\n"+
+				"hz:%d\r\n"+
+				"lru_clock:%d\r\n",
+				redisCompatVersion, rServer.el.ElApi.Name(), os.Getpid(), rServer.port,
+				uptime, uptime/86400, rServer.hz, rServer.lruclock)
+		case "clients":
+			fmt.Fprintf(&info, "# Clients\r\n"+
+				"connected_clients:%d\r\n"+
+				"blocked_clients:%d\r\n",
+				rServer.clients.Len(), rServer.blockedClients)
+		case "memory":
+			used := usedMemory()
+			policy := lookupConfig("maxmemory-policy").get()
+			fmt.Fprintf(&info, "# Memory\r\n"+
+				"used_memory:%d\r\n"+
+				"used_memory_human:%s\r\n"+
+				"maxmemory:%d\r\n"+
+				"maxmemory_human:%s\r\n"+
+				"maxmemory_policy:%s\r\n",
+				used, bytesToHuman(used), rServer.maxmemory, bytesToHuman(rServer.maxmemory), policy)
+		case "persistence":
+			bgsaveStatus, bgsaveTime, currentBgsaveTime := "ok", int64(-1), int64(-1)
+			if rServer.lastBgsaveStatus != nil {
+				bgsaveStatus = "err"
+			}
+			if rServer.rdbSaveTimeLast > 0 {
+				bgsaveTime = int64(rServer.rdbSaveTimeLast.Seconds())
+			}
+			if rServer.rdbChild != nil {
+				currentBgsaveTime = int64(time.Since(rServer.rdbChild.start).Seconds())
+			}
+			fmt.Fprintf(&info, "# Persistence\r\n"+
+				"loading:%d\r\n"+
+				"rdb_changes_since_last_save:%d\r\n"+
+				"rdb_bgsave_in_progress:%d\r\n"+
+				"rdb_last_save_time:%d\r\n"+
+				"rdb_last_bgsave_status:%s\r\n"+
+				"rdb_last_bgsave_time_sec:%d\r\n"+
+				"rdb_current_bgsave_time_sec:%d\r\n"+
+				"rdb_saves:%d\r\n",
+				boolToInt(rServer.loading), rServer.dirty, boolToInt(rServer.rdbChild != nil), rServer.lastSave.Unix(),
+				bgsaveStatus, bgsaveTime, currentBgsaveTime, rServer.statRdbSaves)
+			aofWriteStatus, bgrewriteStatus := "ok", "ok"
+			if rServer.aofLastWriteStatus != nil {
+				aofWriteStatus = "err"
+			}
+			if rServer.aofLastBgrewriteStatus != nil {
+				bgrewriteStatus = "err"
+			}
+			rewriteTime, currentRewriteTime := int64(-1), int64(-1)
+			if rServer.aofRewriteTimeLast > 0 {
+				rewriteTime = int64(rServer.aofRewriteTimeLast.Seconds())
+			}
+			if rServer.aofChild != nil {
+				currentRewriteTime = int64(time.Since(rServer.aofChild.start).Seconds())
+			}
+			fmt.Fprintf(&info, "aof_enabled:%d\r\n"+
+				"aof_rewrite_in_progress:%d\r\n"+
+				"aof_rewrite_scheduled:%d\r\n"+
+				"aof_last_rewrite_time_sec:%d\r\n"+
+				"aof_current_rewrite_time_sec:%d\r\n"+
+				"aof_last_bgrewrite_status:%s\r\n"+
+				"aof_rewrites:%d\r\n"+
+				"aof_last_write_status:%s\r\n",
+				boolToInt(rServer.aofState != aofOff), boolToInt(rServer.aofChild != nil),
+				boolToInt(rServer.aofRewriteScheduled), rewriteTime, currentRewriteTime,
+				bgrewriteStatus, rServer.statAofRewrites, aofWriteStatus)
+			if rServer.aofState == aofOn {
+				fmt.Fprintf(&info, "aof_current_size:%d\r\n"+
+					"aof_base_size:%d\r\n"+
+					"aof_buffer_length:%d\r\n"+
+					"aof_pending_bio_fsync:%d\r\n",
+					rServer.aofCurrentSize, rServer.aofRewriteBaseSize, len(rServer.aofBuf),
+					boolToInt(aofBioFsyncInProgress()))
+			}
+		case "stats":
+			fmt.Fprintf(&info, "# Stats\r\n"+
+				"total_connections_received:%d\r\n"+
+				"total_commands_processed:%d\r\n"+
+				"expired_keys:%d\r\n"+
+				"expired_stale_perc:%.2f\r\n"+
+				"expired_time_cap_reached_count:%d\r\n"+
+				"evicted_keys:%d\r\n"+
+				"pubsub_channels:%d\r\n"+
+				"pubsub_patterns:%d\r\n"+
+				"pubsubshard_channels:%d\r\n"+
+				"sync_full:%d\r\n"+
+				"sync_partial_ok:%d\r\n"+
+				"sync_partial_err:%d\r\n"+
+				"latest_fork_usec:%d\r\n",
+				atomic.LoadInt64(&rServer.nextClientId), rServer.statNumCommands, rServer.statExpiredKeys,
+				rServer.statExpiredStalePerc, rServer.statExpiredTimeCapReached, rServer.statEvictedKeys,
+				len(rServer.pubsubChannels), len(rServer.pubsubPatterns), pubsubTotalShardChannels(),
+				rServer.statSyncFull, rServer.statSyncPartialOk, rServer.statSyncPartialErr,
+				rServer.statSnapshotTime.Microseconds())
+		case "replication":
+			info.WriteString(genReplicationInfoString())
+		case "keyspace":
+			info.WriteString("# Keyspace\r\n")
+			for _, db := range rServer.db {
+				keys, vkeys := db.dict.size(), db.expires.size()
+				if keys > 0 {
+					fmt.Fprintf(&info, "db%d:keys=%d,expires=%d\r\n", db.id, keys, vkeys)
+				}
+			}
+		}
+	}
+	return info.String()
+
+}
+
+func infoCommand(c *client) {
+
+	sections := make(map[string]bool)
+	for j := 1; j < c.argc; j++ {
+		sections[strings.ToLower(c.argv[j].String())] = true
+	}
+	if len(sections) == 0 {
+		sections["default"] = true
+	}
+	addReplyVerbatim(c, genRedisInfoString(sections), "txt")
 
 }
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testServerOnce sync.Once
+	testServerAddr string
+)
+
+// testEdgeTriggerEnv runs the test server on the edge triggered epoll, see
+// TestEventLoopEpoll_EdgeTriggeredServer.
+const testEdgeTriggerEnv = "ROMA_TEST_EDGE_TRIGGER"
+
+// startTestServer runs a single server for the whole test binary, every
+// test talks to it through its own connection like a real client would.
+func startTestServer(t *testing.T) string {
+	testServerOnce.Do(func() {
+		initServerConfig()
+		// no save points, the tests save explicitly to a dir of their own
+		dir, err := os.MkdirTemp("", "roma-test")
+		if err != nil {
+			panic(err)
+		}
+		if err = loadServerConfigFromArgs([]string{"--save", "", "--dir", dir}); err != nil {
+			panic(err)
+		}
+		apiType := defaultEventLoopApi
+		if os.Getenv(testEdgeTriggerEnv) != "" {
+			apiType = ELApiEpollEdge
+		}
+		el, err := NewEventLoop(1024, apiType, beforeSleep, afterSleep)
+		if err != nil {
+			panic(err)
+		}
+		initServer(el)
+		listener, err := listenToPort(el, "127.0.0.1:0")
+		if err != nil {
+			panic(err)
+		}
+		testServerAddr = listener.Addr().String()
+		go el.Serve()
+	})
+	return testServerAddr
+}
+
+type testStatus string
+
+type testError string
+
+// RESP3 aggregate types, maps are kept flat as key, value, key, value...
+type (
+	testMap  []any
+	testSet  []any
+	testPush []any
+)
+
+type testBigNum string
+
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestConn(t *testing.T) *testConn {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial %s error=%v", addr, err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (tc *testConn) writeRaw(data string) {
+	tc.t.Helper()
+	if _, err := tc.conn.Write([]byte(data)); err != nil {
+		tc.t.Fatalf("write error=%v", err)
+	}
+}
+
+func (tc *testConn) send(args ...string) {
+	tc.t.Helper()
+	buf := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		buf += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	tc.writeRaw(buf)
+}
+
+func (tc *testConn) do(args ...string) any {
+	tc.t.Helper()
+	tc.send(args...)
+	return tc.read()
+}
+
+func (tc *testConn) read() any {
+	tc.t.Helper()
+	_ = tc.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	reply, err := readTestReply(tc.r)
+	if err != nil {
+		tc.t.Fatalf("read reply error=%v", err)
+	}
+	return reply
+}
+
+// readTestReply decodes a single reply, bulk strings become string, nil
+// bulks and arrays become nil. Attributes are skipped.
+func readTestReply(r *bufio.Reader) (any, error) {
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed reply line " + strconv.Quote(line))
+	}
+	typ, payload := line[0], line[1:len(line)-2]
+
+	switch typ {
+	case '+':
+		return testStatus(payload), nil
+	case '-':
+		return testError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '=':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 4 {
+			return nil, errors.New("malformed verbatim string " + strconv.Quote(line))
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		// skip the format, txt: or mkd:
+		return string(buf[4:n]), nil
+	case '_':
+		return nil, nil
+	case '#':
+		return payload == "t", nil
+	case ',':
+		return strconv.ParseFloat(payload, 64)
+	case '(':
+		return testBigNum(payload), nil
+	case '*', '~', '>', '%', '|':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		if typ == '%' || typ == '|' {
+			n *= 2
+		}
+		items := make([]any, n)
+		for j := range items {
+			if items[j], err = readTestReply(r); err != nil {
+				return nil, err
+			}
+		}
+		switch typ {
+		case '~':
+			return testSet(items), nil
+		case '>':
+			return testPush(items), nil
+		case '%':
+			return testMap(items), nil
+		case '|':
+			return readTestReply(r)
+		}
+		return items, nil
+	}
+	return nil, errors.New("unknown reply type " + strconv.Quote(line))
+}
+
+func (tc *testConn) expect(want any, args ...string) {
+	tc.t.Helper()
+	got := tc.do(args...)
+	if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", want) {
+		tc.t.Fatalf("%v: want %#v, got %#v", args, want, got)
+	}
+}
+
+func (tc *testConn) expectError(prefix string, args ...string) {
+	tc.t.Helper()
+	got, ok := tc.do(args...).(testError)
+	if !ok || len(got) < len(prefix) || string(got[:len(prefix)]) != prefix {
+		tc.t.Fatalf("%v: want error %q, got %#v", args, prefix, got)
+	}
+}
+
+// infoField returns a field of the INFO reply.
+func (tc *testConn) infoField(section, field string) string {
+	tc.t.Helper()
+	info, _ := tc.do("info", section).(string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			return value
+		}
+	}
+	tc.t.Fatalf("field %s not found in INFO %s", field, section)
+	return ""
+}
+
+func (tc *testConn) usedMemory() int64 {
+	tc.t.Helper()
+	used, err := strconv.ParseInt(tc.infoField("memory", "used_memory"), 10, 64)
+	if err != nil {
+		tc.t.Fatalf("parse used_memory error=%v", err)
+	}
+	return used
+}
+
+func TestServer_Ping(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("PONG"), "PING")
+	tc.expect("hello", "ping", "hello")
+	tc.expect("hello world", "ECHO", "hello world")
+}
+
+func TestServer_UnknownCommand(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testError("ERR unknown command 'foo', with args beginning with: 'bar' 'baz' "), "foo", "bar", "baz")
+	tc.expect(testStatus("PONG"), "PING")
+}
+
+func TestServer_Arity(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testError("ERR wrong number of arguments for 'echo' command"), "echo")
+	tc.expect(testError("ERR wrong number of arguments for 'echo' command"), "echo", "a", "b")
+	tc.expect(testError("ERR wrong number of arguments for 'ping' command"), "ping", "a", "b")
+}
+
+func TestServer_CommandLookupIsCaseInsensitive(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("PONG"), "pInG")
+	tc.expect(int64(len(commandTable)), "COMMAND", "count")
+	tc.expectError("ERR unknown subcommand", "COMMAND", "nope")
+}
+
+func TestServer_Pipeline(t *testing.T) {
+	tc := newTestConn(t)
+
+	const n = 1000
+	buf := ""
+	for j := 0; j < n; j++ {
+		buf += fmt.Sprintf("*2\r\n$4\r\necho\r\n$%d\r\n%d\r\n", len(strconv.Itoa(j)), j)
+	}
+	tc.writeRaw(buf)
+
+	for j := 0; j < n; j++ {
+		if got := tc.read(); got != strconv.Itoa(j) {
+			t.Fatalf("pipelined reply %d: got %#v", j, got)
+		}
+	}
+}
+
+func TestServer_BigArgument(t *testing.T) {
+	tc := newTestConn(t)
+
+	big := make([]byte, bulkBigArgs*3)
+	for j := range big {
+		big[j] = 'a' + byte(j%26)
+	}
+	tc.expect(string(big), "echo", string(big))
+	tc.expect(testStatus("PONG"), "ping")
+}
+
+func TestServer_Quit(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "quit")
+	_ = tc.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := tc.r.ReadByte(); err != io.EOF {
+		t.Fatalf("want EOF after quit, got %v", err)
+	}
+}
+
+func TestServer_ProtocolError(t *testing.T) {
+	tc := newTestConn(t)
+	tc.writeRaw("*1\r\n!4\r\nping\r\n")
+	if got := tc.read(); got != testError("ERR Protocol error: bulk string must start with $") {
+		t.Fatalf("want protocol error, got %#v", got)
+	}
+}
+
+func TestServer_CommandInfo(t *testing.T) {
+	tc := newTestConn(t)
+
+	tc.expect([]any{
+		[]any{"move", int64(3), []any{testStatus("write"), testStatus("fast")}, int64(1), int64(1), int64(1)},
+		nil,
+	}, "command", "info", "MOVE", "nosuchcommand")
+
+	tc.expect([]any{"key"}, "command", "getkeys", "move", "key", "1")
+	tc.expect(testError("ERR The command has no key arguments"), "command", "getkeys", "ping")
+	tc.expect(testError("ERR Invalid command specified"), "command", "getkeys", "nope", "a")
+
+	list, ok := tc.do("command", "list").([]any)
+	if !ok || len(list) != len(commandTable) {
+		t.Fatalf("want %d commands listed, got %#v", len(commandTable), list)
+	}
+	all, ok := tc.do("command").([]any)
+	if !ok || len(all) != len(commandTable) {
+		t.Fatalf("want %d command infos, got %#v", len(commandTable), all)
+	}
+}
+
+func TestServer_BigReplyAfterSmallOnes(t *testing.T) {
+	tc := newTestConn(t)
+
+	// the first replies fill the static buffer, the big one spills into the
+	// block list and the last ones must not jump ahead of it.
+	big := strings.Repeat("x", genericIOBufferLength+genericReplyBlockLen*3)
+	tc.send("ping")
+	tc.send("echo", big)
+	tc.send("ping")
+	tc.send("echo", "tail")
+	for _, want := range []any{testStatus("PONG"), big, testStatus("PONG"), "tail"} {
+		if got := tc.read(); got != want {
+			t.Fatalf("want %.20q, got %.20q", want, got)
+		}
+	}
+}
+
+func TestServer_Hello(t *testing.T) {
+	tc := newTestConn(t)
+
+	id := tc.do("client", "id").(int64)
+	tc.expectError("NOPROTO", "hello", "4")
+	tc.expectError("ERR Syntax error in HELLO option 'foo'", "hello", "3", "foo")
+	tc.expectError("ERR Client names cannot contain", "hello", "3", "setname", "a b")
+	tc.expect(nil, "client", "getname")
+
+	tc.expect(testMap{
+		"server", "redis",
+		"version", redisCompatVersion,
+		"proto", int64(3),
+		"id", id,
+		"mode", "standalone",
+		"role", "master",
+		"modules", []any{},
+	}, "hello", "3", "setname", "conn1")
+	tc.expect("conn1", "client", "getname")
+
+	// the same replies use the RESP3 types once negotiated
+	tc.expectError("ERR unknown subcommand", "client", "nope")
+	tc.expect([]any{
+		[]any{"move", int64(3), testSet{testStatus("write"), testStatus("fast")}, int64(1), int64(1), int64(1)},
+		nil,
+	}, "command", "info", "move", "nosuchcommand")
+
+	reply, ok := tc.do("hello", "2").([]any)
+	if !ok || len(reply) != 14 || reply[5] != int64(2) {
+		t.Fatalf("want a flat array with proto 2, got %#v", reply)
+	}
+	tc.expect([]any{nil}, "command", "info", "nosuchcommand")
+}
+
+func TestServer_Auth(t *testing.T) {
+	tc := newTestConn(t)
+
+	tc.expectError("ERR AUTH <password> called without any password configured", "auth", "foo")
+	tc.expect(testStatus("OK"), "auth", "default", "whatever")
+	tc.expectError("WRONGPASS", "auth", "nosuchuser", "foo")
+	tc.expectError("WRONGPASS", "hello", "3", "auth", "nosuchuser", "foo")
+}
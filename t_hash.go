@@ -0,0 +1,709 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// A hash starts listpack encoded, fields and values stored as consecutive
+// elements, and is converted to a hashtable of field -> []byte once it has
+// more than hash-max-listpack-entries fields or a field or value longer than
+// hash-max-listpack-value bytes. A hash never converts back.
+
+// hashTypeSet flags
+const (
+	hashSetTakeValue = 1 << iota // the value is not referenced by the caller anymore
+)
+
+func createHashObject() *rObj {
+	return &rObj{
+		objectType: objectTypeHash,
+		encoding:   objectEncodingListpack,
+		data:       lpNew(0),
+	}
+}
+
+// hashTypeTryConversion converts a listpack encoded hash about to receive the
+// fields and values of argv[start:end+1] when they are too many or too long.
+func hashTypeTryConversion(o *rObj, argv []*rObj, start, end int) {
+
+	if o.encoding != objectEncodingListpack {
+		return
+	}
+	// many fields are converted at once instead of growing the listpack
+	if (end-start+1)/2 > rServer.hashMaxListpackEntries {
+		hashTypeConvert(o, objectEncodingHT)
+		return
+	}
+	for j := start; j <= end; j++ {
+		if argv[j].encoding != objectEncodingInt && stringObjectLen(argv[j]) > rServer.hashMaxListpackValue {
+			hashTypeConvert(o, objectEncodingHT)
+			return
+		}
+	}
+
+}
+
+func hashTypeConvert(o *rObj, encoding uint8) {
+
+	if o.encoding == encoding {
+		return
+	}
+	if o.encoding != objectEncodingListpack || encoding != objectEncodingHT {
+		panic("hashTypeConvert: unknown hash encoding")
+	}
+
+	lp := o.data.([]byte)
+	d := newDict()
+	d.expand(lpLength(lp) / 2)
+	for p := lpFirst(lp); p != -1; p = lpNext(lp, lpNext(lp, p)) {
+		if !d.add(lpGetString(lp, p), lpGetBytes(lp, lpNext(lp, p))) {
+			panic("hashTypeConvert: listpack with duplicate fields")
+		}
+	}
+	o.encoding, o.data = objectEncodingHT, d
+
+}
+
+func hashTypeLength(o *rObj) int {
+	if o.encoding == objectEncodingListpack {
+		return lpLength(o.data.([]byte)) / 2
+	}
+	return o.data.(*dict).size()
+}
+
+// hashTypeListpackFind returns the position of the value of field, or -1.
+func hashTypeListpackFind(lp []byte, field string) int {
+	p := lpFind(lp, lpFirst(lp), []byte(field), 1)
+	if p == -1 {
+		return -1
+	}
+	return lpNext(lp, p)
+}
+
+// hashTypeGetValue returns the value of field, the result must not be
+// modified.
+func hashTypeGetValue(o *rObj, field string) ([]byte, bool) {
+
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		p := hashTypeListpackFind(lp, field)
+		if p == -1 {
+			return nil, false
+		}
+		str, v := lpGet(lp, p)
+		if str == nil {
+			return strconv.AppendInt(nil, v, 10), true
+		}
+		return str, true
+	}
+
+	val, ok := o.data.(*dict).fetchValue(field)
+	if !ok {
+		return nil, false
+	}
+	return val.([]byte), true
+
+}
+
+func hashTypeExists(o *rObj, field string) bool {
+	_, ok := hashTypeGetValue(o, field)
+	return ok
+}
+
+// hashTypeGetValueLength returns the length of the value of field, 0 when
+// the field does not exist.
+func hashTypeGetValueLength(o *rObj, field string) int {
+
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		p := hashTypeListpackFind(lp, field)
+		if p == -1 {
+			return 0
+		}
+		str, v := lpGet(lp, p)
+		if str == nil {
+			return digits10(v)
+		}
+		return len(str)
+	}
+
+	val, _ := hashTypeGetValue(o, field)
+	return len(val)
+
+}
+
+// hashTypeSet sets field to value, converting the hash when it becomes too
+// big. It returns true when an existing field was updated.
+func hashTypeSet(o *rObj, field string, value []byte, flags int) bool {
+
+	update := false
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		if p := hashTypeListpackFind(lp, field); p != -1 {
+			lp, _ = lpReplace(lp, p, value)
+			update = true
+		} else {
+			lp = lpAppend(lp, []byte(field))
+			lp = lpAppend(lp, value)
+		}
+		o.data = lp
+		if hashTypeLength(o) > rServer.hashMaxListpackEntries {
+			hashTypeConvert(o, objectEncodingHT)
+		}
+		return update
+	}
+
+	if flags&hashSetTakeValue == 0 {
+		value = append([]byte(nil), value...)
+	}
+	return !o.data.(*dict).replace(field, value)
+
+}
+
+// hashTypeDelete removes field, it returns false if it did not exist.
+func hashTypeDelete(o *rObj, field string) bool {
+
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		p := lpFind(lp, lpFirst(lp), []byte(field), 1)
+		if p == -1 {
+			return false
+		}
+		o.data = lpDeleteRangeWithEntry(lp, p, 2)
+		return true
+	}
+
+	d := o.data.(*dict)
+	if d.delete(field) == nil {
+		return false
+	}
+	if d.needsResize() {
+		d.resize()
+	}
+	return true
+
+}
+
+// hashTypeDup returns a copy of the hash o.
+func hashTypeDup(o *rObj) *rObj {
+
+	if o.encoding == objectEncodingListpack {
+		return &rObj{objectType: objectTypeHash, encoding: objectEncodingListpack, data: append([]byte(nil), o.data.([]byte)...)}
+	}
+	d := newDict()
+	d.expand(hashTypeLength(o))
+	o.data.(*dict).forEachUnsafe(func(de *dictEntry) bool {
+		d.add(de.key, append([]byte(nil), de.val.([]byte)...))
+		return true
+	})
+	return &rObj{objectType: objectTypeHash, encoding: objectEncodingHT, data: d}
+
+}
+
+// hashTypeIterator walks the fields and values of a hash, the hash must not
+// be modified until the iterator is released.
+type hashTypeIterator struct {
+	o      *rObj
+	fptr   int // listpack position of the current field
+	di     *dictIterator
+	de     *dictEntry
+	called bool
+}
+
+func hashTypeInitIterator(o *rObj) *hashTypeIterator {
+	hi := &hashTypeIterator{o: o, fptr: -1}
+	if o.encoding == objectEncodingHT {
+		hi.di = o.data.(*dict).iterator()
+	}
+	return hi
+}
+
+func (hi *hashTypeIterator) next() bool {
+
+	if hi.di != nil {
+		hi.de = hi.di.next()
+		return hi.de != nil
+	}
+
+	lp := hi.o.data.([]byte)
+	if !hi.called {
+		hi.called = true
+		hi.fptr = lpFirst(lp)
+	} else if hi.fptr != -1 {
+		hi.fptr = lpNext(lp, lpNext(lp, hi.fptr))
+	}
+	return hi.fptr != -1
+
+}
+
+func (hi *hashTypeIterator) field() []byte {
+	if hi.di != nil {
+		return []byte(hi.de.key)
+	}
+	return lpGetBytes(hi.o.data.([]byte), hi.fptr)
+}
+
+func (hi *hashTypeIterator) value() []byte {
+	if hi.di != nil {
+		return hi.de.val.([]byte)
+	}
+	lp := hi.o.data.([]byte)
+	return lpGetBytes(lp, lpNext(lp, hi.fptr))
+}
+
+func (hi *hashTypeIterator) release() {
+	if hi.di != nil {
+		hi.di.release()
+	}
+}
+
+// hashTypeLookupWriteOrCreate returns the hash at key, creating it when
+// missing, or nil after replying a type error.
+func hashTypeLookupWriteOrCreate(c *client, key string) *rObj {
+
+	o := lookupKeyWrite(c.db, key)
+	if o == nil {
+		o = createHashObject()
+		dbAdd(c.db, key, o)
+		return o
+	}
+	if !checkType(c, o, objectTypeHash) {
+		return nil
+	}
+	return o
+
+}
+
+// hsetCommand implements HSET and HMSET.
+func hsetCommand(c *client) {
+
+	if c.argc%2 == 1 {
+		addReplyErrorFormat(c, "wrong number of arguments for '%s' command", c.cmd.name)
+		return
+	}
+
+	o := hashTypeLookupWriteOrCreate(c, c.argv[1].String())
+	if o == nil {
+		return
+	}
+	hashTypeTryConversion(o, c.argv, 2, c.argc-1)
+
+	var created int64
+	for j := 2; j < c.argc; j += 2 {
+		if !hashTypeSet(o, c.argv[j].String(), c.argv[j+1].bytes(), 0) {
+			created++
+		}
+	}
+	rServer.dirty += int64((c.argc - 2) / 2)
+
+	if c.cmd.name == "hset" {
+		addReplyLongLong(c, created)
+	} else {
+		addReply(c, shared.ok)
+	}
+
+}
+
+func hsetnxCommand(c *client) {
+
+	o := hashTypeLookupWriteOrCreate(c, c.argv[1].String())
+	if o == nil {
+		return
+	}
+	field := c.argv[2].String()
+	if hashTypeExists(o, field) {
+		addReply(c, shared.czero)
+		return
+	}
+	hashTypeTryConversion(o, c.argv, 2, 3)
+	hashTypeSet(o, field, c.argv[3].bytes(), 0)
+	rServer.dirty++
+	addReply(c, shared.cone)
+
+}
+
+func hgetCommand(c *client) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.nullBulk)
+	if o == nil || !checkType(c, o, objectTypeHash) {
+		return
+	}
+	val, ok := hashTypeGetValue(o, c.argv[2].String())
+	if !ok {
+		addReplyNull(c)
+		return
+	}
+	addReplyBulk(c, val)
+
+}
+
+func hmgetCommand(c *client) {
+
+	// a missing key is an empty hash, that replies nulls
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o != nil && !checkType(c, o, objectTypeHash) {
+		return
+	}
+
+	addReplyArrayLen(c, c.argc-2)
+	for j := 2; j < c.argc; j++ {
+		if o == nil {
+			addReplyNull(c)
+			continue
+		}
+		val, ok := hashTypeGetValue(o, c.argv[j].String())
+		if !ok {
+			addReplyNull(c)
+			continue
+		}
+		addReplyBulk(c, val)
+	}
+
+}
+
+func hdelCommand(c *client) {
+
+	key := c.argv[1].String()
+	o := lookupKeyWriteOrReply(c, key, shared.czero)
+	if o == nil || !checkType(c, o, objectTypeHash) {
+		return
+	}
+
+	var deleted int64
+	for j := 2; j < c.argc; j++ {
+		if hashTypeDelete(o, c.argv[j].String()) {
+			deleted++
+			if hashTypeLength(o) == 0 {
+				dbDelete(c.db, key)
+				break
+			}
+		}
+	}
+	rServer.dirty += deleted
+	addReplyLongLong(c, deleted)
+
+}
+
+func hlenCommand(c *client) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeHash) {
+		return
+	}
+	addReplyLongLong(c, int64(hashTypeLength(o)))
+
+}
+
+func hstrlenCommand(c *client) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeHash) {
+		return
+	}
+	addReplyLongLong(c, int64(hashTypeGetValueLength(o, c.argv[2].String())))
+
+}
+
+func hexistsCommand(c *client) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeHash) {
+		return
+	}
+	if hashTypeExists(o, c.argv[2].String()) {
+		addReply(c, shared.cone)
+	} else {
+		addReply(c, shared.czero)
+	}
+
+}
+
+func hincrbyCommand(c *client) {
+
+	incr, ok := getLongLongFromObjectOrReply(c, c.argv[3], "")
+	if !ok {
+		return
+	}
+	o := hashTypeLookupWriteOrCreate(c, c.argv[1].String())
+	if o == nil {
+		return
+	}
+
+	field := c.argv[2].String()
+	var value int64
+	if cur, ok := hashTypeGetValue(o, field); ok {
+		if value, ok = string2ll(cur); !ok {
+			addReplyError(c, "hash value is not an integer")
+			return
+		}
+	}
+
+	if (incr < 0 && value < 0 && incr < math.MinInt64-value) ||
+		(incr > 0 && value > 0 && incr > math.MaxInt64-value) {
+		addReplyError(c, "increment or decrement would overflow")
+		return
+	}
+	value += incr
+
+	hashTypeSet(o, field, strconv.AppendInt(nil, value, 10), hashSetTakeValue)
+	rServer.dirty++
+	addReplyLongLong(c, value)
+
+}
+
+func hincrbyfloatCommand(c *client) {
+
+	incr, ok := getLongDoubleFromObjectOrReply(c, c.argv[3], "")
+	if !ok {
+		return
+	}
+	if math.IsNaN(incr) || math.IsInf(incr, 0) {
+		addReplyError(c, "value is NaN or Infinity")
+		return
+	}
+	o := hashTypeLookupWriteOrCreate(c, c.argv[1].String())
+	if o == nil {
+		return
+	}
+
+	field := c.argv[2].String()
+	var value float64
+	if cur, ok := hashTypeGetValue(o, field); ok {
+		if value, ok = string2ld(cur); !ok {
+			addReplyError(c, "hash value is not a float")
+			return
+		}
+	}
+
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		addReplyError(c, "increment would produce NaN or Infinity")
+		return
+	}
+
+	buf := strconv.AppendFloat(nil, value, 'f', -1, 64)
+	hashTypeTryConversion(o, []*rObj{c.argv[2], createStringObject(buf)}, 0, 1)
+	hashTypeSet(o, field, buf, hashSetTakeValue)
+	rServer.dirty++
+	addReplyBulk(c, buf)
+
+	// propagated as the value it gave, not the increment
+	rewriteClientCommandVector(c, createEmbeddedStringObject("HSET"), c.argv[1], c.argv[2], createStringObject(buf))
+
+}
+
+// genericHgetallCommand replies the fields, the values or both of a hash.
+func genericHgetallCommand(c *client, fields, values bool) {
+
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o != nil && !checkType(c, o, objectTypeHash) {
+		return
+	}
+
+	length := 0
+	if o != nil {
+		length = hashTypeLength(o)
+	}
+	if fields && values {
+		addReplyMapLen(c, length)
+	} else {
+		addReplyArrayLen(c, length)
+	}
+	if o == nil {
+		return
+	}
+
+	hi := hashTypeInitIterator(o)
+	defer hi.release()
+	for hi.next() {
+		if fields {
+			addReplyBulk(c, hi.field())
+		}
+		if values {
+			addReplyBulk(c, hi.value())
+		}
+	}
+
+}
+
+func hkeysCommand(c *client) {
+	genericHgetallCommand(c, true, false)
+}
+
+func hvalsCommand(c *client) {
+	genericHgetallCommand(c, false, true)
+}
+
+func hgetallCommand(c *client) {
+	genericHgetallCommand(c, true, true)
+}
+
+// hrandfieldReplyPair replies a field, and its value when withvalues is set,
+// as a two elements array with RESP3.
+func hrandfieldReplyPair(c *client, field, value []byte, withvalues bool) {
+	if !withvalues {
+		addReplyBulk(c, field)
+		return
+	}
+	if c.resp >= 3 {
+		addReplyArrayLen(c, 2)
+	}
+	addReplyBulk(c, field)
+	addReplyBulk(c, value)
+}
+
+// hashTypeRandomPairs returns count distinct random fields and their values,
+// count being less than the hash length.
+func hashTypeRandomPairs(o *rObj, count int) (fields, values [][]byte) {
+
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		length := lpLength(lp) / 2
+		for _, idx := range rand.Perm(length)[:count] {
+			p := lpSeek(lp, idx*2)
+			fields = append(fields, lpGetBytes(lp, p))
+			values = append(values, lpGetBytes(lp, lpNext(lp, p)))
+		}
+		return fields, values
+	}
+
+	d := o.data.(*dict)
+	if count*3 > d.size() {
+		// close to the whole hash: pick the entries of a random permutation
+		all := make([]*dictEntry, 0, d.size())
+		d.forEach(func(de *dictEntry) bool {
+			all = append(all, de)
+			return true
+		})
+		rand.Shuffle(len(all), func(i, j int) {
+			all[i], all[j] = all[j], all[i]
+		})
+		for _, de := range all[:count] {
+			fields = append(fields, []byte(de.key))
+			values = append(values, de.val.([]byte))
+		}
+		return fields, values
+	}
+
+	seen := make(map[string]struct{}, count)
+	for len(seen) < count {
+		de := d.randomEntry()
+		if _, ok := seen[de.key]; ok {
+			continue
+		}
+		seen[de.key] = struct{}{}
+		fields = append(fields, []byte(de.key))
+		values = append(values, de.val.([]byte))
+	}
+	return fields, values
+
+}
+
+// hashTypeRandomPair returns a random field and its value.
+func hashTypeRandomPair(o *rObj) ([]byte, []byte) {
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		p := lpSeek(lp, rand.Intn(lpLength(lp)/2)*2)
+		return lpGetBytes(lp, p), lpGetBytes(lp, lpNext(lp, p))
+	}
+	de := o.data.(*dict).randomEntry()
+	return []byte(de.key), de.val.([]byte)
+}
+
+func hrandfieldWithCountCommand(c *client, count int64, withvalues bool) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.emptyArray)
+	if o == nil || !checkType(c, o, objectTypeHash) {
+		return
+	}
+	if count == 0 {
+		addReply(c, shared.emptyArray)
+		return
+	}
+
+	replyLen := func(n int) {
+		if withvalues && c.resp == 2 {
+			n *= 2
+		}
+		addReplyArrayLen(c, n)
+	}
+
+	// a negative count allows the same field multiple times
+	if count < 0 {
+		replyLen(int(-count))
+		for j := int64(0); j < -count; j++ {
+			field, value := hashTypeRandomPair(o)
+			hrandfieldReplyPair(c, field, value, withvalues)
+		}
+		return
+	}
+
+	length := hashTypeLength(o)
+	if count >= int64(length) {
+		replyLen(length)
+		hi := hashTypeInitIterator(o)
+		defer hi.release()
+		for hi.next() {
+			hrandfieldReplyPair(c, hi.field(), hi.value(), withvalues)
+		}
+		return
+	}
+
+	fields, values := hashTypeRandomPairs(o, int(count))
+	replyLen(len(fields))
+	for j := range fields {
+		hrandfieldReplyPair(c, fields[j], values[j], withvalues)
+	}
+
+}
+
+// hrandfieldCommand implements HRANDFIELD key [count [WITHVALUES]].
+func hrandfieldCommand(c *client) {
+
+	if c.argc >= 3 {
+		count, ok := getRangeLongFromObjectOrReply(c, c.argv[2], -math.MaxInt64, math.MaxInt64, "")
+		if !ok {
+			return
+		}
+		withvalues := false
+		if c.argc > 4 || (c.argc == 4 && !strings.EqualFold(c.argv[3].String(), "withvalues")) {
+			addReply(c, shared.syntaxErr)
+			return
+		}
+		if c.argc == 4 {
+			withvalues = true
+			// the reply would hold twice the elements
+			if count < -math.MaxInt64/2 || count > math.MaxInt64/2 {
+				addReplyError(c, "value is out of range")
+				return
+			}
+		}
+		hrandfieldWithCountCommand(c, count, withvalues)
+		return
+	}
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.nullBulk)
+	if o == nil || !checkType(c, o, objectTypeHash) {
+		return
+	}
+	field, _ := hashTypeRandomPair(o)
+	addReplyBulk(c, field)
+
+}
+
+func hscanCommand(c *client) {
+
+	cursor, ok := parseScanCursorOrReply(c, c.argv[2])
+	if !ok {
+		return
+	}
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.emptyScan)
+	if o == nil || !checkType(c, o, objectTypeHash) {
+		return
+	}
+	scanGenericCommand(c, o, cursor)
+
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setHashListpackLimits lowers the listpack thresholds for a test.
+func setHashListpackLimits(tc *testConn, entries, value int) {
+	tc.t.Helper()
+	tc.expect(testStatus("OK"), "config", "set",
+		"hash-max-listpack-entries", strconv.Itoa(entries), "hash-max-listpack-value", strconv.Itoa(value))
+	tc.t.Cleanup(func() {
+		tc.do("config", "set", "hash-max-listpack-entries", "128", "hash-max-listpack-value", "64")
+	})
+}
+
+func TestHash_Basic(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "12")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(int64(2), "hset", "h", "a", "1", "b", "2")
+	tc.expect(int64(1), "hset", "h", "a", "10", "c", "3")
+	tc.expect(testError("ERR wrong number of arguments for 'hset' command"), "hset", "h", "a", "1", "b")
+	tc.expect(testStatus("OK"), "hmset", "h", "d", "4")
+	tc.expect(testStatus("hash"), "type", "h")
+	tc.expect("listpack", "object", "encoding", "h")
+
+	tc.expect("10", "hget", "h", "a")
+	tc.expect(nil, "hget", "h", "nofield")
+	tc.expect(nil, "hget", "nokey", "a")
+	tc.expect([]any{"10", nil, "3"}, "hmget", "h", "a", "x", "c")
+	tc.expect([]any{nil, nil}, "hmget", "nokey", "a", "b")
+	tc.expect(int64(4), "hlen", "h")
+	tc.expect(int64(0), "hlen", "nokey")
+	tc.expect(int64(1), "hexists", "h", "b")
+	tc.expect(int64(0), "hexists", "h", "x")
+	tc.expect(int64(2), "hstrlen", "h", "a")
+	tc.expect(int64(0), "hstrlen", "h", "x")
+
+	tc.expect(int64(0), "hsetnx", "h", "a", "x")
+	tc.expect(int64(1), "hsetnx", "h", "e", "5")
+	tc.expect([]any{"a", "b", "c", "d", "e"}, "hkeys", "h")
+	tc.expect([]any{"10", "2", "3", "4", "5"}, "hvals", "h")
+	tc.expect([]any{"a", "10", "b", "2", "c", "3", "d", "4", "e", "5"}, "hgetall", "h")
+	tc.expect([]any{}, "hgetall", "nokey")
+
+	tc.expect(int64(2), "hdel", "h", "a", "b", "x")
+	tc.expect(int64(3), "hlen", "h")
+	tc.expect(int64(3), "hdel", "h", "c", "d", "e")
+	tc.expect(int64(0), "exists", "h")
+
+	tc.expect(testStatus("OK"), "set", "s", "v")
+	tc.expectError("WRONGTYPE", "hset", "s", "a", "1")
+	tc.expectError("WRONGTYPE", "hget", "s", "a")
+	tc.expectError("WRONGTYPE", "hgetall", "s")
+
+	tc.do("hello", "3")
+	tc.expect(int64(1), "hset", "h", "a", "1")
+	tc.expect(testMap{"a", "1"}, "hgetall", "h")
+	tc.expect(testMap{}, "hgetall", "nokey")
+}
+
+func TestHash_Incr(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "12")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(int64(5), "hincrby", "h", "n", "5")
+	tc.expect(int64(-5), "hincrby", "h", "n", "-10")
+	tc.expect(int64(1), "hset", "h", "s", "abc")
+	tc.expect(testError("ERR hash value is not an integer"), "hincrby", "h", "s", "1")
+	tc.expect(testError("ERR value is not an integer or out of range"), "hincrby", "h", "n", "x")
+	tc.expect(int64(1), "hset", "h", "big", "9223372036854775807")
+	tc.expect(testError("ERR increment or decrement would overflow"), "hincrby", "h", "big", "1")
+
+	tc.expect("10.5", "hincrbyfloat", "h", "f", "10.5")
+	tc.expect("5.5", "hincrbyfloat", "h", "f", "-5")
+	tc.expect("-4.5", "hincrbyfloat", "h", "n", "0.5")
+	tc.expect(testError("ERR hash value is not a float"), "hincrbyfloat", "h", "s", "1")
+	tc.expect(testError("ERR value is not a valid float"), "hincrbyfloat", "h", "f", "x")
+	tc.expect("5.5", "hget", "h", "f")
+}
+
+func TestHash_Conversion(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "12")
+	tc.expect(testStatus("OK"), "flushdb")
+	setHashListpackLimits(tc, 4, 8)
+
+	// too many fields
+	for j := 0; j < 4; j++ {
+		tc.do("hset", "many", "f"+strconv.Itoa(j), strconv.Itoa(j))
+	}
+	tc.expect("listpack", "object", "encoding", "many")
+	tc.expect(int64(1), "hset", "many", "f4", "4")
+	tc.expect("hashtable", "object", "encoding", "many")
+	tc.expect("4", "hget", "many", "f4")
+	tc.expect(int64(5), "hlen", "many")
+
+	// too long values, even when set by HINCRBYFLOAT
+	tc.expect(int64(1), "hset", "long", "a", "12345678")
+	tc.expect("listpack", "object", "encoding", "long")
+	tc.expect(int64(1), "hset", "long", "b", "123456789")
+	tc.expect("hashtable", "object", "encoding", "long")
+	tc.expect("0.3333333333", "hincrbyfloat", "flt", "a", "0.3333333333")
+	tc.expect("hashtable", "object", "encoding", "flt")
+
+	// every command works on both encodings
+	tc.expect(int64(1), "hsetnx", "many", "x", "y")
+	tc.expect(int64(0), "hsetnx", "many", "x", "z")
+	tc.expect(int64(1), "hstrlen", "many", "x")
+	tc.expect(int64(7), "hincrby", "many", "f3", "4")
+	tc.expect(int64(1), "hdel", "many", "x")
+	tc.expect(int64(5), "hlen", "many")
+
+	all := tc.do("hgetall", "many").([]any)
+	got := make([]string, 0, len(all)/2)
+	for j := 0; j < len(all); j += 2 {
+		got = append(got, all[j].(string)+"="+all[j+1].(string))
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "f0=0,f1=1,f2=2,f3=7,f4=4" {
+		t.Fatalf("unexpected hgetall reply %v", got)
+	}
+
+	// the conversion happens at once for a big HSET
+	tc.expect(int64(5), "hset", "bulk", "a", "1", "b", "2", "c", "3", "d", "4", "e", "5")
+	tc.expect("hashtable", "object", "encoding", "bulk")
+}
+
+func TestHash_Randfield(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "12")
+	tc.expect(testStatus("OK"), "flushdb")
+	setHashListpackLimits(tc, 16, 64)
+
+	tc.expect(nil, "hrandfield", "nokey")
+	tc.expect([]any{}, "hrandfield", "nokey", "3")
+
+	for _, key := range []string{"small", "big"} {
+		n := 10
+		if key == "big" {
+			n = 100
+		}
+		fields := make(map[string]string)
+		for j := 0; j < n; j++ {
+			fields["f"+strconv.Itoa(j)] = "v" + strconv.Itoa(j)
+			tc.do("hset", key, "f"+strconv.Itoa(j), "v"+strconv.Itoa(j))
+		}
+
+		if f := tc.do("hrandfield", key).(string); fields[f] == "" {
+			t.Fatalf("%s: unknown random field %q", key, f)
+		}
+		tc.expect([]any{}, "hrandfield", key, "0")
+
+		for _, count := range []int{3, n - 1, n, n + 5} {
+			reply := tc.do("hrandfield", key, strconv.Itoa(count), "withvalues").([]any)
+			seen := make(map[string]bool)
+			for j := 0; j < len(reply); j += 2 {
+				f, v := reply[j].(string), reply[j+1].(string)
+				if fields[f] != v || seen[f] {
+					t.Fatalf("%s count %d: bad or repeated pair %s=%s", key, count, f, v)
+				}
+				seen[f] = true
+			}
+			if want := min(count, n); len(seen) != want {
+				t.Fatalf("%s count %d: want %d fields, got %d", key, count, want, len(seen))
+			}
+		}
+
+		// negative counts may repeat fields
+		reply := tc.do("hrandfield", key, "-30").([]any)
+		if len(reply) != 30 {
+			t.Fatalf("%s: want 30 fields, got %d", key, len(reply))
+		}
+	}
+
+	tc.expect(testError("ERR syntax error"), "hrandfield", "small", "3", "nope")
+	tc.expect(testError("ERR value is out of range"), "hrandfield", "small", "-9223372036854775807", "withvalues")
+
+	tc.do("hello", "3")
+	reply := tc.do("hrandfield", "small", "2", "withvalues").([]any)
+	if len(reply) != 2 || len(reply[0].([]any)) != 2 {
+		t.Fatalf("want pairs with RESP3, got %#v", reply)
+	}
+}
+
+func TestHash_Scan(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "12")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect([]any{"0", []any{}}, "hscan", "nokey", "0")
+	tc.expect(testError("ERR invalid cursor"), "hscan", "nokey", "x")
+
+	tc.expect(int64(2), "hset", "small", "a", "1", "b", "2")
+	tc.expect([]any{"0", []any{"a", "1", "b", "2"}}, "hscan", "small", "0")
+	tc.expect([]any{"0", []any{"b", "2"}}, "hscan", "small", "0", "match", "b*")
+	tc.expect([]any{"0", []any{"a", "b"}}, "hscan", "small", "0", "novalues")
+	tc.expect(testError("ERR syntax error"), "hscan", "small", "0", "count", "0")
+
+	for j := 0; j < 1000; j++ {
+		tc.do("hset", "big", "f"+strconv.Itoa(j), strconv.Itoa(j))
+	}
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply := tc.do("hscan", "big", cursor, "count", "50").([]any)
+		cursor = reply[0].(string)
+		elements := reply[1].([]any)
+		for j := 0; j < len(elements); j += 2 {
+			f := elements[j].(string)
+			if "f"+elements[j+1].(string) != f {
+				t.Fatalf("field %s with value %s", f, elements[j+1])
+			}
+			seen[f] = true
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 1000 {
+		t.Fatalf("want 1000 fields scanned, got %d", len(seen))
+	}
+
+	reply := tc.do("hscan", "big", "0", "match", "f99*", "count", "2000", "novalues").([]any)
+	if reply[0] != "0" || len(reply[1].([]any)) != 11 {
+		t.Fatalf("want the 11 fields matching f99*, got %#v", reply)
+	}
+}
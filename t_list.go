@@ -0,0 +1,770 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// list ends, used both as push position and pop side
+const (
+	listHead = quicklistHead
+	listTail = quicklistTail
+)
+
+func createQuicklistObject() *rObj {
+	return &rObj{
+		objectType: objectTypeList,
+		encoding:   objectEncodingQuicklist,
+		data:       quicklistCreate(rServer.listMaxListpackSize, rServer.listCompressDepth),
+	}
+}
+
+// listTypeDup returns a copy of the list o.
+func listTypeDup(o *rObj) *rObj {
+	return &rObj{
+		objectType: objectTypeList,
+		encoding:   objectEncodingQuicklist,
+		data:       o.data.(*quicklist).dup(),
+	}
+}
+
+func listTypeLength(o *rObj) int {
+	return o.data.(*quicklist).count
+}
+
+func listTypePush(o *rObj, value []byte, where int) {
+	o.data.(*quicklist).push(value, where)
+}
+
+func listTypePop(o *rObj, where int) ([]byte, bool) {
+	return o.data.(*quicklist).pop(where)
+}
+
+// listTypeIndex returns the element at index, negative indexes counting from
+// the tail.
+func listTypeIndex(o *rObj, index int) ([]byte, bool) {
+
+	it := o.data.(*quicklist).getIteratorAtIdx(quicklistHead, index)
+	if it == nil {
+		return nil, false
+	}
+	defer it.release()
+	var entry quicklistEntry
+	if !it.next(&entry) {
+		return nil, false
+	}
+	return entry.entryBytes(), true
+
+}
+
+// getListPositionFromObjectOrReply parses LEFT and RIGHT.
+func getListPositionFromObjectOrReply(c *client, o *rObj) (int, bool) {
+	switch s := o.String(); {
+	case strings.EqualFold(s, "left"):
+		return listHead, true
+	case strings.EqualFold(s, "right"):
+		return listTail, true
+	}
+	addReply(c, shared.syntaxErr)
+	return 0, false
+}
+
+// listElementsRemoved deletes the key of a list left empty.
+func listElementsRemoved(c *client, key string, o *rObj) {
+	if listTypeLength(o) == 0 {
+		dbDelete(c.db, key)
+	}
+}
+
+// pushGenericCommand implements LPUSH, RPUSH, LPUSHX and RPUSHX, the X
+// variants only pushing to existing lists.
+func pushGenericCommand(c *client, where int, xx bool) {
+
+	key := c.argv[1].String()
+	o := lookupKeyWrite(c.db, key)
+	if o != nil && !checkType(c, o, objectTypeList) {
+		return
+	}
+	if o == nil {
+		if xx {
+			addReply(c, shared.czero)
+			return
+		}
+		o = createQuicklistObject()
+		dbAdd(c.db, key, o)
+	}
+
+	for j := 2; j < c.argc; j++ {
+		listTypePush(o, c.argv[j].bytes(), where)
+	}
+	rServer.dirty += int64(c.argc - 2)
+	addReplyLongLong(c, int64(listTypeLength(o)))
+
+}
+
+func lpushCommand(c *client) {
+	pushGenericCommand(c, listHead, false)
+}
+
+func rpushCommand(c *client) {
+	pushGenericCommand(c, listTail, false)
+}
+
+func lpushxCommand(c *client) {
+	pushGenericCommand(c, listHead, true)
+}
+
+func rpushxCommand(c *client) {
+	pushGenericCommand(c, listTail, true)
+}
+
+// addListRangeReply replies rangelen elements starting at index from,
+// walking toward the head when reverse is set.
+func addListRangeReply(c *client, o *rObj, from, rangelen int, reverse bool) {
+
+	addReplyArrayLen(c, rangelen)
+	direction := quicklistHead
+	if reverse {
+		direction = quicklistTail
+	}
+	it := o.data.(*quicklist).getIteratorAtIdx(direction, from)
+	if it == nil {
+		return
+	}
+	defer it.release()
+
+	var entry quicklistEntry
+	for j := 0; j < rangelen && it.next(&entry); j++ {
+		if entry.value != nil {
+			addReplyBulk(c, entry.value)
+		} else {
+			addReplyBulkLongLong(c, entry.longval)
+		}
+	}
+
+}
+
+// listPopRangeAndReply pops count elements from the where end and replies
+// them as an array.
+func listPopRangeAndReply(c *client, o *rObj, key string, where int, count int) {
+
+	ql := o.data.(*quicklist)
+	rangelen := min(count, listTypeLength(o))
+	if where == listHead {
+		addListRangeReply(c, o, 0, rangelen, false)
+		ql.delRange(0, rangelen)
+	} else {
+		addListRangeReply(c, o, -1, rangelen, true)
+		ql.delRange(-rangelen, rangelen)
+	}
+	rServer.dirty += int64(rangelen)
+	listElementsRemoved(c, key, o)
+
+}
+
+// listPopRangeAndReplyWithKey is listPopRangeAndReply prefixed by the key,
+// the reply of LMPOP.
+func listPopRangeAndReplyWithKey(c *client, o *rObj, key string, where int, count int) {
+	addReplyArrayLen(c, 2)
+	addReplyBulkString(c, key)
+	listPopRangeAndReply(c, o, key, where, count)
+}
+
+// popGenericCommand implements LPOP and RPOP with the optional count.
+func popGenericCommand(c *client, where int) {
+
+	if c.argc > 3 {
+		addReplyErrorFormat(c, "wrong number of arguments for '%s' command", c.cmd.name)
+		return
+	}
+	hascount := c.argc == 3
+	count := int64(0)
+	if hascount {
+		var ok bool
+		count, ok = getRangeLongFromObjectOrReply(c, c.argv[2], 0, math.MaxInt64, "value is out of range, must be positive")
+		if !ok {
+			return
+		}
+	}
+
+	key := c.argv[1].String()
+	o := lookupKeyWrite(c.db, key)
+	if o == nil {
+		if hascount {
+			addReplyNullArray(c)
+		} else {
+			addReplyNull(c)
+		}
+		return
+	}
+	if !checkType(c, o, objectTypeList) {
+		return
+	}
+
+	if !hascount {
+		value, _ := listTypePop(o, where)
+		addReplyBulk(c, value)
+		rServer.dirty++
+		listElementsRemoved(c, key, o)
+		return
+	}
+	if count == 0 {
+		addReply(c, shared.emptyArray)
+		return
+	}
+	listPopRangeAndReply(c, o, key, where, int(count))
+
+}
+
+func lpopCommand(c *client) {
+	popGenericCommand(c, listHead)
+}
+
+func rpopCommand(c *client) {
+	popGenericCommand(c, listTail)
+}
+
+func llenCommand(c *client) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeList) {
+		return
+	}
+	addReplyLongLong(c, int64(listTypeLength(o)))
+
+}
+
+func lindexCommand(c *client) {
+
+	index, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o == nil {
+		addReplyNull(c)
+		return
+	}
+	if !checkType(c, o, objectTypeList) {
+		return
+	}
+
+	value, ok := listTypeIndex(o, int(index))
+	if !ok {
+		addReplyNull(c)
+		return
+	}
+	addReplyBulk(c, value)
+
+}
+
+func lsetCommand(c *client) {
+
+	o := lookupKeyWriteOrReply(c, c.argv[1].String(), shared.noKeyErr)
+	if o == nil || !checkType(c, o, objectTypeList) {
+		return
+	}
+	index, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+
+	if !o.data.(*quicklist).replaceAtIndex(int(index), c.argv[3].bytes()) {
+		addReply(c, shared.outOfRange)
+		return
+	}
+	rServer.dirty++
+	addReply(c, shared.ok)
+
+}
+
+// listNormalizeRange converts the start and end indexes of LRANGE and LTRIM
+// to a range of the list, it returns false when the range is empty.
+func listNormalizeRange(start, end int64, llen int) (int, int, bool) {
+
+	if start < 0 {
+		start += int64(llen)
+	}
+	if end < 0 {
+		end += int64(llen)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= int64(llen) {
+		return 0, 0, false
+	}
+	if end >= int64(llen) {
+		end = int64(llen) - 1
+	}
+	return int(start), int(end), true
+
+}
+
+func lrangeCommand(c *client) {
+
+	start, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+	end, ok := getLongLongFromObjectOrReply(c, c.argv[3], "")
+	if !ok {
+		return
+	}
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.emptyArray)
+	if o == nil || !checkType(c, o, objectTypeList) {
+		return
+	}
+	from, to, ok := listNormalizeRange(start, end, listTypeLength(o))
+	if !ok {
+		addReply(c, shared.emptyArray)
+		return
+	}
+	addListRangeReply(c, o, from, to-from+1, false)
+
+}
+
+func ltrimCommand(c *client) {
+
+	start, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+	end, ok := getLongLongFromObjectOrReply(c, c.argv[3], "")
+	if !ok {
+		return
+	}
+
+	key := c.argv[1].String()
+	o := lookupKeyWriteOrReply(c, key, shared.ok)
+	if o == nil || !checkType(c, o, objectTypeList) {
+		return
+	}
+
+	llen := listTypeLength(o)
+	ltrim, rtrim := llen, 0
+	if from, to, ok := listNormalizeRange(start, end, llen); ok {
+		ltrim, rtrim = from, llen-to-1
+	}
+
+	ql := o.data.(*quicklist)
+	ql.delRange(0, ltrim)
+	ql.delRange(-rtrim, rtrim)
+	rServer.dirty += int64(ltrim + rtrim)
+	listElementsRemoved(c, key, o)
+	addReply(c, shared.ok)
+
+}
+
+// linsertCommand implements LINSERT key BEFORE|AFTER pivot element.
+func linsertCommand(c *client) {
+
+	var after bool
+	switch s := c.argv[2].String(); {
+	case strings.EqualFold(s, "after"):
+		after = true
+	case strings.EqualFold(s, "before"):
+		after = false
+	default:
+		addReply(c, shared.syntaxErr)
+		return
+	}
+
+	o := lookupKeyWriteOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeList) {
+		return
+	}
+
+	ql := o.data.(*quicklist)
+	it := ql.iterator(quicklistHead)
+	pivot := c.argv[3].bytes()
+	var entry quicklistEntry
+	found := false
+	for it.next(&entry) {
+		if entry.compare(pivot) {
+			found = true
+			break
+		}
+	}
+	it.release()
+
+	if !found {
+		addReplyLongLong(c, -1)
+		return
+	}
+	ql.insert(&entry, c.argv[4].bytes(), after)
+	rServer.dirty++
+	addReplyLongLong(c, int64(listTypeLength(o)))
+
+}
+
+// lremCommand removes the first count occurrences of element, the last ones
+// with a negative count and all of them with 0.
+func lremCommand(c *client) {
+
+	toremove, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+	key := c.argv[1].String()
+	o := lookupKeyWriteOrReply(c, key, shared.czero)
+	if o == nil || !checkType(c, o, objectTypeList) {
+		return
+	}
+
+	direction := quicklistHead
+	if toremove < 0 {
+		toremove = -toremove
+		direction = quicklistTail
+	}
+
+	ql := o.data.(*quicklist)
+	it := ql.iterator(direction)
+	element := c.argv[3].bytes()
+	var entry quicklistEntry
+	var removed int64
+	for it.next(&entry) {
+		if entry.compare(element) {
+			it.delEntry(&entry)
+			removed++
+			if toremove != 0 && removed == toremove {
+				break
+			}
+		}
+	}
+	it.release()
+
+	rServer.dirty += removed
+	listElementsRemoved(c, key, o)
+	addReplyLongLong(c, removed)
+
+}
+
+// lposCommand implements LPOS key element [RANK rank] [COUNT num-matches]
+// [MAXLEN len].
+func lposCommand(c *client) {
+
+	rank, count, maxlen := int64(1), int64(-1), int64(0)
+	for j := 3; j < c.argc; j++ {
+		opt := strings.ToLower(c.argv[j].String())
+		if (opt != "rank" && opt != "count" && opt != "maxlen") || j+1 >= c.argc {
+			addReply(c, shared.syntaxErr)
+			return
+		}
+		v, ok := getLongLongFromObjectOrReply(c, c.argv[j+1], "")
+		if !ok {
+			return
+		}
+		switch opt {
+		case "rank":
+			if v == 0 {
+				addReplyError(c, "RANK can't be zero: use 1 to start from the first match, "+
+					"2 from the second ... or use negative to start from the end of the list")
+				return
+			}
+			if v == math.MinInt64 {
+				addReplyError(c, "value is out of range")
+				return
+			}
+			rank = v
+		case "count":
+			if v < 0 {
+				addReplyError(c, "COUNT can't be negative")
+				return
+			}
+			count = v
+		case "maxlen":
+			if v < 0 {
+				addReplyError(c, "MAXLEN can't be negative")
+				return
+			}
+			maxlen = v
+		}
+		j++
+	}
+
+	direction := quicklistHead
+	if rank < 0 {
+		rank = -rank
+		direction = quicklistTail
+	}
+
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o == nil {
+		if count != -1 {
+			addReply(c, shared.emptyArray)
+		} else {
+			addReplyNull(c)
+		}
+		return
+	}
+	if !checkType(c, o, objectTypeList) {
+		return
+	}
+
+	var placeholder *bufferBlock
+	if count != -1 {
+		placeholder = addReplyDeferredLen(c)
+	}
+
+	ql := o.data.(*quicklist)
+	llen := int64(ql.count)
+	it := ql.iterator(direction)
+	defer it.release()
+	element := c.argv[2].bytes()
+	var entry quicklistEntry
+	var index, matches, arraylen int64
+	for (maxlen == 0 || index < maxlen) && it.next(&entry) {
+		if entry.compare(element) {
+			matches++
+			if matches >= rank {
+				pos := index
+				if direction == quicklistTail {
+					pos = llen - index - 1
+				}
+				if placeholder == nil {
+					addReplyLongLong(c, pos)
+					return
+				}
+				addReplyLongLong(c, pos)
+				arraylen++
+				if count != 0 && matches-rank+1 >= count {
+					break
+				}
+			}
+		}
+		index++
+	}
+
+	if placeholder == nil {
+		addReplyNull(c)
+		return
+	}
+	setDeferredArrayLen(c, placeholder, int(arraylen))
+
+}
+
+// lmoveHandlePush pushes value to the destination list, creating it when
+// missing.
+func lmoveHandlePush(c *client, dstkey string, dobj *rObj, value []byte, where int) {
+	if dobj == nil {
+		dobj = createQuicklistObject()
+		dbAdd(c.db, dstkey, dobj)
+	}
+	listTypePush(dobj, value, where)
+}
+
+func lmoveGenericCommand(c *client, wherefrom, whereto int) {
+
+	srckey, dstkey := c.argv[1].String(), c.argv[2].String()
+	sobj := lookupKeyWrite(c.db, srckey)
+	if sobj == nil {
+		addReplyNull(c)
+		return
+	}
+	if !checkType(c, sobj, objectTypeList) {
+		return
+	}
+	dobj := lookupKeyWrite(c.db, dstkey)
+	if dobj != nil && !checkType(c, dobj, objectTypeList) {
+		return
+	}
+
+	value, _ := listTypePop(sobj, wherefrom)
+	lmoveHandlePush(c, dstkey, dobj, value, whereto)
+	addReplyBulk(c, value)
+	// when source and destination are the same list, it is not empty
+	listElementsRemoved(c, srckey, sobj)
+	rServer.dirty++
+
+}
+
+func lmoveCommand(c *client) {
+
+	wherefrom, ok := getListPositionFromObjectOrReply(c, c.argv[3])
+	if !ok {
+		return
+	}
+	whereto, ok := getListPositionFromObjectOrReply(c, c.argv[4])
+	if !ok {
+		return
+	}
+	lmoveGenericCommand(c, wherefrom, whereto)
+
+}
+
+func rpoplpushCommand(c *client) {
+	lmoveGenericCommand(c, listTail, listHead)
+}
+
+// blockingPopGenericCommand implements BLPOP and BRPOP key [key ...] timeout,
+// popping from the first non empty list.
+func blockingPopGenericCommand(c *client, where int) {
+
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.argv[c.argc-1], unitSeconds)
+	if !ok {
+		return
+	}
+
+	keys := c.argv[1 : c.argc-1]
+	for _, k := range keys {
+		key := k.String()
+		o := lookupKeyWrite(c.db, key)
+		if o == nil {
+			continue
+		}
+		if !checkType(c, o, objectTypeList) {
+			return
+		}
+		// empty lists are deleted, there is an element to pop
+		value, _ := listTypePop(o, where)
+		addReplyArrayLen(c, 2)
+		addReplyBulkString(c, key)
+		addReplyBulk(c, value)
+		rServer.dirty++
+		listElementsRemoved(c, key, o)
+		return
+	}
+
+	blockForKeys(c, blockedList, keys, timeout)
+
+}
+
+func blpopCommand(c *client) {
+	blockingPopGenericCommand(c, listHead)
+}
+
+func brpopCommand(c *client) {
+	blockingPopGenericCommand(c, listTail)
+}
+
+// blmoveGenericCommand is LMOVE blocking on the source key while it does
+// not exist.
+func blmoveGenericCommand(c *client, wherefrom, whereto int, timeout time.Duration) {
+
+	o := lookupKeyWrite(c.db, c.argv[1].String())
+	if o == nil {
+		blockForKeys(c, blockedList, c.argv[1:2], timeout)
+		return
+	}
+	lmoveGenericCommand(c, wherefrom, whereto)
+
+}
+
+// blmoveCommand implements BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout.
+func blmoveCommand(c *client) {
+
+	wherefrom, ok := getListPositionFromObjectOrReply(c, c.argv[3])
+	if !ok {
+		return
+	}
+	whereto, ok := getListPositionFromObjectOrReply(c, c.argv[4])
+	if !ok {
+		return
+	}
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.argv[5], unitSeconds)
+	if !ok {
+		return
+	}
+	blmoveGenericCommand(c, wherefrom, whereto, timeout)
+
+}
+
+func brpoplpushCommand(c *client) {
+
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.argv[3], unitSeconds)
+	if !ok {
+		return
+	}
+	blmoveGenericCommand(c, listTail, listHead, timeout)
+
+}
+
+// lmpopParseArgs parses the arguments of LMPOP and BLMPOP, the number
+// of keys being at argv[numkeysIdx]. It returns the keys, the side to pop
+// from and the count.
+func lmpopParseArgs(c *client, numkeysIdx int) ([]string, int, int, bool) {
+
+	numkeys, ok := getRangeLongFromObjectOrReply(c, c.argv[numkeysIdx], 1, math.MaxInt64, "numkeys should be greater than 0")
+	if !ok {
+		return nil, 0, 0, false
+	}
+	whereIdx := int64(numkeysIdx) + numkeys + 1
+	if whereIdx >= int64(c.argc) {
+		addReply(c, shared.syntaxErr)
+		return nil, 0, 0, false
+	}
+	where, ok := getListPositionFromObjectOrReply(c, c.argv[whereIdx])
+	if !ok {
+		return nil, 0, 0, false
+	}
+
+	count := int64(-1)
+	for j := int(whereIdx) + 1; j < c.argc; j++ {
+		if strings.EqualFold(c.argv[j].String(), "count") && j+1 < c.argc && count == -1 {
+			if count, ok = getRangeLongFromObjectOrReply(c, c.argv[j+1], 1, math.MaxInt64, "count should be greater than 0"); !ok {
+				return nil, 0, 0, false
+			}
+			j++
+			continue
+		}
+		addReply(c, shared.syntaxErr)
+		return nil, 0, 0, false
+	}
+	if count == -1 {
+		count = 1
+	}
+
+	keys := make([]string, numkeys)
+	for j := range keys {
+		keys[j] = c.argv[numkeysIdx+1+j].String()
+	}
+	return keys, where, int(count), true
+
+}
+
+// lmpopGenericCommand implements LMPOP and BLMPOP, blocking when every list
+// is empty with block.
+func lmpopGenericCommand(c *client, numkeysIdx int, block bool, timeout time.Duration) {
+
+	keys, where, count, ok := lmpopParseArgs(c, numkeysIdx)
+	if !ok {
+		return
+	}
+	for _, key := range keys {
+		o := lookupKeyWrite(c.db, key)
+		if o == nil {
+			continue
+		}
+		if !checkType(c, o, objectTypeList) {
+			return
+		}
+		listPopRangeAndReplyWithKey(c, o, key, where, count)
+		return
+	}
+
+	if block {
+		blockForKeys(c, blockedList, c.argv[numkeysIdx+1:numkeysIdx+1+len(keys)], timeout)
+		return
+	}
+	addReplyNullArray(c)
+
+}
+
+// lmpopCommand implements LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count].
+func lmpopCommand(c *client) {
+	lmpopGenericCommand(c, 1, false, 0)
+}
+
+// blmpopCommand implements BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count].
+func blmpopCommand(c *client) {
+
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.argv[1], unitSeconds)
+	if !ok {
+		return
+	}
+	lmpopGenericCommand(c, 2, true, timeout)
+
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setListNodeLimits makes small quicklist nodes for a test, so the lists
+// span many of them.
+func setListNodeLimits(tc *testConn, size, depth int) {
+	tc.t.Helper()
+	tc.expect(testStatus("OK"), "config", "set",
+		"list-max-listpack-size", strconv.Itoa(size), "list-compress-depth", strconv.Itoa(depth))
+	tc.t.Cleanup(func() {
+		tc.do("config", "set", "list-max-listpack-size", "-2", "list-compress-depth", "0")
+	})
+}
+
+func TestList_PushPop(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "13")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(int64(0), "lpushx", "l", "a")
+	tc.expect(int64(0), "exists", "l")
+	tc.expect(int64(3), "rpush", "l", "a", "b", "c")
+	tc.expect(int64(5), "lpush", "l", "2", "1")
+	tc.expect(int64(6), "rpushx", "l", "d")
+	tc.expect(testStatus("list"), "type", "l")
+	tc.expect("quicklist", "object", "encoding", "l")
+	tc.expect([]any{"1", "2", "a", "b", "c", "d"}, "lrange", "l", "0", "-1")
+
+	tc.expect("1", "lpop", "l")
+	tc.expect("d", "rpop", "l")
+	tc.expect([]any{"2", "a"}, "lpop", "l", "2")
+	tc.expect([]any{"c", "b"}, "rpop", "l", "5")
+	tc.expect(int64(0), "exists", "l")
+	tc.expect(nil, "lpop", "l")
+	tc.expect(nil, "rpop", "l", "2")
+	tc.expect(testError("ERR value is out of range, must be positive"), "lpop", "l", "-1")
+	tc.expect(testError("ERR wrong number of arguments for 'lpop' command"), "lpop", "l", "1", "2")
+
+	tc.expect(int64(1), "rpush", "l", "x")
+	tc.expect([]any{}, "lpop", "l", "0")
+	tc.expect(int64(1), "llen", "l")
+	tc.expect(int64(0), "llen", "nokey")
+
+	tc.expect(testStatus("OK"), "set", "s", "v")
+	tc.expectError("WRONGTYPE", "lpush", "s", "a")
+	tc.expectError("WRONGTYPE", "lrange", "s", "0", "-1")
+}
+
+func TestList_Index(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "13")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(int64(5), "rpush", "l", "a", "b", "c", "d", "e")
+	tc.expect("a", "lindex", "l", "0")
+	tc.expect("e", "lindex", "l", "-1")
+	tc.expect(nil, "lindex", "l", "5")
+	tc.expect(nil, "lindex", "l", "-6")
+	tc.expect(nil, "lindex", "nokey", "0")
+
+	tc.expect(testStatus("OK"), "lset", "l", "1", "B")
+	tc.expect(testStatus("OK"), "lset", "l", "-1", "E")
+	tc.expect(testError("ERR index out of range"), "lset", "l", "5", "x")
+	tc.expect(testError("ERR no such key"), "lset", "nokey", "0", "x")
+
+	tc.expect([]any{"B", "c"}, "lrange", "l", "1", "2")
+	tc.expect([]any{"d", "E"}, "lrange", "l", "-2", "100")
+	tc.expect([]any{}, "lrange", "l", "3", "1")
+	tc.expect([]any{}, "lrange", "l", "10", "20")
+	tc.expect([]any{}, "lrange", "nokey", "0", "-1")
+
+	tc.expect(int64(6), "linsert", "l", "before", "c", "b2")
+	tc.expect(int64(7), "linsert", "l", "AFTER", "E", "f")
+	tc.expect(int64(-1), "linsert", "l", "after", "nope", "x")
+	tc.expect(int64(0), "linsert", "nokey", "after", "a", "x")
+	tc.expect(testError("ERR syntax error"), "linsert", "l", "middle", "a", "x")
+	tc.expect([]any{"a", "B", "b2", "c", "d", "E", "f"}, "lrange", "l", "0", "-1")
+
+	tc.expect(testStatus("OK"), "ltrim", "l", "1", "-2")
+	tc.expect([]any{"B", "b2", "c", "d", "E"}, "lrange", "l", "0", "-1")
+	tc.expect(testStatus("OK"), "ltrim", "l", "5", "10")
+	tc.expect(int64(0), "exists", "l")
+}
+
+func TestList_RemPos(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "13")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(int64(8), "rpush", "l", "a", "b", "a", "1", "a", "b", "1", "a")
+	tc.expect(int64(0), "lpos", "l", "a")
+	tc.expect(int64(2), "lpos", "l", "a", "rank", "2")
+	tc.expect(int64(7), "lpos", "l", "a", "rank", "-1")
+	tc.expect(int64(4), "lpos", "l", "a", "rank", "-2")
+	tc.expect(int64(3), "lpos", "l", "1")
+	tc.expect(nil, "lpos", "l", "x")
+	tc.expect([]any{int64(0), int64(2), int64(4), int64(7)}, "lpos", "l", "a", "count", "0")
+	tc.expect([]any{int64(2), int64(4)}, "lpos", "l", "a", "rank", "2", "count", "2")
+	tc.expect([]any{int64(7), int64(4)}, "lpos", "l", "a", "rank", "-1", "count", "2")
+	tc.expect([]any{int64(0), int64(2)}, "lpos", "l", "a", "count", "0", "maxlen", "4")
+	tc.expect([]any{}, "lpos", "l", "x", "count", "0")
+	tc.expect([]any{}, "lpos", "nokey", "x", "count", "0")
+	tc.expectError("ERR RANK can't be zero", "lpos", "l", "a", "rank", "0")
+	tc.expect(testError("ERR COUNT can't be negative"), "lpos", "l", "a", "count", "-1")
+	tc.expect(testError("ERR syntax error"), "lpos", "l", "a", "nope", "1")
+
+	tc.expect(int64(2), "lrem", "l", "2", "a")
+	tc.expect([]any{"b", "1", "a", "b", "1", "a"}, "lrange", "l", "0", "-1")
+	tc.expect(int64(1), "lrem", "l", "-1", "1")
+	tc.expect([]any{"b", "1", "a", "b", "a"}, "lrange", "l", "0", "-1")
+	tc.expect(int64(2), "lrem", "l", "0", "b")
+	tc.expect(int64(0), "lrem", "l", "0", "nope")
+	tc.expect(int64(2), "lrem", "l", "0", "a")
+	tc.expect(int64(1), "lrem", "l", "0", "1")
+	tc.expect(int64(0), "exists", "l")
+}
+
+func TestList_Move(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "13")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(int64(3), "rpush", "src", "a", "b", "c")
+	tc.expect("a", "lmove", "src", "dst", "left", "right")
+	tc.expect("c", "lmove", "src", "dst", "RIGHT", "LEFT")
+	tc.expect([]any{"c", "a"}, "lrange", "dst", "0", "-1")
+	tc.expect("b", "rpoplpush", "src", "dst")
+	tc.expect(int64(0), "exists", "src")
+	tc.expect(nil, "lmove", "src", "dst", "left", "left")
+	tc.expect(testError("ERR syntax error"), "lmove", "dst", "src", "up", "left")
+
+	// rotation
+	tc.expect("a", "lmove", "dst", "dst", "right", "left")
+	tc.expect([]any{"a", "b", "c"}, "lrange", "dst", "0", "-1")
+
+	tc.expect(testStatus("OK"), "set", "str", "v")
+	tc.expectError("WRONGTYPE", "lmove", "dst", "str", "left", "left")
+	tc.expect(int64(3), "llen", "dst")
+
+	tc.expect(nil, "lmpop", "2", "nokey1", "nokey2", "left")
+	tc.expect([]any{"dst", []any{"a"}}, "lmpop", "2", "nokey", "dst", "left")
+	tc.expect([]any{"dst", []any{"c", "b"}}, "lmpop", "1", "dst", "right", "count", "10")
+	tc.expect(int64(0), "exists", "dst")
+	tc.expect(testError("ERR numkeys should be greater than 0"), "lmpop", "0", "l", "left")
+	tc.expect(testError("ERR count should be greater than 0"), "lmpop", "1", "l", "left", "count", "0")
+	tc.expect(testError("ERR syntax error"), "lmpop", "2", "l", "left")
+	tc.expect(testError("ERR syntax error"), "lmpop", "1", "l", "left", "count", "1", "count", "1")
+	tc.expectError("WRONGTYPE", "lmpop", "1", "str", "left")
+}
+
+// TestList_ManyNodes runs the commands on lists spanning many compressed
+// nodes, checking them against a slice.
+func TestList_ManyNodes(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "13")
+	tc.expect(testStatus("OK"), "flushdb")
+	setListNodeLimits(tc, 4, 1)
+
+	var model []string
+	args := []string{"rpush", "l"}
+	for j := 0; j < 500; j++ {
+		v := strings.Repeat("e", j%70) + strconv.Itoa(j)
+		args = append(args, v)
+		model = append(model, v)
+	}
+	tc.expect(int64(500), args...)
+
+	check := func() {
+		t.Helper()
+		got := tc.do("lrange", "l", "0", "-1").([]any)
+		if len(got) != len(model) {
+			t.Fatalf("want %d elements, got %d", len(model), len(got))
+		}
+		for j := range got {
+			if got[j] != model[j] {
+				t.Fatalf("element %d: want %.10q, got %.10q", j, model[j], got[j])
+			}
+		}
+	}
+	check()
+
+	tc.expect(model[250], "lindex", "l", "250")
+	tc.expect(model[400], "lindex", "l", "-100")
+	tc.expect(testStatus("OK"), "lset", "l", "123", strings.Repeat("big", 100))
+	model[123] = strings.Repeat("big", 100)
+	tc.expect(int64(501), "linsert", "l", "after", model[300], "new")
+	model = append(model[:301], append([]string{"new"}, model[301:]...)...)
+	check()
+
+	tc.expect(testStatus("OK"), "ltrim", "l", "17", "-33")
+	model = model[17 : len(model)-32]
+	check()
+
+	tc.expect(int64(1), "lrem", "l", "0", model[100])
+	model = append(model[:100], model[101:]...)
+	check()
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A set of integers is intset encoded while it has at most
+// set-max-intset-entries members, any other set is a hashtable of
+// member -> nil. A set never converts back.
+
+// setTypeCreate returns an empty set suited to hold value and about
+// sizeHint members.
+func setTypeCreate(value string, sizeHint int) *rObj {
+
+	if _, ok := string2ll([]byte(value)); ok && sizeHint <= rServer.setMaxIntsetEntries {
+		return createIntsetObject()
+	}
+	d := newDict()
+	if sizeHint > 1 {
+		d.expand(sizeHint)
+	}
+	return &rObj{objectType: objectTypeSet, encoding: objectEncodingHT, data: d}
+
+}
+
+func createIntsetObject() *rObj {
+	return &rObj{
+		objectType: objectTypeSet,
+		encoding:   objectEncodingIntset,
+		data:       intsetNew(),
+	}
+}
+
+// setTypeConvert converts an intset to a hashtable sized for sizeHint
+// members.
+func setTypeConvert(o *rObj, sizeHint int) {
+
+	if o.encoding != objectEncodingIntset {
+		panic("setTypeConvert: unknown set encoding")
+	}
+
+	is := o.data.([]byte)
+	d := newDict()
+	d.expand(max(sizeHint, intsetLen(is)))
+	for j := 0; j < intsetLen(is); j++ {
+		d.add(strconv.FormatInt(intsetGet(is, j), 10), nil)
+	}
+	o.encoding, o.data = objectEncodingHT, d
+
+}
+
+// setTypeAdd adds value to the set, it returns false if it was a member.
+func setTypeAdd(o *rObj, value string) bool {
+
+	if o.encoding == objectEncodingIntset {
+		if v, ok := string2ll([]byte(value)); ok {
+			is, added := intsetAdd(o.data.([]byte), v)
+			o.data = is
+			if added && intsetLen(is) > rServer.setMaxIntsetEntries {
+				setTypeConvert(o, intsetLen(is))
+			}
+			return added
+		}
+		setTypeConvert(o, setTypeSize(o)+1)
+	}
+	return o.data.(*dict).add(value, nil)
+
+}
+
+// setTypeRemove removes value from the set, it returns false if it was not
+// a member.
+func setTypeRemove(o *rObj, value string) bool {
+
+	if o.encoding == objectEncodingIntset {
+		v, ok := string2ll([]byte(value))
+		if !ok {
+			return false
+		}
+		is, removed := intsetRemove(o.data.([]byte), v)
+		o.data = is
+		return removed
+	}
+
+	d := o.data.(*dict)
+	if d.delete(value) == nil {
+		return false
+	}
+	if d.needsResize() {
+		d.resize()
+	}
+	return true
+
+}
+
+func setTypeIsMember(o *rObj, value string) bool {
+
+	if o.encoding == objectEncodingIntset {
+		v, ok := string2ll([]byte(value))
+		return ok && intsetFind(o.data.([]byte), v)
+	}
+	return o.data.(*dict).find(value) != nil
+
+}
+
+func setTypeSize(o *rObj) int {
+	if o.encoding == objectEncodingIntset {
+		return intsetLen(o.data.([]byte))
+	}
+	return o.data.(*dict).size()
+}
+
+// setTypeDup returns a copy of the set o.
+func setTypeDup(o *rObj) *rObj {
+
+	if o.encoding == objectEncodingIntset {
+		return &rObj{objectType: objectTypeSet, encoding: objectEncodingIntset, data: append([]byte(nil), o.data.([]byte)...)}
+	}
+	d := newDict()
+	d.expand(setTypeSize(o))
+	o.data.(*dict).forEachUnsafe(func(de *dictEntry) bool {
+		d.add(de.key, nil)
+		return true
+	})
+	return &rObj{objectType: objectTypeSet, encoding: objectEncodingHT, data: d}
+
+}
+
+// setTypeIterator walks the members of a set, the set must not be modified
+// until the iterator is released.
+type setTypeIterator struct {
+	o   *rObj
+	idx int
+	di  *dictIterator
+}
+
+func setTypeInitIterator(o *rObj) *setTypeIterator {
+	si := &setTypeIterator{o: o}
+	if o.encoding == objectEncodingHT {
+		si.di = o.data.(*dict).iterator()
+	}
+	return si
+}
+
+func (si *setTypeIterator) next() (string, bool) {
+
+	if si.di != nil {
+		de := si.di.next()
+		if de == nil {
+			return "", false
+		}
+		return de.key, true
+	}
+
+	is := si.o.data.([]byte)
+	if si.idx >= intsetLen(is) {
+		return "", false
+	}
+	si.idx++
+	return strconv.FormatInt(intsetGet(is, si.idx-1), 10), true
+
+}
+
+func (si *setTypeIterator) release() {
+	if si.di != nil {
+		si.di.release()
+	}
+}
+
+// setTypeRandomElement returns a random member of a non empty set.
+func setTypeRandomElement(o *rObj) string {
+	if o.encoding == objectEncodingIntset {
+		return strconv.FormatInt(intsetRandom(o.data.([]byte)), 10)
+	}
+	return o.data.(*dict).randomEntry().key
+}
+
+// setTypeRandomElements returns count distinct random members, count being
+// smaller than the size of the set.
+func setTypeRandomElements(o *rObj, count int) []string {
+
+	members := make([]string, 0, count)
+	if o.encoding == objectEncodingIntset {
+		is := o.data.([]byte)
+		for _, idx := range rand.Perm(intsetLen(is))[:count] {
+			members = append(members, strconv.FormatInt(intsetGet(is, idx), 10))
+		}
+		return members
+	}
+
+	d := o.data.(*dict)
+	if count*3 > d.size() {
+		// close to the whole set: pick the members of a random permutation
+		d.forEach(func(de *dictEntry) bool {
+			members = append(members, de.key)
+			return true
+		})
+		rand.Shuffle(len(members), func(i, j int) {
+			members[i], members[j] = members[j], members[i]
+		})
+		return members[:count]
+	}
+
+	seen := make(map[string]struct{}, count)
+	for len(members) < count {
+		de := d.randomEntry()
+		if _, ok := seen[de.key]; ok {
+			continue
+		}
+		seen[de.key] = struct{}{}
+		members = append(members, de.key)
+	}
+	return members
+
+}
+
+// addSetReply replies the members of o, a nil o being an empty set.
+func addSetReply(c *client, o *rObj) {
+
+	if o == nil {
+		addReplySetLen(c, 0)
+		return
+	}
+	addReplySetLen(c, setTypeSize(o))
+	si := setTypeInitIterator(o)
+	defer si.release()
+	for member, ok := si.next(); ok; member, ok = si.next() {
+		addReplyBulkString(c, member)
+	}
+
+}
+
+func saddCommand(c *client) {
+
+	key := c.argv[1].String()
+	o := lookupKeyWrite(c.db, key)
+	if o != nil && !checkType(c, o, objectTypeSet) {
+		return
+	}
+	if o == nil {
+		o = setTypeCreate(c.argv[2].String(), c.argc-2)
+		dbAdd(c.db, key, o)
+	}
+
+	var added int64
+	for j := 2; j < c.argc; j++ {
+		if setTypeAdd(o, c.argv[j].String()) {
+			added++
+		}
+	}
+	rServer.dirty += added
+	addReplyLongLong(c, added)
+
+}
+
+func sremCommand(c *client) {
+
+	key := c.argv[1].String()
+	o := lookupKeyWriteOrReply(c, key, shared.czero)
+	if o == nil || !checkType(c, o, objectTypeSet) {
+		return
+	}
+
+	var deleted int64
+	for j := 2; j < c.argc; j++ {
+		if setTypeRemove(o, c.argv[j].String()) {
+			deleted++
+			if setTypeSize(o) == 0 {
+				dbDelete(c.db, key)
+				break
+			}
+		}
+	}
+	rServer.dirty += deleted
+	addReplyLongLong(c, deleted)
+
+}
+
+func smoveCommand(c *client) {
+
+	srckey, dstkey := c.argv[1].String(), c.argv[2].String()
+	member := c.argv[3].String()
+	srcset := lookupKeyWrite(c.db, srckey)
+	dstset := lookupKeyWrite(c.db, dstkey)
+	if srcset == nil {
+		addReply(c, shared.czero)
+		return
+	}
+	if !checkType(c, srcset, objectTypeSet) {
+		return
+	}
+	if dstset != nil && !checkType(c, dstset, objectTypeSet) {
+		return
+	}
+
+	// moving to the same set only tells whether member is there
+	if srcset == dstset {
+		if setTypeIsMember(srcset, member) {
+			addReply(c, shared.cone)
+		} else {
+			addReply(c, shared.czero)
+		}
+		return
+	}
+
+	if !setTypeRemove(srcset, member) {
+		addReply(c, shared.czero)
+		return
+	}
+	if setTypeSize(srcset) == 0 {
+		dbDelete(c.db, srckey)
+	}
+	if dstset == nil {
+		dstset = setTypeCreate(member, 1)
+		dbAdd(c.db, dstkey, dstset)
+	}
+	if setTypeAdd(dstset, member) {
+		rServer.dirty++
+	}
+	rServer.dirty++
+	addReply(c, shared.cone)
+
+}
+
+func sismemberCommand(c *client) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeSet) {
+		return
+	}
+	if setTypeIsMember(o, c.argv[2].String()) {
+		addReply(c, shared.cone)
+	} else {
+		addReply(c, shared.czero)
+	}
+
+}
+
+func smismemberCommand(c *client) {
+
+	// a missing key is an empty set, none of the values is a member
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o != nil && !checkType(c, o, objectTypeSet) {
+		return
+	}
+
+	addReplyArrayLen(c, c.argc-2)
+	for j := 2; j < c.argc; j++ {
+		if o != nil && setTypeIsMember(o, c.argv[j].String()) {
+			addReply(c, shared.cone)
+		} else {
+			addReply(c, shared.czero)
+		}
+	}
+
+}
+
+func scardCommand(c *client) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeSet) {
+		return
+	}
+	addReplyLongLong(c, int64(setTypeSize(o)))
+
+}
+
+func smembersCommand(c *client) {
+
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o != nil && !checkType(c, o, objectTypeSet) {
+		return
+	}
+	addSetReply(c, o)
+
+}
+
+// SPOP with count propagates the members popped in SREMs of this size.
+const spopPropagationBatch = 1024
+
+func spopWithCountCommand(c *client) {
+
+	count, ok := getRangeLongFromObjectOrReply(c, c.argv[2], 0, math.MaxInt64, "value is out of range, must be positive")
+	if !ok {
+		return
+	}
+
+	key := c.argv[1].String()
+	o := lookupKeyWrite(c.db, key)
+	if o != nil && !checkType(c, o, objectTypeSet) {
+		return
+	}
+	if o == nil || count == 0 {
+		addReplySetLen(c, 0)
+		return
+	}
+
+	// popping the whole set is deleting it
+	if count >= int64(setTypeSize(o)) {
+		rServer.dirty += int64(setTypeSize(o))
+		addSetReply(c, o)
+		dbDelete(c.db, key)
+		rewriteClientCommandVector(c, createEmbeddedStringObject("DEL"), c.argv[1])
+		return
+	}
+
+	// the members popped at random are propagated as SREMs of at most
+	// spopPropagationBatch members each
+	members := setTypeRandomElements(o, int(count))
+	addReplySetLen(c, len(members))
+	var srem []*rObj
+	for _, member := range members {
+		setTypeRemove(o, member)
+		addReplyBulkString(c, member)
+		if srem == nil {
+			srem = make([]*rObj, 0, 2+min(spopPropagationBatch, len(members)))
+			srem = append(srem, createEmbeddedStringObject("SREM"), c.argv[1])
+		}
+		srem = append(srem, createStringObject([]byte(member)))
+		if len(srem)-2 == spopPropagationBatch {
+			alsoPropagate(c.db.id, srem)
+			srem = nil
+		}
+	}
+	if srem != nil {
+		alsoPropagate(c.db.id, srem)
+	}
+	preventCommandPropagation(c)
+	rServer.dirty += count
+
+}
+
+// spopCommand implements SPOP key [count].
+func spopCommand(c *client) {
+
+	if c.argc == 3 {
+		spopWithCountCommand(c)
+		return
+	}
+	if c.argc > 3 {
+		addReply(c, shared.syntaxErr)
+		return
+	}
+
+	key := c.argv[1].String()
+	o := lookupKeyWriteOrReply(c, key, shared.nullBulk)
+	if o == nil || !checkType(c, o, objectTypeSet) {
+		return
+	}
+	member := setTypeRandomElement(o)
+	setTypeRemove(o, member)
+	if setTypeSize(o) == 0 {
+		dbDelete(c.db, key)
+	}
+	rServer.dirty++
+	addReplyBulkString(c, member)
+
+	// the member popped at random is propagated
+	rewriteClientCommandVector(c, createEmbeddedStringObject("SREM"), c.argv[1], createStringObject([]byte(member)))
+
+}
+
+func srandmemberWithCountCommand(c *client) {
+
+	count, ok := getRangeLongFromObjectOrReply(c, c.argv[2], -math.MaxInt64, math.MaxInt64, "")
+	if !ok {
+		return
+	}
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.emptyArray)
+	if o == nil || !checkType(c, o, objectTypeSet) {
+		return
+	}
+	if count == 0 {
+		addReply(c, shared.emptyArray)
+		return
+	}
+
+	// a negative count allows the same member multiple times
+	if count < 0 {
+		addReplyArrayLen(c, int(-count))
+		for j := int64(0); j < -count; j++ {
+			addReplyBulkString(c, setTypeRandomElement(o))
+		}
+		return
+	}
+
+	size := setTypeSize(o)
+	if count >= int64(size) {
+		addReplyArrayLen(c, size)
+		si := setTypeInitIterator(o)
+		defer si.release()
+		for member, ok := si.next(); ok; member, ok = si.next() {
+			addReplyBulkString(c, member)
+		}
+		return
+	}
+
+	members := setTypeRandomElements(o, int(count))
+	addReplyArrayLen(c, len(members))
+	for _, member := range members {
+		addReplyBulkString(c, member)
+	}
+
+}
+
+// srandmemberCommand implements SRANDMEMBER key [count].
+func srandmemberCommand(c *client) {
+
+	if c.argc == 3 {
+		srandmemberWithCountCommand(c)
+		return
+	}
+	if c.argc > 3 {
+		addReply(c, shared.syntaxErr)
+		return
+	}
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.nullBulk)
+	if o == nil || !checkType(c, o, objectTypeSet) {
+		return
+	}
+	addReplyBulkString(c, setTypeRandomElement(o))
+
+}
+
+// storeSetResult stores the result of a *STORE command at dstkey, deleting
+// the key when the result is empty, and replies its size.
+func storeSetResult(c *client, dstkey string, dstset *rObj) {
+
+	size := setTypeSize(dstset)
+	if size > 0 {
+		setKey(c.db, dstkey, dstset, false)
+	} else {
+		dbDelete(c.db, dstkey)
+	}
+	rServer.dirty++
+	addReplyLongLong(c, int64(size))
+
+}
+
+// sinterGenericCommand implements SINTER, SINTERSTORE when dstkey is set and
+// SINTERCARD when cardinalityOnly is set, stopping at limit members unless
+// limit is 0.
+func sinterGenericCommand(c *client, setkeys []*rObj, dstkey string, cardinalityOnly bool, limit int64) {
+
+	sets := make([]*rObj, 0, len(setkeys))
+	for _, key := range setkeys {
+		o := lookupKeyRead(c.db, key.String())
+		if o == nil {
+			// the intersection with an empty set is empty
+			switch {
+			case dstkey != "":
+				if dbDelete(c.db, dstkey) {
+					rServer.dirty++
+				}
+				addReply(c, shared.czero)
+			case cardinalityOnly:
+				addReply(c, shared.czero)
+			default:
+				addReplySetLen(c, 0)
+			}
+			return
+		}
+		if !checkType(c, o, objectTypeSet) {
+			return
+		}
+		sets = append(sets, o)
+	}
+
+	// walk the smallest set, checking the members in the others
+	sort.SliceStable(sets, func(i, j int) bool {
+		return setTypeSize(sets[i]) < setTypeSize(sets[j])
+	})
+
+	var members []string
+	var cardinality int64
+	si := setTypeInitIterator(sets[0])
+	for member, ok := si.next(); ok; member, ok = si.next() {
+		found := true
+		for _, o := range sets[1:] {
+			if !setTypeIsMember(o, member) {
+				found = false
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		if cardinalityOnly {
+			cardinality++
+			if cardinality == limit {
+				break
+			}
+			continue
+		}
+		members = append(members, member)
+	}
+	si.release()
+
+	switch {
+	case cardinalityOnly:
+		addReplyLongLong(c, cardinality)
+	case dstkey != "":
+		dstset := createIntsetObject()
+		for _, member := range members {
+			setTypeAdd(dstset, member)
+		}
+		storeSetResult(c, dstkey, dstset)
+	default:
+		addReplySetLen(c, len(members))
+		for _, member := range members {
+			addReplyBulkString(c, member)
+		}
+	}
+
+}
+
+func sinterCommand(c *client) {
+	sinterGenericCommand(c, c.argv[1:c.argc], "", false, 0)
+}
+
+func sinterstoreCommand(c *client) {
+	sinterGenericCommand(c, c.argv[2:c.argc], c.argv[1].String(), false, 0)
+}
+
+// sintercardCommand implements SINTERCARD numkeys key [key ...] [LIMIT limit].
+func sintercardCommand(c *client) {
+
+	numkeys, ok := getRangeLongFromObjectOrReply(c, c.argv[1], 1, math.MaxInt64, "numkeys should be greater than 0")
+	if !ok {
+		return
+	}
+	if numkeys > int64(c.argc-2) {
+		addReplyError(c, "Number of keys can't be greater than number of args")
+		return
+	}
+
+	var limit int64
+	for j := 2 + int(numkeys); j < c.argc; j++ {
+		if strings.EqualFold(c.argv[j].String(), "limit") && j+1 < c.argc {
+			limit, ok = getRangeLongFromObjectOrReply(c, c.argv[j+1], 0, math.MaxInt64, "LIMIT can't be negative")
+			if !ok {
+				return
+			}
+			j++
+			continue
+		}
+		addReply(c, shared.syntaxErr)
+		return
+	}
+
+	sinterGenericCommand(c, c.argv[2:2+numkeys], "", true, limit)
+
+}
+
+// set operations of sunionDiffGenericCommand
+const (
+	setOpUnion = iota
+	setOpDiff
+)
+
+// sunionDiffGenericCommand implements SUNION, SDIFF and their STORE variants
+// when dstkey is set.
+func sunionDiffGenericCommand(c *client, setkeys []*rObj, dstkey string, op int) {
+
+	// missing keys are empty sets, left nil
+	sets := make([]*rObj, len(setkeys))
+	for j, key := range setkeys {
+		o := lookupKeyRead(c.db, key.String())
+		if o != nil && !checkType(c, o, objectTypeSet) {
+			return
+		}
+		sets[j] = o
+	}
+
+	dstset := createIntsetObject()
+	addMembers := func(o *rObj, keep func(member string) bool) {
+		si := setTypeInitIterator(o)
+		defer si.release()
+		for member, ok := si.next(); ok; member, ok = si.next() {
+			if keep == nil || keep(member) {
+				setTypeAdd(dstset, member)
+			}
+		}
+	}
+
+	switch op {
+	case setOpUnion:
+		for _, o := range sets {
+			if o != nil {
+				addMembers(o, nil)
+			}
+		}
+	case setOpDiff:
+		if sets[0] != nil {
+			addMembers(sets[0], func(member string) bool {
+				for _, o := range sets[1:] {
+					if o != nil && setTypeIsMember(o, member) {
+						return false
+					}
+				}
+				return true
+			})
+		}
+	}
+
+	if dstkey != "" {
+		storeSetResult(c, dstkey, dstset)
+		return
+	}
+	addSetReply(c, dstset)
+
+}
+
+func sunionCommand(c *client) {
+	sunionDiffGenericCommand(c, c.argv[1:c.argc], "", setOpUnion)
+}
+
+func sunionstoreCommand(c *client) {
+	sunionDiffGenericCommand(c, c.argv[2:c.argc], c.argv[1].String(), setOpUnion)
+}
+
+func sdiffCommand(c *client) {
+	sunionDiffGenericCommand(c, c.argv[1:c.argc], "", setOpDiff)
+}
+
+func sdiffstoreCommand(c *client) {
+	sunionDiffGenericCommand(c, c.argv[2:c.argc], c.argv[1].String(), setOpDiff)
+}
+
+func sscanCommand(c *client) {
+
+	cursor, ok := parseScanCursorOrReply(c, c.argv[2])
+	if !ok {
+		return
+	}
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.emptyScan)
+	if o == nil || !checkType(c, o, objectTypeSet) {
+		return
+	}
+	scanGenericCommand(c, o, cursor)
+
+}
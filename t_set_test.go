@@ -0,0 +1,275 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sortedMembers returns the members of a set reply, sorted.
+func sortedMembers(t *testing.T, reply any) string {
+	t.Helper()
+	var items []any
+	switch r := reply.(type) {
+	case []any:
+		items = r
+	case testSet:
+		items = r
+	default:
+		t.Fatalf("want an array or set reply, got %#v", reply)
+	}
+	members := make([]string, len(items))
+	for j, item := range items {
+		members[j] = item.(string)
+	}
+	sort.Strings(members)
+	return strings.Join(members, ",")
+}
+
+func TestSet_Basic(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "14")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(int64(3), "sadd", "s", "3", "1", "2")
+	tc.expect(int64(1), "sadd", "s", "2", "-10")
+	tc.expect(testStatus("set"), "type", "s")
+	tc.expect("intset", "object", "encoding", "s")
+	// an intset replies its members sorted
+	tc.expect([]any{"-10", "1", "2", "3"}, "smembers", "s")
+
+	tc.expect(int64(1), "sismember", "s", "1")
+	tc.expect(int64(0), "sismember", "s", "01")
+	tc.expect(int64(0), "sismember", "nokey", "1")
+	tc.expect([]any{int64(1), int64(0), int64(1)}, "smismember", "s", "3", "x", "-10")
+	tc.expect([]any{int64(0), int64(0)}, "smismember", "nokey", "a", "b")
+	tc.expect(int64(4), "scard", "s")
+	tc.expect(int64(0), "scard", "nokey")
+	tc.expect([]any{}, "smembers", "nokey")
+
+	// a member that is not an integer converts the set
+	tc.expect(int64(1), "sadd", "s", "a")
+	tc.expect("hashtable", "object", "encoding", "s")
+	if got := sortedMembers(t, tc.do("smembers", "s")); got != "-10,1,2,3,a" {
+		t.Fatalf("unexpected members %s", got)
+	}
+	tc.expect(int64(1), "sismember", "s", "2")
+
+	tc.expect(int64(2), "srem", "s", "a", "1", "nope")
+	tc.expect(int64(0), "srem", "nokey", "a")
+	tc.expect(int64(3), "srem", "s", "-10", "2", "3")
+	tc.expect(int64(0), "exists", "s")
+
+	tc.expect(int64(2), "sadd", "words", "a", "b")
+	tc.expect("hashtable", "object", "encoding", "words")
+
+	tc.expect(testStatus("OK"), "set", "str", "v")
+	tc.expectError("WRONGTYPE", "sadd", "str", "a")
+	tc.expectError("WRONGTYPE", "smembers", "str")
+	tc.expectError("WRONGTYPE", "sinter", "words", "str")
+
+	tc.do("hello", "3")
+	if got := sortedMembers(t, tc.do("smembers", "words")); got != "a,b" {
+		t.Fatalf("unexpected RESP3 members %s", got)
+	}
+}
+
+func TestSet_IntsetLimit(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "14")
+	tc.expect(testStatus("OK"), "flushdb")
+	tc.expect(testStatus("OK"), "config", "set", "set-max-intset-entries", "4")
+	t.Cleanup(func() {
+		tc.do("config", "set", "set-max-intset-entries", "512")
+	})
+
+	tc.expect(int64(4), "sadd", "s", "1", "2", "3", "4")
+	tc.expect("intset", "object", "encoding", "s")
+	tc.expect(int64(1), "sadd", "s", "5")
+	tc.expect("hashtable", "object", "encoding", "s")
+	tc.expect(int64(5), "scard", "s")
+
+	// too many members are added to a hashtable from the start
+	tc.expect(int64(5), "sadd", "big", "1", "2", "3", "4", "5")
+	tc.expect("hashtable", "object", "encoding", "big")
+
+	tc.expect(int64(1), "smove", "s", "dst", "5")
+	tc.expect("intset", "object", "encoding", "dst")
+	tc.expect(int64(1), "smove", "s", "dst", "4")
+	tc.expect(int64(0), "smove", "s", "dst", "4")
+	tc.expect(int64(1), "smove", "dst", "dst", "4")
+	tc.expect(int64(0), "smove", "dst", "dst", "9")
+	tc.expect(int64(0), "smove", "nokey", "dst", "4")
+	tc.expect([]any{"4", "5"}, "smembers", "dst")
+	tc.expect(int64(1), "smove", "dst", "other", "4")
+	tc.expect(int64(1), "smove", "dst", "other", "5")
+	tc.expect(int64(0), "exists", "dst")
+	tc.expect(testStatus("OK"), "set", "str", "v")
+	tc.expectError("WRONGTYPE", "smove", "other", "str", "4")
+	tc.expect(int64(2), "scard", "other")
+}
+
+func TestSet_Random(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "14")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(nil, "spop", "nokey")
+	tc.expect([]any{}, "spop", "nokey", "3")
+	tc.expect(nil, "srandmember", "nokey")
+	tc.expect([]any{}, "srandmember", "nokey", "3")
+	tc.expect(testError("ERR value is out of range, must be positive"), "spop", "nokey", "-1")
+
+	for _, key := range []string{"ints", "strs"} {
+		n := 100
+		members := make(map[string]bool)
+		args := []string{"sadd", key}
+		for j := 0; j < n; j++ {
+			m := strconv.Itoa(j)
+			if key == "strs" {
+				m = "m" + m
+			}
+			members[m] = true
+			args = append(args, m)
+		}
+		tc.expect(int64(n), args...)
+
+		if m := tc.do("srandmember", key).(string); !members[m] {
+			t.Fatalf("%s: unknown random member %q", key, m)
+		}
+		tc.expect([]any{}, "srandmember", key, "0")
+		for _, count := range []int{3, 50, n, n + 5} {
+			reply := tc.do("srandmember", key, strconv.Itoa(count)).([]any)
+			seen := make(map[string]bool)
+			for _, item := range reply {
+				m := item.(string)
+				if !members[m] || seen[m] {
+					t.Fatalf("%s count %d: bad or repeated member %s", key, count, m)
+				}
+				seen[m] = true
+			}
+			if want := min(count, n); len(seen) != want {
+				t.Fatalf("%s count %d: want %d members, got %d", key, count, want, len(seen))
+			}
+		}
+		if reply := tc.do("srandmember", key, "-300").([]any); len(reply) != 300 {
+			t.Fatalf("%s: want 300 members with repetitions, got %d", key, len(reply))
+		}
+
+		// pop everything, in several ways
+		popped := 0
+		m := tc.do("spop", key).(string)
+		if !members[m] {
+			t.Fatalf("%s: unknown popped member %q", key, m)
+		}
+		delete(members, m)
+		popped++
+		for _, count := range []int{10, 60} {
+			reply := tc.do("spop", key, strconv.Itoa(count)).([]any)
+			if len(reply) != count {
+				t.Fatalf("%s: want %d popped, got %d", key, count, len(reply))
+			}
+			for _, item := range reply {
+				if !members[item.(string)] {
+					t.Fatalf("%s: member %v popped twice", key, item)
+				}
+				delete(members, item.(string))
+			}
+			popped += count
+		}
+		tc.expect(int64(n-popped), "scard", key)
+		reply := tc.do("spop", key, "1000").([]any)
+		if len(reply) != n-popped {
+			t.Fatalf("%s: want the %d remaining members, got %d", key, n-popped, len(reply))
+		}
+		tc.expect(int64(0), "exists", key)
+	}
+}
+
+func TestSet_Algebra(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "14")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(int64(5), "sadd", "a", "1", "2", "3", "4", "5")
+	tc.expect(int64(4), "sadd", "b", "3", "4", "5", "x")
+	tc.expect(int64(3), "sadd", "c", "4", "5", "6")
+
+	check := func(want string, args ...string) {
+		t.Helper()
+		if got := sortedMembers(t, tc.do(args...)); got != want {
+			t.Fatalf("%v: want %s, got %s", args, want, got)
+		}
+	}
+	check("4,5", "sinter", "a", "b", "c")
+	check("", "sinter", "a", "nokey")
+	check("1,2,3,4,5,6,x", "sunion", "a", "b", "c", "nokey")
+	check("1,2", "sdiff", "a", "b", "nokey")
+	check("1,2,3", "sdiff", "a", "c")
+	check("", "sdiff", "nokey", "a")
+	check("", "sdiff", "a", "a")
+
+	tc.expect(int64(2), "sinterstore", "dst", "a", "b", "c")
+	tc.expect("intset", "object", "encoding", "dst")
+	tc.expect(int64(7), "sunionstore", "dst", "a", "b", "c")
+	tc.expect("hashtable", "object", "encoding", "dst")
+	tc.expect(int64(2), "sdiffstore", "dst", "a", "b")
+	check("1,2", "smembers", "dst")
+	// the destination may be a source
+	tc.expect(int64(2), "sdiffstore", "dst", "dst", "c", "nokey")
+	tc.expect(int64(5), "sunionstore", "dst", "dst", "c")
+	check("1,2,4,5,6", "smembers", "dst")
+	tc.expect(int64(0), "sdiffstore", "dst", "dst", "a", "c")
+	tc.expect(int64(0), "exists", "dst")
+	tc.expect(int64(0), "sinterstore", "dst", "a", "nokey")
+	tc.expect(int64(0), "exists", "dst")
+
+	tc.expect(testStatus("OK"), "set", "dst", "v")
+	tc.expect(int64(5), "sunionstore", "dst", "a")
+	tc.expect(testStatus("set"), "type", "dst")
+
+	tc.expect(int64(2), "sintercard", "3", "a", "b", "c")
+	tc.expect(int64(3), "sintercard", "2", "a", "b")
+	tc.expect(int64(2), "sintercard", "2", "a", "b", "limit", "2")
+	tc.expect(int64(3), "sintercard", "2", "a", "b", "LIMIT", "0")
+	tc.expect(int64(0), "sintercard", "2", "a", "nokey")
+	tc.expect(testError("ERR numkeys should be greater than 0"), "sintercard", "0", "a")
+	tc.expect(testError("ERR Number of keys can't be greater than number of args"), "sintercard", "3", "a", "b")
+	tc.expect(testError("ERR LIMIT can't be negative"), "sintercard", "1", "a", "limit", "-1")
+	tc.expect(testError("ERR syntax error"), "sintercard", "1", "a", "b")
+}
+
+func TestSet_Scan(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "14")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect([]any{"0", []any{}}, "sscan", "nokey", "0")
+	tc.expect(int64(3), "sadd", "ints", "10", "20", "30")
+	tc.expect([]any{"0", []any{"10", "20", "30"}}, "sscan", "ints", "0")
+	tc.expect([]any{"0", []any{"20"}}, "sscan", "ints", "0", "match", "2*")
+
+	args := []string{"sadd", "big"}
+	for j := 0; j < 1000; j++ {
+		args = append(args, "m"+strconv.Itoa(j))
+	}
+	tc.expect(int64(1000), args...)
+
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply := tc.do("sscan", "big", cursor, "count", "50").([]any)
+		for _, item := range reply[1].([]any) {
+			seen[item.(string)] = true
+		}
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 1000 {
+		t.Fatalf("want every member seen, got %d", len(seen))
+	}
+	tc.expectError("ERR syntax error", "sscan", "big", "0", "novalues")
+}
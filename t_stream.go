@@ -0,0 +1,2610 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A stream is a rax of listpacks keyed by the big endian encoding of the ID
+// of their first entry, the master ID, so the nodes are sorted by ID.
+//
+// Every listpack starts with a master entry, the fields of the first entry
+// added to it:
+//
+//	count | deleted | num-fields | field_1 | ... | field_N | 0
+//
+// count and deleted are the live and the deleted entries of the listpack.
+// The entries follow, their ID being the difference from the master ID:
+//
+//	flags | ms-diff | seq-diff | num-fields | field_1 | value_1 | ... | lp-count
+//
+// When an entry has the very fields of the master entry the SAMEFIELDS flag
+// is set and only the values are stored:
+//
+//	flags | ms-diff | seq-diff | value_1 | ... | value_N | lp-count
+//
+// lp-count is the number of elements of the entry before it, so the
+// listpack can be walked backward. Deleted entries are only flagged, the
+// listpack is removed once all its entries are.
+
+const (
+	streamItemFlagNone       = 0
+	streamItemFlagDeleted    = 1 << 0 // entry is deleted, skipped
+	streamItemFlagSameFields = 1 << 1 // entry has the fields of the master entry
+)
+
+// a listpack never grows beyond this size, whatever stream-node-max-bytes
+const streamListpackMaxSize = 1 << 30
+
+// streamCG.entriesRead when the logical position of the group is unknown
+const streamCGInvalidEntriesRead = -1
+
+// approximate memory overhead of the go structures, in bytes
+const (
+	streamOverhead         = 128
+	streamCGOverhead       = 96
+	streamConsumerOverhead = 64
+	streamNACKOverhead     = 32
+)
+
+type streamID struct {
+	ms  uint64 // unix time in milliseconds
+	seq uint64 // sequence number of the IDs generated in the same ms
+}
+
+var streamIDMax = streamID{ms: math.MaxUint64, seq: math.MaxUint64}
+
+type stream struct {
+	rax               *rax     // listpacks by master ID
+	length            int64    // live entries
+	lastId            streamID // greatest ID ever added, 0-0 if none
+	firstId           streamID // ID of the first live entry, 0-0 if none
+	maxDeletedEntryId streamID // greatest ID deleted by XDEL
+	entriesAdded      int64    // entries ever added
+	cgroups           *rax     // consumer groups by name, nil if none was created
+}
+
+// streamCG is a consumer group, its PEL holds the entries delivered and not
+// acknowledged yet, by ID.
+type streamCG struct {
+	lastId      streamID // last entry delivered to the consumers
+	entriesRead int64    // logical position of lastId in the stream, or streamCGInvalidEntriesRead
+	pel         *rax     // *streamNACK by encoded ID
+	consumers   *rax     // *streamConsumer by name
+}
+
+type streamConsumer struct {
+	name       string
+	seenTime   int64 // last attempted interaction, unix time in ms
+	activeTime int64 // last successful interaction, -1 if none
+	pel        *rax  // the NACKs of the group PEL owned by the consumer
+}
+
+// streamNACK is a delivered entry waiting to be acknowledged, shared by the
+// group and the consumer PELs.
+type streamNACK struct {
+	deliveryTime  int64 // last delivery, unix time in ms
+	deliveryCount int64
+	consumer      *streamConsumer
+}
+
+func (id streamID) String() string {
+	buf := strconv.AppendUint(nil, id.ms, 10)
+	buf = append(buf, '-')
+	return string(strconv.AppendUint(buf, id.seq, 10))
+}
+
+func (id streamID) compare(o streamID) int {
+	switch {
+	case id.ms > o.ms:
+		return 1
+	case id.ms < o.ms:
+		return -1
+	case id.seq > o.seq:
+		return 1
+	case id.seq < o.seq:
+		return -1
+	}
+	return 0
+}
+
+func (id streamID) isZero() bool {
+	return id.ms == 0 && id.seq == 0
+}
+
+// encode returns id as a 128 bit big endian number, the order of the
+// encoded IDs being the order of the IDs.
+func (id streamID) encode() string {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], id.ms)
+	binary.BigEndian.PutUint64(buf[8:], id.seq)
+	return string(buf[:])
+}
+
+func streamDecodeID(key string) streamID {
+	return streamID{
+		ms:  binary.BigEndian.Uint64([]byte(key[:8])),
+		seq: binary.BigEndian.Uint64([]byte(key[8:16])),
+	}
+}
+
+// streamIncrID sets id to the following one, it returns false, wrapping to
+// 0-0, when id is the last possible ID.
+func streamIncrID(id *streamID) bool {
+
+	if id.seq == math.MaxUint64 {
+		if id.ms == math.MaxUint64 {
+			*id = streamID{}
+			return false
+		}
+		id.ms++
+		id.seq = 0
+		return true
+	}
+	id.seq++
+	return true
+
+}
+
+// streamDecrID sets id to the preceding one, it returns false, wrapping to
+// the last possible ID, when id is 0-0.
+func streamDecrID(id *streamID) bool {
+
+	if id.seq == 0 {
+		if id.ms == 0 {
+			*id = streamIDMax
+			return false
+		}
+		id.ms--
+		id.seq = math.MaxUint64
+		return true
+	}
+	id.seq--
+	return true
+
+}
+
+// streamNextID returns the ID generated for an entry added after last.
+func streamNextID(last streamID) (streamID, bool) {
+	ms := uint64(mstime())
+	if ms > last.ms {
+		return streamID{ms: ms}, true
+	}
+	ok := streamIncrID(&last)
+	return last, ok
+}
+
+func newStream() *stream {
+	return &stream{rax: newRax()}
+}
+
+func createStreamObject() *rObj {
+	return &rObj{
+		objectType: objectTypeStream,
+		encoding:   objectEncodingStream,
+		data:       newStream(),
+	}
+}
+
+// streamComputeSize estimates the size of s from a few sampled listpacks.
+func streamComputeSize(s *stream) int64 {
+
+	size := int64(streamOverhead) + int64(s.rax.numNodes)*raxNodeOverhead
+	sampled, samples := int64(0), 0
+	it := s.rax.iterator()
+	it.seek("^", "")
+	for samples < objectComputeSizeSamples && it.next() {
+		sampled += int64(cap(it.data.([]byte)))
+		samples++
+	}
+	if samples > 0 {
+		size += sampled * int64(s.rax.size()) / int64(samples)
+	}
+
+	if s.cgroups == nil {
+		return size
+	}
+	size += int64(s.cgroups.numNodes) * raxNodeOverhead
+	it = s.cgroups.iterator()
+	it.seek("^", "")
+	for it.next() {
+		cg := it.data.(*streamCG)
+		size += streamCGOverhead + int64(len(it.key))
+		size += int64(cg.pel.numNodes)*raxNodeOverhead + int64(cg.pel.size())*streamNACKOverhead
+		size += int64(cg.consumers.numNodes) * raxNodeOverhead
+		ci := cg.consumers.iterator()
+		ci.seek("^", "")
+		for ci.next() {
+			consumer := ci.data.(*streamConsumer)
+			size += streamConsumerOverhead + int64(len(consumer.name)) + int64(consumer.pel.numNodes)*raxNodeOverhead
+		}
+	}
+	return size
+
+}
+
+// streamDup returns a copy of the stream o, consumer groups included.
+func streamDup(o *rObj) *rObj {
+
+	s := o.data.(*stream)
+	copyo := createStreamObject()
+	copys := copyo.data.(*stream)
+	it := s.rax.iterator()
+	it.seek("^", "")
+	for it.next() {
+		copys.rax.insert(it.key, append([]byte(nil), it.data.([]byte)...), false)
+	}
+	copys.length = s.length
+	copys.lastId, copys.firstId, copys.maxDeletedEntryId = s.lastId, s.firstId, s.maxDeletedEntryId
+	copys.entriesAdded = s.entriesAdded
+
+	if s.cgroups == nil {
+		return copyo
+	}
+	copys.cgroups = newRax()
+	gi := s.cgroups.iterator()
+	gi.seek("^", "")
+	for gi.next() {
+		cg := gi.data.(*streamCG)
+		copycg := streamCreateCG(copys, gi.key, cg.lastId, cg.entriesRead)
+
+		// the NACKs are shared by the group and the consumer PELs
+		nacks := make(map[*streamNACK]*streamNACK, cg.pel.size())
+		pi := cg.pel.iterator()
+		pi.seek("^", "")
+		for pi.next() {
+			nack := pi.data.(*streamNACK)
+			copynack := &streamNACK{deliveryTime: nack.deliveryTime, deliveryCount: nack.deliveryCount}
+			copycg.pel.insert(pi.key, copynack, false)
+			nacks[nack] = copynack
+		}
+
+		ci := cg.consumers.iterator()
+		ci.seek("^", "")
+		for ci.next() {
+			consumer := ci.data.(*streamConsumer)
+			copyconsumer := streamCreateConsumer(copycg, consumer.name)
+			copyconsumer.seenTime, copyconsumer.activeTime = consumer.seenTime, consumer.activeTime
+			pi = consumer.pel.iterator()
+			pi.seek("^", "")
+			for pi.next() {
+				copynack := nacks[pi.data.(*streamNACK)]
+				copynack.consumer = copyconsumer
+				copyconsumer.pel.insert(pi.key, copynack, false)
+			}
+		}
+	}
+	return copyo
+
+}
+
+// streamAppendItem adds an entry made of the field value pairs in argv. The
+// ID is generated, unless useId is given, in which case only its sequence is
+// generated when seqGiven is false. It returns the ID added, or false when
+// that ID is not greater than the last one.
+func streamAppendItem(s *stream, argv []*rObj, useId *streamID, seqGiven bool) (streamID, bool) {
+
+	var id streamID
+	switch {
+	case useId == nil:
+		var ok bool
+		if id, ok = streamNextID(s.lastId); !ok {
+			return id, false
+		}
+	case seqGiven:
+		id = *useId
+	case s.lastId.ms == useId.ms:
+		// the sequence continues the one of the last ID
+		if s.lastId.seq == math.MaxUint64 {
+			return id, false
+		}
+		id = streamID{ms: useId.ms, seq: s.lastId.seq + 1}
+	default:
+		id = *useId
+	}
+	if id.compare(s.lastId) <= 0 {
+		return id, false
+	}
+
+	numFields := int64(len(argv) / 2)
+	entryLen := 0
+	for _, arg := range argv {
+		entryLen += stringObjectLen(arg)
+	}
+
+	// the tail listpack, if it can take the entry
+	var lp []byte
+	var key string
+	it := s.rax.iterator()
+	if it.seek("$", "") {
+		lp, key = it.data.([]byte), it.key
+		nodeMaxBytes := rServer.streamNodeMaxBytes
+		if nodeMaxBytes == 0 || nodeMaxBytes > streamListpackMaxSize {
+			nodeMaxBytes = streamListpackMaxSize
+		}
+		if int64(len(lp)+entryLen) >= nodeMaxBytes {
+			lp = nil
+		} else if rServer.streamNodeMaxEntries > 0 {
+			// both live and deleted entries count
+			p := lpFirst(lp)
+			count := lpGetInteger(lp, p) + lpGetInteger(lp, lpNext(lp, p))
+			if count >= int64(rServer.streamNodeMaxEntries) {
+				lp = nil
+			}
+		}
+	}
+
+	var masterId streamID
+	flags := int64(streamItemFlagNone)
+	if lp == nil {
+		// a new listpack, the entry is the master entry
+		masterId, key = id, id.encode()
+		lp = lpNew(min(int(max(rServer.streamNodeMaxBytes, 64)), 4096))
+		lp = lpAppendInteger(lp, 1)
+		lp = lpAppendInteger(lp, 0)
+		lp = lpAppendInteger(lp, numFields)
+		for j := 0; j < len(argv); j += 2 {
+			lp = lpAppend(lp, argv[j].bytes())
+		}
+		lp = lpAppendInteger(lp, 0)
+		flags |= streamItemFlagSameFields
+	} else {
+		masterId = streamDecodeID(key)
+		p := lpFirst(lp)
+		lp, p = lpReplaceInteger(lp, p, lpGetInteger(lp, p)+1)
+		p = lpNext(lp, lpNext(lp, p))
+		if lpGetInteger(lp, p) == numFields {
+			same := true
+			for j := 0; j < len(argv) && same; j += 2 {
+				p = lpNext(lp, p)
+				same = lpCompare(lp, p, argv[j].bytes())
+			}
+			if same {
+				flags |= streamItemFlagSameFields
+			}
+		}
+	}
+
+	lp = lpAppendInteger(lp, flags)
+	lp = lpAppendInteger(lp, int64(id.ms-masterId.ms))
+	lp = lpAppendInteger(lp, int64(id.seq-masterId.seq))
+	lpCount := numFields + 3
+	if flags&streamItemFlagSameFields == 0 {
+		lp = lpAppendInteger(lp, numFields)
+		lpCount += numFields + 1
+	}
+	for j := 0; j < len(argv); j += 2 {
+		if flags&streamItemFlagSameFields == 0 {
+			lp = lpAppend(lp, argv[j].bytes())
+		}
+		lp = lpAppend(lp, argv[j+1].bytes())
+	}
+	lp = lpAppendInteger(lp, lpCount)
+	s.rax.insert(key, lp, true)
+
+	s.length++
+	s.entriesAdded++
+	s.lastId = id
+	if s.length == 1 {
+		s.firstId = id
+	}
+	return id, true
+
+}
+
+// streamIterator iterates the entries with IDs between start and end
+// included. Once getID returns an entry its fields must be read with
+// getField, numfields times, before getting the next one.
+type streamIterator struct {
+	s                 *stream
+	start, end        streamID
+	rev               bool
+	skipTombstones    bool // deleted entries are not returned
+	ri                *raxIterator
+	masterId          streamID
+	masterFieldsCount int64
+	masterFieldsStart int
+	masterFieldsPtr   int // the field of the master entry read next
+	lp                []byte
+	lpEle             int // the current element, -1 when the listpack is consumed
+	lpFlags           int // the flags of the current entry
+	entryFlags        int64
+}
+
+func newStreamIterator(s *stream, start, end streamID, rev bool) *streamIterator {
+	si := &streamIterator{s: s, rev: rev, skipTombstones: true}
+	si.seek(start, end)
+	return si
+}
+
+// seek positions the iterator on the listpack holding the first entry to
+// return.
+func (si *streamIterator) seek(start, end streamID) {
+
+	si.start, si.end = start, end
+	si.lp, si.lpEle = nil, -1
+	si.ri = si.s.rax.iterator()
+	if !si.rev {
+		if start.isZero() || !si.ri.seek("<=", start.encode()) {
+			si.ri.seek("^", "")
+		}
+	} else {
+		if end.isZero() || !si.ri.seek("<=", end.encode()) {
+			si.ri.seek("$", "")
+		}
+	}
+
+}
+
+// getID returns the next entry in range with its number of fields, or
+// false once done.
+func (si *streamIterator) getID() (streamID, int64, bool) {
+
+	for {
+		if si.lp == nil || si.lpEle == -1 {
+			if !si.rev && !si.ri.next() || si.rev && !si.ri.prev() {
+				return streamID{}, 0, false
+			}
+			si.masterId = streamDecodeID(si.ri.key)
+			si.lp = si.ri.data.([]byte)
+			p := lpNext(si.lp, lpNext(si.lp, lpFirst(si.lp)))
+			si.masterFieldsCount = lpGetInteger(si.lp, p)
+			si.masterFieldsStart = lpNext(si.lp, p)
+			if !si.rev {
+				// skip the master fields, up to the terminator
+				si.lpEle = si.masterFieldsStart
+				for j := int64(0); j < si.masterFieldsCount; j++ {
+					si.lpEle = lpNext(si.lp, si.lpEle)
+				}
+			} else {
+				si.lpEle = lpLast(si.lp)
+			}
+		} else if si.rev {
+			// back from the lp-count of the entry returned last to the
+			// lp-count of the previous one
+			for n := lpGetInteger(si.lp, si.lpEle); n > 0; n-- {
+				si.lpEle = lpPrev(si.lp, si.lpEle)
+			}
+			si.lpEle = lpPrev(si.lp, si.lpEle)
+		}
+
+		for {
+			if !si.rev {
+				// skip the lp-count of the previous entry
+				si.lpEle = lpNext(si.lp, si.lpEle)
+				if si.lpEle == -1 {
+					break
+				}
+			} else {
+				n := lpGetInteger(si.lp, si.lpEle)
+				if n == 0 {
+					// the terminator of the master entry
+					si.lp, si.lpEle = nil, -1
+					break
+				}
+				for ; n > 0; n-- {
+					si.lpEle = lpPrev(si.lp, si.lpEle)
+				}
+			}
+
+			si.lpFlags = si.lpEle
+			flags := lpGetInteger(si.lp, si.lpEle)
+			si.lpEle = lpNext(si.lp, si.lpEle)
+			id := si.masterId
+			id.ms += uint64(lpGetInteger(si.lp, si.lpEle))
+			si.lpEle = lpNext(si.lp, si.lpEle)
+			id.seq += uint64(lpGetInteger(si.lp, si.lpEle))
+			si.lpEle = lpNext(si.lp, si.lpEle)
+
+			numFields := si.masterFieldsCount
+			if flags&streamItemFlagSameFields == 0 {
+				numFields = lpGetInteger(si.lp, si.lpEle)
+				si.lpEle = lpNext(si.lp, si.lpEle)
+			}
+
+			if !si.skipTombstones || flags&streamItemFlagDeleted == 0 {
+				inRange := false
+				if !si.rev && id.compare(si.start) >= 0 {
+					if id.compare(si.end) > 0 {
+						return streamID{}, 0, false
+					}
+					inRange = true
+				} else if si.rev && id.compare(si.end) <= 0 {
+					if id.compare(si.start) < 0 {
+						return streamID{}, 0, false
+					}
+					inRange = true
+				}
+				if inRange {
+					si.entryFlags = flags
+					si.masterFieldsPtr = si.masterFieldsStart
+					return id, numFields, true
+				}
+			}
+
+			if !si.rev {
+				// skip the fields and values, up to the lp-count
+				toDiscard := numFields
+				if flags&streamItemFlagSameFields == 0 {
+					toDiscard *= 2
+				}
+				for ; toDiscard > 0; toDiscard-- {
+					si.lpEle = lpNext(si.lp, si.lpEle)
+				}
+			} else {
+				// back to the lp-count of the previous entry
+				prevTimes := 4
+				if flags&streamItemFlagSameFields == 0 {
+					prevTimes++
+				}
+				for ; prevTimes > 0; prevTimes-- {
+					si.lpEle = lpPrev(si.lp, si.lpEle)
+				}
+			}
+		}
+	}
+
+}
+
+// getField returns the next field and value of the current entry.
+func (si *streamIterator) getField() (field, value []byte) {
+
+	if si.entryFlags&streamItemFlagSameFields != 0 {
+		field = lpGetBytes(si.lp, si.masterFieldsPtr)
+		si.masterFieldsPtr = lpNext(si.lp, si.masterFieldsPtr)
+	} else {
+		field = lpGetBytes(si.lp, si.lpEle)
+		si.lpEle = lpNext(si.lp, si.lpEle)
+	}
+	value = lpGetBytes(si.lp, si.lpEle)
+	si.lpEle = lpNext(si.lp, si.lpEle)
+	return field, value
+
+}
+
+// removeEntry deletes the current entry, whose ID is current, the iteration
+// continues after it.
+func (si *streamIterator) removeEntry(current streamID) {
+
+	lp := si.lp
+	flags := lpGetInteger(lp, si.lpFlags)
+	lp, _ = lpReplaceInteger(lp, si.lpFlags, flags|streamItemFlagDeleted)
+
+	p := lpFirst(lp)
+	count := lpGetInteger(lp, p)
+	if count == 1 {
+		// the last live entry of the listpack
+		si.s.rax.remove(si.ri.key)
+	} else {
+		lp, p = lpReplaceInteger(lp, p, count-1)
+		p = lpNext(lp, p)
+		lp, _ = lpReplaceInteger(lp, p, lpGetInteger(lp, p)+1)
+		si.s.rax.insert(si.ri.key, lp, true)
+	}
+	si.s.length--
+
+	if si.rev {
+		si.seek(si.start, current)
+	} else {
+		si.seek(current, si.end)
+	}
+
+}
+
+// streamGetEdgeID returns the first or the last ID of s, the last possible
+// ID or 0-0 respectively when s is empty.
+func streamGetEdgeID(s *stream, first bool, skipTombstones bool) streamID {
+
+	si := newStreamIterator(s, streamID{}, streamIDMax, !first)
+	si.skipTombstones = skipTombstones
+	id, _, found := si.getID()
+	if !found {
+		if first {
+			return streamIDMax
+		}
+		return streamID{}
+	}
+	return id
+
+}
+
+// streamLastValidID returns the ID of the last live entry, 0-0 if s is
+// empty.
+func streamLastValidID(s *stream) streamID {
+	return streamGetEdgeID(s, false, true)
+}
+
+func streamEntryExists(s *stream, id streamID) bool {
+	_, _, found := newStreamIterator(s, id, id, false).getID()
+	return found
+}
+
+func streamDeleteItem(s *stream, id streamID) bool {
+
+	si := newStreamIterator(s, id, id, false)
+	myid, _, found := si.getID()
+	if !found {
+		return false
+	}
+	si.removeEntry(myid)
+	return true
+
+}
+
+// lpGetEdgeStreamID returns the ID of the first or last entry of a stream
+// listpack, deleted or not, false when it only holds the master entry.
+func lpGetEdgeStreamID(lp []byte, first bool, masterId streamID) (streamID, bool) {
+
+	var p int
+	if first {
+		p = lpNext(lp, lpNext(lp, lpFirst(lp)))
+		masterFieldsCount := lpGetInteger(lp, p)
+		for j := int64(0); j <= masterFieldsCount; j++ {
+			p = lpNext(lp, p)
+		}
+		// skip the master entry terminator
+		if p = lpNext(lp, p); p == -1 {
+			return streamID{}, false
+		}
+	} else {
+		p = lpLast(lp)
+		n := lpGetInteger(lp, p)
+		if n == 0 {
+			return streamID{}, false
+		}
+		for ; n > 0; n-- {
+			p = lpPrev(lp, p)
+		}
+	}
+
+	id := masterId
+	p = lpNext(lp, p)
+	id.ms += uint64(lpGetInteger(lp, p))
+	p = lpNext(lp, p)
+	id.seq += uint64(lpGetInteger(lp, p))
+	return id, true
+
+}
+
+const (
+	trimStrategyNone = iota
+	trimStrategyMaxlen
+	trimStrategyMinid
+)
+
+// streamAddTrimArgs are the options of XADD and XTRIM.
+type streamAddTrimArgs struct {
+	id         streamID
+	idGiven    bool
+	seqGiven   bool
+	noMkstream bool
+
+	trimStrategy       int
+	trimStrategyArgIdx int // argv index of the MAXLEN or MINID value
+	approxTrim         bool
+	limit              int64 // max entries trimmed, 0 means no limit
+	maxlen             int64
+	minid              streamID
+}
+
+// streamTrim deletes the entries from the head of the stream that do not
+// fit args, returning how many were deleted. An approximated trim only
+// removes whole listpacks.
+func streamTrim(s *stream, args *streamAddTrimArgs) int64 {
+
+	if args.trimStrategy == trimStrategyNone {
+		return 0
+	}
+
+	deleted := int64(0)
+	it := s.rax.iterator()
+	it.seek("^", "")
+	for it.next() {
+		if args.trimStrategy == trimStrategyMaxlen && s.length <= args.maxlen {
+			break
+		}
+
+		lp := it.data.([]byte)
+		p := lpFirst(lp)
+		entries := lpGetInteger(lp, p)
+		if args.limit > 0 && deleted+entries > args.limit {
+			break
+		}
+
+		masterId := streamDecodeID(it.key)
+		var removeNode bool
+		if args.trimStrategy == trimStrategyMaxlen {
+			removeNode = s.length-entries >= args.maxlen
+		} else {
+			lastId, _ := lpGetEdgeStreamID(lp, false, masterId)
+			removeNode = lastId.compare(args.minid) < 0
+		}
+		if removeNode {
+			s.rax.remove(it.key)
+			s.length -= entries
+			deleted += entries
+			continue
+		}
+
+		// the node holds entries to keep, only exact trimming goes inside
+		if args.approxTrim {
+			break
+		}
+
+		p = lpNext(lp, lpNext(lp, p))
+		masterFieldsCount := lpGetInteger(lp, p)
+		for j := int64(0); j <= masterFieldsCount+1; j++ {
+			p = lpNext(lp, p)
+		}
+
+		deletedFromLp := int64(0)
+		for p != -1 {
+			flagsPos := p
+			flags := lpGetInteger(lp, p)
+			p = lpNext(lp, p)
+			currId := masterId
+			currId.ms += uint64(lpGetInteger(lp, p))
+			p = lpNext(lp, p)
+			currId.seq += uint64(lpGetInteger(lp, p))
+			p = lpNext(lp, p)
+
+			if args.trimStrategy == trimStrategyMaxlen && s.length <= args.maxlen ||
+				args.trimStrategy == trimStrategyMinid && currId.compare(args.minid) >= 0 {
+				break
+			}
+
+			toSkip := masterFieldsCount
+			if flags&streamItemFlagSameFields == 0 {
+				toSkip = lpGetInteger(lp, p) * 2
+				p = lpNext(lp, p)
+			}
+			for ; toSkip > 0; toSkip-- {
+				p = lpNext(lp, p)
+			}
+			// the lp-count
+			p = lpNext(lp, p)
+
+			if flags&streamItemFlagDeleted == 0 {
+				// the flags keep their size, p stays valid
+				lp, _ = lpReplaceInteger(lp, flagsPos, flags|streamItemFlagDeleted)
+				deletedFromLp++
+				s.length--
+			}
+		}
+		deleted += deletedFromLp
+
+		p = lpFirst(lp)
+		lp, p = lpReplaceInteger(lp, p, entries-deletedFromLp)
+		p = lpNext(lp, p)
+		lp, _ = lpReplaceInteger(lp, p, lpGetInteger(lp, p)+deletedFromLp)
+		s.rax.insert(it.key, lp, true)
+		break
+	}
+
+	if s.length == 0 {
+		s.firstId = streamID{}
+	} else {
+		s.firstId = streamGetEdgeID(s, true, true)
+	}
+	return deleted
+
+}
+
+// streamRangeHasTombstones reports whether an entry between start and end
+// may have been deleted.
+func streamRangeHasTombstones(s *stream, start, end streamID) bool {
+
+	if s.length == 0 || s.maxDeletedEntryId.isZero() {
+		return false
+	}
+	if s.firstId.compare(s.maxDeletedEntryId) > 0 {
+		// the last tombstone is before the first entry
+		return false
+	}
+	return start.compare(s.maxDeletedEntryId) <= 0 && s.maxDeletedEntryId.compare(end) <= 0
+
+}
+
+// streamEstimateDistanceFromFirstEverEntry returns the logical position of
+// id, the number of entries added up to it, or streamCGInvalidEntriesRead
+// when it can not be known.
+func streamEstimateDistanceFromFirstEverEntry(s *stream, id streamID) int64 {
+
+	if s.entriesAdded == 0 {
+		return 0
+	}
+	if s.length == 0 && id.compare(s.lastId) < 1 {
+		return s.entriesAdded
+	}
+
+	cmpLast := id.compare(s.lastId)
+	if cmpLast == 0 {
+		return s.entriesAdded
+	} else if cmpLast > 0 {
+		return streamCGInvalidEntriesRead
+	}
+
+	// without deletions after the first entry the positions are contiguous
+	if s.maxDeletedEntryId.isZero() || s.maxDeletedEntryId.compare(s.firstId) < 0 {
+		switch id.compare(s.firstId) {
+		case -1:
+			return s.entriesAdded - s.length
+		case 0:
+			return s.entriesAdded - s.length + 1
+		}
+	}
+	return streamCGInvalidEntriesRead
+
+}
+
+// streamCGLag returns the entries of the stream the group has not read yet,
+// false when it can not be known.
+func streamCGLag(s *stream, cg *streamCG) (int64, bool) {
+
+	if s.entriesAdded == 0 {
+		return 0, true
+	}
+	if cg.entriesRead != streamCGInvalidEntriesRead && !streamRangeHasTombstones(s, cg.lastId, streamIDMax) {
+		return s.entriesAdded - cg.entriesRead, true
+	}
+	entriesRead := streamEstimateDistanceFromFirstEverEntry(s, cg.lastId)
+	if entriesRead == streamCGInvalidEntriesRead {
+		return 0, false
+	}
+	return s.entriesAdded - entriesRead, true
+
+}
+
+func streamLookupCG(s *stream, name string) *streamCG {
+	if s == nil || s.cgroups == nil {
+		return nil
+	}
+	cg, ok := s.cgroups.find(name)
+	if !ok {
+		return nil
+	}
+	return cg.(*streamCG)
+}
+
+// streamCreateCG creates a consumer group delivering the entries after id,
+// it returns nil if the group exists.
+func streamCreateCG(s *stream, name string, id streamID, entriesRead int64) *streamCG {
+
+	if s.cgroups == nil {
+		s.cgroups = newRax()
+	}
+	cg := &streamCG{lastId: id, entriesRead: entriesRead, pel: newRax(), consumers: newRax()}
+	if !s.cgroups.insert(name, cg, false) {
+		return nil
+	}
+	return cg
+
+}
+
+func streamLookupConsumer(cg *streamCG, name string) *streamConsumer {
+	consumer, ok := cg.consumers.find(name)
+	if !ok {
+		return nil
+	}
+	return consumer.(*streamConsumer)
+}
+
+// streamCreateConsumer creates a consumer in the group, it returns nil if
+// the consumer exists.
+func streamCreateConsumer(cg *streamCG, name string) *streamConsumer {
+
+	consumer := &streamConsumer{name: name, seenTime: mstime(), activeTime: -1, pel: newRax()}
+	if !cg.consumers.insert(name, consumer, false) {
+		return nil
+	}
+	return consumer
+
+}
+
+// streamLookupOrCreateConsumer returns the consumer, creating it if needed.
+func streamLookupOrCreateConsumer(cg *streamCG, name string) *streamConsumer {
+	if consumer := streamLookupConsumer(cg, name); consumer != nil {
+		return consumer
+	}
+	return streamCreateConsumer(cg, name)
+}
+
+// streamDelConsumer deletes the consumer, its pending entries are removed
+// from the group PEL.
+func streamDelConsumer(cg *streamCG, consumer *streamConsumer) {
+
+	it := consumer.pel.iterator()
+	it.seek("^", "")
+	for it.next() {
+		cg.pel.remove(it.key)
+	}
+	cg.consumers.remove(consumer.name)
+
+}
+
+// streamID parsing
+
+// streamGenericParseIDOrReply parses ms-seq, ms alone taking missingSeq as
+// sequence, or "-" and "+" unless strict. With seqGiven set, ms-* is
+// accepted and *seqGiven reports whether the sequence was given.
+func streamGenericParseIDOrReply(c *client, o *rObj, missingSeq uint64, strict bool, seqGiven *bool) (streamID, bool) {
+
+	s := o.String()
+	if seqGiven != nil {
+		*seqGiven = true
+	}
+
+	if len(s) <= 127 {
+		switch {
+		case s == "-" && !strict:
+			return streamID{}, true
+		case s == "+" && !strict:
+			return streamIDMax, true
+		}
+
+		msPart, seqPart, hasSeq := strings.Cut(s, "-")
+		ms, err := strconv.ParseUint(msPart, 10, 64)
+		if err == nil {
+			seq := missingSeq
+			switch {
+			case !hasSeq:
+			case seqGiven != nil && seqPart == "*":
+				seq = 0
+				*seqGiven = false
+			default:
+				seq, err = strconv.ParseUint(seqPart, 10, 64)
+			}
+			if err == nil {
+				return streamID{ms: ms, seq: seq}, true
+			}
+		}
+	}
+
+	if c != nil {
+		addReplyError(c, "Invalid stream ID specified as stream command argument")
+	}
+	return streamID{}, false
+
+}
+
+func streamParseIDOrReply(c *client, o *rObj, missingSeq uint64) (streamID, bool) {
+	return streamGenericParseIDOrReply(c, o, missingSeq, false, nil)
+}
+
+// streamParseStrictIDOrReply is like streamParseIDOrReply but refuses "-"
+// and "+".
+func streamParseStrictIDOrReply(c *client, o *rObj, missingSeq uint64, seqGiven *bool) (streamID, bool) {
+	return streamGenericParseIDOrReply(c, o, missingSeq, true, seqGiven)
+}
+
+// streamParseIntervalIDOrReply parses a range boundary, excluded when
+// prefixed by "(".
+func streamParseIntervalIDOrReply(c *client, o *rObj, missingSeq uint64) (id streamID, exclude bool, ok bool) {
+
+	s := o.String()
+	if len(s) > 1 && s[0] == '(' {
+		id, ok = streamParseStrictIDOrReply(c, createStringObject([]byte(s[1:])), missingSeq, nil)
+		return id, true, ok
+	}
+	id, ok = streamParseIDOrReply(c, o, missingSeq)
+	return id, false, ok
+
+}
+
+// replies
+
+func addReplyStreamID(c *client, id streamID) {
+	addReplyBulkString(c, id.String())
+}
+
+// streamReplyWithRange flags
+const (
+	streamRwrNoack      = 1 << iota // do not create entries in the PEL
+	streamRwrRawEntries             // do not emit the array header
+	streamRwrHistory                // only serve the consumer PEL
+)
+
+// streamReplyWithRange replies the entries between start and end, at most
+// count if not 0, returning how many were emitted.
+//
+// When a group and a consumer are given the entries are delivered to the
+// consumer: the group last ID moves forward and the entries are added to
+// the PELs, unless streamRwrNoack is set. With streamRwrHistory the entries
+// are served from the consumer PEL instead.
+func streamReplyWithRange(c *client, s *stream, start, end streamID, count int64, rev bool,
+	group *streamCG, consumer *streamConsumer, flags int, spi *streamPropInfo) int64 {
+
+	if group != nil && flags&streamRwrHistory != 0 {
+		return streamReplyWithRangeFromConsumerPEL(c, s, start, end, count, group, consumer, spi)
+	}
+
+	propagateLastId := false
+	var placeholder *bufferBlock
+	if flags&streamRwrRawEntries == 0 {
+		placeholder = addReplyDeferredLen(c)
+	}
+
+	arraylen := int64(0)
+	si := newStreamIterator(s, start, end, rev)
+	for {
+		id, numFields, ok := si.getID()
+		if !ok {
+			break
+		}
+
+		if group != nil && id.compare(group.lastId) > 0 {
+			if group.entriesRead != streamCGInvalidEntriesRead && !streamRangeHasTombstones(s, group.lastId, streamIDMax) {
+				// no deletion ahead, the counter stays exact
+				group.entriesRead++
+			} else if s.entriesAdded > 0 {
+				group.entriesRead = streamEstimateDistanceFromFirstEverEntry(s, id)
+			}
+			group.lastId = id
+			propagateLastId = true
+		}
+
+		addReplyArrayLen(c, 2)
+		addReplyStreamID(c, id)
+		addReplyArrayLen(c, int(numFields*2))
+		for ; numFields > 0; numFields-- {
+			field, value := si.getField()
+			addReplyBulk(c, field)
+			addReplyBulk(c, value)
+		}
+
+		if group != nil && flags&streamRwrNoack == 0 {
+			// the entry may already be pending after XGROUP SETID moved the
+			// group back, it is delivered to this consumer again.
+			key := id.encode()
+			now := mstime()
+			var nack *streamNACK
+			if v, ok := group.pel.find(key); ok {
+				nack = v.(*streamNACK)
+				nack.consumer.pel.remove(key)
+				nack.consumer = consumer
+				nack.deliveryTime = now
+				nack.deliveryCount = 1
+				consumer.pel.insert(key, nack, true)
+			} else {
+				nack = &streamNACK{deliveryTime: now, deliveryCount: 1, consumer: consumer}
+				group.pel.insert(key, nack, false)
+				consumer.pel.insert(key, nack, false)
+			}
+			consumer.activeTime = now
+			if spi != nil {
+				streamPropagateXCLAIM(c, spi.keyname, group, spi.groupname, id, nack)
+			}
+		}
+
+		arraylen++
+		if count > 0 && count == arraylen {
+			break
+		}
+	}
+
+	if spi != nil && propagateLastId {
+		streamPropagateGroupID(c, spi.keyname, group, spi.groupname)
+	}
+	if placeholder != nil {
+		setDeferredArrayLen(c, placeholder, int(arraylen))
+	}
+	return arraylen
+
+}
+
+// streamReplyWithRangeFromConsumerPEL replies the entries pending in the
+// consumer PEL from start, the deleted ones with a null value, and counts
+// them as delivered once more.
+func streamReplyWithRangeFromConsumerPEL(c *client, s *stream, start, end streamID, count int64,
+	group *streamCG, consumer *streamConsumer, spi *streamPropInfo) int64 {
+
+	placeholder := addReplyDeferredLen(c)
+	arraylen := int64(0)
+	endKey := end.encode()
+	it := consumer.pel.iterator()
+	it.seek(">=", start.encode())
+	for (count == 0 || arraylen < count) && it.next() {
+		if it.key > endKey {
+			break
+		}
+		id := streamDecodeID(it.key)
+		if streamReplyWithRange(c, s, id, id, 1, false, nil, nil, streamRwrRawEntries, nil) == 0 {
+			addReplyArrayLen(c, 2)
+			addReplyStreamID(c, id)
+			addReplyNullArray(c)
+		} else {
+			nack := it.data.(*streamNACK)
+			nack.deliveryTime = mstime()
+			nack.deliveryCount++
+			if spi != nil {
+				streamPropagateXCLAIM(c, spi.keyname, group, spi.groupname, id, nack)
+			}
+		}
+		arraylen++
+	}
+	setDeferredArrayLen(c, placeholder, int(arraylen))
+	return arraylen
+
+}
+
+// streamPropInfo names the key and the group of the entries delivered by
+// XREADGROUP, so that the deliveries are propagated.
+type streamPropInfo struct {
+	keyname   *rObj
+	groupname *rObj
+}
+
+// streamPropagateXCLAIM propagates the pending entry id as the XCLAIM that
+// recreates it as is:
+//
+//	XCLAIM key group consumer 0 id TIME ms RETRYCOUNT count FORCE JUSTID LASTID id
+func streamPropagateXCLAIM(c *client, key *rObj, group *streamCG, groupname *rObj, id streamID, nack *streamNACK) {
+	alsoPropagate(c.db.id, []*rObj{
+		createEmbeddedStringObject("XCLAIM"), key, groupname,
+		createStringObject([]byte(nack.consumer.name)), createEmbeddedStringObject("0"),
+		createStringObject([]byte(id.String())),
+		createEmbeddedStringObject("TIME"), createStringObjectFromLongLong(nack.deliveryTime),
+		createEmbeddedStringObject("RETRYCOUNT"), createStringObjectFromLongLong(nack.deliveryCount),
+		createEmbeddedStringObject("FORCE"), createEmbeddedStringObject("JUSTID"),
+		createEmbeddedStringObject("LASTID"), createStringObject([]byte(group.lastId.String())),
+	})
+}
+
+// streamPropagateGroupID propagates the group last ID and entries read as
+// XGROUP SETID key group id ENTRIESREAD n.
+func streamPropagateGroupID(c *client, key *rObj, group *streamCG, groupname *rObj) {
+	alsoPropagate(c.db.id, []*rObj{
+		createEmbeddedStringObject("XGROUP"), createEmbeddedStringObject("SETID"), key, groupname,
+		createStringObject([]byte(group.lastId.String())),
+		createEmbeddedStringObject("ENTRIESREAD"), createStringObjectFromLongLong(group.entriesRead),
+	})
+}
+
+// streamPropagateConsumerCreation propagates the consumer created by
+// XREADGROUP as XGROUP CREATECONSUMER key group consumer.
+func streamPropagateConsumerCreation(c *client, key, groupname *rObj, name string) {
+	alsoPropagate(c.db.id, []*rObj{
+		createEmbeddedStringObject("XGROUP"), createEmbeddedStringObject("CREATECONSUMER"), key, groupname,
+		createStringObject([]byte(name)),
+	})
+}
+
+// streamTypeLookupWriteOrCreate returns the stream at key, creating it
+// unless noCreate is set. It returns nil after replying when the key holds
+// another type or does not exist with noCreate.
+func streamTypeLookupWriteOrCreate(c *client, key string, noCreate bool) *rObj {
+
+	o := lookupKeyWrite(c.db, key)
+	if o == nil {
+		if noCreate {
+			addReply(c, shared.nullBulk)
+			return nil
+		}
+		o = createStreamObject()
+		dbAdd(c.db, key, o)
+		return o
+	}
+	if !checkType(c, o, objectTypeStream) {
+		return nil
+	}
+	return o
+
+}
+
+// streamParseAddOrTrimArgsOrReply parses the options of XADD and XTRIM, for
+// XADD it returns the argv index of the ID. It returns -1 after replying an
+// error.
+func streamParseAddOrTrimArgsOrReply(c *client, args *streamAddTrimArgs, xadd bool) int {
+
+	*args = streamAddTrimArgs{}
+	limitGiven := false
+
+	j := 2
+	for ; j < c.argc; j++ {
+		moreargs := c.argc - 1 - j
+		opt := c.argv[j].String()
+		switch {
+		case xadd && opt == "*":
+			// the common case of an auto generated ID
+			return j
+		case strings.EqualFold(opt, "maxlen") && moreargs > 0, strings.EqualFold(opt, "minid") && moreargs > 0:
+			if args.trimStrategy != trimStrategyNone {
+				addReplyError(c, "syntax error, MAXLEN and MINID options at the same time are not compatible")
+				return -1
+			}
+			args.approxTrim = false
+			if next := c.argv[j+1].String(); moreargs >= 2 && (next == "~" || next == "=") {
+				args.approxTrim = next == "~"
+				j++
+			}
+			j++
+			if strings.EqualFold(opt, "maxlen") {
+				maxlen, ok := getLongLongFromObjectOrReply(c, c.argv[j], "")
+				if !ok {
+					return -1
+				}
+				if maxlen < 0 {
+					addReplyError(c, "The MAXLEN argument must be >= 0.")
+					return -1
+				}
+				args.maxlen = maxlen
+				args.trimStrategy = trimStrategyMaxlen
+			} else {
+				minid, ok := streamParseStrictIDOrReply(c, c.argv[j], 0, nil)
+				if !ok {
+					return -1
+				}
+				args.minid = minid
+				args.trimStrategy = trimStrategyMinid
+			}
+			args.trimStrategyArgIdx = j
+		case strings.EqualFold(opt, "limit") && moreargs > 0:
+			// without LIMIT the approximated trimming stops after 100
+			// listpacks worth of entries, so a single command does not take
+			// too long.
+			limit, ok := getLongLongFromObjectOrReply(c, c.argv[j+1], "")
+			if !ok {
+				return -1
+			}
+			if limit < 0 {
+				addReplyError(c, "The LIMIT argument must be >= 0.")
+				return -1
+			}
+			args.limit = limit
+			limitGiven = true
+			j++
+		case xadd && strings.EqualFold(opt, "nomkstream"):
+			args.noMkstream = true
+		case xadd:
+			// anything else is the ID
+			id, ok := streamParseStrictIDOrReply(c, c.argv[j], 0, &args.seqGiven)
+			if !ok {
+				return -1
+			}
+			args.id, args.idGiven = id, true
+			return j
+		default:
+			addReply(c, shared.syntaxErr)
+			return -1
+		}
+	}
+
+	if args.limit > 0 && args.trimStrategy == trimStrategyNone {
+		addReplyError(c, "syntax error, LIMIT cannot be used without specifying a trimming strategy")
+		return -1
+	}
+	if !xadd && args.trimStrategy == trimStrategyNone {
+		addReplyError(c, "syntax error, XTRIM must be called with a trimming strategy")
+		return -1
+	}
+
+	if limitGiven {
+		if !args.approxTrim {
+			addReplyError(c, "syntax error, LIMIT cannot be used without the special ~ option")
+			return -1
+		}
+	} else if args.approxTrim {
+		args.limit = 100 * int64(rServer.streamNodeMaxEntries)
+		if args.limit <= 0 || args.limit > 10000 {
+			args.limit = 10000
+		}
+	} else {
+		args.limit = 0
+	}
+	return j
+
+}
+
+// streamRewriteTrimArgument rewrites an approximated trim as the exact one
+// that happened, so running the command again trims the same entries.
+func streamRewriteTrimArgument(c *client, s *stream, args *streamAddTrimArgs) {
+
+	rewriteClientCommandArgument(c, args.trimStrategyArgIdx-1, createStringObject([]byte("=")))
+	if args.trimStrategy == trimStrategyMaxlen {
+		rewriteClientCommandArgument(c, args.trimStrategyArgIdx, createStringObjectFromLongLong(s.length))
+	} else {
+		first := streamGetEdgeID(s, true, false)
+		rewriteClientCommandArgument(c, args.trimStrategyArgIdx, createStringObject([]byte(first.String())))
+	}
+
+}
+
+func xaddCommand(c *client) {
+
+	var args streamAddTrimArgs
+	idpos := streamParseAddOrTrimArgsOrReply(c, &args, true)
+	if idpos < 0 {
+		return
+	}
+	fieldPos := idpos + 1
+	if c.argc-fieldPos < 2 || (c.argc-fieldPos)%2 == 1 {
+		addReplyErrorFormat(c, "wrong number of arguments for '%s' command", c.cmd.name)
+		return
+	}
+
+	// checked before the stream gets created
+	if args.idGiven && args.seqGiven && args.id.isZero() {
+		addReplyError(c, "The ID specified in XADD must be greater than 0-0")
+		return
+	}
+
+	key := c.argv[1].String()
+	o := streamTypeLookupWriteOrCreate(c, key, args.noMkstream)
+	if o == nil {
+		return
+	}
+	s := o.data.(*stream)
+
+	if s.lastId == streamIDMax {
+		addReplyError(c, "The stream has exhausted the last possible ID, unable to add more items")
+		return
+	}
+
+	var useId *streamID
+	if args.idGiven {
+		useId = &args.id
+	}
+	id, ok := streamAppendItem(s, c.argv[fieldPos:], useId, args.seqGiven)
+	if !ok {
+		addReplyError(c, "The ID specified in XADD is equal or smaller than the target stream top item")
+		return
+	}
+	addReplyStreamID(c, id)
+	rServer.dirty++
+
+	if args.trimStrategy != trimStrategyNone {
+		streamTrim(s, &args)
+		if args.approxTrim {
+			streamRewriteTrimArgument(c, s, &args)
+		}
+	}
+
+	// the generated ID, for the command to be run again the same way
+	if !args.idGiven || !args.seqGiven {
+		rewriteClientCommandArgument(c, idpos, createStringObject([]byte(id.String())))
+	}
+
+	// the key may have been there already
+	signalKeyAsReady(c.db, key)
+
+}
+
+// xrangeGenericCommand implements XRANGE and XREVRANGE.
+func xrangeGenericCommand(c *client, rev bool) {
+
+	startArg, endArg := c.argv[2], c.argv[3]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+
+	start, startEx, ok := streamParseIntervalIDOrReply(c, startArg, 0)
+	if !ok {
+		return
+	}
+	if startEx && !streamIncrID(&start) {
+		addReplyError(c, "invalid start ID for the interval")
+		return
+	}
+	end, endEx, ok := streamParseIntervalIDOrReply(c, endArg, math.MaxUint64)
+	if !ok {
+		return
+	}
+	if endEx && !streamDecrID(&end) {
+		addReplyError(c, "invalid end ID for the interval")
+		return
+	}
+
+	count := int64(-1)
+	for j := 4; j < c.argc; j++ {
+		if strings.EqualFold(c.argv[j].String(), "count") && j+1 < c.argc {
+			if count, ok = getLongLongFromObjectOrReply(c, c.argv[j+1], ""); !ok {
+				return
+			}
+			count = max(count, 0)
+			j++
+		} else {
+			addReply(c, shared.syntaxErr)
+			return
+		}
+	}
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.emptyArray)
+	if o == nil || !checkType(c, o, objectTypeStream) {
+		return
+	}
+	if count == 0 {
+		addReplyNullArray(c)
+		return
+	}
+	streamReplyWithRange(c, o.data.(*stream), start, end, max(count, 0), rev, nil, nil, 0, nil)
+
+}
+
+func xrangeCommand(c *client) {
+	xrangeGenericCommand(c, false)
+}
+
+func xrevrangeCommand(c *client) {
+	xrangeGenericCommand(c, true)
+}
+
+func xlenCommand(c *client) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeStream) {
+		return
+	}
+	addReplyLongLong(c, o.data.(*stream).length)
+
+}
+
+func xdelCommand(c *client) {
+
+	o := lookupKeyWriteOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeStream) {
+		return
+	}
+	s := o.data.(*stream)
+
+	// all the IDs are checked first, not to delete some and then fail
+	ids := make([]streamID, 0, c.argc-2)
+	for j := 2; j < c.argc; j++ {
+		id, ok := streamParseStrictIDOrReply(c, c.argv[j], 0, nil)
+		if !ok {
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	deleted := int64(0)
+	firstEntry := false
+	for _, id := range ids {
+		if !streamDeleteItem(s, id) {
+			continue
+		}
+		if id == s.firstId {
+			firstEntry = true
+		}
+		if id.compare(s.maxDeletedEntryId) > 0 {
+			s.maxDeletedEntryId = id
+		}
+		deleted++
+	}
+
+	if deleted > 0 {
+		if s.length == 0 {
+			s.firstId = streamID{}
+		} else if firstEntry {
+			s.firstId = streamGetEdgeID(s, true, true)
+		}
+		rServer.dirty += deleted
+	}
+	addReplyLongLong(c, deleted)
+
+}
+
+func xtrimCommand(c *client) {
+
+	var args streamAddTrimArgs
+	if streamParseAddOrTrimArgsOrReply(c, &args, false) < 0 {
+		return
+	}
+
+	o := lookupKeyWriteOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeStream) {
+		return
+	}
+	s := o.data.(*stream)
+
+	deleted := streamTrim(s, &args)
+	if deleted > 0 {
+		if args.approxTrim {
+			streamRewriteTrimArgument(c, s, &args)
+		}
+		rServer.dirty += deleted
+	}
+	addReplyLongLong(c, deleted)
+
+}
+
+// xreadCommand implements XREAD and XREADGROUP:
+//
+//	XREAD [COUNT count] [BLOCK ms] STREAMS key [key ...] id [id ...]
+//	XREADGROUP GROUP group consumer [COUNT count] [BLOCK ms] [NOACK]
+//	           STREAMS key [key ...] id [id ...]
+func xreadCommand(c *client) {
+
+	xreadgroup := c.cmd.name == "xreadgroup"
+	timeout := int64(-1) // no BLOCK
+	count := int64(0)
+	streamsArg, streamsCount := 0, 0
+	noack := false
+	var groupName, consumerName string
+	groupArg := 0
+
+	for j := 1; j < c.argc; j++ {
+		moreargs := c.argc - j - 1
+		opt := c.argv[j].String()
+		switch {
+		case strings.EqualFold(opt, "block") && moreargs > 0:
+			j++
+			d, ok := getTimeoutFromObjectOrReply(c, c.argv[j], unitMilliseconds)
+			if !ok {
+				return
+			}
+			timeout = d.Milliseconds()
+		case strings.EqualFold(opt, "count") && moreargs > 0:
+			j++
+			var ok bool
+			if count, ok = getLongLongFromObjectOrReply(c, c.argv[j], ""); !ok {
+				return
+			}
+			count = max(count, 0)
+		case strings.EqualFold(opt, "streams") && moreargs > 0:
+			streamsArg = j + 1
+			streamsCount = c.argc - streamsArg
+			if streamsCount%2 != 0 {
+				symbol := "$"
+				if xreadgroup {
+					symbol = ">"
+				}
+				addReplyErrorFormat(c, "Unbalanced '%s' list of streams: for each stream key an ID or '%s' must be specified.",
+					c.cmd.name, symbol)
+				return
+			}
+			streamsCount /= 2
+			j = c.argc
+		case strings.EqualFold(opt, "group") && moreargs >= 2:
+			if !xreadgroup {
+				addReplyError(c, "The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+				return
+			}
+			groupName, consumerName = c.argv[j+1].String(), c.argv[j+2].String()
+			groupArg = j + 1
+			j += 2
+		case strings.EqualFold(opt, "noack"):
+			if !xreadgroup {
+				addReplyError(c, "The NOACK option is only supported by XREADGROUP. You called XREAD instead.")
+				return
+			}
+			noack = true
+		default:
+			addReply(c, shared.syntaxErr)
+			return
+		}
+	}
+
+	if streamsArg == 0 {
+		addReply(c, shared.syntaxErr)
+		return
+	}
+	if xreadgroup && groupArg == 0 {
+		addReplyError(c, "Missing GROUP option for XREADGROUP")
+		return
+	}
+	// the deliveries are propagated as XCLAIM and XGROUP instead
+	preventCommandPropagation(c)
+
+	// the ID after which each stream is read, ">" being the last possible ID
+	ids := make([]streamID, streamsCount)
+	var groups []*streamCG
+	if groupArg != 0 {
+		groups = make([]*streamCG, streamsCount)
+	}
+	for j := 0; j < streamsCount; j++ {
+		key := c.argv[streamsArg+j].String()
+		idArg := c.argv[streamsArg+streamsCount+j]
+		o := lookupKeyRead(c.db, key)
+		if o != nil && !checkType(c, o, objectTypeStream) {
+			return
+		}
+		var s *stream
+		if o != nil {
+			s = o.data.(*stream)
+		}
+
+		if groupArg != 0 {
+			if groups[j] = streamLookupCG(s, groupName); groups[j] == nil {
+				addReplyErrorFormat(c, "-NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option",
+					key, groupName)
+				return
+			}
+		}
+
+		switch idArg.String() {
+		case "$":
+			if xreadgroup {
+				addReplyError(c, "The $ ID is meaningless in the context of XREADGROUP: you want to read the history of "+
+					"this consumer by specifying a proper ID, or use the > ID to get new messages. "+
+					"The $ ID would just return an empty result set.")
+				return
+			}
+			if s != nil {
+				ids[j] = s.lastId
+			}
+		case ">":
+			if !xreadgroup {
+				addReplyError(c, "The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+				return
+			}
+			ids[j] = streamIDMax
+		default:
+			id, ok := streamParseStrictIDOrReply(c, idArg, 0, nil)
+			if !ok {
+				return
+			}
+			ids[j] = id
+		}
+	}
+
+	var placeholder *bufferBlock
+	arraylen := 0
+	for j := 0; j < streamsCount; j++ {
+		o := lookupKeyRead(c.db, c.argv[streamsArg+j].String())
+		if o == nil {
+			continue
+		}
+		s := o.data.(*stream)
+		gt := ids[j] // the entries served are greater than gt
+		serve, serveHistory := false, false
+		var consumer *streamConsumer
+
+		if groups != nil {
+			if gt != streamIDMax {
+				// an ID other than ">" serves the consumer PEL
+				serve, serveHistory = true, true
+			} else if s.length > 0 && streamLastValidID(s).compare(groups[j].lastId) > 0 {
+				serve = true
+				gt = groups[j].lastId
+			}
+			if consumer = streamLookupConsumer(groups[j], consumerName); consumer == nil {
+				consumer = streamCreateConsumer(groups[j], consumerName)
+				streamPropagateConsumerCreation(c, c.argv[streamsArg+j], c.argv[groupArg], consumerName)
+				rServer.dirty++
+			}
+			consumer.seenTime = mstime()
+		} else if s.length > 0 && streamLastValidID(s).compare(gt) > 0 {
+			serve = true
+		}
+		if !serve {
+			continue
+		}
+
+		arraylen++
+		if arraylen == 1 {
+			placeholder = addReplyDeferredLen(c)
+		}
+		start := gt
+		streamIncrID(&start)
+
+		if c.resp == 2 {
+			addReplyArrayLen(c, 2)
+		}
+		addReplyBulk(c, c.argv[streamsArg+j].bytes())
+
+		flags := 0
+		if noack {
+			flags |= streamRwrNoack
+		}
+		if serveHistory {
+			flags |= streamRwrHistory
+		}
+		var group *streamCG
+		var spi *streamPropInfo
+		if groups != nil {
+			group = groups[j]
+			spi = &streamPropInfo{keyname: c.argv[streamsArg+j], groupname: c.argv[groupArg]}
+		}
+		streamReplyWithRange(c, s, start, streamIDMax, count, false, group, consumer, flags, spi)
+		if groups != nil {
+			rServer.dirty++
+		}
+	}
+
+	if arraylen > 0 {
+		if c.resp == 2 {
+			setDeferredArrayLen(c, placeholder, arraylen)
+		} else {
+			setDeferredMapLen(c, placeholder, arraylen)
+		}
+		return
+	}
+
+	if timeout != -1 {
+		// "$" becomes the ID it stands for now, not the last ID of when the
+		// command runs again.
+		for j := 0; j < streamsCount; j++ {
+			if argIdx := streamsArg + streamsCount + j; c.argv[argIdx].String() == "$" {
+				rewriteClientCommandArgument(c, argIdx, createStringObject([]byte(ids[j].String())))
+			}
+		}
+		blockForKeys(c, blockedStream, c.argv[streamsArg:streamsArg+streamsCount], time.Duration(timeout)*time.Millisecond)
+		return
+	}
+
+	addReplyNullArray(c)
+
+}
+
+var xgroupHelp = []string{
+	"CREATE <key> <groupname> <id|$> [option]",
+	"    Create a new consumer group. Options are:",
+	"    * MKSTREAM",
+	"      Create the empty stream if it does not exist.",
+	"    * ENTRIESREAD entries_read",
+	"      Set the group's entries_read counter (internal use).",
+	"CREATECONSUMER <key> <groupname> <consumer>",
+	"    Create a new consumer in the specified group.",
+	"DELCONSUMER <key> <groupname> <consumer>",
+	"    Remove the specified consumer.",
+	"DESTROY <key> <groupname>",
+	"    Remove the specified group.",
+	"SETID <key> <groupname> <id|$> [ENTRIESREAD entries_read]",
+	"    Set the current group ID and entries_read counter.",
+}
+
+// parseEntriesReadOrReply parses the ENTRIESREAD value of XGROUP.
+func parseEntriesReadOrReply(c *client, o *rObj) (int64, bool) {
+
+	entriesRead, ok := getLongLongFromObjectOrReply(c, o, "")
+	if !ok {
+		return 0, false
+	}
+	if entriesRead < 0 && entriesRead != streamCGInvalidEntriesRead {
+		addReplyError(c, "value for ENTRIESREAD must be positive or -1")
+		return 0, false
+	}
+	return entriesRead, true
+
+}
+
+func xgroupCommand(c *client) {
+
+	opt := strings.ToLower(c.argv[1].String())
+	if opt == "help" && c.argc == 2 {
+		addReplyHelp(c, xgroupHelp)
+		return
+	}
+
+	var s *stream
+	var cg *streamCG
+	var key, groupName string
+	mkstream := false
+	entriesRead := int64(streamCGInvalidEntriesRead)
+
+	// everything but HELP takes a key and a group
+	if c.argc >= 4 {
+		if opt == "create" && c.argc >= 5 {
+			for j := 5; j < c.argc; j++ {
+				switch {
+				case strings.EqualFold(c.argv[j].String(), "mkstream"):
+					mkstream = true
+				case strings.EqualFold(c.argv[j].String(), "entriesread") && j+1 < c.argc:
+					var ok bool
+					if entriesRead, ok = parseEntriesReadOrReply(c, c.argv[j+1]); !ok {
+						return
+					}
+					j++
+				default:
+					addReplySubcommandSyntaxError(c)
+					return
+				}
+			}
+		}
+
+		key, groupName = c.argv[2].String(), c.argv[3].String()
+		if o := lookupKeyWrite(c.db, key); o != nil {
+			if !checkType(c, o, objectTypeStream) {
+				return
+			}
+			s = o.data.(*stream)
+		}
+
+		if !mkstream {
+			if s == nil {
+				addReplyError(c, "The XGROUP subcommand requires the key to exist. "+
+					"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+				return
+			}
+			cg = streamLookupCG(s, groupName)
+			if cg == nil && (opt == "setid" || opt == "createconsumer" || opt == "delconsumer") {
+				addReplyErrorFormat(c, "-NOGROUP No such consumer group '%s' for key name '%s'", groupName, key)
+				return
+			}
+		}
+	}
+
+	switch {
+	case opt == "create" && c.argc >= 5 && c.argc <= 8:
+		var id streamID
+		if c.argv[4].String() == "$" {
+			if s != nil {
+				id = s.lastId
+			}
+		} else {
+			var ok bool
+			if id, ok = streamParseStrictIDOrReply(c, c.argv[4], 0, nil); !ok {
+				return
+			}
+		}
+
+		// MKSTREAM, now that nothing can fail
+		if s == nil {
+			o := createStreamObject()
+			dbAdd(c.db, key, o)
+			s = o.data.(*stream)
+		}
+		if streamCreateCG(s, groupName, id, entriesRead) == nil {
+			addReplyError(c, "-BUSYGROUP Consumer Group name already exists")
+			return
+		}
+		rServer.dirty++
+		addReply(c, shared.ok)
+	case opt == "setid" && (c.argc == 5 || c.argc == 7):
+		var id streamID
+		if c.argv[4].String() == "$" {
+			id = s.lastId
+		} else {
+			var ok bool
+			if id, ok = streamParseIDOrReply(c, c.argv[4], 0); !ok {
+				return
+			}
+		}
+		if c.argc == 7 {
+			if !strings.EqualFold(c.argv[5].String(), "entriesread") {
+				addReplySubcommandSyntaxError(c)
+				return
+			}
+			var ok bool
+			if entriesRead, ok = parseEntriesReadOrReply(c, c.argv[6]); !ok {
+				return
+			}
+		}
+		cg.lastId = id
+		cg.entriesRead = entriesRead
+		rServer.dirty++
+		addReply(c, shared.ok)
+	case opt == "destroy" && c.argc == 4:
+		if cg == nil {
+			addReply(c, shared.czero)
+			return
+		}
+		s.cgroups.remove(groupName)
+		rServer.dirty++
+		addReply(c, shared.cone)
+		// the consumers blocked on the group get an error
+		signalKeyAsReady(c.db, key)
+	case opt == "createconsumer" && c.argc == 5:
+		if streamCreateConsumer(cg, c.argv[4].String()) == nil {
+			addReply(c, shared.czero)
+			return
+		}
+		rServer.dirty++
+		addReply(c, shared.cone)
+	case opt == "delconsumer" && c.argc == 5:
+		pending := 0
+		if consumer := streamLookupConsumer(cg, c.argv[4].String()); consumer != nil {
+			pending = consumer.pel.size()
+			streamDelConsumer(cg, consumer)
+			rServer.dirty++
+		}
+		addReplyLongLong(c, int64(pending))
+	default:
+		addReplySubcommandSyntaxError(c)
+	}
+
+}
+
+// xackCommand implements XACK key group id [id ...].
+func xackCommand(c *client) {
+
+	var group *streamCG
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o != nil {
+		if !checkType(c, o, objectTypeStream) {
+			return
+		}
+		group = streamLookupCG(o.data.(*stream), c.argv[2].String())
+	}
+
+	// the IDs are checked first, the command acks all of them or none
+	ids := make([]streamID, 0, c.argc-3)
+	for j := 3; j < c.argc; j++ {
+		id, ok := streamParseStrictIDOrReply(c, c.argv[j], 0, nil)
+		if !ok {
+			return
+		}
+		ids = append(ids, id)
+	}
+	if group == nil {
+		addReply(c, shared.czero)
+		return
+	}
+
+	acknowledged := int64(0)
+	for _, id := range ids {
+		key := id.encode()
+		v, ok := group.pel.remove(key)
+		if !ok {
+			continue
+		}
+		v.(*streamNACK).consumer.pel.remove(key)
+		acknowledged++
+	}
+	rServer.dirty += acknowledged
+	addReplyLongLong(c, acknowledged)
+
+}
+
+// xpendingCommand implements XPENDING key group [[IDLE min-idle] start end
+// count [consumer]].
+func xpendingCommand(c *client) {
+
+	justInfo := c.argc == 3
+	key, groupName := c.argv[1].String(), c.argv[2].String()
+	var start, end streamID
+	var consumerName string
+	count, minIdle := int64(0), int64(0)
+
+	if c.argc != 3 && (c.argc < 6 || c.argc > 9) {
+		addReply(c, shared.syntaxErr)
+		return
+	}
+
+	// the arguments are parsed first, to report syntax errors before anything
+	if c.argc >= 6 {
+		startIdx := 3
+		if strings.EqualFold(c.argv[3].String(), "idle") {
+			var ok bool
+			if minIdle, ok = getLongLongFromObjectOrReply(c, c.argv[4], ""); !ok {
+				return
+			}
+			if c.argc < 8 {
+				addReply(c, shared.syntaxErr)
+				return
+			}
+			startIdx += 2
+		}
+
+		var ok, startEx, endEx bool
+		if count, ok = getLongLongFromObjectOrReply(c, c.argv[startIdx+2], ""); !ok {
+			return
+		}
+		count = max(count, 0)
+
+		if start, startEx, ok = streamParseIntervalIDOrReply(c, c.argv[startIdx], 0); !ok {
+			return
+		}
+		if startEx && !streamIncrID(&start) {
+			addReplyError(c, "invalid start ID for the interval")
+			return
+		}
+		if end, endEx, ok = streamParseIntervalIDOrReply(c, c.argv[startIdx+1], math.MaxUint64); !ok {
+			return
+		}
+		if endEx && !streamDecrID(&end) {
+			addReplyError(c, "invalid end ID for the interval")
+			return
+		}
+		if startIdx+3 < c.argc {
+			consumerName = c.argv[startIdx+3].String()
+		}
+	}
+
+	o := lookupKeyRead(c.db, key)
+	var group *streamCG
+	if o != nil {
+		if !checkType(c, o, objectTypeStream) {
+			return
+		}
+		group = streamLookupCG(o.data.(*stream), groupName)
+	}
+	if group == nil {
+		addReplyErrorFormat(c, "-NOGROUP No such key '%s' or consumer group '%s'", key, groupName)
+		return
+	}
+
+	if justInfo {
+		addReplyArrayLen(c, 4)
+		addReplyLongLong(c, int64(group.pel.size()))
+		if group.pel.size() == 0 {
+			addReplyNull(c)
+			addReplyNull(c)
+			addReplyNullArray(c)
+			return
+		}
+		it := group.pel.iterator()
+		it.seek("^", "")
+		addReplyStreamID(c, streamDecodeID(it.key))
+		it.seek("$", "")
+		addReplyStreamID(c, streamDecodeID(it.key))
+
+		// the consumers with pending entries
+		placeholder := addReplyDeferredLen(c)
+		arraylen := 0
+		it = group.consumers.iterator()
+		it.seek("^", "")
+		for it.next() {
+			consumer := it.data.(*streamConsumer)
+			if consumer.pel.size() == 0 {
+				continue
+			}
+			addReplyArrayLen(c, 2)
+			addReplyBulkString(c, consumer.name)
+			addReplyBulkLongLong(c, int64(consumer.pel.size()))
+			arraylen++
+		}
+		setDeferredArrayLen(c, placeholder, arraylen)
+		return
+	}
+
+	pel := group.pel
+	if consumerName != "" {
+		consumer := streamLookupConsumer(group, consumerName)
+		if consumer == nil {
+			addReply(c, shared.emptyArray)
+			return
+		}
+		pel = consumer.pel
+	}
+
+	now := mstime()
+	endKey := end.encode()
+	placeholder := addReplyDeferredLen(c)
+	arraylen := 0
+	it := pel.iterator()
+	it.seek(">=", start.encode())
+	for count > 0 && it.next() && it.key <= endKey {
+		nack := it.data.(*streamNACK)
+		elapsed := max(now-nack.deliveryTime, 0)
+		if minIdle > 0 && elapsed < minIdle {
+			continue
+		}
+		arraylen++
+		count--
+		addReplyArrayLen(c, 4)
+		addReplyStreamID(c, streamDecodeID(it.key))
+		addReplyBulkString(c, nack.consumer.name)
+		addReplyLongLong(c, elapsed)
+		addReplyLongLong(c, nack.deliveryCount)
+	}
+	setDeferredArrayLen(c, placeholder, arraylen)
+
+}
+
+// streamClaimNACK moves the pending entry to the consumer, as delivered at
+// deliveryTime.
+func streamClaimNACK(nack *streamNACK, key string, consumer *streamConsumer, deliveryTime int64) {
+
+	if nack.consumer != consumer {
+		if nack.consumer != nil {
+			nack.consumer.pel.remove(key)
+		}
+		consumer.pel.insert(key, nack, true)
+		nack.consumer = consumer
+	}
+	nack.deliveryTime = deliveryTime
+	consumer.activeTime = mstime()
+
+}
+
+// xclaimCommand implements:
+//
+//	XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms]
+//	       [TIME unix-time-ms] [RETRYCOUNT count] [FORCE] [JUSTID]
+//	       [LASTID id]
+func xclaimCommand(c *client) {
+
+	var group *streamCG
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o != nil {
+		if !checkType(c, o, objectTypeStream) {
+			return
+		}
+		group = streamLookupCG(o.data.(*stream), c.argv[2].String())
+	}
+	if group == nil {
+		addReplyErrorFormat(c, "-NOGROUP No such key '%s' or consumer group '%s'", c.argv[1].String(), c.argv[2].String())
+		return
+	}
+	s := o.data.(*stream)
+
+	minIdle, ok := getLongLongFromObjectOrReply(c, c.argv[4], "Invalid min-idle-time argument for XCLAIM")
+	if !ok {
+		return
+	}
+	minIdle = max(minIdle, 0)
+
+	// the IDs come first, then the options
+	j := 5
+	var ids []streamID
+	for ; j < c.argc; j++ {
+		id, ok := streamParseStrictIDOrReply(nil, c.argv[j], 0, nil)
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := mstime()
+	deliveryTime, retryCount := int64(-1), int64(-1)
+	force, justId := false, false
+	var lastId streamID
+	for ; j < c.argc; j++ {
+		moreargs := c.argc - 1 - j
+		opt := c.argv[j].String()
+		switch {
+		case strings.EqualFold(opt, "force"):
+			force = true
+		case strings.EqualFold(opt, "justid"):
+			justId = true
+		case strings.EqualFold(opt, "idle") && moreargs > 0:
+			j++
+			idle, ok := getLongLongFromObjectOrReply(c, c.argv[j], "Invalid IDLE option argument for XCLAIM")
+			if !ok {
+				return
+			}
+			deliveryTime = now - idle
+		case strings.EqualFold(opt, "time") && moreargs > 0:
+			j++
+			if deliveryTime, ok = getLongLongFromObjectOrReply(c, c.argv[j], "Invalid TIME option argument for XCLAIM"); !ok {
+				return
+			}
+		case strings.EqualFold(opt, "retrycount") && moreargs > 0:
+			j++
+			if retryCount, ok = getLongLongFromObjectOrReply(c, c.argv[j], "Invalid RETRYCOUNT option argument for XCLAIM"); !ok {
+				return
+			}
+		case strings.EqualFold(opt, "lastid") && moreargs > 0:
+			j++
+			if lastId, ok = streamParseStrictIDOrReply(c, c.argv[j], 0, nil); !ok {
+				return
+			}
+		default:
+			addReplyErrorFormat(c, "Unrecognized XCLAIM option '%s'", opt)
+			return
+		}
+	}
+
+	propagateLastId := false
+	if lastId.compare(group.lastId) > 0 {
+		group.lastId = lastId
+		propagateLastId = true
+	}
+
+	// a bogus delivery time, e.g. computed by a client whose clock is
+	// ahead, is not an error.
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+
+	var consumer *streamConsumer
+	placeholder := addReplyDeferredLen(c)
+	arraylen := 0
+	for _, id := range ids {
+		key := id.encode()
+		v, pending := group.pel.find(key)
+
+		// an entry deleted from the stream is no longer pending
+		if !streamEntryExists(s, id) {
+			if pending {
+				nack := v.(*streamNACK)
+				streamPropagateXCLAIM(c, c.argv[1], group, c.argv[2], id, nack)
+				group.pel.remove(key)
+				nack.consumer.pel.remove(key)
+				rServer.dirty++
+			}
+			continue
+		}
+
+		// FORCE creates the pending entry, useful to rebuild the PELs
+		var nack *streamNACK
+		if pending {
+			nack = v.(*streamNACK)
+		} else if force {
+			nack = &streamNACK{}
+			group.pel.insert(key, nack, false)
+		} else {
+			continue
+		}
+
+		// the consumer of a forced entry is nil, min-idle does not apply
+		if nack.consumer != nil && minIdle > 0 && now-nack.deliveryTime < minIdle {
+			continue
+		}
+
+		if consumer == nil {
+			consumer = streamLookupOrCreateConsumer(group, c.argv[3].String())
+		}
+		streamClaimNACK(nack, key, consumer, deliveryTime)
+		if retryCount >= 0 {
+			nack.deliveryCount = retryCount
+		} else if !justId {
+			nack.deliveryCount++
+		}
+
+		if justId {
+			addReplyStreamID(c, id)
+		} else {
+			streamReplyWithRange(c, s, id, id, 1, false, nil, nil, streamRwrRawEntries, nil)
+		}
+		streamPropagateXCLAIM(c, c.argv[1], group, c.argv[2], id, nack)
+		arraylen++
+		rServer.dirty++
+	}
+	if propagateLastId {
+		streamPropagateGroupID(c, c.argv[1], group, c.argv[2])
+		rServer.dirty++
+	}
+	setDeferredArrayLen(c, placeholder, arraylen)
+	// the claims are propagated one by one, as they happened
+	preventCommandPropagation(c)
+
+}
+
+// xautoclaimCommand implements XAUTOCLAIM key group consumer min-idle-time
+// start [COUNT count] [JUSTID].
+func xautoclaimCommand(c *client) {
+
+	// how many pending entries are scanned for each one claimed, at most
+	const attemptsFactor = 10
+
+	minIdle, ok := getLongLongFromObjectOrReply(c, c.argv[4], "Invalid min-idle-time argument for XAUTOCLAIM")
+	if !ok {
+		return
+	}
+	minIdle = max(minIdle, 0)
+
+	start, startEx, ok := streamParseIntervalIDOrReply(c, c.argv[5], 0)
+	if !ok {
+		return
+	}
+	if startEx && !streamIncrID(&start) {
+		addReplyError(c, "invalid start ID for the interval")
+		return
+	}
+
+	count, justId := int64(100), false
+	for j := 6; j < c.argc; j++ {
+		opt := c.argv[j].String()
+		switch {
+		case strings.EqualFold(opt, "count") && j+1 < c.argc:
+			if count, ok = getRangeLongFromObjectOrReply(c, c.argv[j+1], 1, math.MaxInt64/16, "COUNT must be > 0"); !ok {
+				return
+			}
+			j++
+		case strings.EqualFold(opt, "justid"):
+			justId = true
+		default:
+			addReply(c, shared.syntaxErr)
+			return
+		}
+	}
+
+	var group *streamCG
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o != nil {
+		if !checkType(c, o, objectTypeStream) {
+			return
+		}
+		group = streamLookupCG(o.data.(*stream), c.argv[2].String())
+	}
+	if group == nil {
+		addReplyErrorFormat(c, "-NOGROUP No such key '%s' or consumer group '%s'", c.argv[1].String(), c.argv[2].String())
+		return
+	}
+	s := o.data.(*stream)
+
+	var consumer *streamConsumer
+	var claimed, deletedIds []streamID
+	now := mstime()
+	attempts := count * attemptsFactor
+	it := group.pel.iterator()
+	it.seek(">=", start.encode())
+	for ; attempts > 0 && count > 0 && it.next(); attempts-- {
+		nack := it.data.(*streamNACK)
+		id := streamDecodeID(it.key)
+
+		// an entry deleted from the stream is no longer pending
+		if !streamEntryExists(s, id) {
+			streamPropagateXCLAIM(c, c.argv[1], group, c.argv[2], id, nack)
+			group.pel.remove(it.key)
+			nack.consumer.pel.remove(it.key)
+			deletedIds = append(deletedIds, id)
+			count--
+			rServer.dirty++
+			continue
+		}
+
+		if minIdle > 0 && now-nack.deliveryTime < minIdle {
+			continue
+		}
+
+		if consumer == nil {
+			consumer = streamLookupOrCreateConsumer(group, c.argv[3].String())
+		}
+		streamClaimNACK(nack, it.key, consumer, now)
+		if !justId {
+			nack.deliveryCount++
+		}
+		streamPropagateXCLAIM(c, c.argv[1], group, c.argv[2], id, nack)
+		claimed = append(claimed, id)
+		count--
+		rServer.dirty++
+	}
+
+	// the cursor of the next call, 0-0 once the PEL was scanned to its end
+	var next streamID
+	if it.next() {
+		next = streamDecodeID(it.key)
+	}
+
+	addReplyArrayLen(c, 3)
+	addReplyStreamID(c, next)
+	addReplyArrayLen(c, len(claimed))
+	for _, id := range claimed {
+		if justId {
+			addReplyStreamID(c, id)
+		} else {
+			streamReplyWithRange(c, s, id, id, 1, false, nil, nil, streamRwrRawEntries, nil)
+		}
+	}
+	addReplyArrayLen(c, len(deletedIds))
+	for _, id := range deletedIds {
+		addReplyStreamID(c, id)
+	}
+	// the claims are propagated one by one, as they happened
+	preventCommandPropagation(c)
+
+}
+
+var xinfoHelp = []string{
+	"CONSUMERS <key> <groupname>",
+	"    Show consumers of <groupname>.",
+	"GROUPS <key>",
+	"    Show the stream consumer groups.",
+	"STREAM <key> [FULL [COUNT <count>]",
+	"    Show information about the stream.",
+}
+
+func addReplyStreamCGLag(c *client, s *stream, cg *streamCG) {
+	if lag, ok := streamCGLag(s, cg); ok {
+		addReplyLongLong(c, lag)
+		return
+	}
+	addReplyNull(c)
+}
+
+func addReplyStreamCGEntriesRead(c *client, cg *streamCG) {
+	if cg.entriesRead == streamCGInvalidEntriesRead {
+		addReplyNull(c)
+		return
+	}
+	addReplyLongLong(c, cg.entriesRead)
+}
+
+// xinfoReplyWithStreamInfo implements XINFO STREAM key [FULL [COUNT count]].
+func xinfoReplyWithStreamInfo(c *client, s *stream) {
+
+	full := false
+	count := int64(10)
+	opts := c.argv[3:]
+	if len(opts) > 0 {
+		if len(opts) != 1 && len(opts) != 3 || !strings.EqualFold(opts[0].String(), "full") {
+			addReplySubcommandSyntaxError(c)
+			return
+		}
+		if len(opts) == 3 {
+			if !strings.EqualFold(opts[1].String(), "count") {
+				addReplySubcommandSyntaxError(c)
+				return
+			}
+			var ok bool
+			if count, ok = getLongLongFromObjectOrReply(c, opts[2], ""); !ok {
+				return
+			}
+			if count < 0 {
+				count = 10
+			}
+		}
+		full = true
+	}
+
+	if full {
+		addReplyMapLen(c, 9)
+	} else {
+		addReplyMapLen(c, 10)
+	}
+	addReplyBulkString(c, "length")
+	addReplyLongLong(c, s.length)
+	addReplyBulkString(c, "radix-tree-keys")
+	addReplyLongLong(c, int64(s.rax.size()))
+	addReplyBulkString(c, "radix-tree-nodes")
+	addReplyLongLong(c, int64(s.rax.numNodes))
+	addReplyBulkString(c, "last-generated-id")
+	addReplyStreamID(c, s.lastId)
+	addReplyBulkString(c, "max-deleted-entry-id")
+	addReplyStreamID(c, s.maxDeletedEntryId)
+	addReplyBulkString(c, "entries-added")
+	addReplyLongLong(c, s.entriesAdded)
+	addReplyBulkString(c, "recorded-first-entry-id")
+	addReplyStreamID(c, s.firstId)
+
+	if !full {
+		addReplyBulkString(c, "groups")
+		if s.cgroups == nil {
+			addReplyLongLong(c, 0)
+		} else {
+			addReplyLongLong(c, int64(s.cgroups.size()))
+		}
+		addReplyBulkString(c, "first-entry")
+		if streamReplyWithRange(c, s, streamID{}, streamIDMax, 1, false, nil, nil, streamRwrRawEntries, nil) == 0 {
+			addReplyNull(c)
+		}
+		addReplyBulkString(c, "last-entry")
+		if streamReplyWithRange(c, s, streamID{}, streamIDMax, 1, true, nil, nil, streamRwrRawEntries, nil) == 0 {
+			addReplyNull(c)
+		}
+		return
+	}
+
+	addReplyBulkString(c, "entries")
+	streamReplyWithRange(c, s, streamID{}, streamIDMax, count, false, nil, nil, 0, nil)
+
+	addReplyBulkString(c, "groups")
+	if s.cgroups == nil {
+		addReply(c, shared.emptyArray)
+		return
+	}
+	addReplyArrayLen(c, s.cgroups.size())
+	gi := s.cgroups.iterator()
+	gi.seek("^", "")
+	for gi.next() {
+		cg := gi.data.(*streamCG)
+		addReplyMapLen(c, 7)
+		addReplyBulkString(c, "name")
+		addReplyBulkString(c, gi.key)
+		addReplyBulkString(c, "last-delivered-id")
+		addReplyStreamID(c, cg.lastId)
+		addReplyBulkString(c, "entries-read")
+		addReplyStreamCGEntriesRead(c, cg)
+		addReplyBulkString(c, "lag")
+		addReplyStreamCGLag(c, s, cg)
+		addReplyBulkString(c, "pel-count")
+		addReplyLongLong(c, int64(cg.pel.size()))
+
+		addReplyBulkString(c, "pending")
+		placeholder := addReplyDeferredLen(c)
+		arraylen := int64(0)
+		it := cg.pel.iterator()
+		it.seek("^", "")
+		for (count == 0 || arraylen < count) && it.next() {
+			nack := it.data.(*streamNACK)
+			addReplyArrayLen(c, 4)
+			addReplyStreamID(c, streamDecodeID(it.key))
+			addReplyBulkString(c, nack.consumer.name)
+			addReplyLongLong(c, nack.deliveryTime)
+			addReplyLongLong(c, nack.deliveryCount)
+			arraylen++
+		}
+		setDeferredArrayLen(c, placeholder, int(arraylen))
+
+		addReplyBulkString(c, "consumers")
+		addReplyArrayLen(c, cg.consumers.size())
+		ci := cg.consumers.iterator()
+		ci.seek("^", "")
+		for ci.next() {
+			consumer := ci.data.(*streamConsumer)
+			addReplyMapLen(c, 5)
+			addReplyBulkString(c, "name")
+			addReplyBulkString(c, consumer.name)
+			addReplyBulkString(c, "seen-time")
+			addReplyLongLong(c, consumer.seenTime)
+			addReplyBulkString(c, "active-time")
+			addReplyLongLong(c, consumer.activeTime)
+			addReplyBulkString(c, "pel-count")
+			addReplyLongLong(c, int64(consumer.pel.size()))
+
+			addReplyBulkString(c, "pending")
+			placeholder := addReplyDeferredLen(c)
+			arraylen := int64(0)
+			it := consumer.pel.iterator()
+			it.seek("^", "")
+			for (count == 0 || arraylen < count) && it.next() {
+				nack := it.data.(*streamNACK)
+				addReplyArrayLen(c, 3)
+				addReplyStreamID(c, streamDecodeID(it.key))
+				addReplyLongLong(c, nack.deliveryTime)
+				addReplyLongLong(c, nack.deliveryCount)
+				arraylen++
+			}
+			setDeferredArrayLen(c, placeholder, int(arraylen))
+		}
+	}
+
+}
+
+func xinfoCommand(c *client) {
+
+	opt := strings.ToLower(c.argv[1].String())
+	if opt == "help" {
+		if c.argc != 2 {
+			addReplySubcommandSyntaxError(c)
+			return
+		}
+		addReplyHelp(c, xinfoHelp)
+		return
+	}
+	if c.argc < 3 {
+		addReplySubcommandSyntaxError(c)
+		return
+	}
+
+	key := c.argv[2].String()
+	o := lookupKeyReadOrReply(c, key, shared.noKeyErr)
+	if o == nil || !checkType(c, o, objectTypeStream) {
+		return
+	}
+	s := o.data.(*stream)
+
+	switch {
+	case opt == "consumers" && c.argc == 4:
+		cg := streamLookupCG(s, c.argv[3].String())
+		if cg == nil {
+			addReplyErrorFormat(c, "-NOGROUP No such consumer group '%s' for key name '%s'", c.argv[3].String(), key)
+			return
+		}
+		now := mstime()
+		addReplyArrayLen(c, cg.consumers.size())
+		it := cg.consumers.iterator()
+		it.seek("^", "")
+		for it.next() {
+			consumer := it.data.(*streamConsumer)
+			inactive := int64(-1)
+			if consumer.activeTime != -1 {
+				inactive = now - consumer.activeTime
+			}
+			addReplyMapLen(c, 4)
+			addReplyBulkString(c, "name")
+			addReplyBulkString(c, consumer.name)
+			addReplyBulkString(c, "pending")
+			addReplyLongLong(c, int64(consumer.pel.size()))
+			addReplyBulkString(c, "idle")
+			addReplyLongLong(c, max(now-consumer.seenTime, 0))
+			addReplyBulkString(c, "inactive")
+			addReplyLongLong(c, inactive)
+		}
+	case opt == "groups" && c.argc == 3:
+		if s.cgroups == nil {
+			addReply(c, shared.emptyArray)
+			return
+		}
+		addReplyArrayLen(c, s.cgroups.size())
+		it := s.cgroups.iterator()
+		it.seek("^", "")
+		for it.next() {
+			cg := it.data.(*streamCG)
+			addReplyMapLen(c, 6)
+			addReplyBulkString(c, "name")
+			addReplyBulkString(c, it.key)
+			addReplyBulkString(c, "consumers")
+			addReplyLongLong(c, int64(cg.consumers.size()))
+			addReplyBulkString(c, "pending")
+			addReplyLongLong(c, int64(cg.pel.size()))
+			addReplyBulkString(c, "last-delivered-id")
+			addReplyStreamID(c, cg.lastId)
+			addReplyBulkString(c, "entries-read")
+			addReplyStreamCGEntriesRead(c, cg)
+			addReplyBulkString(c, "lag")
+			addReplyStreamCGLag(c, s, cg)
+		}
+	case opt == "stream":
+		xinfoReplyWithStreamInfo(c, s)
+	default:
+		addReplySubcommandSyntaxError(c)
+	}
+
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setStreamNodeMaxEntries sets stream-node-max-entries for a test, small
+// values spreading the entries over many listpacks.
+func setStreamNodeMaxEntries(tc *testConn, entries int) {
+	tc.t.Helper()
+	tc.expect(testStatus("OK"), "config", "set", "stream-node-max-entries", strconv.Itoa(entries))
+	tc.t.Cleanup(func() {
+		tc.do("config", "set", "stream-node-max-entries", "100")
+	})
+}
+
+func TestStream_AddRange(t *testing.T) {
+	tc := newBlockingTestConns(t, "8", 1)[0]
+	setStreamNodeMaxEntries(tc, 3)
+
+	tc.expect("1-1", "xadd", "s", "1-1", "a", "1")
+	tc.expect(testStatus("stream"), "type", "s")
+	tc.expect("stream", "object", "encoding", "s")
+	tc.expect("1-2", "xadd", "s", "1-*", "b", "2")
+	tc.expect("5-0", "xadd", "s", "5", "a", "3", "c", "4")
+	for j := 6; j <= 10; j++ {
+		id := strconv.Itoa(j) + "-0"
+		tc.expect(id, "xadd", "s", id, "a", strconv.Itoa(j))
+	}
+	tc.expect(int64(8), "xlen", "s")
+
+	tc.expect([]any{
+		[]any{"1-1", []any{"a", "1"}},
+		[]any{"1-2", []any{"b", "2"}},
+		[]any{"5-0", []any{"a", "3", "c", "4"}},
+	}, "xrange", "s", "-", "+", "count", "3")
+	tc.expect([]any{
+		[]any{"10-0", []any{"a", "10"}},
+		[]any{"9-0", []any{"a", "9"}},
+	}, "xrevrange", "s", "+", "(8", "count", "2")
+	tc.expect([]any{[]any{"1-2", []any{"b", "2"}}}, "xrange", "s", "(1-1", "1")
+	tc.expect(nil, "xrange", "s", "-", "+", "count", "0")
+	tc.expect([]any{}, "xrange", "nokey", "-", "+")
+
+	id := tc.do("xadd", "s", "*", "f", "v").(string)
+	ms, _ := strconv.ParseInt(strings.Split(id, "-")[0], 10, 64)
+	if ms < 10 {
+		t.Fatalf("unexpected generated ID %s", id)
+	}
+	tc.expect(testError("ERR The ID specified in XADD is equal or smaller than the target stream top item"),
+		"xadd", "s", "10-0", "f", "v")
+	tc.expect(testError("ERR The ID specified in XADD must be greater than 0-0"), "xadd", "s2", "0-0", "f", "v")
+	tc.expect(testError("ERR Invalid stream ID specified as stream command argument"), "xadd", "s", "1-x", "f", "v")
+	tc.expect(testError("ERR wrong number of arguments for 'xadd' command"), "xadd", "s", "*", "f", "v", "g")
+	tc.expect(nil, "xadd", "s3", "nomkstream", "*", "f", "v")
+	tc.expect(int64(0), "exists", "s3")
+
+	tc.expect("18446744073709551615-18446744073709551615", "xadd", "s4", "18446744073709551615-18446744073709551615", "f", "v")
+	tc.expect(testError("ERR The stream has exhausted the last possible ID, unable to add more items"),
+		"xadd", "s4", "*", "f", "v")
+
+	tc.expect(testStatus("OK"), "set", "str", "v")
+	tc.expectError("WRONGTYPE", "xadd", "str", "*", "f", "v")
+}
+
+func TestStream_DelTrim(t *testing.T) {
+	tc := newBlockingTestConns(t, "8", 1)[0]
+	setStreamNodeMaxEntries(tc, 4)
+
+	for j := 1; j <= 20; j++ {
+		tc.do("xadd", "s", strconv.Itoa(j), "f", strconv.Itoa(j))
+	}
+	tc.expect(int64(2), "xdel", "s", "1", "3", "100")
+	tc.expect([]any{[]any{"2-0", []any{"f", "2"}}}, "xrange", "s", "-", "+", "count", "1")
+	tc.expect([]any{[]any{"20-0", []any{"f", "20"}}, []any{"19-0", []any{"f", "19"}}},
+		"xrevrange", "s", "+", "-", "count", "2")
+	tc.expect(int64(18), "xlen", "s")
+
+	// exact trimming goes inside the listpacks, approximated trimming not
+	tc.expect(int64(3), "xtrim", "s", "maxlen", "15")
+	tc.expect([]any{[]any{"6-0", []any{"f", "6"}}}, "xrange", "s", "-", "+", "count", "1")
+	tc.expect(int64(3), "xtrim", "s", "minid", "~", "11")
+	tc.expect([]any{[]any{"9-0", []any{"f", "9"}}}, "xrange", "s", "-", "+", "count", "1")
+	tc.expect(int64(0), "xtrim", "s", "maxlen", "~", "10")
+	tc.expect(testError("ERR syntax error, LIMIT cannot be used without specifying a trimming strategy"),
+		"xtrim", "s", "limit", "10")
+	tc.expect(int64(12), "xlen", "s")
+
+	tc.expect("21-0", "xadd", "s", "maxlen", "5", "21", "f", "21")
+	tc.expect(int64(5), "xlen", "s")
+	tc.expect([]any{[]any{"17-0", []any{"f", "17"}}}, "xrange", "s", "-", "+", "count", "1")
+
+	tc.expect(testError("ERR syntax error, LIMIT cannot be used without the special ~ option"),
+		"xtrim", "s", "maxlen", "1", "limit", "10")
+	tc.expect(testError("ERR The MAXLEN argument must be >= 0."), "xtrim", "s", "maxlen", "-1")
+
+	// deleting everything keeps the key and its last ID
+	tc.expect(int64(5), "xtrim", "s", "maxlen", "0")
+	tc.expect(int64(0), "xlen", "s")
+	tc.expect(int64(1), "exists", "s")
+	tc.expectError("ERR The ID specified in XADD is equal", "xadd", "s", "21", "f", "v")
+}
+
+func TestStream_Read(t *testing.T) {
+	conns := newBlockingTestConns(t, "8", 2)
+	tc, b := conns[0], conns[1]
+
+	tc.do("xadd", "s1", "1", "a", "1")
+	tc.do("xadd", "s1", "2", "a", "2")
+	tc.expect([]any{
+		[]any{"s1", []any{[]any{"2-0", []any{"a", "2"}}}},
+	}, "xread", "count", "5", "streams", "s1", "s2", "1", "0")
+	tc.expect(nil, "xread", "streams", "s1", "$")
+	tc.expect(nil, "xread", "block", "10", "streams", "s1", "$")
+	tc.expect(testError("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."),
+		"xread", "streams", "s1", "s2", "0")
+
+	// "$" is the last ID of when the client blocked
+	b.send("xread", "block", "0", "streams", "s2", "s1", "$", "$")
+	waitBlockedClients(tc, 1)
+	tc.expect("3-0", "xadd", "s1", "3", "a", "3")
+	expectReply(b, []any{[]any{"s1", []any{[]any{"3-0", []any{"a", "3"}}}}})
+
+	// a listpack at the key does not serve a stream client
+	b.send("xread", "block", "0", "streams", "s3", "0")
+	waitBlockedClients(tc, 1)
+	tc.expect(int64(1), "rpush", "s3", "x")
+	waitBlockedClients(tc, 1)
+	tc.expect(int64(1), "del", "s3")
+	tc.expect("1-0", "xadd", "s3", "1", "b", "1")
+	expectReply(b, []any{[]any{"s3", []any{[]any{"1-0", []any{"b", "1"}}}}})
+}
+
+func TestStream_Groups(t *testing.T) {
+	conns := newBlockingTestConns(t, "8", 2)
+	tc, b := conns[0], conns[1]
+
+	tc.expectError("ERR The XGROUP subcommand requires the key to exist", "xgroup", "create", "s", "g", "$")
+	tc.expect(testStatus("OK"), "xgroup", "create", "s", "g", "$", "mkstream")
+	tc.expect(testError("BUSYGROUP Consumer Group name already exists"), "xgroup", "create", "s", "g", "$")
+	for j := 1; j <= 4; j++ {
+		tc.do("xadd", "s", strconv.Itoa(j), "f", strconv.Itoa(j))
+	}
+
+	tc.expect([]any{
+		[]any{"s", []any{[]any{"1-0", []any{"f", "1"}}, []any{"2-0", []any{"f", "2"}}}},
+	}, "xreadgroup", "group", "g", "alice", "count", "2", "streams", "s", ">")
+	tc.expect([]any{
+		[]any{"s", []any{[]any{"3-0", []any{"f", "3"}}}},
+	}, "xreadgroup", "group", "g", "bob", "count", "1", "streams", "s", ">")
+	tc.expect([]any{
+		[]any{"s", []any{[]any{"1-0", []any{"f", "1"}}, []any{"2-0", []any{"f", "2"}}}},
+	}, "xreadgroup", "group", "g", "alice", "streams", "s", "0")
+	tc.expect(testError("NOGROUP No such key 's' or consumer group 'nope' in XREADGROUP with GROUP option"),
+		"xreadgroup", "group", "nope", "alice", "streams", "s", ">")
+
+	tc.expect([]any{int64(3), "1-0", "3-0", []any{[]any{"alice", "2"}, []any{"bob", "1"}}}, "xpending", "s", "g")
+	pending := tc.do("xpending", "s", "g", "-", "+", "10", "alice").([]any)
+	if len(pending) != 2 || pending[0].([]any)[0] != "1-0" || pending[0].([]any)[3] != int64(2) {
+		t.Fatalf("unexpected pending entries %v", pending)
+	}
+
+	tc.expect(int64(1), "xack", "s", "g", "1", "9")
+	tc.expect([]any{"2-0"}, "xclaim", "s", "g", "bob", "0", "2", "justid")
+	tc.expect([]any{int64(2), "2-0", "3-0", []any{[]any{"bob", "2"}}}, "xpending", "s", "g")
+	tc.expect([]any{}, "xclaim", "s", "g", "alice", "3600000", "2")
+	tc.expect([]any{[]any{"4-0", []any{"f", "4"}}}, "xclaim", "s", "g", "alice", "0", "4", "force")
+
+	// deleted entries are dropped from the PEL
+	tc.expect(int64(1), "xdel", "s", "3")
+	tc.expect([]any{"0-0", []any{[]any{"2-0", []any{"f", "2"}}, []any{"4-0", []any{"f", "4"}}}, []any{"3-0"}},
+		"xautoclaim", "s", "g", "carol", "0", "0")
+	tc.expect([]any{"4-0", []any{"2-0"}, []any{}}, "xautoclaim", "s", "g", "dave", "0", "0", "count", "1", "justid")
+	tc.expect(testError("ERR COUNT must be > 0"), "xautoclaim", "s", "g", "dave", "0", "0", "count", "0")
+
+	tc.expect(int64(1), "xgroup", "createconsumer", "s", "g", "erin")
+	tc.expect(int64(0), "xgroup", "createconsumer", "s", "g", "erin")
+	tc.expect(int64(1), "xgroup", "delconsumer", "s", "g", "dave")
+	tc.expect(testStatus("OK"), "xgroup", "setid", "s", "g", "0")
+	tc.expect([]any{
+		[]any{"s", []any{[]any{"1-0", []any{"f", "1"}}}},
+	}, "xreadgroup", "group", "g", "erin", "count", "1", "noack", "streams", "s", ">")
+
+	groups := tc.do("xinfo", "groups", "s").([]any)
+	if len(groups) != 1 || len(groups[0].([]any)) != 12 || groups[0].([]any)[1] != "g" {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+	info := tc.do("xinfo", "stream", "s").([]any)
+	if len(info) != 20 || info[0] != "length" || info[1] != int64(3) {
+		t.Fatalf("unexpected stream info %v", info)
+	}
+	full := tc.do("xinfo", "stream", "s", "full").([]any)
+	if len(full) != 18 {
+		t.Fatalf("unexpected full stream info %v", full)
+	}
+	tc.expect(testError("ERR no such key"), "xinfo", "stream", "nokey")
+
+	// destroying the group errors the clients blocked on it
+	tc.expect(testStatus("OK"), "xgroup", "setid", "s", "g", "$")
+	b.send("xreadgroup", "group", "g", "erin", "block", "0", "streams", "s", ">")
+	waitBlockedClients(tc, 1)
+	tc.expect(int64(1), "xgroup", "destroy", "s", "g")
+	expectReply(b, testError("NOGROUP No such key 's' or consumer group 'g' in XREADGROUP with GROUP option"))
+	tc.expect(int64(0), "xgroup", "destroy", "s", "g")
+}
+
+func TestStream_ReadGroupBlocking(t *testing.T) {
+	conns := newBlockingTestConns(t, "8", 3)
+	tc, b1, b2 := conns[0], conns[1], conns[2]
+
+	tc.expect(testStatus("OK"), "xgroup", "create", "s", "g", "$", "mkstream")
+	b1.send("xreadgroup", "group", "g", "c1", "block", "0", "streams", "s", ">")
+	waitBlockedClients(tc, 1)
+	b2.send("xreadgroup", "group", "g", "c2", "block", "0", "streams", "s", ">")
+	waitBlockedClients(tc, 2)
+
+	// every entry is delivered to a single consumer
+	tc.expect("1-0", "xadd", "s", "1", "f", "1")
+	expectReply(b1, []any{[]any{"s", []any{[]any{"1-0", []any{"f", "1"}}}}})
+	waitBlockedClients(tc, 1)
+	tc.expect("2-0", "xadd", "s", "2", "f", "2")
+	expectReply(b2, []any{[]any{"s", []any{[]any{"2-0", []any{"f", "2"}}}}})
+
+	tc.expect([]any{int64(2), "1-0", "2-0", []any{[]any{"c1", "1"}, []any{"c2", "1"}}}, "xpending", "s", "g")
+	tc.expect(nil, "xreadgroup", "group", "g", "c1", "block", "10", "streams", "s", ">")
+}
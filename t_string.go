@@ -0,0 +1,575 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// SET and GETEX option flags
+const (
+	objSetNX = 1 << iota
+	objSetXX
+	objSetEX
+	objSetPX
+	objSetEXAT
+	objSetPXAT
+	objSetKeepTTL
+	objSetGet
+	objSetPersist
+)
+
+// commandSet and commandGetEx select the options accepted by
+// parseExtendedStringArguments.
+const (
+	commandSet = iota
+	commandGetEx
+)
+
+func checkStringLength(c *client, size int64) bool {
+	if size > maxBulkLen {
+		addReplyError(c, "string exceeds maximum allowed size (proto-max-bulk-len)")
+		return false
+	}
+	return true
+}
+
+// parseExtendedStringArguments parses the options of SET and GETEX starting
+// at argv[3] and argv[2]. It returns the option flags and the expire
+// argument, if any.
+func parseExtendedStringArguments(c *client, commandType int) (int, *rObj, bool) {
+
+	flags := 0
+	var expire *rObj
+
+	start := 3
+	if commandType == commandGetEx {
+		start = 2
+	}
+
+	for j := start; j < c.argc; j++ {
+		opt := strings.ToLower(c.argv[j].String())
+		var next *rObj
+		if j < c.argc-1 {
+			next = c.argv[j+1]
+		}
+
+		expireFlags := objSetEX | objSetPX | objSetEXAT | objSetPXAT | objSetKeepTTL | objSetPersist
+		switch {
+		case opt == "nx" && commandType == commandSet && flags&objSetXX == 0:
+			flags |= objSetNX
+		case opt == "xx" && commandType == commandSet && flags&objSetNX == 0:
+			flags |= objSetXX
+		case opt == "get" && commandType == commandSet:
+			flags |= objSetGet
+		case opt == "keepttl" && commandType == commandSet && flags&expireFlags == 0:
+			flags |= objSetKeepTTL
+		case opt == "persist" && commandType == commandGetEx && flags&expireFlags == 0:
+			flags |= objSetPersist
+		case opt == "ex" && next != nil && flags&expireFlags == 0:
+			flags |= objSetEX
+			expire = next
+			j++
+		case opt == "px" && next != nil && flags&expireFlags == 0:
+			flags |= objSetPX
+			expire = next
+			j++
+		case opt == "exat" && next != nil && flags&expireFlags == 0:
+			flags |= objSetEXAT
+			expire = next
+			j++
+		case opt == "pxat" && next != nil && flags&expireFlags == 0:
+			flags |= objSetPXAT
+			expire = next
+			j++
+		default:
+			addReply(c, shared.syntaxErr)
+			return 0, nil, false
+		}
+	}
+	return flags, expire, true
+
+}
+
+// getExpireMillisecondsOrReply converts the expire argument of SET and GETEX
+// to an absolute unix time in milliseconds.
+func getExpireMillisecondsOrReply(c *client, expire *rObj, flags int) (int64, bool) {
+
+	msg := "invalid expire time in '" + c.cmd.name + "' command"
+	v, ok := getLongLongFromObjectOrReply(c, expire, "")
+	if !ok {
+		return 0, false
+	}
+	if v <= 0 {
+		addReplyError(c, msg)
+		return 0, false
+	}
+
+	if flags&(objSetEX|objSetEXAT) != 0 {
+		if v > math.MaxInt64/1000 {
+			addReplyError(c, msg)
+			return 0, false
+		}
+		v *= 1000
+	}
+	if flags&(objSetEX|objSetPX) != 0 {
+		now := mstime()
+		if v > math.MaxInt64-now {
+			addReplyError(c, msg)
+			return 0, false
+		}
+		v += now
+	}
+	return v, true
+
+}
+
+// getGenericCommand replies the string value of argv[1], it returns false
+// if the key holds another type.
+func getGenericCommand(c *client) bool {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.nullBulk)
+	if o == nil {
+		return true
+	}
+	if !checkType(c, o, objectTypeString) {
+		return false
+	}
+	addReplyBulk(c, o.bytes())
+	return true
+
+}
+
+func setGenericCommand(c *client, flags int, key string, val *rObj, expire *rObj, okReply, abortReply []byte) {
+
+	var when int64
+	if expire != nil {
+		var ok bool
+		if when, ok = getExpireMillisecondsOrReply(c, expire, flags); !ok {
+			return
+		}
+	}
+
+	if flags&objSetGet != 0 && !getGenericCommand(c) {
+		return
+	}
+
+	found := lookupKeyWrite(c.db, key) != nil
+	if (flags&objSetNX != 0 && found) || (flags&objSetXX != 0 && !found) {
+		if flags&objSetGet == 0 {
+			if abortReply == nil {
+				abortReply = shared.nullBulk
+			}
+			addReply(c, abortReply)
+		}
+		return
+	}
+
+	setKey(c.db, key, val, flags&objSetKeepTTL != 0)
+	rServer.dirty++
+	if expire != nil {
+		setExpire(c.db, key, when)
+		// propagated with the absolute expire time
+		rewriteClientCommandVector(c, createEmbeddedStringObject("SET"), c.argv[1], val,
+			createEmbeddedStringObject("PXAT"), createStringObjectFromLongLong(when))
+	}
+
+	if flags&objSetGet == 0 {
+		if okReply == nil {
+			okReply = shared.ok
+		}
+		addReply(c, okReply)
+	}
+
+}
+
+// setCommand implements SET key value [NX | XX] [GET] [EX seconds |
+// PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+func setCommand(c *client) {
+
+	flags, expire, ok := parseExtendedStringArguments(c, commandSet)
+	if !ok {
+		return
+	}
+	setGenericCommand(c, flags, c.argv[1].String(), tryObjectEncoding(c.argv[2]), expire, nil, nil)
+
+}
+
+func setnxCommand(c *client) {
+	setGenericCommand(c, objSetNX, c.argv[1].String(), tryObjectEncoding(c.argv[2]), nil, shared.cone, shared.czero)
+}
+
+func setexCommand(c *client) {
+	setGenericCommand(c, objSetEX, c.argv[1].String(), tryObjectEncoding(c.argv[3]), c.argv[2], nil, nil)
+}
+
+func psetexCommand(c *client) {
+	setGenericCommand(c, objSetPX, c.argv[1].String(), tryObjectEncoding(c.argv[3]), c.argv[2], nil, nil)
+}
+
+func getCommand(c *client) {
+	getGenericCommand(c)
+}
+
+// getexCommand implements GETEX key [EX seconds | PX milliseconds |
+// EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
+func getexCommand(c *client) {
+
+	flags, expire, ok := parseExtendedStringArguments(c, commandGetEx)
+	if !ok {
+		return
+	}
+
+	key := c.argv[1].String()
+	o := lookupKeyReadOrReply(c, key, shared.nullBulk)
+	if o == nil || !checkType(c, o, objectTypeString) {
+		return
+	}
+
+	var when int64
+	if expire != nil {
+		if when, ok = getExpireMillisecondsOrReply(c, expire, flags); !ok {
+			return
+		}
+	}
+
+	addReplyBulk(c, o.bytes())
+
+	// propagated as the command that has the same effect
+	switch {
+	case expire != nil && when <= mstime():
+		dbDelete(c.db, key)
+		rServer.dirty++
+		rewriteClientCommandVector(c, createEmbeddedStringObject("DEL"), c.argv[1])
+	case expire != nil:
+		setExpire(c.db, key, when)
+		rServer.dirty++
+		rewriteClientCommandVector(c, createEmbeddedStringObject("PEXPIREAT"), c.argv[1],
+			createStringObjectFromLongLong(when))
+	case flags&objSetPersist != 0:
+		if removeExpire(c.db, key) {
+			rServer.dirty++
+			rewriteClientCommandVector(c, createEmbeddedStringObject("PERSIST"), c.argv[1])
+		}
+	}
+
+}
+
+func getdelCommand(c *client) {
+
+	key := c.argv[1].String()
+	if !getGenericCommand(c) {
+		return
+	}
+	if dbDelete(c.db, key) {
+		rServer.dirty++
+		rewriteClientCommandVector(c, createEmbeddedStringObject("DEL"), c.argv[1])
+	}
+
+}
+
+func getsetCommand(c *client) {
+
+	if !getGenericCommand(c) {
+		return
+	}
+	setKey(c.db, c.argv[1].String(), tryObjectEncoding(c.argv[2]), false)
+	rServer.dirty++
+
+}
+
+func mgetCommand(c *client) {
+
+	addReplyArrayLen(c, c.argc-1)
+	for j := 1; j < c.argc; j++ {
+		o := lookupKeyRead(c.db, c.argv[j].String())
+		if o == nil || o.objectType != objectTypeString {
+			addReplyNull(c)
+			continue
+		}
+		addReplyBulk(c, o.bytes())
+	}
+
+}
+
+func msetGenericCommand(c *client, nx bool) {
+
+	if c.argc%2 == 0 {
+		addReplyErrorFormat(c, "wrong number of arguments for '%s' command", c.cmd.name)
+		return
+	}
+
+	// MSETNX sets nothing if a single key already exists
+	if nx {
+		for j := 1; j < c.argc; j += 2 {
+			if lookupKeyWrite(c.db, c.argv[j].String()) != nil {
+				addReply(c, shared.czero)
+				return
+			}
+		}
+	}
+
+	for j := 1; j < c.argc; j += 2 {
+		setKey(c.db, c.argv[j].String(), tryObjectEncoding(c.argv[j+1]), false)
+	}
+	rServer.dirty += int64(c.argc-1) / 2
+
+	if nx {
+		addReply(c, shared.cone)
+	} else {
+		addReply(c, shared.ok)
+	}
+
+}
+
+func msetCommand(c *client) {
+	msetGenericCommand(c, false)
+}
+
+func msetnxCommand(c *client) {
+	msetGenericCommand(c, true)
+}
+
+// dbUnshareStringValue makes sure the string at key is raw encoded, so it
+// can be modified in place.
+func dbUnshareStringValue(db *redisDb, key string, o *rObj) *rObj {
+	if o.encoding == objectEncodingRaw {
+		return o
+	}
+	o = dupStringObject(o)
+	dbOverwrite(db, key, o)
+	return o
+}
+
+func appendCommand(c *client) {
+
+	key := c.argv[1].String()
+	o := lookupKeyWrite(c.db, key)
+
+	var totalLen int
+	if o == nil {
+		o = tryObjectEncoding(dupStringObject(c.argv[2]))
+		dbAdd(c.db, key, o)
+		totalLen = stringObjectLen(o)
+	} else {
+		if !checkType(c, o, objectTypeString) {
+			return
+		}
+		appendLen := stringObjectLen(c.argv[2])
+		if !checkStringLength(c, int64(stringObjectLen(o)+appendLen)) {
+			return
+		}
+		o = dbUnshareStringValue(c.db, key, o)
+		o.data = append(o.data.([]byte), c.argv[2].bytes()...)
+		totalLen = len(o.data.([]byte))
+	}
+
+	rServer.dirty++
+	addReplyLongLong(c, int64(totalLen))
+
+}
+
+func strlenCommand(c *client) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeString) {
+		return
+	}
+	addReplyLongLong(c, int64(stringObjectLen(o)))
+
+}
+
+func getrangeCommand(c *client) {
+
+	start, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+	end, ok := getLongLongFromObjectOrReply(c, c.argv[3], "")
+	if !ok {
+		return
+	}
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.emptyBulk)
+	if o == nil || !checkType(c, o, objectTypeString) {
+		return
+	}
+
+	if start < 0 && end < 0 && start > end {
+		addReply(c, shared.emptyBulk)
+		return
+	}
+
+	str := o.bytes()
+	strlen := int64(len(str))
+	if start < 0 {
+		start = max(strlen+start, 0)
+	}
+	if end < 0 {
+		end = max(strlen+end, 0)
+	}
+	if end >= strlen {
+		end = strlen - 1
+	}
+
+	if start > end || strlen == 0 {
+		addReply(c, shared.emptyBulk)
+		return
+	}
+	addReplyBulk(c, str[start:end+1])
+
+}
+
+func setrangeCommand(c *client) {
+
+	offset, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+	if offset < 0 {
+		addReplyError(c, "offset is out of range")
+		return
+	}
+
+	key := c.argv[1].String()
+	value := c.argv[3].bytes()
+	o := lookupKeyWrite(c.db, key)
+
+	if o == nil {
+		// an empty value leaves the key missing
+		if len(value) == 0 {
+			addReply(c, shared.czero)
+			return
+		}
+		if !checkStringLength(c, offset+int64(len(value))) {
+			return
+		}
+		o = createStringObject(make([]byte, 0, offset+int64(len(value))))
+		dbAdd(c.db, key, o)
+	} else {
+		if !checkType(c, o, objectTypeString) {
+			return
+		}
+		olen := int64(stringObjectLen(o))
+		if len(value) == 0 {
+			addReplyLongLong(c, olen)
+			return
+		}
+		if !checkStringLength(c, offset+int64(len(value))) {
+			return
+		}
+		o = dbUnshareStringValue(c.db, key, o)
+	}
+
+	buf := o.data.([]byte)
+	if need := int(offset) + len(value); need > len(buf) {
+		buf = append(buf, make([]byte, need-len(buf))...)
+	}
+	copy(buf[offset:], value)
+	o.data = buf
+
+	rServer.dirty++
+	addReplyLongLong(c, int64(len(buf)))
+
+}
+
+func incrDecrCommand(c *client, incr int64) {
+
+	key := c.argv[1].String()
+	o := lookupKeyWrite(c.db, key)
+	if o != nil && !checkType(c, o, objectTypeString) {
+		return
+	}
+
+	value, ok := getLongLongFromObjectOrReply(c, o, "")
+	if !ok {
+		return
+	}
+
+	if (incr < 0 && value < 0 && incr < math.MinInt64-value) ||
+		(incr > 0 && value > 0 && incr > math.MaxInt64-value) {
+		addReplyError(c, "increment or decrement would overflow")
+		return
+	}
+	value += incr
+
+	n := createStringObjectFromLongLong(value)
+	if o == nil {
+		dbAdd(c.db, key, n)
+	} else {
+		dbOverwrite(c.db, key, n)
+	}
+	rServer.dirty++
+	addReplyLongLong(c, value)
+
+}
+
+func incrCommand(c *client) {
+	incrDecrCommand(c, 1)
+}
+
+func decrCommand(c *client) {
+	incrDecrCommand(c, -1)
+}
+
+func incrbyCommand(c *client) {
+
+	incr, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+	incrDecrCommand(c, incr)
+
+}
+
+func decrbyCommand(c *client) {
+
+	incr, ok := getLongLongFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+	if incr == math.MinInt64 {
+		addReplyError(c, "decrement would overflow")
+		return
+	}
+	incrDecrCommand(c, -incr)
+
+}
+
+func incrbyfloatCommand(c *client) {
+
+	key := c.argv[1].String()
+	o := lookupKeyWrite(c.db, key)
+	if o != nil && !checkType(c, o, objectTypeString) {
+		return
+	}
+
+	value, ok := getLongDoubleFromObjectOrReply(c, o, "")
+	if !ok {
+		return
+	}
+	incr, ok := getLongDoubleFromObjectOrReply(c, c.argv[2], "")
+	if !ok {
+		return
+	}
+
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		addReplyError(c, "increment would produce NaN or Infinity")
+		return
+	}
+
+	n := createStringObjectFromLongDouble(value)
+	if o == nil {
+		dbAdd(c.db, key, n)
+	} else {
+		dbOverwrite(c.db, key, n)
+	}
+	rServer.dirty++
+	addReplyBulk(c, n.bytes())
+
+	// the float printed may differ from one run to another, the result is
+	// propagated as it is
+	rewriteClientCommandVector(c, createEmbeddedStringObject("SET"), c.argv[1], n,
+		createEmbeddedStringObject("KEEPTTL"))
+
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestString_SetGet(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "9")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(nil, "get", "foo")
+	tc.expect(testStatus("OK"), "set", "foo", "bar")
+	tc.expect("bar", "get", "foo")
+
+	tc.expect(nil, "set", "foo", "baz", "nx")
+	tc.expect(nil, "set", "nokey", "baz", "xx")
+	tc.expect(int64(0), "exists", "nokey")
+	tc.expect(testStatus("OK"), "set", "foo", "baz", "xx")
+	tc.expect("baz", "set", "foo", "qux", "get")
+	tc.expect(nil, "set", "newkey", "v", "nx", "get")
+	tc.expect("v", "get", "newkey")
+
+	tc.expect(testError("ERR syntax error"), "set", "foo", "bar", "nx", "xx")
+	tc.expect(testError("ERR syntax error"), "set", "foo", "bar", "ex", "10", "px", "100")
+	tc.expect(testError("ERR syntax error"), "set", "foo", "bar", "ex")
+	tc.expect(testError("ERR invalid expire time in 'set' command"), "set", "foo", "bar", "ex", "0")
+	tc.expect(testError("ERR value is not an integer or out of range"), "set", "foo", "bar", "ex", "ten")
+
+	tc.expect(int64(1), "setnx", "nx1", "a")
+	tc.expect(int64(0), "setnx", "nx1", "b")
+	tc.expect(int64(2), "del", "nx1", "newkey", "nokey")
+
+	tc.expect(testStatus("OK"), "mset", "a", "1", "b", "2")
+	tc.expect([]any{"1", "2", nil}, "mget", "a", "b", "c")
+	tc.expect(int64(0), "msetnx", "c", "3", "a", "x")
+	tc.expect(nil, "get", "c")
+	tc.expect(int64(1), "msetnx", "c", "3", "d", "4")
+	tc.expect(testError("ERR wrong number of arguments for 'mset' command"), "mset", "a", "1", "b")
+
+	tc.expect("2", "getdel", "b")
+	tc.expect(int64(0), "exists", "b")
+	tc.expect(testStatus("string"), "type", "a")
+	tc.expect(testStatus("none"), "type", "b")
+}
+
+func TestString_Expire(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "9")
+
+	tc.expect(testStatus("OK"), "set", "ex", "v", "px", "50")
+	tc.expect("v", "get", "ex")
+	time.Sleep(time.Millisecond * 100)
+	tc.expect(nil, "get", "ex")
+
+	tc.expect(testStatus("OK"), "set", "ex", "v", "pxat", strconv.FormatInt(mstime()-1000, 10))
+	tc.expect(nil, "get", "ex")
+
+	// KEEPTTL keeps the expire of the old value, a plain SET drops it
+	tc.expect(testStatus("OK"), "set", "ttl", "v", "px", "50")
+	tc.expect(testStatus("OK"), "set", "ttl", "v2", "keepttl")
+	time.Sleep(time.Millisecond * 100)
+	tc.expect(nil, "get", "ttl")
+	tc.expect(testStatus("OK"), "set", "ttl", "v", "px", "50")
+	tc.expect(testStatus("OK"), "set", "ttl", "v2")
+	time.Sleep(time.Millisecond * 100)
+	tc.expect("v2", "get", "ttl")
+
+	tc.expect("v2", "getex", "ttl", "px", "50")
+	time.Sleep(time.Millisecond * 100)
+	tc.expect(nil, "getex", "ttl")
+
+	tc.expect(testStatus("OK"), "setex", "ttl", "100", "v")
+	tc.expect("v", "getex", "ttl", "persist")
+	tc.expect(testError("ERR syntax error"), "getex", "ttl", "keepttl")
+	tc.expect(testError("ERR invalid expire time in 'psetex' command"), "psetex", "ttl", "-1", "v")
+}
+
+func TestString_Encoding(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "9")
+
+	long := strings.Repeat("x", objectEncodingEmbeddingSizeLimit+1)
+	for _, tt := range []struct {
+		value, encoding string
+	}{
+		{"12345", "int"},
+		{"-9223372036854775808", "int"},
+		{"9223372036854775808", "embstr"},
+		{"012", "embstr"},
+		{"hello", "embstr"},
+		{long, "raw"},
+	} {
+		tc.expect(testStatus("OK"), "set", "enc", tt.value)
+		tc.expect(tt.encoding, "object", "encoding", "enc")
+		tc.expect(tt.value, "get", "enc")
+		tc.expect(int64(len(tt.value)), "strlen", "enc")
+	}
+
+	// modifying the value in place converts it to raw
+	tc.expect(testStatus("OK"), "set", "enc", "12")
+	tc.expect(int64(3), "append", "enc", "3")
+	tc.expect("raw", "object", "encoding", "enc")
+	tc.expect(int64(124), "incr", "enc")
+	tc.expect("int", "object", "encoding", "enc")
+	tc.expect(nil, "object", "encoding", "nokey")
+}
+
+func TestString_Ranges(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "9")
+	tc.do("del", "r")
+
+	tc.expect(int64(0), "setrange", "r", "5", "")
+	tc.expect(int64(0), "exists", "r")
+	tc.expect(int64(8), "setrange", "r", "3", "hello")
+	tc.expect("\x00\x00\x00hello", "get", "r")
+	tc.expect(int64(8), "setrange", "r", "0", "abc")
+	tc.expect(int64(8), "setrange", "r", "0", "")
+	tc.expect(testError("ERR offset is out of range"), "setrange", "r", "-1", "x")
+
+	tc.expect(int64(11), "append", "r", "!!!")
+	tc.expect("abchello!!!", "get", "r")
+	tc.expect("abc", "getrange", "r", "0", "2")
+	tc.expect("!!!", "getrange", "r", "-3", "-1")
+	tc.expect("abchello!!!", "getrange", "r", "0", "100")
+	tc.expect("", "getrange", "r", "5", "2")
+	tc.expect("", "getrange", "r", "-1", "-5")
+	tc.expect("", "getrange", "nokey", "0", "-1")
+	tc.expect(int64(0), "strlen", "nokey")
+}
+
+func TestString_Incr(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "9")
+	tc.expect(testStatus("OK"), "flushdb")
+
+	tc.expect(int64(1), "incr", "n")
+	tc.expect(int64(11), "incrby", "n", "10")
+	tc.expect(int64(10), "decr", "n")
+	tc.expect(int64(-5), "decrby", "n", "15")
+	tc.expect(testStatus("OK"), "set", "n", "9223372036854775807")
+	tc.expect(testError("ERR increment or decrement would overflow"), "incr", "n")
+	tc.expect(testStatus("OK"), "set", "n", " 1")
+	tc.expect(testError("ERR value is not an integer or out of range"), "incr", "n")
+
+	tc.expect("10.5", "incrbyfloat", "f", "10.5")
+	tc.expect("10.6", "incrbyfloat", "f", "0.1")
+	tc.expect("5", "incrbyfloat", "f", "-5.6")
+	tc.expect("int", "object", "encoding", "f")
+	tc.expect("5000", "incrbyfloat", "f", "4.995e3")
+	tc.expect(testError("ERR value is not a valid float"), "incrbyfloat", "f", "abc")
+	tc.expect(testError("ERR increment would produce NaN or Infinity"), "incrbyfloat", "f", "inf")
+
+	tc.expect(testStatus("OK"), "set", "s", "abc")
+	tc.expect(testError("ERR value is not a valid float"), "incrbyfloat", "s", "1")
+}
@@ -0,0 +1,2442 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A sorted set starts listpack encoded, every member followed by its score,
+// ordered by score and then by member, and is converted to a skiplist plus a
+// dict of member -> score once it has more than zset-max-listpack-entries
+// members or a member longer than zset-max-listpack-value bytes. A sorted
+// set never converts back.
+
+const (
+	zskiplistMaxLevel = 32
+	zskiplistP        = 0.25
+)
+
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span    int // number of nodes skipped by forward
+}
+
+type zskiplistNode struct {
+	ele      string
+	score    float64
+	backward *zskiplistNode
+	level    []zskiplistLevel
+}
+
+type zskiplist struct {
+	header, tail *zskiplistNode
+	length       int
+	level        int
+}
+
+// zset is the skiplist encoding: the skiplist orders the members and the dict
+// finds their scores in constant time.
+type zset struct {
+	dict *dict
+	zsl  *zskiplist
+}
+
+// approximate memory of a skiplist node besides its member
+const zskiplistNodeOverhead = 80
+
+func zslCreateNode(level int, score float64, ele string) *zskiplistNode {
+	return &zskiplistNode{ele: ele, score: score, level: make([]zskiplistLevel, level)}
+}
+
+func zslCreate() *zskiplist {
+	return &zskiplist{header: zslCreateNode(zskiplistMaxLevel, 0, ""), level: 1}
+}
+
+// zslRandomLevel returns a level for a new node, with a powerlaw-alike
+// distribution where higher levels are less likely.
+func zslRandomLevel() int {
+	level := 1
+	for float64(rand.Uint32()&0xFFFF) < zskiplistP*0xFFFF && level < zskiplistMaxLevel {
+		level++
+	}
+	return level
+}
+
+// zslLess reports whether the node x sorts before score and ele.
+func zslLess(x *zskiplistNode, score float64, ele string) bool {
+	return x.score < score || (x.score == score && x.ele < ele)
+}
+
+// zslInsert inserts a member that must not be in the skiplist.
+func zslInsert(zsl *zskiplist, score float64, ele string) *zskiplistNode {
+
+	var update [zskiplistMaxLevel]*zskiplistNode
+	var rank [zskiplistMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		// rank of the node reached at each level
+		if i != zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zslLess(x.level[i].forward, score, ele) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = zslCreateNode(level, score, ele)
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	// the levels above the new node span it too
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+
+}
+
+// zslDeleteNode unlinks x, update holding the nodes preceding it at every
+// level.
+func zslDeleteNode(zsl *zskiplist, x *zskiplistNode, update []*zskiplistNode) {
+
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+
+}
+
+// zslDelete removes the node with the given score and member, it returns
+// false if it was not found.
+func zslDelete(zsl *zskiplist, score float64, ele string) bool {
+
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslLess(x.level[i].forward, score, ele) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x != nil && x.score == score && x.ele == ele {
+		zslDeleteNode(zsl, x, update)
+		return true
+	}
+	return false
+
+}
+
+// zslUpdateScore changes the score of a member, reusing its node when it
+// stays at the same position.
+func zslUpdateScore(zsl *zskiplist, curscore float64, ele string, newscore float64) *zskiplistNode {
+
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslLess(x.level[i].forward, curscore, ele) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != curscore || x.ele != ele {
+		panic("zslUpdateScore: member not found")
+	}
+
+	if (x.backward == nil || x.backward.score < newscore) &&
+		(x.level[0].forward == nil || x.level[0].forward.score > newscore) {
+		x.score = newscore
+		return x
+	}
+
+	zslDeleteNode(zsl, x, update)
+	return zslInsert(zsl, newscore, ele)
+
+}
+
+// zslGetRank returns the 1-based rank of the member, 0 when not found.
+func zslGetRank(zsl *zskiplist, score float64, ele string) int {
+
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(zslLess(x.level[i].forward, score, ele) || (x.level[i].forward.score == score && x.level[i].forward.ele == ele)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.score == score && x.ele == ele {
+			return rank
+		}
+	}
+	return 0
+
+}
+
+// zslGetElementByRank returns the node at the 1-based rank, or nil.
+func zslGetElementByRank(zsl *zskiplist, rank int) *zskiplistNode {
+
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+
+}
+
+// zrangespec is a range of scores, each bound being inclusive unless
+// flagged exclusive.
+type zrangespec struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func zslValueGteMin(value float64, spec *zrangespec) bool {
+	if spec.minex {
+		return value > spec.min
+	}
+	return value >= spec.min
+}
+
+func zslValueLteMax(value float64, spec *zrangespec) bool {
+	if spec.maxex {
+		return value < spec.max
+	}
+	return value <= spec.max
+}
+
+func zslRangeIsEmpty(spec *zrangespec) bool {
+	return spec.min > spec.max || (spec.min == spec.max && (spec.minex || spec.maxex))
+}
+
+// zslIsInRange reports whether part of the skiplist is in the range.
+func zslIsInRange(zsl *zskiplist, spec *zrangespec) bool {
+
+	if zslRangeIsEmpty(spec) {
+		return false
+	}
+	if zsl.tail == nil || !zslValueGteMin(zsl.tail.score, spec) {
+		return false
+	}
+	x := zsl.header.level[0].forward
+	return x != nil && zslValueLteMax(x.score, spec)
+
+}
+
+// zslFirstInRange returns the first node in the range, or nil.
+func zslFirstInRange(zsl *zskiplist, spec *zrangespec) *zskiplistNode {
+
+	if !zslIsInRange(zsl, spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslValueGteMin(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+	}
+	// the range is not empty, so the next node exists
+	x = x.level[0].forward
+	if !zslValueLteMax(x.score, spec) {
+		return nil
+	}
+	return x
+
+}
+
+// zslLastInRange returns the last node in the range, or nil.
+func zslLastInRange(zsl *zskiplist, spec *zrangespec) *zskiplistNode {
+
+	if !zslIsInRange(zsl, spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslValueLteMax(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !zslValueGteMin(x.score, spec) {
+		return nil
+	}
+	return x
+
+}
+
+// zslDeleteRangeByScore removes the nodes in the range from the skiplist and
+// dict, it returns the number of removed members.
+func zslDeleteRangeByScore(zsl *zskiplist, spec *zrangespec, d *dict) int {
+
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslValueGteMin(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	removed := 0
+	x = x.level[0].forward
+	for x != nil && zslValueLteMax(x.score, spec) {
+		next := x.level[0].forward
+		zslDeleteNode(zsl, x, update)
+		d.delete(x.ele)
+		removed++
+		x = next
+	}
+	return removed
+
+}
+
+// zslDeleteRangeByLex removes the nodes in the range from the skiplist and
+// dict, it returns the number of removed members.
+func zslDeleteRangeByLex(zsl *zskiplist, spec *zlexrangespec, d *dict) int {
+
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslLexValueGteMin(x.level[i].forward.ele, spec) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	removed := 0
+	x = x.level[0].forward
+	for x != nil && zslLexValueLteMax(x.ele, spec) {
+		next := x.level[0].forward
+		zslDeleteNode(zsl, x, update)
+		d.delete(x.ele)
+		removed++
+		x = next
+	}
+	return removed
+
+}
+
+// zslDeleteRangeByRank removes the nodes between the 1-based ranks start and
+// end, both inclusive, it returns the number of removed members.
+func zslDeleteRangeByRank(zsl *zskiplist, start, end int, d *dict) int {
+
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span < start {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	removed := 0
+	traversed++
+	x = x.level[0].forward
+	for x != nil && traversed <= end {
+		next := x.level[0].forward
+		zslDeleteNode(zsl, x, update)
+		d.delete(x.ele)
+		removed++
+		traversed++
+		x = next
+	}
+	return removed
+
+}
+
+// zlexBound is a bound of a range of members, "-" and "+" being the
+// infinite bounds, stored as inf -1 and 1.
+type zlexBound struct {
+	s   string
+	inf int
+}
+
+// zlexrangespec is a range of members, each bound being inclusive unless
+// flagged exclusive.
+type zlexrangespec struct {
+	min, max     zlexBound
+	minex, maxex bool
+}
+
+// zslLexCompare compares value to the bound b.
+func zslLexCompare(value string, b zlexBound) int {
+	if b.inf != 0 {
+		return -b.inf
+	}
+	return strings.Compare(value, b.s)
+}
+
+// zslLexCompareBounds compares two bounds.
+func zslLexCompareBounds(a, b zlexBound) int {
+	switch {
+	case a.inf == b.inf && a.inf != 0:
+		return 0
+	case a.inf != 0:
+		return a.inf
+	}
+	return zslLexCompare(a.s, b)
+}
+
+func zslLexValueGteMin(value string, spec *zlexrangespec) bool {
+	if spec.minex {
+		return zslLexCompare(value, spec.min) > 0
+	}
+	return zslLexCompare(value, spec.min) >= 0
+}
+
+func zslLexValueLteMax(value string, spec *zlexrangespec) bool {
+	if spec.maxex {
+		return zslLexCompare(value, spec.max) < 0
+	}
+	return zslLexCompare(value, spec.max) <= 0
+}
+
+func zslLexRangeIsEmpty(spec *zlexrangespec) bool {
+	cmp := zslLexCompareBounds(spec.min, spec.max)
+	return cmp > 0 || (cmp == 0 && (spec.minex || spec.maxex))
+}
+
+// zslParseLexRangeItem parses "-", "+", "(member" or "[member".
+func zslParseLexRangeItem(item string) (zlexBound, bool, bool) {
+
+	if item == "" {
+		return zlexBound{}, false, false
+	}
+	switch item[0] {
+	case '+':
+		if len(item) != 1 {
+			return zlexBound{}, false, false
+		}
+		return zlexBound{inf: 1}, false, true
+	case '-':
+		if len(item) != 1 {
+			return zlexBound{}, false, false
+		}
+		return zlexBound{inf: -1}, false, true
+	case '(':
+		return zlexBound{s: item[1:]}, true, true
+	case '[':
+		return zlexBound{s: item[1:]}, false, true
+	}
+	return zlexBound{}, false, false
+
+}
+
+func zslParseLexRange(min, max *rObj) (zlexrangespec, bool) {
+
+	var spec zlexrangespec
+	var ok bool
+	if spec.min, spec.minex, ok = zslParseLexRangeItem(min.String()); !ok {
+		return spec, false
+	}
+	if spec.max, spec.maxex, ok = zslParseLexRangeItem(max.String()); !ok {
+		return spec, false
+	}
+	return spec, true
+
+}
+
+// zslParseRangeItem parses a score, exclusive when prefixed by "(".
+func zslParseRangeItem(item string) (float64, bool, bool) {
+
+	ex := false
+	if strings.HasPrefix(item, "(") {
+		ex = true
+		item = item[1:]
+	}
+	v, ok := string2ld([]byte(item))
+	return v, ex, ok
+
+}
+
+func zslParseRange(min, max *rObj) (zrangespec, bool) {
+
+	var spec zrangespec
+	var ok bool
+	if spec.min, spec.minex, ok = zslParseRangeItem(min.String()); !ok {
+		return spec, false
+	}
+	if spec.max, spec.maxex, ok = zslParseRangeItem(max.String()); !ok {
+		return spec, false
+	}
+	return spec, true
+
+}
+
+func zslIsInLexRange(zsl *zskiplist, spec *zlexrangespec) bool {
+
+	if zslLexRangeIsEmpty(spec) {
+		return false
+	}
+	if zsl.tail == nil || !zslLexValueGteMin(zsl.tail.ele, spec) {
+		return false
+	}
+	x := zsl.header.level[0].forward
+	return x != nil && zslLexValueLteMax(x.ele, spec)
+
+}
+
+func zslFirstInLexRange(zsl *zskiplist, spec *zlexrangespec) *zskiplistNode {
+
+	if !zslIsInLexRange(zsl, spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslLexValueGteMin(x.level[i].forward.ele, spec) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if !zslLexValueLteMax(x.ele, spec) {
+		return nil
+	}
+	return x
+
+}
+
+func zslLastInLexRange(zsl *zskiplist, spec *zlexrangespec) *zskiplistNode {
+
+	if !zslIsInLexRange(zsl, spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslLexValueLteMax(x.level[i].forward.ele, spec) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !zslLexValueGteMin(x.ele, spec) {
+		return nil
+	}
+	return x
+
+}
+
+// The listpack encoding. Positions of members are named eptr and positions
+// of scores sptr, a missing element being -1.
+
+func zzlGetScore(lp []byte, sptr int) float64 {
+	str, v := lpGet(lp, sptr)
+	if str == nil {
+		return float64(v)
+	}
+	score, _ := strconv.ParseFloat(string(str), 64)
+	return score
+}
+
+func zzlLength(lp []byte) int {
+	return lpLength(lp) / 2
+}
+
+// zzlNext returns the member and score following the member at eptr.
+func zzlNext(lp []byte, eptr int) (int, int) {
+	eptr = lpNext(lp, lpNext(lp, eptr))
+	if eptr == -1 {
+		return -1, -1
+	}
+	return eptr, lpNext(lp, eptr)
+}
+
+// zzlPrev returns the member and score preceding the member at eptr.
+func zzlPrev(lp []byte, eptr int) (int, int) {
+	sptr := lpPrev(lp, eptr)
+	if sptr == -1 {
+		return -1, -1
+	}
+	return lpPrev(lp, sptr), sptr
+}
+
+func zzlIsInRange(lp []byte, spec *zrangespec) bool {
+
+	if zslRangeIsEmpty(spec) {
+		return false
+	}
+	p := lpLast(lp)
+	if p == -1 || !zslValueGteMin(zzlGetScore(lp, p), spec) {
+		return false
+	}
+	return zslValueLteMax(zzlGetScore(lp, lpNext(lp, lpFirst(lp))), spec)
+
+}
+
+// zzlFirstInRange returns the position of the first member in the range, or
+// -1.
+func zzlFirstInRange(lp []byte, spec *zrangespec) int {
+
+	if !zzlIsInRange(lp, spec) {
+		return -1
+	}
+	for eptr := lpFirst(lp); eptr != -1; eptr = lpNext(lp, lpNext(lp, eptr)) {
+		score := zzlGetScore(lp, lpNext(lp, eptr))
+		if zslValueGteMin(score, spec) {
+			if zslValueLteMax(score, spec) {
+				return eptr
+			}
+			return -1
+		}
+	}
+	return -1
+
+}
+
+// zzlLastInRange returns the position of the last member in the range, or
+// -1.
+func zzlLastInRange(lp []byte, spec *zrangespec) int {
+
+	if !zzlIsInRange(lp, spec) {
+		return -1
+	}
+	for eptr := lpPrev(lp, lpLast(lp)); eptr != -1; eptr, _ = zzlPrev(lp, eptr) {
+		score := zzlGetScore(lp, lpNext(lp, eptr))
+		if zslValueLteMax(score, spec) {
+			if zslValueGteMin(score, spec) {
+				return eptr
+			}
+			return -1
+		}
+	}
+	return -1
+
+}
+
+func zzlIsInLexRange(lp []byte, spec *zlexrangespec) bool {
+
+	if zslLexRangeIsEmpty(spec) {
+		return false
+	}
+	p := lpLast(lp)
+	if p == -1 || !zslLexValueGteMin(lpGetString(lp, lpPrev(lp, p)), spec) {
+		return false
+	}
+	return zslLexValueLteMax(lpGetString(lp, lpFirst(lp)), spec)
+
+}
+
+func zzlFirstInLexRange(lp []byte, spec *zlexrangespec) int {
+
+	if !zzlIsInLexRange(lp, spec) {
+		return -1
+	}
+	for eptr := lpFirst(lp); eptr != -1; eptr = lpNext(lp, lpNext(lp, eptr)) {
+		ele := lpGetString(lp, eptr)
+		if zslLexValueGteMin(ele, spec) {
+			if zslLexValueLteMax(ele, spec) {
+				return eptr
+			}
+			return -1
+		}
+	}
+	return -1
+
+}
+
+func zzlLastInLexRange(lp []byte, spec *zlexrangespec) int {
+
+	if !zzlIsInLexRange(lp, spec) {
+		return -1
+	}
+	for eptr := lpPrev(lp, lpLast(lp)); eptr != -1; eptr, _ = zzlPrev(lp, eptr) {
+		ele := lpGetString(lp, eptr)
+		if zslLexValueLteMax(ele, spec) {
+			if zslLexValueGteMin(ele, spec) {
+				return eptr
+			}
+			return -1
+		}
+	}
+	return -1
+
+}
+
+// zzlFind returns the position of ele and its score, or -1.
+func zzlFind(lp []byte, ele string) (int, float64) {
+	eptr := lpFind(lp, lpFirst(lp), []byte(ele), 1)
+	if eptr == -1 {
+		return -1, 0
+	}
+	return eptr, zzlGetScore(lp, lpNext(lp, eptr))
+}
+
+// zzlDelete removes the member at eptr and its score.
+func zzlDelete(lp []byte, eptr int) []byte {
+	return lpDeleteRangeWithEntry(lp, eptr, 2)
+}
+
+// zzlInsertAt inserts ele and score before the member at eptr, or appends
+// them when eptr is -1.
+func zzlInsertAt(lp []byte, eptr int, ele string, score float64) []byte {
+
+	if eptr == -1 {
+		lp = lpAppend(lp, []byte(ele))
+		return lpAppend(lp, formatDouble(score))
+	}
+	lp, eptr = lpInsert(lp, []byte(ele), eptr, lpInsertBefore)
+	lp, _ = lpInsert(lp, formatDouble(score), eptr, lpInsertAfter)
+	return lp
+
+}
+
+// zzlInsert inserts a member that must not be in the listpack, keeping the
+// order.
+func zzlInsert(lp []byte, ele string, score float64) []byte {
+
+	for eptr := lpFirst(lp); eptr != -1; eptr = lpNext(lp, lpNext(lp, eptr)) {
+		s := zzlGetScore(lp, lpNext(lp, eptr))
+		if s > score || (s == score && lpGetString(lp, eptr) > ele) {
+			return zzlInsertAt(lp, eptr, ele, score)
+		}
+	}
+	return zzlInsertAt(lp, -1, ele, score)
+
+}
+
+func zzlDeleteRangeByScore(lp []byte, spec *zrangespec) ([]byte, int) {
+
+	eptr := zzlFirstInRange(lp, spec)
+	if eptr == -1 {
+		return lp, 0
+	}
+	// the following members move to eptr as they are deleted
+	removed := 0
+	for lp[eptr] != lpEOF && zslValueLteMax(zzlGetScore(lp, lpNext(lp, eptr)), spec) {
+		lp = zzlDelete(lp, eptr)
+		removed++
+	}
+	return lp, removed
+
+}
+
+func zzlDeleteRangeByLex(lp []byte, spec *zlexrangespec) ([]byte, int) {
+
+	eptr := zzlFirstInLexRange(lp, spec)
+	if eptr == -1 {
+		return lp, 0
+	}
+	removed := 0
+	for lp[eptr] != lpEOF && zslLexValueLteMax(lpGetString(lp, eptr), spec) {
+		lp = zzlDelete(lp, eptr)
+		removed++
+	}
+	return lp, removed
+
+}
+
+// zzlDeleteRangeByRank removes the members between the 1-based ranks start
+// and end, both inclusive.
+func zzlDeleteRangeByRank(lp []byte, start, end int) ([]byte, int) {
+	num := end - start + 1
+	return lpDeleteRange(lp, 2*(start-1), 2*num), num
+}
+
+// Sorted set API, common to both encodings.
+
+func zsetLength(o *rObj) int {
+	if o.encoding == objectEncodingListpack {
+		return zzlLength(o.data.([]byte))
+	}
+	return o.data.(*zset).zsl.length
+}
+
+func createZsetObject() *rObj {
+	return &rObj{
+		objectType: objectTypeZSet,
+		encoding:   objectEncodingSkiplist,
+		data:       &zset{dict: newDict(), zsl: zslCreate()},
+	}
+}
+
+func createZsetListpackObject() *rObj {
+	return &rObj{
+		objectType: objectTypeZSet,
+		encoding:   objectEncodingListpack,
+		data:       lpNew(0),
+	}
+}
+
+// zsetTypeCreate returns an empty sorted set suited to hold sizeHint
+// members, the longest being valueLenHint bytes.
+func zsetTypeCreate(sizeHint, valueLenHint int) *rObj {
+
+	if rServer.zsetMaxListpackEntries == 0 || sizeHint > rServer.zsetMaxListpackEntries ||
+		valueLenHint > rServer.zsetMaxListpackValue {
+		o := createZsetObject()
+		o.data.(*zset).dict.expand(sizeHint)
+		return o
+	}
+	return createZsetListpackObject()
+
+}
+
+// zsetTypeMaybeConvert converts a listpack encoded sorted set about to
+// receive sizeHint members when they are too many.
+func zsetTypeMaybeConvert(o *rObj, sizeHint int) {
+	if o.encoding == objectEncodingListpack && sizeHint > rServer.zsetMaxListpackEntries {
+		zsetConvert(o, objectEncodingSkiplist)
+	}
+}
+
+func zsetConvert(o *rObj, encoding uint8) {
+
+	if o.encoding == encoding {
+		return
+	}
+	if o.encoding != objectEncodingListpack || encoding != objectEncodingSkiplist {
+		panic("zsetConvert: unknown sorted set encoding")
+	}
+
+	lp := o.data.([]byte)
+	zs := &zset{dict: newDict(), zsl: zslCreate()}
+	zs.dict.expand(zzlLength(lp))
+	for eptr := lpFirst(lp); eptr != -1; eptr = lpNext(lp, lpNext(lp, eptr)) {
+		ele := lpGetString(lp, eptr)
+		score := zzlGetScore(lp, lpNext(lp, eptr))
+		zslInsert(zs.zsl, score, ele)
+		zs.dict.add(ele, score)
+	}
+	o.encoding, o.data = objectEncodingSkiplist, zs
+
+}
+
+// zsetScore returns the score of ele.
+func zsetScore(o *rObj, ele string) (float64, bool) {
+
+	if o.encoding == objectEncodingListpack {
+		eptr, score := zzlFind(o.data.([]byte), ele)
+		return score, eptr != -1
+	}
+	val, ok := o.data.(*zset).dict.fetchValue(ele)
+	if !ok {
+		return 0, false
+	}
+	return val.(float64), true
+
+}
+
+// zsetAdd input flags
+const (
+	zaddInIncr = 1 << iota // increment the score instead of setting it
+	zaddInNX               // only add new members
+	zaddInXX               // only update existing members
+	zaddInGT               // only update when the score increases
+	zaddInLT               // only update when the score decreases
+)
+
+// zsetAdd output flags
+const (
+	zaddOutNop     = 1 << iota // nothing done because of the conditions
+	zaddOutNaN                 // the resulting score is not a number
+	zaddOutAdded               // the member was added
+	zaddOutUpdated             // the score of the member was updated
+)
+
+// zsetAdd adds ele with score or updates its score as the input flags say.
+// It returns the output flags and the score of ele after the operation.
+func zsetAdd(o *rObj, score float64, ele string, inFlags int) (int, float64) {
+
+	incr := inFlags&zaddInIncr != 0
+	nx := inFlags&zaddInNX != 0
+	xx := inFlags&zaddInXX != 0
+	gt := inFlags&zaddInGT != 0
+	lt := inFlags&zaddInLT != 0
+
+	if math.IsNaN(score) {
+		return zaddOutNaN, 0
+	}
+
+	// update checks the conditions on an existing member, returning the
+	// output flags when the update is not possible
+	update := func(curscore float64) (int, float64, bool) {
+		if nx {
+			return zaddOutNop, curscore, false
+		}
+		if incr {
+			score += curscore
+			if math.IsNaN(score) {
+				return zaddOutNaN, 0, false
+			}
+		}
+		if (lt && score >= curscore) || (gt && score <= curscore) {
+			return zaddOutNop, curscore, false
+		}
+		return 0, score, true
+	}
+
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		if eptr, curscore := zzlFind(lp, ele); eptr != -1 {
+			flags, newscore, ok := update(curscore)
+			if !ok {
+				return flags, newscore
+			}
+			if score != curscore {
+				lp = zzlDelete(lp, eptr)
+				o.data = zzlInsert(lp, ele, score)
+				return zaddOutUpdated, score
+			}
+			return 0, score
+		}
+		if xx {
+			return zaddOutNop, 0
+		}
+		if zzlLength(lp)+1 <= rServer.zsetMaxListpackEntries && len(ele) <= rServer.zsetMaxListpackValue {
+			o.data = zzlInsert(lp, ele, score)
+			return zaddOutAdded, score
+		}
+		zsetConvert(o, objectEncodingSkiplist)
+	}
+
+	zs := o.data.(*zset)
+	if de := zs.dict.find(ele); de != nil {
+		curscore := de.val.(float64)
+		flags, newscore, ok := update(curscore)
+		if !ok {
+			return flags, newscore
+		}
+		if score != curscore {
+			zslUpdateScore(zs.zsl, curscore, ele, score)
+			de.val = score
+			return zaddOutUpdated, score
+		}
+		return 0, score
+	}
+	if xx {
+		return zaddOutNop, 0
+	}
+	zslInsert(zs.zsl, score, ele)
+	zs.dict.add(ele, score)
+	return zaddOutAdded, score
+
+}
+
+// zsetDel removes ele, it returns false if it was not a member.
+func zsetDel(o *rObj, ele string) bool {
+
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		eptr, _ := zzlFind(lp, ele)
+		if eptr == -1 {
+			return false
+		}
+		o.data = zzlDelete(lp, eptr)
+		return true
+	}
+
+	zs := o.data.(*zset)
+	de := zs.dict.delete(ele)
+	if de == nil {
+		return false
+	}
+	zslDelete(zs.zsl, de.val.(float64), ele)
+	if zs.dict.needsResize() {
+		zs.dict.resize()
+	}
+	return true
+
+}
+
+// zsetRank returns the 0-based rank of ele and its score, ranking from the
+// highest score when reverse is set.
+func zsetRank(o *rObj, ele string, reverse bool) (int, float64, bool) {
+
+	length := zsetLength(o)
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		rank := 0
+		for eptr := lpFirst(lp); eptr != -1; eptr = lpNext(lp, lpNext(lp, eptr)) {
+			if lpCompare(lp, eptr, []byte(ele)) {
+				score := zzlGetScore(lp, lpNext(lp, eptr))
+				if reverse {
+					return length - rank - 1, score, true
+				}
+				return rank, score, true
+			}
+			rank++
+		}
+		return 0, 0, false
+	}
+
+	zs := o.data.(*zset)
+	val, ok := zs.dict.fetchValue(ele)
+	if !ok {
+		return 0, 0, false
+	}
+	score := val.(float64)
+	rank := zslGetRank(zs.zsl, score, ele)
+	if reverse {
+		return length - rank, score, true
+	}
+	return rank - 1, score, true
+
+}
+
+// zsetForEach calls fn for every member and score of a sorted set, in order.
+func zsetForEach(o *rObj, fn func(ele string, score float64)) {
+
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		for eptr := lpFirst(lp); eptr != -1; eptr = lpNext(lp, lpNext(lp, eptr)) {
+			fn(lpGetString(lp, eptr), zzlGetScore(lp, lpNext(lp, eptr)))
+		}
+		return
+	}
+	for x := o.data.(*zset).zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		fn(x.ele, x.score)
+	}
+
+}
+
+// zsetDup returns a copy of the sorted set o.
+func zsetDup(o *rObj) *rObj {
+
+	if o.encoding == objectEncodingListpack {
+		return &rObj{objectType: objectTypeZSet, encoding: objectEncodingListpack, data: append([]byte(nil), o.data.([]byte)...)}
+	}
+	zs := o.data.(*zset)
+	copyzs := &zset{dict: newDict(), zsl: zslCreate()}
+	copyzs.dict.expand(zs.zsl.length)
+	// from the tail, every insertion happens at the head
+	for x := zs.zsl.tail; x != nil; x = x.backward {
+		zslInsert(copyzs.zsl, x.score, x.ele)
+		copyzs.dict.add(x.ele, x.score)
+	}
+	return &rObj{objectType: objectTypeZSet, encoding: objectEncodingSkiplist, data: copyzs}
+
+}
+
+// zsetTypeRandomElement returns a random member of a non empty sorted set
+// and its score.
+func zsetTypeRandomElement(o *rObj) (string, float64) {
+
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		eptr := lpSeek(lp, rand.Intn(zzlLength(lp))*2)
+		return lpGetString(lp, eptr), zzlGetScore(lp, lpNext(lp, eptr))
+	}
+	de := o.data.(*zset).dict.randomEntry()
+	return de.key, de.val.(float64)
+
+}
+
+// zsetTypeRandomElements returns count distinct random members and their
+// scores, count being smaller than the size of the sorted set.
+func zsetTypeRandomElements(o *rObj, count int) ([]string, []float64) {
+
+	members := make([]string, 0, count)
+	scores := make([]float64, 0, count)
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		for _, idx := range rand.Perm(zzlLength(lp))[:count] {
+			eptr := lpSeek(lp, idx*2)
+			members = append(members, lpGetString(lp, eptr))
+			scores = append(scores, zzlGetScore(lp, lpNext(lp, eptr)))
+		}
+		return members, scores
+	}
+
+	d := o.data.(*zset).dict
+	if count*3 > d.size() {
+		// close to the whole set: pick the entries of a random permutation
+		all := make([]*dictEntry, 0, d.size())
+		d.forEach(func(de *dictEntry) bool {
+			all = append(all, de)
+			return true
+		})
+		rand.Shuffle(len(all), func(i, j int) {
+			all[i], all[j] = all[j], all[i]
+		})
+		for _, de := range all[:count] {
+			members = append(members, de.key)
+			scores = append(scores, de.val.(float64))
+		}
+		return members, scores
+	}
+
+	seen := make(map[string]struct{}, count)
+	for len(members) < count {
+		de := d.randomEntry()
+		if _, ok := seen[de.key]; ok {
+			continue
+		}
+		seen[de.key] = struct{}{}
+		members = append(members, de.key)
+		scores = append(scores, de.val.(float64))
+	}
+	return members, scores
+
+}
+
+// Sorted set commands.
+
+// zaddGenericCommand implements ZADD and ZINCRBY, flags holding the
+// options implied by the command.
+func zaddGenericCommand(c *client, flags int) {
+
+	// the options come first, up to the first score
+	ch := false
+	scoreidx := 2
+	for ; scoreidx < c.argc; scoreidx++ {
+		opt := strings.ToLower(c.argv[scoreidx].String())
+		if opt == "nx" {
+			flags |= zaddInNX
+		} else if opt == "xx" {
+			flags |= zaddInXX
+		} else if opt == "gt" {
+			flags |= zaddInGT
+		} else if opt == "lt" {
+			flags |= zaddInLT
+		} else if opt == "ch" {
+			ch = true
+		} else if opt == "incr" {
+			flags |= zaddInIncr
+		} else {
+			break
+		}
+	}
+
+	incr := flags&zaddInIncr != 0
+	nx := flags&zaddInNX != 0
+	xx := flags&zaddInXX != 0
+	gt := flags&zaddInGT != 0
+	lt := flags&zaddInLT != 0
+
+	elements := c.argc - scoreidx
+	if elements%2 != 0 || elements == 0 {
+		addReply(c, shared.syntaxErr)
+		return
+	}
+	elements /= 2
+
+	if nx && xx {
+		addReplyError(c, "XX and NX options at the same time are not compatible")
+		return
+	}
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		addReplyError(c, "GT, LT, and/or NX options at the same time are not compatible")
+		return
+	}
+	if incr && elements > 1 {
+		addReplyError(c, "INCR option supports a single increment-element pair")
+		return
+	}
+
+	// parse all the scores before touching the sorted set
+	scores := make([]float64, elements)
+	maxelelen := 0
+	for j := 0; j < elements; j++ {
+		score, ok := getLongDoubleFromObjectOrReply(c, c.argv[scoreidx+j*2], "")
+		if !ok {
+			return
+		}
+		scores[j] = score
+		maxelelen = max(maxelelen, stringObjectLen(c.argv[scoreidx+j*2+1]))
+	}
+
+	key := c.argv[1].String()
+	o := lookupKeyWrite(c.db, key)
+	if o != nil && !checkType(c, o, objectTypeZSet) {
+		return
+	}
+
+	var added, updated, processed int64
+	var score float64
+	if o == nil && xx {
+		// nothing to update
+	} else {
+		if o == nil {
+			o = zsetTypeCreate(elements, maxelelen)
+			dbAdd(c.db, key, o)
+		} else {
+			zsetTypeMaybeConvert(o, elements)
+		}
+
+		for j := 0; j < elements; j++ {
+			retflags, newscore := zsetAdd(o, scores[j], c.argv[scoreidx+j*2+1].String(), flags)
+			if retflags&zaddOutNaN != 0 {
+				rServer.dirty += added + updated
+				addReplyError(c, "resulting score is not a number (NaN)")
+				return
+			}
+			if retflags&zaddOutAdded != 0 {
+				added++
+			}
+			if retflags&zaddOutUpdated != 0 {
+				updated++
+			}
+			if retflags&zaddOutNop == 0 {
+				processed++
+			}
+			score = newscore
+		}
+		rServer.dirty += added + updated
+	}
+
+	switch {
+	case incr && processed > 0:
+		addReplyDouble(c, score)
+	case incr:
+		addReplyNull(c)
+	case ch:
+		addReplyLongLong(c, added+updated)
+	default:
+		addReplyLongLong(c, added)
+	}
+
+}
+
+func zaddCommand(c *client) {
+	zaddGenericCommand(c, 0)
+}
+
+func zincrbyCommand(c *client) {
+	zaddGenericCommand(c, zaddInIncr)
+}
+
+func zremCommand(c *client) {
+
+	key := c.argv[1].String()
+	o := lookupKeyWriteOrReply(c, key, shared.czero)
+	if o == nil || !checkType(c, o, objectTypeZSet) {
+		return
+	}
+
+	var deleted int64
+	for j := 2; j < c.argc; j++ {
+		if zsetDel(o, c.argv[j].String()) {
+			deleted++
+			if zsetLength(o) == 0 {
+				dbDelete(c.db, key)
+				break
+			}
+		}
+	}
+	rServer.dirty += deleted
+	addReplyLongLong(c, deleted)
+
+}
+
+// range types of the ZRANGE family
+const (
+	zrangeAuto = iota
+	zrangeRank
+	zrangeScore
+	zrangeLex
+)
+
+// zremrangeGenericCommand implements ZREMRANGEBYRANK, ZREMRANGEBYSCORE and
+// ZREMRANGEBYLEX.
+func zremrangeGenericCommand(c *client, rangetype int) {
+
+	var start, end int64
+	var spec zrangespec
+	var lexspec zlexrangespec
+	var ok bool
+	switch rangetype {
+	case zrangeRank:
+		if start, ok = getLongLongFromObjectOrReply(c, c.argv[2], ""); !ok {
+			return
+		}
+		if end, ok = getLongLongFromObjectOrReply(c, c.argv[3], ""); !ok {
+			return
+		}
+	case zrangeScore:
+		if spec, ok = zslParseRange(c.argv[2], c.argv[3]); !ok {
+			addReplyError(c, "min or max is not a float")
+			return
+		}
+	case zrangeLex:
+		if lexspec, ok = zslParseLexRange(c.argv[2], c.argv[3]); !ok {
+			addReplyError(c, "min or max not valid string range item")
+			return
+		}
+	}
+
+	key := c.argv[1].String()
+	o := lookupKeyWriteOrReply(c, key, shared.czero)
+	if o == nil || !checkType(c, o, objectTypeZSet) {
+		return
+	}
+
+	if rangetype == zrangeRank {
+		llen := int64(zsetLength(o))
+		if start < 0 {
+			start += llen
+		}
+		if end < 0 {
+			end += llen
+		}
+		if start < 0 {
+			start = 0
+		}
+		if start > end || start >= llen {
+			addReply(c, shared.czero)
+			return
+		}
+		if end >= llen {
+			end = llen - 1
+		}
+	}
+
+	deleted := 0
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		switch rangetype {
+		case zrangeRank:
+			lp, deleted = zzlDeleteRangeByRank(lp, int(start)+1, int(end)+1)
+		case zrangeScore:
+			lp, deleted = zzlDeleteRangeByScore(lp, &spec)
+		case zrangeLex:
+			lp, deleted = zzlDeleteRangeByLex(lp, &lexspec)
+		}
+		o.data = lp
+	} else {
+		zs := o.data.(*zset)
+		switch rangetype {
+		case zrangeRank:
+			deleted = zslDeleteRangeByRank(zs.zsl, int(start)+1, int(end)+1, zs.dict)
+		case zrangeScore:
+			deleted = zslDeleteRangeByScore(zs.zsl, &spec, zs.dict)
+		case zrangeLex:
+			deleted = zslDeleteRangeByLex(zs.zsl, &lexspec, zs.dict)
+		}
+		if zs.dict.needsResize() {
+			zs.dict.resize()
+		}
+	}
+
+	if zsetLength(o) == 0 {
+		dbDelete(c.db, key)
+	}
+	rServer.dirty += int64(deleted)
+	addReplyLongLong(c, int64(deleted))
+
+}
+
+func zremrangebyrankCommand(c *client) {
+	zremrangeGenericCommand(c, zrangeRank)
+}
+
+func zremrangebyscoreCommand(c *client) {
+	zremrangeGenericCommand(c, zrangeScore)
+}
+
+func zremrangebylexCommand(c *client) {
+	zremrangeGenericCommand(c, zrangeLex)
+}
+
+// zrangeResultHandler receives the result of the ZRANGE family, either
+// replying it to the client or storing it at dstkey.
+type zrangeResultHandler struct {
+	c          *client
+	store      bool
+	dstkey     string
+	dstobj     *rObj
+	withscores bool
+	deferred   *bufferBlock
+	count      int
+}
+
+// begin starts the result, length being -1 when it is not known yet.
+func (h *zrangeResultHandler) begin(length int) {
+
+	if h.store {
+		h.dstobj = zsetTypeCreate(max(length, 0), 0)
+		return
+	}
+	if length < 0 {
+		h.deferred = addReplyDeferredLen(h.c)
+		return
+	}
+	if h.withscores && h.c.resp == 2 {
+		length *= 2
+	}
+	addReplyArrayLen(h.c, length)
+
+}
+
+func (h *zrangeResultHandler) emit(ele string, score float64) {
+
+	h.count++
+	if h.store {
+		zsetAdd(h.dstobj, score, ele, 0)
+		return
+	}
+	if h.withscores && h.c.resp > 2 {
+		addReplyArrayLen(h.c, 2)
+	}
+	addReplyBulkString(h.c, ele)
+	if h.withscores {
+		addReplyDouble(h.c, score)
+	}
+
+}
+
+func (h *zrangeResultHandler) finalize() {
+
+	if h.store {
+		if h.count > 0 {
+			setKey(h.c.db, h.dstkey, h.dstobj, false)
+			rServer.dirty++
+		} else if dbDelete(h.c.db, h.dstkey) {
+			rServer.dirty++
+		}
+		addReplyLongLong(h.c, int64(h.count))
+		return
+	}
+	if h.deferred != nil {
+		length := h.count
+		if h.withscores && h.c.resp == 2 {
+			length *= 2
+		}
+		setDeferredArrayLen(h.c, h.deferred, length)
+	}
+
+}
+
+// genericZrangebyrankCommand emits the members between the 0-based ranks
+// start and end.
+func genericZrangebyrankCommand(h *zrangeResultHandler, o *rObj, start, end int64, reverse bool) {
+
+	llen := int64(zsetLength(o))
+	if start < 0 {
+		start += llen
+	}
+	if end < 0 {
+		end += llen
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= llen {
+		h.begin(0)
+		h.finalize()
+		return
+	}
+	if end >= llen {
+		end = llen - 1
+	}
+	rangelen := int(end - start + 1)
+	h.begin(rangelen)
+
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		var eptr, sptr int
+		if reverse {
+			eptr = lpSeek(lp, int(-2-2*start))
+		} else {
+			eptr = lpSeek(lp, int(2*start))
+		}
+		sptr = lpNext(lp, eptr)
+		for ; rangelen > 0; rangelen-- {
+			h.emit(lpGetString(lp, eptr), zzlGetScore(lp, sptr))
+			if reverse {
+				eptr, sptr = zzlPrev(lp, eptr)
+			} else {
+				eptr, sptr = zzlNext(lp, eptr)
+			}
+		}
+	} else {
+		zsl := o.data.(*zset).zsl
+		var ln *zskiplistNode
+		if reverse {
+			ln = zsl.tail
+			if start > 0 {
+				ln = zslGetElementByRank(zsl, int(llen-start))
+			}
+		} else {
+			ln = zsl.header.level[0].forward
+			if start > 0 {
+				ln = zslGetElementByRank(zsl, int(start+1))
+			}
+		}
+		for ; rangelen > 0; rangelen-- {
+			h.emit(ln.ele, ln.score)
+			if reverse {
+				ln = ln.backward
+			} else {
+				ln = ln.level[0].forward
+			}
+		}
+	}
+	h.finalize()
+
+}
+
+// genericZrangebyscoreCommand emits the members in the score range, skipping
+// offset of them and emitting at most limit, a negative limit meaning all.
+func genericZrangebyscoreCommand(h *zrangeResultHandler, spec *zrangespec, o *rObj, offset, limit int64, reverse bool) {
+
+	h.begin(-1)
+
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		var eptr int
+		if reverse {
+			eptr = zzlLastInRange(lp, spec)
+		} else {
+			eptr = zzlFirstInRange(lp, spec)
+		}
+		step := func() {
+			if reverse {
+				eptr, _ = zzlPrev(lp, eptr)
+			} else {
+				eptr, _ = zzlNext(lp, eptr)
+			}
+		}
+		for ; eptr != -1 && offset > 0; offset-- {
+			step()
+		}
+		for eptr != -1 && limit != 0 {
+			score := zzlGetScore(lp, lpNext(lp, eptr))
+			if (reverse && !zslValueGteMin(score, spec)) || (!reverse && !zslValueLteMax(score, spec)) {
+				break
+			}
+			h.emit(lpGetString(lp, eptr), score)
+			limit--
+			step()
+		}
+	} else {
+		zsl := o.data.(*zset).zsl
+		var ln *zskiplistNode
+		if reverse {
+			ln = zslLastInRange(zsl, spec)
+		} else {
+			ln = zslFirstInRange(zsl, spec)
+		}
+		step := func() {
+			if reverse {
+				ln = ln.backward
+			} else {
+				ln = ln.level[0].forward
+			}
+		}
+		for ; ln != nil && offset > 0; offset-- {
+			step()
+		}
+		for ln != nil && limit != 0 {
+			if (reverse && !zslValueGteMin(ln.score, spec)) || (!reverse && !zslValueLteMax(ln.score, spec)) {
+				break
+			}
+			h.emit(ln.ele, ln.score)
+			limit--
+			step()
+		}
+	}
+	h.finalize()
+
+}
+
+// genericZrangebylexCommand is genericZrangebyscoreCommand for ranges of
+// members.
+func genericZrangebylexCommand(h *zrangeResultHandler, spec *zlexrangespec, o *rObj, offset, limit int64, reverse bool) {
+
+	h.begin(-1)
+
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		var eptr int
+		if reverse {
+			eptr = zzlLastInLexRange(lp, spec)
+		} else {
+			eptr = zzlFirstInLexRange(lp, spec)
+		}
+		step := func() {
+			if reverse {
+				eptr, _ = zzlPrev(lp, eptr)
+			} else {
+				eptr, _ = zzlNext(lp, eptr)
+			}
+		}
+		for ; eptr != -1 && offset > 0; offset-- {
+			step()
+		}
+		for eptr != -1 && limit != 0 {
+			ele := lpGetString(lp, eptr)
+			if (reverse && !zslLexValueGteMin(ele, spec)) || (!reverse && !zslLexValueLteMax(ele, spec)) {
+				break
+			}
+			h.emit(ele, zzlGetScore(lp, lpNext(lp, eptr)))
+			limit--
+			step()
+		}
+	} else {
+		zsl := o.data.(*zset).zsl
+		var ln *zskiplistNode
+		if reverse {
+			ln = zslLastInLexRange(zsl, spec)
+		} else {
+			ln = zslFirstInLexRange(zsl, spec)
+		}
+		step := func() {
+			if reverse {
+				ln = ln.backward
+			} else {
+				ln = ln.level[0].forward
+			}
+		}
+		for ; ln != nil && offset > 0; offset-- {
+			step()
+		}
+		for ln != nil && limit != 0 {
+			if (reverse && !zslLexValueGteMin(ln.ele, spec)) || (!reverse && !zslLexValueLteMax(ln.ele, spec)) {
+				break
+			}
+			h.emit(ln.ele, ln.score)
+			limit--
+			step()
+		}
+	}
+	h.finalize()
+
+}
+
+// zrangeGenericCommand implements the ZRANGE family, the source key being at
+// argv[argvStart]. ZRANGE and ZRANGESTORE pass zrangeAuto and no direction,
+// taking them from the options.
+func zrangeGenericCommand(h *zrangeResultHandler, argvStart int, rangetype int, reverse, directionSet bool) {
+
+	c := h.c
+	withscores := false
+	var offset, limit int64 = 0, -1
+	hasLimit := false
+
+	for j := argvStart + 3; j < c.argc; j++ {
+		leftargs := c.argc - j - 1
+		opt := c.argv[j].String()
+		switch {
+		case !h.store && strings.EqualFold(opt, "withscores"):
+			withscores = true
+		case strings.EqualFold(opt, "limit") && leftargs >= 2:
+			var ok bool
+			if offset, ok = getLongLongFromObjectOrReply(c, c.argv[j+1], ""); !ok {
+				return
+			}
+			if limit, ok = getLongLongFromObjectOrReply(c, c.argv[j+2], ""); !ok {
+				return
+			}
+			hasLimit = true
+			j += 2
+		case !directionSet && strings.EqualFold(opt, "rev"):
+			reverse, directionSet = true, true
+		case rangetype == zrangeAuto && strings.EqualFold(opt, "bylex"):
+			rangetype = zrangeLex
+		case rangetype == zrangeAuto && strings.EqualFold(opt, "byscore"):
+			rangetype = zrangeScore
+		default:
+			addReply(c, shared.syntaxErr)
+			return
+		}
+	}
+	if rangetype == zrangeAuto {
+		rangetype = zrangeRank
+	}
+
+	if hasLimit && rangetype == zrangeRank {
+		addReplyError(c, "syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+		return
+	}
+	if withscores && rangetype == zrangeLex {
+		addReplyError(c, "syntax error, WITHSCORES not supported in combination with BYLEX")
+		return
+	}
+
+	// the reverse score and lex ranges take max before min
+	minidx, maxidx := argvStart+1, argvStart+2
+	if reverse && (rangetype == zrangeScore || rangetype == zrangeLex) {
+		minidx, maxidx = maxidx, minidx
+	}
+
+	var start, end int64
+	var spec zrangespec
+	var lexspec zlexrangespec
+	var ok bool
+	switch rangetype {
+	case zrangeRank:
+		if start, ok = getLongLongFromObjectOrReply(c, c.argv[minidx], ""); !ok {
+			return
+		}
+		if end, ok = getLongLongFromObjectOrReply(c, c.argv[maxidx], ""); !ok {
+			return
+		}
+	case zrangeScore:
+		if spec, ok = zslParseRange(c.argv[minidx], c.argv[maxidx]); !ok {
+			addReplyError(c, "min or max is not a float")
+			return
+		}
+	case zrangeLex:
+		if lexspec, ok = zslParseLexRange(c.argv[minidx], c.argv[maxidx]); !ok {
+			addReplyError(c, "min or max not valid string range item")
+			return
+		}
+	}
+
+	h.withscores = withscores || h.store
+
+	o := lookupKeyRead(c.db, c.argv[argvStart].String())
+	if o == nil {
+		if h.store {
+			h.begin(0)
+			h.finalize()
+		} else {
+			addReply(c, shared.emptyArray)
+		}
+		return
+	}
+	if !checkType(c, o, objectTypeZSet) {
+		return
+	}
+
+	switch rangetype {
+	case zrangeRank:
+		genericZrangebyrankCommand(h, o, start, end, reverse)
+	case zrangeScore:
+		genericZrangebyscoreCommand(h, &spec, o, offset, limit, reverse)
+	case zrangeLex:
+		genericZrangebylexCommand(h, &lexspec, o, offset, limit, reverse)
+	}
+
+}
+
+// zrangeCommand implements ZRANGE key start stop [BYSCORE|BYLEX] [REV]
+// [LIMIT offset count] [WITHSCORES].
+func zrangeCommand(c *client) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, zrangeAuto, false, false)
+}
+
+func zrangestoreCommand(c *client) {
+	h := &zrangeResultHandler{c: c, store: true, dstkey: c.argv[1].String()}
+	zrangeGenericCommand(h, 2, zrangeAuto, false, false)
+}
+
+func zrevrangeCommand(c *client) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, zrangeRank, true, true)
+}
+
+func zrangebyscoreCommand(c *client) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, zrangeScore, false, true)
+}
+
+func zrevrangebyscoreCommand(c *client) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, zrangeScore, true, true)
+}
+
+func zrangebylexCommand(c *client) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, zrangeLex, false, true)
+}
+
+func zrevrangebylexCommand(c *client) {
+	zrangeGenericCommand(&zrangeResultHandler{c: c}, 1, zrangeLex, true, true)
+}
+
+func zcountCommand(c *client) {
+
+	spec, ok := zslParseRange(c.argv[2], c.argv[3])
+	if !ok {
+		addReplyError(c, "min or max is not a float")
+		return
+	}
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeZSet) {
+		return
+	}
+
+	count := 0
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		for eptr := zzlFirstInRange(lp, &spec); eptr != -1; eptr, _ = zzlNext(lp, eptr) {
+			if !zslValueLteMax(zzlGetScore(lp, lpNext(lp, eptr)), &spec) {
+				break
+			}
+			count++
+		}
+	} else {
+		// the count is the difference of the ranks of the range ends
+		zsl := o.data.(*zset).zsl
+		if zn := zslFirstInRange(zsl, &spec); zn != nil {
+			count = zsl.length - (zslGetRank(zsl, zn.score, zn.ele) - 1)
+			if zn = zslLastInRange(zsl, &spec); zn != nil {
+				count -= zsl.length - zslGetRank(zsl, zn.score, zn.ele)
+			}
+		}
+	}
+	addReplyLongLong(c, int64(count))
+
+}
+
+func zlexcountCommand(c *client) {
+
+	spec, ok := zslParseLexRange(c.argv[2], c.argv[3])
+	if !ok {
+		addReplyError(c, "min or max not valid string range item")
+		return
+	}
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeZSet) {
+		return
+	}
+
+	count := 0
+	if o.encoding == objectEncodingListpack {
+		lp := o.data.([]byte)
+		for eptr := zzlFirstInLexRange(lp, &spec); eptr != -1; eptr, _ = zzlNext(lp, eptr) {
+			if !zslLexValueLteMax(lpGetString(lp, eptr), &spec) {
+				break
+			}
+			count++
+		}
+	} else {
+		zsl := o.data.(*zset).zsl
+		if zn := zslFirstInLexRange(zsl, &spec); zn != nil {
+			count = zsl.length - (zslGetRank(zsl, zn.score, zn.ele) - 1)
+			if zn = zslLastInLexRange(zsl, &spec); zn != nil {
+				count -= zsl.length - zslGetRank(zsl, zn.score, zn.ele)
+			}
+		}
+	}
+	addReplyLongLong(c, int64(count))
+
+}
+
+func zcardCommand(c *client) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.czero)
+	if o == nil || !checkType(c, o, objectTypeZSet) {
+		return
+	}
+	addReplyLongLong(c, int64(zsetLength(o)))
+
+}
+
+func zscoreCommand(c *client) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.nullBulk)
+	if o == nil || !checkType(c, o, objectTypeZSet) {
+		return
+	}
+	score, ok := zsetScore(o, c.argv[2].String())
+	if !ok {
+		addReplyNull(c)
+		return
+	}
+	addReplyDouble(c, score)
+
+}
+
+func zmscoreCommand(c *client) {
+
+	// a missing key is an empty sorted set, that replies nulls
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o != nil && !checkType(c, o, objectTypeZSet) {
+		return
+	}
+
+	addReplyArrayLen(c, c.argc-2)
+	for j := 2; j < c.argc; j++ {
+		if o == nil {
+			addReplyNull(c)
+			continue
+		}
+		score, ok := zsetScore(o, c.argv[j].String())
+		if !ok {
+			addReplyNull(c)
+			continue
+		}
+		addReplyDouble(c, score)
+	}
+
+}
+
+// zrankGenericCommand implements ZRANK and ZREVRANK key member [WITHSCORE].
+func zrankGenericCommand(c *client, reverse bool) {
+
+	withscore := false
+	if c.argc > 4 || (c.argc == 4 && !strings.EqualFold(c.argv[3].String(), "withscore")) {
+		addReply(c, shared.syntaxErr)
+		return
+	}
+	if c.argc == 4 {
+		withscore = true
+	}
+
+	o := lookupKeyRead(c.db, c.argv[1].String())
+	if o != nil && !checkType(c, o, objectTypeZSet) {
+		return
+	}
+	var rank int
+	var score float64
+	ok := false
+	if o != nil {
+		rank, score, ok = zsetRank(o, c.argv[2].String(), reverse)
+	}
+	if !ok {
+		if withscore {
+			addReplyNullArray(c)
+		} else {
+			addReplyNull(c)
+		}
+		return
+	}
+
+	if withscore {
+		addReplyArrayLen(c, 2)
+		addReplyLongLong(c, int64(rank))
+		addReplyDouble(c, score)
+		return
+	}
+	addReplyLongLong(c, int64(rank))
+
+}
+
+func zrankCommand(c *client) {
+	zrankGenericCommand(c, false)
+}
+
+func zrevrankCommand(c *client) {
+	zrankGenericCommand(c, true)
+}
+
+// sides of a sorted set for the pop commands
+const (
+	zsetMin = iota
+	zsetMax
+)
+
+// genericZpopCommand pops up to count members with the lowest or highest
+// scores from the first non empty sorted set among keys, count being -1 for
+// a single member. It replies the popped members and scores as a flat array,
+// or as an array of pairs with useNested, preceded by the key with emitkey.
+// It returns false when nothing was popped.
+func genericZpopCommand(c *client, keys []*rObj, where int, emitkey bool, count int64, useNested, replyNilWhenEmpty bool) bool {
+
+	var key *rObj
+	var o *rObj
+	for _, k := range keys {
+		o = lookupKeyWrite(c.db, k.String())
+		if o == nil {
+			continue
+		}
+		if !checkType(c, o, objectTypeZSet) {
+			return false
+		}
+		key = k
+		break
+	}
+
+	if o == nil {
+		if replyNilWhenEmpty {
+			addReplyNullArray(c)
+		} else {
+			addReply(c, shared.emptyArray)
+		}
+		return false
+	}
+	if count == 0 {
+		addReply(c, shared.emptyArray)
+		return false
+	}
+	if count == -1 {
+		count = 1
+	}
+
+	rangelen := zsetLength(o)
+	if count < int64(rangelen) {
+		rangelen = int(count)
+	}
+	switch {
+	case !useNested && !emitkey:
+		addReplyArrayLen(c, rangelen*2)
+	case useNested && !emitkey:
+		addReplyArrayLen(c, rangelen)
+	case !useNested && emitkey:
+		addReplyArrayLen(c, rangelen*2+1)
+		addReplyBulk(c, key.bytes())
+	default:
+		addReplyArrayLen(c, 2)
+		addReplyBulk(c, key.bytes())
+		addReplyArrayLen(c, rangelen)
+	}
+
+	for j := 0; j < rangelen; j++ {
+		var ele string
+		var score float64
+		if o.encoding == objectEncodingListpack {
+			lp := o.data.([]byte)
+			eptr := lpSeek(lp, 0)
+			if where == zsetMax {
+				eptr = lpSeek(lp, -2)
+			}
+			ele, score = lpGetString(lp, eptr), zzlGetScore(lp, lpNext(lp, eptr))
+		} else {
+			zsl := o.data.(*zset).zsl
+			zln := zsl.header.level[0].forward
+			if where == zsetMax {
+				zln = zsl.tail
+			}
+			ele, score = zln.ele, zln.score
+		}
+		if useNested {
+			addReplyArrayLen(c, 2)
+		}
+		addReplyBulkString(c, ele)
+		addReplyDouble(c, score)
+		zsetDel(o, ele)
+	}
+
+	if zsetLength(o) == 0 {
+		dbDelete(c.db, key.String())
+	}
+	rServer.dirty += int64(rangelen)
+	return true
+
+}
+
+// zpopMinMaxCommand implements ZPOPMIN and ZPOPMAX key [count].
+func zpopMinMaxCommand(c *client, where int) {
+
+	if c.argc > 3 {
+		addReply(c, shared.syntaxErr)
+		return
+	}
+	count := int64(-1)
+	if c.argc == 3 {
+		var ok bool
+		count, ok = getRangeLongFromObjectOrReply(c, c.argv[2], 0, math.MaxInt64, "value is out of range, must be positive")
+		if !ok {
+			return
+		}
+	}
+	// a single member is replied flat, a count of them as pairs in RESP3
+	useNested := c.resp > 2 && count != -1
+	genericZpopCommand(c, c.argv[1:2], where, false, count, useNested, false)
+
+}
+
+func zpopminCommand(c *client) {
+	zpopMinMaxCommand(c, zsetMin)
+}
+
+func zpopmaxCommand(c *client) {
+	zpopMinMaxCommand(c, zsetMax)
+}
+
+// bzpopMinMaxCommand implements BZPOPMIN and BZPOPMAX key [key ...] timeout,
+// replying the key, the member and its score.
+func bzpopMinMaxCommand(c *client, where int) {
+
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.argv[c.argc-1], unitSeconds)
+	if !ok {
+		return
+	}
+
+	keys := c.argv[1 : c.argc-1]
+	for _, k := range keys {
+		o := lookupKeyWrite(c.db, k.String())
+		if o == nil {
+			continue
+		}
+		if !checkType(c, o, objectTypeZSet) {
+			return
+		}
+		genericZpopCommand(c, []*rObj{k}, where, true, -1, false, false)
+		return
+	}
+
+	blockForKeys(c, blockedZset, keys, timeout)
+
+}
+
+func bzpopminCommand(c *client) {
+	bzpopMinMaxCommand(c, zsetMin)
+}
+
+func bzpopmaxCommand(c *client) {
+	bzpopMinMaxCommand(c, zsetMax)
+}
+
+func zrandmemberReplyPair(c *client, ele string, score float64, withscores bool) {
+	if withscores && c.resp > 2 {
+		addReplyArrayLen(c, 2)
+	}
+	addReplyBulkString(c, ele)
+	if withscores {
+		addReplyDouble(c, score)
+	}
+}
+
+func zrandmemberWithCountCommand(c *client, count int64, withscores bool) {
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.emptyArray)
+	if o == nil || !checkType(c, o, objectTypeZSet) {
+		return
+	}
+	if count == 0 {
+		addReply(c, shared.emptyArray)
+		return
+	}
+
+	replyLen := func(n int) {
+		if withscores && c.resp == 2 {
+			n *= 2
+		}
+		addReplyArrayLen(c, n)
+	}
+
+	// a negative count allows the same member multiple times
+	if count < 0 {
+		replyLen(int(-count))
+		for j := int64(0); j < -count; j++ {
+			ele, score := zsetTypeRandomElement(o)
+			zrandmemberReplyPair(c, ele, score, withscores)
+		}
+		return
+	}
+
+	size := zsetLength(o)
+	if count >= int64(size) {
+		replyLen(size)
+		zsetForEach(o, func(ele string, score float64) {
+			zrandmemberReplyPair(c, ele, score, withscores)
+		})
+		return
+	}
+
+	members, scores := zsetTypeRandomElements(o, int(count))
+	replyLen(len(members))
+	for j := range members {
+		zrandmemberReplyPair(c, members[j], scores[j], withscores)
+	}
+
+}
+
+// zrandmemberCommand implements ZRANDMEMBER key [count [WITHSCORES]].
+func zrandmemberCommand(c *client) {
+
+	if c.argc >= 3 {
+		count, ok := getRangeLongFromObjectOrReply(c, c.argv[2], -math.MaxInt64, math.MaxInt64, "")
+		if !ok {
+			return
+		}
+		if c.argc > 4 || (c.argc == 4 && !strings.EqualFold(c.argv[3].String(), "withscores")) {
+			addReply(c, shared.syntaxErr)
+			return
+		}
+		withscores := c.argc == 4
+		// the reply would hold twice the elements
+		if withscores && (count < -math.MaxInt64/2 || count > math.MaxInt64/2) {
+			addReplyError(c, "value is out of range")
+			return
+		}
+		zrandmemberWithCountCommand(c, count, withscores)
+		return
+	}
+
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.nullBulk)
+	if o == nil || !checkType(c, o, objectTypeZSet) {
+		return
+	}
+	ele, _ := zsetTypeRandomElement(o)
+	addReplyBulkString(c, ele)
+
+}
+
+// operations of zunionInterDiffGenericCommand
+const (
+	zsetOpUnion = iota
+	zsetOpInter
+	zsetOpDiff
+)
+
+// aggregate functions of ZUNION and ZINTER
+const (
+	zaggSum = iota
+	zaggMin
+	zaggMax
+)
+
+// zsetopsrc is an input of ZUNION, ZINTER and ZDIFF, a sorted set or a set
+// whose members score 1.
+type zsetopsrc struct {
+	o      *rObj
+	weight float64
+}
+
+func (src *zsetopsrc) length() int {
+	if src.o == nil {
+		return 0
+	}
+	if src.o.objectType == objectTypeSet {
+		return setTypeSize(src.o)
+	}
+	return zsetLength(src.o)
+}
+
+func (src *zsetopsrc) forEach(fn func(ele string, score float64)) {
+
+	if src.o == nil {
+		return
+	}
+	if src.o.objectType == objectTypeZSet {
+		zsetForEach(src.o, fn)
+		return
+	}
+	si := setTypeInitIterator(src.o)
+	defer si.release()
+	for ele, ok := si.next(); ok; ele, ok = si.next() {
+		fn(ele, 1)
+	}
+
+}
+
+func (src *zsetopsrc) score(ele string) (float64, bool) {
+
+	if src.o == nil {
+		return 0, false
+	}
+	if src.o.objectType == objectTypeSet {
+		return 1, setTypeIsMember(src.o, ele)
+	}
+	return zsetScore(src.o, ele)
+
+}
+
+func zunionInterAggregate(target, val float64, aggregate int) float64 {
+
+	switch aggregate {
+	case zaggMin:
+		return math.Min(target, val)
+	case zaggMax:
+		return math.Max(target, val)
+	}
+	// +inf and -inf sum to NaN
+	if sum := target + val; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0
+
+}
+
+// zunionInterDiffGenericCommand implements ZUNION, ZINTER and ZDIFF, and
+// their STORE variants when dstkey is set. The number of keys is at
+// argv[numkeysIndex].
+func zunionInterDiffGenericCommand(c *client, dstkey string, numkeysIndex int, op int) {
+
+	numkeys, ok := getLongLongFromObjectOrReply(c, c.argv[numkeysIndex], "")
+	if !ok {
+		return
+	}
+	if numkeys < 1 {
+		addReplyErrorFormat(c, "at least 1 input key is needed for '%s' command", c.cmd.name)
+		return
+	}
+	if numkeys > int64(c.argc-numkeysIndex-1) {
+		addReply(c, shared.syntaxErr)
+		return
+	}
+
+	srcs := make([]zsetopsrc, numkeys)
+	for j := range srcs {
+		o := lookupKeyRead(c.db, c.argv[numkeysIndex+1+j].String())
+		if o != nil && o.objectType != objectTypeZSet && o.objectType != objectTypeSet {
+			addReply(c, shared.wrongTypeErr)
+			return
+		}
+		srcs[j] = zsetopsrc{o: o, weight: 1}
+	}
+
+	aggregate := zaggSum
+	withscores := false
+	for j := numkeysIndex + 1 + int(numkeys); j < c.argc; j++ {
+		remaining := c.argc - j - 1
+		opt := c.argv[j].String()
+		switch {
+		case op != zsetOpDiff && strings.EqualFold(opt, "weights") && remaining >= int(numkeys):
+			for i := range srcs {
+				j++
+				if srcs[i].weight, ok = getLongDoubleFromObjectOrReply(c, c.argv[j], "weight value is not a float"); !ok {
+					return
+				}
+			}
+		case op != zsetOpDiff && strings.EqualFold(opt, "aggregate") && remaining >= 1:
+			j++
+			switch strings.ToLower(c.argv[j].String()) {
+			case "sum":
+				aggregate = zaggSum
+			case "min":
+				aggregate = zaggMin
+			case "max":
+				aggregate = zaggMax
+			default:
+				addReply(c, shared.syntaxErr)
+				return
+			}
+		case dstkey == "" && strings.EqualFold(opt, "withscores"):
+			withscores = true
+		default:
+			addReply(c, shared.syntaxErr)
+			return
+		}
+	}
+
+	// the result, member -> score
+	result := make(map[string]float64)
+	weighted := func(weight, score float64) float64 {
+		if v := weight * score; !math.IsNaN(v) {
+			return v
+		}
+		return 0
+	}
+
+	switch op {
+	case zsetOpUnion:
+		for i := range srcs {
+			src := &srcs[i]
+			src.forEach(func(ele string, score float64) {
+				score = weighted(src.weight, score)
+				if cur, ok := result[ele]; ok {
+					score = zunionInterAggregate(cur, score, aggregate)
+				}
+				result[ele] = score
+			})
+		}
+	case zsetOpInter:
+		// walk the smallest input, looking up the members in the others
+		sort.SliceStable(srcs, func(i, j int) bool {
+			return srcs[i].length() < srcs[j].length()
+		})
+		srcs[0].forEach(func(ele string, score float64) {
+			score = weighted(srcs[0].weight, score)
+			for i := 1; i < len(srcs); i++ {
+				other, ok := srcs[i].score(ele)
+				if !ok {
+					return
+				}
+				score = zunionInterAggregate(score, weighted(srcs[i].weight, other), aggregate)
+			}
+			result[ele] = score
+		})
+	case zsetOpDiff:
+		srcs[0].forEach(func(ele string, score float64) {
+			for i := 1; i < len(srcs); i++ {
+				if _, ok := srcs[i].score(ele); ok {
+					return
+				}
+			}
+			result[ele] = score
+		})
+	}
+
+	maxelelen := 0
+	for ele := range result {
+		maxelelen = max(maxelelen, len(ele))
+	}
+	dstobj := zsetTypeCreate(len(result), maxelelen)
+	for ele, score := range result {
+		zsetAdd(dstobj, score, ele, 0)
+	}
+
+	if dstkey != "" {
+		if zsetLength(dstobj) > 0 {
+			setKey(c.db, dstkey, dstobj, false)
+			rServer.dirty++
+		} else if dbDelete(c.db, dstkey) {
+			rServer.dirty++
+		}
+		addReplyLongLong(c, int64(zsetLength(dstobj)))
+		return
+	}
+
+	h := &zrangeResultHandler{c: c, withscores: withscores}
+	genericZrangebyrankCommand(h, dstobj, 0, -1, false)
+
+}
+
+func zunionstoreCommand(c *client) {
+	zunionInterDiffGenericCommand(c, c.argv[1].String(), 2, zsetOpUnion)
+}
+
+func zinterstoreCommand(c *client) {
+	zunionInterDiffGenericCommand(c, c.argv[1].String(), 2, zsetOpInter)
+}
+
+func zdiffstoreCommand(c *client) {
+	zunionInterDiffGenericCommand(c, c.argv[1].String(), 2, zsetOpDiff)
+}
+
+func zunionCommand(c *client) {
+	zunionInterDiffGenericCommand(c, "", 1, zsetOpUnion)
+}
+
+func zinterCommand(c *client) {
+	zunionInterDiffGenericCommand(c, "", 1, zsetOpInter)
+}
+
+func zdiffCommand(c *client) {
+	zunionInterDiffGenericCommand(c, "", 1, zsetOpDiff)
+}
+
+func zscanCommand(c *client) {
+
+	cursor, ok := parseScanCursorOrReply(c, c.argv[2])
+	if !ok {
+		return
+	}
+	o := lookupKeyReadOrReply(c, c.argv[1].String(), shared.emptyScan)
+	if o == nil || !checkType(c, o, objectTypeZSet) {
+		return
+	}
+	scanGenericCommand(c, o, cursor)
+
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// setZsetListpackEntries sets zset-max-listpack-entries for a test, 0
+// making every sorted set a skiplist.
+func setZsetListpackEntries(tc *testConn, entries int) {
+	tc.t.Helper()
+	tc.expect(testStatus("OK"), "config", "set", "zset-max-listpack-entries", strconv.Itoa(entries))
+	tc.t.Cleanup(func() {
+		tc.do("config", "set", "zset-max-listpack-entries", "128")
+	})
+}
+
+// zsetEncodings runs fn once with each encoding of the sorted sets.
+func zsetEncodings(t *testing.T, fn func(tc *testConn, encoding string)) {
+	for _, encoding := range []string{"listpack", "skiplist"} {
+		t.Run(encoding, func(t *testing.T) {
+			tc := newTestConn(t)
+			tc.expect(testStatus("OK"), "select", "15")
+			tc.expect(testStatus("OK"), "flushdb")
+			if encoding == "skiplist" {
+				setZsetListpackEntries(tc, 0)
+			}
+			fn(tc, encoding)
+		})
+	}
+}
+
+func TestZset_Add(t *testing.T) {
+	zsetEncodings(t, func(tc *testConn, encoding string) {
+		tc.expect(int64(3), "zadd", "z", "1", "a", "2", "b", "3", "c")
+		tc.expect(testStatus("zset"), "type", "z")
+		tc.expect(encoding, "object", "encoding", "z")
+		tc.expect(int64(0), "zadd", "z", "5", "a")
+		tc.expect("5", "zscore", "z", "a")
+		tc.expect(int64(2), "zadd", "z", "ch", "5", "a", "6", "a", "4", "d")
+		tc.expect([]any{"b", "c", "d", "a"}, "zrange", "z", "0", "-1")
+
+		tc.expect(int64(0), "zadd", "z", "nx", "1", "a")
+		tc.expect(int64(0), "zadd", "z", "xx", "1", "e")
+		tc.expect(int64(0), "exists", "e")
+		tc.expect(int64(1), "zadd", "z", "xx", "ch", "1", "a", "1", "e")
+		tc.expect("1", "zscore", "z", "a")
+		tc.expect(int64(0), "zadd", "z", "gt", "ch", "0", "a")
+		tc.expect(int64(1), "zadd", "z", "gt", "ch", "10", "a")
+		tc.expect(int64(1), "zadd", "z", "lt", "ch", "-1", "a")
+		tc.expect(int64(0), "zadd", "z", "lt", "ch", "0", "a")
+
+		tc.expect("1.5", "zadd", "z", "incr", "2.5", "a")
+		tc.expect(nil, "zadd", "z", "nx", "incr", "1", "a")
+		tc.expect(nil, "zadd", "z", "xx", "incr", "1", "nope")
+		tc.expect("3.5", "zincrby", "z", "2", "a")
+		tc.expect("-2", "zincrby", "z", "-2", "new")
+		tc.expect(int64(5), "zcard", "z")
+		tc.expect(int64(0), "zcard", "nokey")
+
+		tc.expect(testError("ERR syntax error"), "zadd", "z", "nx", "1")
+		tc.expect(testError("ERR value is not a valid float"), "zadd", "z", "x", "a")
+		tc.expect(testError("ERR value is not a valid float"), "zadd", "z", "nan", "a")
+		tc.expect(testError("ERR XX and NX options at the same time are not compatible"), "zadd", "z", "nx", "xx", "1", "a")
+		tc.expect(testError("ERR GT, LT, and/or NX options at the same time are not compatible"), "zadd", "z", "gt", "lt", "1", "a")
+		tc.expect(testError("ERR INCR option supports a single increment-element pair"), "zadd", "z", "incr", "1", "a", "2", "b")
+		tc.expect(int64(1), "zadd", "inf", "inf", "x")
+		tc.expect(testError("ERR resulting score is not a number (NaN)"), "zincrby", "inf", "-inf", "x")
+
+		tc.expect([]any{"3.5", nil, "-2"}, "zmscore", "z", "a", "nope", "new")
+		tc.expect([]any{nil}, "zmscore", "nokey", "a")
+		tc.expect(nil, "zscore", "nokey", "a")
+
+		tc.expect(int64(2), "zrem", "z", "a", "nope", "new")
+		tc.expect(int64(3), "zrem", "z", "b", "c", "d", "e")
+		tc.expect(int64(0), "exists", "z")
+
+		tc.expect(testStatus("OK"), "set", "str", "v")
+		tc.expectError("WRONGTYPE", "zadd", "str", "1", "a")
+		tc.expectError("WRONGTYPE", "zrange", "str", "0", "-1")
+	})
+}
+
+func TestZset_Conversion(t *testing.T) {
+	tc := newTestConn(t)
+	tc.expect(testStatus("OK"), "select", "15")
+	tc.expect(testStatus("OK"), "flushdb")
+	setZsetListpackEntries(tc, 4)
+
+	tc.expect(int64(4), "zadd", "z", "1", "a", "2", "b", "3", "c", "4", "d")
+	tc.expect("listpack", "object", "encoding", "z")
+	tc.expect(int64(1), "zadd", "z", "5", "e")
+	tc.expect("skiplist", "object", "encoding", "z")
+	tc.expect([]any{"a", "b", "c", "d", "e"}, "zrange", "z", "0", "-1")
+
+	tc.expect(int64(1), "zadd", "long", "1", "x")
+	tc.expect(int64(1), "zadd", "long", "1", string(make([]byte, 65)))
+	tc.expect("skiplist", "object", "encoding", "long")
+}
+
+func TestZset_Range(t *testing.T) {
+	zsetEncodings(t, func(tc *testConn, encoding string) {
+		tc.expect(int64(6), "zadd", "z", "1", "a", "2", "b", "3", "c", "4", "d", "5", "e", "5", "f")
+
+		tc.expect([]any{"a", "b"}, "zrange", "z", "0", "1")
+		tc.expect([]any{"e", "f"}, "zrange", "z", "-2", "-1")
+		tc.expect([]any{}, "zrange", "z", "4", "2")
+		tc.expect([]any{}, "zrange", "nokey", "0", "-1")
+		tc.expect([]any{"f", "e", "d"}, "zrange", "z", "0", "2", "rev")
+		tc.expect([]any{"f", "e", "d"}, "zrevrange", "z", "0", "2")
+		tc.expect([]any{"a", "1", "b", "2"}, "zrange", "z", "0", "1", "withscores")
+
+		tc.expect([]any{"b", "c", "d"}, "zrange", "z", "2", "4", "byscore")
+		tc.expect([]any{"c", "d"}, "zrange", "z", "(2", "4", "byscore")
+		tc.expect([]any{"c"}, "zrange", "z", "(2", "(4", "byscore")
+		tc.expect([]any{"a", "b", "c", "d", "e", "f"}, "zrange", "z", "-inf", "+inf", "byscore")
+		tc.expect([]any{"d", "c", "b"}, "zrange", "z", "4", "2", "byscore", "rev")
+		tc.expect([]any{"c", "d"}, "zrange", "z", "-inf", "inf", "byscore", "limit", "2", "2")
+		tc.expect([]any{"e", "d"}, "zrange", "z", "+inf", "-inf", "byscore", "rev", "limit", "1", "2")
+		tc.expect([]any{"c", "d", "e", "f"}, "zrangebyscore", "z", "3", "inf", "limit", "0", "-1")
+		tc.expect([]any{"e", "5", "f", "5"}, "zrangebyscore", "z", "5", "5", "withscores")
+		tc.expect([]any{"c", "b"}, "zrevrangebyscore", "z", "3", "(1")
+		tc.expect([]any{}, "zrangebyscore", "z", "6", "10")
+		tc.expect([]any{}, "zrangebyscore", "z", "3", "2")
+		tc.expect(testError("ERR min or max is not a float"), "zrangebyscore", "z", "x", "2")
+
+		tc.expect(int64(3), "zcount", "z", "2", "4")
+		tc.expect(int64(6), "zcount", "z", "-inf", "+inf")
+		tc.expect(int64(0), "zcount", "z", "(5", "+inf")
+		tc.expect(int64(0), "zcount", "nokey", "0", "1")
+
+		tc.expect(testError("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"),
+			"zrange", "z", "0", "1", "limit", "0", "1")
+		tc.expect(testError("ERR syntax error, WITHSCORES not supported in combination with BYLEX"),
+			"zrange", "z", "-", "+", "bylex", "withscores")
+		tc.expect(testError("ERR syntax error"), "zrange", "z", "0", "1", "nope")
+
+		// ranges of members, on members of a same score
+		tc.expect(int64(5), "zadd", "lex", "0", "a", "0", "b", "0", "c", "0", "d", "0", "e")
+		tc.expect([]any{"a", "b", "c"}, "zrange", "lex", "-", "[c", "bylex")
+		tc.expect([]any{"b", "c"}, "zrangebylex", "lex", "(a", "(d")
+		tc.expect([]any{"e", "d"}, "zrange", "lex", "+", "(c", "bylex", "rev")
+		tc.expect([]any{"d", "c"}, "zrevrangebylex", "lex", "[d", "-", "limit", "0", "2")
+		tc.expect([]any{}, "zrangebylex", "lex", "+", "-")
+		tc.expect([]any{}, "zrangebylex", "lex", "[c", "(c")
+		tc.expect(int64(3), "zlexcount", "lex", "[b", "[d")
+		tc.expect(int64(5), "zlexcount", "lex", "-", "+")
+		tc.expect(int64(0), "zlexcount", "lex", "(e", "+")
+		tc.expect(testError("ERR min or max not valid string range item"), "zlexcount", "lex", "a", "+")
+
+		tc.expect(int64(2), "zrangestore", "dst", "z", "4", "5", "byscore", "limit", "1", "2")
+		tc.expect([]any{"e", "5", "f", "5"}, "zrange", "dst", "0", "-1", "withscores")
+		tc.expect(int64(0), "zrangestore", "dst", "z", "10", "20", "byscore")
+		tc.expect(int64(0), "exists", "dst")
+		tc.expect(int64(0), "zrangestore", "dst", "nokey", "0", "-1")
+		tc.expect(testError("ERR syntax error"), "zrangestore", "dst", "z", "0", "-1", "withscores")
+
+		tc.do("hello", "3")
+		tc.expect([]any{[]any{"a", 1.0}, []any{"b", 2.0}}, "zrange", "z", "0", "1", "withscores")
+		tc.do("hello", "2")
+	})
+}
+
+func TestZset_Rank(t *testing.T) {
+	zsetEncodings(t, func(tc *testConn, encoding string) {
+		tc.expect(int64(3), "zadd", "z", "10", "a", "20", "b", "30", "c")
+		tc.expect(int64(0), "zrank", "z", "a")
+		tc.expect(int64(2), "zrank", "z", "c")
+		tc.expect(int64(0), "zrevrank", "z", "c")
+		tc.expect(nil, "zrank", "z", "nope")
+		tc.expect(nil, "zrank", "nokey", "a")
+		tc.expect([]any{int64(1), "20"}, "zrank", "z", "b", "withscore")
+		tc.expect([]any{int64(2), "10"}, "zrevrank", "z", "a", "withscore")
+		tc.expect(nil, "zrevrank", "z", "nope", "withscore")
+		tc.expect(testError("ERR syntax error"), "zrank", "z", "a", "nope")
+	})
+}
+
+func TestZset_RemRange(t *testing.T) {
+	zsetEncodings(t, func(tc *testConn, encoding string) {
+		reset := func() {
+			tc.do("del", "z")
+			tc.expect(int64(6), "zadd", "z", "1", "a", "2", "b", "3", "c", "4", "d", "5", "e", "6", "f")
+		}
+
+		reset()
+		tc.expect(int64(2), "zremrangebyrank", "z", "1", "2")
+		tc.expect([]any{"a", "d", "e", "f"}, "zrange", "z", "0", "-1")
+		tc.expect(int64(2), "zremrangebyrank", "z", "-2", "-1")
+		tc.expect(int64(0), "zremrangebyrank", "z", "5", "10")
+		tc.expect(int64(2), "zremrangebyrank", "z", "0", "-1")
+		tc.expect(int64(0), "exists", "z")
+		tc.expect(int64(0), "zremrangebyrank", "z", "0", "-1")
+
+		reset()
+		tc.expect(int64(3), "zremrangebyscore", "z", "(1", "4")
+		tc.expect([]any{"a", "e", "f"}, "zrange", "z", "0", "-1")
+		tc.expect(int64(2), "zremrangebyscore", "z", "5", "+inf")
+		tc.expect(int64(0), "zremrangebyscore", "z", "10", "20")
+		tc.expect(testError("ERR min or max is not a float"), "zremrangebyscore", "z", "x", "1")
+
+		tc.do("del", "z")
+		tc.expect(int64(4), "zadd", "z", "0", "a", "0", "b", "0", "c", "0", "d")
+		tc.expect(int64(2), "zremrangebylex", "z", "(a", "[c")
+		tc.expect([]any{"a", "d"}, "zrange", "z", "0", "-1")
+		tc.expect(int64(2), "zremrangebylex", "z", "-", "+")
+		tc.expect(int64(0), "exists", "z")
+	})
+}
+
+func TestZset_Store(t *testing.T) {
+	zsetEncodings(t, func(tc *testConn, encoding string) {
+		tc.expect(int64(3), "zadd", "z1", "1", "a", "2", "b", "3", "c")
+		tc.expect(int64(3), "zadd", "z2", "10", "b", "20", "c", "30", "d")
+		tc.expect(int64(2), "sadd", "s", "c", "d")
+
+		tc.expect(int64(4), "zunionstore", "dst", "2", "z1", "z2")
+		tc.expect([]any{"a", "1", "b", "12", "c", "23", "d", "30"}, "zrange", "dst", "0", "-1", "withscores")
+		tc.expect(int64(4), "zunionstore", "dst", "3", "z1", "z2", "nokey", "weights", "2", "1", "5", "aggregate", "min")
+		tc.expect([]any{"a", "2", "b", "4", "c", "6", "d", "30"}, "zrange", "dst", "0", "-1", "withscores")
+		tc.expect(int64(2), "zinterstore", "dst", "2", "z1", "z2", "aggregate", "max")
+		tc.expect([]any{"b", "10", "c", "20"}, "zrange", "dst", "0", "-1", "withscores")
+		tc.expect(int64(1), "zinterstore", "dst", "3", "z1", "z2", "s")
+		tc.expect([]any{"c", "24"}, "zrange", "dst", "0", "-1", "withscores")
+		tc.expect(int64(1), "zdiffstore", "dst", "2", "z1", "z2")
+		tc.expect([]any{"a", "1"}, "zrange", "dst", "0", "-1", "withscores")
+		tc.expect(int64(0), "zinterstore", "dst", "2", "z1", "nokey")
+		tc.expect(int64(0), "exists", "dst")
+
+		tc.expect([]any{"a", "b", "c", "d"}, "zunion", "2", "z1", "z2")
+		tc.expect([]any{"b", "12", "c", "23"}, "zinter", "2", "z1", "z2", "withscores")
+		tc.expect([]any{"a"}, "zdiff", "2", "z1", "z2")
+		tc.expect([]any{}, "zdiff", "1", "nokey")
+
+		tc.expect(testError("ERR at least 1 input key is needed for 'zunionstore' command"), "zunionstore", "dst", "0", "z1")
+		tc.expect(testError("ERR syntax error"), "zunionstore", "dst", "3", "z1", "z2")
+		tc.expect(testError("ERR syntax error"), "zdiffstore", "dst", "1", "z1", "weights", "1")
+		tc.expect(testError("ERR syntax error"), "zunionstore", "dst", "1", "z1", "withscores")
+		tc.expect(testError("ERR weight value is not a float"), "zunionstore", "dst", "1", "z1", "weights", "x")
+		tc.expect(testError("ERR syntax error"), "zunionstore", "dst", "1", "z1", "aggregate", "avg")
+		tc.expect(testStatus("OK"), "set", "str", "v")
+		tc.expectError("WRONGTYPE", "zunionstore", "dst", "2", "z1", "str")
+	})
+}
+
+func TestZset_PopRandom(t *testing.T) {
+	zsetEncodings(t, func(tc *testConn, encoding string) {
+		tc.expect(int64(4), "zadd", "z", "1", "a", "2", "b", "3", "c", "4", "d")
+		tc.expect([]any{"a", "1"}, "zpopmin", "z")
+		tc.expect([]any{"d", "4"}, "zpopmax", "z")
+		tc.expect([]any{"b", "2", "c", "3"}, "zpopmin", "z", "5")
+		tc.expect(int64(0), "exists", "z")
+		tc.expect([]any{}, "zpopmin", "z")
+		tc.expect([]any{}, "zpopmax", "z", "0")
+		tc.expect(testError("ERR value is out of range, must be positive"), "zpopmin", "z", "-1")
+
+		tc.expect(int64(2), "zadd", "z", "1", "a", "2", "b")
+		tc.do("hello", "3")
+		tc.expect([]any{"a", 1.0}, "zpopmin", "z")
+		tc.expect([]any{[]any{"b", 2.0}}, "zpopmin", "z", "1")
+		tc.do("hello", "2")
+
+		tc.expect(nil, "zrandmember", "nokey")
+		tc.expect([]any{}, "zrandmember", "nokey", "2")
+		n := 50
+		scores := make(map[string]string)
+		args := []string{"zadd", "r"}
+		for j := 0; j < n; j++ {
+			scores["m"+strconv.Itoa(j)] = strconv.Itoa(j)
+			args = append(args, strconv.Itoa(j), "m"+strconv.Itoa(j))
+		}
+		tc.expect(int64(n), args...)
+		if m := tc.do("zrandmember", "r").(string); scores[m] == "" {
+			t.Fatalf("unknown random member %q", m)
+		}
+		for _, count := range []int{3, 40, n, n + 5} {
+			reply := tc.do("zrandmember", "r", strconv.Itoa(count), "withscores").([]any)
+			seen := make(map[string]bool)
+			for j := 0; j < len(reply); j += 2 {
+				m, s := reply[j].(string), reply[j+1].(string)
+				if scores[m] != s || seen[m] {
+					t.Fatalf("count %d: bad or repeated pair %s=%s", count, m, s)
+				}
+				seen[m] = true
+			}
+			if want := min(count, n); len(seen) != want {
+				t.Fatalf("count %d: want %d members, got %d", count, want, len(seen))
+			}
+		}
+		if reply := tc.do("zrandmember", "r", "-100").([]any); len(reply) != 100 {
+			t.Fatalf("want 100 members with repetitions, got %d", len(reply))
+		}
+	})
+}
+
+func TestZset_Scan(t *testing.T) {
+	zsetEncodings(t, func(tc *testConn, encoding string) {
+		args := []string{"zadd", "z"}
+		for j := 0; j < 200; j++ {
+			args = append(args, strconv.Itoa(j), "m"+strconv.Itoa(j))
+		}
+		tc.expect(int64(200), args...)
+
+		seen := make(map[string]string)
+		cursor := "0"
+		for {
+			reply := tc.do("zscan", "z", cursor, "count", "20").([]any)
+			items := reply[1].([]any)
+			for j := 0; j < len(items); j += 2 {
+				seen[items[j].(string)] = items[j+1].(string)
+			}
+			cursor = reply[0].(string)
+			if cursor == "0" {
+				break
+			}
+		}
+		if len(seen) != 200 || seen["m150"] != "150" {
+			t.Fatalf("want every member seen with its score, got %d", len(seen))
+		}
+	})
+}
+
+// TestZskiplist_Model checks the skiplist ranks and ranges against a sorted
+// slice.
+func TestZskiplist_Model(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	zsl := zslCreate()
+	scores := make(map[string]float64)
+
+	for op := 0; op < 5000; op++ {
+		ele := "e" + strconv.Itoa(rnd.Intn(500))
+		score := float64(rnd.Intn(100))
+		cur, ok := scores[ele]
+		switch {
+		case !ok:
+			zslInsert(zsl, score, ele)
+			scores[ele] = score
+		case rnd.Intn(2) == 0:
+			zslUpdateScore(zsl, cur, ele, score)
+			scores[ele] = score
+		default:
+			if !zslDelete(zsl, cur, ele) {
+				t.Fatalf("delete of %s failed", ele)
+			}
+			delete(scores, ele)
+		}
+	}
+
+	type entry struct {
+		ele   string
+		score float64
+	}
+	var model []entry
+	for ele, score := range scores {
+		model = append(model, entry{ele, score})
+	}
+	sort.Slice(model, func(i, j int) bool {
+		return model[i].score < model[j].score || (model[i].score == model[j].score && model[i].ele < model[j].ele)
+	})
+
+	if zsl.length != len(model) {
+		t.Fatalf("want %d nodes, got %d", len(model), zsl.length)
+	}
+	x := zsl.header.level[0].forward
+	for j, e := range model {
+		if x.ele != e.ele || x.score != e.score {
+			t.Fatalf("node %d: want %s %v, got %s %v", j, e.ele, e.score, x.ele, x.score)
+		}
+		if rank := zslGetRank(zsl, e.score, e.ele); rank != j+1 {
+			t.Fatalf("%s: want rank %d, got %d", e.ele, j+1, rank)
+		}
+		if n := zslGetElementByRank(zsl, j+1); n != x {
+			t.Fatalf("rank %d: wrong node", j+1)
+		}
+		x = x.level[0].forward
+	}
+
+	spec := zrangespec{min: 20, max: 30, maxex: true}
+	first, last := zslFirstInRange(zsl, &spec), zslLastInRange(zsl, &spec)
+	if first == nil || first.score < 20 || (first.backward != nil && first.backward.score >= 20) ||
+		last == nil || last.score >= 30 || (last.level[0].forward != nil && last.level[0].forward.score < 30) {
+		t.Fatalf("wrong range ends")
+	}
+	d := newDict()
+	for ele := range scores {
+		d.add(ele, nil)
+	}
+	removed := zslDeleteRangeByScore(zsl, &spec, d)
+	if zslFirstInRange(zsl, &spec) != nil || zsl.length != len(model)-removed || d.size() != zsl.length {
+		t.Fatalf("wrong range deletion, removed %d", removed)
+	}
+}
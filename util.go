@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+func isHexDigit(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+func hexDigitToInt(b byte) byte {
+	switch {
+	case b >= '0' && b <= '9':
+		return b - '0'
+	case b >= 'a' && b <= 'f':
+		return b - 'a' + 10
+	default:
+		return b - 'A' + 10
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\n' || b == '\r' || b == '\t' || b == '\v' || b == '\f'
+}
+
+// splitArgs splits a line into arguments the way redis-cli does: arguments
+// are separated by spaces, "double quoted" arguments support the \n \r \t \b
+// \a and \xff escapes, 'single quoted' arguments only support \'. A closing
+// quote must be followed by a space or the end of the line. It returns false
+// on unbalanced quotes.
+func splitArgs(line []byte) ([][]byte, bool) {
+
+	var args [][]byte
+	p := 0
+
+	for {
+		// skip blanks
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+		if p == len(line) {
+			return args, true
+		}
+
+		inq, insq, done := false, false, false
+		current := make([]byte, 0, 16)
+
+		for !done {
+			if inq {
+				switch {
+				case p == len(line):
+					// unterminated quotes
+					return nil, false
+				case line[p] == '\\' && p+3 < len(line) && line[p+1] == 'x' &&
+					isHexDigit(line[p+2]) && isHexDigit(line[p+3]):
+					current = append(current, hexDigitToInt(line[p+2])*16+hexDigitToInt(line[p+3]))
+					p += 3
+				case line[p] == '\\' && p+1 < len(line):
+					p++
+					switch line[p] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[p])
+					}
+				case line[p] == '"':
+					// closing quote must be followed by a space or nothing at all
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					current = append(current, line[p])
+				}
+			} else if insq {
+				switch {
+				case p == len(line):
+					return nil, false
+				case line[p] == '\\' && p+1 < len(line) && line[p+1] == '\'':
+					p++
+					current = append(current, '\'')
+				case line[p] == '\'':
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					current = append(current, line[p])
+				}
+			} else {
+				switch {
+				case p == len(line) || isSpace(line[p]):
+					done = true
+				case line[p] == '"':
+					inq = true
+				case line[p] == '\'':
+					insq = true
+				default:
+					current = append(current, line[p])
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+		args = append(args, current)
+	}
+
+}
+
+// catRepr returns s double quoted with the escapes splitArgs reads back
+// when it is empty or has spaces, quotes or non printable characters, s as
+// it is otherwise.
+func catRepr(s string) string {
+
+	needsRepr := s == ""
+	for j := 0; j < len(s) && !needsRepr; j++ {
+		c := s[j]
+		needsRepr = isSpace(c) || c == '"' || c == '\'' || c == '\\' || c < 0x20 || c > 0x7e
+	}
+	if !needsRepr {
+		return s
+	}
+
+	b := make([]byte, 0, len(s)+2)
+	b = append(b, '"')
+	for j := 0; j < len(s); j++ {
+		switch c := s[j]; c {
+		case '\\', '"':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case '\t':
+			b = append(b, '\\', 't')
+		case '\a':
+			b = append(b, '\\', 'a')
+		case '\b':
+			b = append(b, '\\', 'b')
+		default:
+			if c < 0x20 || c > 0x7e {
+				b = append(b, fmt.Sprintf("\\x%02x", c)...)
+			} else {
+				b = append(b, c)
+			}
+		}
+	}
+	return string(append(b, '"'))
+
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// digits10 returns the length of v printed in base 10.
+func digits10(v int64) int {
+	n := 1
+	if v < 0 {
+		n++
+		if v == math.MinInt64 {
+			return 20
+		}
+		v = -v
+	}
+	for ; v >= 10; v /= 10 {
+		n++
+	}
+	return n
+}
+
+// mstime returns the unix time in milliseconds.
+func mstime() int64 {
+	return time.Now().UnixMilli()
+}
+
+// stringmatch reports whether s matches the glob-style pattern, supporting
+// *, ?, [abc], [^abc], [a-z] and \ escapes like redis does.
+func stringmatch(pattern, s string, nocase bool) bool {
+
+	lower := func(b byte) byte {
+		if nocase && b >= 'A' && b <= 'Z' {
+			return b + 'a' - 'A'
+		}
+		return b
+	}
+
+	for len(pattern) > 0 && len(s) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for len(s) > 0 {
+				if stringmatch(pattern[1:], s, nocase) {
+					return true
+				}
+				s = s[1:]
+			}
+			return false
+		case '?':
+			s = s[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					if lower(pattern[0]) == lower(s[0]) {
+						match = true
+					}
+				case len(pattern) >= 3 && pattern[1] == '-':
+					start, end := lower(pattern[0]), lower(pattern[2])
+					if start > end {
+						start, end = end, start
+					}
+					pattern = pattern[2:]
+					if c := lower(s[0]); c >= start && c <= end {
+						match = true
+					}
+				default:
+					if lower(pattern[0]) == lower(s[0]) {
+						match = true
+					}
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				// unterminated class, the last character stays the ']'
+				pattern = "]"
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if lower(pattern[0]) != lower(s[0]) {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+
+	for len(pattern) > 0 && pattern[0] == '*' {
+		pattern = pattern[1:]
+	}
+	return len(pattern) == 0 && len(s) == 0
+
+}
@@ -51,12 +51,10 @@ func newPool(capacity int32) *workPool {
 	ctx, cancel := context.WithCancel(context.Background())
 	pool.workerCache = sync.Pool{
 		New: func() any {
-			w := &goWorker{pool: pool}
-			w.submitTask = make(chan func())
-			w.run()
-			return w
+			return &goWorker{pool: pool, submitTask: make(chan func())}
 		},
 	}
+	pool.now.Store(time.Now())
 	pool.stop = cancel
 	go pool.goPurgeStaleWorkers(ctx)
 	go pool.goTickTok(ctx)
@@ -160,15 +158,17 @@ func (pool *workPool) retrieveWorker() (*goWorker, error) {
 			return w, nil
 		}
 
-		if pool.capacity < pool.nRunning() {
+		// a cached worker is not running anymore, it is started again
+		if pool.nRunning() < pool.capacity {
 			pool.lock.Unlock()
 			w = pool.workerCache.Get().(*goWorker)
+			w.run()
 			return w, nil
 		}
 
-		pool.addRunning(1)
+		pool.addWaiting(1)
 		pool.cond.Wait()
-		pool.addRunning(-1)
+		pool.addWaiting(-1)
 
 		if pool.isClosed() {
 			pool.lock.Unlock()
@@ -189,7 +189,7 @@ func (pool *workPool) revertWorker(worker *goWorker) bool {
 	worker.lastUsed = pool.nowTime()
 
 	pool.lock.Lock()
-	if pool.capacity <= pool.nRunning() {
+	if pool.nRunning() > pool.capacity {
 		pool.lock.Unlock()
 		return false
 	}
@@ -330,7 +330,7 @@ func (q *stackWorkQueue) detach() *goWorker {
 func (q *stackWorkQueue) binarySearch(expiry time.Time) int {
 	l, r := 0, q.len()-1
 	for l <= r {
-		mid := l + (r-l)<<1
+		mid := l + (r-l)>>1
 		if q.items[mid].lastUsed.After(expiry) {
 			r = mid - 1
 		} else {
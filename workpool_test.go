@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWorkPool_SubmitTask(t *testing.T) {
+	pool := newPool(2)
+	defer func() {
+		_ = pool.release()
+	}()
+
+	var wg sync.WaitGroup
+	var done int32
+	for j := 0; j < 100; j++ {
+		wg.Add(1)
+		if err := pool.submitTask(func() {
+			atomic.AddInt32(&done, 1)
+			wg.Done()
+		}); err != nil {
+			t.Fatalf("submitTask error=%v", err)
+		}
+	}
+	wg.Wait()
+	if done != 100 {
+		t.Fatalf("want 100 tasks done, got %d", done)
+	}
+	if running := pool.nRunning(); running > 2 {
+		t.Fatalf("want at most 2 workers, got %d", running)
+	}
+
+	_ = pool.release()
+	if err := pool.submitTask(func() {}); err != errPoolClosed {
+		t.Fatalf("want errPoolClosed, got %v", err)
+	}
+}